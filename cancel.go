@@ -0,0 +1,111 @@
+package conduit
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// EOS is returned by conduits and consumers
+// that do not need more input, e.g. because they
+// have already seen the number of items they needed.
+// EOS is not reported as error. The chain cancels
+// all components upstream of the component returning EOS
+// and discards the data they still send.
+var EOS = errors.New("end of stream")
+
+// Canceler is implemented by components that can stop early.
+// Cancel is called concurrently with the running component,
+// which is expected to return as soon as possible.
+// Producers that are not Cancelers run to completion
+// even when nobody needs their data anymore.
+type Canceler interface {
+	Cancel()
+}
+
+// Cancelable implements Canceler and can be embedded
+// into components. Components check Canceled regularly,
+// e.g. before producing the next item.
+// The chain resets Cancelables before it runs.
+type Cancelable struct {
+	c int32
+}
+
+// Cancel marks the component as canceled.
+func (c *Cancelable) Cancel() {
+	atomic.StoreInt32(&c.c, 1)
+}
+
+// Canceled tells whether the component was canceled.
+func (c *Cancelable) Canceled() bool {
+	return atomic.LoadInt32(&c.c) != 0
+}
+
+func (c *Cancelable) resetCancel() {
+	atomic.StoreInt32(&c.c, 0)
+}
+
+// implemented by Cancelable
+type resetter interface {
+	resetCancel()
+}
+
+// ResetCancel resets the cancellation of comp,
+// if comp embeds Cancelable. The chain does so
+// for its components before it runs; components that
+// run other components call it for those.
+func ResetCancel(comp interface{}) {
+	if r, ok := comp.(resetter); ok {
+		r.resetCancel()
+	}
+}
+
+// Cancel stops the chain by canceling all components
+// that are Cancelers. Components that are no Cancelers
+// terminate when their input is exhausted.
+// Data still sent by canceled components are discarded;
+// Run returns when all components have terminated.
+func (ch *Chain) Cancel() {
+	ch.cancel(len(ch.pipe) + 1)
+}
+
+// Cancels the producer and the first n-1 conduits
+func (ch *Chain) cancel(n int) {
+	atomic.StoreInt32(&ch.stop, 1)
+	for i, comp := range ch.components() {
+		if i >= n {
+			break
+		}
+		if c, ok := comp.(Canceler); ok {
+			c.Cancel()
+		}
+	}
+}
+
+// Tells whether the chain was canceled
+func (ch *Chain) canceled() bool {
+	return atomic.LoadInt32(&ch.stop) != 0
+}
+
+// Resets all Cancelables of the chain
+func (ch *Chain) resetCancel() {
+	atomic.StoreInt32(&ch.stop, 0)
+	for _, comp := range ch.components() {
+		ResetCancel(comp)
+	}
+}
+
+// producer, conduits, consumer
+func (ch *Chain) components() []interface{} {
+	comps := make([]interface{}, 0, len(ch.pipe)+2)
+	comps = append(comps, ch.p)
+	for _, p := range ch.pipe {
+		comps = append(comps, p)
+	}
+	return append(comps, ch.c)
+}
+
+// Discards the data left in src
+func drain(src Source) {
+	for range src {
+	}
+}
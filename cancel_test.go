@@ -0,0 +1,122 @@
+package conduit
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Produces 0, 1, 2, ... until canceled
+type InfProducer struct {
+	Cancelable
+	n int
+}
+
+func (p *InfProducer) Produce(trg Target) error {
+	p.n = 0
+	for !p.Canceled() {
+		trg <- p.n
+		p.n++
+	}
+	return nil
+}
+
+// Passes n items and returns EOS
+type TakeConduit struct {
+	n int
+}
+
+func (c *TakeConduit) Conduct(src Source, trg Target) error {
+	i := 0
+	for v := range src {
+		if i >= c.n {
+			return EOS
+		}
+		trg <- v
+		if !IsBarrier(v) {
+			i++
+		}
+	}
+	return nil
+}
+
+// Cancels the chain after n items
+type CancelConsumer struct {
+	BaseConsumer
+	chn *Chain
+	n   int
+}
+
+func (c *CancelConsumer) Consume(src Source) error {
+	for v := range src {
+		if IsBarrier(v) {
+			continue
+		}
+		c.recvd = append(c.recvd, v.(int))
+		if len(c.recvd) == c.n {
+			c.chn.Cancel()
+		}
+	}
+	return nil
+}
+
+// EOS:
+// - It is not reported as error
+// - The producer is canceled and Run returns
+// - With checkpoints, too
+// - The chain can be run again
+func TestEOS(t *testing.T) {
+	for i := 0; i < numOfTests; i++ {
+		err := testEOS(i, i%2 == 0)
+		if err != nil {
+			m := fmt.Sprintf("EOS failed: %v", err)
+			t.Error(m)
+		}
+	}
+}
+
+func testEOS(n int, cp bool) error {
+	p := new(InfProducer)
+	c := &CancelConsumer{n: -1}
+	chn := NewChain(p, []Conduit{new(BaseConduit), &TakeConduit{n}}, c, small)
+	for k := 0; k < 2; k++ {
+		c.recvd = nil
+		// a fresh store, otherwise the chain resumes
+		if cp {
+			chn.SetCheckpoints(time.Microsecond, NewMemCheckpoints())
+		}
+		err := chn.Run()
+		if err != nil {
+			m := fmt.Sprintf("error on running chain: %v", chn.Errs)
+			return errors.New(m)
+		}
+		if len(c.recvd) != n {
+			m := fmt.Sprintf("expected %d items, have %d", n, len(c.recvd))
+			return errors.New(m)
+		}
+		for i := range c.recvd {
+			if c.recvd[i] != i {
+				return errors.New("Received values differ from original!")
+			}
+		}
+	}
+	return nil
+}
+
+// Cancel:
+// - The producer is canceled
+// - Run returns without errors
+func TestCancel(t *testing.T) {
+	p := new(InfProducer)
+	c := &CancelConsumer{n: numOfData}
+	chn := NewChain(p, []Conduit{new(BaseConduit)}, c, small)
+	c.chn = chn
+	err := chn.Run()
+	if err != nil {
+		t.Fatalf("Cancel failed: %v", chn.Errs)
+	}
+	if len(c.recvd) < numOfData || len(c.recvd) != p.n {
+		t.Errorf("Cancel: %d items produced, %d received", p.n, len(c.recvd))
+	}
+}
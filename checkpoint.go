@@ -0,0 +1,463 @@
+package conduit
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Barrier is injected into the processing chain
+// when checkpointing is enabled (see Chain.SetCheckpoints).
+// Conduits must pass barriers on unchanged
+// after having processed all data received before the barrier;
+// consumers must ignore them.
+// The components provided by this library do so.
+type Barrier struct {
+	ID uint64
+}
+
+// IsBarrier tells whether an incoming datum is a Barrier.
+func IsBarrier(inp interface{}) bool {
+	_, ok := inp.(*Barrier)
+	return ok
+}
+
+// Checkpointer is implemented by components
+// whose state shall be included in checkpoints.
+// Snapshot is called when the component has processed
+// all data before a barrier and waits for more input;
+// Restore is called before the chain runs
+// with the state of the latest checkpoint.
+type Checkpointer interface {
+	Snapshot() ([]byte, error)
+	Restore([]byte) error
+}
+
+// Resumer is implemented by producers
+// that can resume production at a given position,
+// i.e. after having produced pos items.
+// The chain restores producers that are not Resumers
+// by discarding the first pos items they produce,
+// which is correct only for producers that produce
+// the same items in the same order on each run.
+// Producers of live data, which cannot be replayed,
+// are Resumers that skip nothing.
+type Resumer interface {
+	Resume(pos uint64) error
+}
+
+// Committer is implemented by components that shall be notified
+// when a checkpoint was saved, e.g. producers that acknowledge
+// the messages they received from a queue only when
+// the whole chain has processed them.
+// Commit is called with the saved checkpoint,
+// concurrently with the processing of the component;
+// all items produced before cp.Position have been consumed.
+type Committer interface {
+	Commit(cp *Checkpoint) error
+}
+
+// Stateful is implemented by components that keep
+// their state in the StateStore of the chain.
+// Before the chain runs, it passes its store
+// and the name of the stage to each Stateful component.
+type Stateful interface {
+	SetState(st StateStore, stage string)
+}
+
+// Volatile is implemented by components that keep state
+// between items, e.g. open windows or running aggregates,
+// which they cannot include in checkpoints.
+// Since that state would be lost on restore, chains
+// with checkpointing refuse to run with components
+// whose Volatile method returns true.
+type Volatile interface {
+	Volatile() bool
+}
+
+// Checkpoint is a snapshot of a running chain.
+// Position is the number of items produced
+// before the checkpoint barrier.
+// States holds the snapshots of all Checkpointers by stage name;
+// Store holds the contents of the chain's StateStore.
+type Checkpoint struct {
+	ID       uint64
+	Time     time.Time
+	Position uint64
+	States   map[string][]byte
+	Store    map[string]map[string][]byte
+}
+
+// CheckpointStore is a backend where checkpoints are kept.
+type CheckpointStore interface {
+	// Save stores a checkpoint
+	Save(cp *Checkpoint) error
+
+	// Latest returns the latest checkpoint
+	// or nil if there is none.
+	Latest() (*Checkpoint, error)
+}
+
+// MemCheckpoints is a CheckpointStore
+// that keeps the latest checkpoint in memory.
+type MemCheckpoints struct {
+	door sync.Mutex
+	cp   *Checkpoint
+}
+
+// NewMemCheckpoints creates a new MemCheckpoints.
+func NewMemCheckpoints() *MemCheckpoints {
+	return new(MemCheckpoints)
+}
+
+// Save implements CheckpointStore.
+func (m *MemCheckpoints) Save(cp *Checkpoint) error {
+	m.door.Lock()
+	defer m.door.Unlock()
+	m.cp = cp
+	return nil
+}
+
+// Latest implements CheckpointStore.
+func (m *MemCheckpoints) Latest() (*Checkpoint, error) {
+	m.door.Lock()
+	defer m.door.Unlock()
+	return m.cp, nil
+}
+
+// FileCheckpoints is a CheckpointStore
+// that keeps the latest checkpoint in a file.
+// The file is replaced atomically on each Save.
+type FileCheckpoints struct {
+	door sync.Mutex
+	path string
+}
+
+// NewFileCheckpoints creates a new FileCheckpoints
+// that stores checkpoints in the file path.
+func NewFileCheckpoints(path string) *FileCheckpoints {
+	f := new(FileCheckpoints)
+	f.path = path
+	return f
+}
+
+// Save implements CheckpointStore.
+func (f *FileCheckpoints) Save(cp *Checkpoint) error {
+	f.door.Lock()
+	defer f.door.Unlock()
+
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), "tmp-*")
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(tmp).Encode(cp)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	cerr := tmp.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
+
+// Latest implements CheckpointStore.
+func (f *FileCheckpoints) Latest() (*Checkpoint, error) {
+	f.door.Lock()
+	defer f.door.Unlock()
+
+	file, err := os.Open(f.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	cp := new(Checkpoint)
+	err = gob.NewDecoder(file).Decode(cp)
+	if err != nil {
+		return nil, err
+	}
+	return cp, nil
+}
+
+// SetStateStore defines the StateStore
+// that is passed to Stateful components
+// and included in checkpoints.
+func (ch *Chain) SetStateStore(st StateStore) {
+	ch.store = st
+}
+
+// SetCheckpoints enables checkpointing:
+// while the chain is running, every interval
+// a barrier is injected after the data produced so far;
+// when the barrier has passed all conduits
+// and reached the consumer, a checkpoint is saved to cps.
+// Production is paused in the meantime.
+// Before the chain runs, the latest checkpoint found in cps
+// is restored. If interval is not positive, the latest
+// checkpoint is restored, but no new checkpoints are taken.
+func (ch *Chain) SetCheckpoints(interval time.Duration, cps CheckpointStore) {
+	ch.every = interval
+	ch.cps = cps
+}
+
+// name of the stage of a component
+func stageName(kind string, i int) string {
+	if i < 0 {
+		return kind
+	}
+	return fmt.Sprintf("%s/%d", kind, i)
+}
+
+// all components of the chain by stage name
+func (ch *Chain) stages() map[string]interface{} {
+	m := make(map[string]interface{}, len(ch.pipe)+2)
+	m[stageName("producer", -1)] = ch.p
+	for i, p := range ch.pipe {
+		m[stageName("conduit", i)] = p
+	}
+	m[stageName("consumer", -1)] = ch.c
+	return m
+}
+
+// passes the state store to all Stateful components
+// and restores the latest checkpoint;
+// returns the number of items to skip.
+func (ch *Chain) prepare() (uint64, error) {
+	if ch.store != nil {
+		for name, c := range ch.stages() {
+			if s, ok := c.(Stateful); ok {
+				s.SetState(ch.store, name)
+			}
+		}
+	}
+	ch.pos = 0
+	if ch.cps == nil {
+		return 0, nil
+	}
+	for name, c := range ch.stages() {
+		if v, ok := c.(Volatile); ok && v.Volatile() {
+			s := fmt.Sprintf("cannot checkpoint %s: its state would be lost", name)
+			return 0, errors.New(s)
+		}
+	}
+	cp, err := ch.cps.Latest()
+	if err != nil {
+		return 0, err
+	}
+	if cp == nil {
+		return 0, nil
+	}
+	ch.cpid = cp.ID
+	ch.pos = cp.Position
+	if ch.store != nil {
+		err = restoreStore(ch.store, cp.Store)
+		if err != nil {
+			return 0, err
+		}
+	}
+	for name, c := range ch.stages() {
+		if k, ok := c.(Checkpointer); ok {
+			state, ok := cp.States[name]
+			if !ok {
+				continue
+			}
+			err = k.Restore(state)
+			if err != nil {
+				s := fmt.Sprintf("cannot restore %s: %v", name, err)
+				return 0, errors.New(s)
+			}
+		}
+	}
+	if r, ok := ch.p.(Resumer); ok {
+		return 0, r.Resume(cp.Position)
+	}
+	return cp.Position, nil
+}
+
+// replaces the contents of a state store
+func restoreStore(st StateStore, snap map[string]map[string][]byte) error {
+	if r, ok := st.(Replacer); ok {
+		return r.Replace(snap)
+	}
+	stages, err := st.Stages()
+	if err != nil {
+		return err
+	}
+	for _, stage := range stages {
+		err = st.Iterate(stage, func(key string, _ []byte) error {
+			return st.Delete(stage, key)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for stage, kvs := range snap {
+		for k, v := range kvs {
+			err = st.Put(stage, k, v)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// copies the contents of a state store
+func snapshotStore(st StateStore) (map[string]map[string][]byte, error) {
+	snap := make(map[string]map[string][]byte)
+	stages, err := st.Stages()
+	if err != nil {
+		return nil, err
+	}
+	for _, stage := range stages {
+		kvs := make(map[string][]byte)
+		err = st.Iterate(stage, func(key string, val []byte) error {
+			kvs[key] = val
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		snap[stage] = kvs
+	}
+	return snap, nil
+}
+
+// takes a checkpoint; all components are idle.
+func (ch *Chain) checkpoint() error {
+	cp := &Checkpoint{
+		ID:       ch.cpid,
+		Time:     time.Now(),
+		Position: ch.pos,
+		States:   make(map[string][]byte),
+	}
+	for name, c := range ch.stages() {
+		if name == stageName("producer", -1) {
+			continue
+		}
+		if k, ok := c.(Checkpointer); ok {
+			state, err := k.Snapshot()
+			if err != nil {
+				s := fmt.Sprintf("cannot snapshot %s: %v", name, err)
+				return errors.New(s)
+			}
+			cp.States[name] = state
+		}
+	}
+	if ch.store != nil {
+		snap, err := snapshotStore(ch.store)
+		if err != nil {
+			return err
+		}
+		cp.Store = snap
+	}
+	err := ch.cps.Save(cp)
+	if err != nil {
+		return err
+	}
+	for name, c := range ch.stages() {
+		if k, ok := c.(Committer); ok {
+			err = k.Commit(cp)
+			if err != nil {
+				s := fmt.Sprintf("cannot commit %s: %v", name, err)
+				return errors.New(s)
+			}
+		}
+	}
+	return nil
+}
+
+// sits between producer and pipe:
+// counts and skips produced items and injects barriers.
+func (ch *Chain) inject(src Source, trg chan interface{}, acks <-chan uint64, quit <-chan struct{}, skip uint64) {
+	defer close(trg)
+	defer func() {
+		if ch.canceled() {
+			drain(src)
+		}
+	}()
+
+	var tick <-chan time.Time
+	if ch.every > 0 {
+		t := time.NewTicker(ch.every)
+		defer t.Stop()
+		tick = t.C
+	}
+
+	cping := true
+	for {
+		select {
+		case inp, ok := <-src:
+			if !ok {
+				return
+			}
+			if skip > 0 {
+				skip--
+				continue
+			}
+			select {
+			case trg <- inp:
+				ch.pos++
+			case <-quit:
+				return
+			}
+		case <-tick:
+			if !cping {
+				continue
+			}
+			ch.cpid++
+			select {
+			case trg <- &Barrier{ID: ch.cpid}:
+			case <-quit:
+				return
+			}
+			select {
+			case _, ok := <-acks:
+				if !ok {
+					cping = false
+					continue
+				}
+			case <-quit:
+				return
+			}
+			err := ch.checkpoint()
+			if err != nil {
+				ch.addErr(err)
+			}
+		}
+	}
+}
+
+// sits between pipe and consumer:
+// acknowledges barriers received by the consumer.
+func (ch *Chain) collect(src Source, trg chan interface{}, acks chan<- uint64, quit <-chan struct{}) {
+	defer close(acks)
+	defer close(trg)
+
+	for inp := range src {
+		select {
+		case trg <- inp:
+		case <-quit:
+			return
+		}
+		if b, ok := inp.(*Barrier); ok {
+			select {
+			case acks <- b.ID:
+			case <-quit:
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,363 @@
+package conduit
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Produces 0..max-1 slowly
+type SlowProducer struct {
+	max int
+}
+
+func (p *SlowProducer) Produce(trg Target) error {
+	for i := 0; i < p.max; i++ {
+		if i%10 == 0 {
+			time.Sleep(100 * time.Microsecond)
+		}
+		trg <- i
+	}
+	return nil
+}
+
+// Counts items, keeps the count as checkpointed state
+// and the sum in the state store.
+type CountConduit struct {
+	count int
+	st    StateStore
+	stage string
+}
+
+func (c *CountConduit) Conduct(src Source, trg Target) error {
+	for v := range src {
+		if IsBarrier(v) {
+			trg <- v
+			continue
+		}
+		c.count++
+		sum := 0
+		b, err := c.st.Get(c.stage, "sum")
+		if err == nil {
+			sum, _ = strconv.Atoi(string(b))
+		}
+		sum += v.(int)
+		err = c.st.Put(c.stage, "sum", []byte(strconv.Itoa(sum)))
+		if err != nil {
+			return err
+		}
+		trg <- v
+	}
+	return nil
+}
+
+func (c *CountConduit) Snapshot() ([]byte, error) {
+	return []byte(strconv.Itoa(c.count)), nil
+}
+
+func (c *CountConduit) Restore(b []byte) error {
+	n, err := strconv.Atoi(string(b))
+	c.count = n
+	return err
+}
+
+func (c *CountConduit) SetState(st StateStore, stage string) {
+	c.st = st
+	c.stage = stage
+}
+
+// Ignores changes after a crash
+type CrashStore struct {
+	StateStore
+	door    sync.Mutex
+	crashed bool
+}
+
+func (s *CrashStore) crash() {
+	s.door.Lock()
+	defer s.door.Unlock()
+	s.crashed = true
+}
+
+func (s *CrashStore) Put(stage, key string, val []byte) error {
+	s.door.Lock()
+	defer s.door.Unlock()
+	if s.crashed {
+		return nil
+	}
+	return s.StateStore.Put(stage, key, val)
+}
+
+// Fails after max items
+type CrashConsumer struct {
+	max   int
+	st    *CrashStore
+	recvd []int
+}
+
+func (c *CrashConsumer) Consume(src Source) error {
+	for v := range src {
+		if IsBarrier(v) {
+			continue
+		}
+		if c.max > 0 && len(c.recvd) == c.max {
+			c.st.crash()
+			return errors.New("crash")
+		}
+		c.recvd = append(c.recvd, v.(int))
+	}
+	return nil
+}
+
+// Chain with checkpointing:
+// - It is processed without errors
+// - All data are received in order
+// - Checkpoints are taken
+func TestCheckpointChain(t *testing.T) {
+	for i := 0; i < numOfTests/10; i++ {
+		err := testCheckpointChain(medium)
+		if err != nil {
+			m := fmt.Sprintf("CheckpointChain failed: %v", err)
+			t.Error(m)
+		}
+	}
+}
+
+// Chain that crashes and is restarted:
+// - The restarted chain resumes after the latest checkpoint
+// - State of stateful components is restored
+func TestCheckpointRestore(t *testing.T) {
+	for i := 0; i < numOfTests/10; i++ {
+		err := testCheckpointRestore(medium, t.TempDir())
+		if err != nil {
+			m := fmt.Sprintf("CheckpointRestore failed: %v", err)
+			t.Error(m)
+		}
+	}
+}
+
+func testCheckpointChain(n int) error {
+
+	p := &SlowProducer{n}
+	cnt := new(CountConduit)
+	c := new(CrashConsumer)
+
+	chn := NewChain(p, []Conduit{new(BaseConduit), cnt}, c, small)
+	cps := NewMemCheckpoints()
+	chn.SetStateStore(NewMemStore())
+	chn.SetCheckpoints(time.Millisecond, cps)
+
+	err := chn.Run()
+	if err != nil {
+		m := fmt.Sprintf("error on running chain: %v", chn.Errs)
+		return errors.New(m)
+	}
+	if len(c.recvd) != n {
+		m := fmt.Sprintf("expected %d items, have %d", n, len(c.recvd))
+		return errors.New(m)
+	}
+	for i := 0; i < n; i++ {
+		if c.recvd[i] != i {
+			return errors.New("Received values differ from original!")
+		}
+	}
+	cp, _ := cps.Latest()
+	if cp == nil {
+		return errors.New("no checkpoint taken")
+	}
+	if string(cp.States["conduit/1"]) != strconv.Itoa(int(cp.Position)) {
+		m := fmt.Sprintf("checkpoint at %d has count %s",
+			cp.Position, cp.States["conduit/1"])
+		return errors.New(m)
+	}
+	return nil
+}
+
+func testCheckpointRestore(n int, dir string) error {
+
+	cps := NewFileCheckpoints(filepath.Join(dir, "checkpoint"))
+	fs, err := NewFileStore(filepath.Join(dir, "state"))
+	if err != nil {
+		return err
+	}
+	cs := &CrashStore{StateStore: fs}
+
+	p := &SlowProducer{n}
+	cnt := new(CountConduit)
+	c := &CrashConsumer{max: n / 2, st: cs}
+
+	chn := NewChain(p, []Conduit{cnt}, c, small)
+	chn.SetStateStore(cs)
+	chn.SetCheckpoints(time.Millisecond, cps)
+
+	err = chn.Run()
+	if err == nil {
+		return errors.New("chain did not crash")
+	}
+	cp, err := cps.Latest()
+	if err != nil {
+		return err
+	}
+	if cp == nil {
+		return errors.New("no checkpoint taken")
+	}
+
+	// restart
+	st, err := NewFileStore(filepath.Join(dir, "state"))
+	if err != nil {
+		return err
+	}
+	cnt = new(CountConduit)
+	c = new(CrashConsumer)
+	chn = NewChain(p, []Conduit{cnt}, c, small)
+	chn.SetStateStore(st)
+	chn.SetCheckpoints(time.Millisecond, cps)
+
+	err = chn.Run()
+	if err != nil {
+		m := fmt.Sprintf("error on running chain: %v", chn.Errs)
+		return errors.New(m)
+	}
+	if len(c.recvd) != n-int(cp.Position) {
+		m := fmt.Sprintf("expected %d items, have %d", n-int(cp.Position), len(c.recvd))
+		return errors.New(m)
+	}
+	for i, v := range c.recvd {
+		if v != int(cp.Position)+i {
+			return errors.New("Received values differ from original!")
+		}
+	}
+	if cnt.count != n {
+		m := fmt.Sprintf("expected count %d, have %d", n, cnt.count)
+		return errors.New(m)
+	}
+	b, err := st.Get("conduit/0", "sum")
+	if err != nil {
+		return err
+	}
+	if string(b) != strconv.Itoa(n*(n-1)/2) {
+		m := fmt.Sprintf("expected sum %d, have %s", n*(n-1)/2, b)
+		return errors.New(m)
+	}
+	return nil
+}
+
+// Producer that records the checkpoints it is notified of
+// together with the number of items consumed at that time
+type CommitProducer struct {
+	SlowProducer
+	door    sync.Mutex
+	c       *CountConsumer
+	commits [][2]uint64
+}
+
+func (p *CommitProducer) Commit(cp *Checkpoint) error {
+	p.door.Lock()
+	defer p.door.Unlock()
+	p.commits = append(p.commits, [2]uint64{cp.Position, p.c.count()})
+	return nil
+}
+
+// Counts the items it consumes
+type CountConsumer struct {
+	door sync.Mutex
+	n    uint64
+}
+
+func (c *CountConsumer) Consume(src Source) error {
+	for v := range src {
+		if IsBarrier(v) {
+			continue
+		}
+		c.door.Lock()
+		c.n++
+		c.door.Unlock()
+	}
+	return nil
+}
+
+func (c *CountConsumer) count() uint64 {
+	c.door.Lock()
+	defer c.door.Unlock()
+	return c.n
+}
+
+// Committers:
+// - Committers are notified after each checkpoint
+// - All items before the checkpoint position have been consumed
+func TestCheckpointCommit(t *testing.T) {
+	for i := 0; i < numOfTests/10; i++ {
+		err := testCheckpointCommit(medium)
+		if err != nil {
+			m := fmt.Sprintf("CheckpointCommit failed: %v", err)
+			t.Error(m)
+		}
+	}
+}
+
+func testCheckpointCommit(n int) error {
+	c := new(CountConsumer)
+	p := &CommitProducer{SlowProducer: SlowProducer{n}, c: c}
+	cps := NewMemCheckpoints()
+	chn := NewChain(p, []Conduit{new(BaseConduit)}, c, small)
+	chn.SetCheckpoints(time.Millisecond, cps)
+	err := chn.Run()
+	if err != nil {
+		m := fmt.Sprintf("error on running chain: %v", chn.Errs)
+		return errors.New(m)
+	}
+	if len(p.commits) == 0 {
+		return errors.New("no checkpoint committed")
+	}
+	var last uint64
+	for _, cm := range p.commits {
+		if cm[0] < last || cm[0] > cm[1] {
+			m := fmt.Sprintf("commit at %d with %d items consumed", cm[0], cm[1])
+			return errors.New(m)
+		}
+		last = cm[0]
+	}
+	cp, _ := cps.Latest()
+	if cp.Position != last {
+		m := fmt.Sprintf("latest checkpoint at %d, last commit at %d", cp.Position, last)
+		return errors.New(m)
+	}
+	return nil
+}
+
+// Conduit that keeps state it cannot checkpoint
+type VolatileConduit struct {
+	BaseConduit
+}
+
+func (c *VolatileConduit) Volatile() bool {
+	return true
+}
+
+// Volatile components:
+// - A chain with checkpointing refuses to run
+// - A chain without checkpointing runs
+func TestCheckpointVolatile(t *testing.T) {
+	c := new(CountConsumer)
+	chn := NewChain(&SlowProducer{small}, []Conduit{new(VolatileConduit)}, c, small)
+	chn.SetCheckpoints(time.Millisecond, NewMemCheckpoints())
+	err := chn.Run()
+	if err == nil {
+		t.Error("chain with volatile conduit was checkpointed")
+	}
+	if c.count() != 0 {
+		t.Errorf("expected no items, have %d", c.count())
+	}
+	chn = NewChain(&SlowProducer{small}, []Conduit{new(VolatileConduit)}, c, small)
+	err = chn.Run()
+	if err != nil {
+		t.Errorf("error on running chain: %v", chn.Errs)
+	}
+	if c.count() != small {
+		t.Errorf("expected %d items, have %d", small, c.count())
+	}
+}
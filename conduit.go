@@ -24,6 +24,7 @@ import (
 	"errors"
 	"fmt"
 	"sync"
+	"time"
 )
 
 // Source is an input channel
@@ -62,6 +63,14 @@ type Chain struct {
 	p     Producer
 	c     Consumer
 	pipe  []Conduit
+	store StateStore      // state of stateful components
+	cps   CheckpointStore // where checkpoints go
+	every time.Duration   // checkpoint interval
+	pos   uint64          // items produced
+	cpid  uint64          // latest checkpoint
+	sides []*side         // side outputs
+	run   sync.WaitGroup  // running producer and conduits
+	stop  int32           // chain was canceled
 	Errs  []error
 }
 
@@ -69,6 +78,7 @@ type Chain struct {
 func (ch *Chain) reset() {
 	ch.Errs = nil
 	ch.e = false
+	ch.resetCancel()
 }
 
 // Adds an error to the processing chain.
@@ -83,11 +93,17 @@ func (ch *Chain) addErr(err error) {
 	ch.Errs = append(ch.Errs, err)
 }
 
-// Runs one conduit
-func (ch *Chain) pipe2pipe(src Source, trg Target, p Conduit) {
+// Runs the conduit at position i
+func (ch *Chain) pipe2pipe(src Source, trg Target, i int) {
+	defer ch.run.Done()
 	defer close(trg)
+	p := ch.pipe[i]
+	defer ch.closeSides(p)
 	err := p.Conduct(src, trg)
-	if err != nil {
+	if err == EOS {
+		ch.cancel(i + 1)
+		go drain(src)
+	} else if err != nil {
 		ch.addErr(err)
 	}
 }
@@ -97,14 +113,15 @@ func (ch *Chain) runPipe(c0 chan interface{}) (ret chan interface{}, err error)
 	ret = c0
 	src := c0
 
-	for _, p := range ch.pipe {
+	for i := range ch.pipe {
 		trg := make(chan interface{}, ch.sz)
 		if trg == nil {
 			s := fmt.Sprintf("cannot create channel\n")
 			err = errors.New(s)
 			break
 		}
-		go ch.pipe2pipe(src, trg, p)
+		ch.run.Add(1)
+		go ch.pipe2pipe(src, trg, i)
 		src, ret = trg, trg
 	}
 	return
@@ -115,15 +132,39 @@ func (ch *Chain) runPipe(c0 chan interface{}) (ret chan interface{}, err error)
 // Run terminates with an error.
 // Errors that were reported by faulty components
 // are written to Errs and can be inspected afterwards.
+// If a component returned EOS or the chain was canceled,
+// Run returns only when all components have terminated.
 func (ch *Chain) Run() error {
 
 	ch.reset()
 
+	skip, err := ch.prepare()
+	if err != nil {
+		s := fmt.Sprintf("cannot prepare chain: %v\n", err)
+		return errors.New(s)
+	}
+
 	c1 := make(chan interface{}, ch.sz)
 	if c1 == nil {
 		s := fmt.Sprintf("cannot create channel\n")
 		return errors.New(s)
 	}
+	c0 := c1
+
+	// checkpointing: c0 -> inject -> c1 ... c2 -> collect -> c3
+	var acks chan uint64
+	quit := make(chan struct{})
+	var once sync.Once
+	stop := func() { once.Do(func() { close(quit) }) }
+	defer stop()
+	if ch.cps != nil {
+		c0 = make(chan interface{}, ch.sz)
+		acks = make(chan uint64)
+		go ch.inject(c0, c1, acks, quit, skip)
+	}
+
+	var sides sync.WaitGroup
+	ch.startSides(&sides)
 
 	c2, err := ch.runPipe(c1)
 	if err != nil {
@@ -131,18 +172,46 @@ func (ch *Chain) Run() error {
 		return errors.New(s)
 	}
 
+	if acks != nil {
+		c3 := make(chan interface{})
+		go ch.collect(c2, c3, acks, quit)
+		c2 = c3
+	}
+
+	ch.run.Add(1)
 	go func() {
-		defer close(c1)
-		perr := ch.p.Produce(c1)
-		if perr != nil {
+		defer ch.run.Done()
+		defer close(c0)
+		defer ch.closeSides(ch.p)
+		perr := ch.p.Produce(c0)
+		if perr != nil && perr != EOS {
 			ch.addErr(perr)
 		}
 	}()
 
 	cerr := ch.c.Consume(c2)
-	if cerr != nil {
+	if cerr == EOS {
+		ch.cancel(len(ch.pipe) + 1)
+		go drain(c2)
+	} else if cerr != nil {
 		ch.addErr(cerr)
 	}
+	ch.closeSides(ch.c)
+
+	// side consumers wait for upstream components
+	if len(ch.sides) > 0 {
+		go func() {
+			for range c2 {
+			}
+		}()
+		sides.Wait()
+	}
+
+	// canceled components are drained until they terminate
+	if ch.canceled() {
+		stop()
+		ch.run.Wait()
+	}
 	if (ch.e) {
 		return errors.New("Errors occurred")
 	}
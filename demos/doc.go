@@ -9,4 +9,7 @@
 //
 // - primes.go: uses a filter to implement
 // the Sieve of Eratosthenes.
+//
+// - tcpecho.go: the echo server as a TCP server
+// serving each connection with a chain of its own.
 package demos
@@ -76,6 +76,6 @@ func main() {
 	chn := conduit.NewChain(cnt, pipe, prn, 10)
 	err := chn.Run()
 	if err != nil {
-		fmt.Printf("%v: %v\n", chn.Errs)
+		fmt.Printf("%v: %v\n", err, chn.Errs)
 	}
 }
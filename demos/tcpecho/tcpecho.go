@@ -0,0 +1,27 @@
+// The echo server as a TCP server:
+// each connection is served by a chain of its own
+// that writes back what it reads, e.g.
+// go run tcpecho.go -addr :7007 and nc localhost 7007.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"github.com/toschoo/conduit"
+	cutils "github.com/toschoo/conduit/utils"
+)
+
+func main() {
+	addr := flag.String("addr", ":7007", "address to listen on")
+	flag.Parse()
+	srv := cutils.NewTCPChainServer(func(net.Conn) []conduit.Conduit {
+		return []conduit.Conduit{cutils.NewUtf8Conduit()}
+	})
+	err := srv.ListenAndServe(*addr)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,29 @@
+package conduit
+
+import (
+	"sync"
+)
+
+// Merge interleaves data from all srcs into one Source.
+// Data are forwarded as they arrive, so no source
+// is starved by another; the order of data
+// from the same source is preserved.
+// The returned Source is closed when all srcs are closed.
+func Merge(srcs ...Source) Source {
+	trg := make(chan interface{})
+	var wg sync.WaitGroup
+	wg.Add(len(srcs))
+	for _, src := range srcs {
+		go func(src Source) {
+			defer wg.Done()
+			for inp := range src {
+				trg <- inp
+			}
+		}(src)
+	}
+	go func() {
+		wg.Wait()
+		close(trg)
+	}()
+	return trg
+}
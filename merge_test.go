@@ -0,0 +1,59 @@
+package conduit
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// Merge:
+// - All data of all sources arrive
+// - The order per source is preserved
+// - The merged source is closed when all sources are closed
+func TestMerge(t *testing.T) {
+	for i := 0; i < numOfTests; i++ {
+		err := testMerge(numOfData, 1+i%5)
+		if err != nil {
+			m := fmt.Sprintf("Merge failed: %v", err)
+			t.Error(m)
+		}
+	}
+}
+
+func testMerge(n, k int) error {
+	srcs := make([]Source, k)
+	for i := 0; i < k; i++ {
+		ch := make(chan interface{}, i)
+		srcs[i] = ch
+		go func(i int) {
+			defer close(ch)
+			for j := 0; j < n; j++ {
+				ch <- [2]int{i, j}
+			}
+		}(i)
+	}
+	next := make([]int, k)
+	for v := range Merge(srcs...) {
+		x := v.([2]int)
+		if x[1] != next[x[0]] {
+			m := fmt.Sprintf("source %d: expected %d, have %d", x[0], next[x[0]], x[1])
+			return errors.New(m)
+		}
+		next[x[0]]++
+	}
+	for i := range next {
+		if next[i] != n {
+			m := fmt.Sprintf("source %d: expected %d items, have %d", i, n, next[i])
+			return errors.New(m)
+		}
+	}
+	return nil
+}
+
+// Merge without sources:
+// - The merged source is closed immediately
+func TestMergeEmpty(t *testing.T) {
+	for range Merge() {
+		t.Errorf("MergeEmpty: unexpected data")
+	}
+}
@@ -0,0 +1,93 @@
+package conduit
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// SideOutputter is implemented by components that emit data
+// to named side outputs in addition to their main target,
+// e.g. "rejected" for items a filter does not pass or "late"
+// for items that arrive too late for a window.
+// Before the chain runs, it passes a target to the component
+// for each side output connected with Chain.AddSide.
+// The component must not close side targets;
+// the chain closes them when the component terminates.
+// Components shall ignore side outputs for which
+// they have not received a target.
+type SideOutputter interface {
+	SideOutput(name string, trg Target)
+}
+
+// side is a side output connected to a consumer
+type side struct {
+	comp SideOutputter
+	name string
+	c    Consumer
+	trg  chan interface{}
+}
+
+// AddSide connects the side output name of comp,
+// which must be the producer, a conduit or the consumer of the chain
+// and must occur only once in the chain, to consumer c. Run starts c together with the chain
+// and waits for it to terminate; its errors are reported in Errs.
+func (ch *Chain) AddSide(comp SideOutputter, name string, c Consumer) error {
+	if comp == nil || c == nil {
+		return errors.New("side output without component or consumer")
+	}
+	if !reflect.TypeOf(comp).Comparable() {
+		s := fmt.Sprintf("component %T cannot be identified", comp)
+		return errors.New(s)
+	}
+	switch ch.occurrences(comp) {
+	case 0:
+		s := fmt.Sprintf("component %T is not part of the chain", comp)
+		return errors.New(s)
+	case 1:
+	default:
+		s := fmt.Sprintf("component %T occurs more than once in the chain", comp)
+		return errors.New(s)
+	}
+	ch.sides = append(ch.sides, &side{comp: comp, name: name, c: c})
+	return nil
+}
+
+// Counts how often comp occurs in the chain
+func (ch *Chain) occurrences(comp interface{}) int {
+	n := 0
+	for _, c := range ch.components() {
+		if comp == c {
+			n++
+		}
+	}
+	return n
+}
+
+// Starts all side consumers
+func (ch *Chain) startSides(wg *sync.WaitGroup) {
+	for _, s := range ch.sides {
+		s.trg = make(chan interface{}, ch.sz)
+		s.comp.SideOutput(s.name, s.trg)
+		wg.Add(1)
+		go func(s *side) {
+			defer wg.Done()
+			err := s.c.Consume(s.trg)
+			if err != nil {
+				ch.addErr(err)
+			}
+			for range s.trg {
+			}
+		}(s)
+	}
+}
+
+// Closes the side outputs of a component that has terminated
+func (ch *Chain) closeSides(comp interface{}) {
+	for _, s := range ch.sides {
+		if interface{}(s.comp) == comp {
+			close(s.trg)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package conduit
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// Sends odd numbers to side output "odd"
+type OddConduit struct {
+	odd Target
+}
+
+func (c *OddConduit) SideOutput(name string, trg Target) {
+	if name == "odd" {
+		c.odd = trg
+	}
+}
+
+func (c *OddConduit) Conduct(src Source, trg Target) error {
+	for v := range src {
+		if IsBarrier(v) {
+			trg <- v
+			continue
+		}
+		if v.(int)%2 != 0 && c.odd != nil {
+			c.odd <- v
+			continue
+		}
+		trg <- v
+	}
+	return nil
+}
+
+type ErrConsumer struct{}
+
+func (c *ErrConsumer) Consume(src Source) error {
+	return errors.New("side error")
+}
+
+// Side outputs:
+// - The chain is processed without errors
+// - Items sent to the side output arrive at the side consumer
+// - Without side consumer, the conduit sends all items down the chain
+func TestSideOutput(t *testing.T) {
+	for i := 0; i < numOfTests; i++ {
+		for _, connect := range []bool{false, true} {
+			err := testSideOutput(numOfData, connect)
+			if err != nil {
+				m := fmt.Sprintf("SideOutput failed: %v", err)
+				t.Error(m)
+			}
+		}
+	}
+}
+
+func testSideOutput(n int, connect bool) error {
+	mydata := makeTestData(n)
+	p := &BaseProducer{mydata}
+	c := new(BaseConsumer)
+	odd := new(BaseConsumer)
+	oc := new(OddConduit)
+
+	chn := NewChain(p, []Conduit{oc}, c, small)
+	if connect {
+		err := chn.AddSide(oc, "odd", odd)
+		if err != nil {
+			return err
+		}
+	}
+	// run twice to check that side outputs are renewed
+	for k := 0; k < 2; k++ {
+		c.recvd, odd.recvd = nil, nil
+		err := chn.Run()
+		if err != nil {
+			m := fmt.Sprintf("error on running chain: %v", err)
+			return errors.New(m)
+		}
+		var even, rest []int
+		for _, v := range mydata {
+			if connect && v%2 != 0 {
+				rest = append(rest, v)
+			} else {
+				even = append(even, v)
+			}
+		}
+		for _, x := range []struct {
+			have, want []int
+		}{{c.recvd, even}, {odd.recvd, rest}} {
+			if len(x.have) != len(x.want) {
+				m := fmt.Sprintf("expected %d items, have %d", len(x.want), len(x.have))
+				return errors.New(m)
+			}
+			for i := range x.want {
+				if x.have[i] != x.want[i] {
+					return errors.New("Received values differ from original!")
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Side outputs with errors:
+// - Components not in the chain are rejected
+// - Components occurring more than once are rejected
+// - Errors of side consumers are reported
+func TestErrSideOutput(t *testing.T) {
+	p := &BaseProducer{makeTestData(numOfData)}
+	oc := new(OddConduit)
+	twice := NewChain(p, []Conduit{oc, oc}, new(BaseConsumer), small)
+	if twice.AddSide(oc, "odd", new(BaseConsumer)) == nil {
+		t.Errorf("ErrSideOutput: component occurring twice accepted")
+	}
+	chn := NewChain(p, []Conduit{oc}, new(BaseConsumer), small)
+	if chn.AddSide(new(OddConduit), "odd", new(BaseConsumer)) == nil {
+		t.Errorf("ErrSideOutput: foreign component accepted")
+	}
+	err := chn.AddSide(oc, "odd", new(ErrConsumer))
+	if err != nil {
+		t.Fatalf("ErrSideOutput: %v", err)
+	}
+	err = chn.Run()
+	if err == nil || len(chn.Errs) != 1 || chn.Errs[0].Error() != "side error" {
+		t.Errorf("ErrSideOutput: unexpected errors: %v", chn.Errs)
+	}
+}
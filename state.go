@@ -0,0 +1,337 @@
+package conduit
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ErrNoState is returned by StateStores
+// when there is no state for the requested key.
+var ErrNoState = errors.New("no state for key")
+
+// StateStore is a standard place for stateful components
+// (deduplicators, counters, joins, etc.) to keep their state.
+// State is organised per stage, i.e. per component,
+// and, within a stage, per key. State values are byte slices,
+// such that they can be snapshot and restored
+// independently of the types used by the components.
+// Implementations must be safe for concurrent use.
+type StateStore interface {
+	// Get returns the state of key in stage
+	// or ErrNoState if there is none.
+	Get(stage, key string) ([]byte, error)
+
+	// Put sets the state of key in stage.
+	Put(stage, key string, val []byte) error
+
+	// Delete removes the state of key in stage.
+	// Deleting a key that does not exist is not an error.
+	Delete(stage, key string) error
+
+	// Iterate calls f for each key in stage in ascending order.
+	// Iteration stops when f returns an error, which is then
+	// returned by Iterate. f may modify the store.
+	Iterate(stage string, f func(key string, val []byte) error) error
+
+	// Stages returns the names of all stages
+	// that have state in ascending order.
+	Stages() ([]string, error)
+}
+
+// Replacer is implemented by StateStores that can replace
+// their whole contents at once. The chain uses it
+// to restore checkpoints; StateStores that are no Replacers
+// are restored key by key.
+type Replacer interface {
+	// Replace discards all state and sets
+	// the state of all stages to snap.
+	Replace(snap map[string]map[string][]byte) error
+}
+
+// MemStore is an in-memory StateStore.
+type MemStore struct {
+	door   sync.RWMutex
+	stages map[string]map[string][]byte
+}
+
+// NewMemStore creates a new, empty MemStore.
+func NewMemStore() (m *MemStore) {
+	m = new(MemStore)
+	if m != nil {
+		m.stages = make(map[string]map[string][]byte)
+	}
+	return
+}
+
+// Get implements StateStore.
+func (m *MemStore) Get(stage, key string) ([]byte, error) {
+	m.door.RLock()
+	defer m.door.RUnlock()
+
+	v, ok := m.stages[stage][key]
+	if !ok {
+		return nil, ErrNoState
+	}
+	return dup(v), nil
+}
+
+// Put implements StateStore.
+func (m *MemStore) Put(stage, key string, val []byte) error {
+	m.door.Lock()
+	defer m.door.Unlock()
+
+	s, ok := m.stages[stage]
+	if !ok {
+		s = make(map[string][]byte)
+		m.stages[stage] = s
+	}
+	s[key] = dup(val)
+	return nil
+}
+
+// Delete implements StateStore.
+func (m *MemStore) Delete(stage, key string) error {
+	m.door.Lock()
+	defer m.door.Unlock()
+
+	s, ok := m.stages[stage]
+	if !ok {
+		return nil
+	}
+	delete(s, key)
+	if len(s) == 0 {
+		delete(m.stages, stage)
+	}
+	return nil
+}
+
+// Iterate implements StateStore.
+func (m *MemStore) Iterate(stage string, f func(key string, val []byte) error) error {
+	m.door.RLock()
+	s := m.stages[stage]
+	keys := make([]string, 0, len(s))
+	vals := make(map[string][]byte, len(s))
+	for k, v := range s {
+		keys = append(keys, k)
+		vals[k] = dup(v)
+	}
+	m.door.RUnlock()
+
+	sort.Strings(keys)
+	for _, k := range keys {
+		err := f(k, vals[k])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stages implements StateStore.
+func (m *MemStore) Stages() ([]string, error) {
+	m.door.RLock()
+	defer m.door.RUnlock()
+
+	stages := make([]string, 0, len(m.stages))
+	for s := range m.stages {
+		stages = append(stages, s)
+	}
+	sort.Strings(stages)
+	return stages, nil
+}
+
+// Replace implements Replacer.
+func (m *MemStore) Replace(snap map[string]map[string][]byte) error {
+	stages := make(map[string]map[string][]byte, len(snap))
+	for stage, kvs := range snap {
+		if len(kvs) == 0 {
+			continue
+		}
+		s := make(map[string][]byte, len(kvs))
+		for k, v := range kvs {
+			s[k] = dup(v)
+		}
+		stages[stage] = s
+	}
+
+	m.door.Lock()
+	defer m.door.Unlock()
+	m.stages = stages
+	return nil
+}
+
+// copies a byte slice
+func dup(v []byte) []byte {
+	if v == nil {
+		return nil
+	}
+	c := make([]byte, len(v))
+	copy(c, v)
+	return c
+}
+
+// FileStore is a StateStore that keeps state
+// in a directory with one file per stage.
+// State is held in memory and written through
+// to the stage file on each change;
+// stage files are replaced atomically.
+// Since each change rewrites the whole stage file,
+// bulk updates should go through Replace,
+// which writes each stage file only once.
+type FileStore struct {
+	door sync.Mutex
+	dir  string
+	mem  *MemStore
+}
+
+// suffix of stage files
+const stageSuffix = ".state"
+
+// NewFileStore creates a new FileStore in directory dir,
+// which is created if it does not exist.
+// State found in dir is loaded.
+func NewFileStore(dir string) (*FileStore, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	fs := new(FileStore)
+	fs.dir = dir
+	fs.mem = NewMemStore()
+
+	names, err := filepath.Glob(filepath.Join(dir, "*"+stageSuffix))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		base := strings.TrimSuffix(filepath.Base(name), stageSuffix)
+		stage, err := url.PathUnescape(base)
+		if err != nil {
+			continue
+		}
+		err = fs.load(stage, name)
+		if err != nil {
+			s := fmt.Sprintf("cannot load state file %s: %v", name, err)
+			return nil, errors.New(s)
+		}
+	}
+	return fs, nil
+}
+
+// loads one stage file
+func (fs *FileStore) load(stage, name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var s map[string][]byte
+	err = gob.NewDecoder(f).Decode(&s)
+	if err != nil {
+		return err
+	}
+	fs.mem.stages[stage] = s
+	return nil
+}
+
+// writes one stage file
+func (fs *FileStore) store(stage string) error {
+	name := filepath.Join(fs.dir, url.PathEscape(stage)+stageSuffix)
+
+	fs.mem.door.RLock()
+	s, ok := fs.mem.stages[stage]
+	if !ok {
+		fs.mem.door.RUnlock()
+		err := os.Remove(name)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	tmp, err := os.CreateTemp(fs.dir, "tmp-*")
+	if err != nil {
+		fs.mem.door.RUnlock()
+		return err
+	}
+	err = gob.NewEncoder(tmp).Encode(s)
+	fs.mem.door.RUnlock()
+
+	if err == nil {
+		err = tmp.Sync()
+	}
+	cerr := tmp.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+// Get implements StateStore.
+func (fs *FileStore) Get(stage, key string) ([]byte, error) {
+	return fs.mem.Get(stage, key)
+}
+
+// Put implements StateStore.
+func (fs *FileStore) Put(stage, key string, val []byte) error {
+	fs.door.Lock()
+	defer fs.door.Unlock()
+
+	fs.mem.Put(stage, key, val)
+	return fs.store(stage)
+}
+
+// Delete implements StateStore.
+func (fs *FileStore) Delete(stage, key string) error {
+	fs.door.Lock()
+	defer fs.door.Unlock()
+
+	fs.mem.Delete(stage, key)
+	return fs.store(stage)
+}
+
+// Iterate implements StateStore.
+func (fs *FileStore) Iterate(stage string, f func(key string, val []byte) error) error {
+	return fs.mem.Iterate(stage, f)
+}
+
+// Stages implements StateStore.
+func (fs *FileStore) Stages() ([]string, error) {
+	return fs.mem.Stages()
+}
+
+// Replace implements Replacer.
+func (fs *FileStore) Replace(snap map[string]map[string][]byte) error {
+	fs.door.Lock()
+	defer fs.door.Unlock()
+
+	old, _ := fs.mem.Stages()
+	fs.mem.Replace(snap)
+	for _, stage := range old {
+		if _, ok := snap[stage]; ok {
+			continue
+		}
+		err := fs.store(stage)
+		if err != nil {
+			return err
+		}
+	}
+	for stage := range snap {
+		err := fs.store(stage)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+package conduit
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// MemStore:
+// - Random puts and deletes are reflected by Get and Iterate
+func TestMemStore(t *testing.T) {
+	for i := 0; i < numOfTests; i++ {
+		err := testStateStore(NewMemStore(), numOfData)
+		if err != nil {
+			m := fmt.Sprintf("MemStore failed: %v", err)
+			t.Error(m)
+		}
+	}
+}
+
+// FileStore:
+// - Random puts and deletes are reflected by Get and Iterate
+// - The state is the same after reopening the store
+func TestFileStore(t *testing.T) {
+	for i := 0; i < numOfTests/10; i++ {
+		dir := t.TempDir()
+		fs, err := NewFileStore(dir)
+		if err != nil {
+			t.Fatalf("cannot create FileStore: %v", err)
+		}
+		err = testStateStore(fs, numOfData)
+		if err != nil {
+			m := fmt.Sprintf("FileStore failed: %v", err)
+			t.Error(m)
+		}
+		fs2, err := NewFileStore(dir)
+		if err != nil {
+			t.Fatalf("cannot reopen FileStore: %v", err)
+		}
+		err = compareStores(fs, fs2)
+		if err != nil {
+			m := fmt.Sprintf("reopened FileStore differs: %v", err)
+			t.Error(m)
+		}
+	}
+}
+
+// Replace:
+// - Replacing the contents of a store discards all former state
+// - A replaced FileStore is the same after reopening
+func TestReplace(t *testing.T) {
+	for i := 0; i < numOfTests/10; i++ {
+		dir := t.TempDir()
+		fs, err := NewFileStore(dir)
+		if err != nil {
+			t.Fatalf("cannot create FileStore: %v", err)
+		}
+		for _, st := range []StateStore{NewMemStore(), fs} {
+			err = testReplace(st, numOfData)
+			if err != nil {
+				m := fmt.Sprintf("Replace failed: %v", err)
+				t.Error(m)
+			}
+		}
+		fs2, err := NewFileStore(dir)
+		if err != nil {
+			t.Fatalf("cannot reopen FileStore: %v", err)
+		}
+		err = compareStores(fs, fs2)
+		if err != nil {
+			m := fmt.Sprintf("reopened FileStore differs: %v", err)
+			t.Error(m)
+		}
+	}
+}
+
+func testReplace(st StateStore, n int) error {
+	err := testStateStore(st, n)
+	if err != nil {
+		return err
+	}
+	snap := make(map[string]map[string][]byte)
+	for i := 0; i < n; i++ {
+		stage := fmt.Sprintf("stage/%d", 1+rand.Int()%3)
+		if snap[stage] == nil {
+			snap[stage] = make(map[string][]byte)
+		}
+		key := fmt.Sprintf("key%d", rand.Int()%10)
+		snap[stage][key] = []byte(fmt.Sprintf("%d", rand.Int()))
+	}
+	err = st.(Replacer).Replace(snap)
+	if err != nil {
+		return err
+	}
+	ref := NewMemStore()
+	ref.Replace(snap)
+	err = compareStores(st, ref)
+	if err != nil {
+		return err
+	}
+	return compareStores(ref, st)
+}
+
+func testStateStore(st StateStore, n int) error {
+
+	ref := make(map[string]map[string][]byte)
+
+	for i := 0; i < n; i++ {
+		stage := fmt.Sprintf("stage/%d", rand.Int()%3)
+		key := fmt.Sprintf("key%d", rand.Int()%10)
+		if rand.Int()%4 == 0 {
+			err := st.Delete(stage, key)
+			if err != nil {
+				return err
+			}
+			delete(ref[stage], key)
+			continue
+		}
+		val := []byte(fmt.Sprintf("%d", rand.Int()))
+		err := st.Put(stage, key, val)
+		if err != nil {
+			return err
+		}
+		if ref[stage] == nil {
+			ref[stage] = make(map[string][]byte)
+		}
+		ref[stage][key] = val
+	}
+
+	for stage, s := range ref {
+		for k, v := range s {
+			have, err := st.Get(stage, k)
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(have, v) {
+				return errors.New("Stored values differ from original!")
+			}
+		}
+		cnt := 0
+		last := ""
+		err := st.Iterate(stage, func(k string, v []byte) error {
+			if k <= last {
+				return errors.New("keys not in order")
+			}
+			last = k
+			if !bytes.Equal(s[k], v) {
+				return errors.New("Iterated values differ from original!")
+			}
+			cnt++
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if cnt != len(s) {
+			m := fmt.Sprintf("expected %d keys, have %d", len(s), cnt)
+			return errors.New(m)
+		}
+	}
+	_, err := st.Get("nostage", "nokey")
+	if err != ErrNoState {
+		m := fmt.Sprintf("expected ErrNoState, have %v", err)
+		return errors.New(m)
+	}
+	return nil
+}
+
+func compareStores(a, b StateStore) error {
+	sa, err := a.Stages()
+	if err != nil {
+		return err
+	}
+	sb, err := b.Stages()
+	if err != nil {
+		return err
+	}
+	if fmt.Sprintf("%v", sa) != fmt.Sprintf("%v", sb) {
+		m := fmt.Sprintf("stages differ: %v - %v", sa, sb)
+		return errors.New(m)
+	}
+	for _, stage := range sa {
+		err = a.Iterate(stage, func(k string, v []byte) error {
+			w, err := b.Get(stage, k)
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(v, w) {
+				return errors.New("values differ")
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
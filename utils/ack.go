@@ -0,0 +1,168 @@
+package utils
+
+import (
+	"sync"
+
+	"github.com/toschoo/conduit"
+)
+
+// Acknowledgments of produced items that are pending
+// until a checkpoint covers the items (see conduit.Committer);
+// used by producers reading from message queues
+// that redeliver unacknowledged messages
+type ackQueue struct {
+	door    sync.Mutex
+	base    uint64
+	resumed bool
+	pending []func() error
+}
+
+// Continues at position pos after a restart
+func (q *ackQueue) resume(pos uint64) {
+	q.door.Lock()
+	defer q.door.Unlock()
+	q.base = pos
+	q.resumed = true
+}
+
+// Starts production; pending acknowledgments of previous runs
+// are dropped, since their messages are redelivered
+func (q *ackQueue) start() {
+	q.door.Lock()
+	defer q.door.Unlock()
+	if !q.resumed {
+		q.base = 0
+	}
+	q.resumed = false
+	q.pending = nil
+}
+
+// Adds the acknowledgment of the next item;
+// must be called before the item is sent
+func (q *ackQueue) add(ack func() error) {
+	q.door.Lock()
+	defer q.door.Unlock()
+	q.pending = append(q.pending, ack)
+}
+
+// Acknowledges all items before position pos;
+// returns the first error
+func (q *ackQueue) commit(pos uint64) error {
+	q.door.Lock()
+	if pos <= q.base {
+		q.door.Unlock()
+		return nil
+	}
+	n := int(pos - q.base)
+	if n > len(q.pending) {
+		n = len(q.pending)
+	}
+	acks := q.pending[:n]
+	q.pending = q.pending[n:]
+	q.base += uint64(n)
+	q.door.Unlock()
+
+	var err error
+	for _, ack := range acks {
+		if e := ack(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Positions of a producer in the partitions of a stream
+// (e.g. the shards of a Kinesis stream) that are kept
+// in a StateStore: the position of the last item acknowledged
+// per partition or end for partitions that are closed
+// and completely acknowledged
+type streamPositions struct {
+	door    sync.Mutex
+	store   conduit.StateStore
+	stage   string
+	end     string
+	pos     map[string]string
+	pending map[string]int
+	closed  map[string]bool
+	dirty   bool
+}
+
+// Loads the positions stored under stage;
+// store may be nil
+func (p *streamPositions) load(store conduit.StateStore, stage, end string) (map[string]string, error) {
+	p.door.Lock()
+	defer p.door.Unlock()
+	p.store, p.stage, p.end = store, stage, end
+	p.pos = make(map[string]string)
+	p.pending = make(map[string]int)
+	p.closed = make(map[string]bool)
+	p.dirty = false
+	pos := make(map[string]string)
+	if store == nil {
+		return pos, nil
+	}
+	err := store.Iterate(stage, func(part string, v []byte) error {
+		p.pos[part] = string(v)
+		pos[part] = string(v)
+		return nil
+	})
+	return pos, err
+}
+
+func (p *streamPositions) get(part string) string {
+	p.door.Lock()
+	defer p.door.Unlock()
+	return p.pos[part]
+}
+
+// An item of part was sent down the chain
+func (p *streamPositions) sent(part string) {
+	p.door.Lock()
+	defer p.door.Unlock()
+	p.pending[part]++
+}
+
+// The item of part at pos was acknowledged
+func (p *streamPositions) ack(part, pos string) {
+	p.door.Lock()
+	defer p.door.Unlock()
+	p.pending[part]--
+	p.pos[part] = pos
+	if p.closed[part] && p.pending[part] == 0 {
+		p.pos[part] = p.end
+	}
+	p.dirty = true
+}
+
+// All items of part were sent down the chain
+func (p *streamPositions) close(part string) {
+	p.door.Lock()
+	defer p.door.Unlock()
+	p.closed[part] = true
+	if p.pending[part] == 0 {
+		p.pos[part] = p.end
+		p.dirty = true
+	}
+}
+
+// Stores the positions if they changed
+func (p *streamPositions) save() error {
+	p.door.Lock()
+	if !p.dirty || p.store == nil {
+		p.door.Unlock()
+		return nil
+	}
+	p.dirty = false
+	pos := make(map[string]string, len(p.pos))
+	for k, v := range p.pos {
+		pos[k] = v
+	}
+	p.door.Unlock()
+	for part, v := range pos {
+		err := p.store.Put(p.stage, part, []byte(v))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
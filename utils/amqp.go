@@ -0,0 +1,1183 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// AMQP 1.0 performatives, outcomes and sections (descriptor codes)
+const (
+	amqpOpen        = 0x10
+	amqpBegin       = 0x11
+	amqpAttach      = 0x12
+	amqpFlow        = 0x13
+	amqpTransfer    = 0x14
+	amqpDisposition = 0x15
+	amqpDetach      = 0x16
+	amqpEnd         = 0x17
+	amqpClose       = 0x18
+	amqpErrorCode   = 0x1d
+	amqpAccepted    = 0x24
+	amqpRejected    = 0x25
+	amqpReleased    = 0x26
+	amqpModified    = 0x27
+	amqpSource      = 0x28
+	amqpTarget      = 0x29
+
+	amqpSASLMechanisms = 0x40
+	amqpSASLInit       = 0x41
+	amqpSASLOutcome    = 0x44
+
+	amqpHeader      = 0x70
+	amqpAnnotations = 0x72
+	amqpProperties  = 0x73
+	amqpAppProps    = 0x74
+	amqpData        = 0x75
+	amqpValue       = 0x77
+
+	amqpBatchFormat = 0x80013700
+	amqpWindow      = 5000
+)
+
+var amqpProto = []byte{'A', 'M', 'Q', 'P', 0, 1, 0, 0}
+var amqpSASLProto = []byte{'A', 'M', 'Q', 'P', 3, 1, 0, 0}
+
+var errAMQPShort = errors.New("amqp: frame too short")
+
+// AMQP symbol
+type amqpSymbol string
+
+// AMQP described type
+type amqpDescribed struct {
+	descriptor interface{}
+	value      interface{}
+}
+
+// Described list, e.g. a performative
+func amqpList(code uint64, fields ...interface{}) amqpDescribed {
+	return amqpDescribed{descriptor: code, value: fields}
+}
+
+// Code of a described value with ulong descriptor
+func amqpCode(v interface{}) (uint64, []interface{}) {
+	d, ok := v.(amqpDescribed)
+	if !ok {
+		return 0, nil
+	}
+	code, _ := amqpUint(d.descriptor)
+	fields, _ := d.value.([]interface{})
+	return code, fields
+}
+
+// Field i of a list or nil
+func amqpField(fields []interface{}, i int) interface{} {
+	if i < len(fields) {
+		return fields[i]
+	}
+	return nil
+}
+
+// Value of an unsigned or signed integer
+func amqpUint(v interface{}) (uint64, bool) {
+	switch x := v.(type) {
+	case uint8:
+		return uint64(x), true
+	case uint16:
+		return uint64(x), true
+	case uint32:
+		return uint64(x), true
+	case uint64:
+		return x, true
+	case int8:
+		return uint64(x), true
+	case int16:
+		return uint64(x), true
+	case int32:
+		return uint64(x), true
+	case int64:
+		return uint64(x), true
+	}
+	return 0, false
+}
+
+// Value of a string, symbol or binary
+func amqpString(v interface{}) string {
+	switch x := v.(type) {
+	case string:
+		return x
+	case amqpSymbol:
+		return string(x)
+	case []byte:
+		return string(x)
+	case nil:
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+// Appends a variable width value with size and count
+func amqpCompound(b *bytes.Buffer, code byte, count int, body []byte) {
+	b.WriteByte(code)
+	binary.Write(b, binary.BigEndian, uint32(len(body)+4))
+	binary.Write(b, binary.BigEndian, uint32(count))
+	b.Write(body)
+}
+
+// Encodes v; unsupported types are encoded as strings
+func amqpWrite(b *bytes.Buffer, v interface{}) {
+	var body bytes.Buffer
+	switch x := v.(type) {
+	case nil:
+		b.WriteByte(0x40)
+	case bool:
+		if x {
+			b.WriteByte(0x41)
+		} else {
+			b.WriteByte(0x42)
+		}
+	case uint8:
+		b.Write([]byte{0x50, x})
+	case uint16:
+		b.WriteByte(0x60)
+		binary.Write(b, binary.BigEndian, x)
+	case uint32:
+		b.WriteByte(0x70)
+		binary.Write(b, binary.BigEndian, x)
+	case uint64:
+		b.WriteByte(0x80)
+		binary.Write(b, binary.BigEndian, x)
+	case int8:
+		b.Write([]byte{0x51, byte(x)})
+	case int16:
+		b.WriteByte(0x61)
+		binary.Write(b, binary.BigEndian, x)
+	case int32:
+		b.WriteByte(0x71)
+		binary.Write(b, binary.BigEndian, x)
+	case int64:
+		b.WriteByte(0x81)
+		binary.Write(b, binary.BigEndian, x)
+	case int:
+		amqpWrite(b, int64(x))
+	case float64:
+		b.WriteByte(0x82)
+		binary.Write(b, binary.BigEndian, math.Float64bits(x))
+	case time.Time:
+		b.WriteByte(0x83)
+		binary.Write(b, binary.BigEndian, x.UnixNano()/int64(time.Millisecond))
+	case []byte:
+		b.WriteByte(0xb0)
+		binary.Write(b, binary.BigEndian, uint32(len(x)))
+		b.Write(x)
+	case string:
+		b.WriteByte(0xb1)
+		binary.Write(b, binary.BigEndian, uint32(len(x)))
+		b.WriteString(x)
+	case amqpSymbol:
+		b.WriteByte(0xb3)
+		binary.Write(b, binary.BigEndian, uint32(len(x)))
+		b.WriteString(string(x))
+	case amqpDescribed:
+		b.WriteByte(0x00)
+		amqpWrite(b, x.descriptor)
+		amqpWrite(b, x.value)
+	case []interface{}:
+		for _, e := range x {
+			amqpWrite(&body, e)
+		}
+		amqpCompound(b, 0xd0, len(x), body.Bytes())
+	case map[string]interface{}:
+		for k, e := range x {
+			amqpWrite(&body, k)
+			amqpWrite(&body, e)
+		}
+		amqpCompound(b, 0xd1, 2*len(x), body.Bytes())
+	case map[amqpSymbol]interface{}:
+		for k, e := range x {
+			amqpWrite(&body, k)
+			amqpWrite(&body, e)
+		}
+		amqpCompound(b, 0xd1, 2*len(x), body.Bytes())
+	case map[interface{}]interface{}:
+		for k, e := range x {
+			amqpWrite(&body, k)
+			amqpWrite(&body, e)
+		}
+		amqpCompound(b, 0xd1, 2*len(x), body.Bytes())
+	case []string:
+		body.WriteByte(0xb1)
+		for _, s := range x {
+			binary.Write(&body, binary.BigEndian, uint32(len(s)))
+			body.WriteString(s)
+		}
+		amqpCompound(b, 0xf0, len(x), body.Bytes())
+	case []amqpSymbol:
+		body.WriteByte(0xb3)
+		for _, s := range x {
+			binary.Write(&body, binary.BigEndian, uint32(len(s)))
+			body.WriteString(string(s))
+		}
+		amqpCompound(b, 0xf0, len(x), body.Bytes())
+	default:
+		amqpWrite(b, fmt.Sprint(v))
+	}
+}
+
+// Encodes v
+func amqpEncode(v interface{}) []byte {
+	var b bytes.Buffer
+	amqpWrite(&b, v)
+	return b.Bytes()
+}
+
+// Decodes a value; returns the value and the remaining bytes
+func amqpRead(b []byte) (interface{}, []byte, error) {
+	if len(b) == 0 {
+		return nil, nil, errAMQPShort
+	}
+	if b[0] != 0x00 {
+		return amqpReadValue(b[0], b[1:])
+	}
+	d, b, err := amqpRead(b[1:])
+	if err != nil {
+		return nil, nil, err
+	}
+	v, b, err := amqpRead(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	return amqpDescribed{descriptor: d, value: v}, b, nil
+}
+
+// Decodes a value with constructor code
+func amqpReadValue(code byte, b []byte) (interface{}, []byte, error) {
+	// width of fixed values and of size and count of variable ones
+	var width int
+	switch code >> 4 {
+	case 0x4:
+		width = 0
+	case 0x5, 0xa, 0xc, 0xe:
+		width = 1
+	case 0x6:
+		width = 2
+	case 0x7, 0xb, 0xd, 0xf:
+		width = 4
+	case 0x8:
+		width = 8
+	case 0x9:
+		width = 16
+	default:
+		return nil, nil, errors.New(fmt.Sprintf("amqp: invalid type code 0x%x", code))
+	}
+	if len(b) < width {
+		return nil, nil, errAMQPShort
+	}
+	if code < 0xa0 {
+		return amqpFixed(code, b[:width]), b[width:], nil
+	}
+	size := 0
+	if width == 1 {
+		size = int(b[0])
+	} else {
+		size = int(binary.BigEndian.Uint32(b))
+	}
+	b = b[width:]
+	if len(b) < size {
+		return nil, nil, errAMQPShort
+	}
+	data, rest := b[:size], b[size:]
+	switch code {
+	case 0xa0, 0xb0:
+		return append([]byte{}, data...), rest, nil
+	case 0xa1, 0xb1:
+		return string(data), rest, nil
+	case 0xa3, 0xb3:
+		return amqpSymbol(data), rest, nil
+	}
+	if len(data) < width {
+		return nil, nil, errAMQPShort
+	}
+	count := 0
+	if width == 1 {
+		count = int(data[0])
+	} else {
+		count = int(binary.BigEndian.Uint32(data))
+	}
+	data = data[width:]
+	switch code {
+	case 0xc0, 0xd0:
+		list := make([]interface{}, 0, count)
+		for i := 0; i < count; i++ {
+			v, r, err := amqpRead(data)
+			if err != nil {
+				return nil, nil, err
+			}
+			list = append(list, v)
+			data = r
+		}
+		return list, rest, nil
+	case 0xc1, 0xd1:
+		m := make(map[interface{}]interface{})
+		for i := 0; i+1 < count; i += 2 {
+			k, r, err := amqpRead(data)
+			if err != nil {
+				return nil, nil, err
+			}
+			v, r, err := amqpRead(r)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch k.(type) {
+			case []byte, amqpDescribed:
+				k = amqpString(k)
+			}
+			m[k] = v
+			data = r
+		}
+		return m, rest, nil
+	case 0xe0, 0xf0:
+		if len(data) == 0 {
+			return nil, nil, errAMQPShort
+		}
+		elem := data[0]
+		data = data[1:]
+		var descriptor interface{}
+		if elem == 0x00 {
+			d, r, err := amqpRead(data)
+			if err != nil || len(r) == 0 {
+				return nil, nil, errAMQPShort
+			}
+			descriptor, elem, data = d, r[0], r[1:]
+		}
+		array := make([]interface{}, 0, count)
+		for i := 0; i < count; i++ {
+			v, r, err := amqpReadValue(elem, data)
+			if err != nil {
+				return nil, nil, err
+			}
+			if descriptor != nil {
+				v = amqpDescribed{descriptor: descriptor, value: v}
+			}
+			array = append(array, v)
+			data = r
+		}
+		return array, rest, nil
+	}
+	return nil, nil, errors.New(fmt.Sprintf("amqp: invalid type code 0x%x", code))
+}
+
+// Decodes a fixed width value
+func amqpFixed(code byte, b []byte) interface{} {
+	switch code {
+	case 0x41:
+		return true
+	case 0x42:
+		return false
+	case 0x43:
+		return uint32(0)
+	case 0x44:
+		return uint64(0)
+	case 0x45:
+		return []interface{}{}
+	case 0x50:
+		return b[0]
+	case 0x51:
+		return int8(b[0])
+	case 0x52:
+		return uint32(b[0])
+	case 0x53:
+		return uint64(b[0])
+	case 0x54:
+		return int32(int8(b[0]))
+	case 0x55:
+		return int64(int8(b[0]))
+	case 0x56:
+		return b[0] != 0
+	case 0x60:
+		return binary.BigEndian.Uint16(b)
+	case 0x61:
+		return int16(binary.BigEndian.Uint16(b))
+	case 0x70:
+		return binary.BigEndian.Uint32(b)
+	case 0x71:
+		return int32(binary.BigEndian.Uint32(b))
+	case 0x72:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b)))
+	case 0x73:
+		return rune(binary.BigEndian.Uint32(b))
+	case 0x80:
+		return binary.BigEndian.Uint64(b)
+	case 0x81:
+		return int64(binary.BigEndian.Uint64(b))
+	case 0x82:
+		return math.Float64frombits(binary.BigEndian.Uint64(b))
+	case 0x83:
+		ms := int64(binary.BigEndian.Uint64(b))
+		return time.Unix(0, ms*int64(time.Millisecond))
+	case 0x98:
+		var uuid [16]byte
+		copy(uuid[:], b)
+		return uuid
+	}
+	return nil
+}
+
+// Frame of the AMQP or the SASL layer
+type amqpFrame struct {
+	sasl    bool
+	channel uint16
+	code    uint64
+	fields  []interface{}
+	payload []byte
+}
+
+// Reads the next frame; empty frames (heartbeats) are skipped
+func amqpReadFrame(rd *bufio.Reader) (*amqpFrame, error) {
+	for {
+		head := make([]byte, 8)
+		_, err := io.ReadFull(rd, head)
+		if err != nil {
+			return nil, err
+		}
+		size := int(binary.BigEndian.Uint32(head))
+		doff := int(head[4]) * 4
+		if size < 8 || doff < 8 || doff > size {
+			return nil, errors.New("amqp: invalid frame header")
+		}
+		body := make([]byte, size-8)
+		_, err = io.ReadFull(rd, body)
+		if err != nil {
+			return nil, err
+		}
+		body = body[doff-8:]
+		if len(body) == 0 {
+			continue
+		}
+		v, payload, err := amqpRead(body)
+		if err != nil {
+			return nil, err
+		}
+		code, fields := amqpCode(v)
+		return &amqpFrame{
+			sasl:    head[5] == 1,
+			channel: binary.BigEndian.Uint16(head[6:]),
+			code:    code,
+			fields:  fields,
+			payload: payload,
+		}, nil
+	}
+}
+
+// Encodes a frame
+func amqpEncodeFrame(f *amqpFrame) []byte {
+	var b bytes.Buffer
+	b.Write(make([]byte, 8))
+	amqpWrite(&b, amqpList(f.code, f.fields...))
+	b.Write(f.payload)
+	frame := b.Bytes()
+	binary.BigEndian.PutUint32(frame, uint32(len(frame)))
+	frame[4] = 2
+	if f.sasl {
+		frame[5] = 1
+	}
+	binary.BigEndian.PutUint16(frame[6:], f.channel)
+	return frame
+}
+
+// AMQPError is an error condition reported by an AMQP peer.
+type AMQPError struct {
+	Condition   string
+	Description string
+}
+
+func (e *AMQPError) Error() string {
+	return fmt.Sprintf("amqp: %s: %s", e.Condition, e.Description)
+}
+
+// Converts an error field; nil if there is no error
+func amqpErr(v interface{}) error {
+	code, fields := amqpCode(v)
+	if code != amqpErrorCode {
+		return nil
+	}
+	return &AMQPError{Condition: amqpString(amqpField(fields, 0)), Description: amqpString(amqpField(fields, 1))}
+}
+
+// Message with the sections used by the Azure services
+type amqpMessage struct {
+	format        uint32
+	deliveryCount uint32
+	annotations   map[interface{}]interface{}
+	id            interface{}
+	replyTo       string
+	group         string
+	props         map[string]interface{}
+	data          [][]byte
+	value         interface{}
+}
+
+func (m *amqpMessage) encode() []byte {
+	var b bytes.Buffer
+	if len(m.annotations) > 0 {
+		amqpWrite(&b, amqpDescribed{descriptor: uint64(amqpAnnotations), value: m.annotations})
+	}
+	if m.id != nil || m.replyTo != "" || m.group != "" {
+		var group interface{}
+		if m.group != "" {
+			group = m.group
+		}
+		var replyTo interface{}
+		if m.replyTo != "" {
+			replyTo = m.replyTo
+		}
+		amqpWrite(&b, amqpList(amqpProperties, m.id, nil, nil, nil, replyTo,
+			nil, nil, nil, nil, nil, group))
+	}
+	if len(m.props) > 0 {
+		amqpWrite(&b, amqpDescribed{descriptor: uint64(amqpAppProps), value: m.props})
+	}
+	for _, d := range m.data {
+		amqpWrite(&b, amqpDescribed{descriptor: uint64(amqpData), value: d})
+	}
+	if m.value != nil {
+		amqpWrite(&b, amqpDescribed{descriptor: uint64(amqpValue), value: m.value})
+	}
+	return b.Bytes()
+}
+
+func amqpDecodeMessage(b []byte) (*amqpMessage, error) {
+	m := &amqpMessage{}
+	for len(b) > 0 {
+		v, r, err := amqpRead(b)
+		if err != nil {
+			return nil, err
+		}
+		b = r
+		d, ok := v.(amqpDescribed)
+		if !ok {
+			return nil, errors.New("amqp: invalid message section")
+		}
+		code, _ := amqpUint(d.descriptor)
+		fields, _ := d.value.([]interface{})
+		switch code {
+		case amqpHeader:
+			n, _ := amqpUint(amqpField(fields, 4))
+			m.deliveryCount = uint32(n)
+		case amqpAnnotations:
+			m.annotations, _ = d.value.(map[interface{}]interface{})
+		case amqpProperties:
+			m.id = amqpField(fields, 0)
+			m.replyTo = amqpString(amqpField(fields, 4))
+			m.group = amqpString(amqpField(fields, 10))
+		case amqpAppProps:
+			m.props = make(map[string]interface{})
+			props, _ := d.value.(map[interface{}]interface{})
+			for k, v := range props {
+				m.props[amqpString(k)] = v
+			}
+		case amqpData:
+			data, _ := d.value.([]byte)
+			m.data = append(m.data, data)
+		case amqpValue:
+			m.value = d.value
+		}
+	}
+	return m, nil
+}
+
+// Message annotation with symbol key
+func (m *amqpMessage) annotation(key string) interface{} {
+	return m.annotations[amqpSymbol(key)]
+}
+
+// Body of a message with data sections
+func (m *amqpMessage) body() []byte {
+	if len(m.data) == 1 {
+		return m.data[0]
+	}
+	return bytes.Join(m.data, nil)
+}
+
+// Delivery received on a link
+type amqpDelivery struct {
+	id  uint32
+	msg *amqpMessage
+}
+
+// Link of the session; the role is receiver or sender
+type amqpLink struct {
+	name     string
+	handle   uint32
+	receiver bool
+	attached bool
+	count    uint32 // delivery count
+	credit   uint32
+	queue    []*amqpDelivery
+	partial  []byte
+	partID   uint32
+	err      error
+}
+
+// Minimal AMQP 1.0 client with a single session
+type amqpConn struct {
+	conn     net.Conn
+	rd       *bufio.Reader
+	timeout  time.Duration
+	wdoor    sync.Mutex
+	door     sync.Mutex
+	cond     *sync.Cond
+	maxFrame int
+	handles  uint32
+	links    map[uint32]*amqpLink // by handle of the peer
+	names    map[string]*amqpLink
+	nextOut  uint32 // next outgoing transfer
+	nextIn   uint32 // next incoming transfer
+	window   uint32 // incoming window of the peer
+	received int
+	delivery uint32
+	outcomes map[uint32]interface{}
+	err      error
+	once     sync.Once
+	done     chan struct{}
+}
+
+// Options to connect to an AMQP 1.0 broker
+type amqpOptions struct {
+	addr    string // host:port
+	host    string // virtual host
+	tls     bool
+	user    string
+	pass    string
+	timeout time.Duration
+}
+
+// Connects with SASL and opens a session
+func dialAMQP(o *amqpOptions) (*amqpConn, error) {
+	conn, err := net.DialTimeout("tcp", o.addr, o.timeout)
+	if err != nil {
+		return nil, err
+	}
+	if o.tls {
+		conn = tls.Client(conn, &tls.Config{ServerName: o.host})
+	}
+	c := &amqpConn{
+		conn:     conn,
+		rd:       bufio.NewReader(conn),
+		timeout:  o.timeout,
+		maxFrame: 65536,
+		links:    make(map[uint32]*amqpLink),
+		names:    make(map[string]*amqpLink),
+		outcomes: make(map[uint32]interface{}),
+		done:     make(chan struct{}),
+	}
+	c.cond = sync.NewCond(&c.door)
+	conn.SetDeadline(time.Now().Add(o.timeout))
+	idle, err := c.handshake(o)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	go c.run()
+	if idle > 0 {
+		go c.heartbeat(idle / 2)
+	}
+	return c, nil
+}
+
+// Expects the protocol header proto
+func (c *amqpConn) header(proto []byte) error {
+	_, err := c.conn.Write(proto)
+	if err != nil {
+		return err
+	}
+	head := make([]byte, 8)
+	_, err = io.ReadFull(c.rd, head)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(head, proto) {
+		return errors.New(fmt.Sprintf("amqp: unsupported protocol %q", head))
+	}
+	return nil
+}
+
+// Expects a frame with the performative code
+func (c *amqpConn) expect(code uint64) (*amqpFrame, error) {
+	f, err := amqpReadFrame(c.rd)
+	if err != nil {
+		return nil, err
+	}
+	if f.code == amqpClose {
+		if err = amqpErr(amqpField(f.fields, 0)); err != nil {
+			return nil, err
+		}
+	}
+	if f.code != code {
+		return nil, errors.New(fmt.Sprintf("amqp: unexpected performative 0x%x", f.code))
+	}
+	return f, nil
+}
+
+// Authenticates and opens connection and session;
+// returns the idle timeout of the peer
+func (c *amqpConn) handshake(o *amqpOptions) (time.Duration, error) {
+	err := c.header(amqpSASLProto)
+	if err != nil {
+		return 0, err
+	}
+	_, err = c.expect(amqpSASLMechanisms)
+	if err != nil {
+		return 0, err
+	}
+	init := &amqpFrame{sasl: true, code: amqpSASLInit, fields: []interface{}{amqpSymbol("ANONYMOUS")}}
+	if o.user != "" {
+		init.fields = []interface{}{amqpSymbol("PLAIN"), []byte("\x00" + o.user + "\x00" + o.pass), o.host}
+	}
+	err = c.write(init)
+	if err != nil {
+		return 0, err
+	}
+	f, err := c.expect(amqpSASLOutcome)
+	if err != nil {
+		return 0, err
+	}
+	if code, _ := amqpUint(amqpField(f.fields, 0)); code != 0 {
+		return 0, errors.New(fmt.Sprintf("amqp: authentication failed (%d)", code))
+	}
+	err = c.header(amqpProto)
+	if err != nil {
+		return 0, err
+	}
+	err = c.write(&amqpFrame{code: amqpOpen, fields: []interface{}{
+		"conduit", o.host, uint32(c.maxFrame), uint16(0),
+	}})
+	if err != nil {
+		return 0, err
+	}
+	f, err = c.expect(amqpOpen)
+	if err != nil {
+		return 0, err
+	}
+	if n, ok := amqpUint(amqpField(f.fields, 2)); ok && int(n) < c.maxFrame {
+		c.maxFrame = int(n)
+	}
+	idle, _ := amqpUint(amqpField(f.fields, 4))
+	err = c.write(&amqpFrame{code: amqpBegin, fields: []interface{}{
+		nil, uint32(0), uint32(amqpWindow), uint32(amqpWindow),
+	}})
+	if err != nil {
+		return 0, err
+	}
+	f, err = c.expect(amqpBegin)
+	if err != nil {
+		return 0, err
+	}
+	next, _ := amqpUint(amqpField(f.fields, 1))
+	w, _ := amqpUint(amqpField(f.fields, 2))
+	c.nextIn, c.window = uint32(next), uint32(w)
+	return time.Duration(idle) * time.Millisecond, nil
+}
+
+func (c *amqpConn) write(f *amqpFrame) error {
+	c.wdoor.Lock()
+	defer c.wdoor.Unlock()
+	return c.writeLocked(f)
+}
+
+func (c *amqpConn) writeLocked(f *amqpFrame) error {
+	c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	_, err := c.conn.Write(amqpEncodeFrame(f))
+	return err
+}
+
+// Sends empty frames to keep the connection alive
+func (c *amqpConn) heartbeat(d time.Duration) {
+	t := time.NewTicker(d)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-c.done:
+			return
+		}
+		c.wdoor.Lock()
+		c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+		c.conn.Write([]byte{0, 0, 0, 8, 2, 0, 0, 0})
+		c.wdoor.Unlock()
+	}
+}
+
+// Reads and dispatches frames until the connection fails
+func (c *amqpConn) run() {
+	for {
+		f, err := amqpReadFrame(c.rd)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		c.dispatch(f)
+	}
+}
+
+// Terminates the connection with err
+func (c *amqpConn) fail(err error) {
+	c.once.Do(func() {
+		c.door.Lock()
+		c.err = err
+		c.cond.Broadcast()
+		c.door.Unlock()
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+// The error that terminated the connection
+func (c *amqpConn) failed() error {
+	c.door.Lock()
+	defer c.door.Unlock()
+	return c.err
+}
+
+// Closes the connection
+func (c *amqpConn) close() {
+	c.write(&amqpFrame{code: amqpClose})
+	c.fail(errors.New("amqp: connection closed"))
+}
+
+func (c *amqpConn) dispatch(f *amqpFrame) {
+	c.door.Lock()
+	defer c.door.Unlock()
+	defer c.cond.Broadcast()
+	switch f.code {
+	case amqpAttach:
+		l := c.names[amqpString(amqpField(f.fields, 0))]
+		if l == nil {
+			return
+		}
+		h, _ := amqpUint(amqpField(f.fields, 1))
+		c.links[uint32(h)] = l
+		// a refused link is attached without terminus and detached
+		if (l.receiver && amqpField(f.fields, 5) == nil) || (!l.receiver && amqpField(f.fields, 6) == nil) {
+			return
+		}
+		l.attached = true
+		if l.receiver {
+			n, _ := amqpUint(amqpField(f.fields, 9))
+			l.count = uint32(n)
+		}
+	case amqpFlow:
+		in, ok := amqpUint(amqpField(f.fields, 0))
+		if !ok {
+			in = 0
+		}
+		w, _ := amqpUint(amqpField(f.fields, 1))
+		c.window = uint32(in) + uint32(w) - c.nextOut
+		h, ok := amqpUint(amqpField(f.fields, 4))
+		if l := c.links[uint32(h)]; ok && l != nil && !l.receiver {
+			count, _ := amqpUint(amqpField(f.fields, 5))
+			credit, _ := amqpUint(amqpField(f.fields, 6))
+			l.credit = uint32(count) + uint32(credit) - l.count
+		}
+	case amqpTransfer:
+		c.nextIn++
+		c.received++
+		h, _ := amqpUint(amqpField(f.fields, 0))
+		l := c.links[uint32(h)]
+		if l == nil || !l.receiver {
+			return
+		}
+		if id, ok := amqpUint(amqpField(f.fields, 1)); ok && len(l.partial) == 0 {
+			l.partID = uint32(id)
+		}
+		l.partial = append(l.partial, f.payload...)
+		if more, _ := amqpField(f.fields, 5).(bool); more {
+			return
+		}
+		l.count++
+		if l.credit > 0 {
+			l.credit--
+		}
+		m, err := amqpDecodeMessage(l.partial)
+		l.partial = nil
+		if err != nil {
+			l.err = err
+			return
+		}
+		l.queue = append(l.queue, &amqpDelivery{id: l.partID, msg: m})
+		if c.received >= amqpWindow/2 {
+			c.received = 0
+			go c.write(c.flowFrame(nil))
+		}
+	case amqpDisposition:
+		first, _ := amqpUint(amqpField(f.fields, 1))
+		last, ok := amqpUint(amqpField(f.fields, 2))
+		if !ok {
+			last = first
+		}
+		for id := first; id <= last; id++ {
+			c.outcomes[uint32(id)] = amqpField(f.fields, 4)
+		}
+	case amqpDetach:
+		h, _ := amqpUint(amqpField(f.fields, 0))
+		l := c.links[uint32(h)]
+		if l == nil {
+			return
+		}
+		l.err = amqpErr(amqpField(f.fields, 2))
+		if l.err == nil {
+			l.err = errors.New("amqp: link detached")
+		}
+		delete(c.links, uint32(h))
+		if c.names[l.name] == l {
+			delete(c.names, l.name)
+			go c.write(&amqpFrame{code: amqpDetach, fields: []interface{}{l.handle, true}})
+		}
+	case amqpEnd, amqpClose:
+		err := amqpErr(amqpField(f.fields, 0))
+		if err == nil {
+			err = errors.New("amqp: connection closed by peer")
+		}
+		c.err = err
+		go c.fail(err)
+	}
+}
+
+// Flow frame with the state of the session and the link l;
+// must be called with door locked
+func (c *amqpConn) flowFrame(l *amqpLink) *amqpFrame {
+	fields := []interface{}{c.nextIn, uint32(amqpWindow), c.nextOut, uint32(amqpWindow)}
+	if l != nil {
+		fields = append(fields, l.handle, l.count, l.credit)
+	}
+	return &amqpFrame{code: amqpFlow, fields: fields}
+}
+
+// Waits until ready returns true or the timeout expires;
+// must be called with door locked
+func (c *amqpConn) wait(ready func() bool, timeout time.Duration) error {
+	expired := false
+	if timeout > 0 {
+		t := time.AfterFunc(timeout, func() {
+			c.door.Lock()
+			expired = true
+			c.cond.Broadcast()
+			c.door.Unlock()
+		})
+		defer t.Stop()
+	}
+	for !ready() {
+		if c.err != nil {
+			return c.err
+		}
+		if expired {
+			return errors.New("amqp: timeout")
+		}
+		c.cond.Wait()
+	}
+	return nil
+}
+
+// Attaches a link; source and target are addresses,
+// filter is the filter of the source (receivers only)
+func (c *amqpConn) attach(name string, receiver bool, source, target string, filter map[amqpSymbol]interface{}, settled bool) (*amqpLink, error) {
+	c.door.Lock()
+	l := &amqpLink{name: name, handle: c.handles, receiver: receiver}
+	c.handles++
+	c.names[name] = l
+	c.door.Unlock()
+
+	var src []interface{}
+	if filter != nil {
+		src = []interface{}{source, nil, nil, nil, nil, nil, nil, filter}
+	} else {
+		src = []interface{}{source}
+	}
+	sndSettle := uint8(0)
+	if settled {
+		sndSettle = 1
+	}
+	fields := []interface{}{
+		name, l.handle, receiver, sndSettle, uint8(0),
+		amqpList(amqpSource, src...), amqpList(amqpTarget, target),
+		nil, nil, nil,
+	}
+	if !receiver {
+		fields[9] = uint32(0)
+	}
+	err := c.write(&amqpFrame{code: amqpAttach, fields: fields})
+	if err != nil {
+		return nil, err
+	}
+	c.door.Lock()
+	defer c.door.Unlock()
+	err = c.wait(func() bool { return l.attached || l.err != nil }, c.timeout)
+	if err == nil {
+		err = l.err
+	}
+	if err != nil {
+		delete(c.names, name)
+		return nil, err
+	}
+	return l, nil
+}
+
+// Detaches a link
+func (c *amqpConn) detach(l *amqpLink) {
+	c.door.Lock()
+	delete(c.names, l.name)
+	c.door.Unlock()
+	c.write(&amqpFrame{code: amqpDetach, fields: []interface{}{l.handle, true}})
+}
+
+// Grants credit to a receiver
+func (c *amqpConn) flow(l *amqpLink, credit uint32) error {
+	c.door.Lock()
+	l.credit = credit
+	f := c.flowFrame(l)
+	c.door.Unlock()
+	return c.write(f)
+}
+
+// Credit of a receiver and the number of deliveries
+// not yet received
+func (c *amqpConn) credit(l *amqpLink) (uint32, int) {
+	c.door.Lock()
+	defer c.door.Unlock()
+	return l.credit, len(l.queue)
+}
+
+// Returns the next delivery of a receiver
+func (c *amqpConn) receive(l *amqpLink) (*amqpDelivery, error) {
+	c.door.Lock()
+	defer c.door.Unlock()
+	err := c.wait(func() bool { return len(l.queue) > 0 || l.err != nil }, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(l.queue) == 0 {
+		return nil, l.err
+	}
+	d := l.queue[0]
+	l.queue = l.queue[1:]
+	return d, nil
+}
+
+// Settles the deliveries first to last with outcome state
+func (c *amqpConn) settle(first, last uint32, state uint64) error {
+	return c.write(&amqpFrame{code: amqpDisposition, fields: []interface{}{
+		true, first, last, true, amqpList(state),
+	}})
+}
+
+// Transfers a message on a sender; returns the delivery ID
+func (c *amqpConn) transfer(l *amqpLink, m *amqpMessage) (uint32, error) {
+	payload := m.encode()
+	c.door.Lock()
+	err := c.wait(func() bool { return (l.credit > 0 && c.window > 0) || l.err != nil }, c.timeout)
+	if err == nil {
+		err = l.err
+	}
+	if err != nil {
+		c.door.Unlock()
+		return 0, err
+	}
+	id := c.delivery
+	c.delivery++
+	l.credit--
+	l.count++
+	c.door.Unlock()
+
+	tag := binary.BigEndian.AppendUint32(nil, id)
+	chunk := c.maxFrame - 256
+	c.wdoor.Lock()
+	defer c.wdoor.Unlock()
+	first := true
+	for first || len(payload) > 0 {
+		n := len(payload)
+		if n > chunk {
+			n = chunk
+		}
+		fields := []interface{}{l.handle, nil, nil, nil, nil, n < len(payload)}
+		if first {
+			fields[1], fields[2], fields[3], fields[4] = id, tag, m.format, false
+		}
+		err = c.writeLocked(&amqpFrame{code: amqpTransfer, fields: fields, payload: payload[:n]})
+		if err != nil {
+			return 0, err
+		}
+		c.door.Lock()
+		c.nextOut++
+		c.window--
+		c.door.Unlock()
+		payload = payload[n:]
+		first = false
+	}
+	return id, nil
+}
+
+// Waits for the outcome of a delivery;
+// returns the descriptor of the outcome and the error of rejections
+func (c *amqpConn) outcome(id uint32) (uint64, error) {
+	c.door.Lock()
+	defer c.door.Unlock()
+	err := c.wait(func() bool { _, ok := c.outcomes[id]; return ok }, c.timeout)
+	if err != nil {
+		return 0, err
+	}
+	state := c.outcomes[id]
+	delete(c.outcomes, id)
+	code, fields := amqpCode(state)
+	if code == amqpRejected {
+		err = amqpErr(amqpField(fields, 0))
+		if err == nil {
+			err = errors.New("amqp: message rejected")
+		}
+	}
+	return code, err
+}
+
+// Sends a request to the management node of the broker
+// and returns the response
+func (c *amqpConn) request(node string, props map[string]interface{}, value interface{}) (*amqpMessage, error) {
+	reply := fmt.Sprintf("%s-reply-%d", node, time.Now().UnixNano())
+	snd, err := c.attach(reply+"-sender", false, reply, node, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	defer c.detach(snd)
+	rcv, err := c.attach(reply+"-receiver", true, node, reply, nil, true)
+	if err != nil {
+		return nil, err
+	}
+	defer c.detach(rcv)
+	err = c.flow(rcv, 1)
+	if err != nil {
+		return nil, err
+	}
+	id, err := c.transfer(snd, &amqpMessage{id: reply, replyTo: reply, props: props, value: value})
+	if err != nil {
+		return nil, err
+	}
+	if _, err = c.outcome(id); err != nil {
+		return nil, err
+	}
+	d, err := c.receive(rcv)
+	if err != nil {
+		return nil, err
+	}
+	status, _ := amqpUint(d.msg.props["status-code"])
+	if status != 200 {
+		return nil, &AMQPError{Condition: fmt.Sprint(status), Description: amqpString(d.msg.props["status-description"])}
+	}
+	return d.msg, nil
+}
@@ -0,0 +1,77 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// AMQP encoding:
+// - Values are decoded as they were encoded
+// - Messages keep their sections
+// - Frames are read and written
+func TestAMQPCodec(t *testing.T) {
+	now := time.UnixMilli(time.Now().UnixMilli())
+	values := []interface{}{
+		nil, true, false, uint8(7), uint16(300), uint32(70000), uint64(1 << 40),
+		int8(-7), int16(-300), int32(-70000), int64(-1 << 40), 3.5, now,
+		[]byte("bin"), "string", amqpSymbol("symbol"),
+		[]interface{}{"a", uint32(1), []interface{}{}},
+		map[interface{}]interface{}{"k": int64(1), amqpSymbol("s"): "v"},
+		amqpList(amqpSource, "queue", nil),
+	}
+	for _, v := range values {
+		d, rest, err := amqpRead(amqpEncode(v))
+		if err != nil || len(rest) > 0 {
+			t.Errorf("amqpRead %v: %v (%d bytes left)", v, err, len(rest))
+			continue
+		}
+		if tm, ok := v.(time.Time); ok {
+			if !tm.Equal(d.(time.Time)) {
+				t.Errorf("amqpRead: %v decoded as %v", v, d)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(d, v) {
+			t.Errorf("amqpRead: %#v decoded as %#v", v, d)
+		}
+	}
+	if d, _, _ := amqpRead(amqpEncode([]string{"x", "y"})); !reflect.DeepEqual(d, []interface{}{"x", "y"}) {
+		t.Errorf("amqpRead: array decoded as %#v", d)
+	}
+	if _, _, err := amqpRead([]byte{0xb1, 0, 0, 0, 9, 'x'}); err == nil {
+		t.Errorf("amqpRead: short value accepted")
+	}
+
+	m := &amqpMessage{
+		annotations: map[interface{}]interface{}{amqpSymbol("x-opt-offset"): "10"},
+		id:          "id-1",
+		group:       "session",
+		props:       map[string]interface{}{"n": int64(1)},
+		data:        [][]byte{[]byte("hello "), []byte("world")},
+	}
+	d, err := amqpDecodeMessage(m.encode())
+	if err != nil {
+		t.Fatalf("amqpDecodeMessage: %v", err)
+	}
+	if d.annotation("x-opt-offset") != "10" || d.id != "id-1" || d.group != "session" ||
+		d.props["n"] != int64(1) || string(d.body()) != "hello world" {
+		t.Errorf("amqpDecodeMessage: unexpected message %+v", d)
+	}
+
+	var b bytes.Buffer
+	b.Write(amqpEncodeFrame(&amqpFrame{code: amqpTransfer, fields: []interface{}{uint32(1)}, payload: []byte("p")}))
+	b.Write([]byte{0, 0, 0, 8, 2, 0, 0, 0})
+	b.Write(amqpEncodeFrame(&amqpFrame{sasl: true, code: amqpSASLOutcome, fields: []interface{}{uint8(0)}}))
+	rd := bufio.NewReader(&b)
+	f, err := amqpReadFrame(rd)
+	if err != nil || f.code != amqpTransfer || string(f.payload) != "p" || f.fields[0] != uint32(1) {
+		t.Errorf("amqpReadFrame: unexpected frame %+v (%v)", f, err)
+	}
+	f, err = amqpReadFrame(rd)
+	if err != nil || !f.sasl || f.code != amqpSASLOutcome {
+		t.Errorf("amqpReadFrame: heartbeat not skipped: %+v (%v)", f, err)
+	}
+}
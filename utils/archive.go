@@ -0,0 +1,388 @@
+package utils
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+// ArchiveEntry is a file in an archive.
+// Data holds the contents of the file, or, in streaming mode,
+// Body is a reader on the contents, which must be closed.
+// Entries are also used to write archives with TarWriter
+// and ZipWriter; there, Size is needed only with Body.
+type ArchiveEntry struct {
+	Name    string
+	Size    int64
+	Mode    os.FileMode
+	ModTime time.Time
+	Data    []byte
+	Body    io.ReadCloser
+}
+
+// Options common to archive producers
+type archiveFilter struct {
+	patterns []string
+	stream   bool
+}
+
+// Checks name against the patterns
+func (f *archiveFilter) match(name string) bool {
+	if len(f.patterns) == 0 {
+		return true
+	}
+	for _, p := range f.patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+		if ok, _ := path.Match(p, path.Base(name)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Body that signals when it is closed
+type entryBody struct {
+	io.Reader
+	once sync.Once
+	done chan struct{}
+}
+
+func (b *entryBody) Close() error {
+	b.once.Do(func() { close(b.done) })
+	return nil
+}
+
+// TarReader is a Producer that reads a tar archive
+// and sends its regular files as ArchiveEntry down the chain;
+// directories and other entries are skipped.
+// Compressed archives (e.g. .tar.gz) must be decompressed
+// by the io.Reader passed to TarReader.
+type TarReader struct {
+	conduit.Cancelable
+	archiveFilter
+	rd io.Reader
+}
+
+// NewTarReader creates a new TarReader Producer.
+func NewTarReader(r io.Reader) (tr *TarReader) {
+	tr = new(TarReader)
+	if tr != nil {
+		tr.rd = r
+	}
+	return
+}
+
+// Match restricts the files to those matching one of the glob patterns
+// (see path.Match), either with their full name or their base name.
+func (tr *TarReader) Match(patterns ...string) *TarReader {
+	tr.patterns = patterns
+	return tr
+}
+
+// Stream sends entries with Body instead of Data.
+// Since tar archives are read sequentially,
+// the producer waits until the Body of an entry is closed
+// before it continues with the next entry.
+func (tr *TarReader) Stream() *TarReader {
+	tr.stream = true
+	return tr
+}
+
+// Produce is the pre-defined method that makes TarReader a Producer.
+func (tr *TarReader) Produce(trg conduit.Target) error {
+	r := tar.NewReader(tr.rd)
+	for !tr.Canceled() {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg || !tr.match(hdr.Name) {
+			continue
+		}
+		e := &ArchiveEntry{
+			Name:    hdr.Name,
+			Size:    hdr.Size,
+			Mode:    hdr.FileInfo().Mode(),
+			ModTime: hdr.ModTime,
+		}
+		if !tr.stream {
+			e.Data, err = ioutil.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			trg <- e
+			continue
+		}
+		body := &entryBody{Reader: r, done: make(chan struct{})}
+		e.Body = body
+		trg <- e
+		<-body.done
+	}
+	return nil
+}
+
+// ZipReader is a Producer that reads a zip archive
+// and sends its files as ArchiveEntry down the chain;
+// directories are skipped.
+type ZipReader struct {
+	conduit.Cancelable
+	archiveFilter
+	rd   io.ReaderAt
+	size int64
+}
+
+// NewZipReader creates a new ZipReader Producer
+// reading an archive of the given size, e.g. an os.File.
+func NewZipReader(r io.ReaderAt, size int64) (zr *ZipReader) {
+	zr = new(ZipReader)
+	if zr != nil {
+		zr.rd = r
+		zr.size = size
+	}
+	return
+}
+
+// Match restricts the files to those matching one of the glob patterns
+// (see path.Match), either with their full name or their base name.
+func (zr *ZipReader) Match(patterns ...string) *ZipReader {
+	zr.patterns = patterns
+	return zr
+}
+
+// Stream sends entries with Body instead of Data.
+// Bodies may be read in any order and concurrently.
+func (zr *ZipReader) Stream() *ZipReader {
+	zr.stream = true
+	return zr
+}
+
+// Produce is the pre-defined method that makes ZipReader a Producer.
+func (zr *ZipReader) Produce(trg conduit.Target) error {
+	r, err := zip.NewReader(zr.rd, zr.size)
+	if err != nil {
+		return err
+	}
+	for _, f := range r.File {
+		if zr.Canceled() {
+			break
+		}
+		if f.FileInfo().IsDir() || !zr.match(f.Name) {
+			continue
+		}
+		body, err := f.Open()
+		if err != nil {
+			return err
+		}
+		e := &ArchiveEntry{
+			Name:    f.Name,
+			Size:    int64(f.UncompressedSize64),
+			Mode:    f.Mode(),
+			ModTime: f.Modified,
+		}
+		if zr.stream {
+			e.Body = body
+		} else {
+			e.Data, err = ioutil.ReadAll(body)
+			body.Close()
+			if err != nil {
+				return err
+			}
+		}
+		trg <- e
+	}
+	return nil
+}
+
+// Returns the contents of an entry as reader and its size;
+// a Body of unknown size is read completely
+func (e *ArchiveEntry) contents() (io.Reader, int64, error) {
+	if e.Body == nil {
+		return bytes.NewReader(e.Data), int64(len(e.Data)), nil
+	}
+	if e.Size > 0 {
+		return io.LimitReader(e.Body, e.Size), e.Size, nil
+	}
+	data, err := ioutil.ReadAll(e.Body)
+	return bytes.NewReader(data), int64(len(data)), err
+}
+
+// Returns the mode of an entry or the default
+func (e *ArchiveEntry) mode() os.FileMode {
+	if e.Mode == 0 {
+		return 0644
+	}
+	return e.Mode
+}
+
+// Converts incoming items to entries
+func archiveEntry(inp interface{}) (*ArchiveEntry, error) {
+	switch e := inp.(type) {
+	case *ArchiveEntry:
+		return e, nil
+	case ArchiveEntry:
+		return &e, nil
+	}
+	return nil, errors.New(fmt.Sprintf("cannot archive %T", inp))
+}
+
+// TarWriter is a Consumer that writes incoming ArchiveEntry
+// (with Data or Body, which is closed after writing)
+// as files into a tar archive.
+// Entries without ModTime get the current time.
+// To create a compressed archive, pass a compressing writer
+// (e.g. gzip.Writer) to TarWriter and close it after the chain has run.
+type TarWriter struct {
+	wt io.Writer
+}
+
+// NewTarWriter creates a new TarWriter Consumer.
+func NewTarWriter(w io.Writer) (tw *TarWriter) {
+	tw = new(TarWriter)
+	if tw != nil {
+		tw.wt = w
+	}
+	return
+}
+
+// Consume is the pre-defined method that makes TarWriter a Consumer.
+// Consume terminates with an error if an item is not an ArchiveEntry.
+func (tw *TarWriter) Consume(src conduit.Source) error {
+	w := tar.NewWriter(tw.wt)
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			err := w.Flush()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		e, err := archiveEntry(inp)
+		if err != nil {
+			return err
+		}
+		err = tw.write(w, e)
+		if e.Body != nil {
+			e.Body.Close()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return w.Close()
+}
+
+// Writes one entry
+func (tw *TarWriter) write(w *tar.Writer, e *ArchiveEntry) error {
+	r, size, err := e.contents()
+	if err != nil {
+		return err
+	}
+	mtime := e.ModTime
+	if mtime.IsZero() {
+		mtime = time.Now()
+	}
+	err = w.WriteHeader(&tar.Header{
+		Name:     e.Name,
+		Typeflag: tar.TypeReg,
+		Mode:     int64(e.mode().Perm()),
+		Size:     size,
+		ModTime:  mtime,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+// ZipWriter is a Consumer that writes incoming ArchiveEntry
+// (with Data or Body, which is closed after writing)
+// as files into a zip archive.
+// Entries without ModTime get the current time.
+type ZipWriter struct {
+	wt     io.Writer
+	method func(name string) uint16
+}
+
+// NewZipWriter creates a new ZipWriter Consumer
+// compressing all files with zip.Deflate.
+func NewZipWriter(w io.Writer) (zw *ZipWriter) {
+	zw = new(ZipWriter)
+	if zw != nil {
+		zw.wt = w
+		zw.method = func(string) uint16 { return zip.Deflate }
+	}
+	return
+}
+
+// SetMethod sets the compression method per file,
+// e.g. zip.Store for files that are already compressed.
+func (zw *ZipWriter) SetMethod(method func(name string) uint16) *ZipWriter {
+	zw.method = method
+	return zw
+}
+
+// Consume is the pre-defined method that makes ZipWriter a Consumer.
+// Consume terminates with an error if an item is not an ArchiveEntry.
+func (zw *ZipWriter) Consume(src conduit.Source) error {
+	w := zip.NewWriter(zw.wt)
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			err := w.Flush()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		e, err := archiveEntry(inp)
+		if err != nil {
+			return err
+		}
+		err = zw.write(w, e)
+		if e.Body != nil {
+			e.Body.Close()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return w.Close()
+}
+
+// Writes one entry
+func (zw *ZipWriter) write(w *zip.Writer, e *ArchiveEntry) error {
+	hdr := &zip.FileHeader{
+		Name:     e.Name,
+		Method:   zw.method(e.Name),
+		Modified: e.ModTime,
+	}
+	if hdr.Modified.IsZero() {
+		hdr.Modified = time.Now()
+	}
+	hdr.SetMode(e.mode())
+	fw, err := w.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	var r io.Reader = bytes.NewReader(e.Data)
+	if e.Body != nil {
+		r = e.Body
+	}
+	_, err = io.Copy(fw, r)
+	return err
+}
@@ -0,0 +1,181 @@
+package utils
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/toschoo/conduit"
+)
+
+// EntryConsumer collects entries by name,
+// reading and closing bodies
+type EntryConsumer struct {
+	files map[string]string
+	order []string
+}
+
+func (c *EntryConsumer) Consume(src conduit.Source) error {
+	c.files = make(map[string]string)
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			continue
+		}
+		e := inp.(*ArchiveEntry)
+		data := e.Data
+		if e.Body != nil {
+			var err error
+			data, err = ioutil.ReadAll(e.Body)
+			e.Body.Close()
+			if err != nil {
+				return err
+			}
+		}
+		c.files[e.Name] = string(data)
+		c.order = append(c.order, e.Name)
+	}
+	return nil
+}
+
+var archiveFiles = []struct{ name, body string }{
+	{"a.txt", "first file"},
+	{"data/b.csv", "x,y\n1,2\n"},
+	{"data/c.txt", "third file"},
+	{"d.bin", "\x00\x01\x02"},
+}
+
+func makeTar() []byte {
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	w.WriteHeader(&tar.Header{Name: "data/", Typeflag: tar.TypeDir, Mode: 0755})
+	for _, f := range archiveFiles {
+		w.WriteHeader(&tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.body))})
+		w.Write([]byte(f.body))
+	}
+	w.Close()
+	return buf.Bytes()
+}
+
+func makeZip() []byte {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	w.Create("data/")
+	for _, f := range archiveFiles {
+		fw, _ := w.Create(f.name)
+		fw.Write([]byte(f.body))
+	}
+	w.Close()
+	return buf.Bytes()
+}
+
+// Archive producers:
+// - All files of tar and zip archives are read in order
+// - Directories are skipped
+// - Files are filtered by glob patterns
+// - in both, full and streaming mode
+func TestArchiveReader(t *testing.T) {
+	for _, stream := range []bool{false, true} {
+		for _, patterns := range [][]string{nil, {"*.txt"}, {"data/*"}} {
+			tr := NewTarReader(bytes.NewReader(makeTar())).Match(patterns...)
+			z := makeZip()
+			zr := NewZipReader(bytes.NewReader(z), int64(len(z))).Match(patterns...)
+			if stream {
+				tr.Stream()
+				zr.Stream()
+			}
+			for _, p := range []conduit.Producer{tr, zr} {
+				err := testArchiveReader(p, patterns)
+				if err != nil {
+					m := fmt.Sprintf("ArchiveReader failed (%T, %v, %t): %v", p, patterns, stream, err)
+					t.Error(m)
+				}
+			}
+		}
+	}
+}
+
+func testArchiveReader(p conduit.Producer, patterns []string) error {
+	c := new(EntryConsumer)
+	chn := conduit.NewChain(p, nil, c, small)
+	err := chn.Run()
+	if err != nil {
+		m := fmt.Sprintf("error on running chain: %v", chn.Errs)
+		return errors.New(m)
+	}
+	f := archiveFilter{patterns: patterns}
+	var want []string
+	for _, file := range archiveFiles {
+		if f.match(file.name) {
+			want = append(want, file.name)
+			if c.files[file.name] != file.body {
+				m := fmt.Sprintf("unexpected contents of %s: '%s'", file.name, c.files[file.name])
+				return errors.New(m)
+			}
+		}
+	}
+	if fmt.Sprint(c.order) != fmt.Sprint(want) {
+		m := fmt.Sprintf("expected %v, have %v", want, c.order)
+		return errors.New(m)
+	}
+	return nil
+}
+
+// Archive writers:
+// - Entries are written to tar and zip archives and read back
+// - Streamed entries are copied from archive to archive
+// - Compression methods are set per file
+func TestArchiveWriter(t *testing.T) {
+	entries := make([]interface{}, len(archiveFiles))
+	for i, f := range archiveFiles {
+		entries[i] = &ArchiveEntry{Name: f.name, Data: []byte(f.body)}
+	}
+
+	var tbuf bytes.Buffer
+	chn := conduit.NewChain(&AnyProducer{entries}, nil, NewTarWriter(&tbuf), small)
+	err := chn.Run()
+	if err != nil {
+		t.Fatalf("ArchiveWriter failed on tar: %v", chn.Errs)
+	}
+	err = testArchiveReader(NewTarReader(&tbuf), nil)
+	if err != nil {
+		t.Errorf("ArchiveWriter failed on tar: %v", err)
+	}
+
+	var zbuf bytes.Buffer
+	zw := NewZipWriter(&zbuf).SetMethod(func(name string) uint16 {
+		if strings.HasSuffix(name, ".bin") {
+			return zip.Store
+		}
+		return zip.Deflate
+	})
+	chn = conduit.NewChain(NewTarReader(bytes.NewReader(makeTar())).Stream(), nil, zw, small)
+	err = chn.Run()
+	if err != nil {
+		t.Fatalf("ArchiveWriter failed on zip: %v", chn.Errs)
+	}
+	z := zbuf.Bytes()
+	err = testArchiveReader(NewZipReader(bytes.NewReader(z), int64(len(z))), nil)
+	if err != nil {
+		t.Errorf("ArchiveWriter failed on zip: %v", err)
+	}
+	r, _ := zip.NewReader(bytes.NewReader(z), int64(len(z)))
+	for _, f := range r.File {
+		want := uint16(zip.Deflate)
+		if strings.HasSuffix(f.Name, ".bin") {
+			want = zip.Store
+		}
+		if f.Method != want {
+			t.Errorf("ArchiveWriter: %s has method %d, expected %d", f.Name, f.Method, want)
+		}
+	}
+
+	chn = conduit.NewChain(&AnyProducer{[]interface{}{"no entry"}}, nil, NewZipWriter(new(bytes.Buffer)), small)
+	if chn.Run() == nil {
+		t.Errorf("ArchiveWriter: invalid item not reported")
+	}
+}
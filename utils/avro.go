@@ -0,0 +1,704 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"strings"
+)
+
+// avroType is a parsed Avro schema
+type avroType struct {
+	kind    string // null, boolean, int, long, float, double, bytes, string, record, enum, array, map, union, fixed
+	name    string // full name of named types
+	fields  []*avroField
+	items   *avroType // array
+	values  *avroType // map
+	union   []*avroType
+	symbols []string
+	dflt    string // enum default
+	size    int    // fixed
+}
+
+// avroField is a field of a record
+type avroField struct {
+	name   string
+	typ    *avroType
+	def    interface{}
+	hasDef bool
+}
+
+var avroPrimitives = map[string]bool{
+	"null": true, "boolean": true, "int": true, "long": true,
+	"float": true, "double": true, "bytes": true, "string": true,
+}
+
+// Parses an Avro schema in JSON notation
+func parseAvroSchema(schema string) (*avroType, error) {
+	var v interface{}
+	err := json.Unmarshal([]byte(schema), &v)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("invalid schema: %v", err))
+	}
+	return parseAvroType(v, "", make(map[string]*avroType))
+}
+
+// Full name of a named type
+func avroName(name, ns string) string {
+	if strings.Contains(name, ".") || ns == "" {
+		return name
+	}
+	return ns + "." + name
+}
+
+func parseAvroType(v interface{}, ns string, names map[string]*avroType) (*avroType, error) {
+	switch x := v.(type) {
+	case string:
+		if avroPrimitives[x] {
+			return &avroType{kind: x}, nil
+		}
+		if t, ok := names[avroName(x, ns)]; ok {
+			return t, nil
+		}
+		if t, ok := names[x]; ok {
+			return t, nil
+		}
+		return nil, errors.New(fmt.Sprintf("unknown type '%s'", x))
+	case []interface{}:
+		t := &avroType{kind: "union"}
+		for _, b := range x {
+			bt, err := parseAvroType(b, ns, names)
+			if err != nil {
+				return nil, err
+			}
+			t.union = append(t.union, bt)
+		}
+		return t, nil
+	case map[string]interface{}:
+		return parseAvroComplex(x, ns, names)
+	}
+	return nil, errors.New(fmt.Sprintf("invalid schema element %v", v))
+}
+
+func parseAvroComplex(x map[string]interface{}, ns string, names map[string]*avroType) (*avroType, error) {
+	kind, _ := x["type"].(string)
+	if kind == "" {
+		// {"type": {...}} or {"type": [...]}
+		if inner, ok := x["type"]; ok {
+			return parseAvroType(inner, ns, names)
+		}
+		return nil, errors.New("schema element without type")
+	}
+	t := &avroType{kind: kind}
+	switch kind {
+	case "record", "error", "enum", "fixed":
+		name, _ := x["name"].(string)
+		if name == "" {
+			return nil, errors.New(fmt.Sprintf("%s without name", kind))
+		}
+		if s, ok := x["namespace"].(string); ok {
+			ns = s
+		}
+		t.name = avroName(name, ns)
+		if i := strings.LastIndex(t.name, "."); i >= 0 {
+			ns = t.name[:i]
+		}
+		names[t.name] = t
+	}
+	switch kind {
+	case "record", "error":
+		t.kind = "record"
+		fs, _ := x["fields"].([]interface{})
+		for _, f := range fs {
+			fm, ok := f.(map[string]interface{})
+			if !ok {
+				return nil, errors.New(fmt.Sprintf("invalid field in %s", t.name))
+			}
+			fname, _ := fm["name"].(string)
+			ft, err := parseAvroType(fm["type"], ns, names)
+			if err != nil {
+				return nil, err
+			}
+			def, hasDef := fm["default"]
+			t.fields = append(t.fields, &avroField{fname, ft, def, hasDef})
+		}
+	case "enum":
+		syms, _ := x["symbols"].([]interface{})
+		for _, s := range syms {
+			t.symbols = append(t.symbols, fmt.Sprintf("%v", s))
+		}
+		t.dflt, _ = x["default"].(string)
+	case "fixed":
+		size, _ := x["size"].(float64)
+		t.size = int(size)
+	case "array":
+		it, err := parseAvroType(x["items"], ns, names)
+		if err != nil {
+			return nil, err
+		}
+		t.items = it
+	case "map":
+		vt, err := parseAvroType(x["values"], ns, names)
+		if err != nil {
+			return nil, err
+		}
+		t.values = vt
+	default:
+		if !avroPrimitives[kind] {
+			return parseAvroType(kind, ns, names)
+		}
+		// primitive, possibly with logical type
+	}
+	return t, nil
+}
+
+// avroReader reads Avro binary data
+type avroReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+func readAvroLong(rd avroReader) (int64, error) {
+	return binary.ReadVarint(rd) // zig-zag as in Avro
+}
+
+func readAvroBytes(rd avroReader) ([]byte, error) {
+	n, err := readAvroLong(rd)
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 {
+		return nil, errors.New("negative length")
+	}
+	buf := make([]byte, n)
+	_, err = io.ReadFull(rd, buf)
+	return buf, err
+}
+
+// Tells whether a writer type can be read as reader type
+func avroPromotes(w, r string) bool {
+	switch w {
+	case "int":
+		return r == "long" || r == "float" || r == "double"
+	case "long":
+		return r == "float" || r == "double"
+	case "float":
+		return r == "double"
+	case "string":
+		return r == "bytes"
+	case "bytes":
+		return r == "string"
+	}
+	return false
+}
+
+// Tells whether writer type w matches reader type r
+func avroMatches(w, r *avroType, promote bool) bool {
+	if w.kind != r.kind {
+		return promote && avroPromotes(w.kind, r.kind)
+	}
+	switch w.kind {
+	case "record", "enum", "fixed":
+		return avroShortName(w.name) == avroShortName(r.name)
+	}
+	return true
+}
+
+func avroShortName(name string) string {
+	return name[strings.LastIndex(name, ".")+1:]
+}
+
+// Reads a value written with schema w as value of schema r
+func readAvro(rd avroReader, w, r *avroType) (interface{}, error) {
+	if w.kind == "union" {
+		idx, err := readAvroLong(rd)
+		if err != nil {
+			return nil, err
+		}
+		if idx < 0 || int(idx) >= len(w.union) {
+			return nil, errors.New(fmt.Sprintf("invalid union index %d", idx))
+		}
+		return readAvro(rd, w.union[idx], r)
+	}
+	if r.kind == "union" {
+		for _, promote := range []bool{false, true} {
+			for _, b := range r.union {
+				if avroMatches(w, b, promote) {
+					return readAvro(rd, w, b)
+				}
+			}
+		}
+		return nil, errors.New(fmt.Sprintf("%s does not match reader union", w.kind))
+	}
+	if !avroMatches(w, r, true) {
+		return nil, errors.New(fmt.Sprintf("cannot read %s %s as %s %s", w.kind, w.name, r.kind, r.name))
+	}
+
+	switch w.kind {
+	case "null":
+		return nil, nil
+	case "boolean":
+		b, err := rd.ReadByte()
+		return b != 0, err
+	case "int", "long":
+		n, err := readAvroLong(rd)
+		if err != nil {
+			return nil, err
+		}
+		switch r.kind {
+		case "int":
+			return int32(n), nil
+		case "long":
+			return n, nil
+		case "float":
+			return float32(n), nil
+		}
+		return float64(n), nil
+	case "float":
+		var buf [4]byte
+		_, err := io.ReadFull(rd, buf[:])
+		f := math.Float32frombits(binary.LittleEndian.Uint32(buf[:]))
+		if r.kind == "double" {
+			return float64(f), err
+		}
+		return f, err
+	case "double":
+		var buf [8]byte
+		_, err := io.ReadFull(rd, buf[:])
+		return math.Float64frombits(binary.LittleEndian.Uint64(buf[:])), err
+	case "bytes", "string":
+		buf, err := readAvroBytes(rd)
+		if err != nil {
+			return nil, err
+		}
+		if r.kind == "string" {
+			return string(buf), nil
+		}
+		return buf, nil
+	case "fixed":
+		if w.size != r.size {
+			return nil, errors.New(fmt.Sprintf("fixed %s: size differs", w.name))
+		}
+		buf := make([]byte, w.size)
+		_, err := io.ReadFull(rd, buf)
+		return buf, err
+	case "enum":
+		idx, err := readAvroLong(rd)
+		if err != nil {
+			return nil, err
+		}
+		if idx < 0 || int(idx) >= len(w.symbols) {
+			return nil, errors.New(fmt.Sprintf("invalid enum index %d", idx))
+		}
+		sym := w.symbols[idx]
+		for _, s := range r.symbols {
+			if s == sym {
+				return sym, nil
+			}
+		}
+		if r.dflt != "" {
+			return r.dflt, nil
+		}
+		return nil, errors.New(fmt.Sprintf("unknown symbol %s in %s", sym, r.name))
+	case "array":
+		var arr []interface{}
+		err := readAvroBlocks(rd, func() error {
+			v, err := readAvro(rd, w.items, r.items)
+			arr = append(arr, v)
+			return err
+		})
+		if arr == nil {
+			arr = []interface{}{}
+		}
+		return arr, err
+	case "map":
+		m := make(map[string]interface{})
+		err := readAvroBlocks(rd, func() error {
+			k, err := readAvroBytes(rd)
+			if err != nil {
+				return err
+			}
+			v, err := readAvro(rd, w.values, r.values)
+			m[string(k)] = v
+			return err
+		})
+		return m, err
+	case "record":
+		return readAvroRecord(rd, w, r)
+	}
+	return nil, errors.New(fmt.Sprintf("unsupported type %s", w.kind))
+}
+
+// Reads array and map blocks
+func readAvroBlocks(rd avroReader, item func() error) error {
+	for {
+		n, err := readAvroLong(rd)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+		if n < 0 {
+			n = -n
+			_, err = readAvroLong(rd) // block size
+			if err != nil {
+				return err
+			}
+		}
+		for i := int64(0); i < n; i++ {
+			err = item()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func readAvroRecord(rd avroReader, w, r *avroType) (interface{}, error) {
+	rec := make(map[string]interface{}, len(r.fields))
+	seen := make(map[string]bool, len(w.fields))
+	for _, wf := range w.fields {
+		seen[wf.name] = true
+		var rf *avroField
+		for _, f := range r.fields {
+			if f.name == wf.name {
+				rf = f
+				break
+			}
+		}
+		if rf == nil { // not in reader schema: skip
+			_, err := readAvro(rd, wf.typ, wf.typ)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		v, err := readAvro(rd, wf.typ, rf.typ)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("%s.%s: %v", w.name, wf.name, err))
+		}
+		rec[rf.name] = v
+	}
+	for _, rf := range r.fields {
+		if seen[rf.name] {
+			continue
+		}
+		if !rf.hasDef {
+			return nil, errors.New(fmt.Sprintf("%s.%s: missing and without default", r.name, rf.name))
+		}
+		v, err := avroDefault(rf.def, rf.typ)
+		if err != nil {
+			return nil, err
+		}
+		rec[rf.name] = v
+	}
+	return rec, nil
+}
+
+// Converts a default value in JSON notation
+func avroDefault(def interface{}, t *avroType) (interface{}, error) {
+	switch t.kind {
+	case "union":
+		return avroDefault(def, t.union[0])
+	case "null":
+		return nil, nil
+	case "boolean":
+		b, ok := def.(bool)
+		if !ok {
+			break
+		}
+		return b, nil
+	case "int", "long", "float", "double":
+		f, ok := def.(float64)
+		if !ok {
+			break
+		}
+		switch t.kind {
+		case "int":
+			return int32(f), nil
+		case "long":
+			return int64(f), nil
+		case "float":
+			return float32(f), nil
+		}
+		return f, nil
+	case "string", "enum":
+		s, ok := def.(string)
+		if !ok {
+			break
+		}
+		return s, nil
+	case "bytes", "fixed":
+		s, ok := def.(string)
+		if !ok {
+			break
+		}
+		return []byte(s), nil
+	case "array":
+		a, ok := def.([]interface{})
+		if !ok {
+			break
+		}
+		arr := make([]interface{}, len(a))
+		for i := range a {
+			v, err := avroDefault(a[i], t.items)
+			if err != nil {
+				return nil, err
+			}
+			arr[i] = v
+		}
+		return arr, nil
+	case "map":
+		m, ok := def.(map[string]interface{})
+		if !ok {
+			break
+		}
+		res := make(map[string]interface{}, len(m))
+		for k, x := range m {
+			v, err := avroDefault(x, t.values)
+			if err != nil {
+				return nil, err
+			}
+			res[k] = v
+		}
+		return res, nil
+	case "record":
+		m, ok := def.(map[string]interface{})
+		if !ok {
+			break
+		}
+		rec := make(map[string]interface{}, len(t.fields))
+		for _, f := range t.fields {
+			x, ok := m[f.name]
+			if !ok {
+				x = f.def
+			}
+			v, err := avroDefault(x, f.typ)
+			if err != nil {
+				return nil, err
+			}
+			rec[f.name] = v
+		}
+		return rec, nil
+	}
+	return nil, errors.New(fmt.Sprintf("invalid default %v for %s", def, t.kind))
+}
+
+// Writes v with schema t
+func writeAvro(buf *bytes.Buffer, t *avroType, v interface{}) error {
+	var tmp [binary.MaxVarintLen64]byte
+	putLong := func(n int64) {
+		buf.Write(tmp[:binary.PutVarint(tmp[:], n)])
+	}
+	switch t.kind {
+	case "null":
+		if v != nil {
+			break
+		}
+		return nil
+	case "boolean":
+		b, ok := v.(bool)
+		if !ok {
+			break
+		}
+		if b {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+		return nil
+	case "int", "long":
+		n, ok := avroInt(v)
+		if !ok {
+			break
+		}
+		putLong(n)
+		return nil
+	case "float":
+		f, ok := avroFloat(v)
+		if !ok {
+			break
+		}
+		binary.Write(buf, binary.LittleEndian, math.Float32bits(float32(f)))
+		return nil
+	case "double":
+		f, ok := avroFloat(v)
+		if !ok {
+			break
+		}
+		binary.Write(buf, binary.LittleEndian, math.Float64bits(f))
+		return nil
+	case "bytes", "string":
+		var b []byte
+		switch x := v.(type) {
+		case []byte:
+			b = x
+		case string:
+			b = []byte(x)
+		default:
+			return avroTypeErr(t, v)
+		}
+		putLong(int64(len(b)))
+		buf.Write(b)
+		return nil
+	case "fixed":
+		b, ok := v.([]byte)
+		if !ok || len(b) != t.size {
+			break
+		}
+		buf.Write(b)
+		return nil
+	case "enum":
+		s, ok := v.(string)
+		if !ok {
+			break
+		}
+		for i, sym := range t.symbols {
+			if sym == s {
+				putLong(int64(i))
+				return nil
+			}
+		}
+		return errors.New(fmt.Sprintf("unknown symbol %s in %s", s, t.name))
+	case "array":
+		rv := reflect.ValueOf(v)
+		if v == nil || (rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array) {
+			break
+		}
+		if rv.Len() > 0 {
+			putLong(int64(rv.Len()))
+			for i := 0; i < rv.Len(); i++ {
+				err := writeAvro(buf, t.items, rv.Index(i).Interface())
+				if err != nil {
+					return err
+				}
+			}
+		}
+		putLong(0)
+		return nil
+	case "map":
+		rv := reflect.ValueOf(v)
+		if v == nil || rv.Kind() != reflect.Map || rv.Type().Key().Kind() != reflect.String {
+			break
+		}
+		if rv.Len() > 0 {
+			putLong(int64(rv.Len()))
+			for _, k := range rv.MapKeys() {
+				putLong(int64(len(k.String())))
+				buf.WriteString(k.String())
+				err := writeAvro(buf, t.values, rv.MapIndex(k).Interface())
+				if err != nil {
+					return err
+				}
+			}
+		}
+		putLong(0)
+		return nil
+	case "union":
+		for i, b := range t.union {
+			if avroFits(b, v) {
+				putLong(int64(i))
+				return writeAvro(buf, b, v)
+			}
+		}
+	case "record":
+		rec, ok := v.(map[string]interface{})
+		if !ok {
+			break
+		}
+		for _, f := range t.fields {
+			x, ok := rec[f.name]
+			if !ok && f.hasDef {
+				var err error
+				x, err = avroDefault(f.def, f.typ)
+				if err != nil {
+					return err
+				}
+			}
+			err := writeAvro(buf, f.typ, x)
+			if err != nil {
+				return errors.New(fmt.Sprintf("%s.%s: %v", t.name, f.name, err))
+			}
+		}
+		return nil
+	}
+	return avroTypeErr(t, v)
+}
+
+func avroTypeErr(t *avroType, v interface{}) error {
+	return errors.New(fmt.Sprintf("cannot write %T as %s", v, t.kind))
+}
+
+// Tells whether v can be written as union branch t
+func avroFits(t *avroType, v interface{}) bool {
+	switch t.kind {
+	case "null":
+		return v == nil
+	case "boolean":
+		_, ok := v.(bool)
+		return ok
+	case "int", "long":
+		_, ok := avroInt(v)
+		return ok
+	case "float", "double":
+		_, ok := avroFloat(v)
+		return ok
+	case "string", "enum":
+		_, ok := v.(string)
+		return ok
+	case "bytes":
+		_, ok := v.([]byte)
+		return ok
+	case "fixed":
+		b, ok := v.([]byte)
+		return ok && len(b) == t.size
+	case "record":
+		_, ok := v.(map[string]interface{})
+		return ok
+	case "array":
+		k := reflect.ValueOf(v).Kind()
+		return v != nil && (k == reflect.Slice || k == reflect.Array)
+	case "map":
+		return v != nil && reflect.ValueOf(v).Kind() == reflect.Map
+	}
+	return false
+}
+
+func avroInt(v interface{}) (int64, bool) {
+	switch x := v.(type) {
+	case int:
+		return int64(x), true
+	case int8:
+		return int64(x), true
+	case int16:
+		return int64(x), true
+	case int32:
+		return int64(x), true
+	case int64:
+		return x, true
+	case uint8:
+		return int64(x), true
+	case uint16:
+		return int64(x), true
+	case uint32:
+		return int64(x), true
+	}
+	return 0, false
+}
+
+func avroFloat(v interface{}) (float64, bool) {
+	switch x := v.(type) {
+	case float32:
+		return float64(x), true
+	case float64:
+		return x, true
+	}
+	n, ok := avroInt(v)
+	return float64(n), ok
+}
@@ -0,0 +1,183 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/toschoo/conduit"
+)
+
+const avroSchema = `{
+	"type": "record", "name": "Sample", "namespace": "test",
+	"fields": [
+		{"name": "x", "type": "int"},
+		{"name": "y", "type": "long"},
+		{"name": "name", "type": "string"},
+		{"name": "tags", "type": {"type": "array", "items": "string"}},
+		{"name": "kind", "type": {"type": "enum", "name": "Kind", "symbols": ["A", "B"]}},
+		{"name": "opt", "type": ["null", "double"]},
+		{"name": "attrs", "type": {"type": "map", "values": "int"}},
+		{"name": "next", "type": ["null", "test.Sample"], "default": null}
+	]
+}`
+
+// reads y as double, drops name, adds z, reorders the union
+const avroReaderSchema = `{
+	"type": "record", "name": "Sample",
+	"fields": [
+		{"name": "x", "type": "int"},
+		{"name": "y", "type": "double"},
+		{"name": "tags", "type": {"type": "array", "items": "string"}},
+		{"name": "kind", "type": {"type": "enum", "name": "Kind", "symbols": ["B", "A", "C"]}},
+		{"name": "opt", "type": ["double", "null"]},
+		{"name": "attrs", "type": {"type": "map", "values": "long"}},
+		{"name": "z", "type": "int", "default": 7},
+		{"name": "next", "type": ["null", "Sample"], "default": null}
+	]
+}`
+
+func makeAvroRecords(n int) []interface{} {
+	recs := make([]interface{}, n)
+	for i := range recs {
+		r := map[string]interface{}{
+			"x":     int32(i),
+			"y":     int64(-i) << 40,
+			"name":  fmt.Sprintf("sample %d", i),
+			"tags":  []interface{}{},
+			"kind":  "A",
+			"opt":   nil,
+			"attrs": map[string]interface{}{},
+			"next":  nil,
+		}
+		if i%2 == 0 {
+			r["tags"] = []interface{}{"even", fmt.Sprintf("%d", i)}
+			r["kind"] = "B"
+			r["opt"] = float64(i) / 2
+			r["attrs"] = map[string]interface{}{"i": int32(i)}
+		}
+		if i%3 == 0 && i > 0 {
+			r["next"] = recs[i-1]
+		}
+		recs[i] = r
+	}
+	return recs
+}
+
+// Avro:
+// - Records are written and read back without errors
+// - with both codecs and several blocks
+// - The records read equal the records written
+// - Records are resolved to a reader schema
+func TestAvroChain(t *testing.T) {
+	for i := 0; i < numOfTests; i++ {
+		for _, codec := range []string{"null", "deflate"} {
+			err := testAvroChain(i, codec)
+			if err != nil {
+				m := fmt.Sprintf("AvroChain failed: %v", err)
+				t.Error(m)
+			}
+		}
+	}
+}
+
+// Avro with invalid data:
+// - Invalid schemas are rejected
+// - Records not matching the schema are reported
+// - Non-Avro input is reported
+func TestErrAvroChain(t *testing.T) {
+	_, err := NewAvroWriter(new(bytes.Buffer), `{"type": "record"}`, "null")
+	if err == nil {
+		t.Errorf("ErrAvroChain: invalid schema accepted")
+	}
+	w, err := NewAvroWriter(new(bytes.Buffer), avroSchema, "null")
+	if err != nil {
+		t.Fatalf("ErrAvroChain: %v", err)
+	}
+	p := &AnyProducer{[]interface{}{map[string]interface{}{"x": "a"}}}
+	chn := conduit.NewChain(p, nil, w, small)
+	if chn.Run() == nil {
+		t.Errorf("ErrAvroChain: invalid record accepted")
+	}
+	r, _ := NewAvroReader(bytes.NewReader([]byte("not avro")), "")
+	chn = conduit.NewChain(r, nil, new(AnyConsumer), small)
+	if chn.Run() == nil {
+		t.Errorf("ErrAvroChain: invalid file accepted")
+	}
+}
+
+func testAvroChain(n int, codec string) error {
+
+	recs := makeAvroRecords(n)
+
+	var buf bytes.Buffer
+	w, err := NewAvroWriter(&buf, avroSchema, codec)
+	if err != nil {
+		return err
+	}
+	w.SetBlockSize(1 + n/3)
+	chn := conduit.NewChain(&AnyProducer{recs}, nil, w, small)
+	err = chn.Run()
+	if err != nil {
+		m := fmt.Sprintf("error on writing: %v", chn.Errs)
+		return errors.New(m)
+	}
+	data := buf.Bytes()
+
+	r, err := NewAvroReader(bytes.NewReader(data), "")
+	if err != nil {
+		return err
+	}
+	c := new(AnyConsumer)
+	chn = conduit.NewChain(r, nil, c, small)
+	err = chn.Run()
+	if err != nil {
+		m := fmt.Sprintf("error on reading: %v", chn.Errs)
+		return errors.New(m)
+	}
+	if !reflect.DeepEqual(c.recvd, recs) && n > 0 {
+		return errors.New("Received values differ from original!")
+	}
+
+	r, err = NewAvroReader(bytes.NewReader(data), avroReaderSchema)
+	if err != nil {
+		return err
+	}
+	c = new(AnyConsumer)
+	chn = conduit.NewChain(r, nil, c, small)
+	err = chn.Run()
+	if err != nil {
+		m := fmt.Sprintf("error on resolving: %v", chn.Errs)
+		return errors.New(m)
+	}
+	if len(c.recvd) != n {
+		m := fmt.Sprintf("expected %d records, have %d", n, len(c.recvd))
+		return errors.New(m)
+	}
+	for i, v := range c.recvd {
+		rec := v.(map[string]interface{})
+		orig := recs[i].(map[string]interface{})
+		if _, ok := rec["name"]; ok {
+			return errors.New("dropped field present")
+		}
+		if rec["y"] != float64(orig["y"].(int64)) || rec["z"] != int32(7) {
+			m := fmt.Sprintf("unexpected record %v", rec)
+			return errors.New(m)
+		}
+		if rec["kind"] != orig["kind"] || rec["opt"] != orig["opt"] {
+			m := fmt.Sprintf("unexpected record %v", rec)
+			return errors.New(m)
+		}
+		if a, ok := orig["attrs"].(map[string]interface{})["i"]; ok {
+			if rec["attrs"].(map[string]interface{})["i"] != int64(a.(int32)) {
+				return errors.New("map value not promoted")
+			}
+		}
+		if (rec["next"] == nil) != (orig["next"] == nil) {
+			return errors.New("recursive record not resolved")
+		}
+	}
+	return nil
+}
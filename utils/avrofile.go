@@ -0,0 +1,243 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/toschoo/conduit"
+)
+
+var avroMagic = []byte{'O', 'b', 'j', 1}
+
+// AvroReader is a Producer that reads Avro object container files
+// and sends the records down the chain one by one.
+// Records are sent as map[string]interface{};
+// Avro values are represented as nil, bool, int32, int64,
+// float32, float64, []byte, string, []interface{}
+// and map[string]interface{}; enums as strings.
+// If a reader schema is given, records are resolved
+// from the writer schema of the file to the reader schema
+// according to the Avro specification (e.g. missing fields
+// take their default, numbers are promoted).
+// Codecs "null" and "deflate" are supported.
+type AvroReader struct {
+	conduit.Cancelable
+	rd     io.Reader
+	schema *avroType
+}
+
+// NewAvroReader creates a new AvroReader Producer.
+// If schema is empty, records are read with the writer schema.
+func NewAvroReader(r io.Reader, schema string) (*AvroReader, error) {
+	ar := new(AvroReader)
+	ar.rd = r
+	if schema != "" {
+		t, err := parseAvroSchema(schema)
+		if err != nil {
+			return nil, err
+		}
+		ar.schema = t
+	}
+	return ar, nil
+}
+
+// Produce is the pre-defined method that makes AvroReader a Producer.
+func (ar *AvroReader) Produce(trg conduit.Target) error {
+	br := bufio.NewReader(ar.rd)
+	magic := make([]byte, 4)
+	_, err := io.ReadFull(br, magic)
+	if err != nil || !bytes.Equal(magic, avroMagic) {
+		return errors.New("not an Avro object container file")
+	}
+	meta := make(map[string][]byte)
+	err = readAvroBlocks(br, func() error {
+		k, err := readAvroBytes(br)
+		if err != nil {
+			return err
+		}
+		v, err := readAvroBytes(br)
+		meta[string(k)] = v
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	w, err := parseAvroSchema(string(meta["avro.schema"]))
+	if err != nil {
+		return err
+	}
+	r := ar.schema
+	if r == nil {
+		r = w
+	}
+	codec := string(meta["avro.codec"])
+	if codec != "" && codec != "null" && codec != "deflate" {
+		return errors.New(fmt.Sprintf("unsupported codec '%s'", codec))
+	}
+	sync := make([]byte, 16)
+	_, err = io.ReadFull(br, sync)
+	if err != nil {
+		return err
+	}
+
+	for !ar.Canceled() {
+		n, err := readAvroLong(br)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		data, err := readAvroBytes(br)
+		if err != nil {
+			return err
+		}
+		if codec == "deflate" {
+			data, err = ioutil.ReadAll(flate.NewReader(bytes.NewReader(data)))
+			if err != nil {
+				return err
+			}
+		}
+		block := bytes.NewReader(data)
+		for i := int64(0); i < n; i++ {
+			rec, err := readAvro(block, w, r)
+			if err != nil {
+				return err
+			}
+			trg <- rec
+		}
+		marker := make([]byte, 16)
+		_, err = io.ReadFull(br, marker)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(marker, sync) {
+			return errors.New("invalid sync marker")
+		}
+	}
+	return nil
+}
+
+// AvroWriter is a Consumer that writes incoming records
+// to an Avro object container file with a given schema.
+// Records are map[string]interface{}
+// (see AvroReader for the representation of values);
+// integers and floats of any size are accepted
+// and fields missing in a record take their default.
+// Blocks are written when they reach the block size
+// and at checkpoint barriers.
+type AvroWriter struct {
+	wt     io.Writer
+	schema *avroType
+	text   string
+	codec  string
+	n      int
+}
+
+// NewAvroWriter creates a new AvroWriter Consumer
+// with the given schema and codec ("null" or "deflate").
+func NewAvroWriter(w io.Writer, schema string, codec string) (*AvroWriter, error) {
+	if codec == "" {
+		codec = "null"
+	}
+	if codec != "null" && codec != "deflate" {
+		return nil, errors.New(fmt.Sprintf("unsupported codec '%s'", codec))
+	}
+	t, err := parseAvroSchema(schema)
+	if err != nil {
+		return nil, err
+	}
+	aw := new(AvroWriter)
+	aw.wt = w
+	aw.schema = t
+	aw.text = schema
+	aw.codec = codec
+	aw.n = 1000
+	return aw, nil
+}
+
+// SetBlockSize sets the number of records per block (default 1000).
+func (aw *AvroWriter) SetBlockSize(n int) *AvroWriter {
+	aw.n = n
+	return aw
+}
+
+// Consume is the pre-defined method that makes AvroWriter a Consumer.
+// Consume terminates with an error if a record does not match the schema.
+func (aw *AvroWriter) Consume(src conduit.Source) error {
+	bw := bufio.NewWriter(aw.wt)
+	sync := make([]byte, 16)
+	_, err := rand.Read(sync)
+	if err != nil {
+		return err
+	}
+
+	var hdr bytes.Buffer
+	hdr.Write(avroMagic)
+	meta := map[string]interface{}{
+		"avro.schema": []byte(aw.text),
+		"avro.codec":  []byte(aw.codec),
+	}
+	err = writeAvro(&hdr, &avroType{kind: "map", values: &avroType{kind: "bytes"}}, meta)
+	if err != nil {
+		return err
+	}
+	hdr.Write(sync)
+	bw.Write(hdr.Bytes())
+
+	var block bytes.Buffer
+	count := 0
+	flush := func() error {
+		if count == 0 {
+			return nil
+		}
+		data := block.Bytes()
+		if aw.codec == "deflate" {
+			var z bytes.Buffer
+			fw, _ := flate.NewWriter(&z, flate.DefaultCompression)
+			fw.Write(data)
+			fw.Close()
+			data = z.Bytes()
+		}
+		var head bytes.Buffer
+		writeAvro(&head, &avroType{kind: "long"}, int64(count))
+		writeAvro(&head, &avroType{kind: "bytes"}, data)
+		bw.Write(head.Bytes())
+		bw.Write(sync)
+		block.Reset()
+		count = 0
+		return bw.Flush()
+	}
+
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			err = flush()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		err = writeAvro(&block, aw.schema, inp)
+		if err != nil {
+			return err
+		}
+		count++
+		if count >= aw.n {
+			err = flush()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err = flush()
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,337 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+// AWSCredentials are used to sign requests to AWS.
+type AWSCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// EnvCredentials returns the credentials from the environment
+// (AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, AWS_SESSION_TOKEN).
+func EnvCredentials() AWSCredentials {
+	return AWSCredentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+}
+
+// AWSConfig configures the access to an AWS service.
+// Endpoint defaults to https://<service>.<region>.amazonaws.com
+// and Client to http.DefaultClient.
+type AWSConfig struct {
+	Region      string
+	Credentials AWSCredentials
+	Endpoint    string
+	Client      *http.Client
+}
+
+// AWSError is an error returned by an AWS service.
+type AWSError struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *AWSError) Error() string {
+	return fmt.Sprintf("%s: %s (%d)", e.Code, e.Message, e.Status)
+}
+
+// Retries on server errors and throttling
+func (e *AWSError) retryable() bool {
+	return retryableStatus(e.Status) || strings.Contains(e.Code, "Throttl")
+}
+
+// Retries on network errors and retryable AWSErrors
+func awsRetryable(err error) bool {
+	if e, ok := err.(*AWSError); ok {
+		return e.retryable()
+	}
+	return true
+}
+
+// Client for the JSON and query protocols of an AWS service
+type awsClient struct {
+	cfg     AWSConfig
+	service string
+}
+
+func newAWSClient(cfg AWSConfig, service string) awsClient {
+	if cfg.Client == nil {
+		cfg.Client = http.DefaultClient
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = fmt.Sprintf("https://%s.%s.amazonaws.com", service, cfg.Region)
+	}
+	return awsClient{cfg: cfg, service: service}
+}
+
+// Hex encoded SHA-256
+func sha256Hex(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(s))
+	return h.Sum(nil)
+}
+
+// Signs req with AWS Signature Version 4
+func signAWS(req *http.Request, body []byte, creds AWSCredentials, region, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+	hash := sha256Hex(body)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, vs := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(vs, ","))
+	}
+	var names []string
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canon strings.Builder
+	for _, k := range names {
+		canon.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	query := strings.Replace(req.URL.Query().Encode(), "+", "%20", -1)
+	creq := strings.Join([]string{req.Method, path, query, canon.String(), signed, hash}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	sts := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(creq))
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(key, sts))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signed, sig))
+}
+
+// Sends a signed POST request and returns the response body;
+// responses with a status other than 200 are returned as *AWSError
+// with Code and Message extracted by parse
+func (c *awsClient) post(ctx context.Context, body []byte, header http.Header,
+	parse func([]byte, *AWSError)) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.cfg.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	signAWS(req, body, c.cfg.Credentials, c.cfg.Region, c.service, time.Now())
+	rsp, err := c.cfg.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(rsp.Body)
+	rsp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if rsp.StatusCode != http.StatusOK {
+		e := &AWSError{Status: rsp.StatusCode, Code: rsp.Status}
+		parse(data, e)
+		return nil, e
+	}
+	return data, nil
+}
+
+// Calls an operation of the JSON protocol (e.g. target AmazonSQS.ReceiveMessage)
+func (c *awsClient) callJSON(ctx context.Context, version, target string, in, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	header := make(http.Header)
+	header.Set("Content-Type", "application/x-amz-json-"+version)
+	header.Set("X-Amz-Target", target)
+	data, err := c.post(ctx, body, header, func(data []byte, e *AWSError) {
+		var rsp struct {
+			Type     string `json:"__type"`
+			Message  string `json:"message"`
+			Message2 string `json:"Message"`
+		}
+		if json.Unmarshal(data, &rsp) != nil {
+			return
+		}
+		if rsp.Type != "" {
+			e.Code = rsp.Type[strings.LastIndex(rsp.Type, "#")+1:]
+		}
+		e.Message = rsp.Message + rsp.Message2
+	})
+	if err != nil || out == nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
+
+// Calls an action of the query protocol; the response is XML
+func (c *awsClient) callQuery(ctx context.Context, params url.Values, out interface{}) error {
+	header := make(http.Header)
+	header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	data, err := c.post(ctx, []byte(params.Encode()), header, func(data []byte, e *AWSError) {
+		var rsp struct {
+			Error struct {
+				Code    string
+				Message string
+			}
+		}
+		if xml.Unmarshal(data, &rsp) == nil && rsp.Error.Code != "" {
+			e.Code, e.Message = rsp.Error.Code, rsp.Error.Message
+		}
+	})
+	if err != nil || out == nil {
+		return err
+	}
+	return xml.Unmarshal(data, out)
+}
+
+// An entry of a batch request that failed
+type batchFailure struct {
+	index     int
+	retryable bool
+	err       error
+}
+
+// Sends items in a batch request with retries:
+// entries that failed with a retryable error are sent again
+// according to the RetryPolicy; items that finally fail
+// are passed as FailedRequest to side or, if side is nil,
+// reported as error. send returns the failed entries of the batch
+func sendBatch(items []interface{}, retry RetryPolicy, side func(*FailedRequest),
+	send func([]interface{}) ([]batchFailure, error)) error {
+	pending := items
+	var failed []*FailedRequest
+	n := 0
+	attempts, err := retry.run(nil, func() (bool, error) {
+		n++
+		fs, err := send(pending)
+		if err != nil {
+			return awsRetryable(err), err
+		}
+		var again []interface{}
+		var last error
+		for _, f := range fs {
+			if f.retryable {
+				again = append(again, pending[f.index])
+				last = f.err
+				continue
+			}
+			failed = append(failed, &FailedRequest{Item: pending[f.index], Attempts: n, Err: f.err})
+		}
+		pending = again
+		if len(again) == 0 {
+			return false, nil
+		}
+		return true, last
+	})
+	if err != nil {
+		for _, inp := range pending {
+			failed = append(failed, &FailedRequest{Item: inp, Attempts: attempts, Err: err})
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	if side == nil {
+		f := failed[0]
+		return errors.New(fmt.Sprintf("sending failed after %d attempts: %v", f.Attempts, f.Err))
+	}
+	for _, f := range failed {
+		side(f)
+	}
+	return nil
+}
+
+// An entry of a batch request
+type batchEntry interface {
+	source() interface{} // the item the entry was created from
+	size() int           // the size of the entry in the request
+}
+
+// Passes failed requests to the side output trg
+// with the item the batch entry was created from;
+// returns nil if trg is nil
+func sideFailed(trg conduit.Target) func(*FailedRequest) {
+	if trg == nil {
+		return nil
+	}
+	return func(f *FailedRequest) {
+		f.Item = f.Item.(batchEntry).source()
+		trg <- f
+	}
+}
+
+// Sends the items in batch requests (see sendBatch)
+// of up to max entries and size bytes;
+// batches are completed at barriers
+func consumeBatches(src conduit.Source, max, size int, retry RetryPolicy, failed func(*FailedRequest),
+	entry func(interface{}) (batchEntry, error), send func([]interface{}) ([]batchFailure, error)) error {
+	var batch []interface{}
+	bytes := 0
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		entries := batch
+		batch, bytes = nil, 0
+		return sendBatch(entries, retry, failed, send)
+	}
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			if err := flush(); err != nil {
+				return err
+			}
+			continue
+		}
+		e, err := entry(inp)
+		if err != nil {
+			return err
+		}
+		if len(batch) == max || bytes+e.size() > size {
+			if err = flush(); err != nil {
+				return err
+			}
+		}
+		batch = append(batch, e)
+		bytes += e.size()
+	}
+	return flush()
+}
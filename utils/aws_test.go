@@ -0,0 +1,60 @@
+package utils
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// AWS Signature Version 4:
+// - The signature matches the get-vanilla example of the AWS test suite
+func TestAWSSignature(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodGet, "https://example.amazonaws.com/", nil)
+	creds := AWSCredentials{
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+	}
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	signAWS(req, nil, creds, "us-east-1", "service", now)
+	want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+		"SignedHeaders=host;x-amz-date, " +
+		"Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+	if have := req.Header.Get("Authorization"); have != want {
+		t.Errorf("signAWS: expected\n%s\nhave\n%s", want, have)
+	}
+}
+
+// AWS errors:
+// - Errors of the JSON and the query protocol are parsed
+// - Throttling and server errors are retryable
+func TestAWSError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Amz-Target") != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"__type":"com.amazonaws.sqs#QueueDoesNotExist","message":"no such queue"}`))
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`<ErrorResponse><Error><Code>Throttling</Code><Message>slow down</Message></Error></ErrorResponse>`))
+	}))
+	defer srv.Close()
+
+	c := newAWSClient(AWSConfig{Region: "eu-west-1", Endpoint: srv.URL}, "sqs")
+	err := c.callJSON(context.Background(), "1.0", "AmazonSQS.GetQueueUrl", map[string]string{}, nil)
+	e, ok := err.(*AWSError)
+	if !ok || e.Code != "QueueDoesNotExist" || e.Message != "no such queue" || awsRetryable(e) {
+		t.Errorf("callJSON: unexpected error %v", err)
+	}
+	err = c.callQuery(context.Background(), url.Values{"Action": {"Publish"}}, nil)
+	e, ok = err.(*AWSError)
+	if !ok || e.Code != "Throttling" || !awsRetryable(e) {
+		t.Errorf("callQuery: unexpected error %v", err)
+	}
+	if !strings.Contains(newAWSClient(AWSConfig{Region: "eu-west-1"}, "sns").cfg.Endpoint, "sns.eu-west-1") {
+		t.Errorf("newAWSClient: unexpected default endpoint")
+	}
+}
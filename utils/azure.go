@@ -0,0 +1,1057 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+const (
+	eventHubMaxBytes   = 1024*1024 - 16*1024
+	serviceBusMaxBytes = 256*1024 - 16*1024
+	azureMaxBatch      = 1000
+)
+
+// AzureConnection holds the settings of a connection string
+// of an Event Hubs or Service Bus namespace, e.g.
+// Endpoint=sb://ns.servicebus.windows.net/;SharedAccessKeyName=name;SharedAccessKey=key;EntityPath=hub.
+// The connection uses AMQP over TLS (port 5671);
+// with the scheme amqp or UseDevelopmentEmulator=true,
+// plain AMQP (port 5672) is used, e.g. for emulators.
+// Clients authenticate with the shared access key (SASL PLAIN).
+type AzureConnection struct {
+	Endpoint   string
+	KeyName    string
+	Key        string
+	EntityPath string
+	Emulator   bool
+}
+
+// ParseAzureConnection parses a connection string.
+func ParseAzureConnection(s string) (AzureConnection, error) {
+	var ac AzureConnection
+	for _, kv := range strings.Split(s, ";") {
+		i := strings.Index(kv, "=")
+		if i < 0 {
+			continue
+		}
+		v := strings.TrimSpace(kv[i+1:])
+		switch strings.ToLower(strings.TrimSpace(kv[:i])) {
+		case "endpoint":
+			ac.Endpoint = v
+		case "sharedaccesskeyname":
+			ac.KeyName = v
+		case "sharedaccesskey":
+			ac.Key = v
+		case "entitypath":
+			ac.EntityPath = v
+		case "usedevelopmentemulator":
+			ac.Emulator = strings.EqualFold(v, "true")
+		}
+	}
+	if ac.Endpoint == "" {
+		return ac, errors.New("connection string without endpoint")
+	}
+	return ac, nil
+}
+
+// Options to connect to the AMQP endpoint
+func (ac AzureConnection) options(timeout time.Duration) (*amqpOptions, error) {
+	u, err := url.Parse(ac.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	o := &amqpOptions{host: u.Hostname(), user: ac.KeyName, pass: ac.Key, timeout: timeout}
+	port := "5671"
+	o.tls = u.Scheme != "amqp" && !ac.Emulator
+	if !o.tls {
+		port = "5672"
+	}
+	if u.Port() != "" {
+		port = u.Port()
+	}
+	o.addr = net.JoinHostPort(o.host, port)
+	return o, nil
+}
+
+// Connection options common to the Azure components
+type azureOptions struct {
+	conn    AzureConnection
+	entity  string
+	timeout time.Duration
+	retry   RetryPolicy
+}
+
+func (o *azureOptions) init(conn AzureConnection, entity string) bool {
+	if entity == "" {
+		entity = conn.EntityPath
+	}
+	if entity == "" || conn.Endpoint == "" {
+		return false
+	}
+	o.conn = conn
+	o.entity = entity
+	o.timeout = 30 * time.Second
+	o.retry = DefaultRetry
+	return true
+}
+
+func (o *azureOptions) dial() (*amqpConn, error) {
+	ao, err := o.conn.options(o.timeout)
+	if err != nil {
+		return nil, err
+	}
+	return dialAMQP(ao)
+}
+
+// Unique name of a link
+func linkName(entity string) string {
+	return fmt.Sprintf("%s-%d", entity, time.Now().UnixNano())
+}
+
+// Body of a received message: the data sections
+// or a string or binary value
+func amqpBody(m *amqpMessage) []byte {
+	if len(m.data) > 0 {
+		return m.body()
+	}
+	switch v := m.value.(type) {
+	case []byte:
+		return v
+	case string:
+		return []byte(v)
+	}
+	return nil
+}
+
+// EventHubEvent is an event read from a partition of an event hub.
+type EventHubEvent struct {
+	Partition      string
+	Offset         string
+	SequenceNumber int64
+	Enqueued       time.Time
+	PartitionKey   string
+	Properties     map[string]interface{}
+	Body           []byte
+}
+
+// EventHubReader is a Producer that reads the events
+// of all partitions of an event hub concurrently
+// and sends them as *EventHubEvent down the chain.
+// Events of one partition are sent in order.
+// With a StateStore (see SetStore), the offset of the reader
+// in each partition is stored under the stage
+// "eventhubs/<hub>/<consumer group>": by default every second
+// or, with StoreOnCheckpoint, when a checkpoint of the chain
+// covers the events (see conduit.Chain.SetCheckpoints
+// and conduit.Committer); after a restart, reading continues
+// after the stored offsets (at least once).
+// When the connection is lost, the reader reconnects
+// according to the RetryPolicy (DefaultRetry) and continues
+// after the events already sent down the chain.
+type EventHubReader struct {
+	conduit.Cancelable
+	azureOptions
+	group      string
+	partitions []string
+	latest     bool
+	prefetch   uint32
+	store      conduit.StateStore
+	onCP       bool
+	acks       ackQueue
+	pos        streamPositions
+	next       map[string]string
+	send       sync.Mutex
+	door       sync.Mutex
+	ac         *amqpConn
+}
+
+// NewEventHubReader creates a new EventHubReader Producer
+// reading the event hub hub (default: the EntityPath
+// of the connection) with the consumer group
+// (default: "$Default").
+func NewEventHubReader(conn AzureConnection, hub, group string) (er *EventHubReader) {
+	er = new(EventHubReader)
+	if er != nil {
+		if !er.init(conn, hub) {
+			return nil
+		}
+		er.group = group
+		if er.group == "" {
+			er.group = "$Default"
+		}
+		er.prefetch = 300
+	}
+	return
+}
+
+// SetPartitions sets the partitions to read
+// (default: all partitions of the event hub).
+func (er *EventHubReader) SetPartitions(ids ...string) *EventHubReader {
+	er.partitions = ids
+	return er
+}
+
+// SetLatest starts reading partitions without stored offset
+// at the end (default: at the beginning).
+func (er *EventHubReader) SetLatest() *EventHubReader {
+	er.latest = true
+	return er
+}
+
+// SetPrefetch sets the number of events requested
+// in advance per partition (default 300).
+func (er *EventHubReader) SetPrefetch(n int) *EventHubReader {
+	if n > 0 {
+		er.prefetch = uint32(n)
+	}
+	return er
+}
+
+// SetTimeout sets the timeout for connecting
+// and for requests (default 30s).
+func (er *EventHubReader) SetTimeout(d time.Duration) *EventHubReader {
+	er.timeout = d
+	return er
+}
+
+// SetRetry sets the RetryPolicy for reconnecting (default: DefaultRetry).
+func (er *EventHubReader) SetRetry(rp RetryPolicy) *EventHubReader {
+	er.retry = rp
+	return er
+}
+
+// SetStore sets the StateStore where the offsets are kept.
+// The store should not be the StateStore of the chain,
+// which is reset to the latest checkpoint on restore.
+func (er *EventHubReader) SetStore(st conduit.StateStore) *EventHubReader {
+	er.store = st
+	return er
+}
+
+// StoreOnCheckpoint stores offsets only when
+// a checkpoint covers them.
+func (er *EventHubReader) StoreOnCheckpoint() *EventHubReader {
+	er.onCP = true
+	return er
+}
+
+// Resume is the pre-defined method that makes EventHubReader
+// a conduit.Resumer. Reading continues after the stored offsets,
+// so nothing is skipped.
+func (er *EventHubReader) Resume(pos uint64) error {
+	er.acks.resume(pos)
+	return nil
+}
+
+// Commit is the pre-defined method that makes EventHubReader
+// a conduit.Committer; with StoreOnCheckpoint, it stores
+// the offsets covered by the checkpoint.
+func (er *EventHubReader) Commit(cp *conduit.Checkpoint) error {
+	if !er.onCP {
+		return nil
+	}
+	err := er.acks.commit(cp.Position)
+	if err != nil {
+		return err
+	}
+	return er.pos.save()
+}
+
+// Cancel cancels the producer and closes the connection.
+func (er *EventHubReader) Cancel() {
+	er.Cancelable.Cancel()
+	er.door.Lock()
+	defer er.door.Unlock()
+	if er.ac != nil {
+		er.ac.close()
+	}
+}
+
+// Produce is the pre-defined method that makes EventHubReader a Producer.
+func (er *EventHubReader) Produce(trg conduit.Target) error {
+	er.acks.start()
+	next, err := er.pos.load(er.store, "eventhubs/"+er.entity+"/"+er.group, "")
+	if err != nil {
+		return err
+	}
+	er.next = next
+	defer er.pos.save()
+	failures := 0
+	for !er.Canceled() {
+		err := er.session(trg, &failures)
+		if er.Canceled() {
+			break
+		}
+		failures++
+		if failures >= er.retry.Attempts {
+			return errors.New(fmt.Sprintf("connection failed after %d attempts: %v", failures, err))
+		}
+		if er.retry.Backoff != nil {
+			sleep(er.retry.Backoff(failures), er.Canceled)
+		}
+	}
+	return nil
+}
+
+// Connects and reads all partitions until the connection is lost
+func (er *EventHubReader) session(trg conduit.Target, failures *int) error {
+	ac, err := er.dial()
+	if err != nil {
+		return err
+	}
+	er.door.Lock()
+	er.ac = ac
+	er.door.Unlock()
+	defer ac.close()
+	if er.Canceled() {
+		return nil
+	}
+	parts := er.partitions
+	if len(parts) == 0 {
+		parts, err = er.partitionIDs(ac)
+		if err != nil {
+			return err
+		}
+	}
+	var links []*amqpLink
+	for _, p := range parts {
+		l, err := er.attach(ac, p)
+		if err != nil {
+			return err
+		}
+		links = append(links, l)
+	}
+	*failures = 0
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(links))
+	for i, l := range links {
+		wg.Add(1)
+		go func(part string, l *amqpLink) {
+			defer wg.Done()
+			errs <- er.read(ac, part, l, trg)
+		}(parts[i], l)
+	}
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case err = <-errs:
+			ac.close()
+			wg.Wait()
+			return err
+		case <-t.C:
+			if !er.onCP {
+				if err = er.pos.save(); err != nil {
+					ac.close()
+					wg.Wait()
+					return err
+				}
+			}
+		}
+	}
+}
+
+// Requests the partition IDs from the management node
+func (er *EventHubReader) partitionIDs(ac *amqpConn) ([]string, error) {
+	rsp, err := ac.request("$management", map[string]interface{}{
+		"operation": "READ",
+		"name":      er.entity,
+		"type":      "com.microsoft:eventhub",
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	info, _ := rsp.value.(map[interface{}]interface{})
+	ids, _ := info["partition_ids"].([]interface{})
+	if len(ids) == 0 {
+		return nil, errors.New(fmt.Sprintf("event hub %s without partitions", er.entity))
+	}
+	var parts []string
+	for _, id := range ids {
+		parts = append(parts, amqpString(id))
+	}
+	return parts, nil
+}
+
+// Attaches a receiver to a partition, starting after
+// the last event sent down the chain
+func (er *EventHubReader) attach(ac *amqpConn, part string) (*amqpLink, error) {
+	er.send.Lock()
+	offset := er.next[part]
+	er.send.Unlock()
+	if offset == "" {
+		offset = "-1"
+		if er.latest {
+			offset = "@latest"
+		}
+	}
+	filter := map[amqpSymbol]interface{}{
+		"apache.org:selector-filter:string": amqpDescribed{
+			descriptor: amqpSymbol("apache.org:selector-filter:string"),
+			value:      fmt.Sprintf("amqp.annotation.x-opt-offset > '%s'", offset),
+		},
+	}
+	source := fmt.Sprintf("%s/ConsumerGroups/%s/Partitions/%s", er.entity, er.group, part)
+	l, err := ac.attach(linkName(source), true, source, "", filter, true)
+	if err != nil {
+		return nil, err
+	}
+	return l, ac.flow(l, er.prefetch)
+}
+
+// Sends the events of a partition down the chain
+func (er *EventHubReader) read(ac *amqpConn, part string, l *amqpLink, trg conduit.Target) error {
+	for {
+		d, err := ac.receive(l)
+		if err != nil {
+			return err
+		}
+		if credit, _ := ac.credit(l); credit <= er.prefetch/2 {
+			if err = ac.flow(l, er.prefetch); err != nil {
+				return err
+			}
+		}
+		m := d.msg
+		ev := &EventHubEvent{
+			Partition:    part,
+			Offset:       amqpString(m.annotation("x-opt-offset")),
+			PartitionKey: amqpString(m.annotation("x-opt-partition-key")),
+			Properties:   m.props,
+			Body:         amqpBody(m),
+		}
+		if n, ok := amqpUint(m.annotation("x-opt-sequence-number")); ok {
+			ev.SequenceNumber = int64(n)
+		}
+		ev.Enqueued, _ = m.annotation("x-opt-enqueued-time").(time.Time)
+		if !er.deliver(ev, trg) {
+			return nil
+		}
+	}
+}
+
+// Sends an event down the chain; with StoreOnCheckpoint,
+// its acknowledgment is added in the same order
+func (er *EventHubReader) deliver(ev *EventHubEvent, trg conduit.Target) bool {
+	er.send.Lock()
+	defer er.send.Unlock()
+	if er.Canceled() {
+		return false
+	}
+	er.pos.sent(ev.Partition)
+	ack := func() error {
+		er.pos.ack(ev.Partition, ev.Offset)
+		return nil
+	}
+	if er.onCP {
+		er.acks.add(ack)
+	}
+	trg <- ev
+	if !er.onCP {
+		ack()
+	}
+	er.next[ev.Partition] = ev.Offset
+	return true
+}
+
+// ServiceBusMsg is a message received from a Service Bus
+// queue or subscription.
+type ServiceBusMsg struct {
+	ID             string
+	SessionID      string
+	SequenceNumber int64
+	Enqueued       time.Time
+	DeliveryCount  uint32
+	Properties     map[string]interface{}
+	Body           []byte
+}
+
+// Deliveries received on the current connection
+// and acknowledged deliveries not yet settled
+type sbFlight struct {
+	door sync.Mutex
+	ac   *amqpConn
+	link *amqpLink
+	open map[uint32]bool
+	done []uint32
+}
+
+// Starts a new connection; deliveries of the previous one
+// can no longer be settled and are redelivered
+func (f *sbFlight) reset(ac *amqpConn, l *amqpLink) {
+	f.door.Lock()
+	defer f.door.Unlock()
+	f.ac, f.link = ac, l
+	f.open = make(map[uint32]bool)
+	f.done = nil
+}
+
+func (f *sbFlight) add(id uint32) {
+	f.door.Lock()
+	defer f.door.Unlock()
+	f.open[id] = true
+}
+
+// Marks a delivery on connection ac for completion
+func (f *sbFlight) ack(ac *amqpConn, id uint32) {
+	f.door.Lock()
+	defer f.door.Unlock()
+	if ac != f.ac {
+		return
+	}
+	f.done = append(f.done, id)
+}
+
+// Deliveries marked for completion
+func (f *sbFlight) take() (*amqpConn, *amqpLink, []uint32) {
+	f.door.Lock()
+	defer f.door.Unlock()
+	ids := f.done
+	for _, id := range ids {
+		delete(f.open, id)
+	}
+	f.done = nil
+	return f.ac, f.link, ids
+}
+
+// Deliveries not yet settled
+func (f *sbFlight) unsettled() []uint32 {
+	f.door.Lock()
+	defer f.door.Unlock()
+	var ids []uint32
+	for id := range f.open {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Settles deliveries in ranges of consecutive IDs
+func settleRanges(ac *amqpConn, ids []uint32, state uint64) error {
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for i := 0; i < len(ids); {
+		j := i
+		for j+1 < len(ids) && ids[j+1] == ids[j]+1 {
+			j++
+		}
+		err := ac.settle(ids[i], ids[j], state)
+		if err != nil {
+			return err
+		}
+		i = j + 1
+	}
+	return nil
+}
+
+// ServiceBusReceiver is a Producer that receives the messages
+// of a Service Bus queue or subscription in peek-lock mode
+// and sends them as *ServiceBusMsg down the chain.
+// Messages are completed by default when they have been
+// sent down the chain or, with AckOnCheckpoint,
+// when a checkpoint of the chain covers them
+// (see conduit.Chain.SetCheckpoints and conduit.Committer).
+// At most the prefetch count of messages is locked at a time,
+// so that locks do not expire while messages wait in the chain.
+// When the receiver stops, locked messages are abandoned
+// for immediate redelivery; messages of a lost connection
+// are redelivered when their lock expires (at least once).
+// When the connection is lost, the receiver reconnects
+// according to the RetryPolicy (DefaultRetry).
+type ServiceBusReceiver struct {
+	conduit.Cancelable
+	azureOptions
+	prefetch uint32
+	onCP     bool
+	acks     ackQueue
+	flight   sbFlight
+	door     sync.Mutex
+	ac       *amqpConn
+}
+
+// NewServiceBusReceiver creates a new ServiceBusReceiver Producer
+// receiving from entity, a queue or a subscription
+// (<topic>/Subscriptions/<subscription>);
+// the default is the EntityPath of the connection.
+func NewServiceBusReceiver(conn AzureConnection, entity string) (sr *ServiceBusReceiver) {
+	sr = new(ServiceBusReceiver)
+	if sr != nil {
+		if !sr.init(conn, entity) {
+			return nil
+		}
+		sr.prefetch = 10
+	}
+	return
+}
+
+// SetPrefetch sets the maximum number of messages
+// locked at a time (default 10).
+func (sr *ServiceBusReceiver) SetPrefetch(n int) *ServiceBusReceiver {
+	if n > 0 {
+		sr.prefetch = uint32(n)
+	}
+	return sr
+}
+
+// SetTimeout sets the timeout for connecting
+// and for requests (default 30s).
+func (sr *ServiceBusReceiver) SetTimeout(d time.Duration) *ServiceBusReceiver {
+	sr.timeout = d
+	return sr
+}
+
+// SetRetry sets the RetryPolicy for reconnecting (default: DefaultRetry).
+func (sr *ServiceBusReceiver) SetRetry(rp RetryPolicy) *ServiceBusReceiver {
+	sr.retry = rp
+	return sr
+}
+
+// AckOnCheckpoint completes messages only when
+// a checkpoint covers them.
+func (sr *ServiceBusReceiver) AckOnCheckpoint() *ServiceBusReceiver {
+	sr.onCP = true
+	return sr
+}
+
+// Resume is the pre-defined method that makes ServiceBusReceiver
+// a conduit.Resumer. Messages that were not completed
+// are redelivered, so nothing is skipped.
+func (sr *ServiceBusReceiver) Resume(pos uint64) error {
+	sr.acks.resume(pos)
+	return nil
+}
+
+// Commit is the pre-defined method that makes ServiceBusReceiver
+// a conduit.Committer; with AckOnCheckpoint, it completes
+// the messages covered by the checkpoint.
+func (sr *ServiceBusReceiver) Commit(cp *conduit.Checkpoint) error {
+	if !sr.onCP {
+		return nil
+	}
+	err := sr.acks.commit(cp.Position)
+	if err != nil {
+		return err
+	}
+	return sr.complete()
+}
+
+// Cancel cancels the producer, abandons the locked messages
+// and closes the connection.
+func (sr *ServiceBusReceiver) Cancel() {
+	sr.Cancelable.Cancel()
+	sr.door.Lock()
+	defer sr.door.Unlock()
+	if sr.ac != nil {
+		sr.complete()
+		settleRanges(sr.ac, sr.flight.unsettled(), amqpReleased)
+		sr.ac.close()
+	}
+}
+
+// Produce is the pre-defined method that makes ServiceBusReceiver a Producer.
+func (sr *ServiceBusReceiver) Produce(trg conduit.Target) error {
+	sr.acks.start()
+	failures := 0
+	for !sr.Canceled() {
+		err := sr.session(trg, &failures)
+		if sr.Canceled() {
+			break
+		}
+		failures++
+		if failures >= sr.retry.Attempts {
+			return errors.New(fmt.Sprintf("connection failed after %d attempts: %v", failures, err))
+		}
+		if sr.retry.Backoff != nil {
+			sleep(sr.retry.Backoff(failures), sr.Canceled)
+		}
+	}
+	return nil
+}
+
+// Connects and receives messages until the connection is lost
+func (sr *ServiceBusReceiver) session(trg conduit.Target, failures *int) error {
+	ac, err := sr.dial()
+	if err != nil {
+		return err
+	}
+	sr.door.Lock()
+	sr.ac = ac
+	sr.door.Unlock()
+	defer ac.close()
+	if sr.Canceled() {
+		return nil
+	}
+	l, err := ac.attach(linkName(sr.entity), true, sr.entity, "", nil, false)
+	if err != nil {
+		return err
+	}
+	sr.flight.reset(ac, l)
+	err = ac.flow(l, sr.prefetch)
+	if err != nil {
+		return err
+	}
+	*failures = 0
+	for {
+		d, err := ac.receive(l)
+		if err != nil {
+			return err
+		}
+		sr.flight.add(d.id)
+		m := d.msg
+		msg := &ServiceBusMsg{
+			ID:            amqpString(m.id),
+			SessionID:     m.group,
+			DeliveryCount: m.deliveryCount,
+			Properties:    m.props,
+			Body:          amqpBody(m),
+		}
+		if n, ok := amqpUint(m.annotation("x-opt-sequence-number")); ok {
+			msg.SequenceNumber = int64(n)
+		}
+		msg.Enqueued, _ = m.annotation("x-opt-enqueued-time").(time.Time)
+		id := d.id
+		if sr.onCP {
+			sr.acks.add(func() error {
+				sr.flight.ack(ac, id)
+				return nil
+			})
+		}
+		trg <- msg
+		if !sr.onCP {
+			sr.flight.ack(ac, id)
+			if err = sr.complete(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Completes the acknowledged messages and grants credit
+// for the messages that are no longer locked
+func (sr *ServiceBusReceiver) complete() error {
+	ac, l, ids := sr.flight.take()
+	if ac == nil || len(ids) == 0 {
+		return nil
+	}
+	err := settleRanges(ac, ids, amqpAccepted)
+	if err != nil {
+		return err
+	}
+	credit, queued := ac.credit(l)
+	locked := uint32(len(sr.flight.unsettled()) + queued)
+	if locked+credit >= sr.prefetch {
+		return nil
+	}
+	return ac.flow(l, sr.prefetch-locked)
+}
+
+// Entry of a batch of messages sent to an Event Hub or a Service Bus
+type azureEntry struct {
+	item interface{}
+	key  string
+	msg  *amqpMessage
+	data []byte
+}
+
+func (e *azureEntry) source() interface{} { return e.item }
+func (e *azureEntry) size() int           { return len(e.data) + 16 }
+
+// Options and logic common to EventHubWriter and ServiceBusSender
+type azureSend struct {
+	azureOptions
+	key     KeyFunc
+	session bool
+	marshal MarshalFunc
+	side    conduit.Target
+	ac      *amqpConn
+	link    *amqpLink
+}
+
+func (s *azureSend) initSend(conn AzureConnection, entity string) bool {
+	if !s.init(conn, entity) {
+		return false
+	}
+	s.marshal = json.Marshal
+	return true
+}
+
+// The sender link; connects if there is none
+func (s *azureSend) sender() (*amqpConn, *amqpLink, error) {
+	if s.link != nil && s.ac.failed() == nil {
+		return s.ac, s.link, nil
+	}
+	s.disconnect()
+	ac, err := s.dial()
+	if err != nil {
+		return nil, nil, err
+	}
+	l, err := ac.attach(linkName(s.entity), false, "", s.entity, nil, false)
+	if err != nil {
+		ac.close()
+		return nil, nil, err
+	}
+	s.ac, s.link = ac, l
+	return ac, l, nil
+}
+
+func (s *azureSend) disconnect() {
+	if s.ac != nil {
+		s.ac.close()
+	}
+	s.ac, s.link = nil, nil
+}
+
+// Creates the message for an item
+func (s *azureSend) entry(inp interface{}) (batchEntry, error) {
+	m := &amqpMessage{}
+	key := ""
+	switch x := inp.(type) {
+	case *EventHubEvent:
+		m.data, m.props = [][]byte{x.Body}, x.Properties
+		if s.key == nil {
+			key = x.PartitionKey
+		}
+	case *ServiceBusMsg:
+		m.data, m.props, m.group = [][]byte{x.Body}, x.Properties, x.SessionID
+		if s.key == nil {
+			key = x.SessionID
+		}
+		if x.ID != "" {
+			m.id = x.ID
+		}
+	default:
+		data, err := payload(inp, s.marshal)
+		if err != nil {
+			return nil, err
+		}
+		m.data = [][]byte{data}
+	}
+	e := &azureEntry{item: inp, key: key, msg: m}
+	if _, ok := inp.(Keyed); ok || s.key != nil {
+		e.key = keyOf(s.key, inp)
+	}
+	if s.session && e.key != "" {
+		m.group = e.key
+	}
+	if !s.session && e.key != "" {
+		m.annotations = map[interface{}]interface{}{amqpSymbol("x-opt-partition-key"): e.key}
+	}
+	e.data = m.encode()
+	return e, nil
+}
+
+// Sends the entries as one batch message per key;
+// messages that were rejected fail, others are retried
+func (s *azureSend) send(entries []interface{}) ([]batchFailure, error) {
+	ac, l, err := s.sender()
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	groups := make(map[string][]int)
+	for i, inp := range entries {
+		k := inp.(*azureEntry).key
+		if _, ok := groups[k]; !ok {
+			keys = append(keys, k)
+		}
+		groups[k] = append(groups[k], i)
+	}
+	var fs []batchFailure
+	ids := make([]uint32, len(keys))
+	sent := make([]error, len(keys))
+	for i, k := range keys {
+		m := &amqpMessage{}
+		if len(groups[k]) == 1 {
+			m = entries[groups[k][0]].(*azureEntry).msg
+		} else {
+			m.format = amqpBatchFormat
+			for _, j := range groups[k] {
+				m.data = append(m.data, entries[j].(*azureEntry).data)
+			}
+			if s.session && k != "" {
+				m.group = k
+			} else if k != "" {
+				m.annotations = map[interface{}]interface{}{amqpSymbol("x-opt-partition-key"): k}
+			}
+		}
+		ids[i], sent[i] = ac.transfer(l, m)
+	}
+	for i, k := range keys {
+		err := sent[i]
+		retryable := true
+		if err == nil {
+			var code uint64
+			code, err = ac.outcome(ids[i])
+			retryable = code != amqpRejected
+			if err == nil && code != amqpAccepted {
+				err = errors.New(fmt.Sprintf("amqp: message not accepted (0x%x)", code))
+			}
+		}
+		if err == nil {
+			continue
+		}
+		if retryable {
+			s.disconnect()
+		}
+		for _, j := range groups[k] {
+			fs = append(fs, batchFailure{index: j, retryable: retryable, err: err})
+		}
+	}
+	return fs, nil
+}
+
+// Sends the items in batches
+func (s *azureSend) consume(src conduit.Source, size int) error {
+	defer s.disconnect()
+	return consumeBatches(src, azureMaxBatch, size, s.retry, sideFailed(s.side), s.entry, s.send)
+}
+
+// EventHubWriter is a Consumer that sends the incoming items
+// as events to an event hub in batches.
+// Items with the same partition key are sent to the same
+// partition in order; the partition key is obtained
+// with a KeyFunc (see SetPartitionKey) or from Keyed items,
+// other items are distributed over the partitions.
+// []byte and string items are sent as they are,
+// *EventHubEvent items with their body and properties
+// and others are encoded with a MarshalFunc (default: json.Marshal).
+// Batches are sent when they are full, at barriers
+// and at the end of the stream, one batch per partition key.
+// Events that are not accepted are sent again after reconnecting
+// according to the RetryPolicy (DefaultRetry).
+// Events that are rejected or finally fail are sent as FailedRequest
+// to the side output "failed" (see conduit.SideOutputter)
+// or, if the side output is not connected,
+// terminate the consumer with an error.
+type EventHubWriter struct {
+	azureSend
+}
+
+// NewEventHubWriter creates a new EventHubWriter Consumer
+// sending to the event hub hub (default: the EntityPath
+// of the connection).
+func NewEventHubWriter(conn AzureConnection, hub string) (ew *EventHubWriter) {
+	ew = new(EventHubWriter)
+	if ew != nil && !ew.initSend(conn, hub) {
+		return nil
+	}
+	return
+}
+
+// SetPartitionKey sets the KeyFunc that obtains the partition key.
+func (ew *EventHubWriter) SetPartitionKey(kf KeyFunc) *EventHubWriter {
+	ew.key = kf
+	return ew
+}
+
+// SetMarshal sets the MarshalFunc.
+func (ew *EventHubWriter) SetMarshal(marshal MarshalFunc) *EventHubWriter {
+	ew.marshal = marshal
+	return ew
+}
+
+// SetTimeout sets the timeout for connecting
+// and for requests (default 30s).
+func (ew *EventHubWriter) SetTimeout(d time.Duration) *EventHubWriter {
+	ew.timeout = d
+	return ew
+}
+
+// SetRetry sets the RetryPolicy (default: DefaultRetry).
+func (ew *EventHubWriter) SetRetry(rp RetryPolicy) *EventHubWriter {
+	ew.retry = rp
+	return ew
+}
+
+// SideOutput is the pre-defined method that makes EventHubWriter
+// a conduit.SideOutputter; name must be "failed".
+func (ew *EventHubWriter) SideOutput(name string, trg conduit.Target) {
+	if name == "failed" {
+		ew.side = trg
+	}
+}
+
+// Consume is the pre-defined method that makes EventHubWriter a Consumer.
+func (ew *EventHubWriter) Consume(src conduit.Source) error {
+	return ew.consume(src, eventHubMaxBytes)
+}
+
+// ServiceBusSender is a Consumer that sends the incoming items
+// to a Service Bus queue or topic in batches.
+// With SetSession, messages are sent with a session ID
+// obtained with a KeyFunc, so that receivers of sessions
+// receive the messages of a session in order.
+// []byte and string items are sent as they are,
+// *ServiceBusMsg items with their body, ID, session ID
+// and properties and others are encoded with a MarshalFunc
+// (default: json.Marshal).
+// Batches are sent when they are full, at barriers
+// and at the end of the stream, one batch per session.
+// Messages that are not accepted are sent again after reconnecting
+// according to the RetryPolicy (DefaultRetry).
+// Messages that are rejected or finally fail are sent as FailedRequest
+// to the side output "failed" (see conduit.SideOutputter)
+// or, if the side output is not connected,
+// terminate the consumer with an error.
+type ServiceBusSender struct {
+	azureSend
+}
+
+// NewServiceBusSender creates a new ServiceBusSender Consumer
+// sending to entity, a queue or a topic
+// (default: the EntityPath of the connection).
+func NewServiceBusSender(conn AzureConnection, entity string) (ss *ServiceBusSender) {
+	ss = new(ServiceBusSender)
+	if ss != nil {
+		if !ss.initSend(conn, entity) {
+			return nil
+		}
+		ss.session = true
+	}
+	return
+}
+
+// SetSession sets the KeyFunc that obtains the session ID.
+func (ss *ServiceBusSender) SetSession(kf KeyFunc) *ServiceBusSender {
+	ss.key = kf
+	return ss
+}
+
+// SetMarshal sets the MarshalFunc.
+func (ss *ServiceBusSender) SetMarshal(marshal MarshalFunc) *ServiceBusSender {
+	ss.marshal = marshal
+	return ss
+}
+
+// SetTimeout sets the timeout for connecting
+// and for requests (default 30s).
+func (ss *ServiceBusSender) SetTimeout(d time.Duration) *ServiceBusSender {
+	ss.timeout = d
+	return ss
+}
+
+// SetRetry sets the RetryPolicy (default: DefaultRetry).
+func (ss *ServiceBusSender) SetRetry(rp RetryPolicy) *ServiceBusSender {
+	ss.retry = rp
+	return ss
+}
+
+// SideOutput is the pre-defined method that makes ServiceBusSender
+// a conduit.SideOutputter; name must be "failed".
+func (ss *ServiceBusSender) SideOutput(name string, trg conduit.Target) {
+	if name == "failed" {
+		ss.side = trg
+	}
+}
+
+// Consume is the pre-defined method that makes ServiceBusSender a Consumer.
+func (ss *ServiceBusSender) Consume(src conduit.Source) error {
+	return ss.consume(src, serviceBusMaxBytes)
+}
@@ -0,0 +1,800 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+// Fake Event Hubs and Service Bus namespace: a minimal AMQP broker
+// with the event hub "hub" with three partitions and the queue "queue".
+// Messages with body "poison" are rejected,
+// the first message containing "flaky" is released.
+type amqpBroker struct {
+	ln        net.Listener
+	door      sync.Mutex
+	parts     [][]*amqpMessage
+	queue     []*brokerEntry
+	seq       int64
+	conns     map[*brokerConn]bool
+	flaked    bool
+	completed int
+	released  int
+}
+
+// Message of the queue; owner is the connection holding the lock
+type brokerEntry struct {
+	msg   *amqpMessage
+	owner *brokerConn
+	id    uint32
+}
+
+type brokerConn struct {
+	b        *amqpBroker
+	conn     net.Conn
+	wdoor    sync.Mutex
+	links    map[uint32]*brokerLink
+	received uint32
+	sent     uint32
+	partial  []byte
+	partID   uint32
+	format   uint32
+}
+
+// Link by handle of the client; receiver if the client receives
+type brokerLink struct {
+	handle   uint32
+	receiver bool
+	addr     string
+	part     int
+	next     int
+	count    uint32
+	credit   uint32
+}
+
+func newAMQPBroker() (*amqpBroker, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	b := &amqpBroker{ln: ln, parts: make([][]*amqpMessage, 3), conns: make(map[*brokerConn]bool)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+	return b, nil
+}
+
+func (b *amqpBroker) connection() AzureConnection {
+	cs := fmt.Sprintf("Endpoint=amqp://%s/;SharedAccessKeyName=name;SharedAccessKey=secret", b.ln.Addr())
+	ac, _ := ParseAzureConnection(cs)
+	return ac
+}
+
+// Closes all connections
+func (b *amqpBroker) kick() {
+	b.door.Lock()
+	defer b.door.Unlock()
+	for bc := range b.conns {
+		bc.conn.Close()
+	}
+}
+
+func (b *amqpBroker) close() {
+	b.ln.Close()
+	b.kick()
+}
+
+// Number of events, messages in the queue, completed and released messages
+func (b *amqpBroker) counts() (int, int, int, int) {
+	b.door.Lock()
+	defer b.door.Unlock()
+	events := 0
+	for _, p := range b.parts {
+		events += len(p)
+	}
+	return events, len(b.queue), b.completed, b.released
+}
+
+func (bc *brokerConn) write(code uint64, fields []interface{}, payload []byte) error {
+	bc.wdoor.Lock()
+	defer bc.wdoor.Unlock()
+	_, err := bc.conn.Write(amqpEncodeFrame(&amqpFrame{code: code, fields: fields, payload: payload}))
+	return err
+}
+
+// Authenticates the client, opens the connection and a session
+func (bc *brokerConn) handshake(rd *bufio.Reader) error {
+	head := make([]byte, 8)
+	if _, err := io.ReadFull(rd, head); err != nil || !bytes.Equal(head, amqpSASLProto) {
+		return errors.New("no SASL header")
+	}
+	bc.conn.Write(amqpSASLProto)
+	bc.conn.Write(amqpEncodeFrame(&amqpFrame{sasl: true, code: amqpSASLMechanisms,
+		fields: []interface{}{[]amqpSymbol{"PLAIN"}}}))
+	f, err := amqpReadFrame(rd)
+	if err != nil {
+		return err
+	}
+	if amqpString(amqpField(f.fields, 1)) != "\x00name\x00secret" {
+		bc.conn.Write(amqpEncodeFrame(&amqpFrame{sasl: true, code: amqpSASLOutcome, fields: []interface{}{uint8(1)}}))
+		return errors.New("authentication failed")
+	}
+	bc.conn.Write(amqpEncodeFrame(&amqpFrame{sasl: true, code: amqpSASLOutcome, fields: []interface{}{uint8(0)}}))
+	if _, err = io.ReadFull(rd, head); err != nil || !bytes.Equal(head, amqpProto) {
+		return errors.New("no AMQP header")
+	}
+	bc.conn.Write(amqpProto)
+	if f, err = amqpReadFrame(rd); err != nil || f.code != amqpOpen {
+		return errors.New("no open")
+	}
+	// small frames, so that transfers are split
+	bc.write(amqpOpen, []interface{}{"broker", nil, uint32(512), uint16(0), uint32(200)}, nil)
+	if f, err = amqpReadFrame(rd); err != nil || f.code != amqpBegin {
+		return errors.New("no begin")
+	}
+	return bc.write(amqpBegin, []interface{}{uint16(0), bc.sent, uint32(amqpWindow), uint32(amqpWindow)}, nil)
+}
+
+func (b *amqpBroker) serve(conn net.Conn) {
+	bc := &brokerConn{b: b, conn: conn, links: make(map[uint32]*brokerLink)}
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	if bc.handshake(rd) != nil {
+		return
+	}
+	b.door.Lock()
+	b.conns[bc] = true
+	b.door.Unlock()
+	done := make(chan struct{})
+	defer func() {
+		close(done)
+		b.door.Lock()
+		defer b.door.Unlock()
+		delete(b.conns, bc)
+		// the client lost its locks
+		for _, e := range b.queue {
+			if e.owner == bc {
+				e.owner = nil
+			}
+		}
+	}()
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(2 * time.Millisecond):
+			}
+			if bc.deliver() != nil {
+				return
+			}
+		}
+	}()
+	for {
+		f, err := amqpReadFrame(rd)
+		if err != nil {
+			return
+		}
+		b.door.Lock()
+		err = bc.handle(f)
+		b.door.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Handles a frame of the client; must be called with door locked
+func (bc *brokerConn) handle(f *amqpFrame) error {
+	switch f.code {
+	case amqpAttach:
+		return bc.attach(f)
+	case amqpFlow:
+		h, ok := amqpUint(amqpField(f.fields, 4))
+		if l := bc.links[uint32(h)]; ok && l != nil && l.receiver {
+			count, _ := amqpUint(amqpField(f.fields, 5))
+			credit, _ := amqpUint(amqpField(f.fields, 6))
+			l.credit = uint32(count) + uint32(credit) - l.count
+		}
+	case amqpTransfer:
+		bc.received++
+		if id, ok := amqpUint(amqpField(f.fields, 1)); ok && len(bc.partial) == 0 {
+			bc.partID = uint32(id)
+			format, _ := amqpUint(amqpField(f.fields, 3))
+			bc.format = uint32(format)
+		}
+		bc.partial = append(bc.partial, f.payload...)
+		if more, _ := amqpField(f.fields, 5).(bool); more {
+			return nil
+		}
+		h, _ := amqpUint(amqpField(f.fields, 0))
+		data := bc.partial
+		bc.partial = nil
+		return bc.accept(bc.links[uint32(h)], data)
+	case amqpDisposition:
+		first, _ := amqpUint(amqpField(f.fields, 1))
+		last, ok := amqpUint(amqpField(f.fields, 2))
+		if !ok {
+			last = first
+		}
+		state, _ := amqpCode(amqpField(f.fields, 4))
+		var rest []*brokerEntry
+		for _, e := range bc.b.queue {
+			if e.owner != bc || uint64(e.id) < first || uint64(e.id) > last {
+				rest = append(rest, e)
+				continue
+			}
+			if state == amqpAccepted {
+				bc.b.completed++
+				continue
+			}
+			bc.b.released++
+			e.owner = nil
+			rest = append(rest, e)
+		}
+		bc.b.queue = rest
+	case amqpDetach:
+		h, _ := amqpUint(amqpField(f.fields, 0))
+		delete(bc.links, uint32(h))
+		return bc.write(amqpDetach, []interface{}{uint32(h), true}, nil)
+	case amqpClose:
+		bc.write(amqpClose, nil, nil)
+		return io.EOF
+	}
+	return nil
+}
+
+func (bc *brokerConn) attach(f *amqpFrame) error {
+	name := amqpField(f.fields, 0)
+	h, _ := amqpUint(amqpField(f.fields, 1))
+	receiver, _ := amqpField(f.fields, 2).(bool)
+	_, src := amqpCode(amqpField(f.fields, 5))
+	_, trg := amqpCode(amqpField(f.fields, 6))
+	l := &brokerLink{handle: uint32(h), receiver: receiver}
+	known := false
+	if receiver {
+		l.addr = amqpString(amqpField(src, 0))
+		known = l.addr == "$management" || l.addr == "queue"
+		var p string
+		if _, err := fmt.Sscanf(l.addr, "hub/ConsumerGroups/$Default/Partitions/%s", &p); err == nil {
+			l.part, _ = strconv.Atoi(p)
+			known = l.part < len(bc.b.parts)
+			l.next = bc.start(l.part, amqpField(src, 7))
+		}
+	} else {
+		l.addr = amqpString(amqpField(trg, 0))
+		known = l.addr == "$management" || l.addr == "queue" || l.addr == "hub"
+	}
+	if !known {
+		bc.write(amqpAttach, []interface{}{name, l.handle, !receiver, uint8(0), uint8(0), nil, nil}, nil)
+		return bc.write(amqpDetach, []interface{}{l.handle, true,
+			amqpList(amqpErrorCode, amqpSymbol("amqp:not-found"), "no entity "+l.addr)}, nil)
+	}
+	bc.links[l.handle] = l
+	err := bc.write(amqpAttach, []interface{}{name, l.handle, !receiver, amqpField(f.fields, 3), uint8(0),
+		amqpField(f.fields, 5), amqpField(f.fields, 6), nil, nil, uint32(0)}, nil)
+	if err != nil || receiver {
+		return err
+	}
+	return bc.flow(l)
+}
+
+// Index of the first event of a partition after the offset in the filter
+func (bc *brokerConn) start(part int, filter interface{}) int {
+	fm, _ := filter.(map[interface{}]interface{})
+	d, _ := fm[amqpSymbol("apache.org:selector-filter:string")].(amqpDescribed)
+	expr := amqpString(d.value)
+	i := strings.Index(expr, "> '")
+	if i < 0 || part >= len(bc.b.parts) {
+		return 0
+	}
+	offset := strings.TrimSuffix(expr[i+3:], "'")
+	switch offset {
+	case "-1":
+		return 0
+	case "@latest":
+		return len(bc.b.parts[part])
+	}
+	n, _ := strconv.Atoi(offset)
+	return n/10 + 1
+}
+
+// Grants credit to a sender of the client
+func (bc *brokerConn) flow(l *brokerLink) error {
+	l.credit = 100
+	return bc.write(amqpFlow, []interface{}{bc.received, uint32(amqpWindow), bc.sent, uint32(amqpWindow),
+		l.handle, l.count, l.credit}, nil)
+}
+
+// Accepts a message of a sender of the client
+func (bc *brokerConn) accept(l *brokerLink, data []byte) error {
+	if l == nil {
+		return errors.New("transfer on unknown link")
+	}
+	l.count++
+	l.credit--
+	m, err := amqpDecodeMessage(data)
+	if err != nil {
+		return err
+	}
+	msgs := []*amqpMessage{m}
+	if bc.format == amqpBatchFormat {
+		msgs = nil
+		for _, d := range m.data {
+			inner, err := amqpDecodeMessage(d)
+			if err != nil {
+				return err
+			}
+			msgs = append(msgs, inner)
+		}
+	}
+	var state interface{} = amqpList(amqpAccepted)
+	for _, m := range msgs {
+		body := string(m.body())
+		if body == "poison" {
+			state = amqpList(amqpRejected, amqpList(amqpErrorCode, amqpSymbol("amqp:invalid-field"), "poison"))
+		} else if strings.Contains(body, "flaky") && !bc.b.flaked {
+			bc.b.flaked = true
+			state = amqpList(amqpReleased)
+		}
+	}
+	if code, _ := amqpCode(state); code == amqpAccepted {
+		switch l.addr {
+		case "$management":
+			bc.manage(m)
+		case "hub":
+			for _, m := range msgs {
+				bc.publish(m)
+			}
+		case "queue":
+			for _, m := range msgs {
+				bc.b.seq++
+				m.annotations = map[interface{}]interface{}{amqpSymbol("x-opt-sequence-number"): bc.b.seq}
+				bc.b.queue = append(bc.b.queue, &brokerEntry{msg: m})
+			}
+		}
+	}
+	err = bc.write(amqpDisposition, []interface{}{true, bc.partID, bc.partID, true, state}, nil)
+	if err != nil {
+		return err
+	}
+	return bc.flow(l)
+}
+
+// Appends an event to the partition of its key
+func (bc *brokerConn) publish(m *amqpMessage) {
+	key := amqpString(m.annotation("x-opt-partition-key"))
+	p := int(bc.b.seq) % len(bc.b.parts)
+	if key != "" {
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		p = int(h.Sum32()) % len(bc.b.parts)
+	}
+	bc.b.seq++
+	m.annotations = map[interface{}]interface{}{
+		amqpSymbol("x-opt-offset"):          strconv.Itoa(len(bc.b.parts[p]) * 10),
+		amqpSymbol("x-opt-sequence-number"): int64(len(bc.b.parts[p])),
+		amqpSymbol("x-opt-enqueued-time"):   time.Now(),
+		amqpSymbol("x-opt-partition-key"):   key,
+	}
+	bc.b.parts[p] = append(bc.b.parts[p], m)
+}
+
+// Answers a management request with the partition IDs of the hub
+func (bc *brokerConn) manage(m *amqpMessage) {
+	rsp := &amqpMessage{props: map[string]interface{}{"status-code": int32(404)}}
+	if m.props["operation"] == "READ" && m.props["name"] == "hub" && m.props["type"] == "com.microsoft:eventhub" {
+		rsp.props["status-code"] = int32(200)
+		rsp.value = map[string]interface{}{"partition_ids": []string{"0", "1", "2"}}
+	}
+	for _, l := range bc.links {
+		if l.receiver && l.addr == "$management" && l.credit > 0 {
+			bc.send(l, rsp, true)
+		}
+	}
+}
+
+// Sends a message to a receiver of the client; must be called with door locked
+func (bc *brokerConn) send(l *brokerLink, m *amqpMessage, settled bool) (uint32, error) {
+	id := bc.sent
+	bc.sent++
+	l.count++
+	l.credit--
+	return id, bc.write(amqpTransfer, []interface{}{l.handle, id, []byte(strconv.Itoa(int(id))), uint32(0), settled, false},
+		m.encode())
+}
+
+// Delivers events and queued messages to receivers with credit
+func (bc *brokerConn) deliver() error {
+	bc.b.door.Lock()
+	defer bc.b.door.Unlock()
+	for _, l := range bc.links {
+		if !l.receiver {
+			continue
+		}
+		if l.addr == "queue" {
+			for _, e := range bc.b.queue {
+				if l.credit == 0 {
+					break
+				}
+				if e.owner != nil {
+					continue
+				}
+				id, err := bc.send(l, e.msg, false)
+				if err != nil {
+					return err
+				}
+				e.owner, e.id = bc, id
+			}
+			continue
+		}
+		if l.addr == "$management" {
+			continue
+		}
+		for l.credit > 0 && l.next < len(bc.b.parts[l.part]) {
+			if _, err := bc.send(l, bc.b.parts[l.part][l.next], true); err != nil {
+				return err
+			}
+			l.next++
+		}
+	}
+	return nil
+}
+
+// Items of the events in the order of reception
+func eventHubItems(recvd []interface{}) ([]kinesisItem, error) {
+	var items []kinesisItem
+	for _, inp := range recvd {
+		var i kinesisItem
+		ev := inp.(*EventHubEvent)
+		if err := json.Unmarshal(ev.Body, &i); err != nil {
+			return nil, err
+		}
+		if i.K != ev.PartitionKey {
+			return nil, errors.New(fmt.Sprintf("event %s has key %s", ev.Body, ev.PartitionKey))
+		}
+		items = append(items, i)
+	}
+	return items, nil
+}
+
+// Sends n items with keys k0 to k4 starting at from to the hub
+func putEventHub(b *amqpBroker, from, n int) error {
+	var items []interface{}
+	for i := from; i < from+n; i++ {
+		items = append(items, kinesisItem{K: fmt.Sprintf("k%d", i%5), N: i})
+	}
+	chn := conduit.NewChain(&AnyProducer{items}, nil, NewEventHubWriter(b.connection(), "hub"), small)
+	if chn.Run() != nil {
+		return errors.New(fmt.Sprintf("cannot send: %v", chn.Errs))
+	}
+	return nil
+}
+
+// Connection strings:
+// - Keys are case-insensitive
+// - TLS is used unless the scheme is amqp or the emulator is used
+func TestAzureConnection(t *testing.T) {
+	ac, err := ParseAzureConnection("Endpoint=sb://ns.servicebus.windows.net/;SharedAccessKeyName=root;SharedAccessKey=k=;EntityPath=hub")
+	if err != nil || ac.KeyName != "root" || ac.Key != "k=" || ac.EntityPath != "hub" {
+		t.Fatalf("ParseAzureConnection: unexpected connection %+v (%v)", ac, err)
+	}
+	o, _ := ac.options(time.Second)
+	if !o.tls || o.addr != "ns.servicebus.windows.net:5671" || o.host != "ns.servicebus.windows.net" {
+		t.Errorf("options: unexpected options %+v", o)
+	}
+	ac, _ = ParseAzureConnection("endpoint=sb://localhost;usedevelopmentemulator=true")
+	if o, _ = ac.options(time.Second); o.tls || o.addr != "localhost:5672" {
+		t.Errorf("options: unexpected options for emulator %+v", o)
+	}
+	if _, err = ParseAzureConnection("SharedAccessKey=k"); err == nil {
+		t.Errorf("ParseAzureConnection: connection without endpoint accepted")
+	}
+	if NewEventHubReader(ac, "", "") != nil {
+		t.Errorf("NewEventHubReader: reader without event hub created")
+	}
+}
+
+// Event Hubs:
+// - Events are sent in batches per partition key, split into frames
+// - Released events are sent again, rejected ones go to the side output
+// - The reader discovers the partitions and reads them
+// with the events of the same key in order
+// - Offsets are stored, so that a new reader continues after them
+func TestEventHubs(t *testing.T) {
+	b, err := newAMQPBroker()
+	if err != nil {
+		t.Fatalf("EventHubs: cannot start broker: %v", err)
+	}
+	defer b.close()
+
+	items := []interface{}{kinesisItem{K: "flaky", N: -1}, "poison"}
+	for i := 0; i < 300; i++ {
+		items = append(items, kinesisItem{K: fmt.Sprintf("k%d", i%5), N: i})
+	}
+	failed := &sideCollector{items: make(chan interface{}, 10)}
+	ew := NewEventHubWriter(b.connection(), "hub").SetRetry(fastRetry)
+	chn := conduit.NewChain(&AnyProducer{items}, nil, ew, small)
+	chn.AddSide(ew, "failed", failed)
+	if err := chn.Run(); err != nil {
+		t.Fatalf("EventHubWriter failed: %v", chn.Errs)
+	}
+	f := (<-failed.items).(*FailedRequest)
+	if f.Item != "poison" || f.Attempts != 1 {
+		t.Errorf("EventHubWriter: unexpected failed request %+v", f)
+	}
+	if events, _, _, _ := b.counts(); events != 301 {
+		t.Fatalf("EventHubWriter: %d events sent", events)
+	}
+
+	st := conduit.NewMemStore()
+	c := &TakeConsumer{n: 301}
+	er := NewEventHubReader(b.connection(), "hub", "").SetStore(st)
+	if err := conduit.NewChain(er, nil, c, small).Run(); err != nil {
+		t.Fatalf("EventHubReader failed: %v", err)
+	}
+	all, err := eventHubItems(c.recvd)
+	if err != nil {
+		t.Fatalf("EventHubReader: %v", err)
+	}
+	var recvd []kinesisItem
+	for _, i := range all {
+		if i.K != "flaky" {
+			recvd = append(recvd, i)
+		}
+	}
+	if err := checkKinesis(recvd, 300); err != nil || len(recvd) != 300 {
+		t.Errorf("EventHubReader: %d events received: %v", len(recvd), err)
+	}
+
+	if err := putEventHub(b, 300, 50); err != nil {
+		t.Fatalf("EventHubWriter: %v", err)
+	}
+	c = &TakeConsumer{n: 50}
+	er = NewEventHubReader(b.connection(), "hub", "").SetStore(st)
+	if err := conduit.NewChain(er, nil, c, small).Run(); err != nil {
+		t.Fatalf("EventHubReader failed: %v", err)
+	}
+	recvd, _ = eventHubItems(c.recvd)
+	for _, i := range recvd {
+		if i.N < 300 {
+			t.Fatalf("EventHubReader: event %d received again", i.N)
+		}
+	}
+}
+
+// Event Hubs with offsets stored on checkpoints:
+// - Offsets are stored when a checkpoint covers them
+// - After a crash, reading continues after the stored offsets
+func TestEventHubsCheckpoint(t *testing.T) {
+	b, err := newAMQPBroker()
+	if err != nil {
+		t.Fatalf("EventHubs: cannot start broker: %v", err)
+	}
+	defer b.close()
+	if err = putEventHub(b, 0, 400); err != nil {
+		t.Fatalf("EventHubWriter: %v", err)
+	}
+
+	st := conduit.NewMemStore()
+	cps := conduit.NewMemCheckpoints()
+	newReader := func() *EventHubReader {
+		return NewEventHubReader(b.connection(), "hub", "").SetPrefetch(20).SetStore(st).StoreOnCheckpoint()
+	}
+	c := &StopConsumer{n: 300, err: errors.New("crash")}
+	er := newReader()
+	chn := conduit.NewChain(er, nil, c, small)
+	chn.SetCheckpoints(time.Millisecond, cps)
+	if chn.Run() == nil {
+		t.Fatalf("EventHubReader: chain did not crash")
+	}
+	// the producer is not stopped by the failing consumer
+	er.Cancel()
+	cp, _ := cps.Latest()
+	if cp == nil {
+		t.Fatalf("EventHubReader: no checkpoint taken")
+	}
+	pos := int(cp.Position)
+	if pos > len(c.recvd) {
+		t.Fatalf("EventHubReader: checkpoint at %d after %d events", pos, len(c.recvd))
+	}
+
+	rest := &StopConsumer{n: 400 - pos, err: conduit.EOS}
+	if err := conduit.NewChain(newReader(), nil, rest, small).Run(); err != nil {
+		t.Fatalf("EventHubReader: restarted chain failed: %v", err)
+	}
+	before, _ := eventHubItems(c.recvd[:pos])
+	after, err := eventHubItems(rest.recvd)
+	if err != nil {
+		t.Fatalf("EventHubReader: %v", err)
+	}
+	if err := checkKinesis(append(before, after...), 400); err != nil || len(before)+len(after) != 400 {
+		t.Errorf("EventHubReader: after restart: %d events: %v", len(before)+len(after), err)
+	}
+}
+
+// Consumer that closes the connections of the broker
+// after n items
+type KickConsumer struct {
+	b     *amqpBroker
+	n     int
+	total int
+	recvd []interface{}
+}
+
+func (c *KickConsumer) Consume(src conduit.Source) error {
+	for inp := range src {
+		c.recvd = append(c.recvd, inp)
+		if len(c.recvd) == c.n {
+			c.b.kick()
+		}
+		if len(c.recvd) == c.total {
+			return conduit.EOS
+		}
+	}
+	return nil
+}
+
+// Event Hubs with connection loss:
+// - The reader reconnects and continues after the events sent
+func TestEventHubsReconnect(t *testing.T) {
+	b, err := newAMQPBroker()
+	if err != nil {
+		t.Fatalf("EventHubs: cannot start broker: %v", err)
+	}
+	defer b.close()
+	if err = putEventHub(b, 0, 200); err != nil {
+		t.Fatalf("EventHubWriter: %v", err)
+	}
+	c := &KickConsumer{b: b, n: 50, total: 200}
+	er := NewEventHubReader(b.connection(), "hub", "").SetPartitions("0", "1", "2").SetPrefetch(10).SetRetry(fastRetry)
+	if err := conduit.NewChain(er, nil, c, small).Run(); err != nil {
+		t.Fatalf("EventHubReader failed: %v", err)
+	}
+	recvd, err := eventHubItems(c.recvd)
+	if err != nil {
+		t.Fatalf("EventHubReader: %v", err)
+	}
+	if err := checkKinesis(recvd, 200); err != nil {
+		t.Errorf("EventHubReader: %v", err)
+	}
+	for i, n := range recvd {
+		for _, m := range recvd[:i] {
+			if m.N == n.N {
+				t.Fatalf("EventHubReader: event %d received twice", n.N)
+			}
+		}
+	}
+}
+
+// Service Bus:
+// - Messages are sent in batches per session
+// - Rejected messages go to the side output
+// - Received messages are completed
+// - Messages of a lost connection are redelivered
+func TestServiceBus(t *testing.T) {
+	b, err := newAMQPBroker()
+	if err != nil {
+		t.Fatalf("ServiceBus: cannot start broker: %v", err)
+	}
+	defer b.close()
+
+	items := []interface{}{"poison"}
+	for i := 0; i < 200; i++ {
+		items = append(items, kinesisItem{K: fmt.Sprintf("k%d", i%5), N: i})
+	}
+	failed := &sideCollector{items: make(chan interface{}, 10)}
+	ss := NewServiceBusSender(b.connection(), "queue").SetRetry(fastRetry)
+	chn := conduit.NewChain(&AnyProducer{items}, nil, ss, small)
+	chn.AddSide(ss, "failed", failed)
+	if err := chn.Run(); err != nil {
+		t.Fatalf("ServiceBusSender failed: %v", chn.Errs)
+	}
+	f := (<-failed.items).(*FailedRequest)
+	if f.Item != "poison" {
+		t.Errorf("ServiceBusSender: unexpected failed request %+v", f)
+	}
+	if _, queued, _, _ := b.counts(); queued != 200 {
+		t.Fatalf("ServiceBusSender: %d messages sent", queued)
+	}
+
+	c := &KickConsumer{b: b, n: 50, total: 200}
+	sr := NewServiceBusReceiver(b.connection(), "queue").SetRetry(fastRetry)
+	if err := conduit.NewChain(sr, nil, c, small).Run(); err != nil {
+		t.Fatalf("ServiceBusReceiver failed: %v", err)
+	}
+	seen := make(map[int]bool)
+	for _, inp := range c.recvd {
+		msg := inp.(*ServiceBusMsg)
+		var i kinesisItem
+		if err := json.Unmarshal(msg.Body, &i); err != nil {
+			t.Fatalf("ServiceBusReceiver: %v", err)
+		}
+		if i.K != msg.SessionID || msg.SequenceNumber == 0 {
+			t.Errorf("ServiceBusReceiver: unexpected message %+v", msg)
+		}
+		seen[i.N] = true
+	}
+	// messages of the lost connection may be received twice
+	_, queued, completed, _ := b.counts()
+	if completed+queued != 200 || completed > len(seen) || completed < len(seen)-10 {
+		t.Errorf("ServiceBusReceiver: %d messages received, %d completed, %d left", len(seen), completed, queued)
+	}
+}
+
+// Service Bus with completion on checkpoints:
+// - Only messages covered by a checkpoint are completed
+// - After a crash, the other messages are redelivered
+func TestServiceBusCheckpoint(t *testing.T) {
+	b, err := newAMQPBroker()
+	if err != nil {
+		t.Fatalf("ServiceBus: cannot start broker: %v", err)
+	}
+	defer b.close()
+	var items []interface{}
+	for i := 0; i < 300; i++ {
+		items = append(items, kinesisItem{K: "k", N: i})
+	}
+	if chn := conduit.NewChain(&AnyProducer{items}, nil, NewServiceBusSender(b.connection(), "queue"), small); chn.Run() != nil {
+		t.Fatalf("ServiceBusSender failed: %v", chn.Errs)
+	}
+
+	cps := conduit.NewMemCheckpoints()
+	newReceiver := func() *ServiceBusReceiver {
+		return NewServiceBusReceiver(b.connection(), "queue").SetPrefetch(300).AckOnCheckpoint()
+	}
+	c := &StopConsumer{n: 250, err: errors.New("crash")}
+	sr := newReceiver()
+	chn := conduit.NewChain(sr, nil, c, small)
+	chn.SetCheckpoints(time.Millisecond, cps)
+	if chn.Run() == nil {
+		t.Fatalf("ServiceBusReceiver: chain did not crash")
+	}
+	sr.Cancel()
+	cp, _ := cps.Latest()
+	if cp == nil {
+		t.Fatalf("ServiceBusReceiver: no checkpoint taken")
+	}
+	pos := int(cp.Position)
+	// dispositions are processed asynchronously
+	_, queued, completed, released := b.counts()
+	for i := 0; i < 100 && (completed != pos || released == 0); i++ {
+		time.Sleep(10 * time.Millisecond)
+		_, queued, completed, released = b.counts()
+	}
+	if completed != pos || queued != 300-pos || released == 0 {
+		t.Fatalf("ServiceBusReceiver: checkpoint at %d, %d completed, %d released", pos, completed, released)
+	}
+
+	rest := &StopConsumer{n: 300 - pos, err: conduit.EOS}
+	if err := conduit.NewChain(newReceiver(), nil, rest, small).Run(); err != nil {
+		t.Fatalf("ServiceBusReceiver: restarted chain failed: %v", err)
+	}
+	seen := make(map[int]bool)
+	for _, inp := range append(c.recvd[:pos], rest.recvd...) {
+		var i kinesisItem
+		json.Unmarshal(inp.(*ServiceBusMsg).Body, &i)
+		seen[i.N] = true
+	}
+	if len(seen) != 300 {
+		t.Errorf("ServiceBusReceiver: %d messages after restart", len(seen))
+	}
+}
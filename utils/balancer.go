@@ -0,0 +1,134 @@
+package utils
+
+import (
+	"github.com/toschoo/conduit"
+)
+
+// BalanceMode defines how a Balancer chooses the worker
+// for the next item.
+type BalanceMode int
+
+const (
+	// RoundRobin passes items to the workers in turn.
+	RoundRobin BalanceMode = iota
+	// LeastLoaded passes each item to the worker
+	// with the fewest items waiting in its input buffer.
+	LeastLoaded
+)
+
+// Balancer is a Conduit that distributes incoming data
+// over a number of workers to parallelize heavyweight work,
+// e.g. N HTTP uploaders. Each item is processed by exactly one worker.
+// A worker is a branch added with Worker; workers without consumer
+// send the output of their pipe back into the chain,
+// where the outputs of all such workers are merged.
+// Merged output is not ordered.
+type Balancer struct {
+	workers []Branch
+	mode    BalanceMode
+	sz      int
+}
+
+// NewBalancer creates a new Balancer without workers.
+func NewBalancer(mode BalanceMode) (bl *Balancer) {
+	bl = new(Balancer)
+	if bl != nil {
+		bl.mode = mode
+		bl.sz = 10
+	}
+	return
+}
+
+// Worker adds a worker consisting of pipe and consumer.
+// Either may be nil, but not both. If consumer is nil,
+// the output of pipe is merged into the chain.
+func (bl *Balancer) Worker(pipe []conduit.Conduit, consumer conduit.Consumer) *Balancer {
+	bl.workers = append(bl.workers, Branch{pipe, consumer})
+	return bl
+}
+
+// Workers adds n identical workers created by f.
+func (bl *Balancer) Workers(n int, f func(i int) ([]conduit.Conduit, conduit.Consumer)) *Balancer {
+	for i := 0; i < n; i++ {
+		bl = bl.Worker(f(i))
+	}
+	return bl
+}
+
+// merger is a Consumer that forwards data into the target
+// shared by several branches.
+type merger struct {
+	trg conduit.Target
+}
+
+func (m *merger) Consume(src conduit.Source) error {
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			continue
+		}
+		m.trg <- inp
+	}
+	return nil
+}
+
+// Conduct is the pre-defined method that makes Balancer a Conduit.
+// Conduct terminates when all workers have terminated
+// and returns the first error reported by a worker.
+// Without workers, Balancer passes data through.
+// Barriers are sent down the chain when all workers
+// have processed the data received before the barrier
+// (see Branch).
+func (bl *Balancer) Conduct(src conduit.Source, trg conduit.Target) error {
+	rbs := make([]*runningBranch, len(bl.workers))
+	for i, w := range bl.workers {
+		if w.Consumer == nil {
+			w.Consumer = &merger{trg}
+		}
+		rbs[i] = startBranch(w, bl.sz)
+	}
+
+	next := 0
+	for inp := range src {
+		if len(rbs) == 0 {
+			trg <- inp
+			continue
+		}
+		if conduit.IsBarrier(inp) {
+			syncBranches(inp, rbs...)
+			trg <- inp
+			continue
+		}
+		i := next
+		if bl.mode == LeastLoaded {
+			for j := range rbs {
+				k := (next + j) % len(rbs)
+				if len(rbs[k].in) < len(rbs[i].in) {
+					i = k
+				}
+			}
+		}
+		next = (i + 1) % len(rbs)
+		rbs[i].in <- inp
+	}
+
+	var err error
+	for _, rb := range rbs {
+		e := rb.stop()
+		if err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Volatile is the pre-defined method that makes Balancer a conduit.Volatile:
+// a Balancer is volatile if a worker keeps state,
+// which is not included in the checkpoints of the chain.
+func (bl *Balancer) Volatile() bool {
+	for _, w := range bl.workers {
+		if w.stateful() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,191 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+// Balancer:
+// - It is processed without errors
+// - Each item is processed by exactly one worker
+// - Output of workers without consumer is merged into the chain
+func TestBalancerChain(t *testing.T) {
+	for i := 0; i < numOfTests; i++ {
+		for _, mode := range []BalanceMode{RoundRobin, LeastLoaded} {
+			for _, merge := range []bool{false, true} {
+				err := testBalancerChain(numOfData, 4, mode, merge)
+				if err != nil {
+					m := fmt.Sprintf("BalancerChain failed: %v", err)
+					t.Error(m)
+				}
+			}
+		}
+	}
+}
+
+func testBalancerChain(n, k int, mode BalanceMode, merge bool) error {
+
+	p := &SeqProducer{makeSeq(n)}
+	c := new(BaseConsumer)
+
+	cs := make([]*BaseConsumer, k)
+	b := NewBalancer(mode).Workers(k, func(i int) ([]conduit.Conduit, conduit.Consumer) {
+		pipe := []conduit.Conduit{NewIdentity()}
+		if merge {
+			return pipe, nil
+		}
+		cs[i] = new(BaseConsumer)
+		return pipe, cs[i]
+	})
+
+	chn := conduit.NewChain(p, []conduit.Conduit{b}, c, small)
+
+	err := chn.Run()
+	if err != nil {
+		m := fmt.Sprintf("error on running chain: %v", err)
+		return errors.New(m)
+	}
+
+	var have []int
+	if merge {
+		have = c.recvd
+	} else {
+		if len(c.recvd) != 0 {
+			return errors.New("items sent down the chain")
+		}
+		for i, w := range cs {
+			if mode == RoundRobin && len(w.recvd) != n/k {
+				m := fmt.Sprintf("worker %d: expected %d items, have %d", i, n/k, len(w.recvd))
+				return errors.New(m)
+			}
+			have = append(have, w.recvd...)
+		}
+	}
+	if len(have) != n {
+		m := fmt.Sprintf("expected %d items, have %d", n, len(have))
+		return errors.New(m)
+	}
+	sort.Ints(have)
+	for i := range have {
+		if have[i] != i {
+			return errors.New("Received values differ from original!")
+		}
+	}
+	return nil
+}
+
+// Balancer with stateful workers:
+// - It is volatile if a worker has a volatile or checkpointed component
+func TestBalancerVolatile(t *testing.T) {
+	b := NewBalancer(RoundRobin).Worker([]conduit.Conduit{NewIdentity()}, new(BaseConsumer))
+	if b.Volatile() {
+		t.Errorf("Balancer: volatile without stateful worker")
+	}
+	b.Worker(nil, NewKeyCounter(nil))
+	if !b.Volatile() {
+		t.Errorf("Balancer: not volatile with checkpointed consumer")
+	}
+	b = NewBalancer(RoundRobin).Worker([]conduit.Conduit{NewIdentity(), NewTake(1)}, nil)
+	if !b.Volatile() {
+		t.Errorf("Balancer: not volatile with volatile conduit")
+	}
+}
+
+// Counts the items it consumes
+type SyncConsumer struct {
+	door sync.Mutex
+	n    int
+}
+
+func (c *SyncConsumer) Consume(src conduit.Source) error {
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			continue
+		}
+		time.Sleep(100 * time.Microsecond)
+		c.door.Lock()
+		c.n++
+		c.door.Unlock()
+	}
+	return nil
+}
+
+func (c *SyncConsumer) count() int {
+	c.door.Lock()
+	defer c.door.Unlock()
+	return c.n
+}
+
+// Checks at each barrier that f returns the number
+// of items before the barrier
+type BarrierConsumer struct {
+	f     func(id uint64) int
+	have  func() int
+	recvd []interface{}
+	errs  []string
+}
+
+func (c *BarrierConsumer) Consume(src conduit.Source) error {
+	for inp := range src {
+		if b, ok := inp.(*conduit.Barrier); ok {
+			if n := c.have(); n != c.f(b.ID) {
+				c.errs = append(c.errs, fmt.Sprintf("%d items before barrier %d", n, b.ID))
+			}
+		}
+		c.recvd = append(c.recvd, inp)
+	}
+	return nil
+}
+
+// Balancer with barriers:
+// - All merged output preceding a barrier is sent before the barrier
+// - Consumers of workers have processed their items before the barrier
+func TestBalancerBarrier(t *testing.T) {
+	slow := TransformFunc(func(inp interface{}) (interface{}, error) {
+		time.Sleep(time.Duration(inp.(int)%3) * 100 * time.Microsecond)
+		return inp, nil
+	})
+	var items []interface{}
+	for i := 0; i < 100; i++ {
+		items = append(items, i)
+		if i%10 == 9 {
+			items = append(items, &conduit.Barrier{ID: uint64(i)})
+		}
+	}
+	b := NewBalancer(RoundRobin).Workers(4, func(i int) ([]conduit.Conduit, conduit.Consumer) {
+		return []conduit.Conduit{NewTransformer(slow)}, nil
+	})
+	sc := new(SyncConsumer)
+	b.Worker(nil, sc)
+	c := &BarrierConsumer{f: func(id uint64) int { return int(id+1) / 5 }, have: sc.count}
+	if err := conduit.NewChain(&AnyProducer{src: items}, []conduit.Conduit{b}, c, small).Run(); err != nil {
+		t.Fatalf("BalancerBarrier failed: %v", err)
+	}
+	for _, e := range c.errs {
+		t.Errorf("BalancerBarrier: consumer has %s", e)
+	}
+	n := 0
+	merged := 0
+	for _, v := range c.recvd {
+		if bar, ok := v.(*conduit.Barrier); ok {
+			n++
+			if merged != int(bar.ID+1)*4/5 {
+				t.Errorf("BalancerBarrier: %d items before barrier %d", merged, bar.ID)
+			}
+			continue
+		}
+		if v.(int) > int(n*10+9) || v.(int) < n*10 {
+			t.Errorf("BalancerBarrier: item %d after %d barriers", v, n)
+		}
+		merged++
+	}
+	if n != 10 {
+		t.Errorf("BalancerBarrier: expected 10 barriers, have %d", n)
+	}
+}
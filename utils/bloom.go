@@ -0,0 +1,244 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"hash/fnv"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+// BloomFilter is a set of keys that may report keys
+// it does not contain (false positives), but never
+// misses keys it contains. Its size depends
+// only on the capacity and false-positive rate.
+type BloomFilter struct {
+	bits []uint64
+	m, k uint64
+	n    uint64
+}
+
+// NewBloomFilter creates a new BloomFilter for n keys with the
+// false-positive rate p, which holds for up to n keys.
+func NewBloomFilter(n uint64, p float64) (b *BloomFilter) {
+	if n == 0 || p <= 0 || p >= 1 {
+		return nil
+	}
+	m := uint64(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	k := uint64(math.Max(1, math.Round(float64(m)/float64(n)*math.Ln2)))
+	b = new(BloomFilter)
+	if b != nil {
+		b.bits = make([]uint64, (m+63)/64)
+		b.m, b.k = m, k
+	}
+	return
+}
+
+// Positions of key by double hashing
+func (b *BloomFilter) positions(key string, f func(uint64) bool) bool {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h1 := mix64(h.Sum64())
+	h2 := mix64(h1^0x9e3779b97f4a7c15) | 1
+	for i := uint64(0); i < b.k; i++ {
+		if !f((h1 + i*h2) % b.m) {
+			return false
+		}
+	}
+	return true
+}
+
+// Test reports whether key may be in the filter.
+func (b *BloomFilter) Test(key string) bool {
+	return b.positions(key, func(p uint64) bool {
+		return b.bits[p/64]&(1<<(p%64)) != 0
+	})
+}
+
+// Add adds key to the filter and reports
+// whether it may have been in the filter before.
+func (b *BloomFilter) Add(key string) bool {
+	seen := true
+	b.positions(key, func(p uint64) bool {
+		if b.bits[p/64]&(1<<(p%64)) == 0 {
+			seen = false
+			b.bits[p/64] |= 1 << (p % 64)
+		}
+		return true
+	})
+	if !seen {
+		b.n++
+	}
+	return seen
+}
+
+// Len returns the number of keys added (not counting false positives).
+func (b *BloomFilter) Len() uint64 {
+	return b.n
+}
+
+// BloomDedup is a Conduit that drops items whose keys it has seen before
+// using BloomFilters, so that memory does not grow
+// with the number of keys. Since the filters report
+// false positives, some unique items are dropped as well
+// (at the configured rate). Without rotation, one filter is used,
+// whose false-positive rate increases beyond its capacity.
+// With rotation (see SetRotation), keys are remembered
+// in two generations of filters: when the current generation
+// is full or older than the rotation interval, it becomes
+// the previous one and the oldest generation is forgotten;
+// keys seen again are carried over to the current generation.
+// The filters are included in checkpoints (see conduit.Checkpointer).
+// Duplicates are sent to the side output "duplicates"
+// (see conduit.SideOutputter); if the side output is not connected,
+// they are dropped and counted.
+type BloomDedup struct {
+	kf      KeyFunc
+	n       uint64
+	p       float64
+	every   time.Duration
+	door    sync.Mutex
+	cur     *BloomFilter
+	prev    *BloomFilter
+	born    time.Time
+	side    conduit.Target
+	dropped uint64
+}
+
+// NewBloomDedup creates a new BloomDedup Conduit
+// for n keys per generation with the false-positive rate p.
+// The keys of items are obtained using kf (see KeyFunc and Keyed).
+func NewBloomDedup(kf KeyFunc, n uint64, p float64) (d *BloomDedup) {
+	cur := NewBloomFilter(n, p)
+	if cur == nil {
+		return nil
+	}
+	d = new(BloomDedup)
+	if d != nil {
+		d.kf = kf
+		d.n, d.p = n, p
+		d.cur = cur
+	}
+	return
+}
+
+// SetRotation enables rotation of generations
+// when they are full or every interval (if greater than 0).
+func (d *BloomDedup) SetRotation(interval time.Duration) *BloomDedup {
+	d.door.Lock()
+	defer d.door.Unlock()
+	d.every = interval
+	d.prev = NewBloomFilter(d.n, d.p)
+	d.born = time.Now()
+	return d
+}
+
+// Dropped returns the number of duplicates dropped.
+func (d *BloomDedup) Dropped() uint64 {
+	return atomic.LoadUint64(&d.dropped)
+}
+
+// SideOutput is the pre-defined method that makes BloomDedup
+// a conduit.SideOutputter. BloomDedup has the side output "duplicates".
+func (d *BloomDedup) SideOutput(name string, trg conduit.Target) {
+	if name == "duplicates" {
+		d.side = trg
+	}
+}
+
+// Checks and adds key
+func (d *BloomDedup) seen(key string) bool {
+	d.door.Lock()
+	defer d.door.Unlock()
+	if d.prev == nil {
+		return d.cur.Add(key)
+	}
+	if d.cur.Len() >= d.n || d.every > 0 && time.Since(d.born) >= d.every {
+		d.prev, d.cur = d.cur, NewBloomFilter(d.n, d.p)
+		d.born = time.Now()
+	}
+	if d.prev.Test(key) {
+		// keep the key for another generation
+		d.cur.Add(key)
+		return true
+	}
+	return d.cur.Add(key)
+}
+
+// Conduct is the pre-defined method that makes BloomDedup a Conduit.
+func (d *BloomDedup) Conduct(src conduit.Source, trg conduit.Target) error {
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			trg <- inp
+			continue
+		}
+		if !d.seen(keyOf(d.kf, inp)) {
+			trg <- inp
+			continue
+		}
+		if d.side != nil {
+			d.side <- inp
+		} else {
+			atomic.AddUint64(&d.dropped, 1)
+		}
+	}
+	return nil
+}
+
+// checkpointed state of a BloomDedup
+type bloomState struct {
+	Cur, Prev   []uint64
+	CurN, PrevN uint64
+	Age         time.Duration
+}
+
+// Snapshot is the pre-defined method that makes BloomDedup
+// a conduit.Checkpointer.
+func (d *BloomDedup) Snapshot() ([]byte, error) {
+	d.door.Lock()
+	st := bloomState{Cur: d.cur.bits, CurN: d.cur.n}
+	if d.prev != nil {
+		st.Prev, st.PrevN = d.prev.bits, d.prev.n
+		st.Age = time.Since(d.born)
+	}
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(&st)
+	d.door.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Restore is the pre-defined method that makes BloomDedup
+// a conduit.Checkpointer. The BloomDedup must have been created
+// with the same capacity and false-positive rate
+// as the one the snapshot was taken of.
+func (d *BloomDedup) Restore(b []byte) error {
+	var st bloomState
+	err := gob.NewDecoder(bytes.NewReader(b)).Decode(&st)
+	if err != nil {
+		return err
+	}
+
+	d.door.Lock()
+	defer d.door.Unlock()
+
+	if len(st.Cur) != len(d.cur.bits) || (st.Prev != nil) != (d.prev != nil) ||
+		st.Prev != nil && len(st.Prev) != len(d.prev.bits) {
+		return errors.New("bloom filters differ from snapshot")
+	}
+	copy(d.cur.bits, st.Cur)
+	d.cur.n = st.CurN
+	if d.prev != nil {
+		copy(d.prev.bits, st.Prev)
+		d.prev.n = st.PrevN
+		d.born = time.Now().Add(-st.Age)
+	}
+	return nil
+}
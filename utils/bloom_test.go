@@ -0,0 +1,105 @@
+package utils
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+// Bloom filter:
+// - Added keys are always found
+// - The false-positive rate is close to the configured rate
+func TestBloomFilter(t *testing.T) {
+	if NewBloomFilter(0, 0.01) != nil || NewBloomFilter(10, 1) != nil {
+		t.Errorf("BloomFilter: invalid arguments accepted")
+	}
+	b := NewBloomFilter(10000, 0.01)
+	for i := 0; i < 10000; i++ {
+		b.Add(fmt.Sprintf("key%d", i))
+	}
+	fp := 0
+	for i := 0; i < 10000; i++ {
+		if !b.Test(fmt.Sprintf("key%d", i)) {
+			t.Fatalf("BloomFilter: key%d not found", i)
+		}
+		if b.Test(fmt.Sprintf("other%d", i)) {
+			fp++
+		}
+	}
+	if fp > 200 || b.Len() < 9900 {
+		t.Errorf("BloomFilter: %d false positives, %d keys", fp, b.Len())
+	}
+}
+
+// Bloom dedup:
+// - Duplicates are dropped and counted or sent to the side output
+// - With rotation, keys are forgotten after two generations unless seen again
+// - Restored filters remember the keys of the snapshot
+func TestBloomDedup(t *testing.T) {
+	if NewBloomDedup(nil, 0, 0.01) != nil {
+		t.Errorf("BloomDedup: zero capacity accepted")
+	}
+	var items []interface{}
+	for i := 0; i < 3000; i++ {
+		items = append(items, i%1000)
+		if i == 1500 {
+			items = append(items, &conduit.Barrier{})
+		}
+	}
+	d := NewBloomDedup(nil, 1000, 0.001)
+	ac := &AnyConsumer{}
+	if err := conduit.NewChain(&AnyProducer{src: items}, []conduit.Conduit{d}, ac, small).Run(); err != nil {
+		t.Fatalf("BloomDedup failed: %v", err)
+	}
+	barriers := 0
+	for _, r := range ac.recvd {
+		if conduit.IsBarrier(r) {
+			barriers++
+		}
+	}
+	if barriers != 1 || len(ac.recvd) < 995 || len(ac.recvd) > 1001 || ac.recvd[0] != 0 ||
+		uint64(len(ac.recvd)-1)+d.Dropped() != 3000 {
+		t.Errorf("BloomDedup: received %d items, dropped %d", len(ac.recvd), d.Dropped())
+	}
+
+	d = NewBloomDedup(nil, 2, 0.001).SetRotation(0)
+	dups := make(chan interface{}, 10)
+	d.SideOutput("duplicates", dups)
+	items = []interface{}{"a", "b", "a", "c", "d", "e", "f", "a", "b"}
+	ac = &AnyConsumer{}
+	if err := conduit.NewChain(&AnyProducer{src: items}, []conduit.Conduit{d}, ac, small).Run(); err != nil {
+		t.Fatalf("BloomDedup failed: %v", err)
+	}
+	// generations: [a b] [(a) c] [d e] [f a] [b], a and b are forgotten
+	if fmt.Sprint(ac.recvd) != "[a b c d e f a b]" || len(dups) != 1 || <-dups != "a" || d.Dropped() != 0 {
+		t.Errorf("BloomDedup: received %v, %d duplicates", ac.recvd, len(dups))
+	}
+
+	d = NewBloomDedup(nil, 100, 0.001).SetRotation(20 * time.Millisecond)
+	if d.seen("x") || !d.seen("x") {
+		t.Errorf("BloomDedup: x not remembered")
+	}
+	time.Sleep(25 * time.Millisecond)
+	d.seen("y")
+	time.Sleep(25 * time.Millisecond)
+	if d.seen("y") != true || d.seen("x") {
+		t.Errorf("BloomDedup: unexpected rotation")
+	}
+
+	b, err := d.Snapshot()
+	if err != nil {
+		t.Fatalf("BloomDedup: cannot snapshot: %v", err)
+	}
+	d2 := NewBloomDedup(nil, 100, 0.001).SetRotation(20 * time.Millisecond)
+	if err = d2.Restore(b); err != nil {
+		t.Fatalf("BloomDedup: cannot restore: %v", err)
+	}
+	if !d2.seen("x") || !d2.seen("y") || d2.seen("z") {
+		t.Errorf("BloomDedup: restored filters differ")
+	}
+	if NewBloomDedup(nil, 10, 0.001).Restore(b) == nil {
+		t.Errorf("BloomDedup: restored snapshot of other filters")
+	}
+}
@@ -0,0 +1,148 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/toschoo/conduit"
+)
+
+// Known byte order marks; UTF-32LE must be checked before UTF-16LE
+var boms = []struct {
+	name string
+	mark []byte
+	cs   Charset
+}{
+	{"UTF-32LE", []byte{0xff, 0xfe, 0, 0}, UTF32LE},
+	{"UTF-32BE", []byte{0, 0, 0xfe, 0xff}, UTF32BE},
+	{"UTF-8", []byte{0xef, 0xbb, 0xbf}, nil},
+	{"UTF-16LE", []byte{0xff, 0xfe}, UTF16LE},
+	{"UTF-16BE", []byte{0xfe, 0xff}, UTF16BE},
+}
+
+// Returns the encoding indicated by the BOM at the beginning of b,
+// the corresponding Charset (nil for UTF-8) and the length of the BOM
+func detectBOM(b []byte) (string, Charset, int) {
+	for _, bom := range boms {
+		if bytes.HasPrefix(b, bom.mark) {
+			return bom.name, bom.cs, len(bom.mark)
+		}
+	}
+	return "", nil, 0
+}
+
+// BOMStripper is a Conduit that detects a byte order mark
+// (UTF-8, UTF-16 or UTF-32) at the beginning of a []byte stream
+// and strips it. The name of the detected encoding
+// (e.g. "UTF-16LE" or "" if there is no BOM)
+// is sent to the side output "encoding" (see conduit.SideOutputter)
+// and can be obtained by Encoding after the chain has run.
+// With Decode, the rest of the stream is converted to UTF-8.
+type BOMStripper struct {
+	decode bool
+	def    Charset
+	enc    string
+	side   conduit.Target
+}
+
+// NewBOMStripper creates a new BOMStripper Conduit.
+func NewBOMStripper() (bs *BOMStripper) {
+	bs = new(BOMStripper)
+	return
+}
+
+// Decode converts the stream to UTF-8 according to the BOM.
+// Streams without BOM are converted from def;
+// if def is nil, they are passed on unchanged.
+func (bs *BOMStripper) Decode(def Charset) *BOMStripper {
+	bs.decode = true
+	bs.def = def
+	return bs
+}
+
+// Encoding returns the name of the encoding indicated by the BOM
+// or "" if the stream did not start with a BOM.
+func (bs *BOMStripper) Encoding() string {
+	return bs.enc
+}
+
+// SideOutput is the pre-defined method that makes BOMStripper
+// a conduit.SideOutputter. BOMStripper has the side output "encoding".
+func (bs *BOMStripper) SideOutput(name string, trg conduit.Target) {
+	if name == "encoding" {
+		bs.side = trg
+	}
+}
+
+// Conduct is the pre-defined method that makes BOMStripper a Conduit.
+// Conduct terminates with an error if an item is not []byte
+// or if the stream cannot be decoded.
+func (bs *BOMStripper) Conduct(src conduit.Source, trg conduit.Target) error {
+	var head []byte
+	var tc *Transcoder
+	detected := false
+
+	// detects the BOM once enough bytes are available
+	detect := func() {
+		enc, cs, n := detectBOM(head)
+		bs.enc = enc
+		if bs.side != nil {
+			bs.side <- enc
+		}
+		if bs.decode {
+			if cs == nil && n == 0 {
+				cs = bs.def
+			}
+			if cs != nil {
+				tc = NewCharsetDecoder(cs)
+				tc.t.Reset()
+			}
+		}
+		head = head[n:]
+		detected = true
+	}
+	send := func(data []byte) error {
+		if tc != nil {
+			return tc.feed(data, trg)
+		}
+		if len(data) > 0 {
+			trg <- data
+		}
+		return nil
+	}
+
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			trg <- inp
+			continue
+		}
+		data, ok := inp.([]byte)
+		if !ok {
+			return errors.New(fmt.Sprintf("cannot strip BOM from %T", inp))
+		}
+		if !detected {
+			head = append(head, data...)
+			if len(head) < 4 {
+				continue
+			}
+			detect()
+			data, head = head, nil
+		}
+		err := send(data)
+		if err != nil {
+			return err
+		}
+	}
+	if !detected {
+		detect()
+		err := send(head)
+		if err != nil {
+			return err
+		}
+	}
+	if tc != nil {
+		return tc.flush(trg)
+	}
+	return nil
+}
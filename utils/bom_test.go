@@ -0,0 +1,100 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/toschoo/conduit"
+)
+
+// BOM stripper:
+// - The BOM is detected across blocks of random size and stripped
+// - The detected encoding is sent to the side output
+// - With Decode, the stream is converted to UTF-8
+func TestBOMStripper(t *testing.T) {
+	text := "Grüße aus Köln 😀 "
+	type sample struct {
+		enc string
+		bom []byte
+		cs  Charset
+	}
+	samples := []sample{
+		{"UTF-8", []byte{0xef, 0xbb, 0xbf}, nil},
+		{"UTF-16LE", []byte{0xff, 0xfe}, UTF16LE},
+		{"UTF-16BE", []byte{0xfe, 0xff}, UTF16BE},
+		{"UTF-32LE", []byte{0xff, 0xfe, 0, 0}, UTF32LE},
+		{"UTF-32BE", []byte{0, 0, 0xfe, 0xff}, UTF32BE},
+		{"", nil, nil},
+	}
+	for _, s := range samples {
+		for i := 0; i < numOfTests; i++ {
+			err := testBOMStripper(s.enc, s.bom, s.cs, strings.Repeat(text, i))
+			if err != nil {
+				m := fmt.Sprintf("BOMStripper failed (%s): %v", s.enc, err)
+				t.Error(m)
+				break
+			}
+		}
+	}
+}
+
+func testBOMStripper(enc string, bom []byte, cs Charset, text string) error {
+	data := []byte(text)
+	if cs != nil {
+		var code bytes.Buffer
+		chn := conduit.NewChain(&AnyProducer{[]interface{}{data}}, []conduit.Conduit{NewCharsetEncoder(cs)}, NewTextPrinter(&code), small)
+		if chn.Run() != nil {
+			return errors.New(fmt.Sprintf("cannot encode: %v", chn.Errs))
+		}
+		data = code.Bytes()
+	}
+	data = append(append([]byte(nil), bom...), data...)
+
+	// strip only
+	var out bytes.Buffer
+	bs := NewBOMStripper()
+	side := new(AnyConsumer)
+	chn := conduit.NewChain(&AnyProducer{[]interface{}{data}}, []conduit.Conduit{new(Rechunk), bs}, NewTextPrinter(&out), small)
+	err := chn.AddSide(bs, "encoding", side)
+	if err != nil {
+		return err
+	}
+	if chn.Run() != nil {
+		return errors.New(fmt.Sprintf("error on stripping: %v", chn.Errs))
+	}
+	if !bytes.Equal(out.Bytes(), data[len(bom):]) {
+		return errors.New("stripped data differ from expected")
+	}
+	if bs.Encoding() != enc || len(side.recvd) != 1 || side.recvd[0] != enc {
+		return errors.New(fmt.Sprintf("expected encoding %q, have %q (side: %v)", enc, bs.Encoding(), side.recvd))
+	}
+
+	// decode
+	out.Reset()
+	pipe := []conduit.Conduit{new(Rechunk), NewBOMStripper().Decode(nil)}
+	chn = conduit.NewChain(&AnyProducer{[]interface{}{data}}, pipe, NewTextPrinter(&out), small)
+	if chn.Run() != nil {
+		return errors.New(fmt.Sprintf("error on decoding: %v", chn.Errs))
+	}
+	if out.String() != text {
+		return errors.New(fmt.Sprintf("expected %q, have %q", text, out.String()))
+	}
+	return nil
+}
+
+// BOM stripper with default charset:
+// - Streams without BOM are decoded from the default charset
+func TestBOMStripperDefault(t *testing.T) {
+	var out bytes.Buffer
+	pipe := []conduit.Conduit{NewBOMStripper().Decode(Windows1252)}
+	chn := conduit.NewChain(&AnyProducer{[]interface{}{[]byte("5 \x80")}}, pipe, NewTextPrinter(&out), small)
+	if chn.Run() != nil {
+		t.Fatalf("BOMStripper failed: %v", chn.Errs)
+	}
+	if out.String() != "5 €" {
+		t.Errorf("BOMStripper: unexpected result %q", out.String())
+	}
+}
@@ -0,0 +1,162 @@
+package utils
+
+import (
+	"github.com/toschoo/conduit"
+)
+
+// Branch is a sub-chain consisting of a pipe of conduits
+// (which may be nil) and a consumer. Stages that split
+// the processing chain, like Router, feed branches
+// with some or all of their input.
+// Each branch runs as a chain of its own.
+// Barriers are passed into the branches; the stage
+// sends a barrier on only when the consumers of all branches
+// have processed the data received before it.
+// To tell when a consumer has processed a barrier,
+// for instance flushed its output, the consumer
+// receives each barrier twice.
+type Branch struct {
+	Pipe     []conduit.Conduit
+	Consumer conduit.Consumer
+}
+
+// Tells whether a component of the branch keeps state
+func (b Branch) stateful() bool {
+	comps := make([]interface{}, 0, len(b.Pipe)+1)
+	for _, c := range b.Pipe {
+		comps = append(comps, c)
+	}
+	if b.Consumer != nil {
+		comps = append(comps, b.Consumer)
+	}
+	for _, c := range comps {
+		if v, ok := c.(conduit.Volatile); ok && v.Volatile() {
+			return true
+		}
+		if _, ok := c.(conduit.Checkpointer); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Channel is a Producer that forwards data
+// received from a channel.
+type Channel struct {
+	src conduit.Source
+}
+
+// NewChannel creates a new Channel Producer
+// that forwards data from src until src is closed.
+func NewChannel(src conduit.Source) (ch *Channel) {
+	ch = new(Channel)
+	if ch != nil {
+		ch.src = src
+	}
+	return
+}
+
+// Produce is the pre-defined method that
+// makes Channel a Producer.
+func (ch *Channel) Produce(trg conduit.Target) error {
+	for inp := range ch.src {
+		trg <- inp
+	}
+	return nil
+}
+
+// runningBranch is a branch running in its own goroutine
+type runningBranch struct {
+	in   chan interface{}
+	done chan error
+	dead chan struct{} // closed when the chain of the branch has terminated
+	acks chan struct{} // barriers processed by the consumer
+}
+
+// starts a branch with input buffer size sz;
+// the first error of the branch is delivered
+// through done when the branch has terminated.
+// If the branch terminates early, remaining input is discarded.
+func startBranch(b Branch, sz int) *runningBranch {
+	rb := &runningBranch{
+		in:   make(chan interface{}, sz),
+		done: make(chan error, 1),
+		dead: make(chan struct{}),
+		acks: make(chan struct{}, 1),
+	}
+	c := &acker{b.Consumer, rb.acks}
+	go func() {
+		chn := conduit.NewChain(NewChannel(rb.in), b.Pipe, c, uint32(sz))
+		var err error
+		if chn.Run() != nil && len(chn.Errs) > 0 {
+			err = chn.Errs[0]
+		}
+		close(rb.dead)
+		for range rb.in {
+		}
+		rb.done <- err
+	}()
+	return rb
+}
+
+// closes the input of the branch and waits
+// for it to terminate
+func (rb *runningBranch) stop() error {
+	close(rb.in)
+	return <-rb.done
+}
+
+// sends a barrier into the running branches and waits
+// until their consumers have processed all data received before it
+func syncBranches(b interface{}, rbs ...*runningBranch) {
+	for _, rb := range rbs {
+		if rb != nil {
+			rb.in <- b
+		}
+	}
+	for _, rb := range rbs {
+		if rb == nil {
+			continue
+		}
+		select {
+		case <-rb.acks:
+		case <-rb.dead:
+		}
+	}
+}
+
+// acker is a Consumer that passes data on to the consumer
+// of a branch and acknowledges barriers processed by it:
+// the consumer has processed a barrier, when it receives
+// the barrier for the second time.
+type acker struct {
+	c    conduit.Consumer
+	acks chan struct{}
+}
+
+func (a *acker) Consume(src conduit.Source) error {
+	in := make(chan interface{})
+	errc := make(chan error, 1)
+	conduit.ResetCancel(a.c)
+	go func() {
+		errc <- a.c.Consume(in)
+	}()
+	for inp := range src {
+		n := 1
+		if conduit.IsBarrier(inp) {
+			n = 2
+		}
+		for i := 0; i < n; i++ {
+			select {
+			case in <- inp:
+			case err := <-errc:
+				return err
+			}
+		}
+		if n == 2 {
+			a.acks <- struct{}{}
+		}
+	}
+	close(in)
+	return <-errc
+}
@@ -0,0 +1,248 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+// ErrCircuitOpen is the error of items rejected by an open CircuitBreaker.
+var ErrCircuitOpen = errors.New("circuit open")
+
+// FailedItem is an item that could not be processed.
+type FailedItem struct {
+	Item interface{}
+	Err  error
+}
+
+func (f *FailedItem) Error() string {
+	return fmt.Sprintf("%v: %v", f.Item, f.Err)
+}
+
+// BreakerState is the state of a CircuitBreaker.
+type BreakerState int
+
+const (
+	// BreakerClosed passes all items to the Transform.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen rejects all items until the cool-down has passed.
+	BreakerOpen
+	// BreakerHalfOpen passes items to the Transform on trial:
+	// the breaker closes after a number of successes
+	// and opens again on the first failure.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return fmt.Sprintf("BreakerState(%d)", int(s))
+}
+
+// CircuitBreaker is a Conduit that processes items with a Transform
+// calling a remote system and stops calling it while it is failing:
+// when the rate of failures among the latest calls reaches
+// the threshold (see SetThreshold), the breaker opens
+// and rejects all items for the cool-down (see SetCoolDown);
+// then it lets trial calls through (half-open, see SetTrials)
+// and closes again if they succeed.
+// Failed and rejected items are passed to the fallback
+// Transform (see SetFallback) or, without fallback,
+// sent as *FailedItem to the side output "failed"
+// (see conduit.SideOutputter); if the side output
+// is not connected, they are dropped and counted.
+// Like with Transformers, nil results are skipped.
+type CircuitBreaker struct {
+	t        Transform
+	fallback Transform
+	rate     float64
+	window   int
+	cool     time.Duration
+	trials   int
+	side     conduit.Target
+	door     sync.Mutex
+	state    BreakerState
+	results  []bool
+	pos, n   int
+	fails    int
+	opened   time.Time
+	succ     int
+	dropped  uint64
+}
+
+// NewCircuitBreaker creates a new CircuitBreaker Conduit
+// around t with a failure-rate threshold of 0.5 over 20 calls,
+// a cool-down of 30 seconds and 1 trial call.
+func NewCircuitBreaker(t Transform) (cb *CircuitBreaker) {
+	if t == nil {
+		return nil
+	}
+	cb = new(CircuitBreaker)
+	if cb != nil {
+		cb.t = t
+		cb.cool = 30 * time.Second
+		cb.trials = 1
+		cb.SetThreshold(0.5, 20)
+	}
+	return
+}
+
+// SetThreshold opens the breaker when the rate of failures
+// among the latest window calls reaches rate
+// (once window calls were made).
+func (cb *CircuitBreaker) SetThreshold(rate float64, window int) *CircuitBreaker {
+	if window > 0 {
+		cb.rate = rate
+		cb.window = window
+		cb.results = make([]bool, window)
+		cb.pos, cb.n, cb.fails = 0, 0, 0
+	}
+	return cb
+}
+
+// SetCoolDown sets the time the breaker stays open.
+func (cb *CircuitBreaker) SetCoolDown(d time.Duration) *CircuitBreaker {
+	cb.cool = d
+	return cb
+}
+
+// SetTrials sets the number of successful calls
+// in half-open state needed to close the breaker.
+func (cb *CircuitBreaker) SetTrials(n int) *CircuitBreaker {
+	if n > 0 {
+		cb.trials = n
+	}
+	return cb
+}
+
+// SetFallback sets the Transform for failed and rejected items.
+func (cb *CircuitBreaker) SetFallback(t Transform) *CircuitBreaker {
+	cb.fallback = t
+	return cb
+}
+
+// SideOutput is the pre-defined method that makes CircuitBreaker
+// a conduit.SideOutputter. CircuitBreaker has the side output "failed".
+func (cb *CircuitBreaker) SideOutput(name string, trg conduit.Target) {
+	if name == "failed" {
+		cb.side = trg
+	}
+}
+
+// State returns the current state of the breaker.
+func (cb *CircuitBreaker) State() BreakerState {
+	cb.door.Lock()
+	defer cb.door.Unlock()
+	return cb.state
+}
+
+// Dropped returns the number of failed and rejected items dropped.
+func (cb *CircuitBreaker) Dropped() uint64 {
+	return atomic.LoadUint64(&cb.dropped)
+}
+
+// Reports whether a call may be made
+func (cb *CircuitBreaker) allow() bool {
+	cb.door.Lock()
+	defer cb.door.Unlock()
+	if cb.state == BreakerOpen && time.Since(cb.opened) >= cb.cool {
+		cb.state = BreakerHalfOpen
+		cb.succ = 0
+	}
+	return cb.state != BreakerOpen
+}
+
+// Records the outcome of a call
+func (cb *CircuitBreaker) record(ok bool) {
+	cb.door.Lock()
+	defer cb.door.Unlock()
+	if cb.state == BreakerHalfOpen {
+		if !ok {
+			cb.open()
+			return
+		}
+		cb.succ++
+		if cb.succ >= cb.trials {
+			cb.state = BreakerClosed
+			cb.pos, cb.n, cb.fails = 0, 0, 0
+		}
+		return
+	}
+	if cb.n == cb.window {
+		if !cb.results[cb.pos] {
+			cb.fails--
+		}
+	} else {
+		cb.n++
+	}
+	cb.results[cb.pos] = ok
+	cb.pos = (cb.pos + 1) % cb.window
+	if !ok {
+		cb.fails++
+	}
+	if cb.n == cb.window && float64(cb.fails) >= cb.rate*float64(cb.window) {
+		cb.open()
+	}
+}
+
+func (cb *CircuitBreaker) open() {
+	cb.state = BreakerOpen
+	cb.opened = time.Now()
+}
+
+// Passes a failed or rejected item to the fallback or the side output
+func (cb *CircuitBreaker) reject(inp interface{}, err error, trg conduit.Target) error {
+	if cb.fallback != nil {
+		out, err := cb.fallback.Transform(inp)
+		if err != nil {
+			return err
+		}
+		if out != nil {
+			trg <- out
+		}
+		return nil
+	}
+	if cb.side != nil {
+		cb.side <- &FailedItem{Item: inp, Err: err}
+	} else {
+		atomic.AddUint64(&cb.dropped, 1)
+	}
+	return nil
+}
+
+// Conduct is the pre-defined method that makes CircuitBreaker a Conduit.
+// Conduct terminates with an error if the fallback fails.
+func (cb *CircuitBreaker) Conduct(src conduit.Source, trg conduit.Target) error {
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			trg <- inp
+			continue
+		}
+		err := ErrCircuitOpen
+		if cb.allow() {
+			var out interface{}
+			out, err = cb.t.Transform(inp)
+			cb.record(err == nil)
+			if err == nil {
+				if out != nil {
+					trg <- out
+				}
+				continue
+			}
+		}
+		if err := cb.reject(inp, err, trg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+// Remote call that fails for items not starting with "ok"
+var flakyCall = TransformFunc(func(inp interface{}) (interface{}, error) {
+	if s := inp.(string); !strings.HasPrefix(s, "ok") {
+		return nil, errors.New("unavailable")
+	}
+	return inp, nil
+})
+
+func failedItems(side chan interface{}) []string {
+	var fs []string
+	for len(side) > 0 {
+		fs = append(fs, (<-side).(*FailedItem).Error())
+	}
+	return fs
+}
+
+// Circuit breaker:
+// - The breaker opens when the failure rate reaches the threshold
+// - Items are rejected while it is open
+// - After the cool-down, trial calls close it again or reopen it
+// - Failed and rejected items go to the fallback, the side output or are dropped
+func TestCircuitBreaker(t *testing.T) {
+	if NewCircuitBreaker(nil) != nil {
+		t.Errorf("CircuitBreaker: nil transform accepted")
+	}
+	cb := NewCircuitBreaker(flakyCall).SetThreshold(0.5, 4).SetCoolDown(30 * time.Millisecond).SetTrials(2)
+	side := make(chan interface{}, 10)
+	cb.SideOutput("failed", side)
+	run := func(items ...interface{}) []interface{} {
+		ac := &AnyConsumer{}
+		if err := conduit.NewChain(&AnyProducer{src: items}, []conduit.Conduit{cb}, ac, small).Run(); err != nil {
+			t.Fatalf("CircuitBreaker failed: %v", err)
+		}
+		return ac.recvd
+	}
+	recvd := run("ok1", "fail1", "ok2", "fail2", "ok3", &conduit.Barrier{})
+	if len(recvd) != 3 || fmt.Sprint(recvd[:2]) != "[ok1 ok2]" || !conduit.IsBarrier(recvd[2]) || cb.State() != BreakerOpen {
+		t.Errorf("CircuitBreaker: received %v in state %v", recvd, cb.State())
+	}
+	if fs := strings.Join(failedItems(side), "; "); fs != "fail1: unavailable; fail2: unavailable; ok3: circuit open" {
+		t.Errorf("CircuitBreaker: unexpected failed items %s", fs)
+	}
+
+	time.Sleep(40 * time.Millisecond)
+	if recvd = run("fail3", "ok4"); len(recvd) != 0 || cb.State() != BreakerOpen || len(failedItems(side)) != 2 {
+		t.Errorf("CircuitBreaker: received %v in state %v", recvd, cb.State())
+	}
+
+	time.Sleep(40 * time.Millisecond)
+	recvd = run("ok5", "ok6", "fail4", "ok7")
+	if fmt.Sprint(recvd) != "[ok5 ok6 ok7]" || cb.State() != BreakerClosed || len(failedItems(side)) != 1 {
+		t.Errorf("CircuitBreaker: received %v in state %v", recvd, cb.State())
+	}
+	if cb.State().String() != "closed" || BreakerHalfOpen.String() != "half-open" {
+		t.Errorf("CircuitBreaker: unexpected state names")
+	}
+
+	upper := TransformFunc(func(inp interface{}) (interface{}, error) {
+		return strings.ToUpper(inp.(string)), nil
+	})
+	cb = NewCircuitBreaker(flakyCall).SetThreshold(1, 1).SetFallback(upper)
+	recvd = run("fail5", "ok8")
+	if fmt.Sprint(recvd) != "[FAIL5 OK8]" || cb.State() != BreakerOpen {
+		t.Errorf("CircuitBreaker: received %v in state %v", recvd, cb.State())
+	}
+
+	cb = NewCircuitBreaker(flakyCall).SetThreshold(1, 2)
+	if recvd = run("fail6", "fail7", "ok9"); len(recvd) != 0 || cb.Dropped() != 3 {
+		t.Errorf("CircuitBreaker: received %v, dropped %d", recvd, cb.Dropped())
+	}
+}
@@ -0,0 +1,124 @@
+package utils
+
+import (
+	"sync/atomic"
+
+	"github.com/toschoo/conduit"
+)
+
+// SlowPolicy defines how stages feeding several branches
+// handle branches that do not keep up with the input.
+type SlowPolicy int
+
+const (
+	// SlowBlock waits for slow branches,
+	// slowing down all other branches as well.
+	SlowBlock SlowPolicy = iota
+	// SlowDrop drops items for a branch
+	// whose input buffer is full.
+	SlowDrop
+)
+
+// tap is one named branch of a broadcast
+type tap struct {
+	name    string
+	b       Branch
+	dropped *uint64
+}
+
+// Broadcast is a Conduit that duplicates every item
+// to all its taps and sends it down the chain.
+// Taps are named branches added with Tap, e.g.
+//
+//	NewBroadcast(SlowDrop).Tap("archive", nil, archive).Tap("metrics", pipe, metrics)
+//
+// Items are not copied; taps must not modify items they receive.
+type Broadcast struct {
+	taps   []tap
+	policy SlowPolicy
+	sz     int
+}
+
+// NewBroadcast creates a new Broadcast without taps,
+// handling slow taps according to policy.
+func NewBroadcast(policy SlowPolicy) (bc *Broadcast) {
+	bc = new(Broadcast)
+	if bc != nil {
+		bc.policy = policy
+		bc.sz = 10
+	}
+	return
+}
+
+// Tap adds a named branch consisting of pipe (which may be nil)
+// and consumer.
+func (bc *Broadcast) Tap(name string, pipe []conduit.Conduit, consumer conduit.Consumer) *Broadcast {
+	bc.taps = append(bc.taps, tap{name, Branch{pipe, consumer}, new(uint64)})
+	return bc
+}
+
+// Dropped returns the number of items dropped so far
+// for the named tap.
+func (bc *Broadcast) Dropped(name string) uint64 {
+	for _, t := range bc.taps {
+		if t.name == name {
+			return atomic.LoadUint64(t.dropped)
+		}
+	}
+	return 0
+}
+
+// Conduct is the pre-defined method that makes Broadcast a Conduit.
+// Conduct terminates when all taps have terminated
+// and returns the first error reported by a tap.
+// The main chain is never subject to SlowDrop.
+// Barriers are never dropped; they are sent down the chain
+// when all taps have processed the data received before
+// the barrier (see Branch).
+func (bc *Broadcast) Conduct(src conduit.Source, trg conduit.Target) error {
+	rbs := make([]*runningBranch, len(bc.taps))
+	for i, t := range bc.taps {
+		rbs[i] = startBranch(t.b, bc.sz)
+	}
+
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			syncBranches(inp, rbs...)
+			trg <- inp
+			continue
+		}
+		for i, rb := range rbs {
+			if bc.policy == SlowBlock {
+				rb.in <- inp
+				continue
+			}
+			select {
+			case rb.in <- inp:
+			default:
+				atomic.AddUint64(bc.taps[i].dropped, 1)
+			}
+		}
+		trg <- inp
+	}
+
+	var err error
+	for _, rb := range rbs {
+		e := rb.stop()
+		if err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Volatile is the pre-defined method that makes Broadcast a conduit.Volatile:
+// a Broadcast is volatile if a tap keeps state,
+// which is not included in the checkpoints of the chain.
+func (bc *Broadcast) Volatile() bool {
+	for _, t := range bc.taps {
+		if t.b.stateful() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,117 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+type SlowConsumer struct {
+	BaseConsumer
+}
+
+func (c *SlowConsumer) Consume(src conduit.Source) error {
+	for v := range src {
+		if len(c.recvd)%10 == 0 {
+			time.Sleep(100 * time.Microsecond)
+		}
+		c.recvd = append(c.recvd, v.(int))
+	}
+	return nil
+}
+
+// Broadcast:
+// - It is processed without errors
+// - With SlowBlock, all taps and the chain receive all items
+// - With SlowDrop, received and dropped items of a slow tap add up
+func TestBroadcastChain(t *testing.T) {
+	for i := 0; i < numOfTests; i++ {
+		for _, policy := range []SlowPolicy{SlowBlock, SlowDrop} {
+			err := testBroadcastChain(numOfData, policy)
+			if err != nil {
+				m := fmt.Sprintf("BroadcastChain failed: %v", err)
+				t.Error(m)
+			}
+		}
+	}
+}
+
+func testBroadcastChain(n int, policy SlowPolicy) error {
+
+	p := &SeqProducer{makeSeq(n)}
+	c := new(BaseConsumer)
+
+	fast := new(BaseConsumer)
+	slow := new(SlowConsumer)
+
+	b := NewBroadcast(policy).
+		Tap("fast", []conduit.Conduit{NewIdentity()}, fast).
+		Tap("slow", nil, slow)
+
+	chn := conduit.NewChain(p, []conduit.Conduit{b}, c, small)
+
+	err := chn.Run()
+	if err != nil {
+		m := fmt.Sprintf("error on running chain: %v", err)
+		return errors.New(m)
+	}
+	if len(c.recvd) != n {
+		m := fmt.Sprintf("expected %d items, have %d", n, len(c.recvd))
+		return errors.New(m)
+	}
+	for i := range c.recvd {
+		if c.recvd[i] != i {
+			return errors.New("Received values differ from original!")
+		}
+	}
+	for _, x := range []struct {
+		name string
+		have []int
+	}{{"fast", fast.recvd}, {"slow", slow.recvd}} {
+		dropped := int(b.Dropped(x.name))
+		if len(x.have)+dropped != n {
+			m := fmt.Sprintf("expected %d items, have %d + %d dropped", n, len(x.have), dropped)
+			return errors.New(m)
+		}
+		if policy == SlowBlock && dropped != 0 {
+			return errors.New("items dropped with SlowBlock")
+		}
+		for i := 1; i < len(x.have); i++ {
+			if x.have[i] <= x.have[i-1] {
+				return errors.New("items out of order")
+			}
+		}
+	}
+	return nil
+}
+
+// Broadcast with barriers:
+// - Taps have processed their items before the barrier
+// - It is volatile if a tap keeps state
+func TestBroadcastBarrier(t *testing.T) {
+	var items []interface{}
+	for i := 0; i < 100; i++ {
+		items = append(items, i)
+		if i%10 == 9 {
+			items = append(items, &conduit.Barrier{ID: uint64(i)})
+		}
+	}
+	sc := new(SyncConsumer)
+	bc := NewBroadcast(SlowBlock).Tap("sync", nil, sc)
+	c := &BarrierConsumer{f: func(id uint64) int { return int(id + 1) }, have: sc.count}
+	if err := conduit.NewChain(&AnyProducer{src: items}, []conduit.Conduit{bc}, c, small).Run(); err != nil {
+		t.Fatalf("BroadcastBarrier failed: %v", err)
+	}
+	for _, e := range c.errs {
+		t.Errorf("BroadcastBarrier: tap has %s", e)
+	}
+	if len(c.recvd) != 110 || sc.count() != 100 {
+		t.Errorf("BroadcastBarrier: received %d items, tap %d", len(c.recvd), sc.count())
+	}
+	if bc.Volatile() || !bc.Tap("count", nil, NewKeyCounter(nil)).Volatile() {
+		t.Errorf("BroadcastBarrier: unexpected volatility")
+	}
+}
@@ -0,0 +1,497 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+// ObjectID is a BSON ObjectId.
+type ObjectID [12]byte
+
+// String returns the ObjectID in hex notation.
+func (id ObjectID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// BSONDoc is a BSON document whose elements keep their order,
+// as required, e.g., for MongoDB commands and sort specifications.
+type BSONDoc []BSONElem
+
+// BSONElem is an element of a BSONDoc.
+type BSONElem struct {
+	Name  string
+	Value interface{}
+}
+
+// Encoded BSON document that is written as it is
+type bsonRaw []byte
+
+var (
+	oidCounter uint32
+	oidProcess [5]byte
+)
+
+func init() {
+	var b [8]byte
+	rand.Read(b[:])
+	copy(oidProcess[:], b[:5])
+	oidCounter = binary.BigEndian.Uint32(b[4:])
+}
+
+// NewObjectID returns a new, unique ObjectID
+// made of the current time, a random process value and a counter.
+func NewObjectID() ObjectID {
+	var id ObjectID
+	binary.BigEndian.PutUint32(id[:], uint32(time.Now().Unix()))
+	copy(id[4:], oidProcess[:])
+	n := atomic.AddUint32(&oidCounter, 1)
+	id[9], id[10], id[11] = byte(n>>16), byte(n>>8), byte(n)
+	return id
+}
+
+// MarshalBSON encodes v as BSON document.
+// It is a MarshalFunc for use with Encoder and BSONWriter.
+// v must be a map with string keys or a struct,
+// which is encoded with its exported fields
+// (named by their json tag, if any), or a BSONDoc.
+// Map keys are sorted.
+// Values may be nil, bool, integers (as int32 or int64),
+// floats, strings, []byte, time.Time, ObjectID,
+// slices, arrays, maps and structs.
+func MarshalBSON(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := writeBSONDoc(&buf, reflect.ValueOf(v), false)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBSON decodes a BSON document into the value v points to.
+// It is an UnmarshalFunc for use with Decoder and BSONReader.
+// Decoded into interface{}, documents are represented
+// as map[string]interface{}, arrays as []interface{},
+// and values as nil, bool, int32, int64, float64, string,
+// []byte, time.Time and ObjectID; other targets
+// are filled following the rules of encoding/json.
+// Timestamps are uint64 and decimal128 values [16]byte;
+// other deprecated or special types are not supported.
+func UnmarshalBSON(data []byte, v interface{}) error {
+	x, err := readBSONDoc(data, false)
+	if err != nil {
+		return err
+	}
+	return assignValue(x, v)
+}
+
+// Writes a document (or an array, if arr)
+func writeBSONDoc(buf *bytes.Buffer, v reflect.Value, arr bool) error {
+	for v.IsValid() && (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) {
+		v = v.Elem()
+	}
+	if !v.IsValid() {
+		return errors.New("cannot encode nil as BSON document")
+	}
+	var names []string
+	var values []reflect.Value
+	switch v.Kind() {
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return errors.New(fmt.Sprintf("cannot encode %s as BSON document", v.Type()))
+		}
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		for _, k := range keys {
+			names = append(names, k.String())
+			values = append(values, v.MapIndex(k))
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			name := f.Name
+			if tag := f.Tag.Get("json"); tag != "" {
+				if tag == "-" {
+					continue
+				}
+				if j := bytes.IndexByte([]byte(tag), ','); j >= 0 {
+					tag = tag[:j]
+				}
+				if tag != "" {
+					name = tag
+				}
+			}
+			names = append(names, name)
+			values = append(values, v.Field(i))
+		}
+	case reflect.Slice, reflect.Array:
+		if d, ok := v.Interface().(BSONDoc); ok && !arr {
+			for _, e := range d {
+				names = append(names, e.Name)
+				values = append(values, reflect.ValueOf(e.Value))
+			}
+			break
+		}
+		if !arr {
+			return errors.New(fmt.Sprintf("cannot encode %s as BSON document", v.Type()))
+		}
+		for i := 0; i < v.Len(); i++ {
+			names = append(names, strconv.Itoa(i))
+			values = append(values, v.Index(i))
+		}
+	default:
+		return errors.New(fmt.Sprintf("cannot encode %s as BSON document", v.Type()))
+	}
+
+	start := buf.Len()
+	buf.Write([]byte{0, 0, 0, 0}) // length
+	for i := range names {
+		err := writeBSONElem(buf, names[i], values[i])
+		if err != nil {
+			return err
+		}
+	}
+	buf.WriteByte(0)
+	binary.LittleEndian.PutUint32(buf.Bytes()[start:], uint32(buf.Len()-start))
+	return nil
+}
+
+func writeBSONElem(buf *bytes.Buffer, name string, v reflect.Value) error {
+	head := func(t byte) {
+		buf.WriteByte(t)
+		buf.WriteString(name)
+		buf.WriteByte(0)
+	}
+	for v.IsValid() && (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) {
+		if v.IsNil() {
+			head(0x0a)
+			return nil
+		}
+		v = v.Elem()
+	}
+	if !v.IsValid() {
+		head(0x0a)
+		return nil
+	}
+	switch x := v.Interface().(type) {
+	case time.Time:
+		head(0x09)
+		binary.Write(buf, binary.LittleEndian, x.UnixNano()/int64(time.Millisecond))
+		return nil
+	case ObjectID:
+		head(0x07)
+		buf.Write(x[:])
+		return nil
+	case BSONDoc:
+		head(0x03)
+		return writeBSONDoc(buf, v, false)
+	case bsonRaw:
+		head(0x03)
+		buf.Write(x)
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		head(0x08)
+		if v.Bool() {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int, reflect.Int64:
+		writeBSONInt(buf, head, v.Int(), v.Kind() == reflect.Int64)
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint, reflect.Uint64:
+		if v.Uint() > math.MaxInt64 {
+			return errors.New(fmt.Sprintf("cannot encode %d as BSON", v.Uint()))
+		}
+		writeBSONInt(buf, head, int64(v.Uint()), v.Kind() == reflect.Uint64)
+	case reflect.Float32, reflect.Float64:
+		head(0x01)
+		binary.Write(buf, binary.LittleEndian, v.Float())
+	case reflect.String:
+		head(0x02)
+		binary.Write(buf, binary.LittleEndian, int32(v.Len()+1))
+		buf.WriteString(v.String())
+		buf.WriteByte(0)
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			head(0x0a)
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			head(0x05)
+			binary.Write(buf, binary.LittleEndian, int32(v.Len()))
+			buf.WriteByte(0) // generic subtype
+			b := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(b), v)
+			buf.Write(b)
+			return nil
+		}
+		head(0x04)
+		return writeBSONDoc(buf, v, true)
+	case reflect.Map, reflect.Struct:
+		if v.Kind() == reflect.Map && v.IsNil() {
+			head(0x0a)
+			return nil
+		}
+		head(0x03)
+		return writeBSONDoc(buf, v, false)
+	default:
+		return errors.New(fmt.Sprintf("cannot encode %s as BSON", v.Type()))
+	}
+	return nil
+}
+
+// Writes n as int32 if it fits and long is not requested, as int64 otherwise
+func writeBSONInt(buf *bytes.Buffer, head func(byte), n int64, long bool) {
+	if !long && n >= math.MinInt32 && n <= math.MaxInt32 {
+		head(0x10)
+		binary.Write(buf, binary.LittleEndian, int32(n))
+		return
+	}
+	head(0x12)
+	binary.Write(buf, binary.LittleEndian, n)
+}
+
+var errBSON = errors.New("invalid BSON")
+
+// Reads a document (or an array, if arr)
+func readBSONDoc(data []byte, arr bool) (interface{}, error) {
+	if len(data) < 5 || int(binary.LittleEndian.Uint32(data)) != len(data) || data[len(data)-1] != 0 {
+		return nil, errBSON
+	}
+	doc := make(map[string]interface{})
+	var list []interface{}
+	p := data[4 : len(data)-1]
+	for len(p) > 0 {
+		t := p[0]
+		end := bytes.IndexByte(p[1:], 0)
+		if end < 0 {
+			return nil, errBSON
+		}
+		name := string(p[1 : 1+end])
+		p = p[2+end:]
+		v, n, err := readBSONValue(t, p)
+		if err != nil {
+			return nil, err
+		}
+		p = p[n:]
+		if arr {
+			list = append(list, v)
+		} else {
+			doc[name] = v
+		}
+	}
+	if arr {
+		if list == nil {
+			list = []interface{}{}
+		}
+		return list, nil
+	}
+	return doc, nil
+}
+
+// Reads a value of type t from p; returns the value and its size
+func readBSONValue(t byte, p []byte) (interface{}, int, error) {
+	need := func(n int) error {
+		if len(p) < n {
+			return errBSON
+		}
+		return nil
+	}
+	switch t {
+	case 0x01:
+		if need(8) != nil {
+			return nil, 0, errBSON
+		}
+		return math.Float64frombits(binary.LittleEndian.Uint64(p)), 8, nil
+	case 0x02:
+		if need(4) != nil {
+			return nil, 0, errBSON
+		}
+		n := int(int32(binary.LittleEndian.Uint32(p)))
+		if n < 1 || need(4+n) != nil || p[3+n] != 0 {
+			return nil, 0, errBSON
+		}
+		return string(p[4 : 3+n]), 4 + n, nil
+	case 0x03, 0x04:
+		if need(4) != nil {
+			return nil, 0, errBSON
+		}
+		n := int(int32(binary.LittleEndian.Uint32(p)))
+		if n < 5 || need(n) != nil {
+			return nil, 0, errBSON
+		}
+		v, err := readBSONDoc(p[:n], t == 0x04)
+		return v, n, err
+	case 0x05:
+		if need(5) != nil {
+			return nil, 0, errBSON
+		}
+		n := int(int32(binary.LittleEndian.Uint32(p)))
+		if n < 0 || need(5+n) != nil {
+			return nil, 0, errBSON
+		}
+		return append([]byte(nil), p[5:5+n]...), 5 + n, nil
+	case 0x07:
+		if need(12) != nil {
+			return nil, 0, errBSON
+		}
+		var id ObjectID
+		copy(id[:], p)
+		return id, 12, nil
+	case 0x08:
+		if need(1) != nil {
+			return nil, 0, errBSON
+		}
+		return p[0] != 0, 1, nil
+	case 0x09:
+		if need(8) != nil {
+			return nil, 0, errBSON
+		}
+		ms := int64(binary.LittleEndian.Uint64(p))
+		return time.Unix(0, ms*int64(time.Millisecond)).UTC(), 8, nil
+	case 0x0a, 0x7f, 0xff: // null, max key, min key
+		return nil, 0, nil
+	case 0x10:
+		if need(4) != nil {
+			return nil, 0, errBSON
+		}
+		return int32(binary.LittleEndian.Uint32(p)), 4, nil
+	case 0x11:
+		if need(8) != nil {
+			return nil, 0, errBSON
+		}
+		return binary.LittleEndian.Uint64(p), 8, nil
+	case 0x12:
+		if need(8) != nil {
+			return nil, 0, errBSON
+		}
+		return int64(binary.LittleEndian.Uint64(p)), 8, nil
+	case 0x13:
+		if need(16) != nil {
+			return nil, 0, errBSON
+		}
+		var d [16]byte
+		copy(d[:], p)
+		return d, 16, nil
+	}
+	return nil, 0, errors.New(fmt.Sprintf("unsupported BSON type 0x%x", t))
+}
+
+// BSONReader is a Producer that reads a stream
+// of concatenated BSON documents, e.g. a mongodump file,
+// and sends them down the chain.
+type BSONReader struct {
+	conduit.Cancelable
+	rd  io.Reader
+	new func() interface{}
+	max int
+}
+
+// NewBSONReader creates a new BSONReader Producer.
+// Documents are decoded as by UnmarshalBSON into the result
+// of newValue or, if newValue is nil, into interface{}.
+func NewBSONReader(r io.Reader, newValue func() interface{}) (br *BSONReader) {
+	br = new(BSONReader)
+	if br != nil {
+		br.rd = r
+		br.new = newValue
+		br.max = 16 * 1024 * 1024
+	}
+	return
+}
+
+// Produce is the pre-defined method that makes BSONReader a Producer.
+// Documents larger than 16MiB, the MongoDB limit, are rejected.
+func (br *BSONReader) Produce(trg conduit.Target) error {
+	rd := bufio.NewReader(br.rd)
+	for !br.Canceled() {
+		var hdr [4]byte
+		_, err := io.ReadFull(rd, hdr[:])
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		n := int(binary.LittleEndian.Uint32(hdr[:]))
+		if n < 5 || n > br.max {
+			return errors.New(fmt.Sprintf("invalid BSON document size %d", n))
+		}
+		data := make([]byte, n)
+		copy(data, hdr[:])
+		_, err = io.ReadFull(rd, data[4:])
+		if err != nil {
+			return err
+		}
+		x, err := readBSONDoc(data, false)
+		if err != nil {
+			return err
+		}
+		if br.new == nil {
+			trg <- x
+			continue
+		}
+		v := br.new()
+		err = assignValue(x, v)
+		if err != nil {
+			return err
+		}
+		trg <- v
+	}
+	return nil
+}
+
+// BSONWriter is a Consumer that writes incoming data
+// as stream of concatenated BSON documents.
+type BSONWriter struct {
+	wt io.Writer
+}
+
+// NewBSONWriter creates a new BSONWriter Consumer.
+func NewBSONWriter(w io.Writer) (bw *BSONWriter) {
+	bw = new(BSONWriter)
+	if bw != nil {
+		bw.wt = w
+	}
+	return
+}
+
+// Consume is the pre-defined method that makes BSONWriter a Consumer.
+// Consume terminates with an error if an item cannot be encoded.
+func (bw *BSONWriter) Consume(src conduit.Source) error {
+	w := bufio.NewWriter(bw.wt)
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			err := w.Flush()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		buf, err := MarshalBSON(inp)
+		if err != nil {
+			return err
+		}
+		w.Write(buf)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,156 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+// BSON documents with values of all supported types
+func makeBSONDocs() []interface{} {
+	id := ObjectID{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
+	return []interface{}{
+		map[string]interface{}{},
+		map[string]interface{}{
+			"null": nil, "true": true, "false": false,
+			"i32": int32(-7), "i64": int64(1) << 40, "f": 2.5,
+			"s": "hello", "b": []byte{1, 2, 3}, "id": id,
+			"t": time.Unix(1600000000, 123000000).UTC(),
+		},
+		map[string]interface{}{
+			"doc": map[string]interface{}{"a": int32(1)},
+			"arr": []interface{}{int32(1), "two", []interface{}{}},
+		},
+	}
+}
+
+// BSON:
+// - Documents of all types are written and read back without errors
+// - Values are preserved
+func TestBSONChain(t *testing.T) {
+	docs := makeBSONDocs()
+
+	var buf bytes.Buffer
+	chn := conduit.NewChain(&AnyProducer{docs}, nil, NewBSONWriter(&buf), small)
+	err := chn.Run()
+	if err != nil {
+		t.Fatalf("BSONChain failed on writing: %v", chn.Errs)
+	}
+	c := new(AnyConsumer)
+	chn = conduit.NewChain(NewBSONReader(&buf, nil), nil, c, small)
+	err = chn.Run()
+	if err != nil {
+		t.Fatalf("BSONChain failed on reading: %v", chn.Errs)
+	}
+	if !reflect.DeepEqual(c.recvd, docs) {
+		t.Errorf("BSONChain: received documents differ from original")
+	}
+}
+
+// BSON with structs:
+// - Points are written and read back into Points
+// - Truncated input is reported
+func TestBSONPointChain(t *testing.T) {
+	for i := 0; i < numOfTests; i++ {
+		err := testBSONPointChain(i)
+		if err != nil {
+			m := fmt.Sprintf("BSONPointChain failed: %v", err)
+			t.Error(m)
+		}
+	}
+	buf, _ := MarshalBSON(&Point{1, 2})
+	chn := conduit.NewChain(NewBSONReader(bytes.NewReader(buf[:len(buf)-1]), nil), nil, new(AnyConsumer), small)
+	if chn.Run() == nil {
+		t.Errorf("BSONPointChain: truncated input not reported")
+	}
+	var v interface{}
+	if UnmarshalBSON(buf[:len(buf)-1], &v) == nil {
+		t.Errorf("BSONPointChain: truncated document not reported")
+	}
+}
+
+func testBSONPointChain(n int) error {
+
+	points := makePoints(n)
+
+	var buf bytes.Buffer
+	chn := conduit.NewChain(&AnyProducer{points}, nil, NewBSONWriter(&buf), small)
+	err := chn.Run()
+	if err != nil {
+		m := fmt.Sprintf("error on writing: %v", chn.Errs)
+		return errors.New(m)
+	}
+	c := new(AnyConsumer)
+	chn = conduit.NewChain(NewBSONReader(&buf, newPoint), nil, c, small)
+	err = chn.Run()
+	if err != nil {
+		m := fmt.Sprintf("error on reading: %v", chn.Errs)
+		return errors.New(m)
+	}
+	if len(c.recvd) != n {
+		m := fmt.Sprintf("expected %d items, have %d", n, len(c.recvd))
+		return errors.New(m)
+	}
+	for i, v := range c.recvd {
+		if *v.(*Point) != *points[i].(*Point) {
+			return errors.New("Received values differ from original!")
+		}
+	}
+	return nil
+}
+
+// BSONDoc and ObjectIDs:
+// - Elements keep their order, also nested
+// - New ObjectIDs are unique
+func TestBSONDoc(t *testing.T) {
+	doc := BSONDoc{{"z", 1}, {"a", BSONDoc{{"y", "b"}, {"x", nil}}}, {"m", []interface{}{BSONDoc{{"k", true}}}}}
+	data, err := MarshalBSON(doc)
+	if err != nil {
+		t.Fatalf("BSONDoc: %v", err)
+	}
+	z, a, y := bytes.Index(data, []byte("z\x00")), bytes.Index(data, []byte("a\x00")), bytes.Index(data, []byte("y\x00"))
+	if z < 0 || a < z || y < a || bytes.Index(data, []byte("x\x00")) < y {
+		t.Errorf("BSONDoc: elements not in order")
+	}
+	var v interface{}
+	if err := UnmarshalBSON(data, &v); err != nil {
+		t.Fatalf("BSONDoc: %v", err)
+	}
+	want := map[string]interface{}{
+		"z": int32(1),
+		"a": map[string]interface{}{"y": "b", "x": nil},
+		"m": []interface{}{map[string]interface{}{"k": true}},
+	}
+	if !reflect.DeepEqual(v, want) {
+		t.Errorf("BSONDoc: unexpected document %v", v)
+	}
+
+	ids := make(map[ObjectID]bool)
+	for i := 0; i < 1000; i++ {
+		id := NewObjectID()
+		if ids[id] {
+			t.Fatalf("ObjectID: %s not unique", id)
+		}
+		ids[id] = true
+	}
+}
+
+// BSON barrier:
+// - Documents preceding a barrier are flushed at the barrier
+func TestBSONBarrier(t *testing.T) {
+	w := new(chunkWriter)
+	doc := BSONDoc{{"a", 1}}
+	err := consumeWithBarrier(NewBSONWriter(w), doc, doc)
+	if err != nil {
+		t.Fatalf("BSONBarrier failed: %v", err)
+	}
+	data, _ := MarshalBSON(doc)
+	if len(w.chunks) != 2 || w.chunks[0] != string(data) {
+		t.Errorf("BSONBarrier: unexpected writes %q", w.chunks)
+	}
+}
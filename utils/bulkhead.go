@@ -0,0 +1,194 @@
+package utils
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/toschoo/conduit"
+)
+
+// ErrBulkheadFull is the error of items rejected by a full Bulkhead.
+var ErrBulkheadFull = errors.New("bulkhead full")
+
+// Bulkhead caps the number of concurrent calls and of calls
+// waiting for their turn of a group of Transforms,
+// e.g. all stages calling the same slow external system,
+// independently of the rest of the chain.
+// Transforms join the group through Wrap or as BulkheadStage.
+// Calls exceeding the queue depth are rejected with ErrBulkheadFull.
+// A Bulkhead may be shared by several chains.
+type Bulkhead struct {
+	slots    chan struct{}
+	queue    int
+	door     sync.Mutex
+	load     int
+	rejected uint64
+}
+
+// NewBulkhead creates a new Bulkhead allowing concurrency
+// concurrent calls and queue calls waiting.
+func NewBulkhead(concurrency, queue int) (b *Bulkhead) {
+	if concurrency <= 0 || queue < 0 {
+		return nil
+	}
+	b = new(Bulkhead)
+	if b != nil {
+		b.slots = make(chan struct{}, concurrency)
+		b.queue = queue
+	}
+	return
+}
+
+// Load returns the number of calls running and waiting.
+func (b *Bulkhead) Load() (running, waiting int) {
+	b.door.Lock()
+	defer b.door.Unlock()
+	running = len(b.slots)
+	return running, b.load - running
+}
+
+// Rejected returns the number of calls rejected.
+func (b *Bulkhead) Rejected() uint64 {
+	return atomic.LoadUint64(&b.rejected)
+}
+
+// Admits a call if there is a free slot or place in the queue
+func (b *Bulkhead) admit() bool {
+	b.door.Lock()
+	defer b.door.Unlock()
+	if b.load >= cap(b.slots)+b.queue {
+		atomic.AddUint64(&b.rejected, 1)
+		return false
+	}
+	b.load++
+	return true
+}
+
+// Runs an admitted call as soon as a slot is free
+func (b *Bulkhead) run(t Transform, inp interface{}) (interface{}, error) {
+	b.slots <- struct{}{}
+	defer func() {
+		b.door.Lock()
+		<-b.slots
+		b.load--
+		b.door.Unlock()
+	}()
+	return t.Transform(inp)
+}
+
+// Wrap returns a Transform that calls t within the Bulkhead;
+// it blocks while the call is waiting and fails
+// with ErrBulkheadFull if the queue is full.
+func (b *Bulkhead) Wrap(t Transform) Transform {
+	return TransformFunc(func(inp interface{}) (interface{}, error) {
+		if !b.admit() {
+			return nil, ErrBulkheadFull
+		}
+		return b.run(t, inp)
+	})
+}
+
+// Item waiting for its call to be sent down the chain in order
+type bulkheadSlot struct {
+	inp      interface{}
+	done     chan struct{}
+	out      interface{}
+	err      error
+	rejected bool
+}
+
+// BulkheadStage is a Conduit that processes items
+// with a Transform within a Bulkhead: items are processed
+// concurrently as far as the Bulkhead allows and sent
+// down the chain in the order in which they arrived;
+// the stage does not wait for calls of the group,
+// but rejects items if the queue of the Bulkhead is full.
+// Rejected items are sent as *FailedItem to the side output "rejected"
+// (see conduit.SideOutputter); if the side output is not connected,
+// they are dropped and counted.
+// Like with Transformers, nil results are skipped.
+type BulkheadStage struct {
+	b       *Bulkhead
+	t       Transform
+	side    conduit.Target
+	dropped uint64
+}
+
+// NewBulkheadStage creates a new BulkheadStage Conduit
+// calling t within b.
+func NewBulkheadStage(b *Bulkhead, t Transform) (bs *BulkheadStage) {
+	if b == nil || t == nil {
+		return nil
+	}
+	bs = new(BulkheadStage)
+	if bs != nil {
+		bs.b = b
+		bs.t = t
+	}
+	return
+}
+
+// SideOutput is the pre-defined method that makes BulkheadStage
+// a conduit.SideOutputter. BulkheadStage has the side output "rejected".
+func (bs *BulkheadStage) SideOutput(name string, trg conduit.Target) {
+	if name == "rejected" {
+		bs.side = trg
+	}
+}
+
+// Dropped returns the number of rejected items dropped.
+func (bs *BulkheadStage) Dropped() uint64 {
+	return atomic.LoadUint64(&bs.dropped)
+}
+
+// Conduct is the pre-defined method that makes BulkheadStage a Conduit.
+// Conduct terminates with an error if the Transform fails.
+func (bs *BulkheadStage) Conduct(src conduit.Source, trg conduit.Target) error {
+	queue := make(chan *bulkheadSlot, cap(bs.b.slots)+bs.b.queue)
+	var failed atomic.Value
+	emitted := make(chan struct{})
+	go func() {
+		defer close(emitted)
+		for s := range queue {
+			<-s.done
+			switch {
+			case failed.Load() != nil:
+			case s.err != nil:
+				failed.Store(s.err)
+			case s.rejected && bs.side != nil:
+				bs.side <- &FailedItem{Item: s.inp, Err: ErrBulkheadFull}
+			case s.rejected:
+				atomic.AddUint64(&bs.dropped, 1)
+			case s.out != nil:
+				trg <- s.out
+			}
+		}
+	}()
+	for inp := range src {
+		if failed.Load() != nil {
+			break
+		}
+		s := &bulkheadSlot{inp: inp, done: make(chan struct{})}
+		queue <- s
+		switch {
+		case conduit.IsBarrier(inp):
+			s.out = inp
+			close(s.done)
+		case !bs.b.admit():
+			s.rejected = true
+			close(s.done)
+		default:
+			go func() {
+				s.out, s.err = bs.b.run(bs.t, s.inp)
+				close(s.done)
+			}()
+		}
+	}
+	close(queue)
+	<-emitted
+	if err := failed.Load(); err != nil {
+		return err.(error)
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+// Waits until the bulkhead has the given load
+func waitLoad(b *Bulkhead, running, waiting int) bool {
+	for i := 0; i < 1000; i++ {
+		if r, w := b.Load(); r == running && w == waiting {
+			return true
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return false
+}
+
+// Bulkhead:
+// - Stages of a group never exceed the concurrency of the bulkhead
+// - Output is sent in order
+// - Calls beyond the queue depth are rejected
+// - Rejected items go to the side output or are dropped
+// - Errors of the transform terminate the stage
+func TestBulkhead(t *testing.T) {
+	if NewBulkhead(0, 1) != nil || NewBulkhead(1, -1) != nil || NewBulkheadStage(nil, flakyCall) != nil {
+		t.Errorf("Bulkhead: invalid arguments accepted")
+	}
+
+	var active, peak int32
+	slow := TransformFunc(func(inp interface{}) (interface{}, error) {
+		n := atomic.AddInt32(&active, 1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		atomic.AddInt32(&active, -1)
+		return inp.(int) + 1, nil
+	})
+	b := NewBulkhead(2, 100)
+	src := make([]interface{}, 50)
+	for i := range src {
+		src[i] = i
+	}
+	ac := &AnyConsumer{}
+	pipe := []conduit.Conduit{NewBulkheadStage(b, slow), NewBulkheadStage(b, slow)}
+	if err := conduit.NewChain(&AnyProducer{src: src}, pipe, ac, small).Run(); err != nil {
+		t.Fatalf("Bulkhead failed: %v", err)
+	}
+	if len(ac.recvd) != len(src) || ac.recvd[0] != 2 || ac.recvd[len(src)-1] != len(src)+1 {
+		t.Errorf("Bulkhead: received %v", ac.recvd)
+	}
+	if peak > 2 || b.Rejected() != 0 {
+		t.Errorf("Bulkhead: %d concurrent calls, %d rejected", peak, b.Rejected())
+	}
+
+	gate := make(chan struct{})
+	b = NewBulkhead(1, 2)
+	blocked := b.Wrap(TransformFunc(func(inp interface{}) (interface{}, error) {
+		<-gate
+		return inp, nil
+	}))
+	results := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			_, err := blocked.Transform(0)
+			results <- err
+		}()
+		if !waitLoad(b, 1, i) {
+			t.Fatalf("Bulkhead: call %d not admitted", i)
+		}
+	}
+	if _, err := b.Wrap(slow).Transform(0); err != ErrBulkheadFull {
+		t.Errorf("Bulkhead: call beyond queue not rejected: %v", err)
+	}
+
+	bs := NewBulkheadStage(b, slow)
+	side := make(chan interface{}, 10)
+	bs.SideOutput("rejected", side)
+	ac = &AnyConsumer{}
+	if err := conduit.NewChain(&AnyProducer{src: []interface{}{1, 2}}, []conduit.Conduit{bs}, ac, small).Run(); err != nil {
+		t.Fatalf("Bulkhead failed: %v", err)
+	}
+	if len(ac.recvd) != 0 || len(side) != 2 || (<-side).(*FailedItem).Error() != "1: bulkhead full" {
+		t.Errorf("Bulkhead: received %v, %d rejected", ac.recvd, len(side))
+	}
+	bs = NewBulkheadStage(b, slow)
+	if err := conduit.NewChain(&AnyProducer{src: []interface{}{1}}, []conduit.Conduit{bs}, ac, small).Run(); err != nil || bs.Dropped() != 1 {
+		t.Errorf("Bulkhead: %d dropped (%v)", bs.Dropped(), err)
+	}
+	close(gate)
+	for i := 0; i < 3; i++ {
+		if err := <-results; err != nil {
+			t.Errorf("Bulkhead: admitted call failed: %v", err)
+		}
+	}
+	if !waitLoad(b, 0, 0) || b.Rejected() != 4 {
+		t.Errorf("Bulkhead: %d rejected", b.Rejected())
+	}
+
+	failing := TransformFunc(func(inp interface{}) (interface{}, error) {
+		if inp.(int) == 3 {
+			return nil, errors.New("unavailable")
+		}
+		return inp, nil
+	})
+	ac = &AnyConsumer{}
+	b = NewBulkhead(1, len(src))
+	chn := conduit.NewChain(&AnyProducer{src: src}, []conduit.Conduit{NewBulkheadStage(b, failing)}, ac, small)
+	if err := chn.Run(); err == nil || fmt.Sprint(chn.Errs) != "[unavailable]" || len(ac.recvd) != 3 {
+		t.Errorf("Bulkhead: received %v, errors %v", ac.recvd, chn.Errs)
+	}
+}
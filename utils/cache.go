@@ -0,0 +1,140 @@
+package utils
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Cached value
+type cacheEntry struct {
+	key     string
+	val     interface{}
+	expires time.Time
+}
+
+// lruCache holds a limited number of values,
+// evicting the least recently used key, optionally
+// with expiry; it is safe for concurrent use
+type lruCache struct {
+	door  sync.Mutex
+	size  int
+	items map[string]*list.Element
+	lru   *list.List
+}
+
+func newLRUCache(size int) *lruCache {
+	return &lruCache{size: size, items: make(map[string]*list.Element), lru: list.New()}
+}
+
+// Sets the size; 0 disables the cache
+func (c *lruCache) resize(n int) {
+	c.door.Lock()
+	defer c.door.Unlock()
+	c.size = n
+	for c.lru.Len() > n && c.lru.Len() > 0 {
+		c.evict()
+	}
+}
+
+func (c *lruCache) evict() {
+	el := c.lru.Back()
+	c.lru.Remove(el)
+	delete(c.items, el.Value.(*cacheEntry).key)
+}
+
+// Finds key in the cache
+func (c *lruCache) get(key string) (interface{}, bool) {
+	c.door.Lock()
+	defer c.door.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	ce := el.Value.(*cacheEntry)
+	if !ce.expires.IsZero() && time.Now().After(ce.expires) {
+		c.lru.Remove(el)
+		delete(c.items, key)
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return ce.val, true
+}
+
+// Adds a value that expires after ttl (if greater than 0)
+func (c *lruCache) put(key string, val interface{}, ttl time.Duration) {
+	ce := &cacheEntry{key: key, val: val}
+	if ttl > 0 {
+		ce.expires = time.Now().Add(ttl)
+	}
+	c.door.Lock()
+	defer c.door.Unlock()
+	if c.size <= 0 {
+		return
+	}
+	if el, ok := c.items[key]; ok {
+		el.Value = ce
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.lru.PushFront(ce)
+	if c.lru.Len() > c.size {
+		c.evict()
+	}
+}
+
+// CachedTransform is a Transform that memoizes
+// the results of another Transform by the keys of
+// the incoming items, so that repeated inputs
+// are not transformed again, e.g. to avoid
+// recomputing expensive lookups in a Transformer.
+// Errors are not cached. CachedTransform
+// may be used concurrently if the wrapped Transform may.
+type CachedTransform struct {
+	t      Transform
+	kf     KeyFunc
+	ttl    time.Duration
+	cache  *lruCache
+	hits   uint64
+	misses uint64
+}
+
+// Cached creates a new CachedTransform that holds
+// the results for at most size keys, each for ttl
+// (if greater than 0, otherwise until evicted).
+// The keys of items are obtained using kf (see KeyFunc and Keyed).
+func Cached(t Transform, kf KeyFunc, size int, ttl time.Duration) (ct *CachedTransform) {
+	if t == nil || size <= 0 {
+		return nil
+	}
+	ct = new(CachedTransform)
+	if ct != nil {
+		ct.t = t
+		ct.kf = kf
+		ct.ttl = ttl
+		ct.cache = newLRUCache(size)
+	}
+	return
+}
+
+// CacheStats returns the number of cache hits and misses.
+func (ct *CachedTransform) CacheStats() (hits, misses uint64) {
+	return atomic.LoadUint64(&ct.hits), atomic.LoadUint64(&ct.misses)
+}
+
+// Transform is the pre-defined method that makes CachedTransform a Transform.
+func (ct *CachedTransform) Transform(inp interface{}) (interface{}, error) {
+	k := keyOf(ct.kf, inp)
+	if v, ok := ct.cache.get(k); ok {
+		atomic.AddUint64(&ct.hits, 1)
+		return v, nil
+	}
+	atomic.AddUint64(&ct.misses, 1)
+	v, err := ct.t.Transform(inp)
+	if err != nil {
+		return nil, err
+	}
+	ct.cache.put(k, v, ct.ttl)
+	return v, nil
+}
@@ -0,0 +1,56 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+// Cached transform:
+// - Repeated inputs are not transformed again
+// - The least recently used keys are evicted, results expire after the TTL
+// - Errors are not cached
+func TestCachedTransform(t *testing.T) {
+	var calls int32
+	square := TransformFunc(func(inp interface{}) (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		n := inp.(int)
+		if n < 0 {
+			return nil, errors.New("negative")
+		}
+		return n * n, nil
+	})
+	if Cached(nil, nil, 10, 0) != nil || Cached(square, nil, 0, 0) != nil {
+		t.Errorf("Cached: invalid arguments accepted")
+	}
+	ct := Cached(square, nil, 2, 0)
+	items := []interface{}{2, 3, 2, &conduit.Barrier{}, 3, 4, 2, 4}
+	ac := &AnyConsumer{}
+	if err := conduit.NewChain(&AnyProducer{src: items}, []conduit.Conduit{NewTransformer(ct)}, ac, small).Run(); err != nil {
+		t.Fatalf("Cached failed: %v", err)
+	}
+	if fmt.Sprint(ac.recvd[:3], ac.recvd[4:]) != "[4 9 4] [9 16 4 16]" || !conduit.IsBarrier(ac.recvd[3]) {
+		t.Errorf("Cached: received %v", ac.recvd)
+	}
+	// 2 was evicted by 4
+	if hits, misses := ct.CacheStats(); calls != 4 || hits != 3 || misses != 4 {
+		t.Errorf("Cached: %d calls, %d hits, %d misses", calls, hits, misses)
+	}
+
+	calls = 0
+	ct = Cached(square, func(v interface{}) string { return fmt.Sprint(v.(int) % 10) }, 10, 20*time.Millisecond)
+	for _, n := range []int{1, 11, -1, -1} {
+		v, err := ct.Transform(n)
+		if n > 0 && (err != nil || v != 1) || n < 0 && err == nil {
+			t.Errorf("Cached: %d -> %v (%v)", n, v, err)
+		}
+	}
+	time.Sleep(30 * time.Millisecond)
+	if v, _ := ct.Transform(11); v != 121 || calls != 4 {
+		t.Errorf("Cached: %v after expiry, %d calls", v, calls)
+	}
+}
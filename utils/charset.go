@@ -0,0 +1,478 @@
+package utils
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/toschoo/conduit"
+)
+
+// ByteTransformer converts bytes from src to dst as much as possible
+// and returns the number of bytes written and consumed.
+// If src ends with an incomplete sequence and atEOF is false,
+// it consumes what it can and returns an error.
+// The interface matches golang.org/x/text/transform.Transformer,
+// so that the decoders and encoders of golang.org/x/text/encoding
+// (e.g. japanese.ShiftJIS.NewDecoder()) can be used.
+type ByteTransformer interface {
+	Transform(dst, src []byte, atEOF bool) (nDst, nSrc int, err error)
+	Reset()
+}
+
+// Charset is a character encoding;
+// decoders convert to UTF-8, encoders from UTF-8.
+// Latin1, Windows1252, UTF-16 and UTF-32 (in both byte orders)
+// are provided; other encodings can be used via CharsetFuncs.
+type Charset interface {
+	NewDecoder() ByteTransformer
+	NewEncoder() ByteTransformer
+}
+
+// CharsetFuncs implements Charset with ordinary functions.
+type CharsetFuncs struct {
+	Decoder func() ByteTransformer
+	Encoder func() ByteTransformer
+}
+
+// NewDecoder calls f.Decoder.
+func (f CharsetFuncs) NewDecoder() ByteTransformer {
+	return f.Decoder()
+}
+
+// NewEncoder calls f.Encoder.
+func (f CharsetFuncs) NewEncoder() ByteTransformer {
+	return f.Encoder()
+}
+
+var errShortSrc = errors.New("incomplete input sequence")
+
+// A single-byte character set
+type byteCharset struct {
+	table [256]rune
+	rev   map[rune]byte
+}
+
+func newByteCharset(high [128]rune) *byteCharset {
+	cs := new(byteCharset)
+	cs.rev = make(map[rune]byte, 256)
+	for i := 0; i < 256; i++ {
+		r := rune(i)
+		if i >= 128 {
+			r = high[i-128]
+		}
+		cs.table[i] = r
+		cs.rev[r] = byte(i)
+	}
+	return cs
+}
+
+func (cs *byteCharset) NewDecoder() ByteTransformer { return &byteDecoder{cs} }
+func (cs *byteCharset) NewEncoder() ByteTransformer { return &byteEncoder{cs} }
+
+type byteDecoder struct{ cs *byteCharset }
+
+func (d *byteDecoder) Reset() {}
+
+func (d *byteDecoder) Transform(dst, src []byte, atEOF bool) (int, int, error) {
+	nDst := 0
+	for i, b := range src {
+		r := d.cs.table[b]
+		if nDst+utf8.RuneLen(r) > len(dst) {
+			return nDst, i, errors.New("short destination buffer")
+		}
+		nDst += utf8.EncodeRune(dst[nDst:], r)
+	}
+	return nDst, len(src), nil
+}
+
+type byteEncoder struct{ cs *byteCharset }
+
+func (e *byteEncoder) Reset() {}
+
+func (e *byteEncoder) Transform(dst, src []byte, atEOF bool) (int, int, error) {
+	nDst, nSrc := 0, 0
+	for nSrc < len(src) {
+		if !atEOF && !utf8.FullRune(src[nSrc:]) {
+			return nDst, nSrc, errShortSrc
+		}
+		r, n := utf8.DecodeRune(src[nSrc:])
+		if r == utf8.RuneError && n == 1 {
+			return nDst, nSrc, errors.New("invalid UTF-8")
+		}
+		b, ok := e.cs.rev[r]
+		if !ok {
+			return nDst, nSrc, errors.New(fmt.Sprintf("rune %U cannot be encoded", r))
+		}
+		if nDst >= len(dst) {
+			return nDst, nSrc, errors.New("short destination buffer")
+		}
+		dst[nDst] = b
+		nDst++
+		nSrc += n
+	}
+	return nDst, nSrc, nil
+}
+
+var latin1High = func() (high [128]rune) {
+	for i := range high {
+		high[i] = rune(128 + i)
+	}
+	return
+}()
+
+var cp1252High = func() (high [128]rune) {
+	high = latin1High
+	copy(high[:32], []rune{
+		0x20AC, 0x0081, 0x201A, 0x0192, 0x201E, 0x2026, 0x2020, 0x2021,
+		0x02C6, 0x2030, 0x0160, 0x2039, 0x0152, 0x008D, 0x017D, 0x008F,
+		0x0090, 0x2018, 0x2019, 0x201C, 0x201D, 0x2022, 0x2013, 0x2014,
+		0x02DC, 0x2122, 0x0161, 0x203A, 0x0153, 0x009D, 0x017E, 0x0178,
+	})
+	return
+}()
+
+// Latin1 is ISO 8859-1.
+var Latin1 Charset = newByteCharset(latin1High)
+
+// Windows1252 is the Windows code page 1252 (Western European);
+// the five undefined bytes are mapped to the corresponding C1 controls.
+var Windows1252 Charset = newByteCharset(cp1252High)
+
+// UTF-16 in either byte order
+type utf16Charset struct {
+	big bool
+}
+
+// UTF16LE is UTF-16 little endian (without BOM).
+var UTF16LE Charset = utf16Charset{false}
+
+// UTF16BE is UTF-16 big endian (without BOM).
+var UTF16BE Charset = utf16Charset{true}
+
+func (cs utf16Charset) NewDecoder() ByteTransformer { return &utf16Decoder{cs.big} }
+func (cs utf16Charset) NewEncoder() ByteTransformer { return &utf16Encoder{cs.big} }
+
+type utf16Decoder struct{ big bool }
+
+func (d *utf16Decoder) Reset() {}
+
+func (d *utf16Decoder) unit(b []byte) rune {
+	if d.big {
+		return rune(b[0])<<8 | rune(b[1])
+	}
+	return rune(b[1])<<8 | rune(b[0])
+}
+
+// Unpaired surrogates are decoded as U+FFFD.
+func (d *utf16Decoder) Transform(dst, src []byte, atEOF bool) (int, int, error) {
+	nDst, nSrc := 0, 0
+	for nSrc < len(src) {
+		if len(src)-nSrc < 2 {
+			if !atEOF {
+				return nDst, nSrc, errShortSrc
+			}
+			return nDst, nSrc, errors.New("odd number of bytes in UTF-16")
+		}
+		r := d.unit(src[nSrc:])
+		n := 2
+		if utf16.IsSurrogate(r) {
+			if len(src)-nSrc < 4 && !atEOF {
+				return nDst, nSrc, errShortSrc
+			}
+			r2 := utf8.RuneError
+			if len(src)-nSrc >= 4 {
+				r2 = d.unit(src[nSrc+2:])
+			}
+			if dec := utf16.DecodeRune(r, r2); dec != utf8.RuneError {
+				r = dec
+				n = 4
+			} else {
+				r = utf8.RuneError
+			}
+		}
+		if nDst+utf8.RuneLen(r) > len(dst) {
+			return nDst, nSrc, errors.New("short destination buffer")
+		}
+		nDst += utf8.EncodeRune(dst[nDst:], r)
+		nSrc += n
+	}
+	return nDst, nSrc, nil
+}
+
+type utf16Encoder struct{ big bool }
+
+func (e *utf16Encoder) Reset() {}
+
+func (e *utf16Encoder) put(dst []byte, r rune) {
+	if e.big {
+		dst[0], dst[1] = byte(r>>8), byte(r)
+	} else {
+		dst[0], dst[1] = byte(r), byte(r>>8)
+	}
+}
+
+func (e *utf16Encoder) Transform(dst, src []byte, atEOF bool) (int, int, error) {
+	nDst, nSrc := 0, 0
+	for nSrc < len(src) {
+		if !atEOF && !utf8.FullRune(src[nSrc:]) {
+			return nDst, nSrc, errShortSrc
+		}
+		r, n := utf8.DecodeRune(src[nSrc:])
+		if r == utf8.RuneError && n == 1 {
+			return nDst, nSrc, errors.New("invalid UTF-8")
+		}
+		if nDst+4 > len(dst) {
+			return nDst, nSrc, errors.New("short destination buffer")
+		}
+		if r1, r2 := utf16.EncodeRune(r); r1 != utf8.RuneError {
+			e.put(dst[nDst:], r1)
+			e.put(dst[nDst+2:], r2)
+			nDst += 4
+		} else {
+			e.put(dst[nDst:], r)
+			nDst += 2
+		}
+		nSrc += n
+	}
+	return nDst, nSrc, nil
+}
+
+// UTF-32 in either byte order
+type utf32Charset struct {
+	big bool
+}
+
+// UTF32LE is UTF-32 little endian (without BOM).
+var UTF32LE Charset = utf32Charset{false}
+
+// UTF32BE is UTF-32 big endian (without BOM).
+var UTF32BE Charset = utf32Charset{true}
+
+func (cs utf32Charset) NewDecoder() ByteTransformer { return &utf32Decoder{cs.big} }
+func (cs utf32Charset) NewEncoder() ByteTransformer { return &utf32Encoder{cs.big} }
+
+type utf32Decoder struct{ big bool }
+
+func (d *utf32Decoder) Reset() {}
+
+// Surrogates and values beyond U+10FFFF are decoded as U+FFFD.
+func (d *utf32Decoder) Transform(dst, src []byte, atEOF bool) (int, int, error) {
+	nDst, nSrc := 0, 0
+	for nSrc < len(src) {
+		if len(src)-nSrc < 4 {
+			if !atEOF {
+				return nDst, nSrc, errShortSrc
+			}
+			return nDst, nSrc, errors.New("incomplete UTF-32 code unit")
+		}
+		var u uint32
+		if d.big {
+			u = binary.BigEndian.Uint32(src[nSrc:])
+		} else {
+			u = binary.LittleEndian.Uint32(src[nSrc:])
+		}
+		r := rune(u)
+		if u > unicode.MaxRune || !utf8.ValidRune(r) {
+			r = utf8.RuneError
+		}
+		if nDst+utf8.RuneLen(r) > len(dst) {
+			return nDst, nSrc, errors.New("short destination buffer")
+		}
+		nDst += utf8.EncodeRune(dst[nDst:], r)
+		nSrc += 4
+	}
+	return nDst, nSrc, nil
+}
+
+type utf32Encoder struct{ big bool }
+
+func (e *utf32Encoder) Reset() {}
+
+func (e *utf32Encoder) Transform(dst, src []byte, atEOF bool) (int, int, error) {
+	nDst, nSrc := 0, 0
+	for nSrc < len(src) {
+		if !atEOF && !utf8.FullRune(src[nSrc:]) {
+			return nDst, nSrc, errShortSrc
+		}
+		r, n := utf8.DecodeRune(src[nSrc:])
+		if r == utf8.RuneError && n == 1 {
+			return nDst, nSrc, errors.New("invalid UTF-8")
+		}
+		if nDst+4 > len(dst) {
+			return nDst, nSrc, errors.New("short destination buffer")
+		}
+		if e.big {
+			binary.BigEndian.PutUint32(dst[nDst:], uint32(r))
+		} else {
+			binary.LittleEndian.PutUint32(dst[nDst:], uint32(r))
+		}
+		nDst += 4
+		nSrc += n
+	}
+	return nDst, nSrc, nil
+}
+
+// Returns the Charset registered under name in MIME and XML
+// (e.g. "ISO-8859-1"); nil for unknown names and UTF-8
+func charsetByName(name string) Charset {
+	switch strings.ToLower(name) {
+	case "iso-8859-1", "iso8859-1", "latin1", "l1":
+		return Latin1
+	case "windows-1252", "cp1252":
+		return Windows1252
+	case "utf-16le":
+		return UTF16LE
+	case "utf-16be", "utf-16":
+		return UTF16BE
+	case "utf-32le":
+		return UTF32LE
+	case "utf-32be", "utf-32":
+		return UTF32BE
+	}
+	return nil
+}
+
+// Transcoder is a Conduit that converts a stream of []byte blocks
+// from one character encoding to another using a ByteTransformer,
+// e.g. the decoder of a Charset to convert Latin-1 input to UTF-8.
+// Incomplete sequences at the end of a block
+// are carried to the next block.
+// The carried bytes are included in checkpoints
+// (see conduit.Checkpointer); the ByteTransformer
+// itself restarts in its initial state, which is sufficient
+// for the provided charsets, but not for stateful encodings
+// like ISO-2022-JP.
+type Transcoder struct {
+	t        ByteTransformer
+	carry    []byte
+	restored bool // carry was restored from a checkpoint
+}
+
+// NewCharsetDecoder creates a new Transcoder Conduit
+// that converts from the given Charset to UTF-8.
+func NewCharsetDecoder(cs Charset) *Transcoder {
+	if cs == nil {
+		return nil
+	}
+	return NewTranscoder(cs.NewDecoder())
+}
+
+// NewCharsetEncoder creates a new Transcoder Conduit
+// that converts from UTF-8 to the given Charset.
+func NewCharsetEncoder(cs Charset) *Transcoder {
+	if cs == nil {
+		return nil
+	}
+	return NewTranscoder(cs.NewEncoder())
+}
+
+// NewTranscoder creates a new Transcoder Conduit using t.
+func NewTranscoder(t ByteTransformer) (tc *Transcoder) {
+	if t == nil {
+		return nil
+	}
+	tc = new(Transcoder)
+	if tc != nil {
+		tc.t = t
+	}
+	return
+}
+
+// Conduct is the pre-defined method that makes Transcoder a Conduit.
+// Conduct terminates with an error if the input cannot be converted.
+func (tc *Transcoder) Conduct(src conduit.Source, trg conduit.Target) error {
+	tc.t.Reset()
+	if !tc.restored {
+		tc.carry = nil
+	}
+	tc.restored = false
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			trg <- inp
+			continue
+		}
+		data, ok := inp.([]byte)
+		if !ok {
+			return errors.New(fmt.Sprintf("cannot transcode %T", inp))
+		}
+		err := tc.feed(data, trg)
+		if err != nil {
+			return err
+		}
+	}
+	return tc.flush(trg)
+}
+
+// Snapshot is the pre-defined method that makes Transcoder
+// a conduit.Checkpointer.
+func (tc *Transcoder) Snapshot() ([]byte, error) {
+	return append([]byte{}, tc.carry...), nil
+}
+
+// Restore is the pre-defined method that makes Transcoder
+// a conduit.Checkpointer.
+func (tc *Transcoder) Restore(b []byte) error {
+	tc.carry = append([]byte(nil), b...)
+	tc.restored = true
+	return nil
+}
+
+// Converts data and keeps an incomplete tail
+func (tc *Transcoder) feed(data []byte, trg conduit.Target) error {
+	out, rest, err := tc.transform(append(tc.carry, data...), false)
+	if err != nil {
+		return err
+	}
+	tc.carry = append([]byte(nil), rest...)
+	if len(out) > 0 {
+		trg <- out
+	}
+	return nil
+}
+
+// Converts what is left at the end of the stream
+func (tc *Transcoder) flush(trg conduit.Target) error {
+	out, _, err := tc.transform(tc.carry, true)
+	tc.carry = nil
+	if err != nil {
+		return err
+	}
+	if len(out) > 0 {
+		trg <- out
+	}
+	return nil
+}
+
+// Transforms src; returns the output and the incomplete rest
+func (tc *Transcoder) transform(src []byte, atEOF bool) ([]byte, []byte, error) {
+	var out []byte
+	for len(src) > 0 {
+		dst := make([]byte, 4*len(src)+16)
+		nDst, nSrc, err := tc.t.Transform(dst, src, atEOF)
+		out = append(out, dst[:nDst]...)
+		src = src[nSrc:]
+		if err == nil {
+			if nSrc == 0 {
+				break
+			}
+			continue
+		}
+		if nDst > 0 || nSrc > 0 {
+			continue
+		}
+		// an incomplete sequence is at most a few bytes
+		if !atEOF && len(src) <= 2*utf8.UTFMax {
+			return out, src, nil
+		}
+		return nil, nil, err
+	}
+	if atEOF && len(src) > 0 {
+		return nil, nil, errShortSrc
+	}
+	return out, src, nil
+}
@@ -0,0 +1,140 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/toschoo/conduit"
+)
+
+// Charsets:
+// - Text is encoded and decoded in chunks of random size
+// - The encoded stream equals the expected bytes
+// - The decoded stream equals the original text
+func TestCharset(t *testing.T) {
+	type sample struct {
+		cs   Charset
+		text string
+		code []byte
+	}
+	samples := map[string]sample{
+		"latin1":  {Latin1, "Grüße, café!", []byte("Gr\xfc\xdfe, caf\xe9!")},
+		"cp1252":  {Windows1252, "„Zitat“ – 5 €", []byte("\x84Zitat\x93 \x96 5 \x80")},
+		"utf16le": {UTF16LE, "a€😀", []byte{'a', 0, 0xac, 0x20, 0x3d, 0xd8, 0x00, 0xde}},
+		"utf16be": {UTF16BE, "a€😀", []byte{0, 'a', 0x20, 0xac, 0xd8, 0x3d, 0xde, 0x00}},
+		"utf32le": {UTF32LE, "a😀", []byte{'a', 0, 0, 0, 0x00, 0xf6, 0x01, 0x00}},
+		"utf32be": {UTF32BE, "a😀", []byte{0, 0, 0, 'a', 0x00, 0x01, 0xf6, 0x00}},
+	}
+	for name, s := range samples {
+		for i := 1; i < numOfTests; i++ {
+			text := strings.Repeat(s.text, i)
+			code := bytes.Repeat(s.code, i)
+			err := testCharset(s.cs, text, code)
+			if err != nil {
+				m := fmt.Sprintf("Charset failed (%s): %v", name, err)
+				t.Error(m)
+				break
+			}
+		}
+	}
+}
+
+func testCharset(cs Charset, text string, code []byte) error {
+	var out bytes.Buffer
+	pipe := []conduit.Conduit{new(Rechunk), NewCharsetEncoder(cs)}
+	chn := conduit.NewChain(&AnyProducer{[]interface{}{[]byte(text)}}, pipe, NewTextPrinter(&out), small)
+	err := chn.Run()
+	if err != nil {
+		m := fmt.Sprintf("error on encoding: %v", chn.Errs)
+		return errors.New(m)
+	}
+	if !bytes.Equal(out.Bytes(), code) {
+		m := fmt.Sprintf("expected % x, have % x", code, out.Bytes())
+		return errors.New(m)
+	}
+
+	var orig bytes.Buffer
+	pipe = []conduit.Conduit{new(Rechunk), NewCharsetDecoder(cs)}
+	chn = conduit.NewChain(&AnyProducer{[]interface{}{code}}, pipe, NewTextPrinter(&orig), small)
+	err = chn.Run()
+	if err != nil {
+		m := fmt.Sprintf("error on decoding: %v", chn.Errs)
+		return errors.New(m)
+	}
+	if orig.String() != text {
+		m := fmt.Sprintf("expected %q, have %q", text, orig.String())
+		return errors.New(m)
+	}
+	return nil
+}
+
+// Charset errors:
+// - Runes that the charset cannot represent
+// - Truncated multi-byte sequences at the end of the stream
+// - User-defined charsets via CharsetFuncs
+func TestCharsetErrors(t *testing.T) {
+	chn := conduit.NewChain(&AnyProducer{[]interface{}{[]byte("5 €")}},
+		[]conduit.Conduit{NewCharsetEncoder(Latin1)}, new(AnyConsumer), small)
+	if chn.Run() == nil {
+		t.Errorf("Latin1 encoder accepted the euro sign")
+	}
+
+	chn = conduit.NewChain(&AnyProducer{[]interface{}{[]byte{'a', 0, 'b'}}},
+		[]conduit.Conduit{NewCharsetDecoder(UTF16LE)}, new(AnyConsumer), small)
+	if chn.Run() == nil {
+		t.Errorf("UTF-16 decoder accepted an odd number of bytes")
+	}
+
+	cs := CharsetFuncs{
+		Decoder: func() ByteTransformer { return Windows1252.NewDecoder() },
+		Encoder: func() ByteTransformer { return Latin1.NewEncoder() },
+	}
+	var out bytes.Buffer
+	chn = conduit.NewChain(&AnyProducer{[]interface{}{[]byte("\x80 \xe9")}},
+		[]conduit.Conduit{NewCharsetDecoder(cs)}, NewTextPrinter(&out), small)
+	err := chn.Run()
+	if err != nil {
+		t.Fatalf("CharsetFuncs failed: %v", chn.Errs)
+	}
+	if out.String() != "€ é" {
+		t.Errorf("CharsetFuncs: unexpected result %q", out.String())
+	}
+}
+
+// Transcoding with checkpoints:
+// - Bytes carried over a barrier are included in the snapshot
+// - The restored Transcoder completes the carried sequence
+func TestTranscoderRestore(t *testing.T) {
+	tc := NewCharsetDecoder(UTF16LE)
+	src := make(chan interface{}, 2)
+	trg := make(chan interface{}, 2)
+	done := make(chan error)
+	go func() { done <- tc.Conduct(src, trg) }()
+	src <- []byte{'a', 0, 'b'}
+	src <- &conduit.Barrier{}
+	<-trg
+	<-trg // the barrier
+	b, err := tc.Snapshot()
+	if err != nil {
+		t.Fatalf("TranscoderRestore: cannot snapshot: %v", err)
+	}
+	close(src)
+	if <-done == nil {
+		t.Errorf("TranscoderRestore: truncated sequence not reported")
+	}
+	tc = NewCharsetDecoder(UTF16LE)
+	if err = tc.Restore(b); err != nil {
+		t.Fatalf("TranscoderRestore: cannot restore: %v", err)
+	}
+	c := new(AnyConsumer)
+	chn := conduit.NewChain(&AnyProducer{[]interface{}{[]byte{0}}}, []conduit.Conduit{tc}, c, small)
+	if err = chn.Run(); err != nil {
+		t.Fatalf("TranscoderRestore failed: %v", chn.Errs)
+	}
+	if len(c.recvd) != 1 || string(c.recvd[0].([]byte)) != "b" {
+		t.Errorf("TranscoderRestore: unexpected blocks %q", c.recvd)
+	}
+}
@@ -0,0 +1,141 @@
+package utils
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"sync"
+
+	"github.com/toschoo/conduit"
+)
+
+// Checksum is a Conduit that forwards a stream of []byte blocks
+// (or strings) unchanged while computing a running hash,
+// e.g. crc32.NewIEEE(), sha256.New() or xxhash from a third-party package.
+// At the end of the stream, the digest is available through Sum
+// and sent as []byte to the side output "digest"
+// (see conduit.SideOutputter).
+// The state of the hash is included in checkpoints
+// (see conduit.Checkpointer), if the hash implements
+// encoding.BinaryMarshaler and encoding.BinaryUnmarshaler
+// (as the hashes of the standard library do);
+// otherwise, Checksum is conduit.Volatile.
+type Checksum struct {
+	h        hash.Hash
+	expect   []byte
+	side     conduit.Target
+	mu       sync.Mutex
+	sum      []byte
+	restored bool // the hash was restored from a checkpoint
+}
+
+// NewChecksum creates a new Checksum Conduit using the given hash.
+func NewChecksum(h hash.Hash) (cs *Checksum) {
+	if h == nil {
+		return nil
+	}
+	cs = new(Checksum)
+	if cs != nil {
+		cs.h = h
+	}
+	return
+}
+
+// Verify makes the Checksum compare the digest
+// with the expected value at the end of the stream.
+func (cs *Checksum) Verify(expected []byte) *Checksum {
+	cs.expect = expected
+	return cs
+}
+
+// Sum returns the digest of the latest stream
+// or nil, if the stream has not yet ended.
+func (cs *Checksum) Sum() []byte {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.sum
+}
+
+// SideOutput is the pre-defined method that makes Checksum
+// a conduit.SideOutputter. Checksum has the side output "digest".
+func (cs *Checksum) SideOutput(name string, trg conduit.Target) {
+	if name == "digest" {
+		cs.side = trg
+	}
+}
+
+// Conduct is the pre-defined method that makes Checksum a Conduit.
+// Conduct terminates with an error if an item is not []byte or string
+// or if the digest differs from the expected value.
+func (cs *Checksum) Conduct(src conduit.Source, trg conduit.Target) error {
+	cs.mu.Lock()
+	cs.sum = nil
+	cs.mu.Unlock()
+	if !cs.restored {
+		cs.h.Reset()
+	}
+	cs.restored = false
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			trg <- inp
+			continue
+		}
+		switch x := inp.(type) {
+		case []byte:
+			cs.h.Write(x)
+		case string:
+			cs.h.Write([]byte(x))
+		default:
+			return errors.New(fmt.Sprintf("cannot hash %T", inp))
+		}
+		trg <- inp
+	}
+	sum := cs.h.Sum(nil)
+	cs.mu.Lock()
+	cs.sum = sum
+	cs.mu.Unlock()
+	if cs.side != nil {
+		cs.side <- sum
+	}
+	if cs.expect != nil && !bytes.Equal(sum, cs.expect) {
+		return errors.New(fmt.Sprintf("checksum mismatch: expected %s, have %s",
+			hex.EncodeToString(cs.expect), hex.EncodeToString(sum)))
+	}
+	return nil
+}
+
+// Snapshot is the pre-defined method that makes Checksum
+// a conduit.Checkpointer.
+func (cs *Checksum) Snapshot() ([]byte, error) {
+	m, ok := cs.h.(encoding.BinaryMarshaler)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("cannot snapshot %T", cs.h))
+	}
+	return m.MarshalBinary()
+}
+
+// Restore is the pre-defined method that makes Checksum
+// a conduit.Checkpointer.
+func (cs *Checksum) Restore(b []byte) error {
+	u, ok := cs.h.(encoding.BinaryUnmarshaler)
+	if !ok {
+		return errors.New(fmt.Sprintf("cannot restore %T", cs.h))
+	}
+	err := u.UnmarshalBinary(b)
+	if err != nil {
+		return err
+	}
+	cs.restored = true
+	return nil
+}
+
+// Volatile is the pre-defined method that makes Checksum a conduit.Volatile:
+// the state of hashes that cannot be marshaled is not included in checkpoints.
+func (cs *Checksum) Volatile() bool {
+	_, m := cs.h.(encoding.BinaryMarshaler)
+	_, u := cs.h.(encoding.BinaryUnmarshaler)
+	return !m || !u
+}
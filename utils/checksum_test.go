@@ -0,0 +1,89 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"hash"
+	"hash/crc32"
+	"strings"
+	"testing"
+
+	"github.com/toschoo/conduit"
+)
+
+// Checksum:
+// - Data pass unchanged
+// - The digest equals the hash of the whole stream
+// - The digest is sent to the side output
+// - Mismatches are reported
+func TestChecksum(t *testing.T) {
+	text := strings.Repeat("some text to be hashed\n", 1000)
+	want := sha256.Sum256([]byte(text))
+
+	var out bytes.Buffer
+	cs := NewChecksum(sha256.New())
+	side := new(AnyConsumer)
+	chn := conduit.NewChain(NewReader(strings.NewReader(text)), []conduit.Conduit{cs}, NewTextPrinter(&out), small)
+	err := chn.AddSide(cs, "digest", side)
+	if err != nil {
+		t.Fatalf("Checksum: cannot add side: %v", err)
+	}
+	err = chn.Run()
+	if err != nil {
+		t.Fatalf("Checksum failed: %v", chn.Errs)
+	}
+	if out.String() != text {
+		t.Errorf("Checksum: data changed")
+	}
+	if !bytes.Equal(cs.Sum(), want[:]) {
+		t.Errorf("Checksum: expected %x, have %x", want, cs.Sum())
+	}
+	if len(side.recvd) != 1 || !bytes.Equal(side.recvd[0].([]byte), want[:]) {
+		t.Errorf("Checksum: digest not sent to side output: %v", side.recvd)
+	}
+
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(text))
+	cs = NewChecksum(crc32.NewIEEE()).Verify(crc.Sum(nil))
+	chn = conduit.NewChain(NewReader(strings.NewReader(text)), []conduit.Conduit{cs}, NewTextPrinter(new(bytes.Buffer)), small)
+	err = chn.Run()
+	if err != nil {
+		t.Errorf("Checksum: verification failed: %v", chn.Errs)
+	}
+	cs.Verify(want[:4])
+	chn = conduit.NewChain(NewReader(strings.NewReader(text)), []conduit.Conduit{cs}, NewTextPrinter(new(bytes.Buffer)), small)
+	if chn.Run() == nil {
+		t.Errorf("Checksum: mismatch not reported")
+	}
+}
+
+// Checksum with checkpoints:
+// - The restored hash continues the running hash
+// - Hashes that cannot be marshaled are volatile
+func TestChecksumRestore(t *testing.T) {
+	cs := NewChecksum(sha256.New())
+	if cs.Volatile() {
+		t.Errorf("ChecksumRestore: sha256 is volatile")
+	}
+	if err := conduit.NewChain(&AnyProducer{[]interface{}{"ab"}}, []conduit.Conduit{cs}, new(AnyConsumer), small).Run(); err != nil {
+		t.Fatalf("ChecksumRestore failed: %v", err)
+	}
+	b, err := cs.Snapshot()
+	if err != nil {
+		t.Fatalf("ChecksumRestore: cannot snapshot: %v", err)
+	}
+	cs = NewChecksum(sha256.New())
+	if err = cs.Restore(b); err != nil {
+		t.Fatalf("ChecksumRestore: cannot restore: %v", err)
+	}
+	if err := conduit.NewChain(&AnyProducer{[]interface{}{"c"}}, []conduit.Conduit{cs}, new(AnyConsumer), small).Run(); err != nil {
+		t.Fatalf("ChecksumRestore failed: %v", err)
+	}
+	sum := sha256.Sum256([]byte("abc"))
+	if !bytes.Equal(cs.Sum(), sum[:]) {
+		t.Errorf("ChecksumRestore: unexpected digest %x", cs.Sum())
+	}
+	if !NewChecksum(struct{ hash.Hash }{sha256.New()}).Volatile() {
+		t.Errorf("ChecksumRestore: opaque hash is not volatile")
+	}
+}
@@ -0,0 +1,859 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	mbig "math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+// ClickHouse data type, e.g. Nullable(Array(String))
+type chType struct {
+	name  string
+	args  []string
+	elems []*chType
+	enum  map[string]int64
+}
+
+// Parses a data type as reported by DESCRIBE TABLE
+func parseCHType(s string) (*chType, error) {
+	s = strings.TrimSpace(s)
+	t := &chType{name: s}
+	i := strings.Index(s, "(")
+	if i < 0 {
+		return t, nil
+	}
+	if !strings.HasSuffix(s, ")") {
+		return nil, errors.New("invalid ClickHouse type " + s)
+	}
+	t.name = s[:i]
+	t.args = splitCHArgs(s[i+1 : len(s)-1])
+	switch t.name {
+	case "Nullable", "LowCardinality", "Array", "Map":
+		for _, a := range t.args {
+			e, err := parseCHType(a)
+			if err != nil {
+				return nil, err
+			}
+			t.elems = append(t.elems, e)
+		}
+		if len(t.elems) != 1 && !(t.name == "Map" && len(t.elems) == 2) {
+			return nil, errors.New("invalid ClickHouse type " + s)
+		}
+	case "Enum8", "Enum16":
+		t.enum = make(map[string]int64)
+		for _, a := range t.args {
+			j := strings.LastIndex(a, "=")
+			if j < 0 {
+				return nil, errors.New("invalid ClickHouse type " + s)
+			}
+			name := strings.Replace(strings.Trim(strings.TrimSpace(a[:j]), "'"), "\\'", "'", -1)
+			n, err := strconv.ParseInt(strings.TrimSpace(a[j+1:]), 10, 64)
+			if err != nil {
+				return nil, errors.New("invalid ClickHouse type " + s)
+			}
+			t.enum[name] = n
+		}
+	}
+	return t, nil
+}
+
+// Splits arguments at top-level commas outside of quotes
+func splitCHArgs(s string) []string {
+	var args []string
+	depth, quoted, start := 0, false, 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\' && quoted:
+			i++
+		case c == '\'':
+			quoted = !quoted
+		case quoted:
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == ',' && depth == 0:
+			args = append(args, strings.TrimSpace(s[start:i]))
+			start = i + 1
+		}
+	}
+	return append(args, strings.TrimSpace(s[start:]))
+}
+
+// Integer argument n of the type
+func (t *chType) intArg(n int) int {
+	if n >= len(t.args) {
+		return 0
+	}
+	v, _ := strconv.Atoi(t.args[n])
+	return v
+}
+
+// Timezone of DateTime and DateTime64 types
+func (t *chType) location() *time.Location {
+	for _, a := range t.args {
+		if strings.HasPrefix(a, "'") {
+			if loc, err := time.LoadLocation(strings.Trim(a, "'")); err == nil {
+				return loc
+			}
+		}
+	}
+	return time.UTC
+}
+
+// Encoder of values in RowBinary format
+type chEncoder struct {
+	buf     bytes.Buffer
+	marshal MarshalFunc
+}
+
+func (e *chEncoder) uvarint(n uint64) {
+	var b [binary.MaxVarintLen64]byte
+	e.buf.Write(b[:binary.PutUvarint(b[:], n)])
+}
+
+func (e *chEncoder) fixed(v interface{}) {
+	binary.Write(&e.buf, binary.LittleEndian, v)
+}
+
+// Writes value v as type t
+func (e *chEncoder) write(t *chType, v interface{}) error {
+	if r, ok := v.(json.RawMessage); ok {
+		var x interface{}
+		dec := json.NewDecoder(bytes.NewReader(r))
+		dec.UseNumber()
+		if err := dec.Decode(&x); err != nil {
+			return err
+		}
+		v = x
+	}
+	switch t.name {
+	case "Nullable":
+		if isNil(v) {
+			e.buf.WriteByte(1)
+			return nil
+		}
+		e.buf.WriteByte(0)
+		return e.write(t.elems[0], v)
+	case "LowCardinality":
+		return e.write(t.elems[0], v)
+	case "Array":
+		rv := reflect.ValueOf(v)
+		if isNil(v) {
+			e.uvarint(0)
+			return nil
+		}
+		if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+			return errors.New(fmt.Sprintf("cannot convert %T to %s", v, t.name))
+		}
+		e.uvarint(uint64(rv.Len()))
+		for i := 0; i < rv.Len(); i++ {
+			if err := e.write(t.elems[0], rv.Index(i).Interface()); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "Map":
+		rv := reflect.ValueOf(v)
+		if isNil(v) {
+			e.uvarint(0)
+			return nil
+		}
+		if rv.Kind() != reflect.Map {
+			return errors.New(fmt.Sprintf("cannot convert %T to %s", v, t.name))
+		}
+		e.uvarint(uint64(rv.Len()))
+		iter := rv.MapRange()
+		for iter.Next() {
+			if err := e.write(t.elems[0], iter.Key().Interface()); err != nil {
+				return err
+			}
+			if err := e.write(t.elems[1], iter.Value().Interface()); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "String":
+		var s []byte
+		switch x := v.(type) {
+		case nil:
+		case string:
+			s = []byte(x)
+		case []byte:
+			s = x
+		case json.Number:
+			s = []byte(x)
+		default:
+			var err error
+			if s, err = e.marshal(v); err != nil {
+				return err
+			}
+		}
+		e.uvarint(uint64(len(s)))
+		e.buf.Write(s)
+		return nil
+	case "FixedString":
+		s, ok := v.(string)
+		if b, isb := v.([]byte); isb {
+			s, ok = string(b), true
+		}
+		n := t.intArg(0)
+		if !ok && v != nil || len(s) > n {
+			return errors.New(fmt.Sprintf("cannot convert %v to %s(%d)", v, t.name, n))
+		}
+		e.buf.WriteString(s)
+		e.buf.Write(make([]byte, n-len(s)))
+		return nil
+	case "Bool":
+		b, ok := v.(bool)
+		if !ok && v != nil {
+			n, err := chInt(v)
+			if err != nil {
+				return err
+			}
+			b = n != 0
+		}
+		if b {
+			e.buf.WriteByte(1)
+		} else {
+			e.buf.WriteByte(0)
+		}
+		return nil
+	case "Float32", "Float64":
+		f, err := chFloat(v)
+		if err != nil {
+			return err
+		}
+		if t.name == "Float32" {
+			e.fixed(float32(f))
+		} else {
+			e.fixed(f)
+		}
+		return nil
+	case "Date", "Date32", "DateTime", "DateTime64":
+		tm, err := chTime(v, t.location())
+		if err != nil {
+			return err
+		}
+		switch t.name {
+		case "Date":
+			e.fixed(uint16(chDays(tm)))
+		case "Date32":
+			e.fixed(int32(chDays(tm)))
+		case "DateTime":
+			e.fixed(uint32(tm.Unix()))
+		default:
+			scale := int64(math.Pow10(9 - t.intArg(0)))
+			e.fixed(tm.Unix()*int64(math.Pow10(t.intArg(0))) + int64(tm.Nanosecond())/scale)
+		}
+		return nil
+	case "UUID":
+		var id []byte
+		switch x := v.(type) {
+		case nil:
+			id = make([]byte, 16)
+		case string:
+			id, _ = hex.DecodeString(strings.Replace(x, "-", "", -1))
+		case []byte:
+			id = x
+		}
+		if len(id) != 16 {
+			return errors.New(fmt.Sprintf("cannot convert %v to UUID", v))
+		}
+		// two little-endian 64-bit halves
+		for _, half := range [][]byte{id[:8], id[8:]} {
+			for i := 7; i >= 0; i-- {
+				e.buf.WriteByte(half[i])
+			}
+		}
+		return nil
+	case "IPv4", "IPv6":
+		var ip net.IP
+		switch x := v.(type) {
+		case nil:
+			ip = net.IPv6zero
+			if t.name == "IPv4" {
+				ip = net.IPv4zero
+			}
+		case string:
+			ip = net.ParseIP(x)
+		case net.IP:
+			ip = x
+		}
+		if ip == nil || (t.name == "IPv4" && ip.To4() == nil) {
+			return errors.New(fmt.Sprintf("cannot convert %v to %s", v, t.name))
+		}
+		if t.name == "IPv4" {
+			e.fixed(binary.BigEndian.Uint32(ip.To4()))
+		} else {
+			e.buf.Write(ip.To16())
+		}
+		return nil
+	case "Enum8", "Enum16":
+		n, ok := t.enum[fmt.Sprint(v)]
+		if s, isStr := v.(string); isStr && !ok {
+			return errors.New(fmt.Sprintf("%q is not a value of %s", s, t.name))
+		}
+		if !ok {
+			var err error
+			if n, err = chInt(v); err != nil {
+				return err
+			}
+		}
+		if t.name == "Enum8" {
+			e.fixed(int8(n))
+		} else {
+			e.fixed(int16(n))
+		}
+		return nil
+	case "Decimal", "Decimal32", "Decimal64", "Decimal128":
+		return e.decimal(t, v)
+	}
+	if strings.HasPrefix(t.name, "Int") || strings.HasPrefix(t.name, "UInt") {
+		return e.integer(t, v)
+	}
+	return errors.New("unsupported ClickHouse type " + t.name)
+}
+
+// Writes an integer type
+func (e *chEncoder) integer(t *chType, v interface{}) error {
+	var n int64
+	var u uint64
+	var err error
+	unsigned := strings.HasPrefix(t.name, "U")
+	if unsigned {
+		u, err = chUint(v)
+	} else {
+		n, err = chInt(v)
+	}
+	if err != nil {
+		return err
+	}
+	bits, _ := strconv.Atoi(strings.TrimLeft(t.name, "UInt"))
+	switch bits {
+	case 8:
+		e.buf.WriteByte(byte(n) | byte(u))
+	case 16:
+		e.fixed(uint16(n) | uint16(u))
+	case 32:
+		e.fixed(uint32(n) | uint32(u))
+	case 64:
+		e.fixed(uint64(n) | u)
+	default:
+		return errors.New("unsupported ClickHouse type " + t.name)
+	}
+	return nil
+}
+
+// Writes a decimal as scaled integer of 4, 8 or 16 bytes
+func (e *chEncoder) decimal(t *chType, v interface{}) error {
+	prec, scale := t.intArg(0), t.intArg(1)
+	switch t.name {
+	case "Decimal32":
+		prec, scale = 9, t.intArg(0)
+	case "Decimal64":
+		prec, scale = 18, t.intArg(0)
+	case "Decimal128":
+		prec, scale = 38, t.intArg(0)
+	}
+	var r *mbig.Rat
+	switch x := v.(type) {
+	case nil:
+		r = new(mbig.Rat)
+	case string:
+		r, _ = new(mbig.Rat).SetString(x)
+	case json.Number:
+		r, _ = new(mbig.Rat).SetString(string(x))
+	default:
+		f, err := chFloat(v)
+		if err != nil {
+			return err
+		}
+		r = new(mbig.Rat).SetFloat64(f)
+	}
+	if r == nil {
+		return errors.New(fmt.Sprintf("cannot convert %v to %s", v, t.name))
+	}
+	r.Mul(r, new(mbig.Rat).SetInt(new(mbig.Int).Exp(mbig.NewInt(10), mbig.NewInt(int64(scale)), nil)))
+	// rounded half away from zero
+	n := new(mbig.Int).Quo(new(mbig.Int).Add(new(mbig.Int).Mul(r.Num(), mbig.NewInt(2)), new(mbig.Int).Mul(mbig.NewInt(int64(r.Num().Sign())), r.Denom())), new(mbig.Int).Mul(r.Denom(), mbig.NewInt(2)))
+	switch {
+	case prec <= 9:
+		e.fixed(int32(n.Int64()))
+	case prec <= 18:
+		e.fixed(n.Int64())
+	case prec <= 38:
+		// two's complement, little endian
+		if n.Sign() < 0 {
+			n.Add(n, new(mbig.Int).Lsh(mbig.NewInt(1), 128))
+		}
+		b := n.FillBytes(make([]byte, 16))
+		for i := 15; i >= 0; i-- {
+			e.buf.WriteByte(b[i])
+		}
+	default:
+		return errors.New(fmt.Sprintf("unsupported ClickHouse type %s(%d)", t.name, prec))
+	}
+	return nil
+}
+
+func isNil(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Interface:
+		return rv.IsNil()
+	}
+	return false
+}
+
+func chInt(v interface{}) (int64, error) {
+	switch x := v.(type) {
+	case nil:
+		return 0, nil
+	case bool:
+		if x {
+			return 1, nil
+		}
+		return 0, nil
+	case json.Number:
+		return strconv.ParseInt(string(x), 10, 64)
+	case string:
+		return strconv.ParseInt(x, 10, 64)
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(rv.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		if f := rv.Float(); f == math.Trunc(f) {
+			return int64(f), nil
+		}
+	}
+	return 0, errors.New(fmt.Sprintf("cannot convert %v to integer", v))
+}
+
+func chUint(v interface{}) (uint64, error) {
+	switch x := v.(type) {
+	case json.Number:
+		return strconv.ParseUint(string(x), 10, 64)
+	case string:
+		return strconv.ParseUint(x, 10, 64)
+	case uint64:
+		return x, nil
+	case uint:
+		return uint64(x), nil
+	}
+	n, err := chInt(v)
+	if err == nil && n < 0 {
+		err = errors.New(fmt.Sprintf("cannot convert %v to unsigned integer", v))
+	}
+	return uint64(n), err
+}
+
+func chFloat(v interface{}) (float64, error) {
+	switch x := v.(type) {
+	case nil:
+		return 0, nil
+	case json.Number:
+		return x.Float64()
+	case string:
+		return strconv.ParseFloat(x, 64)
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), nil
+	}
+	n, err := chInt(v)
+	return float64(n), err
+}
+
+// Times are time.Time, strings in RFC 3339 or ClickHouse format
+// (in loc) or seconds since the epoch
+func chTime(v interface{}, loc *time.Location) (time.Time, error) {
+	switch x := v.(type) {
+	case nil:
+		return time.Unix(0, 0), nil
+	case time.Time:
+		return x, nil
+	case string:
+		if tm, err := time.Parse(time.RFC3339Nano, x); err == nil {
+			return tm, nil
+		}
+		for _, layout := range []string{"2006-01-02 15:04:05.999999999", "2006-01-02"} {
+			if tm, err := time.ParseInLocation(layout, x, loc); err == nil {
+				return tm, nil
+			}
+		}
+		return time.Time{}, errors.New(fmt.Sprintf("cannot convert %q to time", x))
+	}
+	f, err := chFloat(v)
+	if err != nil {
+		return time.Time{}, err
+	}
+	sec, frac := math.Modf(f)
+	return time.Unix(int64(sec), int64(frac*1e9)), nil
+}
+
+// Days since the epoch of the date of tm
+func chDays(tm time.Time) int64 {
+	y, m, d := tm.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC).Unix() / 86400
+}
+
+// Size at which blocks are inserted regardless of the number of rows
+const chMaxBlock = 64 << 20
+
+// Column of a ClickHouse table
+type chColumn struct {
+	name string
+	typ  *chType
+}
+
+// ClickHouseWriter is a Consumer that inserts the incoming items
+// as rows into a ClickHouse table over the HTTP interface
+// in RowBinary format. Items are Records, maps with string keys
+// or structs, which are converted like by encoding/json;
+// their fields are mapped by name to the columns of the table,
+// whose types are read from the table (DESCRIBE TABLE)
+// or given explicitly (see SetColumns).
+// Missing fields are inserted as default values of the type
+// (not the defaults of the table), e.g. 0, "" or NULL;
+// values are converted to the column types, e.g. strings
+// to numbers or times and other values to String columns
+// with a MarshalFunc (default: json.Marshal).
+// Rows are inserted in blocks (see SetBlockSize and SetMaxAge)
+// of at most 64MiB, which are also inserted at barriers and at the end.
+// Blocks that fail with a network error or status 429 or 5xx
+// are inserted again according to the RetryPolicy (DefaultRetry)
+// with the same insert_deduplication_token, so that tables
+// with deduplication do not receive blocks twice.
+type ClickHouseWriter struct {
+	base     *url.URL
+	user     string
+	pass     string
+	table    string
+	specs    []string
+	columns  []chColumn
+	block    int
+	maxAge   time.Duration
+	compress bool
+	marshal  MarshalFunc
+	client   *http.Client
+	retry    RetryPolicy
+	session  string
+}
+
+// NewClickHouseWriter creates a new ClickHouseWriter Consumer
+// inserting into table (which may be qualified by the database)
+// on the server at the URL of the HTTP interface
+// (http[s]://[user:password@]host:port[/database]).
+func NewClickHouseWriter(rawurl, table string) (cw *ClickHouseWriter) {
+	u, err := url.Parse(rawurl)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || table == "" {
+		return nil
+	}
+	cw = new(ClickHouseWriter)
+	if cw != nil {
+		if u.User != nil {
+			cw.user = u.User.Username()
+			cw.pass, _ = u.User.Password()
+		}
+		cw.base = &url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/"}
+		if db := strings.Trim(u.Path, "/"); db != "" {
+			cw.base.RawQuery = url.Values{"database": {db}}.Encode()
+		}
+		cw.table = table
+		cw.block = 65536
+		cw.marshal = json.Marshal
+		cw.client = http.DefaultClient
+		cw.retry = DefaultRetry
+	}
+	return
+}
+
+// SetColumns restricts the columns to insert to cols,
+// given as name or as name and type (e.g. "ts DateTime64(3)");
+// the types of columns without type are read from the table.
+func (cw *ClickHouseWriter) SetColumns(cols ...string) *ClickHouseWriter {
+	cw.specs = cols
+	return cw
+}
+
+// SetBlockSize sets the number of rows per insert (default 65536).
+func (cw *ClickHouseWriter) SetBlockSize(n int) *ClickHouseWriter {
+	if n > 0 {
+		cw.block = n
+	}
+	return cw
+}
+
+// SetMaxAge sets the time after which a block is inserted
+// even if it is not full.
+func (cw *ClickHouseWriter) SetMaxAge(d time.Duration) *ClickHouseWriter {
+	cw.maxAge = d
+	return cw
+}
+
+// SetCompress compresses requests with gzip.
+func (cw *ClickHouseWriter) SetCompress() *ClickHouseWriter {
+	cw.compress = true
+	return cw
+}
+
+// SetMarshal sets the MarshalFunc for values of String columns
+// that are neither strings nor []byte.
+func (cw *ClickHouseWriter) SetMarshal(marshal MarshalFunc) *ClickHouseWriter {
+	cw.marshal = marshal
+	return cw
+}
+
+// SetClient sets the http.Client (default: http.DefaultClient).
+func (cw *ClickHouseWriter) SetClient(c *http.Client) *ClickHouseWriter {
+	cw.client = c
+	return cw
+}
+
+// SetRetry sets the RetryPolicy (default: DefaultRetry).
+func (cw *ClickHouseWriter) SetRetry(rp RetryPolicy) *ClickHouseWriter {
+	cw.retry = rp
+	return cw
+}
+
+// Quotes a possibly qualified name
+func chQuote(name string) string {
+	parts := strings.Split(name, ".")
+	for i, p := range parts {
+		parts[i] = "`" + strings.Replace(p, "`", "\\`", -1) + "`"
+	}
+	return strings.Join(parts, ".")
+}
+
+// Sends a query with body; retries according to the RetryPolicy
+func (cw *ClickHouseWriter) query(q string, params url.Values, body []byte) ([]byte, error) {
+	u := *cw.base
+	v := u.Query()
+	v.Set("query", q)
+	for k, vs := range params {
+		v[k] = vs
+	}
+	u.RawQuery = v.Encode()
+	var reply []byte
+	_, err := cw.retry.run(nil, func() (bool, error) {
+		req, err := http.NewRequest("POST", u.String(), bytes.NewReader(body))
+		if err != nil {
+			return false, err
+		}
+		if cw.user != "" {
+			req.Header.Set("X-ClickHouse-User", cw.user)
+			req.Header.Set("X-ClickHouse-Key", cw.pass)
+		}
+		if cw.compress && len(body) > 0 {
+			req.Header.Set("Content-Encoding", "gzip")
+		}
+		rsp, err := cw.client.Do(req)
+		if err != nil {
+			return true, err
+		}
+		reply, err = ioutil.ReadAll(rsp.Body)
+		rsp.Body.Close()
+		if err != nil {
+			return true, err
+		}
+		if rsp.StatusCode != http.StatusOK {
+			msg := strings.TrimSpace(string(reply))
+			return retryableStatus(rsp.StatusCode), errors.New(fmt.Sprintf("clickhouse: %s: %s", rsp.Status, msg))
+		}
+		return false, nil
+	})
+	return reply, err
+}
+
+// Determines the columns and their types
+func (cw *ClickHouseWriter) describe() error {
+	types := make(map[string]string)
+	var names []string
+	for _, s := range cw.specs {
+		f := strings.SplitN(strings.TrimSpace(s), " ", 2)
+		names = append(names, f[0])
+		if len(f) == 2 {
+			types[f[0]] = f[1]
+		}
+	}
+	if len(names) == 0 || len(types) < len(names) {
+		reply, err := cw.query("DESCRIBE TABLE "+chQuote(cw.table)+" FORMAT TabSeparated", nil, nil)
+		if err != nil {
+			return err
+		}
+		sc := bufio.NewScanner(bytes.NewReader(reply))
+		for sc.Scan() {
+			f := strings.Split(sc.Text(), "\t")
+			if len(f) < 2 {
+				continue
+			}
+			// materialized and alias columns cannot be inserted
+			if len(f) > 2 && (f[2] == "MATERIALIZED" || f[2] == "ALIAS") {
+				continue
+			}
+			if len(cw.specs) == 0 {
+				names = append(names, f[0])
+			}
+			if _, ok := types[f[0]]; !ok {
+				types[f[0]] = strings.Replace(f[1], "\\'", "'", -1)
+			}
+		}
+	}
+	cw.columns = nil
+	for _, n := range names {
+		s, ok := types[n]
+		if !ok {
+			return errors.New(fmt.Sprintf("clickhouse: no column %s in %s", n, cw.table))
+		}
+		t, err := parseCHType(s)
+		if err != nil {
+			return err
+		}
+		cw.columns = append(cw.columns, chColumn{n, t})
+	}
+	if len(cw.columns) == 0 {
+		return errors.New("clickhouse: no columns in " + cw.table)
+	}
+	return nil
+}
+
+// Fields of an item by name
+func chFields(inp interface{}) (map[string]interface{}, error) {
+	switch x := inp.(type) {
+	case Record:
+		return x, nil
+	case map[string]interface{}:
+		return x, nil
+	}
+	data, err := json.Marshal(inp)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]json.RawMessage
+	err = json.Unmarshal(data, &m)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("cannot convert %T to row", inp))
+	}
+	fields := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		fields[k] = v
+	}
+	return fields, nil
+}
+
+// Inserts a block
+func (cw *ClickHouseWriter) insert(rows []byte, n int) error {
+	names := make([]string, len(cw.columns))
+	for i, c := range cw.columns {
+		names[i] = chQuote(c.name)
+	}
+	q := fmt.Sprintf("INSERT INTO %s (%s) FORMAT RowBinary", chQuote(cw.table), strings.Join(names, ", "))
+	params := url.Values{"insert_deduplication_token": {fmt.Sprintf("%s-%d", cw.session, n)}}
+	if cw.compress {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(rows)
+		zw.Close()
+		rows = buf.Bytes()
+	}
+	_, err := cw.query(q, params, rows)
+	return err
+}
+
+// Consume is the pre-defined method that makes ClickHouseWriter a Consumer.
+// Consume terminates with an error if an item cannot be converted
+// or a block cannot be inserted.
+func (cw *ClickHouseWriter) Consume(src conduit.Source) error {
+	err := cw.describe()
+	if err != nil {
+		return err
+	}
+	id := make([]byte, 8)
+	rand.Read(id)
+	cw.session = hex.EncodeToString(id)
+	enc := &chEncoder{marshal: cw.marshal}
+	rows, blocks := 0, 0
+	var timer *time.Timer
+	var expired <-chan time.Time
+	flush := func() error {
+		if timer != nil {
+			timer.Stop()
+			timer, expired = nil, nil
+		}
+		if rows == 0 {
+			return nil
+		}
+		blocks++
+		err := cw.insert(enc.buf.Bytes(), blocks)
+		enc.buf.Reset()
+		rows = 0
+		return err
+	}
+	for {
+		select {
+		case inp, ok := <-src:
+			if !ok {
+				return flush()
+			}
+			if conduit.IsBarrier(inp) {
+				if err := flush(); err != nil {
+					return err
+				}
+				continue
+			}
+			fields, err := chFields(inp)
+			if err != nil {
+				return err
+			}
+			start := enc.buf.Len()
+			for _, c := range cw.columns {
+				if err = enc.write(c.typ, fields[c.name]); err != nil {
+					enc.buf.Truncate(start)
+					return errors.New(fmt.Sprintf("column %s: %v", c.name, err))
+				}
+			}
+			rows++
+			if rows == 1 && cw.maxAge > 0 {
+				timer = time.NewTimer(cw.maxAge)
+				expired = timer.C
+			}
+			if rows >= cw.block || enc.buf.Len() >= chMaxBlock {
+				if err = flush(); err != nil {
+					return err
+				}
+			}
+		case <-expired:
+			timer, expired = nil, nil
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
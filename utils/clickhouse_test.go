@@ -0,0 +1,360 @@
+package utils
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	mbig "math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+// Test table as reported by DESCRIBE TABLE ... FORMAT TabSeparated
+const chSchema = `id	UInt64
+n	Int32
+name	String
+tag	LowCardinality(String)
+score	Nullable(Float64)
+ok	Bool
+day	Date
+ts	DateTime64(3, \'UTC\')
+at	DateTime
+uid	UUID
+tags	Array(String)
+attrs	Map(String, Int16)
+level	Enum8(\'low\' = 1, \'high\' = 2)
+price	Decimal(10, 2)
+big	Decimal(30, 4)
+ip	IPv4
+code	FixedString(3)
+extra	String
+total	UInt32	MATERIALIZED	n * 2
+`
+
+// ClickHouse test server; the first insert fails with 503,
+// blocks are deduplicated by insert_deduplication_token
+type chServer struct {
+	*httptest.Server
+	door      sync.Mutex
+	describes int
+	inserts   int
+	tokens    map[string]bool
+	rows      []map[string]string
+}
+
+func newCHServer(t *testing.T) *chServer {
+	s := &chServer{tokens: make(map[string]bool)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.door.Lock()
+		defer s.door.Unlock()
+		if r.Header.Get("X-ClickHouse-User") != "user" || r.Header.Get("X-ClickHouse-Key") != "secret" {
+			http.Error(w, "authentication failed", http.StatusForbidden)
+			return
+		}
+		if db := r.URL.Query().Get("database"); db != "db" {
+			http.Error(w, "unknown database "+db, http.StatusNotFound)
+			return
+		}
+		q := r.URL.Query().Get("query")
+		if strings.HasPrefix(q, "DESCRIBE TABLE `events`") {
+			s.describes++
+			io.WriteString(w, chSchema)
+			return
+		}
+		if !strings.HasPrefix(q, "INSERT INTO `events` (") || !strings.HasSuffix(q, ") FORMAT RowBinary") {
+			http.Error(w, "unexpected query "+q, http.StatusBadRequest)
+			return
+		}
+		s.inserts++
+		if s.inserts == 1 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		var body io.Reader = r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			body = zr
+		}
+		data, err := ioutil.ReadAll(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		token := r.URL.Query().Get("insert_deduplication_token")
+		if s.tokens[token] {
+			return
+		}
+		s.tokens[token] = true
+		types := make(map[string]*chType)
+		for _, l := range strings.Split(strings.Replace(chSchema, "\\'", "'", -1), "\n") {
+			if f := strings.Split(l, "\t"); len(f) > 1 {
+				types[f[0]], _ = parseCHType(f[1])
+			}
+		}
+		cols := strings.Split(q[len("INSERT INTO `events` ("):len(q)-len(") FORMAT RowBinary")], ", ")
+		rd := bytes.NewReader(data)
+		for rd.Len() > 0 {
+			row := make(map[string]string)
+			for _, c := range cols {
+				c = strings.Trim(c, "`")
+				row[c] = chDecode(types[c], rd)
+			}
+			s.rows = append(s.rows, row)
+		}
+	}))
+	return s
+}
+
+// Decodes a RowBinary value as string
+func chDecode(t *chType, r *bytes.Reader) string {
+	read := func(v interface{}) { binary.Read(r, binary.LittleEndian, v) }
+	switch t.name {
+	case "Nullable":
+		if b, _ := r.ReadByte(); b == 1 {
+			return "NULL"
+		}
+		return chDecode(t.elems[0], r)
+	case "LowCardinality":
+		return chDecode(t.elems[0], r)
+	case "Array":
+		n, _ := binary.ReadUvarint(r)
+		var vs []string
+		for ; n > 0; n-- {
+			vs = append(vs, chDecode(t.elems[0], r))
+		}
+		return "[" + strings.Join(vs, " ") + "]"
+	case "Map":
+		n, _ := binary.ReadUvarint(r)
+		var vs []string
+		for ; n > 0; n-- {
+			vs = append(vs, chDecode(t.elems[0], r)+":"+chDecode(t.elems[1], r))
+		}
+		sort.Strings(vs)
+		return "{" + strings.Join(vs, " ") + "}"
+	case "String":
+		n, _ := binary.ReadUvarint(r)
+		b := make([]byte, n)
+		r.Read(b)
+		return string(b)
+	case "FixedString":
+		b := make([]byte, t.intArg(0))
+		r.Read(b)
+		return string(b)
+	case "Bool":
+		b, _ := r.ReadByte()
+		return fmt.Sprint(b == 1)
+	case "Int32":
+		var v int32
+		read(&v)
+		return fmt.Sprint(v)
+	case "UInt32":
+		var v uint32
+		read(&v)
+		return fmt.Sprint(v)
+	case "UInt64":
+		var v uint64
+		read(&v)
+		return fmt.Sprint(v)
+	case "Int16":
+		var v int16
+		read(&v)
+		return fmt.Sprint(v)
+	case "Float64":
+		var v float64
+		read(&v)
+		return fmt.Sprint(v)
+	case "Date":
+		var v uint16
+		read(&v)
+		return time.Unix(int64(v)*86400, 0).UTC().Format("2006-01-02")
+	case "DateTime":
+		var v uint32
+		read(&v)
+		return time.Unix(int64(v), 0).UTC().Format("2006-01-02 15:04:05")
+	case "DateTime64":
+		var v int64
+		read(&v)
+		return time.Unix(0, v*1000000).UTC().Format(time.RFC3339Nano)
+	case "UUID":
+		b := make([]byte, 16)
+		r.Read(b)
+		for i := 0; i < 4; i++ {
+			b[i], b[7-i] = b[7-i], b[i]
+			b[8+i], b[15-i] = b[15-i], b[8+i]
+		}
+		h := hex.EncodeToString(b)
+		return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+	case "Enum8":
+		v, _ := r.ReadByte()
+		for name, n := range t.enum {
+			if n == int64(int8(v)) {
+				return name
+			}
+		}
+		return fmt.Sprint(int8(v))
+	case "Decimal":
+		var n *mbig.Int
+		switch {
+		case t.intArg(0) <= 9:
+			var v int32
+			read(&v)
+			n = mbig.NewInt(int64(v))
+		case t.intArg(0) <= 18:
+			var v int64
+			read(&v)
+			n = mbig.NewInt(v)
+		default:
+			b := make([]byte, 16)
+			r.Read(b)
+			for i := 0; i < 8; i++ {
+				b[i], b[15-i] = b[15-i], b[i]
+			}
+			n = new(mbig.Int).SetBytes(b)
+			if b[0]&0x80 != 0 {
+				n.Sub(n, new(mbig.Int).Lsh(mbig.NewInt(1), 128))
+			}
+		}
+		scale := new(mbig.Int).Exp(mbig.NewInt(10), mbig.NewInt(int64(t.intArg(1))), nil)
+		return new(mbig.Rat).SetFrac(n, scale).FloatString(t.intArg(1))
+	case "IPv4":
+		var v uint32
+		read(&v)
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, v)
+		return ip.String()
+	}
+	panic("unexpected type " + t.name)
+}
+
+type chEvent struct {
+	ID    uint64          `json:"id"`
+	Name  string          `json:"name"`
+	Price json.Number     `json:"price"`
+	Tags  []string        `json:"tags"`
+	Attrs map[string]int  `json:"attrs"`
+	Extra struct{ A int } `json:"extra"`
+}
+
+// ClickHouse writer:
+// - Column types are read from the table, materialized columns are skipped
+// - Values are converted to the column types, missing ones are defaults
+// - Blocks are inserted again after 503 with the same deduplication token
+func TestClickHouse(t *testing.T) {
+	srv := newCHServer(t)
+	defer srv.Close()
+	u := strings.Replace(srv.URL, "http://", "http://user:secret@", 1) + "/db"
+
+	if NewClickHouseWriter("ftp://host/db", "events") != nil || NewClickHouseWriter(u, "") != nil {
+		t.Errorf("ClickHouseWriter: invalid arguments accepted")
+	}
+
+	var items []interface{}
+	for i := 0; i < 9; i++ {
+		r := Record{
+			"id": uint64(i), "n": i - 5, "name": fmt.Sprint("row ", i), "tag": "t",
+			"ok": i%2 == 1, "day": "2024-05-01",
+			"ts":   time.Date(2024, 5, 1, 12, 30, 0, i*1000000, time.UTC),
+			"at":   1714566600 + i,
+			"uid":  fmt.Sprintf("123e4567-e89b-12d3-a456-42661417400%d", i),
+			"tags": []string{"a", "b"}, "attrs": map[string]int{"k": i},
+			"level": "high", "price": "-0.005", "big": "-12345678901234567.8901",
+			"ip": "10.0.0.1", "code": "ab", "extra": []int{i},
+		}
+		if i%2 == 1 {
+			r["score"] = float64(i) / 2
+			r["level"] = 1
+		}
+		items = append(items, r)
+	}
+	items = append(items, &conduit.Barrier{}, &chEvent{ID: 9, Name: "event", Price: "12.345", Tags: []string{}, Attrs: map[string]int{"x": -1}, Extra: struct{ A int }{1}})
+
+	cw := NewClickHouseWriter(u, "events").SetBlockSize(4).SetCompress().SetRetry(fastRetry)
+	if err := conduit.NewChain(&AnyProducer{src: items}, nil, cw, small).Run(); err != nil {
+		t.Fatalf("ClickHouseWriter failed: %v", err)
+	}
+	// blocks of 4, 4, 1 (barrier) and 1 (end)
+	if srv.describes != 1 || srv.inserts != 5 || len(srv.tokens) != 4 {
+		t.Errorf("ClickHouseWriter: %d describes, %d inserts, %d blocks", srv.describes, srv.inserts, len(srv.tokens))
+	}
+	if len(srv.rows) != 10 {
+		t.Fatalf("ClickHouseWriter: %d rows inserted", len(srv.rows))
+	}
+	for i, row := range srv.rows[:9] {
+		score, level, ok := "NULL", "high", "false"
+		if i%2 == 1 {
+			score, level, ok = fmt.Sprint(float64(i)/2), "low", "true"
+		}
+		want := map[string]string{
+			"id": fmt.Sprint(i), "n": fmt.Sprint(i - 5), "name": fmt.Sprint("row ", i), "tag": "t",
+			"score": score, "ok": ok, "day": "2024-05-01",
+			"ts":   fmt.Sprintf("2024-05-01T12:30:00.00%dZ", i),
+			"at":   fmt.Sprintf("2024-05-01 12:30:0%d", i),
+			"uid":  fmt.Sprintf("123e4567-e89b-12d3-a456-42661417400%d", i),
+			"tags": "[a b]", "attrs": fmt.Sprintf("{k:%d}", i), "level": level,
+			"price": "-0.01", "big": "-12345678901234567.8901",
+			"ip": "10.0.0.1", "code": "ab\x00", "extra": fmt.Sprintf("[%d]", i),
+		}
+		if i == 0 {
+			want["ts"] = "2024-05-01T12:30:00Z"
+		}
+		if len(row) != len(want) {
+			t.Errorf("ClickHouseWriter: unexpected columns %v", row)
+		}
+		for k, v := range want {
+			if row[k] != v {
+				t.Errorf("ClickHouseWriter: row %d: %s is %q, expected %q", i, k, row[k], v)
+			}
+		}
+	}
+	want := map[string]string{
+		"id": "9", "n": "0", "name": "event", "tag": "", "score": "NULL", "ok": "false",
+		"day": "1970-01-01", "ts": "1970-01-01T00:00:00Z", "at": "1970-01-01 00:00:00",
+		"uid": "00000000-0000-0000-0000-000000000000", "tags": "[]", "attrs": "{x:-1}",
+		"level": "0", "price": "12.35", "big": "0.0000", "ip": "0.0.0.0",
+		"code": "\x00\x00\x00", "extra": `{"A":1}`,
+	}
+	for k, v := range want {
+		if srv.rows[9][k] != v {
+			t.Errorf("ClickHouseWriter: struct: %s is %q, expected %q", k, srv.rows[9][k], v)
+		}
+	}
+
+	// explicit types need no DESCRIBE; invalid values fail
+	srv.rows = nil
+	cw = NewClickHouseWriter(u, "events").SetColumns("id UInt64", "name String").SetRetry(fastRetry)
+	items = []interface{}{Record{"id": 1, "name": "one"}, Record{"id": "x"}}
+	chn := conduit.NewChain(&AnyProducer{src: items}, nil, cw, small)
+	if chn.Run() == nil || !strings.Contains(fmt.Sprint(chn.Errs), "column id") {
+		t.Errorf("ClickHouseWriter: invalid value accepted: %v", chn.Errs)
+	}
+	if srv.describes != 1 || len(srv.rows) != 0 {
+		t.Errorf("ClickHouseWriter: %d describes, %d rows inserted", srv.describes, len(srv.rows))
+	}
+
+	// columns without type are described; unknown columns fail
+	cw = NewClickHouseWriter(u, "events").SetColumns("id", "nope String", "missing")
+	chn = conduit.NewChain(&AnyProducer{src: []interface{}{Record{"id": 1}}}, nil, cw, small)
+	if chn.Run() == nil || !strings.Contains(fmt.Sprint(chn.Errs), "no column missing") {
+		t.Errorf("ClickHouseWriter: unknown column accepted: %v", chn.Errs)
+	}
+	if srv.describes != 2 {
+		t.Errorf("ClickHouseWriter: %d describes", srv.describes)
+	}
+}
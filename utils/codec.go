@@ -0,0 +1,139 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/toschoo/conduit"
+)
+
+// MarshalFunc encodes a value,
+// e.g. yaml.Marshal or toml.Marshal from third-party packages.
+// Components for formats not supported
+// by the standard library are parameterised with codecs,
+// so that users can choose the implementation.
+type MarshalFunc func(v interface{}) ([]byte, error)
+
+// UnmarshalFunc decodes data into the value v points to,
+// e.g. yaml.Unmarshal from a third-party package.
+type UnmarshalFunc func(data []byte, v interface{}) error
+
+// Decodes data with unmarshal into the result of newValue
+// or into interface{}, if newValue is nil
+func unmarshalNew(unmarshal UnmarshalFunc, data []byte, newValue func() interface{}) (interface{}, error) {
+	if newValue == nil {
+		var v interface{}
+		err := unmarshal(data, &v)
+		return v, err
+	}
+	v := newValue()
+	err := unmarshal(data, v)
+	return v, err
+}
+
+// Encodes an item as payload of a message:
+// []byte and string are taken as they are,
+// other items are encoded with marshal
+func payload(inp interface{}, marshal MarshalFunc) ([]byte, error) {
+	switch x := inp.(type) {
+	case []byte:
+		return x, nil
+	case string:
+		return []byte(x), nil
+	}
+	return marshal(inp)
+}
+
+// Assigns a generically decoded value x to the target v points to;
+// targets other than interface{} are filled following
+// the rules of encoding/json
+func assignValue(x interface{}, v interface{}) error {
+	if p, ok := v.(*interface{}); ok {
+		*p = x
+		return nil
+	}
+	buf, err := json.Marshal(x)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(buf, v)
+}
+
+// Encoder is a Conduit that encodes incoming data
+// with a MarshalFunc and sends the result down the chain as []byte.
+type Encoder struct {
+	marshal MarshalFunc
+}
+
+// NewEncoder creates a new Encoder Conduit.
+func NewEncoder(marshal MarshalFunc) (enc *Encoder) {
+	if marshal == nil {
+		return nil
+	}
+	enc = new(Encoder)
+	if enc != nil {
+		enc.marshal = marshal
+	}
+	return
+}
+
+// Conduct is the pre-defined method that makes Encoder a Conduit.
+// Conduct terminates with an error if an item cannot be encoded.
+func (enc *Encoder) Conduct(src conduit.Source, trg conduit.Target) error {
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			trg <- inp
+			continue
+		}
+		buf, err := enc.marshal(inp)
+		if err != nil {
+			return err
+		}
+		trg <- buf
+	}
+	return nil
+}
+
+// Decoder is a Conduit that decodes incoming []byte
+// with an UnmarshalFunc and sends the result down the chain.
+type Decoder struct {
+	unmarshal UnmarshalFunc
+	new       func() interface{}
+}
+
+// NewDecoder creates a new Decoder Conduit.
+// Data are decoded into the result of newValue
+// or, if newValue is nil, into interface{}.
+func NewDecoder(unmarshal UnmarshalFunc, newValue func() interface{}) (dec *Decoder) {
+	if unmarshal == nil {
+		return nil
+	}
+	dec = new(Decoder)
+	if dec != nil {
+		dec.unmarshal = unmarshal
+		dec.new = newValue
+	}
+	return
+}
+
+// Conduct is the pre-defined method that makes Decoder a Conduit.
+// Conduct terminates with an error if an item cannot be decoded.
+func (dec *Decoder) Conduct(src conduit.Source, trg conduit.Target) error {
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			trg <- inp
+			continue
+		}
+		buf, ok := inp.([]byte)
+		if !ok {
+			return errors.New(fmt.Sprintf("cannot decode %T", inp))
+		}
+		v, err := unmarshalNew(dec.unmarshal, buf, dec.new)
+		if err != nil {
+			return err
+		}
+		trg <- v
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/toschoo/conduit"
+)
+
+// Encoder and Decoder:
+// - They are processed without errors
+// - Decoded items equal the original items
+func TestCodecChain(t *testing.T) {
+	for i := 0; i < numOfTests; i++ {
+		err := testCodecChain(i)
+		if err != nil {
+			m := fmt.Sprintf("CodecChain failed: %v", err)
+			t.Error(m)
+		}
+	}
+}
+
+// Decoder with invalid input:
+// - The error is reported
+func TestErrCodecChain(t *testing.T) {
+	p := &AnyProducer{[]interface{}{[]byte("{"), 1}}
+	pipe := []conduit.Conduit{NewDecoder(json.Unmarshal, newPoint)}
+	chn := conduit.NewChain(p, pipe, new(AnyConsumer), small)
+	if chn.Run() == nil {
+		t.Errorf("ErrCodecChain: invalid input not reported")
+	}
+}
+
+func testCodecChain(n int) error {
+
+	points := makePoints(n)
+	c := new(AnyConsumer)
+	pipe := []conduit.Conduit{NewEncoder(json.Marshal), NewDecoder(json.Unmarshal, newPoint)}
+	chn := conduit.NewChain(&AnyProducer{points}, pipe, c, small)
+
+	err := chn.Run()
+	if err != nil {
+		m := fmt.Sprintf("error on running chain: %v", chn.Errs)
+		return errors.New(m)
+	}
+	if len(c.recvd) != n {
+		m := fmt.Sprintf("expected %d items, have %d", n, len(c.recvd))
+		return errors.New(m)
+	}
+	for i, v := range c.recvd {
+		if *v.(*Point) != *points[i].(*Point) {
+			return errors.New("Received values differ from original!")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,342 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+// Coercion declares the conversion of a field of a record
+// to a type (see ColumnType). Strings are parsed,
+// numbers are converted if they fit without loss
+// (e.g. 3.0 to int, but not 3.5), times are formatted
+// and parsed with Layout (default time.RFC3339);
+// the Layouts "unix" and "unixmilli" convert between times
+// and seconds or milliseconds since 1970
+// (times converted to int are always in these units).
+// Numeric values can be converted between units
+// of the same kind by From and To, e.g. "ms" to "s",
+// or multiplied by Factor (if not 0). Known units are
+// ns, us, ms, s, min, h and d (time), mm, cm, m, km, in, ft and mi
+// (length), mg, g, kg, t, oz and lb (mass), B, KB, MB, GB, KiB, MiB
+// and GiB (data) as well as C, F and K (temperature).
+// If Optional, missing fields are ignored
+// and empty strings and nil are converted to nil.
+type Coercion struct {
+	Field    string
+	Type     ColumnType
+	Layout   string
+	From, To string
+	Factor   float64
+	Optional bool
+}
+
+// A unit as multiple of the base unit of its kind;
+// temperatures also have an offset
+type unit struct {
+	kind   string
+	factor float64
+	offset float64
+}
+
+// Units known to Coercion by name
+var units = map[string]unit{
+	"ns": {"time", 1e-9, 0}, "us": {"time", 1e-6, 0}, "ms": {"time", 1e-3, 0}, "s": {"time", 1, 0},
+	"min": {"time", 60, 0}, "h": {"time", 3600, 0}, "d": {"time", 86400, 0},
+	"mm": {"length", 1e-3, 0}, "cm": {"length", 1e-2, 0}, "m": {"length", 1, 0}, "km": {"length", 1e3, 0},
+	"in": {"length", 0.0254, 0}, "ft": {"length", 0.3048, 0}, "mi": {"length", 1609.344, 0},
+	"mg": {"mass", 1e-6, 0}, "g": {"mass", 1e-3, 0}, "kg": {"mass", 1, 0}, "t": {"mass", 1e3, 0},
+	"oz": {"mass", 0.028349523125, 0}, "lb": {"mass", 0.45359237, 0},
+	"B": {"data", 1, 0}, "KB": {"data", 1e3, 0}, "MB": {"data", 1e6, 0}, "GB": {"data", 1e9, 0},
+	"KiB": {"data", 1 << 10, 0}, "MiB": {"data", 1 << 20, 0}, "GiB": {"data", 1 << 30, 0},
+	"C": {"temperature", 1, 273.15}, "K": {"temperature", 1, 0}, "F": {"temperature", 5.0 / 9, 459.67},
+}
+
+// FieldError is the failure to convert a field.
+type FieldError struct {
+	Field string
+	Value interface{}
+	Err   error
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("field '%s' (%v): %v", e.Field, e.Value, e.Err)
+}
+
+// InvalidRecord is a record with fields that could not be converted;
+// Errs contains one FieldError per field.
+type InvalidRecord struct {
+	Record Record
+	Errs   []*FieldError
+}
+
+func (r *InvalidRecord) Error() string {
+	msgs := make([]string, len(r.Errs))
+	for i, e := range r.Errs {
+		msgs[i] = e.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Coercer is a Conduit that converts fields of incoming records
+// (Record or map[string]interface{}) according to Coercions
+// and sends the converted copies down the chain.
+// Records with fields that cannot be converted are sent
+// as *InvalidRecord to the side output "invalid"
+// (see conduit.SideOutputter); if the side output
+// is not connected, they are skipped and counted.
+type Coercer struct {
+	rules   []Coercion
+	side    conduit.Target
+	skipped uint64
+}
+
+// NewCoercer creates a new Coercer Conduit
+// with the given Coercions, which are applied in order.
+// Coercions with unknown or incompatible units are rejected.
+func NewCoercer(rules ...Coercion) (c *Coercer) {
+	if len(rules) == 0 {
+		return nil
+	}
+	for _, r := range rules {
+		if r.From == "" && r.To == "" {
+			continue
+		}
+		from, ok1 := units[r.From]
+		to, ok2 := units[r.To]
+		if !ok1 || !ok2 || from.kind != to.kind {
+			return nil
+		}
+	}
+	c = new(Coercer)
+	if c != nil {
+		c.rules = rules
+	}
+	return
+}
+
+// Skipped returns the number of invalid records skipped.
+func (c *Coercer) Skipped() uint64 {
+	return atomic.LoadUint64(&c.skipped)
+}
+
+// SideOutput is the pre-defined method that makes Coercer
+// a conduit.SideOutputter. Coercer has the side output "invalid".
+func (c *Coercer) SideOutput(name string, trg conduit.Target) {
+	if name == "invalid" {
+		c.side = trg
+	}
+}
+
+// Conduct is the pre-defined method that makes Coercer a Conduit.
+// Conduct terminates with an error if an item is not a record.
+func (c *Coercer) Conduct(src conduit.Source, trg conduit.Target) error {
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			trg <- inp
+			continue
+		}
+		var rec Record
+		switch x := inp.(type) {
+		case Record:
+			rec = x
+		case map[string]interface{}:
+			rec = x
+		default:
+			return errors.New(fmt.Sprintf("cannot coerce %T", inp))
+		}
+		out, errs := c.coerce(rec)
+		if len(errs) > 0 {
+			if c.side != nil {
+				c.side <- &InvalidRecord{rec, errs}
+			} else {
+				atomic.AddUint64(&c.skipped, 1)
+			}
+			continue
+		}
+		if _, ok := inp.(Record); ok {
+			trg <- out
+		} else {
+			trg <- map[string]interface{}(out)
+		}
+	}
+	return nil
+}
+
+// Converts a copy of rec
+func (c *Coercer) coerce(rec Record) (Record, []*FieldError) {
+	out := make(Record, len(rec))
+	for k, v := range rec {
+		out[k] = v
+	}
+	var errs []*FieldError
+	for _, r := range c.rules {
+		v, ok := out[r.Field]
+		if !ok {
+			if !r.Optional {
+				errs = append(errs, &FieldError{r.Field, nil, errors.New("missing")})
+			}
+			continue
+		}
+		x, err := r.convert(v)
+		if err != nil {
+			errs = append(errs, &FieldError{r.Field, v, err})
+			continue
+		}
+		out[r.Field] = x
+	}
+	return out, errs
+}
+
+// Converts a value according to the coercion
+func (r Coercion) convert(v interface{}) (interface{}, error) {
+	if r.Optional && (v == nil || v == "") {
+		return nil, nil
+	}
+	if r.From != "" || r.Factor != 0 {
+		f, err := toFloat(v)
+		if err != nil {
+			return nil, err
+		}
+		if r.From != "" {
+			from, to := units[r.From], units[r.To]
+			f = ((f+from.offset)*from.factor)/to.factor - to.offset
+		}
+		if r.Factor != 0 {
+			f *= r.Factor
+		}
+		v = f
+	}
+	switch r.Type {
+	case ColString:
+		switch x := v.(type) {
+		case string:
+			return x, nil
+		case time.Time:
+			return r.formatTime(x), nil
+		case float64:
+			return strconv.FormatFloat(x, 'f', -1, 64), nil
+		}
+		return fmt.Sprint(v), nil
+	case ColInt:
+		switch x := v.(type) {
+		case int64:
+			return x, nil
+		case time.Time:
+			if r.Layout == "unixmilli" {
+				return x.UnixNano() / 1e6, nil
+			}
+			return x.Unix(), nil
+		case string:
+			// exact for large integers
+			if i, err := strconv.ParseInt(strings.TrimSpace(x), 10, 64); err == nil {
+				return i, nil
+			}
+		}
+		f, err := toFloat(v)
+		if err != nil {
+			return nil, err
+		}
+		if f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+			return nil, errors.New(fmt.Sprintf("%v is not an integer", v))
+		}
+		return int64(f), nil
+	case ColFloat:
+		return toFloat(v)
+	case ColBool:
+		switch x := v.(type) {
+		case bool:
+			return x, nil
+		case string:
+			return strconv.ParseBool(strings.TrimSpace(x))
+		}
+		f, err := toFloat(v)
+		if err != nil {
+			return nil, err
+		}
+		return f != 0, nil
+	case ColTime:
+		return r.parseTime(v)
+	}
+	return nil, errors.New(fmt.Sprintf("unknown type %d", r.Type))
+}
+
+func (r Coercion) formatTime(t time.Time) string {
+	switch r.Layout {
+	case "unix":
+		return strconv.FormatInt(t.Unix(), 10)
+	case "unixmilli":
+		return strconv.FormatInt(t.UnixNano()/1e6, 10)
+	case "":
+		return t.Format(time.RFC3339)
+	}
+	return t.Format(r.Layout)
+}
+
+func (r Coercion) parseTime(v interface{}) (time.Time, error) {
+	if t, ok := v.(time.Time); ok {
+		return t, nil
+	}
+	switch r.Layout {
+	case "unix", "unixmilli":
+		f, err := toFloat(v)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if r.Layout == "unixmilli" {
+			f /= 1e3
+		}
+		sec, frac := math.Modf(f)
+		return time.Unix(int64(sec), int64(math.Round(frac*1e9))).UTC(), nil
+	}
+	s, ok := v.(string)
+	if !ok {
+		return time.Time{}, errors.New(fmt.Sprintf("cannot convert %T to time", v))
+	}
+	layout := r.Layout
+	if layout == "" {
+		layout = time.RFC3339
+	}
+	return time.Parse(layout, strings.TrimSpace(s))
+}
+
+// Converts numbers and numeric strings to float64
+func toFloat(v interface{}) (float64, error) {
+	switch x := v.(type) {
+	case float64:
+		return x, nil
+	case float32:
+		return float64(x), nil
+	case int:
+		return float64(x), nil
+	case int8:
+		return float64(x), nil
+	case int16:
+		return float64(x), nil
+	case int32:
+		return float64(x), nil
+	case int64:
+		return float64(x), nil
+	case uint:
+		return float64(x), nil
+	case uint8:
+		return float64(x), nil
+	case uint16:
+		return float64(x), nil
+	case uint32:
+		return float64(x), nil
+	case uint64:
+		return float64(x), nil
+	case string:
+		return strconv.ParseFloat(strings.TrimSpace(x), 64)
+	case fmt.Stringer:
+		return strconv.ParseFloat(x.String(), 64)
+	}
+	return 0, errors.New(fmt.Sprintf("cannot convert %T to number", v))
+}
@@ -0,0 +1,103 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+// Coercer:
+// - Fields are converted between types, layouts and units
+// - Records with invalid fields go to the side output with one error per field
+// - Without side output, invalid records are skipped and counted
+func TestCoercer(t *testing.T) {
+	if NewCoercer() != nil || NewCoercer(Coercion{Field: "x", From: "ms", To: "kg"}) != nil ||
+		NewCoercer(Coercion{Field: "x", From: "ms", To: "parsec"}) != nil {
+		t.Errorf("Coercer: invalid rules accepted")
+	}
+	rules := []Coercion{
+		{Field: "id", Type: ColInt},
+		{Field: "price", Type: ColFloat},
+		{Field: "active", Type: ColBool},
+		{Field: "day", Type: ColTime, Layout: "2006-01-02"},
+		{Field: "ts", Type: ColTime, Layout: "unixmilli"},
+		{Field: "latency", Type: ColFloat, From: "ms", To: "s"},
+		{Field: "temp", Type: ColFloat, From: "F", To: "C"},
+		{Field: "size", Type: ColInt, From: "KiB", To: "B"},
+		{Field: "pct", Type: ColFloat, Factor: 0.01},
+		{Field: "code", Type: ColString},
+		{Field: "note", Type: ColString, Optional: true},
+	}
+	items := []interface{}{
+		Record{"id": "9007199254740993", "price": "1.5", "active": "true", "day": "2024-03-04", "ts": 1709546400500.0,
+			"latency": 250, "temp": "212", "size": 2.0, "pct": "50", "code": 42.0, "note": ""},
+		&conduit.Barrier{},
+		map[string]interface{}{"id": 7.0, "price": json.Number("2"), "active": 0, "day": "2024-03-05", "ts": "0",
+			"latency": "1000", "temp": 32.0, "size": "1", "pct": 1, "code": "A", "extra": true},
+		Record{"id": 1.5, "price": "x", "active": true, "day": "04.03.2024", "ts": 0, "latency": 1, "temp": 0, "size": 1,
+			"pct": 1, "note": 1},
+	}
+	c := NewCoercer(rules...)
+	invalid := make(chan interface{}, 10)
+	c.SideOutput("invalid", invalid)
+	ac := &AnyConsumer{}
+	if err := conduit.NewChain(&AnyProducer{src: items}, []conduit.Conduit{c}, ac, small).Run(); err != nil {
+		t.Fatalf("Coercer failed: %v", err)
+	}
+	if len(ac.recvd) != 3 {
+		t.Fatalf("Coercer: received %v", ac.recvd)
+	}
+	r := ac.recvd[0].(Record)
+	if r["id"] != int64(9007199254740993) || r["price"] != 1.5 || r["active"] != true ||
+		!r["day"].(time.Time).Equal(time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC)) ||
+		!r["ts"].(time.Time).Equal(time.Date(2024, 3, 4, 10, 0, 0, 5e8, time.UTC)) ||
+		r["latency"] != 0.25 || math.Abs(r["temp"].(float64)-100) > 1e-9 || r["size"] != int64(2048) ||
+		r["pct"] != 0.5 || r["code"] != "42" || r["note"] != nil {
+		t.Errorf("Coercer: unexpected record %v", r)
+	}
+	if items[0].(Record)["id"] != "9007199254740993" {
+		t.Errorf("Coercer: input modified")
+	}
+	if !conduit.IsBarrier(ac.recvd[1]) {
+		t.Errorf("Coercer: barrier not forwarded")
+	}
+	m := ac.recvd[2].(map[string]interface{})
+	if m["id"] != int64(7) || m["price"] != 2.0 || m["active"] != false || m["ts"].(time.Time).Unix() != 0 ||
+		m["latency"] != 1.0 || math.Abs(m["temp"].(float64)) > 1e-9 || m["size"] != int64(1024) ||
+		m["code"] != "A" || m["extra"] != true {
+		t.Errorf("Coercer: unexpected map %v", m)
+	}
+	if len(invalid) != 1 {
+		t.Fatalf("Coercer: %d invalid records", len(invalid))
+	}
+	ir := (<-invalid).(*InvalidRecord)
+	var fields []string
+	for _, e := range ir.Errs {
+		fields = append(fields, e.Field)
+	}
+	if strings.Join(fields, ",") != "id,price,day,code" || ir.Record["id"] != 1.5 ||
+		!strings.Contains(ir.Error(), "field 'id' (1.5): 1.5 is not an integer") ||
+		!strings.Contains(ir.Error(), "field 'code' (<nil>): missing") {
+		t.Errorf("Coercer: unexpected invalid record %v: %v", fields, ir)
+	}
+
+	c = NewCoercer(Coercion{Field: "t", Type: ColString, Layout: "unix"}, Coercion{Field: "u", Type: ColInt})
+	ac = &AnyConsumer{}
+	tm := time.Date(2024, 3, 4, 10, 0, 0, 0, time.UTC)
+	items = []interface{}{Record{"t": tm, "u": tm}, Record{"t": 1}, "no record"}
+	chn := conduit.NewChain(&AnyProducer{src: items}, []conduit.Conduit{c}, ac, small)
+	if err := chn.Run(); err == nil || !strings.Contains(fmt.Sprint(chn.Errs), "cannot coerce string") {
+		t.Errorf("Coercer: expected error: %v", chn.Errs)
+	}
+	if len(ac.recvd) != 1 || ac.recvd[0].(Record)["t"] != "1709546400" || ac.recvd[0].(Record)["u"] != int64(1709546400) {
+		t.Errorf("Coercer: received %v", ac.recvd)
+	}
+	if c.Skipped() != 1 {
+		t.Errorf("Coercer: %d skipped", c.Skipped())
+	}
+}
@@ -0,0 +1,244 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/toschoo/conduit"
+)
+
+// Compression is a compression format
+// used by Compressor and Decompressor.
+// Gzip, Zlib and Flate are provided; other formats,
+// e.g. zstd or snappy from third-party packages,
+// can be used via CompressionFuncs.
+type Compression interface {
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+// CompressionFuncs implements Compression with ordinary functions.
+type CompressionFuncs struct {
+	Writer func(w io.Writer) (io.WriteCloser, error)
+	Reader func(r io.Reader) (io.ReadCloser, error)
+}
+
+// NewWriter calls f.Writer.
+func (f CompressionFuncs) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return f.Writer(w)
+}
+
+// NewReader calls f.Reader.
+func (f CompressionFuncs) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return f.Reader(r)
+}
+
+// Gzip returns the gzip Compression
+// with the given level (e.g. gzip.DefaultCompression).
+func Gzip(level int) Compression {
+	return CompressionFuncs{
+		Writer: func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriterLevel(w, level)
+		},
+		Reader: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	}
+}
+
+// Zlib returns the zlib Compression with the given level.
+func Zlib(level int) Compression {
+	return CompressionFuncs{
+		Writer: func(w io.Writer) (io.WriteCloser, error) {
+			return zlib.NewWriterLevel(w, level)
+		},
+		Reader: func(r io.Reader) (io.ReadCloser, error) {
+			return zlib.NewReader(r)
+		},
+	}
+}
+
+// Flate returns the raw deflate Compression with the given level.
+func Flate(level int) Compression {
+	return CompressionFuncs{
+		Writer: func(w io.Writer) (io.WriteCloser, error) {
+			return flate.NewWriter(w, level)
+		},
+		Reader: func(r io.Reader) (io.ReadCloser, error) {
+			return flate.NewReader(r), nil
+		},
+	}
+}
+
+// blockReader is an io.Reader on a stream of []byte blocks;
+// barriers are forwarded to trg when they are encountered.
+type blockReader struct {
+	src conduit.Source
+	trg conduit.Target
+	buf []byte
+}
+
+func (br *blockReader) Read(p []byte) (int, error) {
+	for len(br.buf) == 0 {
+		inp, ok := <-br.src
+		if !ok {
+			return 0, io.EOF
+		}
+		if conduit.IsBarrier(inp) {
+			br.trg <- inp
+			continue
+		}
+		buf, ok := inp.([]byte)
+		if !ok {
+			return 0, errors.New(fmt.Sprintf("cannot read %T", inp))
+		}
+		br.buf = buf
+	}
+	n := copy(p, br.buf)
+	br.buf = br.buf[n:]
+	return n, nil
+}
+
+// Compressor is a Conduit that compresses a stream of []byte blocks.
+// The stream is compressed as a whole, i.e. the outgoing blocks
+// do not correspond to incoming blocks and only their concatenation
+// is valid compressed data.
+// At barriers, the compressor is flushed
+// (if the format supports flushing), so that all data
+// received so far can be decompressed.
+// The state of the compression stream, however,
+// is not included in checkpoints.
+type Compressor struct {
+	c Compression
+}
+
+// NewCompressor creates a new Compressor Conduit.
+func NewCompressor(c Compression) (cmp *Compressor) {
+	if c == nil {
+		return nil
+	}
+	cmp = new(Compressor)
+	if cmp != nil {
+		cmp.c = c
+	}
+	return
+}
+
+// Conduct is the pre-defined method that makes Compressor a Conduit.
+func (cmp *Compressor) Conduct(src conduit.Source, trg conduit.Target) error {
+	var buf bytes.Buffer
+	w, err := cmp.c.NewWriter(&buf)
+	if err != nil {
+		return err
+	}
+	send := func() {
+		if buf.Len() > 0 {
+			trg <- append([]byte(nil), buf.Bytes()...)
+			buf.Reset()
+		}
+	}
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			if f, ok := w.(interface{ Flush() error }); ok {
+				err = f.Flush()
+				if err != nil {
+					return err
+				}
+			}
+			send()
+			trg <- inp
+			continue
+		}
+		data, ok := inp.([]byte)
+		if !ok {
+			return errors.New(fmt.Sprintf("cannot compress %T", inp))
+		}
+		_, err = w.Write(data)
+		if err != nil {
+			return err
+		}
+		send()
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+	send()
+	return nil
+}
+
+// Volatile is the pre-defined method that makes Compressor a conduit.Volatile:
+// the state of the compression stream is not included in checkpoints.
+func (cmp *Compressor) Volatile() bool {
+	return true
+}
+
+// Decompressor is a Conduit that decompresses a stream of []byte blocks,
+// e.g. a gzip file read by Reader, and sends the data
+// down the chain in blocks of up to 8KiB.
+// Concatenated compressed streams (like multi-member gzip files)
+// are decompressed one after the other.
+// Note that barriers are forwarded when they are read,
+// possibly ahead of data buffered in the decompressor.
+type Decompressor struct {
+	c  Compression
+	sz int
+}
+
+// NewDecompressor creates a new Decompressor Conduit.
+func NewDecompressor(c Compression) (dec *Decompressor) {
+	if c == nil {
+		return nil
+	}
+	dec = new(Decompressor)
+	if dec != nil {
+		dec.c = c
+		dec.sz = 8192
+	}
+	return
+}
+
+// Conduct is the pre-defined method that makes Decompressor a Conduit.
+// Conduct terminates with an error if the data are corrupted.
+func (dec *Decompressor) Conduct(src conduit.Source, trg conduit.Target) error {
+	in := bufio.NewReader(&blockReader{src: src, trg: trg})
+	for {
+		_, err := in.Peek(1)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		r, err := dec.c.NewReader(in)
+		if err != nil {
+			return err
+		}
+		for {
+			buf := make([]byte, dec.sz)
+			n, err := r.Read(buf)
+			if n > 0 {
+				trg <- buf[:n]
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+		}
+		r.Close()
+	}
+}
+
+// Volatile is the pre-defined method that makes Decompressor a conduit.Volatile:
+// the state of the decompression stream is not included in checkpoints.
+func (dec *Decompressor) Volatile() bool {
+	return true
+}
@@ -0,0 +1,100 @@
+package utils
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/toschoo/conduit"
+)
+
+// Compression:
+// - Text is compressed and decompressed in one chain without errors
+// - The result equals the original
+// - for gzip, zlib and flate
+func TestCompressChain(t *testing.T) {
+	cs := map[string]Compression{
+		"gzip":  Gzip(gzip.DefaultCompression),
+		"zlib":  Zlib(gzip.BestSpeed),
+		"flate": Flate(gzip.BestCompression),
+	}
+	for name, c := range cs {
+		for i := 0; i < numOfTests; i++ {
+			err := testCompressChain(c, i*1000)
+			if err != nil {
+				m := fmt.Sprintf("CompressChain failed (%s): %v", name, err)
+				t.Error(m)
+			}
+		}
+	}
+}
+
+func testCompressChain(c Compression, n int) error {
+
+	var text strings.Builder
+	for i := 0; text.Len() < n; i++ {
+		fmt.Fprintf(&text, "line %d\n", i)
+	}
+
+	var out bytes.Buffer
+	pipe := []conduit.Conduit{NewCompressor(c), new(Rechunk), NewDecompressor(c)}
+	chn := conduit.NewChain(NewReader(strings.NewReader(text.String())), pipe, NewTextPrinter(&out), small)
+	err := chn.Run()
+	if err != nil {
+		m := fmt.Sprintf("error on running chain: %v", chn.Errs)
+		return errors.New(m)
+	}
+	if out.String() != text.String() {
+		return errors.New("Received data differ from original!")
+	}
+	return nil
+}
+
+// Compressed files:
+// - Output of the compressor is a valid gzip file
+// - Concatenated gzip members are decompressed completely
+// - Corrupted data are reported
+func TestCompressFile(t *testing.T) {
+	var gz bytes.Buffer
+	pipe := []conduit.Conduit{NewCompressor(Gzip(gzip.DefaultCompression))}
+	chn := conduit.NewChain(NewReader(strings.NewReader("hello ")), pipe, NewTextPrinter(&gz), small)
+	err := chn.Run()
+	if err != nil {
+		t.Fatalf("CompressFile failed: %v", chn.Errs)
+	}
+	r, err := gzip.NewReader(bytes.NewReader(gz.Bytes()))
+	if err != nil {
+		t.Fatalf("CompressFile: invalid gzip: %v", err)
+	}
+	buf, _ := ioutil.ReadAll(r)
+	if string(buf) != "hello " {
+		t.Errorf("CompressFile: expected 'hello ', have '%s'", buf)
+	}
+
+	var member bytes.Buffer
+	w := gzip.NewWriter(&member)
+	w.Write([]byte("world"))
+	w.Close()
+	data := append(gz.Bytes(), member.Bytes()...)
+
+	var out bytes.Buffer
+	pipe = []conduit.Conduit{NewDecompressor(Gzip(0))}
+	chn = conduit.NewChain(NewReader(bytes.NewReader(data)), pipe, NewTextPrinter(&out), small)
+	err = chn.Run()
+	if err != nil {
+		t.Fatalf("CompressFile failed: %v", chn.Errs)
+	}
+	if out.String() != "hello world" {
+		t.Errorf("CompressFile: expected 'hello world', have '%s'", out.String())
+	}
+
+	data = data[:len(data)-5]
+	chn = conduit.NewChain(NewReader(bytes.NewReader(data)), pipe, NewTextPrinter(new(bytes.Buffer)), small)
+	if chn.Run() == nil {
+		t.Errorf("CompressFile: corrupted data not reported")
+	}
+}
@@ -0,0 +1,117 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/gob"
+	"sort"
+
+	"github.com/toschoo/conduit"
+)
+
+// KeyCount is the number of occurrences of a key.
+type KeyCount struct {
+	Key   string
+	Count uint64
+}
+
+// KeyCounter is a Consumer that counts the occurrences
+// of the keys of incoming items, e.g. of words
+// produced by a Tokenizer. The counts are available
+// through Counts and Top and through Result:
+// a map[string]uint64 or, if SetTopN was called,
+// the top n keys as []KeyCount.
+// The counts are included in checkpoints (see conduit.Checkpointer).
+type KeyCounter struct {
+	kf       KeyFunc
+	top      int
+	counts   map[string]uint64
+	restored bool // counts were restored from a checkpoint
+}
+
+// NewKeyCounter creates a new KeyCounter Consumer.
+// The keys of items are obtained using kf (see KeyFunc and Keyed).
+func NewKeyCounter(kf KeyFunc) (kc *KeyCounter) {
+	kc = new(KeyCounter)
+	if kc != nil {
+		kc.kf = kf
+		kc.counts = make(map[string]uint64)
+	}
+	return
+}
+
+// SetTopN makes Result return the n most frequent keys.
+func (kc *KeyCounter) SetTopN(n int) *KeyCounter {
+	kc.top = n
+	return kc
+}
+
+// Consume is the pre-defined method that makes KeyCounter a Consumer.
+func (kc *KeyCounter) Consume(src conduit.Source) error {
+	if !kc.restored {
+		kc.counts = make(map[string]uint64)
+	}
+	kc.restored = false
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			continue
+		}
+		kc.counts[keyOf(kc.kf, inp)]++
+	}
+	return nil
+}
+
+// Counts returns the number of occurrences per key.
+func (kc *KeyCounter) Counts() map[string]uint64 {
+	return kc.counts
+}
+
+// Top returns the n most frequent keys (all keys if n <= 0)
+// ordered by count (descending) and key.
+func (kc *KeyCounter) Top(n int) []KeyCount {
+	kcs := make([]KeyCount, 0, len(kc.counts))
+	for k, c := range kc.counts {
+		kcs = append(kcs, KeyCount{k, c})
+	}
+	sort.Slice(kcs, func(i, j int) bool {
+		if kcs[i].Count != kcs[j].Count {
+			return kcs[i].Count > kcs[j].Count
+		}
+		return kcs[i].Key < kcs[j].Key
+	})
+	if n > 0 && n < len(kcs) {
+		kcs = kcs[:n]
+	}
+	return kcs
+}
+
+// Result returns the counts.
+func (kc *KeyCounter) Result() interface{} {
+	if kc.top > 0 {
+		return kc.Top(kc.top)
+	}
+	return kc.Counts()
+}
+
+// Snapshot is the pre-defined method that makes KeyCounter
+// a conduit.Checkpointer.
+func (kc *KeyCounter) Snapshot() ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(kc.counts)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Restore is the pre-defined method that makes KeyCounter
+// a conduit.Checkpointer.
+func (kc *KeyCounter) Restore(b []byte) error {
+	counts := make(map[string]uint64)
+	err := gob.NewDecoder(bytes.NewReader(b)).Decode(&counts)
+	if err != nil {
+		return err
+	}
+	kc.counts = counts
+	kc.restored = true
+	return nil
+}
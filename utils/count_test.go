@@ -0,0 +1,57 @@
+package utils
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/toschoo/conduit"
+)
+
+// Key counter:
+// - Words of a text are counted
+// - The top n keys are ordered by count and key
+// - Keys are obtained with the key function
+// - Restored counts are continued
+func TestKeyCounter(t *testing.T) {
+	text := []interface{}{"the quick brown fox", &conduit.Barrier{}, "jumps over the lazy dog", "The end"}
+	kc := NewKeyCounter(nil)
+	pipe := []conduit.Conduit{NewTokenizer().Lower()}
+	if err := conduit.NewChain(&AnyProducer{src: text}, pipe, kc, small).Run(); err != nil {
+		t.Fatalf("KeyCounter failed: %v", err)
+	}
+	var r Result = kc
+	counts := r.Result().(map[string]uint64)
+	if len(counts) != 9 || counts["the"] != 3 || counts["fox"] != 1 {
+		t.Errorf("KeyCounter: unexpected counts %v", counts)
+	}
+	if s := fmt.Sprint(kc.Top(3)); s != "[{the 3} {brown 1} {dog 1}]" {
+		t.Errorf("KeyCounter: unexpected top keys %s", s)
+	}
+	if len(kc.Top(0)) != 9 {
+		t.Errorf("KeyCounter: unexpected keys %v", kc.Top(0))
+	}
+
+	items := []interface{}{Record{"status": 200}, Record{"status": 404}, Record{"status": 200}}
+	kc = NewKeyCounter(func(v interface{}) string { return fmt.Sprint(v.(Record)["status"]) }).SetTopN(1)
+	if err := conduit.NewChain(&AnyProducer{src: items}, nil, kc, small).Run(); err != nil {
+		t.Fatalf("KeyCounter failed: %v", err)
+	}
+	if s := fmt.Sprint(kc.Result()); s != "[{200 2}]" {
+		t.Errorf("KeyCounter: unexpected result %s", s)
+	}
+
+	b, err := kc.Snapshot()
+	if err != nil {
+		t.Fatalf("KeyCounter: cannot snapshot: %v", err)
+	}
+	kc2 := NewKeyCounter(kc.kf)
+	if err = kc2.Restore(b); err != nil {
+		t.Fatalf("KeyCounter: cannot restore: %v", err)
+	}
+	if err := conduit.NewChain(&AnyProducer{src: items}, nil, kc2, small).Run(); err != nil {
+		t.Fatalf("KeyCounter failed: %v", err)
+	}
+	if s := fmt.Sprint(kc2.Top(0)); s != "[{200 4} {404 2}]" {
+		t.Errorf("KeyCounter: unexpected restored counts %s", s)
+	}
+}
@@ -0,0 +1,472 @@
+package utils
+
+import (
+	"encoding"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/toschoo/conduit"
+)
+
+// CSV is a Producer that feeds data
+// read from a CSV-encoded source
+// line by line into the processing chain.
+// CSV releases data as string slices,
+// each slice representing
+// one line in the CSV source.
+// With Header or Into, the first line is read as header
+// and lines are released as map[string]string
+// or as user structs instead.
+type CSV struct {
+	conduit.Cancelable
+	Rd      *csv.Reader
+	header  bool
+	new     func() interface{}
+	policy  MalformedPolicy
+	side    conduit.Target
+	skipped uint64
+}
+
+// CSVOption configures the CSV dialect of CSV and CSW.
+type CSVOption func(*csvDialect)
+
+type csvDialect struct {
+	comma   rune
+	comment rune
+	lazy    bool
+	trim    bool
+	fields  int
+	crlf    bool
+	policy  MalformedPolicy
+}
+
+// CSVComma sets the field separator (default ',').
+func CSVComma(r rune) CSVOption {
+	return func(d *csvDialect) { d.comma = r }
+}
+
+// CSVComment sets the character starting comment lines (reader only).
+func CSVComment(r rune) CSVOption {
+	return func(d *csvDialect) { d.comment = r }
+}
+
+// CSVLazyQuotes tolerates quotes in unquoted
+// and non-doubled quotes in quoted fields (reader only).
+func CSVLazyQuotes() CSVOption {
+	return func(d *csvDialect) { d.lazy = true }
+}
+
+// CSVTrimLeadingSpace ignores leading white space in fields (reader only).
+func CSVTrimLeadingSpace() CSVOption {
+	return func(d *csvDialect) { d.trim = true }
+}
+
+// CSVFieldsPerRecord sets the number of fields per line (reader only):
+// 0 requires all lines to have as many fields as the first,
+// a negative number allows any number of fields.
+func CSVFieldsPerRecord(n int) CSVOption {
+	return func(d *csvDialect) { d.fields = n }
+}
+
+// CSVUseCRLF ends lines with \r\n (writer only).
+func CSVUseCRLF() CSVOption {
+	return func(d *csvDialect) { d.crlf = true }
+}
+
+// CSVMalformed sets the policy for lines that cannot be parsed
+// or converted (reader only, default MalformedError).
+// Malformed lines are reported as BadRecord with the line number,
+// the fields read (if any) joined by the separator and the error.
+func CSVMalformed(policy MalformedPolicy) CSVOption {
+	return func(d *csvDialect) { d.policy = policy }
+}
+
+// Applies options to the default dialect
+func newCSVDialect(opts []CSVOption) *csvDialect {
+	d := &csvDialect{comma: ',', policy: MalformedError}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
+}
+
+// Produce is the pre-defined method that
+// makes CSV a Producer.
+// Produce terminates with an error if a field
+// cannot be converted to the type of its struct field.
+func (p *CSV) Produce(trg conduit.Target) error {
+	var names []string
+	if p.header {
+		rec, err := p.Rd.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		names = append([]string(nil), rec...)
+	}
+	for !p.Canceled() {
+		rec, err := p.Rd.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			pe, ok := err.(*csv.ParseError)
+			if !ok {
+				return err
+			}
+			err = p.malformed(pe.StartLine, rec, pe.Err)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if !p.header {
+			trg <- rec
+			continue
+		}
+		if p.new == nil {
+			trg <- csvMap(names, rec)
+			continue
+		}
+		v := p.new()
+		err = csvFill(names, rec, v)
+		if err != nil {
+			line, _ := p.Rd.FieldPos(0)
+			err = p.malformed(line, rec, err)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		trg <- v
+	}
+	return nil
+}
+
+// Handles a malformed line according to the policy
+func (p *CSV) malformed(line int, rec []string, err error) error {
+	switch p.policy {
+	case MalformedError:
+		return errors.New(fmt.Sprintf("line %d: %v", line, err))
+	case MalformedSide:
+		if p.side != nil {
+			data := []byte(strings.Join(rec, string(p.Rd.Comma)))
+			p.side <- BadRecord{line, data, err}
+			return nil
+		}
+	}
+	atomic.AddUint64(&p.skipped, 1)
+	return nil
+}
+
+// Skipped returns the number of malformed lines skipped.
+func (p *CSV) Skipped() uint64 {
+	return atomic.LoadUint64(&p.skipped)
+}
+
+// SideOutput is the pre-defined method that makes CSV
+// a conduit.SideOutputter. CSV has the side output "malformed".
+func (p *CSV) SideOutput(name string, trg conduit.Target) {
+	if name == "malformed" {
+		p.side = trg
+	}
+}
+
+// NewCSV creates a new CSV Producer
+// using some kind of io.Reader.
+// By default, it reads RFC 4180 CSV
+// and terminates with an error on malformed lines.
+func NewCSV(r io.Reader, opts ...CSVOption) (p *CSV) {
+	p = new(CSV)
+	if p != nil {
+		d := newCSVDialect(opts)
+		p.Rd = csv.NewReader(r)
+		p.Rd.Comma = d.comma
+		p.Rd.Comment = d.comment
+		p.Rd.LazyQuotes = d.lazy
+		p.Rd.TrimLeadingSpace = d.trim
+		p.Rd.FieldsPerRecord = d.fields
+		p.policy = d.policy
+	}
+	return
+}
+
+// Header makes CSV read the first line as header
+// and release lines as map[string]string
+// from column names to fields.
+func (p *CSV) Header() *CSV {
+	p.header = true
+	return p
+}
+
+// Into makes CSV read the first line as header
+// and release lines as the result of newValue,
+// a pointer to a struct whose fields are filled
+// from the columns named in their csv tag
+// (e.g. `csv:"name"`) or, without tag, by their name.
+// Columns without field are ignored.
+// Fields may be strings, bools, numbers
+// or implement encoding.TextUnmarshaler.
+func (p *CSV) Into(newValue func() interface{}) *CSV {
+	p.header = true
+	p.new = newValue
+	return p
+}
+
+// CSW is a Consumer that feeds data
+// read from a CSV-encoded source
+// line by line into the processing chain.
+// CSW receives data as string slices,
+// each slice representing
+// one line in the CSV target.
+// With a header, CSW accepts map[string]string
+// and structs (or pointers to structs) as well,
+// which are written in the order of the header
+// (see CSV.Into for the mapping of fields).
+type CSW struct {
+	Wt     *csv.Writer
+	header bool
+	names  []string
+}
+
+// Consume is the pre-defined method that
+// makes CSW a Consumer.
+// Consume terminates with an error if an item
+// cannot be converted to a line.
+func (csw *CSW) Consume(src conduit.Source) error {
+	wrote := false
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			csw.Wt.Flush()
+			err := csw.Wt.Error()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if csw.header && !wrote {
+			if csw.names == nil {
+				csw.names = csvNames(inp)
+			}
+			if csw.names != nil {
+				csw.Wt.Write(csw.names)
+			}
+			wrote = true
+		}
+		line, err := csvLine(csw.names, inp)
+		if err != nil {
+			return err
+		}
+		csw.Wt.Write(line)
+	}
+	csw.Wt.Flush()
+	return csw.Wt.Error()
+}
+
+// NewCSW creates a new CSV Consumer
+// using some kind of io.Writer.
+func NewCSW(stream io.Writer, opts ...CSVOption) *CSW {
+	d := newCSVDialect(opts)
+	csw := new(CSW)
+	csw.Wt = csv.NewWriter(stream)
+	csw.Wt.Comma = d.comma
+	csw.Wt.UseCRLF = d.crlf
+	return csw
+}
+
+// Header makes CSW write a header line with the given column names.
+// Without names, they are derived from the first item,
+// i.e. the fields of a struct or the sorted keys of a map.
+func (csw *CSW) Header(names ...string) *CSW {
+	csw.header = true
+	if len(names) > 0 {
+		csw.names = names
+	}
+	return csw
+}
+
+// Maps column names to fields
+func csvMap(names []string, rec []string) map[string]string {
+	m := make(map[string]string, len(names))
+	for i, name := range names {
+		if i < len(rec) {
+			m[name] = rec[i]
+		}
+	}
+	return m
+}
+
+// Returns the column name of a struct field or "" if it is ignored
+func csvName(f reflect.StructField) string {
+	if f.PkgPath != "" {
+		return ""
+	}
+	tag := f.Tag.Get("csv")
+	if tag == "-" {
+		return ""
+	}
+	if tag != "" {
+		return tag
+	}
+	return f.Name
+}
+
+// Returns the struct value v refers to
+func csvStruct(v interface{}) (reflect.Value, bool) {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+	return rv, rv.Kind() == reflect.Struct
+}
+
+// Fills the struct v points to from a line
+func csvFill(names []string, rec []string, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		return errors.New(fmt.Sprintf("cannot fill %T", v))
+	}
+	rv = rv.Elem()
+	cols := make(map[string]int, len(names))
+	for i, name := range names {
+		cols[name] = i
+	}
+	t := rv.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := csvName(t.Field(i))
+		if name == "" {
+			continue
+		}
+		c, ok := cols[name]
+		if !ok || c >= len(rec) {
+			continue
+		}
+		err := csvSet(rv.Field(i), rec[c])
+		if err != nil {
+			return errors.New(fmt.Sprintf("column '%s': %v", name, err))
+		}
+	}
+	return nil
+}
+
+// Converts s to the type of the field f
+func csvSet(f reflect.Value, s string) error {
+	if u, ok := f.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(s))
+	}
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		f.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, f.Type().Bits())
+		if err != nil {
+			return err
+		}
+		f.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, f.Type().Bits())
+		if err != nil {
+			return err
+		}
+		f.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		x, err := strconv.ParseFloat(s, f.Type().Bits())
+		if err != nil {
+			return err
+		}
+		f.SetFloat(x)
+	default:
+		return errors.New(fmt.Sprintf("unsupported field type %s", f.Type()))
+	}
+	return nil
+}
+
+// Derives column names from an item
+func csvNames(inp interface{}) []string {
+	if m, ok := inp.(map[string]string); ok {
+		names := make([]string, 0, len(m))
+		for k := range m {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		return names
+	}
+	if rv, ok := csvStruct(inp); ok {
+		var names []string
+		t := rv.Type()
+		for i := 0; i < t.NumField(); i++ {
+			if name := csvName(t.Field(i)); name != "" {
+				names = append(names, name)
+			}
+		}
+		return names
+	}
+	return nil
+}
+
+// Converts an item to a line
+func csvLine(names []string, inp interface{}) ([]string, error) {
+	if line, ok := inp.([]string); ok {
+		return line, nil
+	}
+	if names == nil {
+		return nil, errors.New(fmt.Sprintf("cannot write %T without header", inp))
+	}
+	line := make([]string, len(names))
+	if m, ok := inp.(map[string]string); ok {
+		for i, name := range names {
+			line[i] = m[name]
+		}
+		return line, nil
+	}
+	rv, ok := csvStruct(inp)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("cannot write %T", inp))
+	}
+	cols := make(map[string]int, len(names))
+	for i, name := range names {
+		cols[name] = i
+	}
+	t := rv.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := csvName(t.Field(i))
+		c, ok := cols[name]
+		if name == "" || !ok {
+			continue
+		}
+		line[c] = csvFormat(rv.Field(i))
+	}
+	return line, nil
+}
+
+// Converts a field to text
+func csvFormat(f reflect.Value) string {
+	if m, ok := f.Interface().(encoding.TextMarshaler); ok {
+		buf, err := m.MarshalText()
+		if err == nil {
+			return string(buf)
+		}
+	}
+	switch f.Kind() {
+	case reflect.String:
+		return f.String()
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(f.Float(), 'g', -1, f.Type().Bits())
+	}
+	return fmt.Sprint(f.Interface())
+}
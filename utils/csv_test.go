@@ -0,0 +1,221 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+type Person struct {
+	Name   string    `csv:"name"`
+	Age    int       `csv:"age"`
+	Score  float64   `csv:"score"`
+	Member bool      `csv:"member"`
+	Since  time.Time `csv:"since"`
+	Note   string    `csv:"-"`
+}
+
+func newPerson() interface{} {
+	return new(Person)
+}
+
+func makePersons(n int) []interface{} {
+	ps := make([]interface{}, n)
+	for i := range ps {
+		ps[i] = &Person{
+			Name:   fmt.Sprintf("person %d", i),
+			Age:    i,
+			Score:  float64(i) / 4,
+			Member: i%2 == 0,
+			Since:  time.Date(2000+i, 1, 2, 3, 4, 5, 0, time.UTC),
+		}
+	}
+	return ps
+}
+
+// CSV with header:
+// - Structs are written with header and read back into structs
+// - The header is derived from the struct tags
+func TestCSVStructChain(t *testing.T) {
+	for i := 0; i < numOfTests; i++ {
+		err := testCSVStructChain(i)
+		if err != nil {
+			m := fmt.Sprintf("CSVStructChain failed: %v", err)
+			t.Error(m)
+		}
+	}
+}
+
+func testCSVStructChain(n int) error {
+
+	persons := makePersons(n)
+
+	var buf bytes.Buffer
+	chn := conduit.NewChain(&AnyProducer{persons}, nil, NewCSW(&buf).Header(), small)
+	err := chn.Run()
+	if err != nil {
+		m := fmt.Sprintf("error on writing: %v", chn.Errs)
+		return errors.New(m)
+	}
+	if n > 0 && !strings.HasPrefix(buf.String(), "name,age,score,member,since\n") {
+		m := fmt.Sprintf("unexpected header: %s", strings.SplitN(buf.String(), "\n", 2)[0])
+		return errors.New(m)
+	}
+
+	c := new(AnyConsumer)
+	chn = conduit.NewChain(NewCSV(&buf).Into(newPerson), nil, c, small)
+	err = chn.Run()
+	if err != nil {
+		m := fmt.Sprintf("error on reading: %v", chn.Errs)
+		return errors.New(m)
+	}
+	if len(c.recvd) != n {
+		m := fmt.Sprintf("expected %d items, have %d", n, len(c.recvd))
+		return errors.New(m)
+	}
+	for i, v := range c.recvd {
+		if !reflect.DeepEqual(v, persons[i]) {
+			return errors.New("Received values differ from original!")
+		}
+	}
+	return nil
+}
+
+// CSV with header:
+// - Lines are read as maps and written in the order of a given header
+// - Fields that cannot be converted are reported with their line
+func TestCSVMapChain(t *testing.T) {
+	in := "a,b,c\n1,2,3\n4,5,6\n"
+	c := new(AnyConsumer)
+	chn := conduit.NewChain(NewCSV(strings.NewReader(in)).Header(), nil, c, small)
+	err := chn.Run()
+	if err != nil {
+		t.Fatalf("CSVMapChain failed on reading: %v", chn.Errs)
+	}
+	want := []interface{}{
+		map[string]string{"a": "1", "b": "2", "c": "3"},
+		map[string]string{"a": "4", "b": "5", "c": "6"},
+	}
+	if !reflect.DeepEqual(c.recvd, want) {
+		t.Errorf("CSVMapChain: expected %v, have %v", want, c.recvd)
+	}
+
+	var buf bytes.Buffer
+	chn = conduit.NewChain(&AnyProducer{c.recvd}, nil, NewCSW(&buf).Header("c", "a"), small)
+	err = chn.Run()
+	if err != nil {
+		t.Fatalf("CSVMapChain failed on writing: %v", chn.Errs)
+	}
+	if buf.String() != "c,a\n3,1\n6,4\n" {
+		t.Errorf("CSVMapChain: unexpected output: %q", buf.String())
+	}
+
+	in = "name,age\nalice,30\nbob,old\n"
+	chn = conduit.NewChain(NewCSV(strings.NewReader(in)).Into(newPerson), nil, new(AnyConsumer), small)
+	if chn.Run() == nil || !strings.Contains(chn.Errs[0].Error(), "line 3") {
+		t.Errorf("CSVMapChain: conversion error not reported: %v", chn.Errs)
+	}
+}
+
+// CSV dialects:
+// - Semicolon-separated lines with comments and spaces are read
+// - Lines are written with semicolons and CRLF
+func TestCSVDialect(t *testing.T) {
+	in := "# comment\na; b;\"c\"\n1; 2; 3\n"
+	c := new(AnyConsumer)
+	p := NewCSV(strings.NewReader(in), CSVComma(';'), CSVComment('#'), CSVTrimLeadingSpace())
+	chn := conduit.NewChain(p, nil, c, small)
+	err := chn.Run()
+	if err != nil {
+		t.Fatalf("CSVDialect failed on reading: %v", chn.Errs)
+	}
+	want := []interface{}{[]string{"a", "b", "c"}, []string{"1", "2", "3"}}
+	if !reflect.DeepEqual(c.recvd, want) {
+		t.Errorf("CSVDialect: expected %v, have %v", want, c.recvd)
+	}
+
+	var buf bytes.Buffer
+	chn = conduit.NewChain(&AnyProducer{want}, nil, NewCSW(&buf, CSVComma(';'), CSVUseCRLF()), small)
+	err = chn.Run()
+	if err != nil {
+		t.Fatalf("CSVDialect failed on writing: %v", chn.Errs)
+	}
+	if buf.String() != "a;b;c\r\n1;2;3\r\n" {
+		t.Errorf("CSVDialect: unexpected output: %q", buf.String())
+	}
+}
+
+// CSV malformed lines:
+// - are reported by default
+// - are skipped and counted with MalformedSkip
+// - are sent to the side output with MalformedSide
+// - lazy quotes and variable field numbers are tolerated on request
+func TestCSVMalformed(t *testing.T) {
+	in := "a,b\n1,2\n3\n4,\"5\n6,7\nx\"y,8\n"
+
+	chn := conduit.NewChain(NewCSV(strings.NewReader(in)), nil, new(AnyConsumer), small)
+	if chn.Run() == nil {
+		t.Errorf("CSVMalformed: malformed line not reported")
+	}
+
+	in = "a,b\n1,2\n3\n4,5\nx\"y,8\n6,7\n"
+	p := NewCSV(strings.NewReader(in), CSVMalformed(MalformedSkip))
+	c := new(AnyConsumer)
+	chn = conduit.NewChain(p, nil, c, small)
+	err := chn.Run()
+	if err != nil {
+		t.Fatalf("CSVMalformed failed: %v", chn.Errs)
+	}
+	if len(c.recvd) != 4 || p.Skipped() != 2 {
+		t.Errorf("CSVMalformed: expected 4 lines and 2 skipped, have %d and %d", len(c.recvd), p.Skipped())
+	}
+
+	p = NewCSV(strings.NewReader(in), CSVMalformed(MalformedSide))
+	side := new(AnyConsumer)
+	chn = conduit.NewChain(p, nil, new(AnyConsumer), small)
+	err = chn.AddSide(p, "malformed", side)
+	if err != nil {
+		t.Fatalf("CSVMalformed: cannot add side: %v", err)
+	}
+	err = chn.Run()
+	if err != nil {
+		t.Fatalf("CSVMalformed failed: %v", chn.Errs)
+	}
+	if len(side.recvd) != 2 {
+		t.Fatalf("CSVMalformed: expected 2 bad records, have %d", len(side.recvd))
+	}
+	bad := side.recvd[0].(BadRecord)
+	if bad.Num != 3 || string(bad.Data) != "3" || bad.Err == nil {
+		t.Errorf("CSVMalformed: unexpected bad record %v", bad)
+	}
+
+	p = NewCSV(strings.NewReader(in), CSVLazyQuotes(), CSVFieldsPerRecord(-1))
+	c = new(AnyConsumer)
+	chn = conduit.NewChain(p, nil, c, small)
+	err = chn.Run()
+	if err != nil {
+		t.Fatalf("CSVMalformed failed: %v", chn.Errs)
+	}
+	if len(c.recvd) != 6 {
+		t.Errorf("CSVMalformed: expected 6 lines, have %d", len(c.recvd))
+	}
+}
+
+// CSV barrier:
+// - Lines preceding a barrier are flushed at the barrier
+func TestCSVBarrier(t *testing.T) {
+	w := new(chunkWriter)
+	err := consumeWithBarrier(NewCSW(w), []string{"a", "b"}, []string{"c", "d"})
+	if err != nil {
+		t.Fatalf("CSVBarrier failed: %v", err)
+	}
+	if len(w.chunks) != 2 || w.chunks[0] != "a,b\n" {
+		t.Errorf("CSVBarrier: unexpected writes %q", w.chunks)
+	}
+}
@@ -0,0 +1,155 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+// ColumnType is the type of a column in a CSV schema.
+type ColumnType int
+
+const (
+	// ColString keeps the field as string.
+	ColString ColumnType = iota
+	// ColInt converts the field to int64.
+	ColInt
+	// ColFloat converts the field to float64.
+	ColFloat
+	// ColBool converts the field to bool (see strconv.ParseBool).
+	ColBool
+	// ColTime converts the field to time.Time
+	// using the layout of the column (default time.RFC3339).
+	ColTime
+)
+
+// Column declares a column of a CSV schema.
+// If Optional, empty fields are converted to nil.
+type Column struct {
+	Name     string
+	Type     ColumnType
+	Layout   string
+	Optional bool
+}
+
+// InvalidRow is a row that does not match the schema.
+// Num is the number of the row starting with 1;
+// Errs contains one error per invalid field.
+type InvalidRow struct {
+	Num  int
+	Row  []string
+	Errs []error
+}
+
+// CSVConverter is a Conduit that converts incoming []string,
+// e.g. lines from a CSV Producer, into []interface{}
+// with typed values according to a schema.
+// Rows that do not match the schema are sent as InvalidRow
+// to the side output "invalid" (see conduit.SideOutputter);
+// if the side output is not connected, they are skipped and counted.
+type CSVConverter struct {
+	cols    []Column
+	side    conduit.Target
+	skipped uint64
+}
+
+// NewCSVConverter creates a new CSVConverter Conduit
+// with one Column per field.
+func NewCSVConverter(cols ...Column) (cc *CSVConverter) {
+	if len(cols) == 0 {
+		return nil
+	}
+	cc = new(CSVConverter)
+	if cc != nil {
+		cc.cols = cols
+	}
+	return
+}
+
+// Skipped returns the number of invalid rows skipped.
+func (cc *CSVConverter) Skipped() uint64 {
+	return atomic.LoadUint64(&cc.skipped)
+}
+
+// SideOutput is the pre-defined method that makes CSVConverter
+// a conduit.SideOutputter. CSVConverter has the side output "invalid".
+func (cc *CSVConverter) SideOutput(name string, trg conduit.Target) {
+	if name == "invalid" {
+		cc.side = trg
+	}
+}
+
+// Conduct is the pre-defined method that makes CSVConverter a Conduit.
+// Conduct terminates with an error if an item is not []string.
+func (cc *CSVConverter) Conduct(src conduit.Source, trg conduit.Target) error {
+	num := 0
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			trg <- inp
+			continue
+		}
+		row, ok := inp.([]string)
+		if !ok {
+			return errors.New(fmt.Sprintf("cannot convert %T", inp))
+		}
+		num++
+		out, errs := cc.convert(row)
+		if len(errs) == 0 {
+			trg <- out
+			continue
+		}
+		if cc.side != nil {
+			cc.side <- InvalidRow{num, row, errs}
+			continue
+		}
+		atomic.AddUint64(&cc.skipped, 1)
+	}
+	return nil
+}
+
+// Converts one row
+func (cc *CSVConverter) convert(row []string) ([]interface{}, []error) {
+	if len(row) != len(cc.cols) {
+		err := errors.New(fmt.Sprintf("expected %d fields, have %d", len(cc.cols), len(row)))
+		return nil, []error{err}
+	}
+	var errs []error
+	out := make([]interface{}, len(row))
+	for i, col := range cc.cols {
+		v, err := col.convert(row[i])
+		if err != nil {
+			errs = append(errs, errors.New(fmt.Sprintf("column '%s': %v", col.Name, err)))
+			continue
+		}
+		out[i] = v
+	}
+	return out, errs
+}
+
+// Converts one field
+func (col Column) convert(s string) (interface{}, error) {
+	if s == "" && col.Optional {
+		return nil, nil
+	}
+	switch col.Type {
+	case ColString:
+		return s, nil
+	case ColInt:
+		return strconv.ParseInt(s, 10, 64)
+	case ColFloat:
+		return strconv.ParseFloat(s, 64)
+	case ColBool:
+		return strconv.ParseBool(s)
+	case ColTime:
+		layout := col.Layout
+		if layout == "" {
+			layout = time.RFC3339
+		}
+		return time.Parse(layout, s)
+	}
+	return nil, errors.New(fmt.Sprintf("unknown column type %d", col.Type))
+}
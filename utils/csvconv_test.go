@@ -0,0 +1,73 @@
+package utils
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+var personSchema = []Column{
+	{Name: "name", Type: ColString},
+	{Name: "age", Type: ColInt},
+	{Name: "score", Type: ColFloat, Optional: true},
+	{Name: "member", Type: ColBool},
+	{Name: "since", Type: ColTime, Layout: "2006-01-02"},
+}
+
+// CSV conversion:
+// - Valid rows are converted to typed values
+// - Invalid rows are sent to the side output with all errors
+// - Without side output, invalid rows are skipped and counted
+func TestCSVConverter(t *testing.T) {
+	in := "alice,30,1.5,true,2001-02-03\n" +
+		"bob,old,,yes,2001-02-30\n" +
+		"carol,40,,false,2010-01-01\n" +
+		"dave,50\n"
+
+	cc := NewCSVConverter(personSchema...)
+	c := new(AnyConsumer)
+	side := new(AnyConsumer)
+	p := NewCSV(strings.NewReader(in), CSVFieldsPerRecord(-1))
+	chn := conduit.NewChain(p, []conduit.Conduit{cc}, c, small)
+	err := chn.AddSide(cc, "invalid", side)
+	if err != nil {
+		t.Fatalf("CSVConverter: cannot add side: %v", err)
+	}
+	err = chn.Run()
+	if err != nil {
+		t.Fatalf("CSVConverter failed: %v", chn.Errs)
+	}
+	want := []interface{}{
+		[]interface{}{"alice", int64(30), 1.5, true, time.Date(2001, 2, 3, 0, 0, 0, 0, time.UTC)},
+		[]interface{}{"carol", int64(40), nil, false, time.Date(2010, 1, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	if !reflect.DeepEqual(c.recvd, want) {
+		t.Errorf("CSVConverter: expected %v, have %v", want, c.recvd)
+	}
+	if len(side.recvd) != 2 {
+		t.Fatalf("CSVConverter: expected 2 invalid rows, have %d", len(side.recvd))
+	}
+	bad := side.recvd[0].(InvalidRow)
+	if bad.Num != 2 || bad.Row[0] != "bob" || len(bad.Errs) != 3 {
+		t.Errorf("CSVConverter: unexpected invalid row %v", bad)
+	}
+	bad = side.recvd[1].(InvalidRow)
+	if bad.Num != 4 || len(bad.Errs) != 1 {
+		t.Errorf("CSVConverter: unexpected invalid row %v", bad)
+	}
+
+	cc = NewCSVConverter(personSchema...)
+	c = new(AnyConsumer)
+	p = NewCSV(strings.NewReader(in), CSVFieldsPerRecord(-1))
+	chn = conduit.NewChain(p, []conduit.Conduit{cc}, c, small)
+	err = chn.Run()
+	if err != nil {
+		t.Fatalf("CSVConverter failed: %v", chn.Errs)
+	}
+	if len(c.recvd) != 2 || cc.Skipped() != 2 {
+		t.Errorf("CSVConverter: expected 2 rows and 2 skipped, have %d and %d", len(c.recvd), cc.Skipped())
+	}
+}
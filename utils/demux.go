@@ -0,0 +1,91 @@
+package utils
+
+import (
+	"github.com/toschoo/conduit"
+)
+
+// Demux is a Conduit that routes incoming data
+// to named outputs based on their key,
+// e.g. to write each log level or each tenant
+// to a different sink.
+// Outputs are started lazily when the first item
+// with their key arrives. Items with keys
+// for which there is no output and no output
+// can be created are sent down the chain.
+type Demux struct {
+	kf      KeyFunc
+	outs    map[string]conduit.Consumer
+	factory func(key string) conduit.Consumer
+	sz      int
+}
+
+// NewDemux creates a new Demux with the given KeyFunc
+// (which may be nil, see Keyed) and outputs per key.
+func NewDemux(kf KeyFunc, outs map[string]conduit.Consumer) (dm *Demux) {
+	dm = new(Demux)
+	if dm != nil {
+		dm.kf = kf
+		dm.outs = make(map[string]conduit.Consumer, len(outs))
+		for k, c := range outs {
+			dm.outs[k] = c
+		}
+		dm.sz = 10
+	}
+	return
+}
+
+// Factory sets a function that creates the output
+// for keys not given to NewDemux. If the function
+// returns nil, items with that key are sent down the chain.
+func (dm *Demux) Factory(f func(key string) conduit.Consumer) *Demux {
+	dm.factory = f
+	return dm
+}
+
+// Conduct is the pre-defined method that makes Demux a Conduit.
+// Conduct terminates when all outputs have terminated
+// and returns the first error reported by an output.
+// Barriers are sent down the chain when all running outputs
+// have processed the data received before the barrier (see Branch).
+func (dm *Demux) Conduct(src conduit.Source, trg conduit.Target) error {
+	running := make(map[string]*runningBranch)
+	none := make(map[string]bool)
+	var order []*runningBranch
+
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			syncBranches(inp, order...)
+			trg <- inp
+			continue
+		}
+		k := keyOf(dm.kf, inp)
+		rb, ok := running[k]
+		if !ok && !none[k] {
+			c, ok := dm.outs[k]
+			if !ok && dm.factory != nil {
+				c = dm.factory(k)
+			}
+			if c == nil {
+				none[k] = true
+			} else {
+				rb = startBranch(Branch{nil, c}, dm.sz)
+				running[k] = rb
+				order = append(order, rb)
+			}
+		}
+		if rb != nil {
+			rb.in <- inp
+		} else {
+			trg <- inp
+		}
+	}
+
+	var err error
+	for _, rb := range order {
+		e := rb.stop()
+		if err == nil {
+			err = e
+		}
+	}
+	return err
+}
@@ -0,0 +1,110 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/toschoo/conduit"
+)
+
+// Demux:
+// - It is processed without errors
+// - Each output receives the items with its key in order
+// - Outputs are created lazily by the factory
+// - Items without output are sent down the chain
+func TestDemuxChain(t *testing.T) {
+	for i := 0; i < numOfTests; i++ {
+		err := testDemuxChain(numOfData, 5)
+		if err != nil {
+			m := fmt.Sprintf("DemuxChain failed: %v", err)
+			t.Error(m)
+		}
+	}
+}
+
+func testDemuxChain(n, k int) error {
+
+	p := &SeqProducer{makeSeq(n)}
+	c := new(BaseConsumer)
+
+	// key 0 is given, keys 1 and 2 are created lazily,
+	// other keys go down the chain
+	outs := map[string]*BaseConsumer{"0": new(BaseConsumer)}
+	var mu sync.Mutex
+	created := 0
+
+	d := NewDemux(modKey(k), map[string]conduit.Consumer{"0": outs["0"]}).
+		Factory(func(key string) conduit.Consumer {
+			if key != "1" && key != "2" {
+				return nil
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			created++
+			outs[key] = new(BaseConsumer)
+			return outs[key]
+		})
+
+	chn := conduit.NewChain(p, []conduit.Conduit{d}, c, small)
+
+	err := chn.Run()
+	if err != nil {
+		m := fmt.Sprintf("error on running chain: %v", err)
+		return errors.New(m)
+	}
+	if n >= k && created != 2 {
+		m := fmt.Sprintf("expected 2 outputs created, have %d", created)
+		return errors.New(m)
+	}
+
+	expected := make(map[string][]int)
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("%d", i%k)
+		if _, ok := outs[key]; !ok {
+			key = ""
+		}
+		expected[key] = append(expected[key], i)
+	}
+	for key, want := range expected {
+		have := c.recvd
+		if key != "" {
+			have = outs[key].recvd
+		}
+		if len(have) != len(want) {
+			m := fmt.Sprintf("expected %d items for '%s', have %d", len(want), key, len(have))
+			return errors.New(m)
+		}
+		for i := range want {
+			if have[i] != want[i] {
+				return errors.New("Received values differ from original!")
+			}
+		}
+	}
+	return nil
+}
+
+// Demux with barriers:
+// - Outputs have processed their items before the barrier
+func TestDemuxBarrier(t *testing.T) {
+	var items []interface{}
+	for i := 0; i < 100; i++ {
+		items = append(items, i)
+		if i%10 == 9 {
+			items = append(items, &conduit.Barrier{ID: uint64(i)})
+		}
+	}
+	sc := new(SyncConsumer)
+	d := NewDemux(modKey(2), map[string]conduit.Consumer{"0": sc})
+	c := &BarrierConsumer{f: func(id uint64) int { return int(id+1) / 2 }, have: sc.count}
+	if err := conduit.NewChain(&AnyProducer{src: items}, []conduit.Conduit{d}, c, small).Run(); err != nil {
+		t.Fatalf("DemuxBarrier failed: %v", err)
+	}
+	for _, e := range c.errs {
+		t.Errorf("DemuxBarrier: output has %s", e)
+	}
+	if len(c.recvd) != 60 || sc.count() != 50 {
+		t.Errorf("DemuxBarrier: received %d items, output %d", len(c.recvd), sc.count())
+	}
+}
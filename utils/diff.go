@@ -0,0 +1,229 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+
+	"github.com/toschoo/conduit"
+)
+
+// DiffKind is the kind of a Difference.
+type DiffKind int
+
+const (
+	// DiffMissing is an item of the left stream
+	// not found in the right one.
+	DiffMissing DiffKind = iota
+	// DiffExtra is an item of the right stream
+	// not found in the left one.
+	DiffExtra
+	// DiffChanged is a pair of items at the same position
+	// or with the same key that are not equal.
+	DiffChanged
+)
+
+func (k DiffKind) String() string {
+	switch k {
+	case DiffMissing:
+		return "missing"
+	case DiffExtra:
+		return "extra"
+	case DiffChanged:
+		return "changed"
+	}
+	return fmt.Sprintf("DiffKind(%d)", int(k))
+}
+
+// Difference between two streams:
+// Key is the key of the items or, in ordered mode,
+// their position (starting at 0); Left and Right are the items
+// (nil for the side where the item is missing).
+type Difference struct {
+	Kind        DiffKind
+	Key         string
+	Left, Right interface{}
+}
+
+func (d *Difference) String() string {
+	return fmt.Sprintf("%s %s: %v <> %v", d.Kind, d.Key, d.Left, d.Right)
+}
+
+// EqualFunc reports whether two items are equal.
+type EqualFunc func(a, b interface{}) bool
+
+// StreamDiff is a Producer that runs two Producers,
+// e.g. the old and the new implementation of a pipeline,
+// compares their outputs and sends the differences
+// as *Difference down the chain. In ordered mode (the default),
+// items are compared position by position. In keyed mode
+// (see SetKey), items with the same key are compared
+// regardless of their order; items with the same key
+// on the same side are matched in order.
+// Changed items are sent as they are found, missing
+// and extra items at the end ordered by key.
+// Items are compared with reflect.DeepEqual
+// or an EqualFunc (see SetEqual); barriers are ignored.
+type StreamDiff struct {
+	conduit.Cancelable
+	left, right conduit.Producer
+	kf          KeyFunc
+	eq          EqualFunc
+	sz          int
+}
+
+// NewStreamDiff creates a new StreamDiff Producer.
+func NewStreamDiff(left, right conduit.Producer) (sd *StreamDiff) {
+	if left == nil || right == nil {
+		return nil
+	}
+	sd = new(StreamDiff)
+	if sd != nil {
+		sd.left, sd.right = left, right
+		sd.eq = reflect.DeepEqual
+		sd.sz = 10
+	}
+	return
+}
+
+// SetKey switches to keyed mode; the keys of items
+// are obtained using kf (see KeyFunc and Keyed).
+func (sd *StreamDiff) SetKey(kf KeyFunc) *StreamDiff {
+	if kf == nil {
+		kf = func(v interface{}) string { return keyOf(nil, v) }
+	}
+	sd.kf = kf
+	return sd
+}
+
+// SetEqual sets the EqualFunc that compares items.
+func (sd *StreamDiff) SetEqual(eq EqualFunc) *StreamDiff {
+	if eq != nil {
+		sd.eq = eq
+	}
+	return sd
+}
+
+// Produce is the pre-defined method that makes StreamDiff a Producer.
+func (sd *StreamDiff) Produce(trg conduit.Target) error {
+	lc, lerrc := startProducer(sd.left, sd.sz)
+	rc, rerrc := startProducer(sd.right, sd.sz)
+	defer func() {
+		// let the producers terminate if the diff was canceled
+		go func() {
+			for range lc {
+			}
+		}()
+		go func() {
+			for range rc {
+			}
+		}()
+	}()
+	if sd.kf != nil {
+		sd.keyed(lc, rc, trg)
+	} else {
+		sd.ordered(lc, rc, trg)
+	}
+	if sd.Canceled() {
+		return nil
+	}
+	if err := <-lerrc; err != nil {
+		return errors.New(fmt.Sprintf("left: %v", err))
+	}
+	if err := <-rerrc; err != nil {
+		return errors.New(fmt.Sprintf("right: %v", err))
+	}
+	return nil
+}
+
+// Receives the next item that is not a barrier
+func nextItem(ch <-chan interface{}) (interface{}, bool) {
+	for v := range ch {
+		if !conduit.IsBarrier(v) {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+func (sd *StreamDiff) ordered(lc, rc <-chan interface{}, trg conduit.Target) {
+	for i := 0; !sd.Canceled(); i++ {
+		l, lok := nextItem(lc)
+		r, rok := nextItem(rc)
+		key := strconv.Itoa(i)
+		switch {
+		case !lok && !rok:
+			return
+		case !rok:
+			trg <- &Difference{Kind: DiffMissing, Key: key, Left: l}
+		case !lok:
+			trg <- &Difference{Kind: DiffExtra, Key: key, Right: r}
+		case !sd.eq(l, r):
+			trg <- &Difference{Kind: DiffChanged, Key: key, Left: l, Right: r}
+		}
+	}
+}
+
+func (sd *StreamDiff) keyed(lc, rc <-chan interface{}, trg conduit.Target) {
+	// items waiting for their counterpart per side and key
+	pending := [2]map[string][]interface{}{make(map[string][]interface{}), make(map[string][]interface{})}
+	chs := [2]<-chan interface{}{lc, rc}
+	for (chs[0] != nil || chs[1] != nil) && !sd.Canceled() {
+		var v interface{}
+		var ok bool
+		side := 0
+		select {
+		case v, ok = <-chs[0]:
+		case v, ok = <-chs[1]:
+			side = 1
+		}
+		if !ok {
+			chs[side] = nil
+			continue
+		}
+		if conduit.IsBarrier(v) {
+			continue
+		}
+		k := keyOf(sd.kf, v)
+		other := pending[1-side][k]
+		if len(other) == 0 {
+			pending[side][k] = append(pending[side][k], v)
+			continue
+		}
+		if len(other) == 1 {
+			delete(pending[1-side], k)
+		} else {
+			pending[1-side][k] = other[1:]
+		}
+		l, r := other[0], v
+		if side == 0 {
+			l, r = v, other[0]
+		}
+		if !sd.eq(l, r) {
+			trg <- &Difference{Kind: DiffChanged, Key: k, Left: l, Right: r}
+		}
+	}
+	for side, kind := range []DiffKind{DiffMissing, DiffExtra} {
+		keys := make([]string, 0, len(pending[side]))
+		for k := range pending[side] {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			for _, v := range pending[side][k] {
+				if sd.Canceled() {
+					return
+				}
+				d := &Difference{Kind: kind, Key: k}
+				if side == 0 {
+					d.Left = v
+				} else {
+					d.Right = v
+				}
+				trg <- d
+			}
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/toschoo/conduit"
+)
+
+func diffStrings(recvd []interface{}) []string {
+	var ds []string
+	for _, d := range recvd {
+		ds = append(ds, d.(*Difference).String())
+	}
+	return ds
+}
+
+// Stream diff:
+// - In ordered mode, items are compared by position
+// - In keyed mode, items are compared by key regardless of order
+// - Changed items are detected with the equal function
+// - Errors of the producers terminate the diff
+func TestStreamDiff(t *testing.T) {
+	if NewStreamDiff(nil, &AnyProducer{}) != nil {
+		t.Errorf("StreamDiff: nil producer accepted")
+	}
+	left := []interface{}{1, 2, &conduit.Barrier{}, 3, 4}
+	right := []interface{}{1, 5, 3, 4, 6, 7}
+	ac := &AnyConsumer{}
+	sd := NewStreamDiff(&AnyProducer{src: left}, &AnyProducer{src: right})
+	if err := conduit.NewChain(sd, nil, ac, small).Run(); err != nil {
+		t.Fatalf("StreamDiff failed: %v", err)
+	}
+	if s := strings.Join(diffStrings(ac.recvd), "; "); s != "changed 1: 2 <> 5; extra 4: <nil> <> 6; extra 5: <nil> <> 7" {
+		t.Errorf("StreamDiff: unexpected differences %s", s)
+	}
+
+	left = []interface{}{
+		Record{"id": "a", "v": 1}, Record{"id": "b", "v": 2}, Record{"id": "c", "v": 3},
+		Record{"id": "d", "v": 4}, Record{"id": "d", "v": 5},
+	}
+	right = []interface{}{
+		Record{"id": "d", "v": 4}, Record{"id": "c", "v": 3.0}, &conduit.Barrier{},
+		Record{"id": "a", "v": 9}, Record{"id": "e", "v": 6},
+	}
+	id := func(v interface{}) string { return v.(Record)["id"].(string) }
+	ac = &AnyConsumer{}
+	sd = NewStreamDiff(&AnyProducer{src: left}, &AnyProducer{src: right}).SetKey(id)
+	if err := conduit.NewChain(sd, nil, ac, small).Run(); err != nil {
+		t.Fatalf("StreamDiff failed: %v", err)
+	}
+	// c differs in the type of v
+	ds := diffStrings(ac.recvd)
+	if len(ds) != 5 || !strings.Contains(strings.Join(ds[:2], ";"), "changed a: map[id:a v:1] <> map[id:a v:9]") ||
+		!strings.Contains(strings.Join(ds[:2], ";"), "changed c:") ||
+		strings.Join(ds[2:], "; ") != "missing b: map[id:b v:2] <> <nil>; missing d: map[id:d v:5] <> <nil>; extra e: <nil> <> map[id:e v:6]" {
+		t.Errorf("StreamDiff: unexpected differences %v", ds)
+	}
+
+	numEqual := func(a, b interface{}) bool {
+		return fmt.Sprint(a.(Record)["v"]) == fmt.Sprint(b.(Record)["v"])
+	}
+	ac = &AnyConsumer{}
+	sd = NewStreamDiff(&AnyProducer{src: left}, &AnyProducer{src: right}).SetKey(id).SetEqual(numEqual)
+	if err := conduit.NewChain(sd, nil, ac, small).Run(); err != nil {
+		t.Fatalf("StreamDiff failed: %v", err)
+	}
+	if ds := diffStrings(ac.recvd); len(ds) != 4 || !strings.HasPrefix(ds[0], "changed a:") {
+		t.Errorf("StreamDiff: unexpected differences %v", ds)
+	}
+
+	ac = &AnyConsumer{}
+	sd = NewStreamDiff(&AnyProducer{src: left}, &AnyProducer{src: left}).SetKey(nil)
+	if err := conduit.NewChain(sd, nil, ac, small).Run(); err != nil || len(ac.recvd) != 0 {
+		t.Errorf("StreamDiff: differences between equal streams %v (%v)", ac.recvd, err)
+	}
+
+	chn := conduit.NewChain(NewStreamDiff(&AnyProducer{src: left}, new(ErrProducer)), nil, &AnyConsumer{}, small)
+	if err := chn.Run(); err == nil || !strings.Contains(fmt.Sprint(chn.Errs), "right: "+errMsg) {
+		t.Errorf("StreamDiff: expected error: %v", chn.Errs)
+	}
+}
@@ -0,0 +1,262 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+
+	"github.com/toschoo/conduit"
+)
+
+// Converts as much of data as possible and returns the result
+// and the rest that is not yet consumed; with final,
+// all data must be consumed.
+type blockStep func(data []byte, final bool) ([]byte, []byte, error)
+
+// Bytes carried to the next block;
+// they are included in checkpoints.
+type blockCarry struct {
+	carry    []byte
+	restored bool // carry was restored from a checkpoint
+}
+
+func (bc *blockCarry) snapshot() ([]byte, error) {
+	return append([]byte{}, bc.carry...), nil
+}
+
+func (bc *blockCarry) restore(b []byte) error {
+	bc.carry = append([]byte(nil), b...)
+	bc.restored = true
+	return nil
+}
+
+// Runs a blockStep on a stream of []byte blocks,
+// carrying unconsumed bytes to the next block
+func conductBlocks(step blockStep, bc *blockCarry, src conduit.Source, trg conduit.Target) error {
+	var carry []byte
+	if bc.restored {
+		carry = bc.carry
+	}
+	bc.restored = false
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			bc.carry = carry
+			trg <- inp
+			continue
+		}
+		data, ok := inp.([]byte)
+		if !ok {
+			return errors.New(fmt.Sprintf("cannot convert %T", inp))
+		}
+		if len(carry) > 0 {
+			data = append(carry, data...)
+		}
+		out, rest, err := step(data, false)
+		if err != nil {
+			return err
+		}
+		carry = append([]byte(nil), rest...)
+		if len(out) > 0 {
+			trg <- out
+		}
+	}
+	out, _, err := step(carry, true)
+	if err != nil {
+		return err
+	}
+	if len(out) > 0 {
+		trg <- out
+	}
+	return nil
+}
+
+// Removes line breaks
+func stripLines(data []byte) []byte {
+	if bytes.IndexAny(data, "\r\n") < 0 {
+		return data
+	}
+	out := make([]byte, 0, len(data))
+	for _, b := range data {
+		if b != '\r' && b != '\n' {
+			out = append(out, b)
+		}
+	}
+	return out
+}
+
+// ByteEncoder is a Conduit that encodes a stream of []byte blocks
+// as text, e.g. base64, and sends the encoded blocks
+// down the chain. Bytes that do not form a complete quantum
+// of the encoding are carried to the next block,
+// so the concatenation of the outgoing blocks
+// equals the encoding of the whole stream.
+// The carried bytes are included in checkpoints
+// (see conduit.Checkpointer).
+type ByteEncoder struct {
+	step blockStep
+	bc   blockCarry
+}
+
+// Conduct is the pre-defined method that makes ByteEncoder a Conduit.
+func (enc *ByteEncoder) Conduct(src conduit.Source, trg conduit.Target) error {
+	return conductBlocks(enc.step, &enc.bc, src, trg)
+}
+
+// Snapshot is the pre-defined method that makes ByteEncoder
+// a conduit.Checkpointer.
+func (enc *ByteEncoder) Snapshot() ([]byte, error) {
+	return enc.bc.snapshot()
+}
+
+// Restore is the pre-defined method that makes ByteEncoder
+// a conduit.Checkpointer.
+func (enc *ByteEncoder) Restore(b []byte) error {
+	return enc.bc.restore(b)
+}
+
+// ByteDecoder is a Conduit that decodes a stream of []byte blocks
+// encoded as text, e.g. base64, and sends the decoded blocks
+// down the chain. Like ByteEncoder, it carries incomplete quanta
+// to the next block and includes them in checkpoints.
+type ByteDecoder struct {
+	step blockStep
+	bc   blockCarry
+}
+
+// Conduct is the pre-defined method that makes ByteDecoder a Conduit.
+// Conduct terminates with an error if the input is not correctly encoded.
+func (dec *ByteDecoder) Conduct(src conduit.Source, trg conduit.Target) error {
+	return conductBlocks(dec.step, &dec.bc, src, trg)
+}
+
+// Snapshot is the pre-defined method that makes ByteDecoder
+// a conduit.Checkpointer.
+func (dec *ByteDecoder) Snapshot() ([]byte, error) {
+	return dec.bc.snapshot()
+}
+
+// Restore is the pre-defined method that makes ByteDecoder
+// a conduit.Checkpointer.
+func (dec *ByteDecoder) Restore(b []byte) error {
+	return dec.bc.restore(b)
+}
+
+// NewBase64Encoder creates a new ByteEncoder Conduit
+// with a base64 encoding, e.g. base64.StdEncoding.
+func NewBase64Encoder(e *base64.Encoding) (enc *ByteEncoder) {
+	if e == nil {
+		return nil
+	}
+	enc = new(ByteEncoder)
+	if enc != nil {
+		enc.step = func(data []byte, final bool) ([]byte, []byte, error) {
+			n := len(data)
+			if !final {
+				n -= n % 3
+			}
+			out := make([]byte, e.EncodedLen(n))
+			e.Encode(out, data[:n])
+			return out, data[n:], nil
+		}
+	}
+	return
+}
+
+// NewBase64Decoder creates a new ByteDecoder Conduit
+// with a base64 encoding. Line breaks in the input are ignored.
+func NewBase64Decoder(e *base64.Encoding) (dec *ByteDecoder) {
+	if e == nil {
+		return nil
+	}
+	dec = new(ByteDecoder)
+	if dec != nil {
+		dec.step = func(data []byte, final bool) ([]byte, []byte, error) {
+			data = stripLines(data)
+			n := len(data)
+			if !final {
+				n -= n % 4
+			}
+			out := make([]byte, e.DecodedLen(n))
+			m, err := e.Decode(out, data[:n])
+			if err != nil {
+				return nil, nil, err
+			}
+			return out[:m], data[n:], nil
+		}
+	}
+	return
+}
+
+// NewHexEncoder creates a new ByteEncoder Conduit
+// with lower-case hexadecimal encoding.
+func NewHexEncoder() (enc *ByteEncoder) {
+	enc = new(ByteEncoder)
+	if enc != nil {
+		enc.step = func(data []byte, final bool) ([]byte, []byte, error) {
+			out := make([]byte, hex.EncodedLen(len(data)))
+			hex.Encode(out, data)
+			return out, nil, nil
+		}
+	}
+	return
+}
+
+// NewHexDecoder creates a new ByteDecoder Conduit
+// with hexadecimal encoding. Line breaks in the input are ignored.
+func NewHexDecoder() (dec *ByteDecoder) {
+	dec = new(ByteDecoder)
+	if dec != nil {
+		dec.step = func(data []byte, final bool) ([]byte, []byte, error) {
+			data = stripLines(data)
+			n := len(data)
+			if !final {
+				n -= n % 2
+			}
+			out := make([]byte, hex.DecodedLen(n))
+			_, err := hex.Decode(out, data[:n])
+			if err != nil {
+				return nil, nil, err
+			}
+			return out, data[n:], nil
+		}
+	}
+	return
+}
+
+// NewURLEncoder creates a new ByteEncoder Conduit
+// with URL query encoding (see url.QueryEscape).
+func NewURLEncoder() (enc *ByteEncoder) {
+	enc = new(ByteEncoder)
+	if enc != nil {
+		enc.step = func(data []byte, final bool) ([]byte, []byte, error) {
+			return []byte(url.QueryEscape(string(data))), nil, nil
+		}
+	}
+	return
+}
+
+// NewURLDecoder creates a new ByteDecoder Conduit
+// with URL query encoding (see url.QueryUnescape).
+func NewURLDecoder() (dec *ByteDecoder) {
+	dec = new(ByteDecoder)
+	if dec != nil {
+		dec.step = func(data []byte, final bool) ([]byte, []byte, error) {
+			n := len(data)
+			if !final {
+				// an escape sequence may be incomplete
+				if i := bytes.LastIndexByte(data, '%'); i >= 0 && i > n-3 {
+					n = i
+				}
+			}
+			s, err := url.QueryUnescape(string(data[:n]))
+			if err != nil {
+				return nil, nil, err
+			}
+			return []byte(s), data[n:], nil
+		}
+	}
+	return
+}
@@ -0,0 +1,134 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/toschoo/conduit"
+)
+
+// Byte encodings:
+// - Random data are encoded and decoded in chunks of random size
+// - The encoded stream equals the encoding of the whole data
+// - The decoded stream equals the original
+func TestByteEncoding(t *testing.T) {
+	type codec struct {
+		enc  conduit.Conduit
+		dec  conduit.Conduit
+		code func([]byte) string
+	}
+	codecs := map[string]func() codec{
+		"base64": func() codec {
+			return codec{NewBase64Encoder(base64.StdEncoding), NewBase64Decoder(base64.StdEncoding), base64.StdEncoding.EncodeToString}
+		},
+		"base64raw": func() codec {
+			return codec{NewBase64Encoder(base64.RawURLEncoding), NewBase64Decoder(base64.RawURLEncoding), base64.RawURLEncoding.EncodeToString}
+		},
+		"hex": func() codec {
+			return codec{NewHexEncoder(), NewHexDecoder(), hex.EncodeToString}
+		},
+		"url": func() codec {
+			return codec{NewURLEncoder(), NewURLDecoder(), func(b []byte) string { return url.QueryEscape(string(b)) }}
+		},
+	}
+	for name, mk := range codecs {
+		for i := 0; i < numOfTests; i++ {
+			data := make([]byte, i*7)
+			rand.Read(data)
+			c := mk()
+			err := testByteEncoding(data, c.enc, c.dec, c.code(data))
+			if err != nil {
+				m := fmt.Sprintf("ByteEncoding failed (%s): %v", name, err)
+				t.Error(m)
+			}
+		}
+	}
+}
+
+func testByteEncoding(data []byte, enc, dec conduit.Conduit, code string) error {
+	var out bytes.Buffer
+	pipe := []conduit.Conduit{new(Rechunk), enc, new(Rechunk)}
+	chn := conduit.NewChain(&AnyProducer{[]interface{}{data}}, pipe, NewTextPrinter(&out), small)
+	err := chn.Run()
+	if err != nil {
+		m := fmt.Sprintf("error on encoding: %v", chn.Errs)
+		return errors.New(m)
+	}
+	if out.String() != code {
+		return errors.New("encoded data differ from expected")
+	}
+
+	var orig bytes.Buffer
+	pipe = []conduit.Conduit{new(Rechunk), dec}
+	chn = conduit.NewChain(&AnyProducer{[]interface{}{out.Bytes()}}, pipe, NewTextPrinter(&orig), small)
+	err = chn.Run()
+	if err != nil {
+		m := fmt.Sprintf("error on decoding: %v", chn.Errs)
+		return errors.New(m)
+	}
+	if !bytes.Equal(orig.Bytes(), data) {
+		return errors.New("Received data differ from original!")
+	}
+	return nil
+}
+
+// Byte decoding:
+// - Line breaks are ignored in base64 and hex
+// - Invalid input is reported
+func TestByteDecodingErrors(t *testing.T) {
+	in := strings.Repeat("aGVsbG8g\n", 3)
+	var out bytes.Buffer
+	pipe := []conduit.Conduit{new(Rechunk), NewBase64Decoder(base64.StdEncoding)}
+	chn := conduit.NewChain(&AnyProducer{[]interface{}{[]byte(in)}}, pipe, NewTextPrinter(&out), small)
+	err := chn.Run()
+	if err != nil {
+		t.Fatalf("ByteDecodingErrors failed: %v", chn.Errs)
+	}
+	if out.String() != "hello hello hello " {
+		t.Errorf("ByteDecodingErrors: unexpected output '%s'", out.String())
+	}
+	for _, dec := range []conduit.Conduit{NewBase64Decoder(base64.StdEncoding), NewHexDecoder(), NewURLDecoder()} {
+		chn = conduit.NewChain(&AnyProducer{[]interface{}{[]byte("%zz!")}}, []conduit.Conduit{dec}, NewTextPrinter(new(bytes.Buffer)), small)
+		if chn.Run() == nil {
+			t.Errorf("ByteDecodingErrors: invalid input not reported by %T", dec)
+		}
+	}
+}
+
+// Byte encoding with checkpoints:
+// - Bytes carried over a barrier are included in the snapshot
+// - The restored encoder continues with the carried bytes
+func TestByteEncodingRestore(t *testing.T) {
+	enc := NewBase64Encoder(base64.StdEncoding)
+	src := make(chan interface{}, 2)
+	src <- []byte("ab")
+	src <- &conduit.Barrier{}
+	close(src)
+	trg := make(chan interface{}, 2)
+	if err := enc.Conduct(src, trg); err != nil {
+		t.Fatalf("ByteEncodingRestore failed: %v", err)
+	}
+	b, err := enc.Snapshot()
+	if err != nil {
+		t.Fatalf("ByteEncodingRestore: cannot snapshot: %v", err)
+	}
+	enc = NewBase64Encoder(base64.StdEncoding)
+	if err = enc.Restore(b); err != nil {
+		t.Fatalf("ByteEncodingRestore: cannot restore: %v", err)
+	}
+	c := new(AnyConsumer)
+	chn := conduit.NewChain(&AnyProducer{[]interface{}{[]byte("c")}}, []conduit.Conduit{enc}, c, small)
+	if err = chn.Run(); err != nil {
+		t.Fatalf("ByteEncodingRestore failed: %v", chn.Errs)
+	}
+	if len(c.recvd) != 1 || string(c.recvd[0].([]byte)) != "YWJj" {
+		t.Errorf("ByteEncodingRestore: unexpected blocks %q", c.recvd)
+	}
+}
@@ -0,0 +1,240 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+// ErrNotFound is returned by Lookups for unknown keys.
+var ErrNotFound = errors.New("not found")
+
+// Lookups are expected to find the reference data for a key,
+// e.g. by querying Redis, a database or an HTTP service,
+// and to return ErrNotFound if there is none.
+// Lookup may be called concurrently.
+type Lookup interface {
+	Lookup(key string) (interface{}, error)
+}
+
+// LookupFunc turns a function into a Lookup.
+type LookupFunc func(key string) (interface{}, error)
+
+// Lookup calls f.
+func (f LookupFunc) Lookup(key string) (interface{}, error) {
+	return f(key)
+}
+
+// Cached lookup result
+type lookupResult struct {
+	val   interface{}
+	found bool
+}
+
+// Lookup in flight, shared by all items with the same key
+type pendingLookup struct {
+	done  chan struct{}
+	val   interface{}
+	found bool
+	err   error
+}
+
+// Item waiting for its lookup to be sent down the chain in order
+type enrichSlot struct {
+	inp   interface{}
+	done  chan struct{}
+	val   interface{}
+	found bool
+	err   error
+}
+
+// Enricher is a Conduit that enriches each incoming item
+// with reference data found by a Lookup and sends
+// the item together with the data as Enriched down the chain,
+// in the order in which the items arrived.
+// Results are held in an LRU cache (see SetCacheSize and SetTTL);
+// keys not found are cached as well (see SetNegativeTTL).
+// Cache misses are looked up concurrently (see SetConcurrency),
+// items with the same key share one lookup.
+// Items without reference data are handled according to the MissPolicy;
+// failing lookups terminate the Enricher with an error.
+type Enricher struct {
+	lookup  Lookup
+	kf      KeyFunc
+	miss    MissPolicy
+	ttl     time.Duration
+	negTTL  time.Duration
+	conc    int
+	cache   *lruCache
+	door    sync.Mutex
+	pending map[string]*pendingLookup
+	hits    uint64
+	misses  uint64
+}
+
+// NewEnricher creates a new Enricher Conduit.
+// The keys of incoming items are obtained using kf (see KeyFunc and Keyed).
+func NewEnricher(lookup Lookup, kf KeyFunc, miss MissPolicy) (e *Enricher) {
+	if lookup == nil {
+		return nil
+	}
+	e = new(Enricher)
+	if e != nil {
+		e.lookup = lookup
+		e.kf = kf
+		e.miss = miss
+		e.conc = 8
+		e.cache = newLRUCache(1024)
+		e.pending = make(map[string]*pendingLookup)
+	}
+	return
+}
+
+// SetCacheSize sets the maximum number of cached keys (default: 1024);
+// 0 disables the cache.
+func (e *Enricher) SetCacheSize(n int) *Enricher {
+	e.cache.resize(n)
+	return e
+}
+
+// SetTTL sets the time after which cached data expire
+// (default: 0, i.e. never).
+func (e *Enricher) SetTTL(d time.Duration) *Enricher {
+	e.ttl = d
+	return e
+}
+
+// SetNegativeTTL sets the time for which keys not found are cached
+// (default: 0, i.e. keys not found are not cached).
+func (e *Enricher) SetNegativeTTL(d time.Duration) *Enricher {
+	e.negTTL = d
+	return e
+}
+
+// SetConcurrency sets the maximum number of concurrent lookups (default: 8).
+func (e *Enricher) SetConcurrency(n int) *Enricher {
+	if n > 0 {
+		e.conc = n
+	}
+	return e
+}
+
+// CacheStats returns the number of cache hits and misses.
+func (e *Enricher) CacheStats() (hits, misses uint64) {
+	return atomic.LoadUint64(&e.hits), atomic.LoadUint64(&e.misses)
+}
+
+// Adds a result to the cache
+func (e *Enricher) store(key string, val interface{}, found bool) {
+	ttl := e.ttl
+	if !found {
+		if e.negTTL <= 0 {
+			return
+		}
+		ttl = e.negTTL
+	}
+	e.cache.put(key, lookupResult{val, found}, ttl)
+}
+
+// Looks key up or joins the lookup in flight for key;
+// the first caller does the lookup
+func (e *Enricher) resolve(key string) (interface{}, bool, error) {
+	e.door.Lock()
+	p, ok := e.pending[key]
+	if !ok {
+		p = &pendingLookup{done: make(chan struct{})}
+		e.pending[key] = p
+	}
+	e.door.Unlock()
+	if ok {
+		<-p.done
+		return p.val, p.found, p.err
+	}
+	val, err := e.lookup.Lookup(key)
+	p.val, p.found = val, err == nil
+	if err != nil && err != ErrNotFound {
+		p.err = err
+	}
+	if p.err == nil {
+		e.store(key, p.val, p.found)
+	}
+	e.door.Lock()
+	delete(e.pending, key)
+	e.door.Unlock()
+	close(p.done)
+	return p.val, p.found, p.err
+}
+
+// Conduct is the pre-defined method that makes Enricher a Conduit.
+func (e *Enricher) Conduct(src conduit.Source, trg conduit.Target) error {
+	queue := make(chan *enrichSlot, e.conc)
+	sem := make(chan struct{}, e.conc)
+	var failed atomic.Value
+	emitted := make(chan struct{})
+	go func() {
+		defer close(emitted)
+		for s := range queue {
+			<-s.done
+			if failed.Load() != nil {
+				continue
+			}
+			if s.err != nil {
+				failed.Store(s.err)
+				continue
+			}
+			if conduit.IsBarrier(s.inp) {
+				trg <- s.inp
+				continue
+			}
+			if !s.found {
+				switch e.miss {
+				case MissDrop:
+					continue
+				case MissError:
+					failed.Store(errors.New(fmt.Sprintf("no match for key %s", keyOf(e.kf, s.inp))))
+					continue
+				}
+			}
+			trg <- Enriched{Item: s.inp, Match: s.val}
+		}
+	}()
+	for inp := range src {
+		if failed.Load() != nil {
+			break
+		}
+		s := &enrichSlot{inp: inp, done: make(chan struct{})}
+		queue <- s
+		if conduit.IsBarrier(inp) {
+			close(s.done)
+			continue
+		}
+		k := keyOf(e.kf, inp)
+		if v, ok := e.cache.get(k); ok {
+			atomic.AddUint64(&e.hits, 1)
+			r := v.(lookupResult)
+			s.val, s.found = r.val, r.found
+			close(s.done)
+			continue
+		}
+		atomic.AddUint64(&e.misses, 1)
+		sem <- struct{}{}
+		go func() {
+			defer func() { <-sem }()
+			s.val, s.found, s.err = e.resolve(k)
+			if s.err != nil {
+				s.err = errors.New(fmt.Sprintf("lookup of key %s failed: %v", k, s.err))
+			}
+			close(s.done)
+		}()
+	}
+	close(queue)
+	<-emitted
+	if err := failed.Load(); err != nil {
+		return err.(error)
+	}
+	return nil
+}
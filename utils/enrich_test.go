@@ -0,0 +1,148 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+// Lookup of even numbers with a delay, counting calls per key
+// and the maximum number of concurrent calls
+type countingLookup struct {
+	door    sync.Mutex
+	calls   map[string]int
+	running int
+	maxRun  int
+}
+
+func (l *countingLookup) Lookup(key string) (interface{}, error) {
+	l.door.Lock()
+	if l.calls == nil {
+		l.calls = make(map[string]int)
+	}
+	l.calls[key]++
+	l.running++
+	if l.running > l.maxRun {
+		l.maxRun = l.running
+	}
+	l.door.Unlock()
+	defer func() {
+		l.door.Lock()
+		l.running--
+		l.door.Unlock()
+	}()
+	n, err := strconv.Atoi(key)
+	if err != nil {
+		return nil, errors.New("bad key " + key)
+	}
+	// later keys are found first
+	time.Sleep(time.Duration(10-n%10) * time.Millisecond)
+	if n%2 != 0 {
+		return nil, ErrNotFound
+	}
+	return n * 10, nil
+}
+
+func (l *countingLookup) count(key string) int {
+	l.door.Lock()
+	defer l.door.Unlock()
+	return l.calls[key]
+}
+
+// Enricher:
+// - Items are enriched in order with bounded concurrency
+// - Repeated keys are served from the cache, keys not found only with negative caching
+// - Cached data expire after the TTL
+// - Misses are handled according to the policy, failing lookups terminate the chain
+func TestEnricher(t *testing.T) {
+	if NewEnricher(nil, nil, MissPass) != nil {
+		t.Errorf("Enricher: nil lookup accepted")
+	}
+	var items []interface{}
+	for i := 0; i < 40; i++ {
+		items = append(items, i%10)
+		if i == 20 {
+			items = append(items, &conduit.Barrier{})
+		}
+	}
+	lk := &countingLookup{}
+	e := NewEnricher(lk, nil, MissPass).SetConcurrency(3)
+	ac := &AnyConsumer{}
+	if err := conduit.NewChain(&AnyProducer{src: items}, []conduit.Conduit{e}, ac, small).Run(); err != nil {
+		t.Fatalf("Enricher failed: %v", err)
+	}
+	if len(ac.recvd) != len(items) {
+		t.Fatalf("Enricher: received %d items", len(ac.recvd))
+	}
+	for i, r := range ac.recvd {
+		if i == 21 {
+			if !conduit.IsBarrier(r) {
+				t.Errorf("Enricher: barrier not forwarded")
+			}
+			continue
+		}
+		en := r.(Enriched)
+		n := en.Item.(int)
+		if en.Item != items[i] || n%2 == 0 && en.Match != n*10 || n%2 != 0 && en.Match != nil {
+			t.Errorf("Enricher: unexpected item %d: %v", i, en)
+		}
+	}
+	if lk.maxRun > 3 {
+		t.Errorf("Enricher: %d concurrent lookups", lk.maxRun)
+	}
+	if lk.count("2") != 1 || lk.count("3") < 2 {
+		t.Errorf("Enricher: unexpected calls %v", lk.calls)
+	}
+	if hits, misses := e.CacheStats(); hits+misses != 40 || hits < 15 {
+		t.Errorf("Enricher: %d hits, %d misses", hits, misses)
+	}
+
+	lk = &countingLookup{}
+	e = NewEnricher(lk, nil, MissDrop).SetNegativeTTL(time.Hour).SetCacheSize(4).SetConcurrency(1)
+	items = []interface{}{1, 2, 1, 2, 3, 4, 5, 6}
+	ac = &AnyConsumer{}
+	if err := conduit.NewChain(&AnyProducer{src: items}, []conduit.Conduit{e}, ac, small).Run(); err != nil {
+		t.Fatalf("Enricher failed: %v", err)
+	}
+	if fmt.Sprint(ac.recvd) != "[{2 20} {2 20} {4 40} {6 60}]" {
+		t.Errorf("Enricher: received %v", ac.recvd)
+	}
+	// 2 was evicted by 3, 4, 5 and 6
+	if err := conduit.NewChain(&AnyProducer{src: []interface{}{2, 5}}, []conduit.Conduit{e}, &AnyConsumer{}, small).Run(); err != nil {
+		t.Fatalf("Enricher failed: %v", err)
+	}
+	if lk.count("1") != 1 || lk.count("2") != 2 || lk.count("5") != 1 {
+		t.Errorf("Enricher: unexpected calls %v", lk.calls)
+	}
+
+	lk = &countingLookup{}
+	e = NewEnricher(lk, nil, MissPass).SetTTL(20 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		if i == 2 {
+			time.Sleep(30 * time.Millisecond)
+		}
+		if err := conduit.NewChain(&AnyProducer{src: []interface{}{4}}, []conduit.Conduit{e}, &AnyConsumer{}, small).Run(); err != nil {
+			t.Fatalf("Enricher failed: %v", err)
+		}
+	}
+	if lk.count("4") != 2 {
+		t.Errorf("Enricher: unexpected calls after expiry %v", lk.calls)
+	}
+
+	e = NewEnricher(&countingLookup{}, nil, MissError)
+	chn := conduit.NewChain(&AnyProducer{src: []interface{}{2, 3, 4}}, []conduit.Conduit{e}, &AnyConsumer{}, small)
+	if err := chn.Run(); err == nil || !strings.Contains(fmt.Sprint(chn.Errs), "no match for key 3") {
+		t.Errorf("Enricher: expected miss error: %v", chn.Errs)
+	}
+	e = NewEnricher(LookupFunc(func(k string) (interface{}, error) { return nil, errors.New("down") }), nil, MissPass)
+	chn = conduit.NewChain(&AnyProducer{src: []interface{}{1, 2}}, []conduit.Conduit{e}, &AnyConsumer{}, small)
+	if err := chn.Run(); err == nil || !strings.Contains(fmt.Sprint(chn.Errs), "lookup of key 1 failed: down") {
+		t.Errorf("Enricher: expected lookup error: %v", chn.Errs)
+	}
+}
@@ -0,0 +1,529 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+// FeedEntry is an item of an RSS feed or an entry of an Atom feed.
+// GUID identifies the entry within its feed: the guid (RSS)
+// or id (Atom), the link if it is missing, or a hash
+// of title and summary if there is neither.
+// Summary is the description (RSS) or summary (Atom),
+// Content the full content (content:encoded in RSS),
+// both as they are, i.e. usually HTML.
+type FeedEntry struct {
+	Feed       string // URL of the feed
+	FeedTitle  string
+	GUID       string
+	Title      string
+	Link       string
+	Author     string
+	Summary    string
+	Content    string
+	Categories []string
+	Published  time.Time
+	Updated    time.Time
+	Enclosures []FeedEnclosure
+}
+
+// FeedEnclosure is a media file attached to a FeedEntry,
+// e.g. the audio file of a podcast episode.
+type FeedEnclosure struct {
+	URL    string
+	Type   string
+	Length int64
+}
+
+// Item of RSS 2.0 and RSS 1.0 (RDF)
+type rssItem struct {
+	Title       string   `xml:"title"`
+	Link        string   `xml:"link"`
+	GUID        string   `xml:"guid"`
+	About       string   `xml:"http://www.w3.org/1999/02/22-rdf-syntax-ns# about,attr"`
+	Description string   `xml:"description"`
+	Content     string   `xml:"http://purl.org/rss/1.0/modules/content/ encoded"`
+	Author      string   `xml:"author"`
+	Creator     string   `xml:"http://purl.org/dc/elements/1.1/ creator"`
+	PubDate     string   `xml:"pubDate"`
+	Date        string   `xml:"http://purl.org/dc/elements/1.1/ date"`
+	Categories  []string `xml:"category"`
+	Enclosures  []struct {
+		URL    string `xml:"url,attr"`
+		Type   string `xml:"type,attr"`
+		Length int64  `xml:"length,attr"`
+	} `xml:"enclosure"`
+}
+
+// Text construct of Atom; xhtml is kept as markup
+type atomText struct {
+	Type  string `xml:"type,attr"`
+	Text  string `xml:",chardata"`
+	Inner string `xml:",innerxml"`
+}
+
+func (t atomText) String() string {
+	if t.Type == "xhtml" {
+		return strings.TrimSpace(t.Inner)
+	}
+	return strings.TrimSpace(t.Text)
+}
+
+type atomEntry struct {
+	ID      string   `xml:"id"`
+	Title   atomText `xml:"title"`
+	Summary atomText `xml:"summary"`
+	Content atomText `xml:"content"`
+	Authors []string `xml:"author>name"`
+	Links   []struct {
+		Href   string `xml:"href,attr"`
+		Rel    string `xml:"rel,attr"`
+		Type   string `xml:"type,attr"`
+		Length int64  `xml:"length,attr"`
+	} `xml:"link"`
+	Categories []struct {
+		Term string `xml:"term,attr"`
+	} `xml:"category"`
+	Published string `xml:"published"`
+	Updated   string `xml:"updated"`
+}
+
+// Any of the three formats, told apart by the root element
+type feedXML struct {
+	XMLName      xml.Name
+	ChannelTitle string      `xml:"channel>title"`
+	Items        []rssItem   `xml:"channel>item"`
+	RDFItems     []rssItem   `xml:"item"`
+	Title        atomText    `xml:"title"`
+	Entries      []atomEntry `xml:"entry"`
+}
+
+// Layouts of dates in feeds: RFC 822 in RSS
+// (in many variants), RFC 3339 in Atom and Dublin Core
+var feedTimeLayouts = []string{
+	time.RFC1123Z,
+	time.RFC1123,
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"Mon, 2 Jan 2006 15:04:05 MST",
+	"Mon, 2 Jan 2006 15:04 -0700",
+	"Mon, 2 Jan 2006 15:04 MST",
+	"2 Jan 2006 15:04:05 -0700",
+	"2 Jan 2006 15:04:05 MST",
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02",
+}
+
+// Parses a date; unknown formats give the zero time
+func parseFeedTime(s string) time.Time {
+	s = strings.TrimSpace(s)
+	for _, layout := range feedTimeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// Fills in a missing GUID
+func (e *FeedEntry) identify() {
+	if e.GUID == "" {
+		e.GUID = e.Link
+	}
+	if e.GUID == "" {
+		sum := sha1.Sum([]byte(e.Title + "\n" + e.Summary))
+		e.GUID = hex.EncodeToString(sum[:])
+	}
+}
+
+func (it *rssItem) entry(title string) *FeedEntry {
+	e := &FeedEntry{
+		FeedTitle:  title,
+		GUID:       strings.TrimSpace(it.GUID),
+		Title:      strings.TrimSpace(it.Title),
+		Link:       strings.TrimSpace(it.Link),
+		Author:     strings.TrimSpace(it.Author),
+		Summary:    strings.TrimSpace(it.Description),
+		Content:    strings.TrimSpace(it.Content),
+		Categories: it.Categories,
+		Published:  parseFeedTime(it.PubDate),
+	}
+	if e.GUID == "" {
+		e.GUID = it.About
+	}
+	if e.Author == "" {
+		e.Author = strings.TrimSpace(it.Creator)
+	}
+	if e.Published.IsZero() {
+		e.Published = parseFeedTime(it.Date)
+	}
+	for _, enc := range it.Enclosures {
+		e.Enclosures = append(e.Enclosures, FeedEnclosure{URL: enc.URL, Type: enc.Type, Length: enc.Length})
+	}
+	e.identify()
+	return e
+}
+
+func (ae *atomEntry) entry(title string) *FeedEntry {
+	e := &FeedEntry{
+		FeedTitle: title,
+		GUID:      strings.TrimSpace(ae.ID),
+		Title:     ae.Title.String(),
+		Author:    strings.TrimSpace(strings.Join(ae.Authors, ", ")),
+		Summary:   ae.Summary.String(),
+		Content:   ae.Content.String(),
+		Published: parseFeedTime(ae.Published),
+		Updated:   parseFeedTime(ae.Updated),
+	}
+	for _, c := range ae.Categories {
+		e.Categories = append(e.Categories, c.Term)
+	}
+	for _, l := range ae.Links {
+		switch l.Rel {
+		case "", "alternate":
+			if e.Link == "" {
+				e.Link = l.Href
+			}
+		case "enclosure":
+			e.Enclosures = append(e.Enclosures, FeedEnclosure{URL: l.Href, Type: l.Type, Length: l.Length})
+		}
+	}
+	if e.Published.IsZero() {
+		e.Published = e.Updated
+	}
+	e.identify()
+	return e
+}
+
+// ParseFeed parses an RSS 2.0, RSS 1.0 or Atom feed
+// and returns its entries in the order of the document.
+// HTML entities (e.g. &nbsp;) are accepted, and documents
+// in ISO-8859-1 and Windows-1252 are converted to UTF-8.
+func ParseFeed(data []byte) ([]*FeedEntry, error) {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	d.Strict = false
+	d.Entity = xml.HTMLEntity
+	d.CharsetReader = func(charset string, r io.Reader) (io.Reader, error) {
+		if strings.EqualFold(charset, "us-ascii") {
+			return r, nil
+		}
+		cs := charsetByName(charset)
+		if cs == nil {
+			return nil, errors.New("unsupported charset " + charset)
+		}
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		data, _, err = NewCharsetDecoder(cs).transform(data, true)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(data), nil
+	}
+	var doc feedXML
+	err := d.Decode(&doc)
+	if err != nil {
+		return nil, err
+	}
+	var entries []*FeedEntry
+	switch doc.XMLName.Local {
+	case "rss", "RDF":
+		title := strings.TrimSpace(doc.ChannelTitle)
+		for i := range doc.Items {
+			entries = append(entries, doc.Items[i].entry(title))
+		}
+		for i := range doc.RDFItems {
+			entries = append(entries, doc.RDFItems[i].entry(title))
+		}
+	case "feed":
+		title := doc.Title.String()
+		for i := range doc.Entries {
+			entries = append(entries, doc.Entries[i].entry(title))
+		}
+	default:
+		return nil, errors.New(fmt.Sprintf("not a feed: <%s>", doc.XMLName.Local))
+	}
+	return entries, nil
+}
+
+// State of a feed: the validators of the last response
+// and the GUIDs of its entries
+type feedState struct {
+	etag     string
+	modified string
+	seen     map[string]bool
+}
+
+// FeedReader is a Producer that polls RSS and Atom feeds
+// (see ParseFeed) and sends new entries as *FeedEntry down the chain,
+// per feed in the order of their dates (oldest first)
+// or, if not all entries have dates, in reverse order of the feed.
+// Entries are deduplicated by their GUID within each feed;
+// GUIDs of entries that have left the feed are forgotten.
+// Requests are conditional (ETag and Last-Modified),
+// relative links are resolved against the URL of the feed.
+// With a StateStore (see SetStore), the GUIDs are stored
+// under the stage "feed" with the URL as key after each poll,
+// so that entries are not sent again after a restart.
+// With SetInterval, the feeds are polled periodically;
+// otherwise, the producer terminates after one poll.
+// Requests that fail with a network error or status 429 or 5xx
+// are retried according to the RetryPolicy (DefaultRetry).
+// Feeds that cannot be fetched or parsed are sent
+// as FailedRequest with the URL as Item to the side output "failed"
+// (see conduit.SideOutputter), or, if the side output is not connected,
+// terminate the producer with an error.
+type FeedReader struct {
+	conduit.Cancelable
+	urls     []string
+	client   *http.Client
+	interval time.Duration
+	retry    RetryPolicy
+	store    conduit.StateStore
+	skip     bool
+	side     conduit.Target
+	feeds    map[string]*feedState
+	door     sync.Mutex
+	stop     context.CancelFunc
+}
+
+// NewFeedReader creates a new FeedReader Producer
+// polling the feeds at urls.
+func NewFeedReader(urls ...string) (fr *FeedReader) {
+	for _, u := range urls {
+		p, err := url.Parse(u)
+		if err != nil || (p.Scheme != "http" && p.Scheme != "https") {
+			return nil
+		}
+	}
+	fr = new(FeedReader)
+	if fr != nil {
+		fr.urls = urls
+		fr.client = http.DefaultClient
+		fr.retry = DefaultRetry
+	}
+	return
+}
+
+// SetClient sets the http.Client (default: http.DefaultClient).
+func (fr *FeedReader) SetClient(c *http.Client) *FeedReader {
+	fr.client = c
+	return fr
+}
+
+// SetInterval polls the feeds every d until the producer is canceled.
+func (fr *FeedReader) SetInterval(d time.Duration) *FeedReader {
+	fr.interval = d
+	return fr
+}
+
+// SetRetry sets the RetryPolicy (default: DefaultRetry).
+func (fr *FeedReader) SetRetry(rp RetryPolicy) *FeedReader {
+	fr.retry = rp
+	return fr
+}
+
+// SetStore sets the StateStore where the GUIDs are kept.
+func (fr *FeedReader) SetStore(st conduit.StateStore) *FeedReader {
+	fr.store = st
+	return fr
+}
+
+// SkipExisting sends only entries that appear after the first poll
+// of a feed without stored state.
+func (fr *FeedReader) SkipExisting() *FeedReader {
+	fr.skip = true
+	return fr
+}
+
+// SideOutput is the pre-defined method that makes FeedReader
+// a conduit.SideOutputter. FeedReader has the side output "failed".
+func (fr *FeedReader) SideOutput(name string, trg conduit.Target) {
+	if name == "failed" {
+		fr.side = trg
+	}
+}
+
+// Cancel cancels the producer and the request in flight.
+func (fr *FeedReader) Cancel() {
+	fr.Cancelable.Cancel()
+	fr.door.Lock()
+	defer fr.door.Unlock()
+	if fr.stop != nil {
+		fr.stop()
+	}
+}
+
+// Produce is the pre-defined method that makes FeedReader a Producer.
+func (fr *FeedReader) Produce(trg conduit.Target) error {
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	fr.door.Lock()
+	fr.stop = stop
+	fr.door.Unlock()
+
+	fr.feeds = make(map[string]*feedState)
+	for !fr.Canceled() {
+		for _, u := range fr.urls {
+			if fr.Canceled() {
+				return nil
+			}
+			attempts, err := fr.poll(ctx, u, trg)
+			if err == nil || fr.Canceled() {
+				continue
+			}
+			if fr.side == nil {
+				return errors.New(fmt.Sprintf("reading feed %s failed after %d attempts: %v", u, attempts, err))
+			}
+			fr.side <- &FailedRequest{Item: u, Attempts: attempts, Err: err}
+		}
+		if fr.interval <= 0 {
+			break
+		}
+		sleep(fr.interval, fr.Canceled)
+	}
+	return nil
+}
+
+// Loads the state of a feed
+func (fr *FeedReader) state(u string) (*feedState, bool, error) {
+	if st, ok := fr.feeds[u]; ok {
+		return st, false, nil
+	}
+	st := &feedState{seen: make(map[string]bool)}
+	fr.feeds[u] = st
+	if fr.store == nil {
+		return st, true, nil
+	}
+	v, err := fr.store.Get("feed", u)
+	if err == conduit.ErrNoState {
+		return st, true, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	for _, guid := range strings.Split(string(v), "\n") {
+		if guid != "" {
+			st.seen[guid] = true
+		}
+	}
+	return st, false, nil
+}
+
+// Fetches a feed and sends the new entries;
+// returns the number of attempts
+func (fr *FeedReader) poll(ctx context.Context, u string, trg conduit.Target) (int, error) {
+	st, first, err := fr.state(u)
+	if err != nil {
+		return 0, err
+	}
+	var data []byte
+	var etag, modified string
+	attempts, err := fr.retry.run(fr.Canceled, func() (bool, error) {
+		data = nil
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return false, err
+		}
+		req.Header.Set("Accept", "application/rss+xml, application/atom+xml, application/xml;q=0.9, */*;q=0.8")
+		if st.etag != "" {
+			req.Header.Set("If-None-Match", st.etag)
+		}
+		if st.modified != "" {
+			req.Header.Set("If-Modified-Since", st.modified)
+		}
+		rsp, err := fr.client.Do(req)
+		if err != nil {
+			return true, err
+		}
+		defer discardBody(rsp.Body)
+		switch {
+		case rsp.StatusCode == http.StatusNotModified:
+			return false, nil
+		case rsp.StatusCode/100 != 2:
+			return retryableStatus(rsp.StatusCode), errors.New(rsp.Status)
+		}
+		data, err = ioutil.ReadAll(rsp.Body)
+		etag, modified = rsp.Header.Get("ETag"), rsp.Header.Get("Last-Modified")
+		return true, err
+	})
+	if err != nil || data == nil {
+		return attempts, err
+	}
+	entries, err := ParseFeed(data)
+	if err != nil {
+		return attempts, err
+	}
+	base, _ := url.Parse(u)
+	var fresh []*FeedEntry
+	seen := make(map[string]bool, len(entries))
+	// feeds list the newest entries first
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		if seen[e.GUID] {
+			continue
+		}
+		seen[e.GUID] = true
+		if st.seen[e.GUID] || (first && fr.skip) {
+			continue
+		}
+		e.Feed = u
+		e.Link = resolveFeedLink(base, e.Link)
+		for j := range e.Enclosures {
+			e.Enclosures[j].URL = resolveFeedLink(base, e.Enclosures[j].URL)
+		}
+		fresh = append(fresh, e)
+	}
+	dated := true
+	for _, e := range fresh {
+		dated = dated && !e.Published.IsZero()
+	}
+	if dated {
+		sort.SliceStable(fresh, func(i, j int) bool { return fresh[i].Published.Before(fresh[j].Published) })
+	}
+	for _, e := range fresh {
+		if fr.Canceled() {
+			return attempts, nil
+		}
+		trg <- e
+	}
+	st.seen = seen
+	st.etag, st.modified = etag, modified
+	if fr.store == nil {
+		return attempts, nil
+	}
+	guids := make([]string, 0, len(seen))
+	for guid := range seen {
+		guids = append(guids, guid)
+	}
+	sort.Strings(guids)
+	return attempts, fr.store.Put("feed", u, []byte(strings.Join(guids, "\n")))
+}
+
+// Resolves a link relative to the URL of the feed
+func resolveFeedLink(base *url.URL, link string) string {
+	if link == "" || base == nil {
+		return link
+	}
+	ref, err := url.Parse(link)
+	if err != nil {
+		return link
+	}
+	return base.ResolveReference(ref).String()
+}
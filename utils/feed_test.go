@@ -0,0 +1,235 @@
+package utils
+
+import (
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+const rss2 = `<?xml version="1.0" encoding="ISO-8859-1"?>
+<rss version="2.0" xmlns:content="http://purl.org/rss/1.0/modules/content/" xmlns:dc="http://purl.org/dc/elements/1.1/">
+<channel>
+  <title>Caf` + "\xe9" + ` News</title>
+  <link>http://example.com/</link>
+  <item>
+    <title>Second</title>
+    <link>/news/2</link>
+    <guid isPermaLink="false">news-2</guid>
+    <description>&lt;p&gt;Two&amp;nbsp;&lt;/p&gt;</description>
+    <content:encoded><![CDATA[<p>Full <b>two</b></p>]]></content:encoded>
+    <dc:creator>Ann</dc:creator>
+    <category>a</category><category>b</category>
+    <pubDate>Tue, 5 Mar 2024 10:00:00 GMT</pubDate>
+    <enclosure url="/media/2.mp3" type="audio/mpeg" length="1234"/>
+  </item>
+  <item>
+    <title>First&nbsp;item</title>
+    <link>http://example.com/news/1</link>
+    <pubDate>Mon, 04 Mar 2024 10:00:00 +0100</pubDate>
+  </item>
+</channel>
+</rss>`
+
+const atom = `<?xml version="1.0" encoding="utf-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+  <title type="text">Atom Feed</title>
+  <entry>
+    <id>urn:uuid:1</id>
+    <title type="html">A &lt;b&gt;bold&lt;/b&gt; title</title>
+    <link rel="alternate" href="http://example.com/a/1"/>
+    <link rel="enclosure" href="http://example.com/a/1.pdf" type="application/pdf" length="99"/>
+    <author><name>Bob</name></author>
+    <category term="x"/>
+    <summary>Summary</summary>
+    <content type="xhtml"><div xmlns="http://www.w3.org/1999/xhtml"><p>Hi</p></div></content>
+    <updated>2024-03-06T10:00:00Z</updated>
+  </entry>
+</feed>`
+
+const rdf = `<?xml version="1.0"?>
+<rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#" xmlns="http://purl.org/rss/1.0/" xmlns:dc="http://purl.org/dc/elements/1.1/">
+  <channel rdf:about="http://example.com/"><title>RDF</title></channel>
+  <item rdf:about="http://example.com/r/1">
+    <title>R1</title>
+    <link>http://example.com/r/1</link>
+    <dc:date>2024-03-07T08:00:00+01:00</dc:date>
+  </item>
+</rdf:RDF>`
+
+func TestParseFeed(t *testing.T) {
+	entries, err := ParseFeed([]byte(rss2))
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("ParseFeed: RSS: %d entries (%v)", len(entries), err)
+	}
+	e := entries[0]
+	if e.FeedTitle != "Café News" || e.GUID != "news-2" || e.Title != "Second" || e.Link != "/news/2" ||
+		e.Author != "Ann" || e.Summary != "<p>Two&nbsp;</p>" || e.Content != "<p>Full <b>two</b></p>" ||
+		fmt.Sprint(e.Categories) != "[a b]" || !e.Published.Equal(time.Date(2024, 3, 5, 10, 0, 0, 0, time.UTC)) ||
+		len(e.Enclosures) != 1 || e.Enclosures[0] != (FeedEnclosure{"/media/2.mp3", "audio/mpeg", 1234}) {
+		t.Errorf("ParseFeed: unexpected RSS entry %+v", e)
+	}
+	e = entries[1]
+	if e.GUID != "http://example.com/news/1" || e.Title != "First\u00a0item" ||
+		!e.Published.Equal(time.Date(2024, 3, 4, 9, 0, 0, 0, time.UTC)) {
+		t.Errorf("ParseFeed: unexpected RSS entry %+v", e)
+	}
+
+	entries, err = ParseFeed([]byte(atom))
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("ParseFeed: Atom: %d entries (%v)", len(entries), err)
+	}
+	e = entries[0]
+	if e.FeedTitle != "Atom Feed" || e.GUID != "urn:uuid:1" || e.Title != "A <b>bold</b> title" ||
+		e.Link != "http://example.com/a/1" || e.Author != "Bob" || e.Summary != "Summary" ||
+		!strings.Contains(e.Content, "<p>Hi</p>") || fmt.Sprint(e.Categories) != "[x]" ||
+		!e.Published.Equal(time.Date(2024, 3, 6, 10, 0, 0, 0, time.UTC)) || !e.Updated.Equal(e.Published) ||
+		len(e.Enclosures) != 1 || e.Enclosures[0].Length != 99 {
+		t.Errorf("ParseFeed: unexpected Atom entry %+v", e)
+	}
+
+	entries, err = ParseFeed([]byte(rdf))
+	if err != nil || len(entries) != 1 || entries[0].FeedTitle != "RDF" || entries[0].GUID != "http://example.com/r/1" ||
+		!entries[0].Published.Equal(time.Date(2024, 3, 7, 7, 0, 0, 0, time.UTC)) {
+		t.Errorf("ParseFeed: unexpected RDF entries %v (%v)", entries, err)
+	}
+
+	entries, err = ParseFeed([]byte(`<rss><channel><item><title>t</title><description>d</description></item></channel></rss>`))
+	if err != nil || len(entries) != 1 || len(entries[0].GUID) != 40 {
+		t.Errorf("ParseFeed: no GUID for entry without link: %v (%v)", entries, err)
+	}
+	for _, doc := range []string{"<html><body/></html>", "not xml", `<?xml version="1.0" encoding="koi8-r"?><rss/>`} {
+		if _, err = ParseFeed([]byte(doc)); err == nil {
+			t.Errorf("ParseFeed: %q accepted", doc)
+		}
+	}
+}
+
+// Feed test server; /rss and /atom serve the documents in docs
+// with ETag validation, /down always fails
+type feedServer struct {
+	*httptest.Server
+	door     sync.Mutex
+	docs     map[string]string
+	requests map[string]int
+	notMod   int
+}
+
+func newFeedServer() *feedServer {
+	s := &feedServer{docs: make(map[string]string), requests: make(map[string]int)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.door.Lock()
+		defer s.door.Unlock()
+		s.requests[r.URL.Path]++
+		doc, ok := s.docs[r.URL.Path]
+		if !ok {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		etag := fmt.Sprintf(`"%x"`, crc32.ChecksumIEEE([]byte(doc)))
+		if r.Header.Get("If-None-Match") == etag {
+			s.notMod++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Write([]byte(doc))
+	}))
+	return s
+}
+
+func (s *feedServer) set(path, doc string) {
+	s.door.Lock()
+	defer s.door.Unlock()
+	s.docs[path] = doc
+}
+
+func feedTitles(items []interface{}) string {
+	var titles []string
+	for _, inp := range items {
+		titles = append(titles, inp.(*FeedEntry).Title)
+	}
+	return strings.Join(titles, ",")
+}
+
+// Feed reader:
+// - New entries are sent oldest first, with links resolved
+// - Entries already seen and unchanged feeds are skipped
+// - With a StateStore, entries are not sent again after a restart
+// - Failing feeds are sent to the side output or fail the producer
+func TestFeedReader(t *testing.T) {
+	srv := newFeedServer()
+	defer srv.Close()
+	if NewFeedReader(srv.URL+"/rss", "ftp://x/feed") != nil {
+		t.Errorf("FeedReader: invalid URL accepted")
+	}
+	srv.set("/rss", rss2)
+	srv.set("/atom", atom)
+
+	store := conduit.NewMemStore()
+	c := &TakeConsumer{n: 5}
+	fr := NewFeedReader(srv.URL+"/rss", srv.URL+"/atom").SetInterval(5 * time.Millisecond).SetStore(store)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		srv.set("/rss", strings.Replace(rss2, "<item>", "<item><title>Third</title><guid>news-3</guid></item><item>", 1))
+		time.Sleep(50 * time.Millisecond)
+		srv.set("/atom", strings.Replace(atom, "urn:uuid:1", "urn:uuid:2", 1))
+	}()
+	if err := conduit.NewChain(fr, nil, c, small).Run(); err != nil {
+		t.Fatalf("FeedReader failed: %v", err)
+	}
+	want := "First\u00a0item,Second,A <b>bold</b> title,Third,A <b>bold</b> title"
+	if feedTitles(c.recvd) != want {
+		t.Fatalf("FeedReader: received %q", feedTitles(c.recvd))
+	}
+	e := c.recvd[1].(*FeedEntry)
+	if e.Feed != srv.URL+"/rss" || e.Link != srv.URL+"/news/2" || e.Enclosures[0].URL != srv.URL+"/media/2.mp3" {
+		t.Errorf("FeedReader: unexpected entry %+v", e)
+	}
+	if e = c.recvd[4].(*FeedEntry); e.GUID != "urn:uuid:2" {
+		t.Errorf("FeedReader: unexpected entry %+v", e)
+	}
+	srv.door.Lock()
+	if srv.notMod == 0 {
+		t.Errorf("FeedReader: no conditional requests")
+	}
+	srv.door.Unlock()
+
+	// a restart sends only new entries; the first poll of a new feed is skipped
+	srv.set("/rss", strings.Replace(rss2, "<item>", "<item><title>Fourth</title><guid>news-4</guid></item><item>", 1))
+	srv.set("/rdf", rdf)
+	ac := &AnyConsumer{}
+	fr = NewFeedReader(srv.URL+"/rss", srv.URL+"/atom", srv.URL+"/rdf").SetStore(store).SkipExisting()
+	if err := conduit.NewChain(fr, nil, ac, small).Run(); err != nil {
+		t.Fatalf("FeedReader failed: %v", err)
+	}
+	if feedTitles(ac.recvd) != "Fourth" {
+		t.Errorf("FeedReader: received %q after restart", feedTitles(ac.recvd))
+	}
+
+	// failing feeds
+	fr = NewFeedReader(srv.URL+"/down", srv.URL+"/atom").SetRetry(fastRetry)
+	failed := make(chan interface{}, 10)
+	fr.SideOutput("failed", failed)
+	ac = &AnyConsumer{}
+	if err := conduit.NewChain(fr, nil, ac, small).Run(); err != nil {
+		t.Fatalf("FeedReader failed: %v", err)
+	}
+	if len(failed) != 1 || len(ac.recvd) != 1 {
+		t.Fatalf("FeedReader: %d failed, %d received", len(failed), len(ac.recvd))
+	}
+	if f := (<-failed).(*FailedRequest); f.Item != srv.URL+"/down" || f.Attempts != 3 {
+		t.Errorf("FeedReader: unexpected failure %+v", f)
+	}
+	srv.set("/html", "<html><body>no feed</body></html>")
+	chn := conduit.NewChain(NewFeedReader(srv.URL+"/html"), nil, &AnyConsumer{}, small)
+	if err := chn.Run(); err == nil || !strings.Contains(fmt.Sprint(chn.Errs), "not a feed") {
+		t.Errorf("FeedReader: invalid feed accepted: %v", chn.Errs)
+	}
+}
@@ -0,0 +1,106 @@
+package utils
+
+import (
+	"github.com/toschoo/conduit"
+)
+
+// Result is implemented by Consumers that compute a result,
+// which is available after the chain has run.
+type Result interface {
+	Result() interface{}
+}
+
+// FoldFunc combines the accumulator with the next item
+// and returns the new accumulator.
+type FoldFunc func(acc, item interface{}) interface{}
+
+// Fold is a Consumer that reduces all incoming data
+// to one value, starting with an initial value
+// and combining it with each item using a FoldFunc,
+// e.g. to compute sums, concatenations or maxima.
+// The final accumulator is available through Result.
+type Fold struct {
+	init interface{}
+	f    FoldFunc
+	acc  interface{}
+}
+
+// NewFold creates a new Fold Consumer.
+func NewFold(init interface{}, f FoldFunc) (fd *Fold) {
+	if f == nil {
+		return nil
+	}
+	fd = new(Fold)
+	if fd != nil {
+		fd.init = init
+		fd.f = f
+		fd.acc = init
+	}
+	return
+}
+
+// Consume is the pre-defined method that makes Fold a Consumer.
+func (fd *Fold) Consume(src conduit.Source) error {
+	fd.acc = fd.init
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			continue
+		}
+		fd.acc = fd.f(fd.acc, inp)
+	}
+	return nil
+}
+
+// Volatile is the pre-defined method that makes Fold a conduit.Volatile:
+// the accumulated value is not included in checkpoints.
+func (fd *Fold) Volatile() bool {
+	return true
+}
+
+// Result returns the final accumulator.
+func (fd *Fold) Result() interface{} {
+	return fd.acc
+}
+
+// Scan is a Conduit that combines each incoming item
+// with an accumulator using a FoldFunc, like Fold does,
+// but sends the accumulator down the chain after every item,
+// e.g. to compute prefix sums, running maxima
+// or cumulative counts.
+type Scan struct {
+	init interface{}
+	f    FoldFunc
+}
+
+// NewScan creates a new Scan Conduit.
+func NewScan(init interface{}, f FoldFunc) (sc *Scan) {
+	if f == nil {
+		return nil
+	}
+	sc = new(Scan)
+	if sc != nil {
+		sc.init = init
+		sc.f = f
+	}
+	return
+}
+
+// Conduct is the pre-defined method that makes Scan a Conduit.
+func (sc *Scan) Conduct(src conduit.Source, trg conduit.Target) error {
+	acc := sc.init
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			trg <- inp
+			continue
+		}
+		acc = sc.f(acc, inp)
+		trg <- acc
+	}
+	return nil
+}
+
+// Volatile is the pre-defined method that makes Scan a conduit.Volatile:
+// the accumulated value is not included in checkpoints.
+func (sc *Scan) Volatile() bool {
+	return true
+}
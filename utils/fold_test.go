@@ -0,0 +1,98 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/toschoo/conduit"
+)
+
+func sum(acc, item interface{}) interface{} {
+	return acc.(int) + item.(int)
+}
+
+// Fold:
+// - It is processed without errors
+// - The result is the sum of all data
+// - The fold can be run again
+func TestFoldChain(t *testing.T) {
+	for i := 0; i < numOfTests; i++ {
+		err := testFoldChain(numOfData)
+		if err != nil {
+			m := fmt.Sprintf("FoldChain failed: %v", err)
+			t.Error(m)
+		}
+	}
+}
+
+func testFoldChain(n int) error {
+
+	mydata := makeTestData(n)
+
+	p := &SeqProducer{mydata}
+	c := NewFold(0, sum)
+
+	chn := conduit.NewChain(p, nil, c, small)
+
+	expected := 0
+	for _, v := range mydata {
+		expected += v
+	}
+	for i := 0; i < 2; i++ {
+		err := chn.Run()
+		if err != nil {
+			m := fmt.Sprintf("error on running chain: %v", err)
+			return errors.New(m)
+		}
+		var r Result = c
+		if r.Result().(int) != expected {
+			m := fmt.Sprintf("expected %d, have %v", expected, r.Result())
+			return errors.New(m)
+		}
+	}
+	return nil
+}
+
+// Scan:
+// - It is processed without errors
+// - Each item is replaced by the prefix sum
+func TestScanChain(t *testing.T) {
+	for i := 0; i < numOfTests; i++ {
+		err := testScanChain(numOfData)
+		if err != nil {
+			m := fmt.Sprintf("ScanChain failed: %v", err)
+			t.Error(m)
+		}
+	}
+}
+
+func testScanChain(n int) error {
+
+	mydata := makeTestData(n)
+
+	p := &SeqProducer{mydata}
+	c := new(BaseConsumer)
+
+	pipe := []conduit.Conduit{NewScan(0, sum)}
+
+	chn := conduit.NewChain(p, pipe, c, small)
+
+	err := chn.Run()
+	if err != nil {
+		m := fmt.Sprintf("error on running chain: %v", err)
+		return errors.New(m)
+	}
+	if len(c.recvd) != n {
+		m := fmt.Sprintf("expected %d items, have %d", n, len(c.recvd))
+		return errors.New(m)
+	}
+	acc := 0
+	for i := 0; i < n; i++ {
+		acc += mydata[i]
+		if c.recvd[i] != acc {
+			return errors.New("Received values differ from prefix sums!")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package utils
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+// FileFollower is a Producer that follows a growing file
+// like tail -f and sends the lines appended to it
+// as strings (without line terminator) down the chain.
+// Incomplete lines are held back until they are terminated.
+// By default, following starts at the end of the file;
+// with FromStart, the lines already in the file are sent first.
+// The file is checked periodically (see SetInterval).
+// When it is truncated, following continues at its start;
+// when it is rotated, i.e. renamed or removed and replaced
+// by a new file, the rest of the old file is read
+// and following continues at the start of the new file.
+// A file that does not exist (yet) is waited for.
+// The follower runs until it is canceled.
+type FileFollower struct {
+	conduit.Cancelable
+	path     string
+	interval time.Duration
+	start    bool
+	file     *os.File
+	info     os.FileInfo
+	offset   int64
+	partial  []byte
+}
+
+// NewFileFollower creates a new FileFollower Producer
+// that follows the file at path.
+func NewFileFollower(path string) (ff *FileFollower) {
+	if path == "" {
+		return nil
+	}
+	ff = new(FileFollower)
+	if ff != nil {
+		ff.path = path
+		ff.interval = 250 * time.Millisecond
+	}
+	return
+}
+
+// SetInterval checks the file every d (default: 250ms).
+func (ff *FileFollower) SetInterval(d time.Duration) *FileFollower {
+	if d > 0 {
+		ff.interval = d
+	}
+	return ff
+}
+
+// FromStart sends the lines already in the file
+// when following starts.
+func (ff *FileFollower) FromStart() *FileFollower {
+	ff.start = true
+	return ff
+}
+
+// Resume is the pre-defined method that makes FileFollower
+// a conduit.Resumer. After a restart, following starts anew,
+// so nothing is skipped; with FromStart, the lines
+// already in the file are sent again.
+func (ff *FileFollower) Resume(pos uint64) error {
+	return nil
+}
+
+// Produce is the pre-defined method that makes FileFollower a Producer.
+func (ff *FileFollower) Produce(trg conduit.Target) error {
+	defer ff.close()
+	ff.partial = nil
+	for first := true; !ff.Canceled(); first = false {
+		err := ff.poll(first, trg)
+		if err != nil {
+			return err
+		}
+		sleep(ff.interval, ff.Canceled)
+	}
+	return nil
+}
+
+func (ff *FileFollower) close() {
+	if ff.file != nil {
+		ff.file.Close()
+		ff.file = nil
+	}
+}
+
+// Opens the file; the file may not exist
+func (ff *FileFollower) open(atEnd bool) error {
+	f, err := os.Open(ff.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	ff.file, ff.info, ff.offset = f, fi, 0
+	if atEnd {
+		ff.offset = fi.Size()
+	}
+	return nil
+}
+
+// Reads what was appended to the file and
+// checks for truncation and rotation
+func (ff *FileFollower) poll(first bool, trg conduit.Target) error {
+	if ff.file == nil {
+		// a file created after start is read from its start
+		err := ff.open(first && !ff.start)
+		if err != nil || ff.file == nil {
+			return err
+		}
+	}
+	fi, err := os.Stat(ff.path)
+	switch {
+	case err == nil && !os.SameFile(fi, ff.info):
+		// rotated: finish the old file, then start with the new one
+		if err := ff.read(trg); err != nil {
+			return err
+		}
+		ff.flush(trg)
+		ff.close()
+		if err := ff.open(false); err != nil || ff.file == nil {
+			return err
+		}
+	case err != nil && !os.IsNotExist(err):
+		return err
+	}
+	cur, err := ff.file.Stat()
+	if err != nil {
+		return err
+	}
+	if cur.Size() < ff.offset {
+		// truncated
+		ff.offset = 0
+		ff.partial = nil
+	}
+	return ff.read(trg)
+}
+
+// Reads from offset to the end and sends the complete lines
+func (ff *FileFollower) read(trg conduit.Target) error {
+	buf := make([]byte, 32*1024)
+	for !ff.Canceled() {
+		n, err := ff.file.ReadAt(buf, ff.offset)
+		ff.offset += int64(n)
+		data := append(ff.partial, buf[:n]...)
+		for {
+			i := bytes.IndexByte(data, '\n')
+			if i < 0 {
+				break
+			}
+			trg <- string(bytes.TrimSuffix(data[:i], []byte{'\r'}))
+			data = data[i+1:]
+		}
+		ff.partial = append([]byte(nil), data...)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sends an incomplete last line
+func (ff *FileFollower) flush(trg conduit.Target) {
+	if len(ff.partial) > 0 {
+		trg <- string(bytes.TrimSuffix(ff.partial, []byte{'\r'}))
+	}
+	ff.partial = nil
+}
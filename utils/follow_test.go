@@ -0,0 +1,114 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+// Waits for the next n lines
+func nextLines(t *testing.T, ch chan interface{}, n int) string {
+	var lines []string
+	for i := 0; i < n; i++ {
+		select {
+		case inp := <-ch:
+			lines = append(lines, inp.(string))
+		case <-time.After(5 * time.Second):
+			t.Fatalf("FileFollower: no line after %v", lines)
+		}
+	}
+	return strings.Join(lines, ",")
+}
+
+// File follower:
+// - Appended lines are sent, incomplete lines are held back
+// - After truncation, the file is read from the start
+// - After rotation, the old file is finished and the new one read
+func TestFileFollower(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "app.log")
+	appendFile := func(data string) {
+		f, err := os.OpenFile(p, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatalf("FileFollower: cannot open log: %v", err)
+		}
+		f.WriteString(data)
+		f.Close()
+	}
+	if NewFileFollower("") != nil {
+		t.Errorf("FileFollower: empty path accepted")
+	}
+	appendFile("a\r\nb\n")
+
+	ch := make(chan interface{}, 10)
+	done := make(chan error)
+	ff := NewFileFollower(p).FromStart().SetInterval(5 * time.Millisecond)
+	go func() {
+		done <- conduit.NewChain(ff, nil, &ForwardConsumer{n: 8, out: ch}, small).Run()
+	}()
+	if l := nextLines(t, ch, 2); l != "a,b" {
+		t.Errorf("FileFollower: received %q", l)
+	}
+	appendFile("c\npart")
+	time.Sleep(20 * time.Millisecond)
+	appendFile("ial\n")
+	if l := nextLines(t, ch, 2); l != "c,partial" {
+		t.Errorf("FileFollower: received %q", l)
+	}
+	// copy and truncate
+	if err := os.Truncate(p, 0); err != nil {
+		t.Fatalf("FileFollower: cannot truncate: %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	appendFile("d\n")
+	if l := nextLines(t, ch, 1); l != "d" {
+		t.Errorf("FileFollower: received %q after truncation", l)
+	}
+	// rename and create
+	if err := os.Rename(p, p+".1"); err != nil {
+		t.Fatalf("FileFollower: cannot rename: %v", err)
+	}
+	f, _ := os.OpenFile(p+".1", os.O_APPEND|os.O_WRONLY, 0644)
+	f.WriteString("e\nlast")
+	f.Close()
+	time.Sleep(20 * time.Millisecond)
+	appendFile("f\n")
+	if l := nextLines(t, ch, 3); l != "e,last,f" {
+		t.Errorf("FileFollower: received %q after rotation", l)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("FileFollower failed: %v", err)
+	}
+
+	// without FromStart, existing lines are skipped
+	ff = NewFileFollower(p).SetInterval(5 * time.Millisecond)
+	go func() {
+		done <- conduit.NewChain(ff, nil, &ForwardConsumer{n: 1, out: ch}, small).Run()
+	}()
+	time.Sleep(20 * time.Millisecond)
+	appendFile("g\n")
+	if l := nextLines(t, ch, 1); l != "g" {
+		t.Errorf("FileFollower: received %q", l)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("FileFollower failed: %v", err)
+	}
+
+	// a missing file is waited for and read from the start
+	p = filepath.Join(filepath.Dir(p), "later.log")
+	ff = NewFileFollower(p).SetInterval(5 * time.Millisecond)
+	go func() {
+		done <- conduit.NewChain(ff, nil, &ForwardConsumer{n: 1, out: ch}, small).Run()
+	}()
+	time.Sleep(20 * time.Millisecond)
+	appendFile("h\n")
+	if l := nextLines(t, ch, 1); l != "h" {
+		t.Errorf("FileFollower: received %q", l)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("FileFollower failed: %v", err)
+	}
+}
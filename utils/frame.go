@@ -0,0 +1,206 @@
+package utils
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/toschoo/conduit"
+)
+
+// Checks the prefix size and returns the largest length it can hold
+func framePrefix(size int) (uint64, bool) {
+	switch size {
+	case 2:
+		return 1<<16 - 1, true
+	case 4:
+		return 1<<32 - 1, true
+	case 8:
+		return 1<<63 - 1, true
+	}
+	return 0, false
+}
+
+// Framer is a Conduit that prefixes incoming []byte (or string)
+// with their length and sends the frames down the chain.
+// Together with Deframer it transmits exact messages
+// over byte streams like TCP connections.
+type Framer struct {
+	size  int
+	order binary.ByteOrder
+	max   uint64
+}
+
+// NewFramer creates a new Framer Conduit.
+// The length prefix has size bytes (2, 4 or 8)
+// and is written in the given byte order,
+// e.g. binary.BigEndian.
+func NewFramer(size int, order binary.ByteOrder) (fr *Framer) {
+	max, ok := framePrefix(size)
+	if !ok || order == nil {
+		return nil
+	}
+	fr = new(Framer)
+	if fr != nil {
+		fr.size = size
+		fr.order = order
+		fr.max = max
+	}
+	return
+}
+
+// SetMaxFrame sets the maximum payload size of a frame.
+// By default it is the largest length that fits into the prefix.
+func (fr *Framer) SetMaxFrame(n uint64) *Framer {
+	if max, _ := framePrefix(fr.size); n <= max {
+		fr.max = n
+	}
+	return fr
+}
+
+// Conduct is the pre-defined method that makes Framer a Conduit.
+// Conduct terminates with an error if an item is not []byte or string
+// or exceeds the maximum frame size.
+func (fr *Framer) Conduct(src conduit.Source, trg conduit.Target) error {
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			trg <- inp
+			continue
+		}
+		var data []byte
+		switch x := inp.(type) {
+		case []byte:
+			data = x
+		case string:
+			data = []byte(x)
+		default:
+			return errors.New(fmt.Sprintf("cannot frame %T", inp))
+		}
+		if uint64(len(data)) > fr.max {
+			return errors.New(fmt.Sprintf("frame of %d bytes exceeds maximum of %d", len(data), fr.max))
+		}
+		frame := make([]byte, fr.size+len(data))
+		switch fr.size {
+		case 2:
+			fr.order.PutUint16(frame, uint16(len(data)))
+		case 4:
+			fr.order.PutUint32(frame, uint32(len(data)))
+		case 8:
+			fr.order.PutUint64(frame, uint64(len(data)))
+		}
+		copy(frame[fr.size:], data)
+		trg <- frame
+	}
+	return nil
+}
+
+// Deframer is a Conduit that receives []byte chunks of a stream
+// of length-prefixed frames, as written by Framer,
+// and sends the payload of each complete frame down the chain.
+// Chunks may split frames at any position.
+// A partially received frame is included in checkpoints
+// (see conduit.Checkpointer).
+type Deframer struct {
+	size     int
+	order    binary.ByteOrder
+	max      uint64
+	buf      []byte // partially received frame
+	restored bool   // buf was restored from a checkpoint
+}
+
+// NewDeframer creates a new Deframer Conduit.
+// Prefix size and byte order must match those of the Framer.
+func NewDeframer(size int, order binary.ByteOrder) (df *Deframer) {
+	max, ok := framePrefix(size)
+	if !ok || order == nil {
+		return nil
+	}
+	df = new(Deframer)
+	if df != nil {
+		df.size = size
+		df.order = order
+		df.max = max
+	}
+	return
+}
+
+// SetMaxFrame sets the maximum payload size of a frame.
+// Frames announcing a larger payload are rejected
+// before any memory is allocated for them.
+func (df *Deframer) SetMaxFrame(n uint64) *Deframer {
+	if max, _ := framePrefix(df.size); n <= max {
+		df.max = n
+	}
+	return df
+}
+
+// Conduct is the pre-defined method that makes Deframer a Conduit.
+// Conduct terminates with an error if a frame exceeds
+// the maximum frame size or the stream ends within a frame.
+// Barriers are forwarded when they arrive,
+// i.e. they may precede frames that are already partially received.
+func (df *Deframer) Conduct(src conduit.Source, trg conduit.Target) error {
+	var buf []byte
+	if df.restored {
+		buf = df.buf
+	}
+	df.restored = false
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			df.buf = buf
+			trg <- inp
+			continue
+		}
+		chunk, ok := inp.([]byte)
+		if !ok {
+			return errors.New(fmt.Sprintf("cannot deframe %T", inp))
+		}
+		buf = append(buf, chunk...)
+		for len(buf) >= df.size {
+			var n uint64
+			switch df.size {
+			case 2:
+				n = uint64(df.order.Uint16(buf))
+			case 4:
+				n = uint64(df.order.Uint32(buf))
+			case 8:
+				n = df.order.Uint64(buf)
+			}
+			if n > df.max {
+				return errors.New(fmt.Sprintf("frame of %d bytes exceeds maximum of %d", n, df.max))
+			}
+			if uint64(len(buf)-df.size) < n {
+				break
+			}
+			end := df.size + int(n)
+			frame := make([]byte, n)
+			copy(frame, buf[df.size:end])
+			trg <- frame
+			buf = buf[end:]
+		}
+		if len(buf) == 0 {
+			buf = nil
+		}
+	}
+	if len(buf) > 0 {
+		return errors.New(fmt.Sprintf("stream ends within a frame (%d bytes left)", len(buf)))
+	}
+	return nil
+}
+
+// Snapshot is the pre-defined method that makes Deframer
+// a conduit.Checkpointer.
+func (df *Deframer) Snapshot() ([]byte, error) {
+	state := make([]byte, len(df.buf))
+	copy(state, df.buf)
+	return state, nil
+}
+
+// Restore is the pre-defined method that makes Deframer
+// a conduit.Checkpointer.
+func (df *Deframer) Restore(b []byte) error {
+	df.buf = make([]byte, len(b))
+	copy(df.buf, b)
+	df.restored = true
+	return nil
+}
@@ -0,0 +1,143 @@
+package utils
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/toschoo/conduit"
+)
+
+// Rechunk concatenates incoming []byte
+// and sends them on in chunks of random size
+type Rechunk struct {
+	drop int // bytes dropped at the end
+}
+
+func (rc *Rechunk) Conduct(src conduit.Source, trg conduit.Target) error {
+	var buf []byte
+	for inp := range src {
+		buf = append(buf, inp.([]byte)...)
+		for len(buf) > 0 {
+			n := 1 + rand.Intn(7)
+			if n+rc.drop > len(buf) {
+				break
+			}
+			trg <- buf[:n]
+			buf = buf[n:]
+		}
+	}
+	if len(buf) > rc.drop {
+		trg <- buf[:len(buf)-rc.drop]
+	}
+	return nil
+}
+
+// Framing:
+// - Messages are framed, rechunked and deframed without errors
+// - Messages are received exactly
+// - for all prefix sizes and both byte orders
+func TestFrameChain(t *testing.T) {
+	for _, size := range []int{2, 4, 8} {
+		for _, order := range []binary.ByteOrder{binary.BigEndian, binary.LittleEndian} {
+			for i := 0; i < numOfTests; i++ {
+				err := testFrameChain(i, size, order)
+				if err != nil {
+					m := fmt.Sprintf("FrameChain failed (%d, %v): %v", size, order, err)
+					t.Error(m)
+				}
+			}
+		}
+	}
+}
+
+func testFrameChain(n int, size int, order binary.ByteOrder) error {
+
+	msgs := make([]interface{}, n)
+	for i := range msgs {
+		msgs[i] = strings.Repeat("x", i%13)
+	}
+
+	c := new(AnyConsumer)
+	pipe := []conduit.Conduit{NewFramer(size, order), new(Rechunk), NewDeframer(size, order)}
+	chn := conduit.NewChain(&AnyProducer{msgs}, pipe, c, small)
+
+	err := chn.Run()
+	if err != nil {
+		m := fmt.Sprintf("error on running chain: %v", chn.Errs)
+		return errors.New(m)
+	}
+	if len(c.recvd) != n {
+		m := fmt.Sprintf("expected %d frames, have %d", n, len(c.recvd))
+		return errors.New(m)
+	}
+	for i, v := range c.recvd {
+		if string(v.([]byte)) != msgs[i].(string) {
+			return errors.New("Received values differ from original!")
+		}
+	}
+	return nil
+}
+
+// Framing errors:
+// - Invalid prefix sizes are rejected
+// - Frames exceeding the maximum are reported by Framer and Deframer
+// - Truncated streams are reported
+func TestFrameErrors(t *testing.T) {
+	if NewFramer(3, binary.BigEndian) != nil || NewDeframer(0, binary.BigEndian) != nil {
+		t.Errorf("FrameErrors: invalid prefix size accepted")
+	}
+	msgs := []interface{}{"short", "much too long"}
+
+	pipe := []conduit.Conduit{NewFramer(2, binary.BigEndian).SetMaxFrame(8)}
+	chn := conduit.NewChain(&AnyProducer{msgs}, pipe, new(AnyConsumer), small)
+	if chn.Run() == nil {
+		t.Errorf("FrameErrors: oversized frame not reported by Framer")
+	}
+
+	pipe = []conduit.Conduit{NewFramer(2, binary.BigEndian), NewDeframer(2, binary.BigEndian).SetMaxFrame(8)}
+	chn = conduit.NewChain(&AnyProducer{msgs}, pipe, new(AnyConsumer), small)
+	if chn.Run() == nil {
+		t.Errorf("FrameErrors: oversized frame not reported by Deframer")
+	}
+
+	pipe = []conduit.Conduit{NewFramer(4, binary.BigEndian), &Rechunk{drop: 1}, NewDeframer(4, binary.BigEndian)}
+	chn = conduit.NewChain(&AnyProducer{msgs}, pipe, new(AnyConsumer), small)
+	if chn.Run() == nil {
+		t.Errorf("FrameErrors: truncated stream not reported")
+	}
+}
+
+// Deframing with checkpoints:
+// - A partial frame preceding a barrier is included in the snapshot
+// - The restored Deframer completes the partial frame
+func TestDeframerRestore(t *testing.T) {
+	df := NewDeframer(2, binary.BigEndian)
+	src := make(chan interface{}, 2)
+	src <- []byte{0, 3, 'a', 'b'}
+	src <- &conduit.Barrier{}
+	close(src)
+	trg := make(chan interface{}, 1)
+	if df.Conduct(src, trg) == nil {
+		t.Errorf("DeframerRestore: truncated stream not reported")
+	}
+	b, err := df.Snapshot()
+	if err != nil {
+		t.Fatalf("DeframerRestore: cannot snapshot: %v", err)
+	}
+	df = NewDeframer(2, binary.BigEndian)
+	if err = df.Restore(b); err != nil {
+		t.Fatalf("DeframerRestore: cannot restore: %v", err)
+	}
+	c := new(AnyConsumer)
+	chn := conduit.NewChain(&AnyProducer{[]interface{}{[]byte{'c'}}}, []conduit.Conduit{df}, c, small)
+	if err = chn.Run(); err != nil {
+		t.Fatalf("DeframerRestore failed: %v", chn.Errs)
+	}
+	if len(c.recvd) != 1 || string(c.recvd[0].([]byte)) != "abc" {
+		t.Errorf("DeframerRestore: unexpected frames %q", c.recvd)
+	}
+}
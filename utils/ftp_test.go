@@ -0,0 +1,255 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+// FTP test server on a local directory
+// supporting EPSV and MLSD only
+type ftpServer struct {
+	ln   net.Listener
+	root string
+}
+
+func newFTPServer(root string) (*ftpServer, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	fs := &ftpServer{ln: ln, root: root}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go fs.serve(conn)
+		}
+	}()
+	return fs, nil
+}
+
+func (fs *ftpServer) url(dir string) string {
+	return fmt.Sprintf("ftp://user:secret@%s/%s", fs.ln.Addr(), dir)
+}
+
+func (fs *ftpServer) path(p string) string {
+	return filepath.Join(fs.root, filepath.FromSlash(p))
+}
+
+func (fs *ftpServer) serve(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	var pasv net.Listener
+	var from string
+	defer func() {
+		if pasv != nil {
+			pasv.Close()
+		}
+	}()
+	// accepts the data connection and runs f on it
+	transfer := func(f func(net.Conn) error) {
+		if pasv == nil {
+			tp.PrintfLine("425 use EPSV first")
+			return
+		}
+		tp.PrintfLine("150 opening data connection")
+		dc, err := pasv.Accept()
+		pasv.Close()
+		pasv = nil
+		if err != nil {
+			tp.PrintfLine("425 %v", err)
+			return
+		}
+		err = f(dc)
+		dc.Close()
+		if err != nil {
+			tp.PrintfLine("451 %v", err)
+			return
+		}
+		tp.PrintfLine("226 transfer complete")
+	}
+	reply := func(err error, code int, msg string) {
+		if err != nil {
+			tp.PrintfLine("550 %v", err)
+			return
+		}
+		tp.PrintfLine("%d %s", code, msg)
+	}
+	tp.PrintfLine("220 ready")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd, arg := line, ""
+		if i := strings.Index(line, " "); i >= 0 {
+			cmd, arg = line[:i], line[i+1:]
+		}
+		switch cmd {
+		case "USER":
+			tp.PrintfLine("331 password required")
+		case "PASS":
+			if arg != "secret" {
+				tp.PrintfLine("530 login incorrect")
+			} else {
+				tp.PrintfLine("230 logged in")
+			}
+		case "TYPE":
+			tp.PrintfLine("200 type set")
+		case "PASV":
+			tp.PrintfLine("502 not implemented")
+		case "EPSV":
+			pasv, err = net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				tp.PrintfLine("425 %v", err)
+				continue
+			}
+			tp.PrintfLine("229 Entering Extended Passive Mode (|||%d|)", pasv.Addr().(*net.TCPAddr).Port)
+		case "MLSD":
+			entries, err := ioutil.ReadDir(fs.path(arg))
+			if err != nil {
+				tp.PrintfLine("550 %v", err)
+				continue
+			}
+			transfer(func(dc net.Conn) error {
+				fmt.Fprintf(dc, "type=cdir; .\r\ntype=pdir; ..\r\n")
+				for _, e := range entries {
+					typ := "file"
+					if e.IsDir() {
+						typ = "dir"
+					}
+					fmt.Fprintf(dc, "type=%s;size=%d;modify=%s; %s\r\n", typ, e.Size(), e.ModTime().UTC().Format("20060102150405.000"), e.Name())
+				}
+				return nil
+			})
+		case "RETR":
+			f, err := os.Open(fs.path(arg))
+			if err != nil {
+				tp.PrintfLine("550 %v", err)
+				continue
+			}
+			transfer(func(dc net.Conn) error {
+				_, err := io.Copy(dc, f)
+				return err
+			})
+			f.Close()
+		case "STOR":
+			f, err := os.Create(fs.path(arg))
+			if err != nil {
+				tp.PrintfLine("550 %v", err)
+				continue
+			}
+			transfer(func(dc net.Conn) error {
+				_, err := io.Copy(f, dc)
+				return err
+			})
+			f.Close()
+		case "RNFR":
+			from = arg
+			tp.PrintfLine("350 ready for RNTO")
+		case "RNTO":
+			reply(os.Rename(fs.path(from), fs.path(arg)), 250, "renamed")
+		case "DELE":
+			reply(os.Remove(fs.path(arg)), 250, "deleted")
+		case "MKD":
+			reply(os.Mkdir(fs.path(arg), 0755), 257, "created")
+		case "QUIT":
+			tp.PrintfLine("221 bye")
+			return
+		default:
+			tp.PrintfLine("502 not implemented")
+		}
+	}
+}
+
+// Names of the files under dir
+func listFiles(dir string) []string {
+	var names []string
+	filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			rel, _ := filepath.Rel(dir, p)
+			names = append(names, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	sort.Strings(names)
+	return names
+}
+
+func TestFTP(t *testing.T) {
+	root := t.TempDir()
+	fs, err := newFTPServer(root)
+	if err != nil {
+		t.Fatalf("FTP: cannot start server: %v", err)
+	}
+	defer fs.ln.Close()
+
+	if NewFTPReader("http://localhost/dir") != nil || NewFTPWriter("ftp://%zz") != nil {
+		t.Errorf("FTP: invalid URLs accepted")
+	}
+
+	var items []interface{}
+	for i := 1; i <= 20; i++ {
+		items = append(items, &RemoteFile{Name: fmt.Sprintf("f%02d.csv", i), Data: []byte(fmt.Sprintf("%d,%d\n", i, i*i))})
+	}
+	items = append(items, &ArchiveEntry{Name: "sub/readme.txt", Data: []byte("hello")}, "plain text", map[string]int{"n": 1})
+	fw := NewFTPWriter(fs.url("in")).SetNaming(func(n int) string { return fmt.Sprintf("item-%d.txt", n) })
+	if err := conduit.NewChain(&AnyProducer{src: items}, nil, fw, small).Run(); err != nil {
+		t.Fatalf("FTPWriter failed: %v", err)
+	}
+	files := listFiles(filepath.Join(root, "in"))
+	if len(files) != 23 || files[0] != "f01.csv" || files[20] != "item-22.txt" || files[22] != "sub/readme.txt" {
+		t.Fatalf("FTPWriter: unexpected files %v", files)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(root, "in", "item-23.txt")); string(data) != `{"n":1}` {
+		t.Errorf("FTPWriter: unexpected contents %q", data)
+	}
+	// existing files are replaced
+	fw = NewFTPWriter(fs.url("in"))
+	if err := conduit.NewChain(&AnyProducer{src: []interface{}{&RemoteFile{Name: "f01.csv", Data: []byte("1,one\n")}}}, nil, fw, small).Run(); err != nil {
+		t.Fatalf("FTPWriter failed: %v", err)
+	}
+	fw = NewFTPWriter(fs.url("in"))
+	if err := conduit.NewChain(&AnyProducer{src: []interface{}{&RemoteFile{Name: "../escape", Data: []byte("x")}}}, nil, fw, small).Run(); err == nil {
+		t.Errorf("FTPWriter: file outside of directory written")
+	}
+
+	c := &TakeConsumer{n: -1}
+	fr := NewFTPReader(fs.url("in")).Match("*.csv").SetMoveTo("in/done")
+	if err := conduit.NewChain(fr, nil, c, small).Run(); err != nil {
+		t.Fatalf("FTPReader failed: %v", err)
+	}
+	if len(c.recvd) != 20 {
+		t.Fatalf("FTPReader: %d files received", len(c.recvd))
+	}
+	for i, inp := range c.recvd {
+		f := inp.(*RemoteFile)
+		want := fmt.Sprintf("%d,%d\n", i+1, (i+1)*(i+1))
+		if i == 0 {
+			want = "1,one\n"
+		}
+		if f.Name != fmt.Sprintf("f%02d.csv", i+1) || f.Path != "in/"+f.Name || string(f.Data) != want || f.Size != int64(len(want)) {
+			t.Errorf("FTPReader: unexpected file %s (%s): %q", f.Name, f.Path, f.Data)
+		}
+		if time.Since(f.ModTime) > time.Hour {
+			t.Errorf("FTPReader: unexpected time %v", f.ModTime)
+		}
+	}
+	files = listFiles(filepath.Join(root, "in"))
+	if len(files) != 23 || files[0] != "done/f01.csv" || files[20] != "item-22.txt" {
+		t.Errorf("FTPReader: files not moved: %v", files)
+	}
+}
@@ -0,0 +1,237 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TokenSource obtains an OAuth2 access token.
+type TokenSource func(ctx context.Context) (string, error)
+
+// StaticToken returns a TokenSource that always returns token.
+func StaticToken(token string) TokenSource {
+	return func(context.Context) (string, error) {
+		return token, nil
+	}
+}
+
+// ServiceAccountToken returns a TokenSource that obtains tokens
+// for a Google service account with the JSON key of the account.
+// The token is requested with a JWT signed with the private key
+// and cached until shortly before it expires.
+// Scopes default to https://www.googleapis.com/auth/cloud-platform.
+func ServiceAccountToken(key []byte, scopes ...string) (TokenSource, error) {
+	var sa struct {
+		ClientEmail string `json:"client_email"`
+		PrivateKey  string `json:"private_key"`
+		TokenURI    string `json:"token_uri"`
+	}
+	err := json.Unmarshal(key, &sa)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode([]byte(sa.PrivateKey))
+	if block == nil {
+		return nil, errors.New("no private key in service account key")
+	}
+	pk, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rk, ok := pk.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("private key of service account is not an RSA key")
+	}
+	if sa.TokenURI == "" {
+		sa.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+	if len(scopes) == 0 {
+		scopes = []string{"https://www.googleapis.com/auth/cloud-platform"}
+	}
+	var door sync.Mutex
+	var token string
+	var expiry time.Time
+	return func(ctx context.Context) (string, error) {
+		door.Lock()
+		defer door.Unlock()
+		if token != "" && time.Now().Before(expiry) {
+			return token, nil
+		}
+		now := time.Now()
+		jwt, err := signJWT(rk, map[string]interface{}{
+			"iss":   sa.ClientEmail,
+			"scope": strings.Join(scopes, " "),
+			"aud":   sa.TokenURI,
+			"iat":   now.Unix(),
+			"exp":   now.Add(time.Hour).Unix(),
+		})
+		if err != nil {
+			return "", err
+		}
+		form := url.Values{
+			"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+			"assertion":  {jwt},
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, sa.TokenURI, strings.NewReader(form.Encode()))
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer discardBody(rsp.Body)
+		if rsp.StatusCode != http.StatusOK {
+			return "", errors.New(fmt.Sprintf("token request failed: %s", rsp.Status))
+		}
+		var tok struct {
+			AccessToken string `json:"access_token"`
+			ExpiresIn   int    `json:"expires_in"`
+		}
+		err = json.NewDecoder(rsp.Body).Decode(&tok)
+		if err != nil {
+			return "", err
+		}
+		token = tok.AccessToken
+		expiry = now.Add(time.Duration(tok.ExpiresIn)*time.Second - time.Minute)
+		return token, nil
+	}, nil
+}
+
+// Creates a JWT with the claims signed with RS256
+func signJWT(key *rsa.PrivateKey, claims map[string]interface{}) (string, error) {
+	enc := base64.RawURLEncoding
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	unsigned := enc.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`)) + "." + enc.EncodeToString(payload)
+	h := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, h[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + enc.EncodeToString(sig), nil
+}
+
+// GCPConfig configures the access to a Google Cloud service.
+// Names of resources that are not fully qualified
+// (e.g. a topic "events" instead of "projects/p/topics/events")
+// are qualified with Project.
+// Endpoint defaults to https://<service>.googleapis.com
+// and Client to http.DefaultClient.
+// Without Token, requests are not authorized (e.g. for emulators).
+type GCPConfig struct {
+	Project  string
+	Token    TokenSource
+	Endpoint string
+	Client   *http.Client
+}
+
+// GCPError is an error returned by a Google Cloud service.
+type GCPError struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *GCPError) Error() string {
+	return fmt.Sprintf("%s: %s (%d)", e.Code, e.Message, e.Status)
+}
+
+// Retries on network errors, server errors and exhausted quotas
+func gcpRetryable(err error) bool {
+	if e, ok := err.(*GCPError); ok {
+		return retryableStatus(e.Status)
+	}
+	return true
+}
+
+// Client for the REST API of a Google Cloud service
+type gcpClient struct {
+	cfg GCPConfig
+}
+
+func newGCPClient(cfg GCPConfig, service string) gcpClient {
+	if cfg.Client == nil {
+		cfg.Client = http.DefaultClient
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = fmt.Sprintf("https://%s.googleapis.com", service)
+	}
+	cfg.Endpoint = strings.TrimSuffix(cfg.Endpoint, "/")
+	return gcpClient{cfg: cfg}
+}
+
+// Qualified name of a resource of kind (e.g. "topics")
+func (c *gcpClient) resource(kind, name string) string {
+	if strings.Contains(name, "/") {
+		return name
+	}
+	return fmt.Sprintf("projects/%s/%s/%s", c.cfg.Project, kind, name)
+}
+
+// Posts in as JSON to path (e.g. v1/projects/p/topics/t:publish)
+// and decodes the response into out;
+// responses with a status other than 200 are returned as *GCPError
+func (c *gcpClient) post(ctx context.Context, path string, in, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.cfg.Endpoint+"/"+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.cfg.Token != nil {
+		token, err := c.cfg.Token(ctx)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rsp, err := c.cfg.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(rsp.Body)
+	rsp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if rsp.StatusCode != http.StatusOK {
+		var e struct {
+			Error struct {
+				Message string
+				Status  string
+			}
+		}
+		json.Unmarshal(data, &e)
+		if e.Error.Status == "" {
+			e.Error.Status = rsp.Status
+		}
+		return &GCPError{Status: rsp.StatusCode, Code: e.Error.Status, Message: e.Error.Message}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
@@ -0,0 +1,110 @@
+package utils
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Service account tokens:
+// - The token is requested with a JWT signed with the key of the account
+// - The token is cached
+func TestServiceAccountToken(t *testing.T) {
+	rk, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("cannot generate key: %v", err)
+	}
+	var door sync.Mutex
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		door.Lock()
+		requests++
+		door.Unlock()
+		r.ParseForm()
+		parts := strings.Split(r.Form.Get("assertion"), ".")
+		if len(parts) != 3 || r.Form.Get("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		h := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		if rsa.VerifyPKCS1v15(&rk.PublicKey, crypto.SHA256, h[:], sig) != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		claims, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		var c struct{ Iss, Scope string }
+		json.Unmarshal(claims, &c)
+		w.Write([]byte(`{"access_token":"` + c.Iss + "/" + c.Scope + `","expires_in":3600}`))
+	}))
+	defer srv.Close()
+
+	der, _ := x509.MarshalPKCS8PrivateKey(rk)
+	key, _ := json.Marshal(map[string]string{
+		"client_email": "pipeline@project.iam.gserviceaccount.com",
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"token_uri":    srv.URL,
+	})
+	ts, err := ServiceAccountToken(key, "pubsub")
+	if err != nil {
+		t.Fatalf("ServiceAccountToken failed: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		token, err := ts(context.Background())
+		if err != nil || token != "pipeline@project.iam.gserviceaccount.com/pubsub" {
+			t.Fatalf("ServiceAccountToken: unexpected token %s (%v)", token, err)
+		}
+	}
+	door.Lock()
+	defer door.Unlock()
+	if requests != 1 {
+		t.Errorf("ServiceAccountToken: token requested %d times", requests)
+	}
+	if _, err = ServiceAccountToken([]byte(`{"private_key":"none"}`)); err == nil {
+		t.Errorf("ServiceAccountToken: invalid key accepted")
+	}
+}
+
+// Google Cloud errors:
+// - Errors are parsed
+// - Server errors are retryable
+func TestGCPError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error":{"code":404,"message":"Resource not found","status":"NOT_FOUND"}}`))
+	}))
+	defer srv.Close()
+
+	c := newGCPClient(GCPConfig{Project: "p", Token: StaticToken("secret"), Endpoint: srv.URL}, "pubsub")
+	if c.resource("topics", "t") != "projects/p/topics/t" || c.resource("topics", "projects/q/topics/t") != "projects/q/topics/t" {
+		t.Errorf("resource: unexpected names")
+	}
+	err := c.post(context.Background(), "v1/"+c.resource("topics", "t")+":publish", nil, nil)
+	e, ok := err.(*GCPError)
+	if !ok || e.Code != "NOT_FOUND" || e.Message != "Resource not found" || gcpRetryable(e) {
+		t.Errorf("post: unexpected error %v", err)
+	}
+	c = newGCPClient(GCPConfig{Endpoint: srv.URL}, "pubsub")
+	err = c.post(context.Background(), "v1/x", nil, nil)
+	if e, ok = err.(*GCPError); !ok || e.Status != http.StatusUnauthorized {
+		t.Errorf("post: unexpected error %v", err)
+	}
+	if !gcpRetryable(&GCPError{Status: http.StatusServiceUnavailable}) {
+		t.Errorf("gcpRetryable: server error not retryable")
+	}
+}
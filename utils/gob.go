@@ -0,0 +1,150 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+
+	"github.com/toschoo/conduit"
+)
+
+// MarshalGob encodes v with encoding/gob.
+// It is a MarshalFunc for use with Encoder.
+// Values are encoded as interface{}, so that the receiver
+// obtains the original type; types other than
+// the predeclared ones must therefore be registered
+// with gob.Register on both sides.
+// Each result is self-contained including type information.
+func MarshalGob(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(&v)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalGob decodes data produced by MarshalGob
+// into the value v points to.
+// It is an UnmarshalFunc for use with Decoder.
+// The decoded value must be assignable to *v
+// or point to a value assignable to *v.
+func UnmarshalGob(data []byte, v interface{}) error {
+	var x interface{}
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&x)
+	if err != nil {
+		return err
+	}
+	return assignGob(x, v)
+}
+
+// Assigns a decoded value x to the target v points to
+func assignGob(x interface{}, v interface{}) error {
+	if p, ok := v.(*interface{}); ok {
+		*p = x
+		return nil
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errors.New(fmt.Sprintf("cannot decode into %T", v))
+	}
+	xv := reflect.ValueOf(x)
+	t := rv.Elem().Type()
+	switch {
+	case !xv.IsValid():
+		rv.Elem().Set(reflect.Zero(t))
+	case xv.Type().AssignableTo(t):
+		rv.Elem().Set(xv)
+	case xv.Kind() == reflect.Ptr && xv.Elem().Type().AssignableTo(t):
+		rv.Elem().Set(xv.Elem())
+	default:
+		return errors.New(fmt.Sprintf("cannot assign %T to %s", x, t))
+	}
+	return nil
+}
+
+// GobReader is a Producer that reads a gob stream,
+// as written by GobWriter, e.g. from a file or a network connection,
+// and sends the values down the chain.
+type GobReader struct {
+	conduit.Cancelable
+	rd  io.Reader
+	new func() interface{}
+}
+
+// NewGobReader creates a new GobReader Producer.
+// Values are sent with their original type or, if newValue
+// is not nil, assigned to the result of newValue (see UnmarshalGob).
+func NewGobReader(r io.Reader, newValue func() interface{}) (gr *GobReader) {
+	gr = new(GobReader)
+	if gr != nil {
+		gr.rd = r
+		gr.new = newValue
+	}
+	return
+}
+
+// Produce is the pre-defined method that makes GobReader a Producer.
+// Produce terminates without error at the end of the stream.
+func (gr *GobReader) Produce(trg conduit.Target) error {
+	dec := gob.NewDecoder(gr.rd)
+	for !gr.Canceled() {
+		var x interface{}
+		err := dec.Decode(&x)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if gr.new == nil {
+			trg <- x
+			continue
+		}
+		v := gr.new()
+		err = assignGob(x, v)
+		if err != nil {
+			return err
+		}
+		trg <- v
+	}
+	return nil
+}
+
+// GobWriter is a Consumer that writes incoming data
+// as gob stream, e.g. to a file or a network connection.
+// Type information is sent only once per type.
+// Types other than the predeclared ones
+// must be registered with gob.Register.
+// Each value is passed to the writer in a single Write.
+type GobWriter struct {
+	wt io.Writer
+}
+
+// NewGobWriter creates a new GobWriter Consumer.
+func NewGobWriter(w io.Writer) (gw *GobWriter) {
+	gw = new(GobWriter)
+	if gw != nil {
+		gw.wt = w
+	}
+	return
+}
+
+// Consume is the pre-defined method that makes GobWriter a Consumer.
+// Consume terminates with an error if an item cannot be encoded.
+func (gw *GobWriter) Consume(src conduit.Source) error {
+	enc := gob.NewEncoder(gw.wt)
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			continue
+		}
+		err := enc.Encode(&inp)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package utils
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/toschoo/conduit"
+)
+
+func init() {
+	gob.Register(&Point{})
+}
+
+// Gob stream:
+// - Points are sent from one chain to another through a pipe
+// - Points are received with their type
+// - With newValue, Points are received as Points
+func TestGobChain(t *testing.T) {
+	for i := 0; i < numOfTests; i++ {
+		err := testGobChain(i, nil)
+		if err != nil {
+			m := fmt.Sprintf("GobChain failed: %v", err)
+			t.Error(m)
+		}
+		err = testGobChain(i, newPoint)
+		if err != nil {
+			m := fmt.Sprintf("GobChain with newValue failed: %v", err)
+			t.Error(m)
+		}
+	}
+}
+
+func testGobChain(n int, newValue func() interface{}) error {
+
+	points := makePoints(n)
+	r, w := io.Pipe()
+
+	out := conduit.NewChain(&AnyProducer{points}, nil, NewGobWriter(w), small)
+	errs := make(chan error)
+	go func() {
+		err := out.Run()
+		w.Close()
+		errs <- err
+	}()
+
+	c := new(AnyConsumer)
+	in := conduit.NewChain(NewGobReader(r, newValue), nil, c, small)
+	err := in.Run()
+	if err != nil {
+		m := fmt.Sprintf("error on reading: %v", in.Errs)
+		return errors.New(m)
+	}
+	err = <-errs
+	if err != nil {
+		m := fmt.Sprintf("error on writing: %v", out.Errs)
+		return errors.New(m)
+	}
+	if len(c.recvd) != n {
+		m := fmt.Sprintf("expected %d items, have %d", n, len(c.recvd))
+		return errors.New(m)
+	}
+	for i, v := range c.recvd {
+		p, ok := v.(*Point)
+		if !ok {
+			m := fmt.Sprintf("expected *Point, have %T", v)
+			return errors.New(m)
+		}
+		if *p != *points[i].(*Point) {
+			return errors.New("Received values differ from original!")
+		}
+	}
+	return nil
+}
+
+// Gob codec:
+// - Values are encoded and decoded without errors
+// - Unassignable targets are reported
+func TestGobCodecChain(t *testing.T) {
+	values := []interface{}{1, "two", 3.0, []int{4}, []string{"five"}}
+	c := new(AnyConsumer)
+	pipe := []conduit.Conduit{NewEncoder(MarshalGob), NewDecoder(UnmarshalGob, nil)}
+	chn := conduit.NewChain(&AnyProducer{values}, pipe, c, small)
+	err := chn.Run()
+	if err != nil {
+		t.Fatalf("GobCodecChain failed: %v", chn.Errs)
+	}
+	if fmt.Sprint(c.recvd) != fmt.Sprint(values) {
+		t.Errorf("GobCodecChain: expected %v, have %v", values, c.recvd)
+	}
+	buf, _ := MarshalGob("text")
+	var p Point
+	if UnmarshalGob(buf, &p) == nil {
+		t.Errorf("GobCodecChain: unassignable target not reported")
+	}
+}
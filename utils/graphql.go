@@ -0,0 +1,247 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/toschoo/conduit"
+)
+
+// Body of a GraphQL response
+type graphQLResponse struct {
+	Data   interface{} `json:"data"`
+	Errors []struct {
+		Message string        `json:"message"`
+		Path    []interface{} `json:"path"`
+	} `json:"errors"`
+}
+
+// GraphQLReader is a Producer that runs a GraphQL query
+// against an endpoint and sends the nodes of a connection
+// in the result down the chain, decoded as by JSONReader
+// (objects as map[string]interface{}).
+// The connection is given as JSONPath into the data of the result,
+// e.g. "$.repository.issues" for the query
+//
+//	query($cursor: String) {
+//	  repository(owner: "golang", name: "go") {
+//	    issues(first: 100, after: $cursor) {
+//	      nodes { number title }
+//	      pageInfo { hasNextPage endCursor }
+//	    }
+//	  }
+//	}
+//
+// Its nodes are taken from "nodes" or, if missing, from "edges[*].node".
+// As long as pageInfo.hasNextPage is true, the query is run again
+// with pageInfo.endCursor as value of the variable cursor
+// (see SetCursorVariable); a connection without pageInfo
+// is read in one request.
+// Requests that fail with a network error or status 429 or 5xx
+// are retried according to the RetryPolicy (DefaultRetry).
+// Failed requests and responses with errors
+// terminate the producer with an error.
+type GraphQLReader struct {
+	conduit.Cancelable
+	endpoint string
+	query    string
+	conn     *JSONPath
+	vars     map[string]interface{}
+	cursor   string
+	headers  http.Header
+	client   *http.Client
+	retry    RetryPolicy
+	door     sync.Mutex
+	stop     context.CancelFunc
+}
+
+// NewGraphQLReader creates a new GraphQLReader Producer
+// that runs query against endpoint and reads the nodes
+// of the connection at the JSONPath connection.
+func NewGraphQLReader(endpoint, query, connection string) (gr *GraphQLReader) {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || query == "" {
+		return nil
+	}
+	conn, err := CompileJSONPath(connection)
+	if err != nil {
+		return nil
+	}
+	gr = new(GraphQLReader)
+	if gr != nil {
+		gr.endpoint = endpoint
+		gr.query = query
+		gr.conn = conn
+		gr.vars = make(map[string]interface{})
+		gr.cursor = "cursor"
+		gr.headers = make(http.Header)
+		gr.client = http.DefaultClient
+		gr.retry = DefaultRetry
+	}
+	return
+}
+
+// SetVariables sets the variables of the query.
+func (gr *GraphQLReader) SetVariables(vars map[string]interface{}) *GraphQLReader {
+	for k, v := range vars {
+		gr.vars[k] = v
+	}
+	return gr
+}
+
+// SetCursorVariable sets the name of the variable
+// that receives the cursor (default: "cursor").
+// Its value is null in the first request.
+func (gr *GraphQLReader) SetCursorVariable(name string) *GraphQLReader {
+	gr.cursor = name
+	return gr
+}
+
+// SetHeader adds a header to the requests,
+// e.g. Authorization with a token.
+func (gr *GraphQLReader) SetHeader(name, value string) *GraphQLReader {
+	gr.headers.Set(name, value)
+	return gr
+}
+
+// SetClient sets the http.Client (default: http.DefaultClient).
+func (gr *GraphQLReader) SetClient(c *http.Client) *GraphQLReader {
+	gr.client = c
+	return gr
+}
+
+// SetRetry sets the RetryPolicy (default: DefaultRetry).
+func (gr *GraphQLReader) SetRetry(rp RetryPolicy) *GraphQLReader {
+	gr.retry = rp
+	return gr
+}
+
+// Cancel cancels the producer and the request in flight.
+func (gr *GraphQLReader) Cancel() {
+	gr.Cancelable.Cancel()
+	gr.door.Lock()
+	defer gr.door.Unlock()
+	if gr.stop != nil {
+		gr.stop()
+	}
+}
+
+// Produce is the pre-defined method that makes GraphQLReader a Producer.
+func (gr *GraphQLReader) Produce(trg conduit.Target) error {
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	gr.door.Lock()
+	gr.stop = stop
+	gr.door.Unlock()
+
+	vars := make(map[string]interface{}, len(gr.vars)+1)
+	for k, v := range gr.vars {
+		vars[k] = v
+	}
+	vars[gr.cursor] = nil
+	for page := 1; !gr.Canceled(); page++ {
+		data, err := gr.request(ctx, vars)
+		if err != nil {
+			if gr.Canceled() {
+				return nil
+			}
+			return errors.New(fmt.Sprintf("graphql: page %d: %v", page, err))
+		}
+		conn, ok := firstJSON(gr.conn.Find(data)).(map[string]interface{})
+		if !ok {
+			return errors.New(fmt.Sprintf("graphql: page %d: no connection at %s", page, gr.conn))
+		}
+		for _, node := range connectionNodes(conn) {
+			if gr.Canceled() {
+				return nil
+			}
+			trg <- node
+		}
+		info, _ := conn["pageInfo"].(map[string]interface{})
+		if next, _ := info["hasNextPage"].(bool); !next {
+			return nil
+		}
+		cursor, ok := info["endCursor"].(string)
+		if !ok || cursor == vars[gr.cursor] {
+			return errors.New(fmt.Sprintf("graphql: page %d: invalid endCursor %v", page, info["endCursor"]))
+		}
+		vars[gr.cursor] = cursor
+	}
+	return nil
+}
+
+func firstJSON(vs []interface{}) interface{} {
+	if len(vs) == 0 {
+		return nil
+	}
+	return vs[0]
+}
+
+// Nodes of a connection, from nodes or from edges
+func connectionNodes(conn map[string]interface{}) []interface{} {
+	if nodes, ok := conn["nodes"].([]interface{}); ok {
+		return nodes
+	}
+	edges, _ := conn["edges"].([]interface{})
+	nodes := make([]interface{}, 0, len(edges))
+	for _, e := range edges {
+		if edge, ok := e.(map[string]interface{}); ok {
+			nodes = append(nodes, edge["node"])
+		}
+	}
+	return nodes
+}
+
+// Runs the query with vars and returns the data of the result
+func (gr *GraphQLReader) request(ctx context.Context, vars map[string]interface{}) (interface{}, error) {
+	body, err := json.Marshal(map[string]interface{}{"query": gr.query, "variables": vars})
+	if err != nil {
+		return nil, err
+	}
+	var rsp graphQLResponse
+	_, err = gr.retry.run(gr.Canceled, func() (bool, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, gr.endpoint, bytes.NewReader(body))
+		if err != nil {
+			return false, err
+		}
+		for name, vs := range gr.headers {
+			req.Header[name] = vs
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Accept", "application/json")
+		r, err := gr.client.Do(req)
+		if err != nil {
+			return true, err
+		}
+		defer discardBody(r.Body)
+		if r.StatusCode/100 != 2 {
+			msg, _ := ioutil.ReadAll(r.Body)
+			return retryableStatus(r.StatusCode), errors.New(fmt.Sprintf("%s: %s", r.Status, bytes.TrimSpace(msg)))
+		}
+		rsp = graphQLResponse{}
+		err = json.NewDecoder(r.Body).Decode(&rsp)
+		return false, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(rsp.Errors) > 0 {
+		msgs := make([]string, len(rsp.Errors))
+		for i, e := range rsp.Errors {
+			msgs[i] = e.Message
+			if len(e.Path) > 0 {
+				msgs[i] += fmt.Sprintf(" (at %v)", e.Path)
+			}
+		}
+		return nil, errors.New(strings.Join(msgs, "; "))
+	}
+	return rsp.Data, nil
+}
@@ -0,0 +1,148 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/toschoo/conduit"
+)
+
+// GraphQL test server serving 5 issues in pages of 2
+// as nodes or, for queries containing "edges", as edges;
+// the first request fails with 503
+type graphQLServer struct {
+	*httptest.Server
+	door     sync.Mutex
+	requests int
+	cursors  []interface{}
+}
+
+func newGraphQLServer() *graphQLServer {
+	s := &graphQLServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Query     string                 `json:"query"`
+			Variables map[string]interface{} `json:"variables"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || r.Method != http.MethodPost {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		s.door.Lock()
+		s.requests++
+		first := s.requests == 1
+		s.cursors = append(s.cursors, req.Variables["after"])
+		s.door.Unlock()
+		switch {
+		case first:
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		case r.Header.Get("Authorization") != "bearer token":
+			json.NewEncoder(w).Encode(map[string]interface{}{"errors": []interface{}{
+				map[string]interface{}{"message": "bad credentials"}}})
+			return
+		case req.Variables["owner"] != "golang":
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"repository": nil},
+				"errors": []interface{}{map[string]interface{}{"message": "not found", "path": []string{"repository"}}}})
+			return
+		}
+		start := 0
+		if c, ok := req.Variables["after"].(string); ok {
+			start, _ = strconv.Atoi(strings.TrimPrefix(c, "c"))
+		}
+		var nodes, edges []interface{}
+		for i := start + 1; i <= 5 && i <= start+2; i++ {
+			node := map[string]interface{}{"number": i}
+			nodes = append(nodes, node)
+			edges = append(edges, map[string]interface{}{"cursor": fmt.Sprintf("c%d", i), "node": node})
+		}
+		conn := map[string]interface{}{"pageInfo": map[string]interface{}{
+			"hasNextPage": start+2 < 5, "endCursor": fmt.Sprintf("c%d", start+2)}}
+		if strings.Contains(req.Query, "edges") {
+			conn["edges"] = edges
+		} else {
+			conn["nodes"] = nodes
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{
+			"repository": map[string]interface{}{"issues": conn}}})
+	}))
+	return s
+}
+
+func graphQLNumbers(items []interface{}) string {
+	var nums []string
+	for _, inp := range items {
+		nums = append(nums, fmt.Sprint(inp.(map[string]interface{})["number"]))
+	}
+	return strings.Join(nums, ",")
+}
+
+// GraphQL reader:
+// - Nodes of all pages are sent in order
+// - Nodes are taken from nodes or edges
+// - Server errors are retried
+// - Errors in the response fail the producer
+func TestGraphQLReader(t *testing.T) {
+	srv := newGraphQLServer()
+	defer srv.Close()
+	query := `query($owner: String!, $after: String) {
+  repository(owner: $owner, name: "go") {
+    issues(first: 2, after: $after) { nodes { number } pageInfo { hasNextPage endCursor } }
+  }
+}`
+	if NewGraphQLReader("ftp://host", query, "$.x") != nil || NewGraphQLReader(srv.URL, query, "$[") != nil {
+		t.Errorf("GraphQLReader: invalid arguments accepted")
+	}
+	gr := NewGraphQLReader(srv.URL, query, "$.repository.issues").SetVariables(map[string]interface{}{"owner": "golang"}).
+		SetCursorVariable("after").SetHeader("Authorization", "bearer token").SetRetry(fastRetry)
+	c := &AnyConsumer{}
+	if err := conduit.NewChain(gr, nil, c, small).Run(); err != nil {
+		t.Fatalf("GraphQLReader failed: %v", err)
+	}
+	if n := graphQLNumbers(c.recvd); n != "1,2,3,4,5" {
+		t.Errorf("GraphQLReader: received %s", n)
+	}
+	srv.door.Lock()
+	if fmt.Sprint(srv.cursors) != "[<nil> <nil> c2 c4]" {
+		t.Errorf("GraphQLReader: unexpected cursors %v", srv.cursors)
+	}
+	srv.door.Unlock()
+
+	gr = NewGraphQLReader(srv.URL, strings.Replace(query, "nodes { number }", "edges { node { number } }", 1), "repository.issues").
+		SetVariables(map[string]interface{}{"owner": "golang"}).SetCursorVariable("after").SetHeader("Authorization", "bearer token")
+	c = &AnyConsumer{}
+	if err := conduit.NewChain(gr, nil, c, small).Run(); err != nil {
+		t.Fatalf("GraphQLReader failed: %v", err)
+	}
+	if n := graphQLNumbers(c.recvd); n != "1,2,3,4,5" {
+		t.Errorf("GraphQLReader: received %s from edges", n)
+	}
+
+	for _, tc := range []struct {
+		gr  *GraphQLReader
+		err string
+	}{
+		{NewGraphQLReader(srv.URL, query, "$.repository.issues"), "bad credentials"},
+		{NewGraphQLReader(srv.URL, query, "$.repository.issues").SetHeader("Authorization", "bearer token"),
+			"not found (at [repository])"},
+		{NewGraphQLReader(srv.URL, query, "$.repository.pulls").SetHeader("Authorization", "bearer token").
+			SetVariables(map[string]interface{}{"owner": "golang"}), "no connection at $.repository.pulls"},
+		{NewGraphQLReader(srv.URL+"/x", query, "$.x").SetRetry(RetryPolicy{}), "503"},
+	} {
+		if tc.err == "503" {
+			srv.door.Lock()
+			srv.requests = 0
+			srv.door.Unlock()
+		}
+		chn := conduit.NewChain(tc.gr, nil, &AnyConsumer{}, small)
+		if err := chn.Run(); err == nil || !strings.Contains(fmt.Sprint(chn.Errs), tc.err) {
+			t.Errorf("GraphQLReader: expected %q: %v", tc.err, chn.Errs)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package utils
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+// Accumulates are expected to provide the Accumulate method
+// that adds an item to an aggregate and returns
+// the new aggregate. Accumulates are used
+// by GroupBy to maintain per-key aggregates.
+type Accumulate interface {
+	Accumulate(acc, item interface{}) (interface{}, error)
+}
+
+// AccumulateFunc is an ordinary function used as Accumulate.
+type AccumulateFunc func(acc, item interface{}) (interface{}, error)
+
+// Accumulate calls f(acc, item).
+func (f AccumulateFunc) Accumulate(acc, item interface{}) (interface{}, error) {
+	return f(acc, item)
+}
+
+// EmitMode defines when GroupBy sends aggregates down the chain.
+type EmitMode int
+
+const (
+	// EmitAtEnd sends all aggregates when the stream ends.
+	EmitAtEnd EmitMode = iota
+	// EmitOnChange sends the aggregate of a key
+	// each time it changes.
+	EmitOnChange
+	// EmitOnWindow sends all aggregates when a window closes
+	// and starts the next window with empty aggregates.
+	EmitOnWindow
+)
+
+// Group is sent down the chain by GroupBy:
+// the aggregate of one key.
+type Group struct {
+	Key   string
+	Value interface{}
+}
+
+// GroupBy is a Conduit that maintains per-key aggregates
+// of incoming data and sends them down the chain as Group.
+// A GroupBy is created by NewGroupBy(kf).Aggregate(acc).
+type GroupBy struct {
+	kf     KeyFunc
+	acc    Accumulate
+	mode   EmitMode
+	every  time.Duration
+	groups map[string]interface{}
+}
+
+// NewGroupBy creates a new GroupBy that groups items by key;
+// keys are obtained using kf (see KeyFunc and Keyed).
+// The GroupBy emits aggregates at the end of the stream
+// unless another mode is set with Emit.
+func NewGroupBy(kf KeyFunc) (g *GroupBy) {
+	g = new(GroupBy)
+	if g != nil {
+		g.kf = kf
+	}
+	return
+}
+
+// Aggregate defines the Accumulate used to maintain the aggregates.
+// For the first item of a key, acc is nil.
+func (g *GroupBy) Aggregate(acc Accumulate) *GroupBy {
+	g.acc = acc
+	return g
+}
+
+// Emit defines when aggregates are sent down the chain;
+// for EmitOnWindow, window is the length of the windows,
+// which are based on processing time.
+func (g *GroupBy) Emit(mode EmitMode, window time.Duration) *GroupBy {
+	g.mode = mode
+	g.every = window
+	return g
+}
+
+// Conduct is the pre-defined method that makes GroupBy a Conduit.
+// Conduct fails if no Accumulate was defined with Aggregate.
+func (g *GroupBy) Conduct(src conduit.Source, trg conduit.Target) error {
+	if g.acc == nil {
+		for range src {
+		}
+		return errors.New("group by without aggregate")
+	}
+	g.groups = make(map[string]interface{})
+
+	var tick <-chan time.Time
+	if g.mode == EmitOnWindow && g.every > 0 {
+		t := time.NewTicker(g.every)
+		defer t.Stop()
+		tick = t.C
+	}
+	for {
+		select {
+		case inp, ok := <-src:
+			if !ok {
+				g.flush(trg)
+				return nil
+			}
+			if conduit.IsBarrier(inp) {
+				trg <- inp
+				continue
+			}
+			k := keyOf(g.kf, inp)
+			v, err := g.acc.Accumulate(g.groups[k], inp)
+			if err != nil {
+				return err
+			}
+			g.groups[k] = v
+			if g.mode == EmitOnChange {
+				trg <- Group{Key: k, Value: v}
+			}
+		case <-tick:
+			g.flush(trg)
+			g.groups = make(map[string]interface{})
+		}
+	}
+}
+
+// Volatile is the pre-defined method that makes GroupBy a conduit.Volatile:
+// the aggregates are not included in checkpoints.
+func (g *GroupBy) Volatile() bool {
+	return true
+}
+
+// sends all aggregates ordered by key
+func (g *GroupBy) flush(trg conduit.Target) {
+	if g.mode == EmitOnChange {
+		return
+	}
+	keys := make([]string, 0, len(g.groups))
+	for k := range g.groups {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		trg <- Group{Key: k, Value: g.groups[k]}
+	}
+}
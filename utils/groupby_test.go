@@ -0,0 +1,109 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+type GroupConsumer struct {
+	recvd []Group
+}
+
+func (c *GroupConsumer) Consume(src conduit.Source) error {
+	for v := range src {
+		c.recvd = append(c.recvd, v.(Group))
+	}
+	return nil
+}
+
+var countAcc = AccumulateFunc(func(acc, item interface{}) (interface{}, error) {
+	if acc == nil {
+		return 1, nil
+	}
+	return acc.(int) + 1, nil
+})
+
+// GroupBy:
+// - It is processed without errors
+// - At end: one aggregate per key with the final count
+// - On change: the last aggregate per key has the final count
+// - On window: the aggregates per key add up to the final count
+func TestGroupByChain(t *testing.T) {
+	for i := 0; i < numOfTests; i++ {
+		for _, mode := range []EmitMode{EmitAtEnd, EmitOnChange, EmitOnWindow} {
+			err := testGroupByChain(numOfData, 1+rand.Int()%10, mode)
+			if err != nil {
+				m := fmt.Sprintf("GroupByChain failed: %v", err)
+				t.Error(m)
+			}
+		}
+	}
+}
+
+// GroupBy without aggregate:
+// - The error is reported
+func TestGroupByNoAggregate(t *testing.T) {
+	p := &SeqProducer{makeSeq(numOfData)}
+	c := new(GroupConsumer)
+	chn := conduit.NewChain(p, []conduit.Conduit{NewGroupBy(nil)}, c, small)
+	err := chn.Run()
+	if err == nil || len(chn.Errs) != 1 || len(c.recvd) != 0 {
+		t.Errorf("GroupByNoAggregate: unexpected errors: %v", chn.Errs)
+	}
+}
+
+func testGroupByChain(n, k int, mode EmitMode) error {
+
+	p := &SeqProducer{makeSeq(n)}
+	c := new(GroupConsumer)
+
+	g := NewGroupBy(modKey(k)).Aggregate(countAcc).Emit(mode, time.Microsecond)
+
+	chn := conduit.NewChain(p, []conduit.Conduit{g}, c, small)
+
+	err := chn.Run()
+	if err != nil {
+		m := fmt.Sprintf("error on running chain: %v", err)
+		return errors.New(m)
+	}
+
+	expected := make(map[string]int)
+	for i := 0; i < n; i++ {
+		expected[fmt.Sprintf("%d", i%k)]++
+	}
+
+	have := make(map[string]int)
+	for i, g := range c.recvd {
+		switch mode {
+		case EmitAtEnd:
+			if i > 0 && c.recvd[i-1].Key >= g.Key {
+				return errors.New("keys not in order")
+			}
+			have[g.Key] = g.Value.(int)
+		case EmitOnChange:
+			if g.Value.(int) != have[g.Key]+1 {
+				m := fmt.Sprintf("unexpected change for %s: %v", g.Key, g.Value)
+				return errors.New(m)
+			}
+			have[g.Key] = g.Value.(int)
+		case EmitOnWindow:
+			have[g.Key] += g.Value.(int)
+		}
+	}
+	if mode == EmitAtEnd && len(c.recvd) != len(expected) {
+		m := fmt.Sprintf("expected %d groups, have %d", len(expected), len(c.recvd))
+		return errors.New(m)
+	}
+	for k, v := range expected {
+		if have[k] != v {
+			m := fmt.Sprintf("expected %d for %s, have %d", v, k, have[k])
+			return errors.New(m)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,241 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/toschoo/conduit"
+)
+
+// LinearBuckets returns n bucket bounds starting at start
+// with the distance width, e.g. for NewHistogram.
+func LinearBuckets(start, width float64, n int) []float64 {
+	bs := make([]float64, n)
+	for i := range bs {
+		bs[i] = start + float64(i)*width
+	}
+	return bs
+}
+
+// ExponentialBuckets returns n bucket bounds starting at start,
+// each factor times the one before, e.g. for NewHistogram.
+func ExponentialBuckets(start, factor float64, n int) []float64 {
+	bs := make([]float64, n)
+	for i := range bs {
+		bs[i] = start * math.Pow(factor, float64(i))
+	}
+	return bs
+}
+
+// Bucket is one bar of a histogram: the number of values
+// in [Lower, Upper) or, for value histograms, equal to Label.
+type Bucket struct {
+	Label        string
+	Lower, Upper float64
+	Count        uint64
+}
+
+// Histogram is a Consumer that counts numbers in buckets
+// (see NewHistogram) or distinct values (see NewValueHistogram)
+// of incoming items or, if a field is set (see SetField),
+// of that field of records (Record or map[string]interface{});
+// missing fields and nil are ignored. Bucketed histograms
+// terminate with an error on values that are not numbers
+// (or numeric strings).
+// The buckets are available through Result ([]Bucket)
+// and can be rendered as text (see Render and SetOutput).
+type Histogram struct {
+	field  string
+	bounds []float64
+	max    int
+	out    io.Writer
+	counts []uint64
+	values map[string]uint64
+	other  uint64
+	total  uint64
+}
+
+// NewHistogram creates a new Histogram Consumer with buckets
+// between the given ascending bounds and the buckets
+// below the first and from the last bound.
+func NewHistogram(bounds ...float64) (h *Histogram) {
+	if len(bounds) == 0 || !sort.Float64sAreSorted(bounds) {
+		return nil
+	}
+	for i := 1; i < len(bounds); i++ {
+		if bounds[i] == bounds[i-1] {
+			return nil
+		}
+	}
+	h = new(Histogram)
+	if h != nil {
+		h.bounds = bounds
+	}
+	return
+}
+
+// NewValueHistogram creates a new Histogram Consumer
+// counting the distinct values (formatted with fmt.Sprint).
+// At most maxValues values are counted;
+// further values are counted together as "(other)".
+func NewValueHistogram(maxValues int) (h *Histogram) {
+	if maxValues <= 0 {
+		return nil
+	}
+	h = new(Histogram)
+	if h != nil {
+		h.max = maxValues
+	}
+	return
+}
+
+// SetField makes the Histogram count the values of field of records.
+func (h *Histogram) SetField(field string) *Histogram {
+	h.field = field
+	return h
+}
+
+// SetOutput makes the Histogram render itself to w
+// when the input ends.
+func (h *Histogram) SetOutput(w io.Writer) *Histogram {
+	h.out = w
+	return h
+}
+
+// Consume is the pre-defined method that makes Histogram a Consumer.
+func (h *Histogram) Consume(src conduit.Source) error {
+	h.counts = make([]uint64, len(h.bounds)+1)
+	h.values = make(map[string]uint64)
+	h.other, h.total = 0, 0
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			continue
+		}
+		v := inp
+		if h.field != "" {
+			switch x := inp.(type) {
+			case Record:
+				v = x[h.field]
+			case map[string]interface{}:
+				v = x[h.field]
+			default:
+				return errors.New(fmt.Sprintf("cannot count field of %T", inp))
+			}
+			if v == nil {
+				continue
+			}
+		}
+		if err := h.add(v); err != nil {
+			return err
+		}
+	}
+	if h.out != nil {
+		return h.Render(h.out)
+	}
+	return nil
+}
+
+// Volatile is the pre-defined method that makes Histogram a conduit.Volatile:
+// the counts are not included in checkpoints.
+func (h *Histogram) Volatile() bool {
+	return true
+}
+
+func (h *Histogram) add(v interface{}) error {
+	h.total++
+	if h.max > 0 {
+		s := fmt.Sprint(v)
+		if _, ok := h.values[s]; ok || len(h.values) < h.max {
+			h.values[s]++
+		} else {
+			h.other++
+		}
+		return nil
+	}
+	x, err := toFloat(v)
+	if err != nil {
+		return err
+	}
+	h.counts[sort.Search(len(h.bounds), func(i int) bool { return h.bounds[i] > x })]++
+	return nil
+}
+
+// Result returns the buckets as []Bucket:
+// bucketed histograms in order of their bounds
+// (omitting empty buckets below the first and from the last bound),
+// value histograms ordered by count (descending) and value
+// followed by "(other)" (if any).
+func (h *Histogram) Result() interface{} {
+	return h.Buckets()
+}
+
+// Buckets returns the buckets (see Result).
+func (h *Histogram) Buckets() []Bucket {
+	var bs []Bucket
+	if h.max > 0 {
+		for v, n := range h.values {
+			bs = append(bs, Bucket{Label: v, Lower: math.NaN(), Upper: math.NaN(), Count: n})
+		}
+		sort.Slice(bs, func(i, j int) bool {
+			if bs[i].Count != bs[j].Count {
+				return bs[i].Count > bs[j].Count
+			}
+			return bs[i].Label < bs[j].Label
+		})
+		if h.other > 0 {
+			bs = append(bs, Bucket{Label: "(other)", Lower: math.NaN(), Upper: math.NaN(), Count: h.other})
+		}
+		return bs
+	}
+	for i, n := range h.counts {
+		lower, upper := math.Inf(-1), math.Inf(1)
+		if i > 0 {
+			lower = h.bounds[i-1]
+		}
+		if i < len(h.bounds) {
+			upper = h.bounds[i]
+		}
+		if n == 0 && (i == 0 || i == len(h.bounds)) {
+			continue
+		}
+		bs = append(bs, Bucket{
+			Label: fmt.Sprintf("[%g, %g)", lower, upper),
+			Lower: lower, Upper: upper, Count: n,
+		})
+	}
+	return bs
+}
+
+// Width of the longest bar rendered
+const histogramBar = 40
+
+// Render writes the histogram to w as text, one line per bucket
+// with label, bar, count and percentage.
+func (h *Histogram) Render(w io.Writer) error {
+	bs := h.Buckets()
+	width, max := 0, uint64(0)
+	for _, b := range bs {
+		if len(b.Label) > width {
+			width = len(b.Label)
+		}
+		if b.Count > max {
+			max = b.Count
+		}
+	}
+	for _, b := range bs {
+		bar := 0
+		if max > 0 {
+			bar = int(math.Round(float64(b.Count) * histogramBar / float64(max)))
+		}
+		_, err := fmt.Fprintf(w, "%-*s | %-*s %d (%.1f%%)\n", width, b.Label,
+			histogramBar, strings.Repeat("#", bar), b.Count, 100*float64(b.Count)/float64(h.total))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
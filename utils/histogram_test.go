@@ -0,0 +1,66 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/toschoo/conduit"
+)
+
+// Histogram:
+// - Numbers are counted in linear and exponential buckets
+// - Values are counted exactly up to the cap
+// - The histogram is rendered as text at the end
+func TestHistogram(t *testing.T) {
+	if NewHistogram() != nil || NewHistogram(2, 1) != nil || NewHistogram(1, 1) != nil || NewValueHistogram(0) != nil {
+		t.Errorf("Histogram: invalid arguments accepted")
+	}
+	if fmt.Sprint(LinearBuckets(0, 10, 3), ExponentialBuckets(1, 2, 4)) != "[0 10 20] [1 2 4 8]" {
+		t.Errorf("Histogram: unexpected bounds")
+	}
+	items := []interface{}{5, 10, 15.5, 25, &conduit.Barrier{}, "12", 30, 35}
+	h := NewHistogram(LinearBuckets(10, 10, 3)...)
+	if err := conduit.NewChain(&AnyProducer{src: items}, nil, h, small).Run(); err != nil {
+		t.Fatalf("Histogram failed: %v", err)
+	}
+	var r Result = h
+	if s := fmt.Sprint(r.Result()); s != "[{[-Inf, 10) -Inf 10 1} {[10, 20) 10 20 3} {[20, 30) 20 30 1} {[30, +Inf) 30 +Inf 2}]" {
+		t.Errorf("Histogram: unexpected buckets %s", s)
+	}
+
+	var latencies []interface{}
+	for _, ms := range []float64{0.5, 1.5, 1.7, 3, 3, 3, 3, 6, 7} {
+		latencies = append(latencies, Record{"ms": ms}, map[string]interface{}{"other": 1})
+	}
+	out := new(bytes.Buffer)
+	h = NewHistogram(ExponentialBuckets(1, 2, 4)...).SetField("ms").SetOutput(out)
+	if err := conduit.NewChain(&AnyProducer{src: latencies}, nil, h, small).Run(); err != nil {
+		t.Fatalf("Histogram failed: %v", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != 4 || lines[0] != "[-Inf, 1) | ##########                               1 (11.1%)" ||
+		lines[2] != "[2, 4)    | ######################################## 4 (44.4%)" ||
+		!strings.HasSuffix(lines[3], "2 (22.2%)") {
+		t.Errorf("Histogram: unexpected rendering\n%s", out)
+	}
+
+	items = []interface{}{"GET", "POST", "GET", "PUT", "GET", "DELETE", "POST", "PATCH"}
+	h = NewValueHistogram(3)
+	if err := conduit.NewChain(&AnyProducer{src: items}, nil, h, small).Run(); err != nil {
+		t.Fatalf("Histogram failed: %v", err)
+	}
+	var labels []string
+	for _, b := range h.Buckets() {
+		labels = append(labels, fmt.Sprintf("%s=%d", b.Label, b.Count))
+	}
+	if strings.Join(labels, " ") != "GET=3 POST=2 PUT=1 (other)=2" {
+		t.Errorf("Histogram: unexpected values %v", labels)
+	}
+
+	chn := conduit.NewChain(&AnyProducer{src: []interface{}{1, "x"}}, nil, NewHistogram(1), small)
+	if err := chn.Run(); err == nil {
+		t.Errorf("Histogram: non-numeric value accepted")
+	}
+}
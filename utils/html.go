@@ -0,0 +1,777 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/toschoo/conduit"
+)
+
+// Node of a parsed HTML document; text nodes have no tag
+type htmlNode struct {
+	tag      string
+	text     string
+	attrs    []htmlAttr
+	parent   *htmlNode
+	children []*htmlNode
+}
+
+type htmlAttr struct {
+	name, val string
+}
+
+func (n *htmlNode) isElement() bool {
+	return n != nil && n.tag != "" && n.tag != "#document"
+}
+
+func (n *htmlNode) attr(name string) (string, bool) {
+	for _, a := range n.attrs {
+		if a.name == name {
+			return a.val, true
+		}
+	}
+	return "", false
+}
+
+func (n *htmlNode) append(c *htmlNode) {
+	c.parent = n
+	n.children = append(n.children, c)
+}
+
+// Element sibling before n
+func (n *htmlNode) prevElement() *htmlNode {
+	if n.parent == nil {
+		return nil
+	}
+	var prev *htmlNode
+	for _, c := range n.parent.children {
+		if c == n {
+			return prev
+		}
+		if c.isElement() {
+			prev = c
+		}
+	}
+	return nil
+}
+
+// Position among the element siblings (from 1)
+// and number of element siblings
+func (n *htmlNode) position() (int, int) {
+	pos, count := 0, 0
+	for _, c := range n.parent.children {
+		if c.isElement() {
+			count++
+		}
+		if c == n {
+			pos = count
+		}
+	}
+	return pos, count
+}
+
+// Text content with whitespace collapsed;
+// scripts and styles below n are skipped
+func (n *htmlNode) textContent() string {
+	var b strings.Builder
+	var walk func(*htmlNode)
+	walk = func(x *htmlNode) {
+		switch {
+		case x.tag == "":
+			b.WriteString(x.text)
+		case x.tag == "br":
+			b.WriteByte(' ')
+		case x != n && (x.tag == "script" || x.tag == "style"):
+		default:
+			for _, c := range x.children {
+				walk(c)
+			}
+		}
+	}
+	walk(n)
+	return strings.Join(strings.Fields(b.String()), " ")
+}
+
+// Elements without content
+var htmlVoid = map[string]bool{
+	"area": true, "base": true, "br": true, "col": true, "embed": true,
+	"hr": true, "img": true, "input": true, "link": true, "meta": true,
+	"param": true, "source": true, "track": true, "wbr": true,
+}
+
+// Elements whose content is not markup (decoded or not)
+var htmlRaw = map[string]bool{
+	"script": false, "style": false, "textarea": true, "title": true,
+}
+
+// Elements closing an open element (closes) when they start
+// unless an element of scope is found first
+var htmlImplicitEnd = map[string]struct{ closes, scope []string }{
+	"li":     {[]string{"li"}, []string{"ul", "ol"}},
+	"dt":     {[]string{"dt", "dd"}, []string{"dl"}},
+	"dd":     {[]string{"dt", "dd"}, []string{"dl"}},
+	"tr":     {[]string{"tr"}, []string{"table"}},
+	"td":     {[]string{"td", "th"}, []string{"tr", "table"}},
+	"th":     {[]string{"td", "th"}, []string{"tr", "table"}},
+	"thead":  {[]string{"thead", "tbody", "tfoot"}, []string{"table"}},
+	"tbody":  {[]string{"thead", "tbody", "tfoot"}, []string{"table"}},
+	"tfoot":  {[]string{"thead", "tbody", "tfoot"}, []string{"table"}},
+	"option": {[]string{"option"}, []string{"select", "datalist"}},
+}
+
+// Block elements closing an open paragraph
+var htmlClosesP = map[string]bool{
+	"address": true, "article": true, "aside": true, "blockquote": true,
+	"details": true, "div": true, "dl": true, "fieldset": true, "figure": true,
+	"footer": true, "form": true, "h1": true, "h2": true, "h3": true,
+	"h4": true, "h5": true, "h6": true, "header": true, "hr": true,
+	"main": true, "nav": true, "ol": true, "p": true, "pre": true,
+	"section": true, "table": true, "ul": true,
+}
+
+func containsString(ss []string, s string) bool {
+	for _, x := range ss {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Parses an HTML document leniently: unknown end tags are ignored,
+// open elements are closed implicitly as browsers do for
+// paragraphs, list items, table cells and the like.
+func parseHTML(s string) *htmlNode {
+	doc := &htmlNode{tag: "#document"}
+	cur := doc
+	// closes the innermost open element named tag, if any
+	closeTag := func(tag string) {
+		for n := cur; n.isElement(); n = n.parent {
+			if n.tag == tag {
+				cur = n.parent
+				return
+			}
+		}
+	}
+	text := func(t string) {
+		if t != "" {
+			cur.append(&htmlNode{text: t})
+		}
+	}
+	for len(s) > 0 {
+		i := strings.IndexByte(s, '<')
+		if i < 0 {
+			text(html.UnescapeString(s))
+			break
+		}
+		text(html.UnescapeString(s[:i]))
+		s = s[i:]
+		switch {
+		case strings.HasPrefix(s, "<!--"):
+			if j := strings.Index(s[4:], "-->"); j >= 0 {
+				s = s[4+j+3:]
+			} else {
+				s = ""
+			}
+		case strings.HasPrefix(s, "<!") || strings.HasPrefix(s, "<?"):
+			if j := strings.IndexByte(s, '>'); j >= 0 {
+				s = s[j+1:]
+			} else {
+				s = ""
+			}
+		case strings.HasPrefix(s, "</") && len(s) > 2 && isTagStart(s[2]):
+			name, rest := tagName(s[2:])
+			if j := strings.IndexByte(rest, '>'); j >= 0 {
+				s = rest[j+1:]
+			} else {
+				s = ""
+			}
+			closeTag(name)
+		case len(s) > 1 && isTagStart(s[1]):
+			var n *htmlNode
+			var selfClosing bool
+			n, selfClosing, s = parseStartTag(s[1:])
+			if htmlClosesP[n.tag] && cur.tag == "p" {
+				cur = cur.parent
+			}
+			if ie, ok := htmlImplicitEnd[n.tag]; ok {
+				for x := cur; x.isElement() && !containsString(ie.scope, x.tag); x = x.parent {
+					if containsString(ie.closes, x.tag) {
+						cur = x.parent
+						break
+					}
+				}
+			}
+			cur.append(n)
+			if htmlVoid[n.tag] || selfClosing {
+				continue
+			}
+			if decode, ok := htmlRaw[n.tag]; ok {
+				j := indexFold(s, "</"+n.tag)
+				if j < 0 {
+					j = len(s)
+				}
+				t := s[:j]
+				if decode {
+					t = html.UnescapeString(t)
+				}
+				if t != "" {
+					n.append(&htmlNode{text: t})
+				}
+				s = s[j:]
+				continue
+			}
+			cur = n
+		default:
+			text("<")
+			s = s[1:]
+		}
+	}
+	return doc
+}
+
+func isTagStart(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// Reads a lower-case tag or attribute name
+func tagName(s string) (string, string) {
+	i := 0
+	for i < len(s) && !strings.ContainsRune(" \t\r\n\f/>=", rune(s[i])) {
+		i++
+	}
+	return strings.ToLower(s[:i]), s[i:]
+}
+
+// Case-insensitive index of the ASCII string sub in s
+func indexFold(s, sub string) int {
+	for i := 0; i+len(sub) <= len(s); i++ {
+		if strings.EqualFold(s[i:i+len(sub)], sub) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Parses a start tag after '<' and returns the element,
+// whether the tag closes itself and the rest of the document
+func parseStartTag(s string) (*htmlNode, bool, string) {
+	n := new(htmlNode)
+	n.tag, s = tagName(s)
+	for {
+		s = strings.TrimLeft(s, " \t\r\n\f")
+		switch {
+		case s == "":
+			return n, false, s
+		case s[0] == '>':
+			return n, false, s[1:]
+		case strings.HasPrefix(s, "/>"):
+			return n, true, s[2:]
+		case s[0] == '/' || s[0] == '=':
+			s = s[1:]
+			continue
+		}
+		var a htmlAttr
+		a.name, s = tagName(s)
+		s = strings.TrimLeft(s, " \t\r\n\f")
+		if strings.HasPrefix(s, "=") {
+			s = strings.TrimLeft(s[1:], " \t\r\n\f")
+			var v string
+			if s != "" && (s[0] == '"' || s[0] == '\'') {
+				j := strings.IndexByte(s[1:], s[0])
+				if j < 0 {
+					j = len(s) - 1
+				}
+				v, s = s[1:j+1], s[j+1:]
+				if s != "" {
+					s = s[1:]
+				}
+			} else {
+				j := strings.IndexAny(s, " \t\r\n\f>")
+				if j < 0 {
+					j = len(s)
+				}
+				v, s = s[:j], s[j:]
+			}
+			a.val = html.UnescapeString(v)
+		}
+		if _, dup := n.attr(a.name); !dup {
+			n.attrs = append(n.attrs, a)
+		}
+	}
+}
+
+// Simple selector with the combinator relating it
+// to the previous one (0 for the first)
+type cssCompound struct {
+	comb    byte
+	tag     string
+	id      string
+	classes []string
+	attrs   []cssAttr
+	nth     []cssNth
+}
+
+type cssAttr struct {
+	name, op, val string
+}
+
+// Position an+b counted from the start or the end
+type cssNth struct {
+	a, b    int
+	fromEnd bool
+}
+
+// cssSelector is a compiled group of CSS selectors
+type cssSelector struct {
+	expr   string
+	groups [][]cssCompound
+}
+
+// Compiles a CSS selector (see HTMLExtract for the syntax)
+func compileSelector(expr string) (*cssSelector, error) {
+	sel := &cssSelector{expr: expr}
+	for _, g := range splitOutsideQuotes(expr, ',') {
+		cs, err := parseSelectorGroup(strings.TrimSpace(g))
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid selector %s: %v", expr, err))
+		}
+		sel.groups = append(sel.groups, cs)
+	}
+	return sel, nil
+}
+
+func isIdentChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		c == '-' || c == '_' || c >= 0x80
+}
+
+func cssIdent(s string) (string, string) {
+	i := 0
+	for i < len(s) && isIdentChar(s[i]) {
+		i++
+	}
+	return s[:i], s[i:]
+}
+
+func parseSelectorGroup(s string) ([]cssCompound, error) {
+	var cs []cssCompound
+	if s == "" {
+		return nil, errors.New("empty selector")
+	}
+	for s != "" {
+		var c cssCompound
+		if len(cs) > 0 {
+			t := strings.TrimLeft(s, " \t\r\n\f")
+			c.comb = ' '
+			if t != "" && strings.IndexByte(">+~", t[0]) >= 0 {
+				c.comb = t[0]
+				t = strings.TrimLeft(t[1:], " \t\r\n\f")
+			}
+			s = t
+		}
+		var err error
+		c, s, err = parseCompound(c, s)
+		if err != nil {
+			return nil, err
+		}
+		cs = append(cs, c)
+	}
+	return cs, nil
+}
+
+func parseCompound(c cssCompound, s string) (cssCompound, string, error) {
+	universal := strings.HasPrefix(s, "*")
+	if universal {
+		s = s[1:]
+	} else {
+		c.tag, s = cssIdent(s)
+		c.tag = strings.ToLower(c.tag)
+	}
+	start := len(s)
+	for s != "" && strings.IndexByte(" \t\r\n\f>+~", s[0]) < 0 {
+		switch s[0] {
+		case '#', '.':
+			name, rest := cssIdent(s[1:])
+			if name == "" {
+				return c, s, errors.New(fmt.Sprintf("missing name after %c", s[0]))
+			}
+			if s[0] == '#' {
+				c.id = name
+			} else {
+				c.classes = append(c.classes, name)
+			}
+			s = rest
+		case '[':
+			j := matchBracket(s)
+			if j < 0 {
+				return c, s, errors.New("unterminated attribute selector")
+			}
+			a, err := parseAttrSelector(s[1:j])
+			if err != nil {
+				return c, s, err
+			}
+			c.attrs = append(c.attrs, a)
+			s = s[j+1:]
+		case ':':
+			name, rest := cssIdent(s[1:])
+			name = strings.ToLower(name)
+			s = rest
+			switch name {
+			case "first-child":
+				c.nth = append(c.nth, cssNth{0, 1, false})
+			case "last-child":
+				c.nth = append(c.nth, cssNth{0, 1, true})
+			case "only-child":
+				c.nth = append(c.nth, cssNth{0, 1, false}, cssNth{0, 1, true})
+			case "nth-child", "nth-last-child":
+				j := strings.IndexByte(s, ')')
+				if !strings.HasPrefix(s, "(") || j < 0 {
+					return c, s, errors.New(fmt.Sprintf("missing argument of :%s", name))
+				}
+				a, b, err := parseNth(s[1:j])
+				if err != nil {
+					return c, s, err
+				}
+				c.nth = append(c.nth, cssNth{a, b, name == "nth-last-child"})
+				s = s[j+1:]
+			default:
+				return c, s, errors.New(fmt.Sprintf("unsupported pseudo-class :%s", name))
+			}
+		default:
+			return c, s, errors.New(fmt.Sprintf("unexpected %q", s[0]))
+		}
+	}
+	if !universal && c.tag == "" && len(s) == start {
+		return c, s, errors.New("missing selector")
+	}
+	return c, s, nil
+}
+
+func parseAttrSelector(s string) (cssAttr, error) {
+	var a cssAttr
+	s = strings.TrimSpace(s)
+	a.name, s = cssIdent(s)
+	a.name = strings.ToLower(a.name)
+	if a.name == "" {
+		return a, errors.New("missing attribute name")
+	}
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return a, nil
+	}
+	for _, op := range []string{"~=", "|=", "^=", "$=", "*=", "="} {
+		if strings.HasPrefix(s, op) {
+			a.op = op
+			s = strings.TrimSpace(s[len(op):])
+			break
+		}
+	}
+	if a.op == "" || s == "" {
+		return a, errors.New(fmt.Sprintf("invalid attribute selector [%s]", a.name))
+	}
+	if s[0] == '"' || s[0] == '\'' {
+		v, err := unquote(s)
+		if err != nil {
+			return a, err
+		}
+		a.val = v
+		return a, nil
+	}
+	a.val = s
+	return a, nil
+}
+
+// Parses an+b, odd and even
+func parseNth(s string) (int, int, error) {
+	s = strings.ToLower(strings.Replace(s, " ", "", -1))
+	switch s {
+	case "odd":
+		return 2, 1, nil
+	case "even":
+		return 2, 0, nil
+	}
+	i := strings.IndexByte(s, 'n')
+	if i < 0 {
+		b, err := strconv.Atoi(s)
+		return 0, b, err
+	}
+	a, b := 1, 0
+	switch s[:i] {
+	case "", "+":
+	case "-":
+		a = -1
+	default:
+		var err error
+		if a, err = strconv.Atoi(s[:i]); err != nil {
+			return 0, 0, err
+		}
+	}
+	if rest := strings.TrimPrefix(s[i+1:], "+"); rest != "" {
+		var err error
+		if b, err = strconv.Atoi(rest); err != nil {
+			return 0, 0, err
+		}
+	}
+	return a, b, nil
+}
+
+func (c *cssCompound) match(n *htmlNode) bool {
+	if !n.isElement() || c.tag != "" && c.tag != n.tag {
+		return false
+	}
+	if c.id != "" {
+		if v, _ := n.attr("id"); v != c.id {
+			return false
+		}
+	}
+	for _, cl := range c.classes {
+		v, _ := n.attr("class")
+		if !containsString(strings.Fields(v), cl) {
+			return false
+		}
+	}
+	for _, a := range c.attrs {
+		v, ok := n.attr(a.name)
+		if !ok {
+			return false
+		}
+		var m bool
+		switch a.op {
+		case "":
+			m = true
+		case "=":
+			m = v == a.val
+		case "~=":
+			m = containsString(strings.Fields(v), a.val)
+		case "|=":
+			m = v == a.val || strings.HasPrefix(v, a.val+"-")
+		case "^=":
+			m = a.val != "" && strings.HasPrefix(v, a.val)
+		case "$=":
+			m = a.val != "" && strings.HasSuffix(v, a.val)
+		case "*=":
+			m = a.val != "" && strings.Contains(v, a.val)
+		}
+		if !m {
+			return false
+		}
+	}
+	if len(c.nth) > 0 {
+		pos, count := n.position()
+		for _, nth := range c.nth {
+			p := pos
+			if nth.fromEnd {
+				p = count - pos + 1
+			}
+			if nth.a == 0 {
+				if p != nth.b {
+					return false
+				}
+			} else if (p-nth.b)%nth.a != 0 || (p-nth.b)/nth.a < 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Matches n against cs[:i+1] from right to left
+func matchSelector(n *htmlNode, cs []cssCompound, i int) bool {
+	if !cs[i].match(n) {
+		return false
+	}
+	if i == 0 {
+		return true
+	}
+	switch cs[i].comb {
+	case ' ':
+		for p := n.parent; p.isElement(); p = p.parent {
+			if matchSelector(p, cs, i-1) {
+				return true
+			}
+		}
+	case '>':
+		return n.parent.isElement() && matchSelector(n.parent, cs, i-1)
+	case '+':
+		p := n.prevElement()
+		return p != nil && matchSelector(p, cs, i-1)
+	case '~':
+		for p := n.prevElement(); p != nil; p = p.prevElement() {
+			if matchSelector(p, cs, i-1) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (sel *cssSelector) matches(n *htmlNode) bool {
+	for _, cs := range sel.groups {
+		if matchSelector(n, cs, len(cs)-1) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the elements below root matching the selector
+// in document order
+func (sel *cssSelector) selectAll(root *htmlNode) []*htmlNode {
+	var found []*htmlNode
+	var walk func(*htmlNode)
+	walk = func(n *htmlNode) {
+		for _, c := range n.children {
+			if sel.matches(c) {
+				found = append(found, c)
+			}
+			walk(c)
+		}
+	}
+	walk(root)
+	return found
+}
+
+// HTMLField describes a field of the Records created by HTMLExtract:
+// the text (with whitespace collapsed) or the value of the attribute Attr
+// of the first element matching the CSS selector Selector or,
+// with All, of all matching elements.
+// An empty selector denotes the element the Record is created from.
+type HTMLField struct {
+	Selector string
+	Attr     string
+	All      bool
+}
+
+type htmlField struct {
+	HTMLField
+	sel *cssSelector
+}
+
+// HTMLExtract is a Conduit that parses incoming HTML documents
+// and extracts data into Records whose fields are given by HTMLFields,
+// one Record per document or, with a root selector,
+// per element matching the root selector (e.g. each product on a page).
+// Fields of single elements get a string or nil
+// (if no element matches or it has no such attribute);
+// fields with All get []interface{} of strings.
+// Items may be strings, []byte or *HTTPResponse, e.g. from HTTPProducer.
+// The parser is lenient like browsers are and does not fail on
+// malformed documents.
+// Supported selectors are type selectors, *, #id, .class,
+// attribute selectors ([a], [a=v], [a~=v], [a|=v], [a^=v], [a$=v], [a*=v]),
+// :first-child, :last-child, :only-child, :nth-child(an+b),
+// :nth-last-child(an+b), the combinators ' ', >, + and ~
+// and groups separated by commas.
+type HTMLExtract struct {
+	root   *cssSelector
+	fields map[string]htmlField
+}
+
+// NewHTMLExtract creates a new HTMLExtract Conduit
+// with the root selector root ("" for the whole document)
+// from a map of field names to HTMLFields.
+func NewHTMLExtract(root string, fields map[string]HTMLField) (*HTMLExtract, error) {
+	he := new(HTMLExtract)
+	if root != "" {
+		sel, err := compileSelector(root)
+		if err != nil {
+			return nil, err
+		}
+		he.root = sel
+	}
+	he.fields = make(map[string]htmlField, len(fields))
+	for name, f := range fields {
+		hf := htmlField{HTMLField: f}
+		if f.Selector != "" {
+			sel, err := compileSelector(f.Selector)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("field '%s': %v", name, err))
+			}
+			hf.sel = sel
+		}
+		he.fields[name] = hf
+	}
+	return he, nil
+}
+
+// Reads the HTML document of an item
+func htmlDocument(inp interface{}) (string, error) {
+	switch x := inp.(type) {
+	case string:
+		return x, nil
+	case []byte:
+		return string(x), nil
+	case *HTTPResponse:
+		if x.Body == nil {
+			return string(x.Data), nil
+		}
+		defer x.Body.Close()
+		data, err := ioutil.ReadAll(x.Body)
+		return string(data), err
+	}
+	return "", errors.New(fmt.Sprintf("cannot extract HTML from %T", inp))
+}
+
+// Value of a field for one element
+func (f *htmlField) value(n *htmlNode) (string, bool) {
+	if f.Attr == "" {
+		return n.textContent(), true
+	}
+	return n.attr(f.Attr)
+}
+
+func (he *HTMLExtract) record(root *htmlNode) Record {
+	rec := make(Record, len(he.fields))
+	for name, f := range he.fields {
+		ns := []*htmlNode{root}
+		if f.sel != nil {
+			ns = f.sel.selectAll(root)
+		}
+		if !f.All {
+			rec[name] = nil
+			if len(ns) > 0 {
+				if v, ok := f.value(ns[0]); ok {
+					rec[name] = v
+				}
+			}
+			continue
+		}
+		vs := []interface{}{}
+		for _, n := range ns {
+			if v, ok := f.value(n); ok {
+				vs = append(vs, v)
+			}
+		}
+		rec[name] = vs
+	}
+	return rec
+}
+
+// Conduct is the pre-defined method that makes HTMLExtract a Conduit.
+// Conduct terminates with an error on items that are not HTML documents.
+func (he *HTMLExtract) Conduct(src conduit.Source, trg conduit.Target) error {
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			trg <- inp
+			continue
+		}
+		s, err := htmlDocument(inp)
+		if err != nil {
+			return err
+		}
+		doc := parseHTML(s)
+		if he.root == nil {
+			trg <- he.record(doc)
+			continue
+		}
+		for _, n := range he.root.selectAll(doc) {
+			trg <- he.record(n)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package utils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/toschoo/conduit"
+)
+
+const shopHTML = `<!DOCTYPE html>
+<html><head><title>Shop &amp; More</title>
+<style>p { color: red }</style></head>
+<body>
+<!-- <div class="product">hidden</div> -->
+<h1 id=top>Offers</h1>
+<p>Cheap <b>today</b><div class="note">only</div>
+<ul id="products">
+  <li class="product new" data-id="1"><a href="/p/1">Kettle</a><span class=price>19.90</span>
+  <li class="product" data-id="2"><a href='/p/2'>Toaster</a><span class="price">24.50</span>
+  <li class="product sale" data-id="3"><a href="/p/3">Mixer &lt;XL&gt;</a>
+      <img src="/img/3.png" alt="mixer"><span class="price">99.00</span>
+</ul>
+<table><tr><td>a<td>b<tr><td>c</table>
+<script>if (a < b) { document.write("<li>no</li>") }</script>
+</body></html>`
+
+// HTML selectors:
+// - Selectors select the expected elements in document order
+// - Implicitly closed elements are parsed like browsers do
+// - Invalid selectors are reported
+func TestHTMLSelector(t *testing.T) {
+	doc := parseHTML(shopHTML)
+	tests := []struct {
+		sel  string
+		want string
+	}{
+		{"title", "[Shop & More]"},
+		{"h1#top", "[Offers]"},
+		{"#products > li > a", "[Kettle Toaster Mixer <XL>]"},
+		{"li.product.new a", "[Kettle]"},
+		{".product:not", ""},
+		{"li:first-child a, li:last-child a", "[Kettle Mixer <XL>]"},
+		{"li:nth-child(2n+1) span", "[19.90 99.00]"},
+		{"li:nth-child(even) a", "[Toaster]"},
+		{"li:nth-last-child(1) .price", "[99.00]"},
+		{"li[data-id] a[href$='/2']", "[Toaster]"},
+		{"[class~=sale] span", "[99.00]"},
+		{"li[class^=product] + li a", "[Toaster Mixer <XL>]"},
+		{"li.new ~ li a", "[Toaster Mixer <XL>]"},
+		{"img[alt*=ix] + span", "[99.00]"},
+		{"td", "[a b c]"},
+		{"tr:last-child td:only-child", "[c]"},
+		{"p", "[Cheap today]"},
+		{"p .note", "[]"},
+		{"div.product", "[]"},
+		{"script", `[if (a < b) { document.write("<li>no</li>") }]`},
+		{"li li", "[]"},
+		{"head > :first-child", "[Shop & More]"},
+	}
+	for _, tc := range tests {
+		sel, err := compileSelector(tc.sel)
+		if tc.want == "" {
+			if err == nil {
+				t.Errorf("selector %s: invalid selector accepted", tc.sel)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("selector %s: %v", tc.sel, err)
+			continue
+		}
+		var have []string
+		for _, n := range sel.selectAll(doc) {
+			have = append(have, n.textContent())
+		}
+		if fmt.Sprint(have) != tc.want {
+			t.Errorf("selector %s: have %v, want %s", tc.sel, have, tc.want)
+		}
+	}
+	for _, s := range []string{"", "a,", "a >", "li:nth-child(x)", "a[href", "[=x]", "a..b"} {
+		if _, err := compileSelector(s); err == nil {
+			t.Errorf("selector %q: invalid selector accepted", s)
+		}
+	}
+}
+
+// HTMLExtract:
+// - It creates one record per document or root element
+// - Fields hold text, attributes and lists
+// - HTTP responses are accepted
+// - Items that are not HTML fail
+func TestHTMLExtract(t *testing.T) {
+	if _, err := NewHTMLExtract("li[", nil); err == nil {
+		t.Errorf("HTMLExtract: invalid root accepted")
+	}
+	if _, err := NewHTMLExtract("", map[string]HTMLField{"x": {Selector: "a >"}}); err == nil || !strings.HasPrefix(err.Error(), "field 'x'") {
+		t.Errorf("HTMLExtract: invalid field accepted: %v", err)
+	}
+
+	he, err := NewHTMLExtract("li.product", map[string]HTMLField{
+		"id":    {Attr: "data-id"},
+		"name":  {Selector: "a"},
+		"link":  {Selector: "a", Attr: "href"},
+		"image": {Selector: "img", Attr: "src"},
+		"all":   {Selector: "a, span", All: true},
+	})
+	if err != nil {
+		t.Fatalf("HTMLExtract failed: %v", err)
+	}
+	resp := &HTTPResponse{URL: "http://shop", StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader(shopHTML))}
+	ac := &AnyConsumer{}
+	err = conduit.NewChain(&AnyProducer{src: []interface{}{shopHTML, resp}}, []conduit.Conduit{he}, ac, small).Run()
+	if err != nil {
+		t.Fatalf("HTMLExtract failed: %v", err)
+	}
+	if len(ac.recvd) != 6 {
+		t.Fatalf("HTMLExtract: received %d records", len(ac.recvd))
+	}
+	rec := ac.recvd[5].(Record)
+	if rec["id"] != "3" || rec["name"] != "Mixer <XL>" || rec["link"] != "/p/3" || rec["image"] != "/img/3.png" ||
+		fmt.Sprint(rec["all"]) != "[Mixer <XL> 99.00]" {
+		t.Errorf("HTMLExtract: unexpected record %v", rec)
+	}
+	if rec = ac.recvd[0].(Record); rec["image"] != nil || rec["name"] != "Kettle" {
+		t.Errorf("HTMLExtract: unexpected record %v", rec)
+	}
+
+	he, _ = NewHTMLExtract("", map[string]HTMLField{
+		"title":  {Selector: "title"},
+		"prices": {Selector: ".price", All: true},
+		"none":   {Selector: "video", All: true},
+	})
+	ac = &AnyConsumer{}
+	err = conduit.NewChain(&AnyProducer{src: []interface{}{[]byte(shopHTML), &conduit.Barrier{}}}, []conduit.Conduit{he}, ac, small).Run()
+	if err != nil || len(ac.recvd) != 2 || !conduit.IsBarrier(ac.recvd[1]) {
+		t.Fatalf("HTMLExtract: received %v (%v)", ac.recvd, err)
+	}
+	if rec = ac.recvd[0].(Record); rec["title"] != "Shop & More" ||
+		fmt.Sprint(rec["prices"]) != "[19.90 24.50 99.00]" || fmt.Sprint(rec["none"]) != "[]" {
+		t.Errorf("HTMLExtract: unexpected record %v", rec)
+	}
+
+	if err = conduit.NewChain(&AnyProducer{src: []interface{}{1}}, []conduit.Conduit{he}, ac, small).Run(); err == nil {
+		t.Errorf("HTMLExtract: number accepted as HTML")
+	}
+}
@@ -0,0 +1,345 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/toschoo/conduit"
+)
+
+// HTTPResponse is the response to an HTTP request.
+// Data holds the body, or, in streaming mode,
+// Body is a reader on the body, which must be closed.
+type HTTPResponse struct {
+	URL        string
+	StatusCode int
+	Header     http.Header
+	Data       []byte
+	Body       io.ReadCloser
+}
+
+// FailedRequest is a request that could not be completed
+// (after all attempts). Item is the item that caused the request.
+type FailedRequest struct {
+	Item     interface{}
+	Attempts int
+	Err      error
+}
+
+// Retries on server errors and "too many requests"
+func retryableStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= 500
+}
+
+// Discards and closes a response body
+func discardBody(body io.ReadCloser) {
+	io.Copy(ioutil.Discard, body)
+	body.Close()
+}
+
+// Options and logic common to HTTPProducer and HTTPFetcher
+type httpFetch struct {
+	client *http.Client
+	conc   int
+	retry  RetryPolicy
+	stream bool
+	side   conduit.Target
+	door   sync.Mutex
+	err    error
+}
+
+func (f *httpFetch) init() {
+	f.client = http.DefaultClient
+	f.conc = 1
+	f.retry = DefaultRetry
+}
+
+// Records the first error
+func (f *httpFetch) fail(err error) {
+	f.door.Lock()
+	defer f.door.Unlock()
+	if f.err == nil {
+		f.err = err
+	}
+}
+
+func (f *httpFetch) failed() error {
+	f.door.Lock()
+	defer f.door.Unlock()
+	return f.err
+}
+
+// Creates the request for an item (attempt n)
+func httpRequest(ctx context.Context, inp interface{}, n int) (*http.Request, error) {
+	switch x := inp.(type) {
+	case string:
+		return http.NewRequestWithContext(ctx, http.MethodGet, x, nil)
+	case *url.URL:
+		return http.NewRequestWithContext(ctx, http.MethodGet, x.String(), nil)
+	case *http.Request:
+		req := x.WithContext(ctx)
+		if n > 1 && x.Body != nil {
+			if x.GetBody == nil {
+				return nil, errors.New("cannot resend request body")
+			}
+			body, err := x.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+		return req, nil
+	}
+	return nil, errors.New(fmt.Sprintf("cannot request %T", inp))
+}
+
+// Fetches the items from src concurrently
+// and sends the responses (in the order of completion) to trg
+func (f *httpFetch) run(ctx context.Context, src <-chan interface{}, trg conduit.Target, canceled func() bool) error {
+	f.err = nil
+	sem := make(chan struct{}, f.conc)
+	var wg sync.WaitGroup
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			wg.Wait()
+			trg <- inp
+			continue
+		}
+		if f.failed() != nil || canceled() {
+			break
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(inp interface{}) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			f.fetch(ctx, inp, trg, canceled)
+		}(inp)
+	}
+	wg.Wait()
+	return f.failed()
+}
+
+// Fetches one item; in streaming mode,
+// fetch returns when the body is closed
+func (f *httpFetch) fetch(ctx context.Context, inp interface{}, trg conduit.Target, canceled func() bool) {
+	var rsp *http.Response
+	n := 0
+	attempts, err := f.retry.run(canceled, func() (bool, error) {
+		n++
+		if rsp != nil {
+			discardBody(rsp.Body)
+			rsp = nil
+		}
+		req, err := httpRequest(ctx, inp, n)
+		if err != nil {
+			return false, err
+		}
+		rsp, err = f.client.Do(req)
+		if err != nil {
+			return ctx.Err() == nil, err
+		}
+		if retryableStatus(rsp.StatusCode) {
+			return true, errors.New(rsp.Status)
+		}
+		return false, nil
+	})
+	// the last response is sent even if its status is an error
+	if rsp == nil {
+		fr := &FailedRequest{Item: inp, Attempts: attempts, Err: err}
+		if f.side != nil {
+			f.side <- fr
+			return
+		}
+		f.fail(errors.New(fmt.Sprintf("request failed after %d attempts: %v", attempts, err)))
+		return
+	}
+	r := &HTTPResponse{
+		URL:        rsp.Request.URL.String(),
+		StatusCode: rsp.StatusCode,
+		Header:     rsp.Header,
+	}
+	if !f.stream {
+		r.Data, err = ioutil.ReadAll(rsp.Body)
+		rsp.Body.Close()
+		if err != nil {
+			f.fail(err)
+			return
+		}
+		trg <- r
+		return
+	}
+	body := &entryBody{Reader: rsp.Body, done: make(chan struct{})}
+	r.Body = body
+	trg <- r
+	select {
+	case <-body.done:
+	case <-ctx.Done():
+	}
+	rsp.Body.Close()
+}
+
+// HTTPProducer is a Producer that fetches a list of URLs
+// and sends the responses as HTTPResponse down the chain.
+// Requests are sent concurrently (see SetConcurrency),
+// responses are sent in the order in which they complete.
+// Failed requests (network errors or, after all attempts,
+// status 429 or 5xx) are retried according to the RetryPolicy
+// (DefaultRetry). Requests that finally fail with a network error
+// are sent as FailedRequest to the side output "failed"
+// (see conduit.SideOutputter) or, if the side output is not connected,
+// terminate the producer with an error; responses with other
+// status codes are sent down the chain like any other.
+type HTTPProducer struct {
+	conduit.Cancelable
+	httpFetch
+	urls []string
+	stop context.CancelFunc
+}
+
+// NewHTTPProducer creates a new HTTPProducer Producer.
+func NewHTTPProducer(urls ...string) (hp *HTTPProducer) {
+	hp = new(HTTPProducer)
+	if hp != nil {
+		hp.urls = urls
+		hp.init()
+	}
+	return
+}
+
+// SetClient sets the http.Client (default: http.DefaultClient).
+func (hp *HTTPProducer) SetClient(c *http.Client) *HTTPProducer {
+	hp.client = c
+	return hp
+}
+
+// SetConcurrency sets the maximum number of concurrent requests
+// (default: 1).
+func (hp *HTTPProducer) SetConcurrency(n int) *HTTPProducer {
+	if n > 0 {
+		hp.conc = n
+	}
+	return hp
+}
+
+// SetRetry sets the RetryPolicy (default: DefaultRetry).
+func (hp *HTTPProducer) SetRetry(rp RetryPolicy) *HTTPProducer {
+	hp.retry = rp
+	return hp
+}
+
+// Stream sends responses with Body instead of Data.
+// A request counts against the concurrency limit
+// until its Body is closed.
+func (hp *HTTPProducer) Stream() *HTTPProducer {
+	hp.stream = true
+	return hp
+}
+
+// SideOutput is the pre-defined method that makes HTTPProducer
+// a conduit.SideOutputter. HTTPProducer has the side output "failed".
+func (hp *HTTPProducer) SideOutput(name string, trg conduit.Target) {
+	if name == "failed" {
+		hp.side = trg
+	}
+}
+
+// Cancel cancels the producer and the requests in flight.
+func (hp *HTTPProducer) Cancel() {
+	hp.Cancelable.Cancel()
+	hp.door.Lock()
+	defer hp.door.Unlock()
+	if hp.stop != nil {
+		hp.stop()
+	}
+}
+
+// Produce is the pre-defined method that makes HTTPProducer a Producer.
+func (hp *HTTPProducer) Produce(trg conduit.Target) error {
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	hp.door.Lock()
+	hp.stop = stop
+	hp.door.Unlock()
+	if hp.Canceled() {
+		return nil
+	}
+
+	src := make(chan interface{}, len(hp.urls))
+	for _, u := range hp.urls {
+		src <- u
+	}
+	close(src)
+	return hp.run(ctx, src, trg, hp.Canceled)
+}
+
+// HTTPFetcher is a Conduit that fetches the URLs it receives
+// (as string, *url.URL or *http.Request) and sends the responses
+// as HTTPResponse down the chain; the options and the handling
+// of failed requests are the same as for HTTPProducer.
+// Requests with a body are only retried if GetBody is set
+// (as done by http.NewRequest for in-memory bodies).
+type HTTPFetcher struct {
+	httpFetch
+}
+
+// NewHTTPFetcher creates a new HTTPFetcher Conduit.
+func NewHTTPFetcher() (hf *HTTPFetcher) {
+	hf = new(HTTPFetcher)
+	if hf != nil {
+		hf.init()
+	}
+	return
+}
+
+// SetClient sets the http.Client (default: http.DefaultClient).
+func (hf *HTTPFetcher) SetClient(c *http.Client) *HTTPFetcher {
+	hf.client = c
+	return hf
+}
+
+// SetConcurrency sets the maximum number of concurrent requests
+// (default: 1).
+func (hf *HTTPFetcher) SetConcurrency(n int) *HTTPFetcher {
+	if n > 0 {
+		hf.conc = n
+	}
+	return hf
+}
+
+// SetRetry sets the RetryPolicy (default: DefaultRetry).
+func (hf *HTTPFetcher) SetRetry(rp RetryPolicy) *HTTPFetcher {
+	hf.retry = rp
+	return hf
+}
+
+// Stream sends responses with Body instead of Data.
+// A request counts against the concurrency limit
+// until its Body is closed.
+func (hf *HTTPFetcher) Stream() *HTTPFetcher {
+	hf.stream = true
+	return hf
+}
+
+// SideOutput is the pre-defined method that makes HTTPFetcher
+// a conduit.SideOutputter. HTTPFetcher has the side output "failed".
+func (hf *HTTPFetcher) SideOutput(name string, trg conduit.Target) {
+	if name == "failed" {
+		hf.side = trg
+	}
+}
+
+// Conduct is the pre-defined method that makes HTTPFetcher a Conduit.
+// Conduct terminates with an error if a request failed
+// and the side output is not connected;
+// items that are not URLs count as failed requests.
+func (hf *HTTPFetcher) Conduct(src conduit.Source, trg conduit.Target) error {
+	never := func() bool { return false }
+	return hf.run(context.Background(), src, trg, never)
+}
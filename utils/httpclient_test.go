@@ -0,0 +1,156 @@
+package utils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+var fastRetry = RetryPolicy{Attempts: 3, Backoff: ConstantBackoff(time.Millisecond)}
+
+// Test server: /ok/<n> answers with n, /flaky/<n> fails twice with 503,
+// /missing answers 404 and /down always fails with 503
+func newTestServer() (*httptest.Server, *int64) {
+	var calls int64
+	var door sync.Mutex
+	tries := make(map[string]int)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&calls, 1)
+		p := r.URL.Path
+		switch {
+		case strings.HasPrefix(p, "/ok/"):
+			fmt.Fprint(w, strings.TrimPrefix(p, "/ok/"))
+		case strings.HasPrefix(p, "/flaky/"):
+			door.Lock()
+			tries[p]++
+			n := tries[p]
+			door.Unlock()
+			if n < 3 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Header().Set("X-Tries", fmt.Sprint(n))
+			fmt.Fprint(w, strings.TrimPrefix(p, "/flaky/"))
+		case p == "/down":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	return srv, &calls
+}
+
+// Collects the bodies of HTTPResponses
+type ResponseConsumer struct {
+	rsps   []*HTTPResponse
+	bodies []string
+}
+
+func (c *ResponseConsumer) Consume(src conduit.Source) error {
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			continue
+		}
+		r := inp.(*HTTPResponse)
+		data := r.Data
+		if r.Body != nil {
+			var err error
+			data, err = ioutil.ReadAll(r.Body)
+			r.Body.Close()
+			if err != nil {
+				return err
+			}
+		}
+		c.rsps = append(c.rsps, r)
+		c.bodies = append(c.bodies, fmt.Sprintf("%d:%s", r.StatusCode, data))
+	}
+	sort.Strings(c.bodies)
+	return nil
+}
+
+// HTTP producer:
+// - All URLs are fetched concurrently
+// - Server errors are retried
+// - Bodies are sent as data or streamed
+func TestHTTPProducer(t *testing.T) {
+	for _, stream := range []bool{false, true} {
+		srv, _ := newTestServer()
+		var urls []string
+		var want []string
+		for i := 0; i < 10; i++ {
+			urls = append(urls, fmt.Sprintf("%s/ok/%d", srv.URL, i), fmt.Sprintf("%s/flaky/%d", srv.URL, i))
+			want = append(want, fmt.Sprintf("200:%d", i), fmt.Sprintf("200:%d", i))
+		}
+		urls = append(urls, srv.URL+"/missing", srv.URL+"/down")
+		want = append(want, "404:404 page not found\n", "503:")
+		sort.Strings(want)
+
+		hp := NewHTTPProducer(urls...).SetConcurrency(4).SetRetry(fastRetry)
+		if stream {
+			hp.Stream()
+		}
+		c := new(ResponseConsumer)
+		chn := conduit.NewChain(hp, nil, c, small)
+		if chn.Run() != nil {
+			t.Fatalf("HTTPProducer failed: %v", chn.Errs)
+		}
+		if fmt.Sprint(c.bodies) != fmt.Sprint(want) {
+			t.Errorf("HTTPProducer: expected %q, have %q", want, c.bodies)
+		}
+		for _, r := range c.rsps {
+			if strings.Contains(r.URL, "/flaky/") && r.Header.Get("X-Tries") != "3" {
+				t.Errorf("HTTPProducer: unexpected number of tries for %s: %s", r.URL, r.Header.Get("X-Tries"))
+			}
+		}
+		srv.Close()
+	}
+}
+
+// HTTP fetcher:
+// - URLs come from upstream
+// - Failed requests go to the side output
+// - Without side output, failed requests terminate the conduit
+func TestHTTPFetcher(t *testing.T) {
+	srv, _ := newTestServer()
+	defer srv.Close()
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/ok/post", strings.NewReader("body"))
+	items := []interface{}{srv.URL + "/ok/1", dead.URL + "/ok/2", req}
+	hf := NewHTTPFetcher().SetConcurrency(2).SetRetry(fastRetry)
+	c := new(ResponseConsumer)
+	side := new(AnyConsumer)
+	chn := conduit.NewChain(&AnyProducer{items}, []conduit.Conduit{hf}, c, small)
+	err := chn.AddSide(hf, "failed", side)
+	if err != nil {
+		t.Fatalf("HTTPFetcher: cannot add side: %v", err)
+	}
+	if chn.Run() != nil {
+		t.Fatalf("HTTPFetcher failed: %v", chn.Errs)
+	}
+	if fmt.Sprint(c.bodies) != "[200:1 200:post]" {
+		t.Errorf("HTTPFetcher: unexpected responses %q", c.bodies)
+	}
+	if len(side.recvd) != 1 {
+		t.Fatalf("HTTPFetcher: expected 1 failed request, have %v", side.recvd)
+	}
+	fr := side.recvd[0].(*FailedRequest)
+	if fr.Item != dead.URL+"/ok/2" || fr.Attempts != 3 || fr.Err == nil {
+		t.Errorf("HTTPFetcher: unexpected failed request %v", fr)
+	}
+
+	chn = conduit.NewChain(&AnyProducer{items[:2]}, []conduit.Conduit{NewHTTPFetcher().SetRetry(fastRetry)}, new(ResponseConsumer), small)
+	if chn.Run() == nil {
+		t.Errorf("HTTPFetcher: failed request not reported")
+	}
+}
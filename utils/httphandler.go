@@ -0,0 +1,149 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/toschoo/conduit"
+)
+
+// ChainHandler is an http.Handler that runs a chain
+// for each request: the producer reads the request body,
+// the conduits process it and the consumer writes
+// the response. Since components have state,
+// they are created anew for each request.
+// By default, the body is read in []byte blocks (see NewReader)
+// and []byte and string items are written to the response
+// as they are; the response is flushed after each item,
+// so that results are streamed to the client.
+// If the chain fails before anything was written,
+// the handler answers with status 500; otherwise,
+// the response is aborted (see http.ErrAbortHandler).
+type ChainHandler struct {
+	pipe  func(r *http.Request) []conduit.Conduit
+	prod  func(r io.Reader) conduit.Producer
+	cons  func(w io.Writer) conduit.Consumer
+	ctype string
+	sz    uint32
+}
+
+// NewChainHandler creates a new ChainHandler
+// with the conduits created by pipe (which may return nil).
+func NewChainHandler(pipe func(r *http.Request) []conduit.Conduit) (ch *ChainHandler) {
+	if pipe == nil {
+		return nil
+	}
+	ch = new(ChainHandler)
+	if ch != nil {
+		ch.pipe = pipe
+		ch.prod = func(r io.Reader) conduit.Producer { return NewReader(r) }
+		ch.cons = func(w io.Writer) conduit.Consumer { return &textWriter{w} }
+		ch.sz = 128
+	}
+	return
+}
+
+// SetProducer sets the function creating the Producer
+// that reads the request body.
+func (ch *ChainHandler) SetProducer(prod func(r io.Reader) conduit.Producer) *ChainHandler {
+	ch.prod = prod
+	return ch
+}
+
+// SetConsumer sets the function creating the Consumer
+// that writes the response.
+func (ch *ChainHandler) SetConsumer(cons func(w io.Writer) conduit.Consumer) *ChainHandler {
+	ch.cons = cons
+	return ch
+}
+
+// SetContentType sets the Content-Type of responses.
+func (ch *ChainHandler) SetContentType(ctype string) *ChainHandler {
+	ch.ctype = ctype
+	return ch
+}
+
+// SetBufferSize sets the buffer size of the chain (default 128).
+func (ch *ChainHandler) SetBufferSize(sz uint32) *ChainHandler {
+	ch.sz = sz
+	return ch
+}
+
+// ServeHTTP is the pre-defined method that makes ChainHandler
+// an http.Handler.
+func (ch *ChainHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if ch.ctype != "" {
+		w.Header().Set("Content-Type", ch.ctype)
+	}
+	fw := &flushWriter{w: w}
+	chn := conduit.NewChain(ch.prod(r.Body), ch.pipe(r), ch.cons(fw), ch.sz)
+
+	// stop the chain when the client goes away
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-r.Context().Done():
+			chn.Cancel()
+		case <-done:
+		}
+	}()
+
+	err := chn.Run()
+	if err == nil {
+		return
+	}
+	if fw.written {
+		panic(http.ErrAbortHandler)
+	}
+	var msgs []string
+	for _, e := range chn.Errs {
+		msgs = append(msgs, e.Error())
+	}
+	http.Error(w, strings.Join(msgs, "\n"), http.StatusInternalServerError)
+}
+
+// Writer that flushes after each write
+// and remembers whether anything was written
+type flushWriter struct {
+	w       http.ResponseWriter
+	written bool
+}
+
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	fw.written = true
+	n, err := fw.w.Write(p)
+	if f, ok := fw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return n, err
+}
+
+// Consumer that writes []byte and string items
+type textWriter struct {
+	w io.Writer
+}
+
+func (tw *textWriter) Consume(src conduit.Source) error {
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			continue
+		}
+		var err error
+		switch x := inp.(type) {
+		case []byte:
+			_, err = tw.w.Write(x)
+		case string:
+			_, err = io.WriteString(tw.w, x)
+		default:
+			err = errors.New(fmt.Sprintf("cannot write %T", inp))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package utils
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/toschoo/conduit"
+)
+
+// Chain handler:
+// - The request body is converted by a new chain per request
+// - Producer and consumer can be replaced (CSV to JSON lines)
+// - Errors are answered with status 500
+func TestChainHandler(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/gunzip", NewChainHandler(func(*http.Request) []conduit.Conduit {
+		return []conduit.Conduit{NewDecompressor(Gzip(gzip.DefaultCompression))}
+	}).SetContentType("text/plain"))
+	mux.Handle("/csv2json", NewChainHandler(func(*http.Request) []conduit.Conduit { return nil }).
+		SetProducer(func(r io.Reader) conduit.Producer { return NewCSV(r).Header() }).
+		SetConsumer(func(w io.Writer) conduit.Consumer { return NewJSONLWriter(w) }).
+		SetContentType("application/x-ndjson"))
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	text := strings.Repeat("Hello, chain handler!\n", 1000)
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte(text))
+	zw.Close()
+
+	for i := 0; i < numOfTests; i++ {
+		rsp, err := http.Post(srv.URL+"/gunzip", "application/gzip", bytes.NewReader(gz.Bytes()))
+		if err != nil {
+			t.Fatalf("ChainHandler: request failed: %v", err)
+		}
+		body, _ := ioutil.ReadAll(rsp.Body)
+		rsp.Body.Close()
+		if rsp.StatusCode != http.StatusOK || string(body) != text {
+			t.Fatalf("ChainHandler: unexpected response %d (%d bytes)", rsp.StatusCode, len(body))
+		}
+		if rsp.Header.Get("Content-Type") != "text/plain" {
+			t.Errorf("ChainHandler: unexpected content type %s", rsp.Header.Get("Content-Type"))
+		}
+	}
+
+	rsp, err := http.Post(srv.URL+"/csv2json", "text/csv", strings.NewReader("name,age\nann,42\nbob,7\n"))
+	if err != nil {
+		t.Fatalf("ChainHandler: request failed: %v", err)
+	}
+	body, _ := ioutil.ReadAll(rsp.Body)
+	rsp.Body.Close()
+	want := `{"age":"42","name":"ann"}` + "\n" + `{"age":"7","name":"bob"}` + "\n"
+	if string(body) != want {
+		t.Errorf("ChainHandler: expected %q, have %q", want, body)
+	}
+
+	rsp, err = http.Post(srv.URL+"/gunzip", "application/gzip", strings.NewReader("not gzip"))
+	if err != nil {
+		t.Fatalf("ChainHandler: request failed: %v", err)
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("ChainHandler: expected status 500, have %d", rsp.StatusCode)
+	}
+}
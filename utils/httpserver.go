@@ -0,0 +1,191 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+// HTTPServer is a Producer that listens for HTTP requests
+// and sends their bodies down the chain as []byte
+// or, with JSON, as decoded JSON documents.
+// POST and PUT requests are accepted with status 202
+// once the body was sent down the chain; other methods are rejected
+// and bodies that are too large or, with JSON, invalid
+// are answered with status 413 and 400, respectively.
+// The server runs until the chain is canceled (e.g. by conduit.EOS
+// or Chain.Cancel); it then stops accepting connections and waits
+// for the requests in progress (see SetShutdownTimeout).
+type HTTPServer struct {
+	conduit.Cancelable
+	addr    string
+	ln      net.Listener
+	handler http.Handler
+	new     func() interface{}
+	json    bool
+	max     int64
+	timeout time.Duration
+	door    sync.Mutex
+	stop    context.CancelFunc
+	closing bool
+	active  sync.WaitGroup
+}
+
+// NewHTTPServer creates a new HTTPServer Producer
+// listening on addr (see http.Server).
+func NewHTTPServer(addr string) (hs *HTTPServer) {
+	hs = new(HTTPServer)
+	if hs != nil {
+		hs.addr = addr
+		hs.max = 1024 * 1024
+		hs.timeout = 5 * time.Second
+	}
+	return
+}
+
+// NewHTTPServerOn creates a new HTTPServer Producer
+// serving on the listener ln, which is closed at shutdown.
+func NewHTTPServerOn(ln net.Listener) (hs *HTTPServer) {
+	if ln == nil {
+		return nil
+	}
+	hs = NewHTTPServer(ln.Addr().String())
+	if hs != nil {
+		hs.ln = ln
+	}
+	return
+}
+
+// JSON decodes bodies as JSON into the result of newValue
+// (see NewJSONReader).
+func (hs *HTTPServer) JSON(newValue func() interface{}) *HTTPServer {
+	hs.json = true
+	hs.new = newValue
+	return hs
+}
+
+// SetMaxBody sets the maximum size of a body (default 1MiB).
+func (hs *HTTPServer) SetMaxBody(n int64) *HTTPServer {
+	hs.max = n
+	return hs
+}
+
+// SetShutdownTimeout sets how long the server waits at shutdown
+// for the requests in progress (default 5s).
+func (hs *HTTPServer) SetShutdownTimeout(d time.Duration) *HTTPServer {
+	hs.timeout = d
+	return hs
+}
+
+// Cancel cancels the producer and shuts the server down.
+func (hs *HTTPServer) Cancel() {
+	hs.Cancelable.Cancel()
+	hs.door.Lock()
+	defer hs.door.Unlock()
+	if hs.stop != nil {
+		hs.stop()
+	}
+}
+
+// Resume is the pre-defined method that makes HTTPServer
+// a conduit.Resumer. Requests received before a restart
+// are not received again, so nothing is skipped.
+func (hs *HTTPServer) Resume(pos uint64) error {
+	return nil
+}
+
+// Produce is the pre-defined method that makes HTTPServer a Producer.
+func (hs *HTTPServer) Produce(trg conduit.Target) error {
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+
+	ln := hs.ln
+	if ln == nil {
+		var err error
+		ln, err = net.Listen("tcp", hs.addr)
+		if err != nil {
+			return err
+		}
+	}
+	hs.door.Lock()
+	hs.stop = stop
+	hs.closing = false
+	hs.handler = hs.receive(trg)
+	hs.door.Unlock()
+
+	srv := &http.Server{Handler: http.HandlerFunc(hs.serve)}
+	errc := make(chan error, 1)
+	go func() { errc <- srv.Serve(ln) }()
+	if hs.Canceled() {
+		stop()
+	}
+
+	var err error
+	select {
+	case <-ctx.Done():
+		sctx, cancel := context.WithTimeout(context.Background(), hs.timeout)
+		srv.Shutdown(sctx)
+		cancel()
+	case err = <-errc:
+	}
+
+	// no more sends after Produce has returned
+	hs.door.Lock()
+	hs.closing = true
+	hs.door.Unlock()
+	hs.active.Wait()
+	return err
+}
+
+// Dispatches to the handler of the running producer
+func (hs *HTTPServer) serve(w http.ResponseWriter, r *http.Request) {
+	hs.door.Lock()
+	h := hs.handler
+	if hs.closing || h == nil {
+		hs.door.Unlock()
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	hs.active.Add(1)
+	hs.door.Unlock()
+	defer hs.active.Done()
+	h.ServeHTTP(w, r)
+}
+
+// Creates the handler sending to trg
+func (hs *HTTPServer) receive(trg conduit.Target) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost && r.Method != http.MethodPut {
+			w.Header().Set("Allow", "POST, PUT")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, hs.max))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var v interface{} = data
+		if hs.json {
+			v, err = unmarshalNew(json.Unmarshal, data, hs.new)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		trg <- v
+		w.WriteHeader(http.StatusAccepted)
+	})
+}
@@ -0,0 +1,120 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+// Posts body to url and returns the status code
+func post(url, body string) int {
+	rsp, err := http.Post(url, "application/json", strings.NewReader(body))
+	if err != nil {
+		return 0
+	}
+	rsp.Body.Close()
+	return rsp.StatusCode
+}
+
+// HTTP server:
+// - Request bodies are sent down the chain as JSON documents
+// - Invalid requests are rejected
+// - Canceling the chain shuts the server down
+func TestHTTPServer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("HTTPServer: cannot listen: %v", err)
+	}
+	url := "http://" + ln.Addr().String() + "/ingest"
+	hs := NewHTTPServerOn(ln).JSON(nil).SetMaxBody(64)
+	c := new(AnyConsumer)
+	chn := conduit.NewChain(hs, nil, c, small)
+	done := make(chan error)
+	go func() { done <- chn.Run() }()
+
+	type sample struct {
+		body string
+		code int
+	}
+	samples := []sample{
+		{`{"id":1}`, http.StatusAccepted},
+		{`{"id":2}`, http.StatusAccepted},
+		{`{"id":`, http.StatusBadRequest},
+		{`{"id":"` + strings.Repeat("x", 100) + `"}`, http.StatusRequestEntityTooLarge},
+		{`[3]`, http.StatusAccepted},
+	}
+	for _, s := range samples {
+		if code := post(url, s.body); code != s.code {
+			t.Errorf("HTTPServer: expected status %d for %s, have %d", s.code, s.body, code)
+		}
+	}
+	rsp, err := http.Get(url)
+	if err != nil || rsp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("HTTPServer: GET not rejected: %v", err)
+	}
+	if rsp != nil {
+		rsp.Body.Close()
+	}
+
+	chn.Cancel()
+	select {
+	case err = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("HTTPServer: chain did not terminate")
+	}
+	if err != nil {
+		t.Fatalf("HTTPServer failed: %v", chn.Errs)
+	}
+	var have []string
+	for _, v := range c.recvd {
+		have = append(have, fmt.Sprint(v))
+	}
+	sort.Strings(have)
+	if fmt.Sprint(have) != "[[3] map[id:1] map[id:2]]" {
+		t.Errorf("HTTPServer: unexpected items %v", have)
+	}
+	if post(url, `{"id":4}`) != 0 {
+		t.Errorf("HTTPServer: server still running after cancel")
+	}
+}
+
+// HTTP server with raw bodies and concurrent clients
+func TestHTTPServerBodies(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("HTTPServer: cannot listen: %v", err)
+	}
+	url := "http://" + ln.Addr().String()
+	c := new(AnyConsumer)
+	chn := conduit.NewChain(NewHTTPServerOn(ln), nil, c, small)
+	done := make(chan error)
+	go func() { done <- chn.Run() }()
+
+	codes := make(chan int)
+	for i := 0; i < numOfTests; i++ {
+		go func(i int) { codes <- post(url, fmt.Sprint(i)) }(i)
+	}
+	for i := 0; i < numOfTests; i++ {
+		if code := <-codes; code != http.StatusAccepted {
+			t.Errorf("HTTPServer: unexpected status %d", code)
+		}
+	}
+	chn.Cancel()
+	if <-done != nil {
+		t.Fatalf("HTTPServer failed: %v", chn.Errs)
+	}
+	if len(c.recvd) != numOfTests {
+		t.Errorf("HTTPServer: expected %d bodies, have %d", numOfTests, len(c.recvd))
+	}
+	for _, v := range c.recvd {
+		if _, ok := v.([]byte); !ok {
+			t.Errorf("HTTPServer: unexpected item %T", v)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/toschoo/conduit"
+)
+
+// HTTPSink is a Consumer that sends each incoming item,
+// or each batch of items (see SetBatch), as body of an HTTP request.
+// The URL and the headers are templates (see Template),
+// which are rendered with the item (or the batch as []interface{}).
+// Items of type []byte and string are sent as they are,
+// others are encoded with a MarshalFunc (default: json.Marshal);
+// in batches, items are separated by newlines.
+// Requests are sent concurrently (see SetConcurrency).
+// Requests that fail with a network error or status 429 or 5xx
+// are retried according to the RetryPolicy (DefaultRetry);
+// other status codes outside 2xx are not retried.
+// Requests that finally fail are sent as FailedRequest
+// to the side output "failed" (see conduit.SideOutputter),
+// e.g. a dead letter queue, or, if the side output is not connected,
+// terminate the consumer with an error.
+type HTTPSink struct {
+	method  string
+	url     Template
+	headers map[string]Template
+	ctype   string
+	marshal MarshalFunc
+	batch   int
+	client  *http.Client
+	conc    int
+	retry   RetryPolicy
+	side    conduit.Target
+	door    sync.Mutex
+	err     error
+}
+
+// NewHTTPSink creates a new HTTPSink Consumer
+// that sends requests with method to url.
+func NewHTTPSink(method string, url Template) (hs *HTTPSink) {
+	if url == nil {
+		return nil
+	}
+	hs = new(HTTPSink)
+	if hs != nil {
+		hs.method = method
+		hs.url = url
+		hs.headers = make(map[string]Template)
+		hs.marshal = json.Marshal
+		hs.batch = 1
+		hs.client = http.DefaultClient
+		hs.conc = 1
+		hs.retry = DefaultRetry
+	}
+	return
+}
+
+// SetHeader adds a header rendered from value.
+func (hs *HTTPSink) SetHeader(name string, value Template) *HTTPSink {
+	hs.headers[name] = value
+	return hs
+}
+
+// SetContentType sets the Content-Type header.
+func (hs *HTTPSink) SetContentType(ctype string) *HTTPSink {
+	hs.ctype = ctype
+	return hs
+}
+
+// SetMarshal sets the MarshalFunc for items
+// that are neither []byte nor string.
+func (hs *HTTPSink) SetMarshal(marshal MarshalFunc) *HTTPSink {
+	hs.marshal = marshal
+	return hs
+}
+
+// SetBatch sends up to n items per request.
+// Incomplete batches are sent at barriers and at the end of the stream.
+func (hs *HTTPSink) SetBatch(n int) *HTTPSink {
+	if n > 0 {
+		hs.batch = n
+	}
+	return hs
+}
+
+// SetClient sets the http.Client (default: http.DefaultClient).
+func (hs *HTTPSink) SetClient(c *http.Client) *HTTPSink {
+	hs.client = c
+	return hs
+}
+
+// SetConcurrency sets the maximum number of concurrent requests
+// (default: 1).
+func (hs *HTTPSink) SetConcurrency(n int) *HTTPSink {
+	if n > 0 {
+		hs.conc = n
+	}
+	return hs
+}
+
+// SetRetry sets the RetryPolicy (default: DefaultRetry).
+func (hs *HTTPSink) SetRetry(rp RetryPolicy) *HTTPSink {
+	hs.retry = rp
+	return hs
+}
+
+// SideOutput is the pre-defined method that makes HTTPSink
+// a conduit.SideOutputter. HTTPSink has the side output "failed".
+func (hs *HTTPSink) SideOutput(name string, trg conduit.Target) {
+	if name == "failed" {
+		hs.side = trg
+	}
+}
+
+// Records the first error
+func (hs *HTTPSink) fail(err error) {
+	hs.door.Lock()
+	defer hs.door.Unlock()
+	if hs.err == nil {
+		hs.err = err
+	}
+}
+
+func (hs *HTTPSink) failed() error {
+	hs.door.Lock()
+	defer hs.door.Unlock()
+	return hs.err
+}
+
+// Consume is the pre-defined method that makes HTTPSink a Consumer.
+// Consume terminates with an error if a request failed
+// and the side output is not connected.
+func (hs *HTTPSink) Consume(src conduit.Source) error {
+	hs.err = nil
+	sem := make(chan struct{}, hs.conc)
+	var wg sync.WaitGroup
+	var batch []interface{}
+
+	send := func() {
+		if len(batch) == 0 {
+			return
+		}
+		var data interface{} = batch
+		if hs.batch == 1 {
+			data = batch[0]
+		}
+		batch = nil
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			hs.send(data)
+		}()
+	}
+
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			send()
+			wg.Wait()
+			continue
+		}
+		if err := hs.failed(); err != nil {
+			wg.Wait()
+			return err
+		}
+		batch = append(batch, inp)
+		if len(batch) >= hs.batch {
+			send()
+		}
+	}
+	send()
+	wg.Wait()
+	return hs.failed()
+}
+
+// Sends one item or batch
+func (hs *HTTPSink) send(data interface{}) {
+	attempts, err := hs.request(data)
+	if err == nil {
+		return
+	}
+	if hs.side != nil {
+		hs.side <- &FailedRequest{Item: data, Attempts: attempts, Err: err}
+		return
+	}
+	hs.fail(errors.New(fmt.Sprintf("request failed after %d attempts: %v", attempts, err)))
+}
+
+// Renders t with data
+func render(t Template, data interface{}) (string, error) {
+	var b strings.Builder
+	err := t.Execute(&b, data)
+	return b.String(), err
+}
+
+// Encodes an item or a batch
+func (hs *HTTPSink) body(data interface{}) ([]byte, error) {
+	items, ok := data.([]interface{})
+	if !ok || hs.batch == 1 {
+		items = []interface{}{data}
+	}
+	var buf bytes.Buffer
+	for i, inp := range items {
+		if i > 0 {
+			buf.WriteByte('\n')
+		}
+		b, err := payload(inp, hs.marshal)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(b)
+	}
+	return buf.Bytes(), nil
+}
+
+// Sends the request for data with retries
+func (hs *HTTPSink) request(data interface{}) (int, error) {
+	url, err := render(hs.url, data)
+	if err != nil {
+		return 0, err
+	}
+	hdr := make(http.Header)
+	for name, t := range hs.headers {
+		v, err := render(t, data)
+		if err != nil {
+			return 0, err
+		}
+		hdr.Set(name, v)
+	}
+	if hs.ctype != "" {
+		hdr.Set("Content-Type", hs.ctype)
+	}
+	body, err := hs.body(data)
+	if err != nil {
+		return 0, err
+	}
+	return hs.retry.run(nil, func() (bool, error) {
+		req, err := http.NewRequestWithContext(context.Background(), hs.method, url, bytes.NewReader(body))
+		if err != nil {
+			return false, err
+		}
+		req.Header = hdr.Clone()
+		rsp, err := hs.client.Do(req)
+		if err != nil {
+			return true, err
+		}
+		discardBody(rsp.Body)
+		if rsp.StatusCode/100 == 2 {
+			return false, nil
+		}
+		return retryableStatus(rsp.StatusCode), errors.New(rsp.Status)
+	})
+}
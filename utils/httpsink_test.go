@@ -0,0 +1,119 @@
+package utils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"text/template"
+
+	"github.com/toschoo/conduit"
+)
+
+// Test server that records requests;
+// /fail/ fails once with 503, /bad/ fails with 400
+type sinkServer struct {
+	*httptest.Server
+	door  sync.Mutex
+	tries map[string]int
+	recvd []string
+}
+
+func newSinkServer() *sinkServer {
+	s := &sinkServer{tries: make(map[string]int)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		s.door.Lock()
+		defer s.door.Unlock()
+		s.tries[r.URL.Path]++
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/fail/") && s.tries[r.URL.Path] == 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		case strings.HasPrefix(r.URL.Path, "/bad/"):
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		s.recvd = append(s.recvd, fmt.Sprintf("%s %s %s %s %s", r.Method, r.URL.Path,
+			r.Header.Get("Content-Type"), r.Header.Get("X-Id"), body))
+	}))
+	return s
+}
+
+func (s *sinkServer) requests() []string {
+	s.door.Lock()
+	defer s.door.Unlock()
+	sort.Strings(s.recvd)
+	return s.recvd
+}
+
+// HTTP sink:
+// - Items are sent to templated URLs with templated headers
+// - Server errors are retried, client errors are not
+// - Failed requests go to the side output
+func TestHTTPSink(t *testing.T) {
+	srv := newSinkServer()
+	defer srv.Close()
+
+	items := []interface{}{
+		Record{"id": 1, "path": "ok"},
+		Record{"id": 2, "path": "fail"},
+		Record{"id": 3, "path": "bad"},
+		Record{"id": 4, "path": "ok"},
+	}
+	url := template.Must(template.New("url").Parse(srv.URL + "/{{.path}}/{{.id}}"))
+	hdr := template.Must(template.New("hdr").Parse("{{.id}}"))
+	hs := NewHTTPSink(http.MethodPut, url).SetHeader("X-Id", hdr).SetContentType("application/json").
+		SetConcurrency(3).SetRetry(fastRetry)
+	side := new(AnyConsumer)
+	chn := conduit.NewChain(&AnyProducer{items}, nil, hs, small)
+	err := chn.AddSide(hs, "failed", side)
+	if err != nil {
+		t.Fatalf("HTTPSink: cannot add side: %v", err)
+	}
+	if chn.Run() != nil {
+		t.Fatalf("HTTPSink failed: %v", chn.Errs)
+	}
+	want := `[PUT /fail/2 application/json 2 {"id":2,"path":"fail"} ` +
+		`PUT /ok/1 application/json 1 {"id":1,"path":"ok"} ` +
+		`PUT /ok/4 application/json 4 {"id":4,"path":"ok"}]`
+	if fmt.Sprint(srv.requests()) != want {
+		t.Errorf("HTTPSink: expected %s, have %s", want, srv.requests())
+	}
+	if len(side.recvd) != 1 {
+		t.Fatalf("HTTPSink: expected 1 failed request, have %v", side.recvd)
+	}
+	fr := side.recvd[0].(*FailedRequest)
+	if fr.Attempts != 1 || fmt.Sprint(fr.Item) != fmt.Sprint(items[2]) {
+		t.Errorf("HTTPSink: unexpected failed request %v", fr)
+	}
+
+	chn = conduit.NewChain(&AnyProducer{items}, nil, NewHTTPSink(http.MethodPut, url).SetRetry(fastRetry), small)
+	if chn.Run() == nil {
+		t.Errorf("HTTPSink: failed request not reported")
+	}
+}
+
+// HTTP sink with batches:
+// - Items are sent in batches separated by newlines
+// - Barriers flush incomplete batches
+func TestHTTPSinkBatch(t *testing.T) {
+	srv := newSinkServer()
+	defer srv.Close()
+
+	items := []interface{}{"a", []byte("b"), 3, &conduit.Barrier{}, "d", "e", "f", "g"}
+	url := template.Must(template.New("url").Parse(srv.URL + "/batch/{{len .}}"))
+	hs := NewHTTPSink(http.MethodPost, url).SetBatch(3)
+	chn := conduit.NewChain(&AnyProducer{items}, nil, hs, small)
+	if chn.Run() != nil {
+		t.Fatalf("HTTPSink failed: %v", chn.Errs)
+	}
+	want := "[POST /batch/1   g POST /batch/3   a\nb\n3 POST /batch/3   d\ne\nf]"
+	if fmt.Sprint(srv.requests()) != want {
+		t.Errorf("HTTPSink: expected %q, have %q", want, srv.requests())
+	}
+}
@@ -0,0 +1,431 @@
+package utils
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+type imapMsg struct {
+	uid   uint32
+	flags map[string]bool
+	data  []byte
+}
+
+// IMAP test server with the user "user" (password "p@ss");
+// the first fail connections are dropped after the greeting
+type imapServer struct {
+	ln       net.Listener
+	door     sync.Mutex
+	validity uint32
+	next     uint32
+	boxes    map[string][]*imapMsg
+	move     bool
+	fail     int
+}
+
+func newIMAPServer(t *testing.T, move bool) *imapServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("IMAP: cannot listen: %v", err)
+	}
+	s := &imapServer{ln: ln, validity: 7, next: 1, boxes: map[string][]*imapMsg{"INBOX": nil, "Done": nil}, move: move}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return s
+}
+
+func (s *imapServer) url(box string) string {
+	return "imap://user:p%40ss@" + s.ln.Addr().String() + "/" + box
+}
+
+func (s *imapServer) add(box, data string, flags ...string) {
+	s.door.Lock()
+	defer s.door.Unlock()
+	m := &imapMsg{uid: s.next, flags: make(map[string]bool), data: []byte(data)}
+	for _, f := range flags {
+		m.flags[f] = true
+	}
+	s.next++
+	s.boxes[box] = append(s.boxes[box], m)
+}
+
+func (s *imapServer) uids(box string) []uint32 {
+	s.door.Lock()
+	defer s.door.Unlock()
+	var uids []uint32
+	for _, m := range s.boxes[box] {
+		uids = append(uids, m.uid)
+	}
+	return uids
+}
+
+func (s *imapServer) find(box string, uid uint32) (int, *imapMsg) {
+	for i, m := range s.boxes[box] {
+		if m.uid == uid {
+			return i, m
+		}
+	}
+	return -1, nil
+}
+
+func (s *imapServer) serve(conn net.Conn) {
+	defer conn.Close()
+	fmt.Fprintf(conn, "* OK test server ready\r\n")
+	s.door.Lock()
+	if s.fail > 0 {
+		s.fail--
+		s.door.Unlock()
+		return
+	}
+	s.door.Unlock()
+	rd := bufio.NewReader(conn)
+	box := ""
+	for {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			return
+		}
+		args := strings.Fields(strings.TrimRight(line, "\r\n"))
+		if len(args) < 2 {
+			return
+		}
+		tag, cmd := args[0], strings.ToUpper(args[1])
+		if cmd == "UID" && len(args) > 2 {
+			cmd += " " + strings.ToUpper(args[2])
+			args = args[1:]
+		}
+		args = args[2:]
+		s.door.Lock()
+		status := s.exec(conn, cmd, args, &box)
+		s.door.Unlock()
+		fmt.Fprintf(conn, "%s %s\r\n", tag, status)
+		if cmd == "LOGOUT" {
+			return
+		}
+	}
+}
+
+// Executes a command and returns the status
+func (s *imapServer) exec(conn net.Conn, cmd string, args []string, box *string) string {
+	uid := func() uint32 {
+		n, _ := strconv.ParseUint(args[0], 10, 32)
+		return uint32(n)
+	}
+	switch cmd {
+	case "LOGIN":
+		user, _ := strconv.Unquote(args[0])
+		pass, _ := strconv.Unquote(args[1])
+		if user != "user" || pass != "p@ss" {
+			return "NO invalid credentials"
+		}
+	case "CAPABILITY":
+		caps := "IMAP4rev1"
+		if s.move {
+			caps += " MOVE"
+		}
+		fmt.Fprintf(conn, "* CAPABILITY %s\r\n", caps)
+	case "SELECT":
+		name, _ := strconv.Unquote(args[0])
+		msgs, ok := s.boxes[name]
+		if !ok {
+			return "NO no such mailbox"
+		}
+		*box = name
+		fmt.Fprintf(conn, "* %d EXISTS\r\n* OK [UIDVALIDITY %d] UIDs valid\r\n", len(msgs), s.validity)
+	case "UID SEARCH":
+		if len(args) != 3 || args[0] != "UID" || (args[2] != "ALL" && args[2] != "UNSEEN") {
+			return "BAD invalid search"
+		}
+		from, _ := strconv.ParseUint(strings.TrimSuffix(args[1], ":*"), 10, 32)
+		var found []string
+		msgs := s.boxes[*box]
+		for _, m := range msgs {
+			if m.uid >= uint32(from) && (args[2] == "ALL" || !m.flags[`\Seen`]) {
+				found = append(found, fmt.Sprint(m.uid))
+			}
+		}
+		// like real servers, n:* includes the last message
+		if len(found) == 0 && len(msgs) > 0 {
+			found = append(found, fmt.Sprint(msgs[len(msgs)-1].uid))
+		}
+		fmt.Fprintf(conn, "* SEARCH %s\r\n", strings.Join(found, " "))
+	case "UID FETCH":
+		if i, m := s.find(*box, uid()); m != nil {
+			fmt.Fprintf(conn, "* %d FETCH (UID %d BODY[] {%d}\r\n%s)\r\n", i+1, m.uid, len(m.data), m.data)
+		}
+	case "UID STORE":
+		if _, m := s.find(*box, uid()); m != nil {
+			m.flags[strings.Trim(args[2], "()")] = true
+		}
+	case "UID MOVE", "UID COPY":
+		if cmd == "UID MOVE" && !s.move {
+			return "BAD unknown command"
+		}
+		to, _ := strconv.Unquote(args[1])
+		i, m := s.find(*box, uid())
+		if m == nil {
+			return "NO no such message"
+		}
+		c := &imapMsg{uid: s.next, flags: make(map[string]bool), data: m.data}
+		for f := range m.flags {
+			c.flags[f] = true
+		}
+		s.next++
+		s.boxes[to] = append(s.boxes[to], c)
+		if cmd == "UID MOVE" {
+			s.boxes[*box] = append(s.boxes[*box][:i], s.boxes[*box][i+1:]...)
+			fmt.Fprintf(conn, "* %d EXPUNGE\r\n", i+1)
+		}
+	case "EXPUNGE":
+		var kept []*imapMsg
+		for _, m := range s.boxes[*box] {
+			if m.flags[`\Deleted`] {
+				fmt.Fprintf(conn, "* %d EXPUNGE\r\n", len(kept)+1)
+				continue
+			}
+			kept = append(kept, m)
+		}
+		s.boxes[*box] = kept
+	case "LOGOUT":
+		fmt.Fprintf(conn, "* BYE\r\n")
+	default:
+		return "BAD unknown command"
+	}
+	return "OK done"
+}
+
+func imapUIDs(items []interface{}) []uint32 {
+	var uids []uint32
+	for _, inp := range items {
+		uids = append(uids, inp.(*EmailMessage).UID)
+	}
+	return uids
+}
+
+// IMAP reader:
+// - Messages are parsed and sent in the order of their UIDs
+// - Processed messages are flagged and moved (with or without MOVE)
+// - With a StateStore, messages are not read again until the UIDVALIDITY changes
+func TestIMAPReader(t *testing.T) {
+	for _, u := range []string{"http://host/INBOX", "imap:///INBOX", "%"} {
+		if NewIMAPReader(u) != nil {
+			t.Errorf("IMAPReader: invalid URL %q accepted", u)
+		}
+	}
+	for _, move := range []bool{true, false} {
+		srv := newIMAPServer(t, move)
+		srv.fail = 1
+		report := &EmailMessage{
+			From:        &mail.Address{Name: "Reports", Address: "reports@example.com"},
+			To:          []*mail.Address{{Address: "me@example.com"}},
+			Subject:     "Bericht",
+			Text:        "see attachment",
+			Attachments: []Attachment{{Name: "r.csv", Type: "text/csv", Data: []byte("a,b\n")}},
+		}
+		srv.add("INBOX", "Subject: first\r\n\r\nhello\r\n")
+		srv.add("INBOX", string(report.Bytes()))
+		srv.add("INBOX", "no header")
+
+		store := conduit.NewMemStore()
+		c := &AnyConsumer{}
+		ir := NewIMAPReader(srv.url("INBOX")).MarkSeen().SetMoveTo("Done").SetStore(store).SetRetry(fastRetry)
+		if err := conduit.NewChain(ir, nil, c, small).Run(); err != nil {
+			t.Fatalf("IMAPReader failed: %v", err)
+		}
+		if fmt.Sprint(imapUIDs(c.recvd)) != "[1 2 3]" {
+			t.Fatalf("IMAPReader: received %v", imapUIDs(c.recvd))
+		}
+		m := c.recvd[0].(*EmailMessage)
+		if m.Subject != "first" || m.Text != "hello\n" {
+			t.Errorf("IMAPReader: unexpected message %+v", m)
+		}
+		m = c.recvd[1].(*EmailMessage)
+		if m.Subject != "Bericht" || m.From.Address != "reports@example.com" || m.Text != "see attachment" ||
+			len(m.Attachments) != 1 || string(m.Attachments[0].Data) != "a,b\n" {
+			t.Errorf("IMAPReader: unexpected message %+v", m)
+		}
+		if m = c.recvd[2].(*EmailMessage); m.Text != "no header" || m.Header != nil {
+			t.Errorf("IMAPReader: unexpected raw message %+v", m)
+		}
+		if len(srv.uids("INBOX")) != 0 || len(srv.uids("Done")) != 3 {
+			t.Fatalf("IMAPReader: messages not moved: %v %v", srv.uids("INBOX"), srv.uids("Done"))
+		}
+		srv.door.Lock()
+		for _, m := range srv.boxes["Done"] {
+			if !m.flags[`\Seen`] {
+				t.Errorf("IMAPReader: message %d not flagged", m.uid)
+			}
+		}
+		srv.door.Unlock()
+		stage := "imap/user@" + srv.ln.Addr().String() + "/INBOX"
+		if v, err := store.Get(stage, "uid"); err != nil || string(v) != "7 3" {
+			t.Errorf("IMAPReader: stored %q (%v)", v, err)
+		}
+
+		// new and unseen messages only
+		srv.add("INBOX", "Subject: new\r\n\r\nnew")
+		srv.add("INBOX", "Subject: read\r\n\r\nread", `\Seen`)
+		c = &AnyConsumer{}
+		ir = NewIMAPReader(srv.url("INBOX")).SetSearch("UNSEEN").MarkSeen().SetStore(store)
+		if err := conduit.NewChain(ir, nil, c, small).Run(); err != nil {
+			t.Fatalf("IMAPReader failed: %v", err)
+		}
+		if len(c.recvd) != 1 || c.recvd[0].(*EmailMessage).Subject != "new" {
+			t.Errorf("IMAPReader: received %v", imapUIDs(c.recvd))
+		}
+		// the stored UID skips the first message, although it is in the mailbox
+		c = &AnyConsumer{}
+		ir = NewIMAPReader(srv.url("INBOX")).SetStore(store)
+		if err := conduit.NewChain(ir, nil, c, small).Run(); err != nil {
+			t.Fatalf("IMAPReader failed: %v", err)
+		}
+		if len(c.recvd) != 1 || c.recvd[0].(*EmailMessage).Subject != "read" {
+			t.Errorf("IMAPReader: received %v", imapUIDs(c.recvd))
+		}
+		// all messages are read again with a new UIDVALIDITY
+		srv.door.Lock()
+		srv.validity++
+		srv.door.Unlock()
+		c = &AnyConsumer{}
+		ir = NewIMAPReader(srv.url("INBOX")).SetStore(store)
+		if err := conduit.NewChain(ir, nil, c, small).Run(); err != nil {
+			t.Fatalf("IMAPReader failed: %v", err)
+		}
+		if len(c.recvd) != 2 {
+			t.Errorf("IMAPReader: received %v", imapUIDs(c.recvd))
+		}
+	}
+
+	srv := newIMAPServer(t, true)
+	ir := NewIMAPReader(strings.Replace(srv.url(""), "p%40ss", "wrong", 1)).SetRetry(fastRetry)
+	chn := conduit.NewChain(ir, nil, &AnyConsumer{}, small)
+	if chn.Run() == nil || !strings.Contains(fmt.Sprint(chn.Errs), "invalid credentials") {
+		t.Errorf("IMAPReader: wrong password accepted: %v", chn.Errs)
+	}
+}
+
+// IMAP reader that signals the checkpoints it has committed
+type signalingIMAPReader struct {
+	*IMAPReader
+	door sync.Mutex
+	id   uint64
+	kick chan struct{}
+}
+
+func (ir *signalingIMAPReader) Commit(cp *conduit.Checkpoint) error {
+	err := ir.IMAPReader.Commit(cp)
+	ir.door.Lock()
+	ir.id = cp.ID
+	ir.door.Unlock()
+	select {
+	case ir.kick <- struct{}{}:
+	default:
+	}
+	return err
+}
+
+// Waits until the checkpoint id has been committed
+func (ir *signalingIMAPReader) waitCommit(id uint64) {
+	for {
+		ir.door.Lock()
+		done := ir.id >= id
+		ir.door.Unlock()
+		if done {
+			return
+		}
+		<-ir.kick
+	}
+}
+
+// Consumer that crashes at the first barrier after n messages
+// once the checkpoint of that barrier has been committed;
+// it stops receiving there, so no later checkpoint is taken
+type crashIMAPConsumer struct {
+	n     int
+	ir    *signalingIMAPReader
+	recvd int
+}
+
+func (c *crashIMAPConsumer) Consume(src conduit.Source) error {
+	for inp := range src {
+		b, ok := inp.(*conduit.Barrier)
+		if !ok {
+			c.recvd++
+			continue
+		}
+		if c.recvd >= c.n {
+			c.ir.waitCommit(b.ID)
+			return errors.New("crash")
+		}
+	}
+	return nil
+}
+
+// IMAP reader with polling and acknowledgment on checkpoints:
+// - New messages are received while polling
+// - Only messages covered by a checkpoint are moved
+// - After a crash, the other messages are read again
+func TestIMAPCheckpoint(t *testing.T) {
+	srv := newIMAPServer(t, true)
+	for i := 1; i <= 50; i++ {
+		srv.add("INBOX", fmt.Sprintf("Subject: %d\r\n\r\nmessage %d", i, i))
+	}
+	cps := conduit.NewMemCheckpoints()
+	newReader := func() *IMAPReader {
+		return NewIMAPReader(srv.url("INBOX")).SetMoveTo("Done").SetInterval(10 * time.Millisecond).AckOnCheckpoint()
+	}
+	ir := &signalingIMAPReader{IMAPReader: newReader(), kick: make(chan struct{}, 1)}
+	crash := &crashIMAPConsumer{n: 30, ir: ir}
+	chn := conduit.NewChain(ir, nil, crash, small)
+	chn.SetCheckpoints(time.Millisecond, cps)
+	if chn.Run() == nil {
+		t.Fatalf("IMAPReader: chain did not crash")
+	}
+	// the producer is not stopped by the failing consumer
+	ir.Cancel()
+	cp, _ := cps.Latest()
+	if cp == nil || cp.Position < 30 {
+		t.Fatalf("IMAPReader: unexpected checkpoint %v", cp)
+	}
+	moved := len(srv.uids("Done"))
+	if moved != int(cp.Position) || (moved < 50 && srv.uids("INBOX")[0] != uint32(moved+1)) {
+		t.Fatalf("IMAPReader: checkpoint at %d, moved %d", cp.Position, moved)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		srv.add("INBOX", "Subject: late\r\n\r\nlate")
+	}()
+	rest := &StopConsumer{n: 51 - moved, err: conduit.EOS}
+	chn = conduit.NewChain(newReader(), nil, rest, small)
+	chn.SetCheckpoints(time.Millisecond, cps)
+	if err := chn.Run(); err != nil {
+		t.Fatalf("IMAPReader: restarted chain failed: %v", err)
+	}
+	for i, uid := range imapUIDs(rest.recvd[:50-moved]) {
+		if uid != uint32(moved+i+1) {
+			t.Fatalf("IMAPReader: unexpected message %d: %d", i, uid)
+		}
+	}
+	if m := rest.recvd[len(rest.recvd)-1].(*EmailMessage); m.Subject != "late" {
+		t.Errorf("IMAPReader: unexpected last message %q", m.Subject)
+	}
+}
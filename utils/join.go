@@ -0,0 +1,230 @@
+package utils
+
+import (
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+// JoinPair is sent down the chain by Joins,
+// one for each pair of items from the left
+// and the right stream that have the same key
+// and fall into the same window.
+type JoinPair struct {
+	Key   string
+	Left  interface{}
+	Right interface{}
+}
+
+// Join is a Producer that consumes two streams,
+// each created by a Producer, and joins their items by key.
+// Items are buffered per key within a window,
+// which is either a number of items per key and stream
+// (count joins) or a time interval (time joins);
+// each incoming item is paired with the buffered items
+// of the other stream with the same key.
+// When the Join is canceled, it cancels both producers,
+// if they are conduit.Cancelers.
+type Join struct {
+	conduit.Cancelable
+	left, right conduit.Producer
+	lk, rk      KeyFunc
+	n           int           // count joins
+	d           time.Duration // time joins
+	ts          Timestamp
+	lbuf, rbuf  map[string][]stamped
+	lmark       time.Time // watermark left
+	rmark       time.Time // watermark right
+	seen        int
+}
+
+// NewCountJoin creates a new Join that keeps
+// the last n items per key of each stream.
+// Keys of the left stream are obtained using lk,
+// keys of the right stream using rk (see KeyFunc and Keyed).
+func NewCountJoin(left, right conduit.Producer, lk, rk KeyFunc, n int) (j *Join) {
+	if left == nil || right == nil || n < 1 {
+		return nil
+	}
+	j = new(Join)
+	if j != nil {
+		j.left, j.right = left, right
+		j.lk, j.rk = lk, rk
+		j.n = n
+	}
+	return
+}
+
+// NewTimeJoin creates a new Join that pairs items
+// whose times differ by at most d.
+// If ts is not nil, it is used to obtain the event time
+// of the items of both streams, which are expected to
+// arrive in time order per stream;
+// otherwise, the processing time is used.
+func NewTimeJoin(left, right conduit.Producer, lk, rk KeyFunc, d time.Duration, ts Timestamp) (j *Join) {
+	if left == nil || right == nil || d < 0 {
+		return nil
+	}
+	j = new(Join)
+	if j != nil {
+		j.left, j.right = left, right
+		j.lk, j.rk = lk, rk
+		j.d = d
+		j.ts = ts
+	}
+	return
+}
+
+// Cancel is the pre-defined method that makes Join
+// a conduit.Canceler; it cancels both producers.
+func (j *Join) Cancel() {
+	j.Cancelable.Cancel()
+	cancelAll([]conduit.Producer{j.left, j.right})
+}
+
+// Produce is the pre-defined method that
+// makes Join a Producer.
+func (j *Join) Produce(trg conduit.Target) error {
+	j.lbuf = make(map[string][]stamped)
+	j.rbuf = make(map[string][]stamped)
+	j.lmark, j.rmark = time.Time{}, time.Time{}
+
+	conduit.ResetCancel(j.left)
+	conduit.ResetCancel(j.right)
+	l, lerr := startProducer(j.left, 0)
+	r, rerr := startProducer(j.right, 0)
+	defer func() {
+		// let the producers terminate if the join was canceled
+		go drain(l)
+		go drain(r)
+	}()
+
+	lc, rc := l, r
+	for (lc != nil || rc != nil) && !j.Canceled() {
+		select {
+		case inp, ok := <-lc:
+			if !ok {
+				lc = nil
+				continue
+			}
+			j.add(inp, true, trg)
+		case inp, ok := <-rc:
+			if !ok {
+				rc = nil
+				continue
+			}
+			j.add(inp, false, trg)
+		}
+	}
+	if j.Canceled() {
+		return nil
+	}
+	err := <-lerr
+	if e := <-rerr; err == nil {
+		err = e
+	}
+	return err
+}
+
+// Volatile is the pre-defined method that makes Join a conduit.Volatile:
+// the buffered items are not included in checkpoints.
+func (j *Join) Volatile() bool {
+	return true
+}
+
+// buffers an item and pairs it with
+// the buffered items of the other stream.
+func (j *Join) add(inp interface{}, left bool, trg conduit.Target) {
+	var t time.Time
+	if j.n == 0 {
+		if j.ts == nil {
+			t = time.Now()
+		} else {
+			t = j.ts.Timestamp(inp)
+		}
+		if left && t.After(j.lmark) {
+			j.lmark = t
+		}
+		if !left && t.After(j.rmark) {
+			j.rmark = t
+		}
+	}
+
+	mine, other, kf := j.lbuf, j.rbuf, j.lk
+	if !left {
+		mine, other, kf = j.rbuf, j.lbuf, j.rk
+	}
+	k := keyOf(kf, inp)
+
+	other[k] = j.evict(other[k])
+	for _, o := range other[k] {
+		if j.n == 0 && absDuration(t.Sub(o.t)) > j.d {
+			continue
+		}
+		if left {
+			trg <- JoinPair{Key: k, Left: inp, Right: o.item}
+		} else {
+			trg <- JoinPair{Key: k, Left: o.item, Right: inp}
+		}
+	}
+	mine[k] = j.evict(append(mine[k], stamped{t, inp}))
+
+	// from time to time remove items of idle keys
+	j.seen++
+	if j.n == 0 && j.seen%1024 == 0 {
+		j.sweep(j.lbuf)
+		j.sweep(j.rbuf)
+	}
+}
+
+// removes items that left the window
+func (j *Join) evict(buf []stamped) []stamped {
+	if j.n > 0 {
+		if len(buf) > j.n {
+			buf = append(buf[:0], buf[len(buf)-j.n:]...)
+		}
+		return buf
+	}
+	mark := j.lmark
+	if j.rmark.Before(mark) {
+		mark = j.rmark
+	}
+	i := 0
+	for ; i < len(buf) && buf[i].t.Before(mark.Add(-j.d)); i++ {
+	}
+	if i == 0 {
+		return buf
+	}
+	return append(buf[:0], buf[i:]...)
+}
+
+// evicts all keys
+func (j *Join) sweep(bufs map[string][]stamped) {
+	for k, buf := range bufs {
+		buf = j.evict(buf)
+		if len(buf) == 0 {
+			delete(bufs, k)
+			continue
+		}
+		bufs[k] = buf
+	}
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+// runs a producer in its own goroutine;
+// the error is delivered when the producer has terminated.
+func startProducer(p conduit.Producer, sz int) (chan interface{}, chan error) {
+	ch := make(chan interface{}, sz)
+	errc := make(chan error, 1)
+	go func() {
+		defer close(ch)
+		errc <- p.Produce(ch)
+	}()
+	return ch, errc
+}
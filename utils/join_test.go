@@ -0,0 +1,177 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+type JoinConsumer struct {
+	recvd []JoinPair
+}
+
+func (c *JoinConsumer) Consume(src conduit.Source) error {
+	for v := range src {
+		c.recvd = append(c.recvd, v.(JoinPair))
+	}
+	return nil
+}
+
+type ErrProducer struct{}
+
+func (p *ErrProducer) Produce(trg conduit.Target) error {
+	return errors.New(errMsg)
+}
+
+// key of ints
+func modKey(k int) KeyFunc {
+	return func(inp interface{}) string {
+		return fmt.Sprintf("%d", inp.(int)%k)
+	}
+}
+
+// Count join with a window covering all data:
+// - It is processed without errors
+// - Every pair with the same key is joined exactly once
+func TestCountJoinChain(t *testing.T) {
+	for i := 0; i < numOfTests; i++ {
+		err := testCountJoinChain(numOfData, 1+rand.Int()%10)
+		if err != nil {
+			m := fmt.Sprintf("CountJoinChain failed: %v", err)
+			t.Error(m)
+		}
+	}
+}
+
+// Event time join:
+// - It is processed without errors
+// - Exactly the pairs with the same key
+//   that are at most d apart are joined
+func TestTimeJoinChain(t *testing.T) {
+	for i := 0; i < numOfTests; i++ {
+		err := testTimeJoinChain(numOfData, 1+rand.Int()%10, rand.Int()%20)
+		if err != nil {
+			m := fmt.Sprintf("TimeJoinChain failed: %v", err)
+			t.Error(m)
+		}
+	}
+}
+
+// Join with failing input:
+// - The error is reported
+func TestErrJoinChain(t *testing.T) {
+	l := &SeqProducer{makeSeq(numOfData)}
+	p := NewCountJoin(l, new(ErrProducer), nil, nil, 10)
+	c := new(JoinConsumer)
+	chn := conduit.NewChain(p, nil, c, small)
+	err := chn.Run()
+	if err == nil || len(chn.Errs) != 1 || chn.Errs[0].Error() != errMsg {
+		t.Errorf("ErrJoinChain: unexpected errors: %v", chn.Errs)
+	}
+}
+
+// Join of infinite streams followed by Take:
+// - The join and its producers are canceled
+func TestCancelJoinChain(t *testing.T) {
+	l := NewGeneric(new(Naturals))
+	r := NewGeneric(new(Naturals))
+	p := NewCountJoin(l, r, nil, nil, 1)
+	c := new(JoinConsumer)
+	chn := conduit.NewChain(p, []conduit.Conduit{NewTake(numOfData)}, c, small)
+	err := chn.Run()
+	if err != nil || len(c.recvd) != numOfData {
+		t.Errorf("CancelJoinChain failed: %v, %d items", chn.Errs, len(c.recvd))
+	}
+	if !l.Canceled() || !r.Canceled() {
+		t.Errorf("CancelJoinChain: producers not canceled")
+	}
+}
+
+func testCountJoinChain(n, k int) error {
+
+	l := &SeqProducer{makeSeq(n)}
+	r := &SeqProducer{makeSeq(n)}
+	p := NewCountJoin(l, r, modKey(k), modKey(k), n)
+	c := new(JoinConsumer)
+
+	chn := conduit.NewChain(p, nil, c, small)
+
+	err := chn.Run()
+	if err != nil {
+		m := fmt.Sprintf("error on running chain: %v", err)
+		return errors.New(m)
+	}
+	seen := make(map[[2]int]bool)
+	for _, jp := range c.recvd {
+		a, b := jp.Left.(int), jp.Right.(int)
+		if a%k != b%k || jp.Key != fmt.Sprintf("%d", a%k) {
+			m := fmt.Sprintf("wrong pair: %d - %d", a, b)
+			return errors.New(m)
+		}
+		if seen[[2]int{a, b}] {
+			m := fmt.Sprintf("pair twice: %d - %d", a, b)
+			return errors.New(m)
+		}
+		seen[[2]int{a, b}] = true
+	}
+	expected := 0
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			if i%k == j%k {
+				expected++
+			}
+		}
+	}
+	if len(seen) != expected {
+		m := fmt.Sprintf("expected %d pairs, have %d", expected, len(seen))
+		return errors.New(m)
+	}
+	return nil
+}
+
+func testTimeJoinChain(n, k, d int) error {
+
+	l := &SeqProducer{makeSeq(n)}
+	r := &SeqProducer{makeSeq(n)}
+	p := NewTimeJoin(l, r, modKey(k), modKey(k),
+		time.Duration(d)*time.Second, new(SecTimestamp))
+	c := new(JoinConsumer)
+
+	chn := conduit.NewChain(p, nil, c, small)
+
+	err := chn.Run()
+	if err != nil {
+		m := fmt.Sprintf("error on running chain: %v", err)
+		return errors.New(m)
+	}
+	seen := make(map[[2]int]bool)
+	for _, jp := range c.recvd {
+		a, b := jp.Left.(int), jp.Right.(int)
+		if a%k != b%k || a-b > d || b-a > d {
+			m := fmt.Sprintf("wrong pair: %d - %d", a, b)
+			return errors.New(m)
+		}
+		if seen[[2]int{a, b}] {
+			m := fmt.Sprintf("pair twice: %d - %d", a, b)
+			return errors.New(m)
+		}
+		seen[[2]int{a, b}] = true
+	}
+	expected := 0
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			if i%k == j%k && i-j <= d && j-i <= d {
+				expected++
+			}
+		}
+	}
+	if len(seen) != expected {
+		m := fmt.Sprintf("expected %d pairs, have %d", expected, len(seen))
+		return errors.New(m)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package utils
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+
+	"github.com/toschoo/conduit"
+)
+
+// JSONReader is a Producer that decodes JSON values
+// read from some kind of source and sends them down the chain.
+// The source is either a stream of JSON values
+// (e.g. separated by whitespace or newlines)
+// or one JSON array whose elements are sent one by one.
+type JSONReader struct {
+	conduit.Cancelable
+	rd  io.Reader
+	new func() interface{}
+}
+
+// NewJSONReader creates a new JSONReader Producer.
+// Each value is decoded into the result of newValue,
+// typically a pointer to a new struct, which is then sent
+// down the chain. If newValue is nil, values are decoded
+// into interface{} and sent as maps, slices, strings,
+// float64, bool or nil.
+func NewJSONReader(r io.Reader, newValue func() interface{}) (jr *JSONReader) {
+	jr = new(JSONReader)
+	if jr != nil {
+		jr.rd = r
+		jr.new = newValue
+	}
+	return
+}
+
+// Decodes one value
+func (jr *JSONReader) decode(dec *json.Decoder) (interface{}, error) {
+	if jr.new == nil {
+		var v interface{}
+		err := dec.Decode(&v)
+		return v, err
+	}
+	v := jr.new()
+	err := dec.Decode(v)
+	return v, err
+}
+
+// Produce is the pre-defined method that makes JSONReader a Producer.
+func (jr *JSONReader) Produce(trg conduit.Target) error {
+	br := bufio.NewReader(jr.rd)
+	array, err := startsArray(br)
+	if err != nil {
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+	dec := json.NewDecoder(br)
+	if array {
+		_, err = dec.Token() // [
+		if err != nil {
+			return err
+		}
+	}
+	for !jr.Canceled() {
+		if array && !dec.More() {
+			_, err = dec.Token() // ]
+			return err
+		}
+		v, err := jr.decode(dec)
+		if err == io.EOF && !array {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		trg <- v
+	}
+	return nil
+}
+
+// tells whether the input starts with an array
+// skipping leading whitespace
+func startsArray(br *bufio.Reader) (bool, error) {
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return false, err
+		}
+		switch b {
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+		return b == '[', br.UnreadByte()
+	}
+}
+
+// JSONWriter is a Consumer that writes incoming data
+// as JSON to some kind of io.Writer, one value per line.
+type JSONWriter struct {
+	enc *json.Encoder
+}
+
+// NewJSONWriter creates a new JSONWriter Consumer.
+func NewJSONWriter(w io.Writer) (jw *JSONWriter) {
+	jw = new(JSONWriter)
+	if jw != nil {
+		jw.enc = json.NewEncoder(w)
+	}
+	return
+}
+
+// SetIndent sets the indentation as in json.Encoder.
+func (jw *JSONWriter) SetIndent(prefix, indent string) *JSONWriter {
+	jw.enc.SetIndent(prefix, indent)
+	return jw
+}
+
+// Consume is the pre-defined method that makes JSONWriter a Consumer.
+// Consume terminates with an error if an item cannot be encoded.
+func (jw *JSONWriter) Consume(src conduit.Source) error {
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			continue
+		}
+		err := jw.enc.Encode(inp)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
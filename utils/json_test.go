@@ -0,0 +1,123 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/toschoo/conduit"
+)
+
+type Point struct {
+	X, Y int
+}
+
+type AnyConsumer struct {
+	recvd []interface{}
+}
+
+func (c *AnyConsumer) Consume(src conduit.Source) error {
+	for v := range src {
+		c.recvd = append(c.recvd, v)
+	}
+	return nil
+}
+
+func newPoint() interface{} {
+	return new(Point)
+}
+
+func makePoints(n int) []interface{} {
+	ps := make([]interface{}, n)
+	for i := range ps {
+		ps[i] = &Point{i, -i}
+	}
+	return ps
+}
+
+// JSON:
+// - Points are written and read back without errors
+// - as stream and as array
+// - The points read equal the points written
+func TestJSONChain(t *testing.T) {
+	for i := 0; i < numOfTests; i++ {
+		for _, array := range []bool{false, true} {
+			err := testJSONChain(i, array)
+			if err != nil {
+				m := fmt.Sprintf("JSONChain failed: %v", err)
+				t.Error(m)
+			}
+		}
+	}
+}
+
+// JSON without newValue:
+// - Values are decoded generically
+// - Invalid JSON is reported
+func TestGenericJSONChain(t *testing.T) {
+	c := new(AnyConsumer)
+	p := NewJSONReader(strings.NewReader(` [1, "a", {"b": true}, null] `), nil)
+	chn := conduit.NewChain(p, nil, c, small)
+	err := chn.Run()
+	if err != nil {
+		t.Fatalf("GenericJSONChain failed: %v", chn.Errs)
+	}
+	have := fmt.Sprintf("%v", c.recvd)
+	if have != "[1 a map[b:true] <nil>]" {
+		t.Errorf("GenericJSONChain: unexpected values: %s", have)
+	}
+	p = NewJSONReader(strings.NewReader(`{"a": 1} {"a":`), nil)
+	chn = conduit.NewChain(p, nil, c, small)
+	if chn.Run() == nil {
+		t.Errorf("GenericJSONChain: invalid JSON not reported")
+	}
+}
+
+func testJSONChain(n int, array bool) error {
+
+	points := makePoints(n)
+
+	var buf bytes.Buffer
+	chn := conduit.NewChain(&AnyProducer{points}, nil, NewJSONWriter(&buf), small)
+	err := chn.Run()
+	if err != nil {
+		m := fmt.Sprintf("error on writing: %v", chn.Errs)
+		return errors.New(m)
+	}
+	input := buf.String()
+	if array {
+		input = "[" + strings.Join(strings.Fields(input), ",") + "]"
+	}
+
+	c := new(AnyConsumer)
+	chn = conduit.NewChain(NewJSONReader(strings.NewReader(input), newPoint), nil, c, small)
+	err = chn.Run()
+	if err != nil {
+		m := fmt.Sprintf("error on reading: %v", chn.Errs)
+		return errors.New(m)
+	}
+	if len(c.recvd) != n {
+		m := fmt.Sprintf("expected %d items, have %d", n, len(c.recvd))
+		return errors.New(m)
+	}
+	for i, v := range c.recvd {
+		if *v.(*Point) != *points[i].(*Point) {
+			return errors.New("Received values differ from original!")
+		}
+	}
+	return nil
+}
+
+// produces arbitrary values
+type AnyProducer struct {
+	src []interface{}
+}
+
+func (p *AnyProducer) Produce(trg conduit.Target) error {
+	for _, v := range p.src {
+		trg <- v
+	}
+	return nil
+}
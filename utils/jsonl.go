@@ -0,0 +1,163 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+
+	"github.com/toschoo/conduit"
+)
+
+// MalformedPolicy defines how producers handle
+// malformed input records.
+type MalformedPolicy int
+
+const (
+	// MalformedSkip skips malformed records and counts them.
+	MalformedSkip MalformedPolicy = iota
+	// MalformedError terminates the producer with an error.
+	MalformedError
+	// MalformedSide sends malformed records as BadRecord
+	// to the side output "malformed" (see conduit.SideOutputter);
+	// if the side output is not connected, records are skipped.
+	MalformedSide
+)
+
+// BadRecord is a malformed input record.
+// Num is the number of the record (line) starting with 1.
+type BadRecord struct {
+	Num  int
+	Data []byte
+	Err  error
+}
+
+// JSONLReader is a Producer that reads JSON Lines (NDJSON),
+// i.e. one JSON document per line, and sends
+// the decoded documents down the chain. Empty lines are ignored.
+type JSONLReader struct {
+	conduit.Cancelable
+	rd      io.Reader
+	new     func() interface{}
+	policy  MalformedPolicy
+	max     int
+	side    conduit.Target
+	skipped uint64
+}
+
+// NewJSONLReader creates a new JSONLReader Producer
+// handling malformed lines according to policy.
+// Documents are decoded as by JSONReader (see NewJSONReader).
+func NewJSONLReader(r io.Reader, newValue func() interface{}, policy MalformedPolicy) (jr *JSONLReader) {
+	jr = new(JSONLReader)
+	if jr != nil {
+		jr.rd = r
+		jr.new = newValue
+		jr.policy = policy
+		jr.max = 1024 * 1024
+	}
+	return
+}
+
+// SetMaxLine sets the maximum length of a line (default 1MiB).
+// Longer lines terminate the producer with an error.
+func (jr *JSONLReader) SetMaxLine(n int) *JSONLReader {
+	jr.max = n
+	return jr
+}
+
+// Skipped returns the number of malformed lines skipped.
+func (jr *JSONLReader) Skipped() uint64 {
+	return atomic.LoadUint64(&jr.skipped)
+}
+
+// SideOutput is the pre-defined method that makes JSONLReader
+// a conduit.SideOutputter. JSONLReader has the side output "malformed".
+func (jr *JSONLReader) SideOutput(name string, trg conduit.Target) {
+	if name == "malformed" {
+		jr.side = trg
+	}
+}
+
+// Produce is the pre-defined method that makes JSONLReader a Producer.
+func (jr *JSONLReader) Produce(trg conduit.Target) error {
+	sc := bufio.NewScanner(jr.rd)
+	sc.Buffer(make([]byte, 0, 4096), jr.max)
+	num := 0
+	for !jr.Canceled() && sc.Scan() {
+		num++
+		line := bytes.TrimSpace(sc.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		v, err := jr.decode(line)
+		if err == nil {
+			trg <- v
+			continue
+		}
+		switch jr.policy {
+		case MalformedError:
+			return errors.New(fmt.Sprintf("line %d: %v", num, err))
+		case MalformedSide:
+			if jr.side != nil {
+				data := append([]byte(nil), line...)
+				jr.side <- BadRecord{num, data, err}
+				continue
+			}
+		}
+		atomic.AddUint64(&jr.skipped, 1)
+	}
+	return sc.Err()
+}
+
+// Decodes one line
+func (jr *JSONLReader) decode(line []byte) (interface{}, error) {
+	if jr.new == nil {
+		var v interface{}
+		err := json.Unmarshal(line, &v)
+		return v, err
+	}
+	v := jr.new()
+	err := json.Unmarshal(line, v)
+	return v, err
+}
+
+// JSONLWriter is a Consumer that writes incoming data
+// as JSON Lines, i.e. one compact JSON document per line.
+type JSONLWriter struct {
+	wt io.Writer
+}
+
+// NewJSONLWriter creates a new JSONLWriter Consumer.
+func NewJSONLWriter(w io.Writer) (jw *JSONLWriter) {
+	jw = new(JSONLWriter)
+	if jw != nil {
+		jw.wt = w
+	}
+	return
+}
+
+// Consume is the pre-defined method that makes JSONLWriter a Consumer.
+// Consume terminates with an error if an item cannot be encoded.
+func (jw *JSONLWriter) Consume(src conduit.Source) error {
+	bw := bufio.NewWriter(jw.wt)
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			err := bw.Flush()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		buf, err := json.Marshal(inp)
+		if err != nil {
+			return err
+		}
+		bw.Write(buf)
+		bw.WriteByte('\n')
+	}
+	return bw.Flush()
+}
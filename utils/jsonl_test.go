@@ -0,0 +1,114 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/toschoo/conduit"
+)
+
+type BadConsumer struct {
+	recvd []BadRecord
+}
+
+func (c *BadConsumer) Consume(src conduit.Source) error {
+	for v := range src {
+		c.recvd = append(c.recvd, v.(BadRecord))
+	}
+	return nil
+}
+
+// JSONL:
+// - Points are written and read back
+// - Malformed lines are handled according to the policy
+func TestJSONLChain(t *testing.T) {
+	for i := 0; i < numOfTests; i++ {
+		for _, pol := range []MalformedPolicy{MalformedSkip, MalformedError, MalformedSide} {
+			err := testJSONLChain(1+i, 1+i%7, pol)
+			if err != nil {
+				m := fmt.Sprintf("JSONLChain failed: %v", err)
+				t.Error(m)
+			}
+		}
+	}
+}
+
+func testJSONLChain(n, k int, pol MalformedPolicy) error {
+
+	points := makePoints(n)
+
+	var buf bytes.Buffer
+	chn := conduit.NewChain(&AnyProducer{points}, nil, NewJSONLWriter(&buf), small)
+	err := chn.Run()
+	if err != nil {
+		m := fmt.Sprintf("error on writing: %v", chn.Errs)
+		return errors.New(m)
+	}
+
+	// every k-th line is broken, empty lines are inserted
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	bad := 0
+	for i := range lines {
+		if i%k == k-1 {
+			lines[i] = lines[i][1:]
+			bad++
+		}
+	}
+	input := strings.Join(lines, "\n\n")
+
+	p := NewJSONLReader(strings.NewReader(input), newPoint, pol)
+	c := new(AnyConsumer)
+	side := new(BadConsumer)
+	chn = conduit.NewChain(p, nil, c, small)
+	err = chn.AddSide(p, "malformed", side)
+	if err != nil {
+		return err
+	}
+	err = chn.Run()
+	if pol == MalformedError && bad > 0 {
+		if err == nil {
+			return errors.New("malformed line not reported")
+		}
+		return nil
+	}
+	if err != nil {
+		m := fmt.Sprintf("error on reading: %v", chn.Errs)
+		return errors.New(m)
+	}
+	if len(c.recvd) != n-bad {
+		m := fmt.Sprintf("expected %d items, have %d", n-bad, len(c.recvd))
+		return errors.New(m)
+	}
+	j := 0
+	for i := 0; i < n; i++ {
+		if i%k == k-1 {
+			continue
+		}
+		if *c.recvd[j].(*Point) != *points[i].(*Point) {
+			return errors.New("Received values differ from original!")
+		}
+		j++
+	}
+	switch pol {
+	case MalformedSkip:
+		if p.Skipped() != uint64(bad) {
+			m := fmt.Sprintf("expected %d skipped, have %d", bad, p.Skipped())
+			return errors.New(m)
+		}
+	case MalformedSide:
+		if len(side.recvd) != bad || p.Skipped() != 0 {
+			m := fmt.Sprintf("expected %d malformed, have %d", bad, len(side.recvd))
+			return errors.New(m)
+		}
+		for _, b := range side.recvd {
+			if b.Num%(2*k) != 2*k-1 || b.Err == nil {
+				m := fmt.Sprintf("unexpected malformed line %d", b.Num)
+				return errors.New(m)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,608 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/toschoo/conduit"
+)
+
+// JSONPath is a compiled JSONPath expression
+// applied to decoded JSON values (map[string]interface{},
+// Record, []interface{} and scalars).
+// The supported syntax is:
+//
+//	$              the root (may be omitted)
+//	.name ['name'] a member (several names separated by commas)
+//	[n]            an array element (negative from the end;
+//	               several indices separated by commas)
+//	[start:end:step] an array slice
+//	.* [*]         all members or elements
+//	..             recursive descent, e.g. $..name
+//	[?(@.x op v)]  elements whose member x compares with the literal v
+//	               (op is ==, !=, <, <=, > or >=; v is a number,
+//	               a quoted string, true, false or null)
+//	[?(@.x)]       elements having the member x
+type JSONPath struct {
+	expr  string
+	steps []pathStep
+}
+
+const (
+	stepName = iota
+	stepIndex
+	stepWild
+	stepSlice
+	stepFilter
+)
+
+type pathStep struct {
+	kind   int
+	rec    bool
+	names  []string
+	idx    []int
+	slice  [3]*int
+	filter *pathFilter
+}
+
+type pathFilter struct {
+	path *JSONPath
+	op   string
+	val  interface{}
+}
+
+// CompileJSONPath parses a JSONPath expression.
+func CompileJSONPath(expr string) (*JSONPath, error) {
+	p := &JSONPath{expr: expr}
+	s := strings.TrimSpace(expr)
+	s = strings.TrimPrefix(s, "$")
+	if s != "" && s[0] != '.' && s[0] != '[' {
+		s = "." + s
+	}
+	for s != "" {
+		var st pathStep
+		var err error
+		if strings.HasPrefix(s, "..") {
+			st.rec = true
+			s = s[2:]
+			if s != "" && s[0] == '[' {
+				st, s, err = parseBracket(s)
+				st.rec = true
+			} else {
+				st, s, err = parseDot(s)
+				st.rec = true
+			}
+		} else if s[0] == '.' {
+			st, s, err = parseDot(s[1:])
+		} else if s[0] == '[' {
+			st, s, err = parseBracket(s)
+		} else {
+			err = errors.New(fmt.Sprintf("unexpected '%c'", s[0]))
+		}
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid JSONPath '%s': %v", expr, err))
+		}
+		p.steps = append(p.steps, st)
+	}
+	return p, nil
+}
+
+// Parses a member name after a dot
+func parseDot(s string) (pathStep, string, error) {
+	i := strings.IndexAny(s, ".[")
+	if i < 0 {
+		i = len(s)
+	}
+	name := s[:i]
+	if name == "" {
+		return pathStep{}, s, errors.New("missing name")
+	}
+	if name == "*" {
+		return pathStep{kind: stepWild}, s[i:], nil
+	}
+	return pathStep{kind: stepName, names: []string{name}}, s[i:], nil
+}
+
+// Parses a bracket expression
+func parseBracket(s string) (pathStep, string, error) {
+	end := matchBracket(s)
+	if end < 0 {
+		return pathStep{}, s, errors.New("missing ']'")
+	}
+	in := strings.TrimSpace(s[1:end])
+	rest := s[end+1:]
+	switch {
+	case in == "*":
+		return pathStep{kind: stepWild}, rest, nil
+	case strings.HasPrefix(in, "?(") && strings.HasSuffix(in, ")"):
+		f, err := parseFilter(in[2 : len(in)-1])
+		return pathStep{kind: stepFilter, filter: f}, rest, err
+	case in != "" && (in[0] == '\'' || in[0] == '"'):
+		var names []string
+		for _, part := range splitOutsideQuotes(in, ',') {
+			name, err := unquote(strings.TrimSpace(part))
+			if err != nil {
+				return pathStep{}, s, err
+			}
+			names = append(names, name)
+		}
+		return pathStep{kind: stepName, names: names}, rest, nil
+	case strings.Contains(in, ":"):
+		parts := strings.Split(in, ":")
+		if len(parts) > 3 {
+			return pathStep{}, s, errors.New("invalid slice")
+		}
+		var st pathStep
+		st.kind = stepSlice
+		for i, part := range parts {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			n, err := strconv.Atoi(part)
+			if err != nil {
+				return pathStep{}, s, err
+			}
+			st.slice[i] = &n
+		}
+		return st, rest, nil
+	}
+	var st pathStep
+	st.kind = stepIndex
+	for _, part := range strings.Split(in, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return pathStep{}, s, err
+		}
+		st.idx = append(st.idx, n)
+	}
+	return st, rest, nil
+}
+
+// Returns the position of the bracket closing s[0]
+func matchBracket(s string) int {
+	depth := 0
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '[' || c == '(':
+			depth++
+		case c == ']' || c == ')':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// Splits s at sep outside of quotes
+func splitOutsideQuotes(s string, sep byte) []string {
+	var parts []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == sep:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// Removes single or double quotes
+func unquote(s string) (string, error) {
+	if len(s) < 2 || (s[0] != '\'' && s[0] != '"') || s[len(s)-1] != s[0] {
+		return "", errors.New(fmt.Sprintf("invalid string %s", s))
+	}
+	return s[1 : len(s)-1], nil
+}
+
+// Parses a filter expression
+func parseFilter(s string) (*pathFilter, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "@") {
+		return nil, errors.New("filter must start with '@'")
+	}
+	for _, op := range []string{"==", "!=", "<=", ">=", "<", ">"} {
+		i := strings.Index(s, op)
+		if i < 0 {
+			continue
+		}
+		p, err := CompileJSONPath(strings.TrimSpace(s[1:i]))
+		if err != nil {
+			return nil, err
+		}
+		lit := strings.TrimSpace(s[i+len(op):])
+		var v interface{}
+		if lit != "" && (lit[0] == '\'' || lit[0] == '"') {
+			v, err = unquote(lit)
+		} else {
+			err = json.Unmarshal([]byte(lit), &v)
+		}
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid literal %s", lit))
+		}
+		return &pathFilter{p, op, v}, nil
+	}
+	p, err := CompileJSONPath(s[1:])
+	if err != nil {
+		return nil, err
+	}
+	return &pathFilter{path: p}, nil
+}
+
+// String returns the expression.
+func (p *JSONPath) String() string {
+	return p.expr
+}
+
+// Single tells whether the expression selects at most one value,
+// i.e. it consists only of single names and indices.
+func (p *JSONPath) Single() bool {
+	for _, st := range p.steps {
+		if st.rec || len(st.names)+len(st.idx) != 1 {
+			return false
+		}
+	}
+	return true
+}
+
+// Find returns all values selected by the expression in v.
+func (p *JSONPath) Find(v interface{}) []interface{} {
+	nodes := []interface{}{v}
+	for _, st := range p.steps {
+		var next []interface{}
+		for _, n := range nodes {
+			if st.rec {
+				for _, d := range descendants(n, nil) {
+					next = st.apply(d, next)
+				}
+			} else {
+				next = st.apply(n, next)
+			}
+		}
+		nodes = next
+	}
+	return nodes
+}
+
+// Normalises Records to maps
+func jsonNode(v interface{}) interface{} {
+	if r, ok := v.(Record); ok {
+		return map[string]interface{}(r)
+	}
+	return v
+}
+
+// Returns v and all values nested in v
+func descendants(v interface{}, acc []interface{}) []interface{} {
+	acc = append(acc, v)
+	switch x := jsonNode(v).(type) {
+	case map[string]interface{}:
+		for _, k := range sortedMapKeys(x) {
+			acc = descendants(x[k], acc)
+		}
+	case []interface{}:
+		for _, e := range x {
+			acc = descendants(e, acc)
+		}
+	}
+	return acc
+}
+
+func sortedMapKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Applies a step to one node
+func (st *pathStep) apply(v interface{}, acc []interface{}) []interface{} {
+	switch x := jsonNode(v).(type) {
+	case map[string]interface{}:
+		switch st.kind {
+		case stepName:
+			for _, name := range st.names {
+				if e, ok := x[name]; ok {
+					acc = append(acc, e)
+				}
+			}
+		case stepWild, stepFilter:
+			for _, k := range sortedMapKeys(x) {
+				if st.kind == stepWild || st.filter.match(x[k]) {
+					acc = append(acc, x[k])
+				}
+			}
+		}
+	case []interface{}:
+		switch st.kind {
+		case stepIndex:
+			for _, i := range st.idx {
+				if i < 0 {
+					i += len(x)
+				}
+				if i >= 0 && i < len(x) {
+					acc = append(acc, x[i])
+				}
+			}
+		case stepWild:
+			acc = append(acc, x...)
+		case stepFilter:
+			for _, e := range x {
+				if st.filter.match(e) {
+					acc = append(acc, e)
+				}
+			}
+		case stepSlice:
+			acc = append(acc, st.sliceOf(x)...)
+		}
+	}
+	return acc
+}
+
+// Selects a slice of an array
+func (st *pathStep) sliceOf(x []interface{}) []interface{} {
+	n := len(x)
+	step := 1
+	if st.slice[2] != nil {
+		step = *st.slice[2]
+	}
+	if step == 0 {
+		return nil
+	}
+	bound := func(p *int, def int) int {
+		if p == nil {
+			return def
+		}
+		i := *p
+		if i < 0 {
+			i += n
+		}
+		if i < 0 {
+			i = -1
+			if step > 0 {
+				i = 0
+			}
+		}
+		if i > n {
+			i = n
+		}
+		return i
+	}
+	var out []interface{}
+	if step > 0 {
+		for i := bound(st.slice[0], 0); i < bound(st.slice[1], n); i += step {
+			out = append(out, x[i])
+		}
+	} else {
+		start := bound(st.slice[0], n-1)
+		if start >= n {
+			start = n - 1
+		}
+		for i := start; i > bound(st.slice[1], -1); i += step {
+			out = append(out, x[i])
+		}
+	}
+	return out
+}
+
+// Evaluates a filter on a node
+func (f *pathFilter) match(v interface{}) bool {
+	found := f.path.Find(v)
+	if f.op == "" {
+		return len(found) > 0
+	}
+	for _, x := range found {
+		if compareJSON(x, f.op, f.val) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns v as float64, if it is a number
+func jsonNumber(v interface{}) (float64, bool) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	}
+	if n, ok := v.(json.Number); ok {
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// Compares a value with a literal
+func compareJSON(x interface{}, op string, lit interface{}) bool {
+	c, ok := 0, false
+	if a, isNum := jsonNumber(x); isNum {
+		if b, isNum := jsonNumber(lit); isNum {
+			c, ok = 0, true
+			if a < b {
+				c = -1
+			} else if a > b {
+				c = 1
+			}
+		}
+	} else if a, isStr := x.(string); isStr {
+		if b, isStr := lit.(string); isStr {
+			c, ok = strings.Compare(a, b), true
+		}
+	}
+	if !ok {
+		eq := reflect.DeepEqual(x, lit)
+		return (op == "==" && eq) || (op == "!=" && !eq)
+	}
+	switch op {
+	case "==":
+		return c == 0
+	case "!=":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+	return false
+}
+
+// Decodes raw JSON items
+func jsonValue(inp interface{}) (interface{}, error) {
+	var data []byte
+	switch x := inp.(type) {
+	case []byte:
+		data = x
+	case string:
+		data = []byte(x)
+	default:
+		return inp, nil
+	}
+	var v interface{}
+	err := json.Unmarshal(data, &v)
+	return v, err
+}
+
+// JSONExtract is a Conduit that applies a JSONPath expression
+// to incoming JSON values and sends the selected values
+// down the chain, each as an item of its own or, with All,
+// all values selected in one item together as []interface{}.
+// Items may be decoded values or raw JSON ([]byte or string).
+// Items without selected values are dropped.
+type JSONExtract struct {
+	path *JSONPath
+	all  bool
+}
+
+// NewJSONExtract creates a new JSONExtract Conduit.
+func NewJSONExtract(expr string) (*JSONExtract, error) {
+	p, err := CompileJSONPath(expr)
+	if err != nil {
+		return nil, err
+	}
+	je := new(JSONExtract)
+	je.path = p
+	return je, nil
+}
+
+// All sends all values selected in one item together.
+func (je *JSONExtract) All() *JSONExtract {
+	je.all = true
+	return je
+}
+
+// Conduct is the pre-defined method that makes JSONExtract a Conduit.
+// Conduct terminates with an error if raw JSON cannot be decoded.
+func (je *JSONExtract) Conduct(src conduit.Source, trg conduit.Target) error {
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			trg <- inp
+			continue
+		}
+		v, err := jsonValue(inp)
+		if err != nil {
+			return err
+		}
+		found := je.path.Find(v)
+		if len(found) == 0 {
+			continue
+		}
+		if je.all {
+			trg <- found
+			continue
+		}
+		for _, x := range found {
+			trg <- x
+		}
+	}
+	return nil
+}
+
+// JSONReshape is a Conduit that restructures incoming JSON values
+// into Records whose fields are given by JSONPath expressions.
+// Fields of expressions selecting a single value (see JSONPath.Single)
+// get that value or nil; other fields get all values
+// selected as []interface{}.
+type JSONReshape struct {
+	fields map[string]*JSONPath
+}
+
+// NewJSONReshape creates a new JSONReshape Conduit
+// from a map of field names to JSONPath expressions.
+func NewJSONReshape(fields map[string]string) (*JSONReshape, error) {
+	jr := new(JSONReshape)
+	jr.fields = make(map[string]*JSONPath, len(fields))
+	for name, expr := range fields {
+		p, err := CompileJSONPath(expr)
+		if err != nil {
+			return nil, err
+		}
+		jr.fields[name] = p
+	}
+	return jr, nil
+}
+
+// Conduct is the pre-defined method that makes JSONReshape a Conduit.
+// Conduct terminates with an error if raw JSON cannot be decoded.
+func (jr *JSONReshape) Conduct(src conduit.Source, trg conduit.Target) error {
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			trg <- inp
+			continue
+		}
+		v, err := jsonValue(inp)
+		if err != nil {
+			return err
+		}
+		rec := make(Record, len(jr.fields))
+		for name, p := range jr.fields {
+			found := p.Find(v)
+			if !p.Single() {
+				if found == nil {
+					found = []interface{}{}
+				}
+				rec[name] = found
+			} else if len(found) > 0 {
+				rec[name] = found[0]
+			} else {
+				rec[name] = nil
+			}
+		}
+		trg <- rec
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/toschoo/conduit"
+)
+
+const storeJSON = `{
+	"store": {
+		"book": [
+			{"category": "reference", "author": "Rees", "title": "Sayings", "price": 8.95},
+			{"category": "fiction", "author": "Waugh", "title": "Sword", "price": 12.99},
+			{"category": "fiction", "author": "Melville", "title": "Moby Dick", "isbn": "0-553", "price": 8.99},
+			{"category": "fiction", "author": "Tolkien", "title": "Rings", "isbn": "0-395", "price": 22.99}
+		],
+		"bicycle": {"color": "red", "price": 19.95}
+	}
+}`
+
+// JSONPath:
+// - Expressions select the expected values
+// - Invalid expressions are reported
+func TestJSONPath(t *testing.T) {
+	var doc interface{}
+	json.Unmarshal([]byte(storeJSON), &doc)
+
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{"$.store.book[0].author", "[Rees]"},
+		{"store.bicycle.color", "[red]"},
+		{"$['store']['bicycle']['color','price']", "[red 19.95]"},
+		{"$.store.book[*].author", "[Rees Waugh Melville Tolkien]"},
+		{"$..author", "[Rees Waugh Melville Tolkien]"},
+		{"$.store.*.color", "[red]"},
+		{"$..book[-1].title", "[Rings]"},
+		{"$..book[0,2].title", "[Sayings Moby Dick]"},
+		{"$..book[1:3].title", "[Sword Moby Dick]"},
+		{"$..book[::-2].title", "[Rings Sword]"},
+		{"$..book[?(@.isbn)].title", "[Moby Dick Rings]"},
+		{"$..book[?(@.price < 10)].title", "[Sayings Moby Dick]"},
+		{"$..book[?(@.author == 'Waugh')].price", "[12.99]"},
+		{"$..book[?(@.category != \"fiction\")].title", "[Sayings]"},
+		{"$..price", "[19.95 8.95 12.99 8.99 22.99]"},
+		{"$.nothing.here", "[]"},
+	}
+	for _, tc := range tests {
+		p, err := CompileJSONPath(tc.expr)
+		if err != nil {
+			t.Errorf("JSONPath: cannot compile %s: %v", tc.expr, err)
+			continue
+		}
+		have := fmt.Sprint(p.Find(doc))
+		if have != tc.want {
+			t.Errorf("JSONPath %s: expected %s, have %s", tc.expr, tc.want, have)
+		}
+	}
+	for _, expr := range []string{"$.a[", "$[x]", "$[?(x)]", "$[1:2:3:4]", "$..", "$[?(@.a == x)]"} {
+		_, err := CompileJSONPath(expr)
+		if err == nil {
+			t.Errorf("JSONPath: invalid expression %s not reported", expr)
+		}
+	}
+}
+
+// JSON extraction and reshaping:
+// - Selected values are sent individually or together
+// - Raw JSON and Records are accepted
+// - Documents are reshaped into Records
+func TestJSONExtract(t *testing.T) {
+	docs := []interface{}{
+		[]byte(storeJSON),
+		Record{"store": map[string]interface{}{"book": []interface{}{}}},
+	}
+
+	je, err := NewJSONExtract("$..book[*].title")
+	if err != nil {
+		t.Fatalf("JSONExtract: %v", err)
+	}
+	c := new(AnyConsumer)
+	chn := conduit.NewChain(&AnyProducer{docs}, []conduit.Conduit{je}, c, small)
+	err = chn.Run()
+	if err != nil {
+		t.Fatalf("JSONExtract failed: %v", chn.Errs)
+	}
+	if fmt.Sprint(c.recvd) != "[Sayings Sword Moby Dick Rings]" {
+		t.Errorf("JSONExtract: unexpected result %v", c.recvd)
+	}
+
+	je.All()
+	c = new(AnyConsumer)
+	chn = conduit.NewChain(&AnyProducer{docs}, []conduit.Conduit{je}, c, small)
+	err = chn.Run()
+	if err != nil {
+		t.Fatalf("JSONExtract failed: %v", chn.Errs)
+	}
+	if len(c.recvd) != 1 || len(c.recvd[0].([]interface{})) != 4 {
+		t.Errorf("JSONExtract: unexpected result %v", c.recvd)
+	}
+
+	jr, err := NewJSONReshape(map[string]string{
+		"color":   "$.store.bicycle.color",
+		"authors": "$..author",
+	})
+	if err != nil {
+		t.Fatalf("JSONReshape: %v", err)
+	}
+	c = new(AnyConsumer)
+	chn = conduit.NewChain(&AnyProducer{docs}, []conduit.Conduit{jr}, c, small)
+	err = chn.Run()
+	if err != nil {
+		t.Fatalf("JSONReshape failed: %v", chn.Errs)
+	}
+	want := []interface{}{
+		Record{"color": "red", "authors": []interface{}{"Rees", "Waugh", "Melville", "Tolkien"}},
+		Record{"color": nil, "authors": []interface{}{}},
+	}
+	if !reflect.DeepEqual(c.recvd, want) {
+		t.Errorf("JSONReshape: expected %v, have %v", want, c.recvd)
+	}
+
+	chn = conduit.NewChain(&AnyProducer{[]interface{}{"{bad"}}, []conduit.Conduit{jr}, new(AnyConsumer), small)
+	if chn.Run() == nil {
+		t.Errorf("JSONReshape: invalid JSON not reported")
+	}
+}
@@ -0,0 +1,182 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/toschoo/conduit"
+)
+
+// JSONTokens is a Producer that sends the tokens
+// of arbitrarily large JSON documents down the chain
+// as json.Token, without loading documents into memory.
+type JSONTokens struct {
+	conduit.Cancelable
+	rd io.Reader
+}
+
+// NewJSONTokens creates a new JSONTokens Producer.
+func NewJSONTokens(r io.Reader) (jt *JSONTokens) {
+	jt = new(JSONTokens)
+	if jt != nil {
+		jt.rd = r
+	}
+	return
+}
+
+// Produce is the pre-defined method that makes JSONTokens a Producer.
+func (jt *JSONTokens) Produce(trg conduit.Target) error {
+	dec := json.NewDecoder(jt.rd)
+	for !jt.Canceled() {
+		t, err := dec.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		trg <- t
+	}
+	return nil
+}
+
+// JSONPathReader is a Producer that selects subtrees
+// of arbitrarily large JSON documents by a path,
+// decodes them and sends them down the chain.
+// Only the selected subtrees are held in memory.
+// A path consists of object keys and array indices
+// separated by '/'; "*" matches any key or index.
+// For instance, "data/items/*" selects the elements
+// of the array "items" in the object "data";
+// the empty path selects the documents themselves.
+type JSONPathReader struct {
+	conduit.Cancelable
+	rd   io.Reader
+	path []string
+	new  func() interface{}
+}
+
+// NewJSONPathReader creates a new JSONPathReader Producer.
+// Subtrees are decoded as by JSONReader (see NewJSONReader).
+func NewJSONPathReader(r io.Reader, path string, newValue func() interface{}) (jp *JSONPathReader) {
+	jp = new(JSONPathReader)
+	if jp != nil {
+		jp.rd = r
+		jp.new = newValue
+		path = strings.Trim(path, "/")
+		if path != "" {
+			jp.path = strings.Split(path, "/")
+		}
+	}
+	return
+}
+
+// Produce is the pre-defined method that makes JSONPathReader a Producer.
+func (jp *JSONPathReader) Produce(trg conduit.Target) error {
+	dec := json.NewDecoder(jp.rd)
+	for !jp.Canceled() {
+		if !dec.More() {
+			_, err := dec.Token()
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		err := jp.value(dec, nil, trg)
+		if err == errCanceled {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// errCanceled unwinds the processing of a document
+// when the JSONPathReader was canceled
+var errCanceled = errors.New("canceled")
+
+// Processes the value at position pos
+func (jp *JSONPathReader) value(dec *json.Decoder, pos []string, trg conduit.Target) error {
+	if jp.Canceled() {
+		return errCanceled
+	}
+	switch {
+	case len(pos) == len(jp.path):
+		var v interface{}
+		var err error
+		if jp.new == nil {
+			err = dec.Decode(&v)
+		} else {
+			v = jp.new()
+			err = dec.Decode(v)
+		}
+		if err != nil {
+			return err
+		}
+		trg <- v
+		return nil
+	case !jp.prefix(pos):
+		return skipValue(dec)
+	}
+
+	t, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	d, ok := t.(json.Delim)
+	if !ok {
+		return nil // scalar above the path
+	}
+	for i := 0; dec.More(); i++ {
+		k := strconv.Itoa(i)
+		if d == '{' {
+			t, err = dec.Token()
+			if err != nil {
+				return err
+			}
+			k = t.(string)
+		}
+		err = jp.value(dec, append(pos, k), trg)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = dec.Token() // '}' or ']'
+	return err
+}
+
+// Tells whether pos is on the path
+func (jp *JSONPathReader) prefix(pos []string) bool {
+	for i, k := range pos {
+		if jp.path[i] != "*" && jp.path[i] != k {
+			return false
+		}
+	}
+	return true
+}
+
+// Skips the next value token by token
+func skipValue(dec *json.Decoder) error {
+	depth := 0
+	for {
+		t, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		if d, ok := t.(json.Delim); ok {
+			if d == '{' || d == '[' {
+				depth++
+			} else {
+				depth--
+			}
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/toschoo/conduit"
+)
+
+// builds {"meta": {...}, "data": {"skip": [...], "items": [points...]}}
+func makePointDoc(n int) string {
+	buf, _ := json.Marshal(map[string]interface{}{
+		"meta": map[string]interface{}{"items": []interface{}{&Point{7, 7}}},
+		"data": map[string]interface{}{
+			"skip":  []interface{}{&Point{-1, -1}},
+			"items": makePoints(n),
+		},
+	})
+	return string(buf)
+}
+
+// JSON path:
+// - It is processed without errors
+// - Exactly the selected subtrees are sent
+// - Wildcards match any key
+func TestJSONPathChain(t *testing.T) {
+	for i := 0; i < numOfTests; i++ {
+		for _, path := range []string{"data/items/*", "/*/items/*/"} {
+			err := testJSONPathChain(i, path)
+			if err != nil {
+				m := fmt.Sprintf("JSONPathChain failed: %v", err)
+				t.Error(m)
+			}
+		}
+	}
+}
+
+func testJSONPathChain(n int, path string) error {
+
+	doc := makePointDoc(n)
+	c := new(AnyConsumer)
+	p := NewJSONPathReader(strings.NewReader(doc+doc), path, newPoint)
+	chn := conduit.NewChain(p, nil, c, small)
+
+	err := chn.Run()
+	if err != nil {
+		m := fmt.Sprintf("error on running chain: %v", chn.Errs)
+		return errors.New(m)
+	}
+	points := makePoints(n)
+	if path != "data/items/*" {
+		// meta/items matches as well (keys are sorted)
+		points = append(points, &Point{7, 7})
+	}
+	points = append(points, points...)
+	if len(c.recvd) != len(points) {
+		m := fmt.Sprintf("expected %d items, have %d", len(points), len(c.recvd))
+		return errors.New(m)
+	}
+	for i, v := range c.recvd {
+		if *v.(*Point) != *points[i].(*Point) {
+			return errors.New("Received values differ from original!")
+		}
+	}
+	return nil
+}
+
+// JSON tokens:
+// - All tokens are sent
+// - Invalid JSON is reported
+// JSON path followed by Take:
+// - The reader stops when it is canceled
+//   in the middle of an array or an object
+func TestJSONPathTake(t *testing.T) {
+	var arr, obj []string
+	for i := 0; i < 2000; i++ {
+		arr = append(arr, fmt.Sprintf(`{"a": %d}`, i))
+		obj = append(obj, fmt.Sprintf(`"k%d": {"a": %d}`, i, i))
+	}
+	docs := []string{"[" + strings.Join(arr, ",") + "]", "{" + strings.Join(obj, ",") + "}"}
+	for _, doc := range docs {
+		p := NewJSONPathReader(strings.NewReader(doc), "*/a", nil)
+		c := &AnyConsumer{}
+		chn := conduit.NewChain(p, []conduit.Conduit{NewTake(3)}, c, small)
+		if err := chn.Run(); err != nil {
+			t.Errorf("JSONPathTake failed: %v", chn.Errs)
+		}
+		if fmt.Sprint(c.recvd) != "[0 1 2]" {
+			t.Errorf("JSONPathTake: received %v", c.recvd)
+		}
+	}
+}
+
+func TestJSONTokensChain(t *testing.T) {
+	c := new(AnyConsumer)
+	p := NewJSONTokens(strings.NewReader(`{"a": [1, true, null]}`))
+	chn := conduit.NewChain(p, nil, c, small)
+	err := chn.Run()
+	if err != nil {
+		t.Fatalf("JSONTokensChain failed: %v", chn.Errs)
+	}
+	have := fmt.Sprintf("%v", c.recvd)
+	if have != "[{ a [ 1 true <nil> ] }]" {
+		t.Errorf("JSONTokensChain: unexpected tokens: %s", have)
+	}
+	p = NewJSONTokens(strings.NewReader(`{"a" 1}`))
+	chn = conduit.NewChain(p, nil, c, small)
+	if chn.Run() == nil {
+		t.Errorf("JSONTokensChain: invalid JSON not reported")
+	}
+}
@@ -0,0 +1,29 @@
+package utils
+
+import (
+	"fmt"
+)
+
+// Keyed is implemented by data that carry their own key.
+// Keyed stages (session windows, groupings, routers, etc.)
+// use the key to tell apart data belonging to
+// different entities, e.g. users, tenants or devices.
+type Keyed interface {
+	Key() string
+}
+
+// KeyFunc obtains the key of an item.
+type KeyFunc func(interface{}) string
+
+// keyOf obtains the key of an item using kf;
+// if kf is nil, Keyed items provide their own key
+// and all other items are formatted with "%v".
+func keyOf(kf KeyFunc, inp interface{}) string {
+	if kf != nil {
+		return kf(inp)
+	}
+	if k, ok := inp.(Keyed); ok {
+		return k.Key()
+	}
+	return fmt.Sprintf("%v", inp)
+}
@@ -0,0 +1,479 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+const (
+	kinesisMaxBatch = 500
+	kinesisMaxBytes = 5 * 1024 * 1024
+	kinesisShardEnd = "SHARD_END"
+)
+
+// KinesisRecord is a record read from a Kinesis stream.
+type KinesisRecord struct {
+	Stream         string
+	ShardID        string
+	SequenceNumber string
+	PartitionKey   string
+	Data           []byte
+	Arrival        time.Time
+}
+
+type kinesisShard struct {
+	ShardId               string
+	ParentShardId         string
+	AdjacentParentShardId string
+}
+
+// KinesisReader is a Producer that reads the records
+// of all shards of a Kinesis stream concurrently
+// and sends them as *KinesisRecord down the chain.
+// The order of records with the same partition key is preserved:
+// after resharding, the child shards are read only when
+// their parents have been read completely.
+// With a StateStore (see SetStore), the position of the reader
+// in each shard is stored under the stage "kinesis/<stream>":
+// by default when the records of a request have been sent
+// down the chain or, with StoreOnCheckpoint, when a checkpoint
+// of the chain covers them (see conduit.Chain.SetCheckpoints
+// and conduit.Committer); after a restart, reading continues
+// after the stored positions (at least once).
+// The producer runs until the chain is canceled or terminates
+// with an error when reading fails after all attempts.
+type KinesisReader struct {
+	conduit.Cancelable
+	aws      awsClient
+	stream   string
+	latest   bool
+	limit    int
+	poll     time.Duration
+	discover time.Duration
+	retry    RetryPolicy
+	store    conduit.StateStore
+	onCP     bool
+	acks     ackQueue
+	pos      streamPositions
+	send     sync.Mutex
+	door     sync.Mutex
+	cancel   context.CancelFunc
+}
+
+// NewKinesisReader creates a new KinesisReader Producer
+// reading stream.
+func NewKinesisReader(cfg AWSConfig, stream string) (kr *KinesisReader) {
+	if stream == "" {
+		return nil
+	}
+	kr = new(KinesisReader)
+	if kr != nil {
+		kr.aws = newAWSClient(cfg, "kinesis")
+		kr.stream = stream
+		kr.limit = 1000
+		kr.poll = time.Second
+		kr.discover = 10 * time.Second
+		kr.retry = DefaultRetry
+	}
+	return
+}
+
+// SetLatest starts reading shards without stored position
+// at the newest record (default: at the oldest record).
+func (kr *KinesisReader) SetLatest() *KinesisReader {
+	kr.latest = true
+	return kr
+}
+
+// SetLimit sets the maximum number of records per request (default 1000).
+func (kr *KinesisReader) SetLimit(n int) *KinesisReader {
+	if n > 0 && n <= 10000 {
+		kr.limit = n
+	}
+	return kr
+}
+
+// SetPoll sets how long the reader waits
+// after a request without records (default 1s).
+func (kr *KinesisReader) SetPoll(d time.Duration) *KinesisReader {
+	kr.poll = d
+	return kr
+}
+
+// SetDiscovery sets the interval in which
+// the reader looks for new shards (default 10s).
+func (kr *KinesisReader) SetDiscovery(d time.Duration) *KinesisReader {
+	if d > 0 {
+		kr.discover = d
+	}
+	return kr
+}
+
+// SetRetry sets the RetryPolicy for requests (default: DefaultRetry).
+func (kr *KinesisReader) SetRetry(rp RetryPolicy) *KinesisReader {
+	kr.retry = rp
+	return kr
+}
+
+// SetStore sets the StateStore where the positions are kept.
+// The store should not be the StateStore of the chain,
+// which is reset to the latest checkpoint on restore.
+func (kr *KinesisReader) SetStore(st conduit.StateStore) *KinesisReader {
+	kr.store = st
+	return kr
+}
+
+// StoreOnCheckpoint stores positions only when
+// a checkpoint covers them.
+func (kr *KinesisReader) StoreOnCheckpoint() *KinesisReader {
+	kr.onCP = true
+	return kr
+}
+
+// Resume is the pre-defined method that makes KinesisReader
+// a conduit.Resumer. Reading continues after the stored positions,
+// so nothing is skipped.
+func (kr *KinesisReader) Resume(pos uint64) error {
+	kr.acks.resume(pos)
+	return nil
+}
+
+// Commit is the pre-defined method that makes KinesisReader
+// a conduit.Committer; with StoreOnCheckpoint, it stores
+// the positions covered by the checkpoint.
+func (kr *KinesisReader) Commit(cp *conduit.Checkpoint) error {
+	if !kr.onCP {
+		return nil
+	}
+	err := kr.acks.commit(cp.Position)
+	if err != nil {
+		return err
+	}
+	return kr.pos.save()
+}
+
+// Cancel cancels the producer and the pending requests.
+func (kr *KinesisReader) Cancel() {
+	kr.Cancelable.Cancel()
+	kr.door.Lock()
+	defer kr.door.Unlock()
+	if kr.cancel != nil {
+		kr.cancel()
+	}
+}
+
+// Calls an operation of the Kinesis API with retries
+func (kr *KinesisReader) call(ctx context.Context, op string, in, out interface{}) error {
+	attempts, err := kr.retry.run(kr.Canceled, func() (bool, error) {
+		err := kr.aws.callJSON(ctx, "1.1", "Kinesis_20131202."+op, in, out)
+		return awsRetryable(err), err
+	})
+	if err != nil {
+		return errors.New(fmt.Sprintf("%s failed after %d attempts: %v", op, attempts, err))
+	}
+	return nil
+}
+
+// Lists all shards of the stream
+func (kr *KinesisReader) shards(ctx context.Context) ([]kinesisShard, error) {
+	var shards []kinesisShard
+	req := map[string]interface{}{"StreamName": kr.stream}
+	for {
+		var rsp struct {
+			Shards    []kinesisShard
+			NextToken string
+		}
+		err := kr.call(ctx, "ListShards", req, &rsp)
+		if err != nil {
+			return nil, err
+		}
+		shards = append(shards, rsp.Shards...)
+		if rsp.NextToken == "" {
+			return shards, nil
+		}
+		req = map[string]interface{}{"NextToken": rsp.NextToken}
+	}
+}
+
+// Produce is the pre-defined method that makes KinesisReader a Producer.
+func (kr *KinesisReader) Produce(trg conduit.Target) error {
+	kr.acks.start()
+	pos, err := kr.pos.load(kr.store, "kinesis/"+kr.stream, kinesisShardEnd)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	kr.door.Lock()
+	kr.cancel = cancel
+	kr.door.Unlock()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	var first error
+	var errOnce sync.Once
+	done := make(chan string)
+	running := make(map[string]bool)
+	finished := make(map[string]bool)
+	for shard, seq := range pos {
+		if seq == kinesisShardEnd {
+			finished[shard] = true
+		}
+	}
+
+	t := time.NewTicker(kr.discover)
+	defer t.Stop()
+	for ctx.Err() == nil && !kr.Canceled() {
+		shards, err := kr.shards(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				errOnce.Do(func() { first = err })
+			}
+			break
+		}
+		known := make(map[string]bool)
+		for _, s := range shards {
+			known[s.ShardId] = true
+		}
+		for _, s := range shards {
+			if running[s.ShardId] || finished[s.ShardId] {
+				continue
+			}
+			// parents that are no longer listed have expired
+			if (known[s.ParentShardId] && !finished[s.ParentShardId]) ||
+				(known[s.AdjacentParentShardId] && !finished[s.AdjacentParentShardId]) {
+				continue
+			}
+			running[s.ShardId] = true
+			wg.Add(1)
+			go func(shard string) {
+				defer wg.Done()
+				err := kr.read(ctx, shard, trg)
+				if err != nil && !kr.Canceled() {
+					errOnce.Do(func() { first = err })
+					cancel()
+				}
+				select {
+				case done <- shard:
+				case <-ctx.Done():
+				}
+			}(s.ShardId)
+		}
+		select {
+		case shard := <-done:
+			// children of a finished shard may be ready
+			delete(running, shard)
+			finished[shard] = true
+		case <-t.C:
+		case <-ctx.Done():
+		}
+	}
+	cancel()
+	wg.Wait()
+	return first
+}
+
+// Reads a shard until it is closed or the reader is canceled
+func (kr *KinesisReader) read(ctx context.Context, shard string, trg conduit.Target) error {
+	req := map[string]interface{}{"StreamName": kr.stream, "ShardId": shard, "ShardIteratorType": "TRIM_HORIZON"}
+	if seq := kr.pos.get(shard); seq != "" {
+		req["ShardIteratorType"] = "AFTER_SEQUENCE_NUMBER"
+		req["StartingSequenceNumber"] = seq
+	} else if kr.latest {
+		req["ShardIteratorType"] = "LATEST"
+	}
+	var it struct{ ShardIterator string }
+	err := kr.call(ctx, "GetShardIterator", req, &it)
+	if err != nil {
+		return err
+	}
+	iterator := it.ShardIterator
+	for iterator != "" && !kr.Canceled() {
+		var rsp struct {
+			Records []struct {
+				SequenceNumber              string
+				PartitionKey                string
+				Data                        []byte
+				ApproximateArrivalTimestamp float64
+			}
+			NextShardIterator string
+		}
+		err = kr.call(ctx, "GetRecords", map[string]interface{}{"ShardIterator": iterator, "Limit": kr.limit}, &rsp)
+		if err != nil {
+			return err
+		}
+		for _, r := range rsp.Records {
+			rec := &KinesisRecord{
+				Stream:         kr.stream,
+				ShardID:        shard,
+				SequenceNumber: r.SequenceNumber,
+				PartitionKey:   r.PartitionKey,
+				Data:           r.Data,
+				Arrival:        time.Unix(0, int64(r.ApproximateArrivalTimestamp*1e9)),
+			}
+			if !kr.deliver(ctx, rec, trg) {
+				return nil
+			}
+		}
+		if rsp.NextShardIterator == "" {
+			kr.pos.close(shard)
+		}
+		if !kr.onCP {
+			err = kr.pos.save()
+			if err != nil {
+				return err
+			}
+		}
+		iterator = rsp.NextShardIterator
+		if len(rsp.Records) == 0 && iterator != "" {
+			sleep(kr.poll, kr.Canceled)
+		}
+	}
+	return nil
+}
+
+// Sends a record down the chain; with StoreOnCheckpoint,
+// its acknowledgment is added in the same order
+func (kr *KinesisReader) deliver(ctx context.Context, rec *KinesisRecord, trg conduit.Target) bool {
+	kr.send.Lock()
+	defer kr.send.Unlock()
+	if ctx.Err() != nil {
+		return false
+	}
+	kr.pos.sent(rec.ShardID)
+	ack := func() error {
+		kr.pos.ack(rec.ShardID, rec.SequenceNumber)
+		return nil
+	}
+	if kr.onCP {
+		kr.acks.add(ack)
+	}
+	trg <- rec
+	if !kr.onCP {
+		ack()
+	}
+	return true
+}
+
+// Record to be sent with PutRecords
+type kinesisEntry struct {
+	item interface{}
+	Data []byte
+	Key  string `json:"PartitionKey"`
+}
+
+func (e *kinesisEntry) source() interface{} { return e.item }
+func (e *kinesisEntry) size() int           { return len(e.Data) + len(e.Key) }
+
+// KinesisWriter is a Consumer that puts the incoming items
+// into a Kinesis stream in batches (PutRecords).
+// The partition key of an item is obtained with a KeyFunc
+// (see KeyFunc and Keyed), so that items of the same entity
+// go to the same shard in order.
+// []byte and string items are sent as they are,
+// *KinesisRecord items with their data and partition key
+// and others are encoded with a MarshalFunc (default: json.Marshal).
+// Batches hold up to 500 records and are sent
+// when they are full, at barriers and at the end of the stream.
+// Records that fail (e.g. due to throttling) are sent again
+// according to the RetryPolicy (DefaultRetry).
+// Records that finally fail are sent as FailedRequest
+// to the side output "failed" (see conduit.SideOutputter)
+// or, if the side output is not connected,
+// terminate the consumer with an error.
+type KinesisWriter struct {
+	aws     awsClient
+	stream  string
+	key     KeyFunc
+	marshal MarshalFunc
+	retry   RetryPolicy
+	side    conduit.Target
+}
+
+// NewKinesisWriter creates a new KinesisWriter Consumer
+// writing to stream with partition keys obtained by key.
+func NewKinesisWriter(cfg AWSConfig, stream string, key KeyFunc) (kw *KinesisWriter) {
+	if stream == "" {
+		return nil
+	}
+	kw = new(KinesisWriter)
+	if kw != nil {
+		kw.aws = newAWSClient(cfg, "kinesis")
+		kw.stream = stream
+		kw.key = key
+		kw.marshal = json.Marshal
+		kw.retry = DefaultRetry
+	}
+	return
+}
+
+// SetMarshal sets the MarshalFunc.
+func (kw *KinesisWriter) SetMarshal(marshal MarshalFunc) *KinesisWriter {
+	kw.marshal = marshal
+	return kw
+}
+
+// SetRetry sets the RetryPolicy (default: DefaultRetry).
+func (kw *KinesisWriter) SetRetry(rp RetryPolicy) *KinesisWriter {
+	kw.retry = rp
+	return kw
+}
+
+// SideOutput is the pre-defined method that makes KinesisWriter
+// a conduit.SideOutputter; name must be "failed".
+func (kw *KinesisWriter) SideOutput(name string, trg conduit.Target) {
+	if name == "failed" {
+		kw.side = trg
+	}
+}
+
+// Consume is the pre-defined method that makes KinesisWriter a Consumer.
+func (kw *KinesisWriter) Consume(src conduit.Source) error {
+	return consumeBatches(src, kinesisMaxBatch, kinesisMaxBytes, kw.retry, sideFailed(kw.side), kw.entry, kw.send)
+}
+
+// Creates the record for an item
+func (kw *KinesisWriter) entry(inp interface{}) (batchEntry, error) {
+	if r, ok := inp.(*KinesisRecord); ok {
+		return &kinesisEntry{item: inp, Data: r.Data, Key: r.PartitionKey}, nil
+	}
+	data, err := payload(inp, kw.marshal)
+	if err != nil {
+		return nil, err
+	}
+	key := keyOf(kw.key, inp)
+	if key == "" || len(key) > 256 {
+		return nil, errors.New(fmt.Sprintf("invalid partition key %q", key))
+	}
+	return &kinesisEntry{item: inp, Data: data, Key: key}, nil
+}
+
+// Sends a batch
+func (kw *KinesisWriter) send(entries []interface{}) ([]batchFailure, error) {
+	var rsp struct {
+		FailedRecordCount int
+		Records           []struct {
+			ErrorCode    string
+			ErrorMessage string
+		}
+	}
+	req := map[string]interface{}{"StreamName": kw.stream, "Records": entries}
+	err := kw.aws.callJSON(context.Background(), "1.1", "Kinesis_20131202.PutRecords", req, &rsp)
+	if err != nil || rsp.FailedRecordCount == 0 {
+		return nil, err
+	}
+	var fs []batchFailure
+	for i, r := range rsp.Records {
+		if r.ErrorCode != "" {
+			e := &AWSError{Code: r.ErrorCode, Message: r.ErrorMessage}
+			fs = append(fs, batchFailure{index: i, retryable: true, err: e})
+		}
+	}
+	return fs, nil
+}
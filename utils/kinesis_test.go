@@ -0,0 +1,364 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+// Kinesis test server: one stream with shards that can be split;
+// records with key "throttle" are throttled once,
+// records with key "blocked" are always throttled
+type kinesisServer struct {
+	srv       *httptest.Server
+	door      sync.Mutex
+	shards    []*kinesisTestShard
+	seq       int
+	roots     int
+	throttled bool
+	requests  int
+}
+
+type kinesisTestShard struct {
+	id      string
+	parent  string
+	closed  bool
+	records []map[string]interface{}
+}
+
+func newKinesisServer(shards int) *kinesisServer {
+	ks := &kinesisServer{roots: shards}
+	for i := 0; i < shards; i++ {
+		ks.shards = append(ks.shards, &kinesisTestShard{id: fmt.Sprintf("shard-%d", i)})
+	}
+	ks.srv = httptest.NewServer(http.HandlerFunc(ks.handle))
+	return ks
+}
+
+func (ks *kinesisServer) config() AWSConfig {
+	return AWSConfig{
+		Region:      "eu-west-1",
+		Credentials: AWSCredentials{AccessKeyID: "key", SecretAccessKey: "secret"},
+		Endpoint:    ks.srv.URL,
+	}
+}
+
+// Closes the shard and creates two children
+func (ks *kinesisServer) split(id string) {
+	ks.door.Lock()
+	defer ks.door.Unlock()
+	for _, s := range ks.shards {
+		if s.id == id {
+			s.closed = true
+		}
+	}
+	n := len(ks.shards)
+	for i := 0; i < 2; i++ {
+		ks.shards = append(ks.shards, &kinesisTestShard{id: fmt.Sprintf("shard-%d", n+i), parent: id})
+	}
+}
+
+func (ks *kinesisServer) putRequests() int {
+	ks.door.Lock()
+	defer ks.door.Unlock()
+	return ks.requests
+}
+
+// Open shard for a partition key:
+// keys of a closed shard go to one of its children
+func (ks *kinesisServer) route(key string) *kinesisTestShard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	hash := int(h.Sum32())
+	s := ks.shards[hash%ks.roots]
+	for s.closed {
+		var children []*kinesisTestShard
+		for _, c := range ks.shards {
+			if c.parent == s.id {
+				children = append(children, c)
+			}
+		}
+		hash /= 2
+		s = children[hash%len(children)]
+	}
+	return s
+}
+
+func (ks *kinesisServer) shard(id string) *kinesisTestShard {
+	for _, s := range ks.shards {
+		if s.id == id {
+			return s
+		}
+	}
+	return nil
+}
+
+func (ks *kinesisServer) handle(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=key/") {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	var req struct {
+		ShardId                string
+		ShardIteratorType      string
+		StartingSequenceNumber string
+		ShardIterator          string
+		Limit                  int
+		NextToken              string
+		Records                []struct {
+			Data         []byte
+			PartitionKey string
+		}
+	}
+	json.NewDecoder(r.Body).Decode(&req)
+	ks.door.Lock()
+	defer ks.door.Unlock()
+	var rsp interface{}
+	switch r.Header.Get("X-Amz-Target") {
+	case "Kinesis_20131202.ListShards":
+		// two shards per page
+		from, _ := strconv.Atoi(req.NextToken)
+		var shards []map[string]string
+		for i := from; i < len(ks.shards) && i < from+2; i++ {
+			shards = append(shards, map[string]string{"ShardId": ks.shards[i].id, "ParentShardId": ks.shards[i].parent})
+		}
+		next := ""
+		if from+2 < len(ks.shards) {
+			next = strconv.Itoa(from + 2)
+		}
+		rsp = map[string]interface{}{"Shards": shards, "NextToken": next}
+	case "Kinesis_20131202.GetShardIterator":
+		s := ks.shard(req.ShardId)
+		pos := 0
+		switch req.ShardIteratorType {
+		case "LATEST":
+			pos = len(s.records)
+		case "AFTER_SEQUENCE_NUMBER":
+			for i, rec := range s.records {
+				if rec["SequenceNumber"] == req.StartingSequenceNumber {
+					pos = i + 1
+				}
+			}
+		}
+		rsp = map[string]string{"ShardIterator": fmt.Sprintf("%s/%d", s.id, pos)}
+	case "Kinesis_20131202.GetRecords":
+		parts := strings.Split(req.ShardIterator, "/")
+		s := ks.shard(parts[0])
+		pos, _ := strconv.Atoi(parts[1])
+		end := pos + req.Limit
+		if end > len(s.records) {
+			end = len(s.records)
+		}
+		m := map[string]interface{}{"Records": s.records[pos:end]}
+		if !s.closed || end < len(s.records) {
+			m["NextShardIterator"] = fmt.Sprintf("%s/%d", s.id, end)
+		}
+		rsp = m
+	case "Kinesis_20131202.PutRecords":
+		ks.requests++
+		var results []map[string]string
+		failed := 0
+		for _, rec := range req.Records {
+			if rec.PartitionKey == "blocked" || (rec.PartitionKey == "throttle" && !ks.throttled) {
+				ks.throttled = true
+				failed++
+				results = append(results, map[string]string{"ErrorCode": "ProvisionedThroughputExceededException", "ErrorMessage": "slow down"})
+				continue
+			}
+			s := ks.route(rec.PartitionKey)
+			ks.seq++
+			seq := fmt.Sprintf("%020d", ks.seq)
+			s.records = append(s.records, map[string]interface{}{
+				"SequenceNumber":              seq,
+				"PartitionKey":                rec.PartitionKey,
+				"Data":                        rec.Data,
+				"ApproximateArrivalTimestamp": float64(time.Now().Unix()),
+			})
+			results = append(results, map[string]string{"SequenceNumber": seq, "ShardId": s.id})
+		}
+		rsp = map[string]interface{}{"FailedRecordCount": failed, "Records": results}
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"__type":"UnknownOperationException"}`))
+		return
+	}
+	json.NewEncoder(w).Encode(rsp)
+}
+
+// Item with a partition key
+type kinesisItem struct {
+	K string `json:"k"`
+	N int    `json:"n"`
+}
+
+func (i kinesisItem) Key() string { return i.K }
+
+// Puts n items with keys k0 to k4 starting at from
+func putKinesis(ks *kinesisServer, from, n int) error {
+	var items []interface{}
+	for i := from; i < from+n; i++ {
+		items = append(items, kinesisItem{K: fmt.Sprintf("k%d", i%5), N: i})
+	}
+	chn := conduit.NewChain(&AnyProducer{items}, nil, NewKinesisWriter(ks.config(), "stream", nil), small)
+	if chn.Run() != nil {
+		return errors.New(fmt.Sprintf("cannot put: %v", chn.Errs))
+	}
+	return nil
+}
+
+// Items of the records in the order of reception
+func kinesisItems(recs []interface{}) ([]kinesisItem, error) {
+	var items []kinesisItem
+	for _, inp := range recs {
+		var i kinesisItem
+		rec := inp.(*KinesisRecord)
+		if err := json.Unmarshal(rec.Data, &i); err != nil {
+			return nil, err
+		}
+		if i.K != rec.PartitionKey {
+			return nil, errors.New(fmt.Sprintf("record %s has key %s", rec.Data, rec.PartitionKey))
+		}
+		items = append(items, i)
+	}
+	return items, nil
+}
+
+// Checks that all items from 0 to n were received
+// and that items with the same key are in order
+func checkKinesis(items []kinesisItem, n int) error {
+	seen := make(map[int]bool)
+	last := make(map[string]int)
+	for _, i := range items {
+		if l, ok := last[i.K]; ok && l > i.N {
+			return errors.New(fmt.Sprintf("%s: %d after %d", i.K, i.N, l))
+		}
+		last[i.K] = i.N
+		seen[i.N] = true
+	}
+	for i := 0; i < n; i++ {
+		if !seen[i] {
+			return errors.New(fmt.Sprintf("item %d missing", i))
+		}
+	}
+	return nil
+}
+
+// Kinesis:
+// - Items are put in batches with partition keys from Keyed
+// - Throttled records are retried, finally failing ones are sent to the side output
+// - The reader reads all shards, also after resharding,
+// with items of the same key in order
+func TestKinesis(t *testing.T) {
+	ks := newKinesisServer(3)
+	defer ks.srv.Close()
+
+	items := []interface{}{kinesisItem{K: "throttle", N: -1}, kinesisItem{K: "blocked", N: -2}}
+	for i := 0; i < 600; i++ {
+		items = append(items, kinesisItem{K: fmt.Sprintf("k%d", i%5), N: i})
+	}
+	failed := &sideCollector{items: make(chan interface{}, 10)}
+	kw := NewKinesisWriter(ks.config(), "stream", nil).SetRetry(fastRetry)
+	chn := conduit.NewChain(&AnyProducer{items}, nil, kw, small)
+	chn.AddSide(kw, "failed", failed)
+	if err := chn.Run(); err != nil {
+		t.Fatalf("KinesisWriter failed: %v", chn.Errs)
+	}
+	f := (<-failed.items).(*FailedRequest)
+	if f.Item != items[1] || f.Attempts != fastRetry.Attempts {
+		t.Errorf("KinesisWriter: unexpected failed request %+v", f)
+	}
+	if ks.putRequests() < 2 {
+		t.Errorf("KinesisWriter: records not sent in batches of 500")
+	}
+
+	ks.split("shard-0")
+	if err := putKinesis(ks, 600, 100); err != nil {
+		t.Fatalf("KinesisWriter: %v", err)
+	}
+
+	c := &TakeConsumer{n: 701}
+	kr := NewKinesisReader(ks.config(), "stream").SetLimit(50).SetPoll(10 * time.Millisecond)
+	if err := conduit.NewChain(kr, nil, c, small).Run(); err != nil {
+		t.Fatalf("KinesisReader failed: %v", err)
+	}
+	recvd, err := kinesisItems(c.recvd)
+	if err != nil {
+		t.Fatalf("KinesisReader: %v", err)
+	}
+	throttled := false
+	var rest []kinesisItem
+	for _, i := range recvd {
+		if i.K == "throttle" {
+			throttled = true
+			continue
+		}
+		rest = append(rest, i)
+	}
+	if !throttled {
+		t.Errorf("KinesisReader: throttled record not received")
+	}
+	if len(rest) != 700 {
+		t.Errorf("KinesisReader: received %d records", len(rest))
+	}
+	if err := checkKinesis(rest, 700); err != nil {
+		t.Errorf("KinesisReader: %v", err)
+	}
+}
+
+// Kinesis with positions stored on checkpoints:
+// - Positions are stored when a checkpoint covers them
+// - After a crash, reading continues after the stored positions
+func TestKinesisCheckpoint(t *testing.T) {
+	ks := newKinesisServer(2)
+	defer ks.srv.Close()
+	if err := putKinesis(ks, 0, 400); err != nil {
+		t.Fatalf("KinesisWriter: %v", err)
+	}
+
+	st := conduit.NewMemStore()
+	cps := conduit.NewMemCheckpoints()
+	newReader := func() *KinesisReader {
+		return NewKinesisReader(ks.config(), "stream").SetLimit(20).SetPoll(10 * time.Millisecond).
+			SetStore(st).StoreOnCheckpoint()
+	}
+	c := &StopConsumer{n: 350, err: errors.New("crash")}
+	kr := newReader()
+	chn := conduit.NewChain(kr, nil, c, small)
+	chn.SetCheckpoints(time.Millisecond, cps)
+	if chn.Run() == nil {
+		t.Fatalf("KinesisReader: chain did not crash")
+	}
+	// the producer is not stopped by the failing consumer
+	kr.Cancel()
+	cp, _ := cps.Latest()
+	if cp == nil {
+		t.Fatalf("KinesisReader: no checkpoint taken")
+	}
+	pos := int(cp.Position)
+	if pos > len(c.recvd) {
+		t.Fatalf("KinesisReader: checkpoint at %d after %d records", pos, len(c.recvd))
+	}
+
+	rest := &StopConsumer{n: 400 - pos, err: conduit.EOS}
+	if err := conduit.NewChain(newReader(), nil, rest, small).Run(); err != nil {
+		t.Fatalf("KinesisReader: restarted chain failed: %v", err)
+	}
+	before, _ := kinesisItems(c.recvd[:pos])
+	after, err := kinesisItems(rest.recvd)
+	if err != nil {
+		t.Fatalf("KinesisReader: %v", err)
+	}
+	if err := checkKinesis(append(before, after...), 400); err != nil {
+		t.Errorf("KinesisReader: after restart: %v", err)
+	}
+}
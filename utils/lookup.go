@@ -0,0 +1,160 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+// TableLoaders are expected to provide a Producer
+// that delivers the complete contents of a lookup table,
+// e.g. a CSV Producer reading the table file.
+// LookupJoins call Load each time the table is (re)loaded.
+type TableLoader interface {
+	Load() (conduit.Producer, error)
+}
+
+// MissPolicy defines how LookupJoins handle items
+// without match in the lookup table.
+type MissPolicy int
+
+const (
+	// MissPass sends items without match down the chain
+	// with Match set to nil.
+	MissPass MissPolicy = iota
+	// MissDrop drops items without match.
+	MissDrop
+	// MissError terminates the LookupJoin with an error.
+	MissError
+)
+
+// Enriched is sent down the chain by LookupJoins:
+// an incoming item together with the matching table row.
+type Enriched struct {
+	Item  interface{}
+	Match interface{}
+}
+
+// LookupJoin is a Conduit that joins each incoming item
+// against a lookup table held in memory.
+// The table is loaded from a Producer before
+// the first item is processed and, optionally,
+// refreshed periodically in the background.
+type LookupJoin struct {
+	door    sync.RWMutex
+	loader  TableLoader
+	tk, ik  KeyFunc
+	miss    MissPolicy
+	every   time.Duration
+	table   map[string]interface{}
+	lastErr error
+}
+
+// NewLookupJoin creates a new LookupJoin.
+// The keys of table rows are obtained using tk,
+// the keys of incoming items using ik (see KeyFunc and Keyed).
+// If the table contains the same key more than once,
+// the last row wins.
+func NewLookupJoin(loader TableLoader, tk, ik KeyFunc, miss MissPolicy) (l *LookupJoin) {
+	if loader == nil {
+		return nil
+	}
+	l = new(LookupJoin)
+	if l != nil {
+		l.loader = loader
+		l.tk, l.ik = tk, ik
+		l.miss = miss
+	}
+	return
+}
+
+// SetRefresh makes the LookupJoin reload the table
+// every interval while it is running.
+// If reloading fails, the old table is kept
+// (see RefreshErr).
+func (l *LookupJoin) SetRefresh(interval time.Duration) {
+	l.every = interval
+}
+
+// RefreshErr returns the error of the latest
+// failed refresh or nil if the latest refresh succeeded.
+func (l *LookupJoin) RefreshErr() error {
+	l.door.RLock()
+	defer l.door.RUnlock()
+	return l.lastErr
+}
+
+// Conduct is the pre-defined method that makes LookupJoin a Conduit.
+func (l *LookupJoin) Conduct(src conduit.Source, trg conduit.Target) error {
+	err := l.refresh()
+	if err != nil {
+		return err
+	}
+	if l.every > 0 {
+		stop := make(chan struct{})
+		defer close(stop)
+		go l.refresher(stop)
+	}
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			trg <- inp
+			continue
+		}
+		k := keyOf(l.ik, inp)
+		l.door.RLock()
+		m, ok := l.table[k]
+		l.door.RUnlock()
+		if !ok {
+			switch l.miss {
+			case MissDrop:
+				continue
+			case MissError:
+				s := fmt.Sprintf("no match for key %s", k)
+				return errors.New(s)
+			}
+		}
+		trg <- Enriched{Item: inp, Match: m}
+	}
+	return nil
+}
+
+// reloads the table periodically
+func (l *LookupJoin) refresher(stop <-chan struct{}) {
+	t := time.NewTicker(l.every)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			err := l.refresh()
+			l.door.Lock()
+			l.lastErr = err
+			l.door.Unlock()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// loads the table
+func (l *LookupJoin) refresh() error {
+	p, err := l.loader.Load()
+	if err != nil {
+		return err
+	}
+	table := make(map[string]interface{})
+	rows, errc := startProducer(p, 0)
+	for row := range rows {
+		table[keyOf(l.tk, row)] = row
+	}
+	err = <-errc
+	if err != nil {
+		return err
+	}
+	l.door.Lock()
+	l.table = table
+	l.door.Unlock()
+	return nil
+}
@@ -0,0 +1,163 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+// Loads 0..k-1 first and 0..k+max-1 on reload
+type SeqLoader struct {
+	k     int
+	max   int
+	loads int32
+}
+
+func (l *SeqLoader) Load() (conduit.Producer, error) {
+	if atomic.AddInt32(&l.loads, 1) == 1 {
+		return &SeqProducer{makeSeq(l.k)}, nil
+	}
+	return &SeqProducer{makeSeq(l.k + l.max)}, nil
+}
+
+type ErrLoader struct{}
+
+func (l *ErrLoader) Load() (conduit.Producer, error) {
+	return new(ErrProducer), nil
+}
+
+type EnrichedConsumer struct {
+	recvd []Enriched
+}
+
+func (c *EnrichedConsumer) Consume(src conduit.Source) error {
+	for v := range src {
+		c.recvd = append(c.recvd, v.(Enriched))
+	}
+	return nil
+}
+
+// Lookup join:
+// - It is processed without errors (unless MissError)
+// - Items are enriched with the matching row
+// - Misses are handled according to the policy
+func TestLookupJoinChain(t *testing.T) {
+	for i := 0; i < numOfTests; i++ {
+		for _, miss := range []MissPolicy{MissPass, MissDrop, MissError} {
+			err := testLookupJoinChain(numOfData, 1+rand.Int()%10, miss)
+			if err != nil {
+				m := fmt.Sprintf("LookupJoinChain failed: %v", err)
+				t.Error(m)
+			}
+		}
+	}
+}
+
+// Lookup join with refresh:
+// - The table is reloaded
+// - Later items see the reloaded table
+func TestLookupJoinRefresh(t *testing.T) {
+	ld := &SeqLoader{k: 1, max: numOfData}
+	l := NewLookupJoin(ld, nil, nil, MissDrop)
+	l.SetRefresh(time.Millisecond)
+	p := &SlowSeqProducer{numOfData}
+	c := new(EnrichedConsumer)
+	chn := conduit.NewChain(p, []conduit.Conduit{l}, c, small)
+	err := chn.Run()
+	if err != nil {
+		t.Fatalf("LookupJoinRefresh failed: %v", chn.Errs)
+	}
+	if atomic.LoadInt32(&ld.loads) < 2 {
+		t.Errorf("LookupJoinRefresh: table not reloaded")
+	}
+	if len(c.recvd) < 2 {
+		t.Errorf("LookupJoinRefresh: only %d matches", len(c.recvd))
+	}
+}
+
+// Lookup join with failing table:
+// - The error is reported
+func TestErrLookupJoinChain(t *testing.T) {
+	p := &SeqProducer{makeSeq(numOfData)}
+	c := new(EnrichedConsumer)
+	pipe := []conduit.Conduit{NewLookupJoin(new(ErrLoader), nil, nil, MissPass)}
+	chn := conduit.NewChain(p, pipe, c, small)
+	err := chn.Run()
+	if err == nil || len(chn.Errs) != 1 || chn.Errs[0].Error() != errMsg {
+		t.Errorf("ErrLookupJoinChain: unexpected errors: %v", chn.Errs)
+	}
+}
+
+// Produces 0..max-1 slowly
+type SlowSeqProducer struct {
+	max int
+}
+
+func (p *SlowSeqProducer) Produce(trg conduit.Target) error {
+	for i := 0; i < p.max; i++ {
+		time.Sleep(100 * time.Microsecond)
+		trg <- i
+	}
+	return nil
+}
+
+func testLookupJoinChain(n, k int, miss MissPolicy) error {
+
+	p := &SeqProducer{makeSeq(n)}
+	c := new(EnrichedConsumer)
+
+	// table has keys 0..k-1, items have keys 0..2k-1
+	l := NewLookupJoin(&SeqLoader{k: k}, nil, modKey(2*k), miss)
+
+	chn := conduit.NewChain(p, []conduit.Conduit{l}, c, small)
+
+	err := chn.Run()
+	if miss == MissError {
+		if err == nil || len(chn.Errs) != 1 {
+			return errors.New("miss not reported")
+		}
+		return nil
+	}
+	if err != nil {
+		m := fmt.Sprintf("error on running chain: %v", err)
+		return errors.New(m)
+	}
+	hits := 0
+	for _, e := range c.recvd {
+		i := e.Item.(int)
+		if i%(2*k) < k {
+			if e.Match == nil || e.Match.(int) != i%(2*k) {
+				m := fmt.Sprintf("wrong match for %d: %v", i, e.Match)
+				return errors.New(m)
+			}
+			hits++
+		} else if e.Match != nil {
+			m := fmt.Sprintf("unexpected match for %d: %v", i, e.Match)
+			return errors.New(m)
+		}
+	}
+	expected := 0
+	for i := 0; i < n; i++ {
+		if i%(2*k) < k {
+			expected++
+		}
+	}
+	if hits != expected {
+		m := fmt.Sprintf("expected %d hits, have %d", expected, hits)
+		return errors.New(m)
+	}
+	if miss == MissPass && len(c.recvd) != n {
+		m := fmt.Sprintf("expected %d items, have %d", n, len(c.recvd))
+		return errors.New(m)
+	}
+	if miss == MissDrop && len(c.recvd) != expected {
+		m := fmt.Sprintf("expected %d items, have %d", expected, len(c.recvd))
+		return errors.New(m)
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package utils
+
+import (
+	"github.com/toschoo/conduit"
+)
+
+// Loop is a Conduit that feeds the output of a body,
+// i.e. a pipe of conduits, back into the body,
+// enabling iterative algorithms like graph propagation
+// or retries with reprocessing.
+// Processing is organised in rounds: the first round
+// processes the incoming data; items of the body's output
+// that pass the feedback Sieve are collected
+// and processed again in the next round,
+// all other items are sent down the chain.
+// The Loop terminates when a round has no feedback
+// or after the maximum number of rounds; items passing
+// the feedback Sieve in the last round are sent down the chain.
+// The body runs once per round and must be restartable.
+// A barrier ends the input of the current rounds: it is sent
+// down the chain when all items received before it
+// have left the Loop; the items after it start new rounds.
+type Loop struct {
+	body []conduit.Conduit
+	fb   Sieve
+	max  int
+	sz   int
+}
+
+// NewLoop creates a new Loop running body
+// for at most max rounds (no limit if max <= 0).
+func NewLoop(body []conduit.Conduit, feedback Sieve, max int) (lp *Loop) {
+	if feedback == nil {
+		return nil
+	}
+	lp = new(Loop)
+	if lp != nil {
+		lp.body = body
+		lp.fb = feedback
+		lp.max = max
+		lp.sz = 10
+	}
+	return
+}
+
+// loopInput feeds the first round with incoming data
+// up to the next barrier.
+type loopInput struct {
+	src conduit.Source
+	bar interface{} // barrier that ended the input
+}
+
+func (in *loopInput) Produce(trg conduit.Target) error {
+	for inp := range in.src {
+		if conduit.IsBarrier(inp) {
+			in.bar = inp
+			return nil
+		}
+		trg <- inp
+	}
+	return nil
+}
+
+// feedback feeds later rounds with the items collected before
+type feedback struct {
+	items []interface{}
+}
+
+func (fb *feedback) Produce(trg conduit.Target) error {
+	for _, inp := range fb.items {
+		trg <- inp
+	}
+	return nil
+}
+
+// loopOutput splits the output of the body
+type loopOutput struct {
+	lp   *Loop
+	last bool
+	trg  conduit.Target
+	next []interface{}
+}
+
+func (out *loopOutput) Consume(src conduit.Source) error {
+	for inp := range src {
+		if !conduit.IsBarrier(inp) && !out.last && out.lp.fb.Sieve(inp) {
+			out.next = append(out.next, inp)
+			continue
+		}
+		out.trg <- inp
+	}
+	return nil
+}
+
+// Conduct is the pre-defined method that makes Loop a Conduit.
+// Errors of the body terminate the Loop.
+func (lp *Loop) Conduct(src conduit.Source, trg conduit.Target) error {
+	for {
+		in := &loopInput{src: src}
+		err := lp.rounds(in, trg)
+		if err != nil {
+			for range src {
+			}
+			return err
+		}
+		if in.bar == nil {
+			return nil
+		}
+		trg <- in.bar
+	}
+}
+
+// runs the rounds for the items produced by p
+func (lp *Loop) rounds(p conduit.Producer, trg conduit.Target) error {
+	for round := 1; ; round++ {
+		out := &loopOutput{lp: lp, last: round == lp.max, trg: trg}
+		chn := conduit.NewChain(p, lp.body, out, uint32(lp.sz))
+		if chn.Run() != nil && len(chn.Errs) > 0 {
+			return chn.Errs[0]
+		}
+		if len(out.next) == 0 {
+			return nil
+		}
+		p = &feedback{out.next}
+	}
+}
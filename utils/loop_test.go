@@ -0,0 +1,119 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/toschoo/conduit"
+)
+
+var decrement = TransformFunc(func(inp interface{}) (interface{}, error) {
+	return inp.(int) - 1, nil
+})
+
+var positive = SieveFunc(func(inp interface{}) bool {
+	return inp.(int) > 0
+})
+
+// Loop:
+// - It is processed without errors
+// - Items are fed back until the feedback is empty
+// - or until the maximum number of rounds is reached
+func TestLoopChain(t *testing.T) {
+	for i := 0; i < numOfTests; i++ {
+		err := testLoopChain(numOfData, i%(numOfData/2))
+		if err != nil {
+			m := fmt.Sprintf("LoopChain failed: %v", err)
+			t.Error(m)
+		}
+	}
+}
+
+// Loop with failing body:
+// - The error is reported
+func TestErrLoopChain(t *testing.T) {
+	fail := TransformFunc(func(inp interface{}) (interface{}, error) {
+		return nil, errors.New(errMsg)
+	})
+	p := &SeqProducer{makeSeq(numOfData)}
+	lp := NewLoop([]conduit.Conduit{NewTransformer(fail)}, positive, 0)
+	chn := conduit.NewChain(p, []conduit.Conduit{lp}, new(BaseConsumer), small)
+	err := chn.Run()
+	if err == nil || len(chn.Errs) != 1 || chn.Errs[0].Error() != errMsg {
+		t.Errorf("ErrLoopChain: unexpected errors: %v", chn.Errs)
+	}
+}
+
+// Loop with barriers:
+// - All items received before a barrier leave the Loop before the barrier
+func TestLoopBarrier(t *testing.T) {
+	var items []interface{}
+	for i := 0; i < 100; i++ {
+		items = append(items, i%10)
+		if i%10 == 9 {
+			items = append(items, &conduit.Barrier{ID: uint64(i)})
+		}
+	}
+	body := []conduit.Conduit{NewTransformer(decrement)}
+	c := &AnyConsumer{}
+	chn := conduit.NewChain(&AnyProducer{src: items}, []conduit.Conduit{NewLoop(body, positive, 0)}, c, small)
+	if err := chn.Run(); err != nil {
+		t.Fatalf("LoopBarrier failed: %v", chn.Errs)
+	}
+	n := 0
+	for _, v := range c.recvd {
+		if conduit.IsBarrier(v) {
+			if n != 10 {
+				t.Errorf("LoopBarrier: %d items before barrier", n)
+			}
+			n = 0
+			continue
+		}
+		if v != 0 && v != -1 {
+			t.Errorf("LoopBarrier: unexpected item %v", v)
+		}
+		n++
+	}
+	if n != 0 || len(c.recvd) != 110 {
+		t.Errorf("LoopBarrier: expected 110 items, have %d", len(c.recvd))
+	}
+}
+
+func testLoopChain(n, max int) error {
+
+	p := &SeqProducer{makeSeq(n)}
+	c := new(BaseConsumer)
+
+	body := []conduit.Conduit{NewTransformer(decrement)}
+	chn := conduit.NewChain(p, []conduit.Conduit{NewLoop(body, positive, max)}, c, small)
+
+	err := chn.Run()
+	if err != nil {
+		m := fmt.Sprintf("error on running chain: %v", err)
+		return errors.New(m)
+	}
+	expected := make([]int, n)
+	for i := range expected {
+		switch {
+		case i == 0:
+			expected[i] = -1
+		case max > 0 && i > max:
+			expected[i] = i - max
+		}
+	}
+	sort.Ints(expected)
+	sort.Ints(c.recvd)
+	if len(c.recvd) != n {
+		m := fmt.Sprintf("expected %d items, have %d", n, len(c.recvd))
+		return errors.New(m)
+	}
+	for i := range expected {
+		if c.recvd[i] != expected[i] {
+			m := fmt.Sprintf("expected %d, have %d", expected[i], c.recvd[i])
+			return errors.New(m)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,313 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// EmailMessage is an email, as received by IMAPReader
+// or sent by SMTPWriter. Text and HTML are the plain text
+// and HTML bodies (converted to UTF-8, with newlines
+// as line breaks); all other parts are Attachments.
+type EmailMessage struct {
+	UID         uint32 // IMAP UID of received messages
+	Header      mail.Header
+	From        *mail.Address
+	To          []*mail.Address
+	Cc          []*mail.Address
+	Bcc         []*mail.Address // only sent, never received
+	Subject     string
+	Date        time.Time
+	MessageID   string
+	Text        string
+	HTML        string
+	Attachments []Attachment
+}
+
+// Attachment is a part of an EmailMessage; ContentID is set
+// for inline parts referenced from the HTML body (cid:...).
+type Attachment struct {
+	Name      string
+	Type      string
+	ContentID string
+	Data      []byte
+}
+
+// Converts data in charset to UTF-8; unknown charsets are kept
+func mailDecodeCharset(charset string, data []byte) []byte {
+	cs := charsetByName(charset)
+	if cs == nil {
+		return data
+	}
+	out, _, err := NewCharsetDecoder(cs).transform(data, true)
+	if err != nil {
+		return data
+	}
+	return out
+}
+
+var mailWords = &mime.WordDecoder{
+	CharsetReader: func(charset string, r io.Reader) (io.Reader, error) {
+		if charsetByName(charset) == nil {
+			return nil, errors.New("unsupported charset " + charset)
+		}
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(mailDecodeCharset(charset, data)), nil
+	},
+}
+
+// Decodes a header with encoded words (RFC 2047)
+func mailHeader(s string) string {
+	dec, err := mailWords.DecodeHeader(s)
+	if err != nil {
+		return s
+	}
+	return dec
+}
+
+// Decodes the content transfer encoding of a part
+func mailBody(r io.Reader, encoding string) ([]byte, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		// line breaks are ignored by the decoder
+		r = base64.NewDecoder(base64.StdEncoding, r)
+	case "quoted-printable":
+		r = quotedprintable.NewReader(r)
+	}
+	return ioutil.ReadAll(r)
+}
+
+// Converts a text body to UTF-8 with newlines as line breaks
+func mailText(charset string, data []byte) string {
+	return strings.Replace(string(mailDecodeCharset(charset, data)), "\r\n", "\n", -1)
+}
+
+// Adds a part (with header h) to the message
+func (m *EmailMessage) addPart(h textproto.MIMEHeader, body io.Reader) error {
+	ctype := h.Get("Content-Type")
+	if ctype == "" {
+		ctype = "text/plain; charset=us-ascii"
+	}
+	mtype, params, err := mime.ParseMediaType(ctype)
+	if err != nil {
+		mtype, params = "application/octet-stream", nil
+	}
+	if strings.HasPrefix(mtype, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			p, err := mr.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err = m.addPart(p.Header, p); err != nil {
+				return err
+			}
+		}
+	}
+	data, err := mailBody(body, h.Get("Content-Transfer-Encoding"))
+	if err != nil {
+		return err
+	}
+	disp, dparams, _ := mime.ParseMediaType(h.Get("Content-Disposition"))
+	if disp != "attachment" {
+		switch {
+		case mtype == "text/plain" && m.Text == "":
+			m.Text = mailText(params["charset"], data)
+			return nil
+		case mtype == "text/html" && m.HTML == "":
+			m.HTML = mailText(params["charset"], data)
+			return nil
+		}
+	}
+	name := dparams["filename"]
+	if name == "" {
+		name = params["name"]
+	}
+	m.Attachments = append(m.Attachments, Attachment{
+		Name:      mailHeader(name),
+		Type:      mtype,
+		ContentID: strings.Trim(h.Get("Content-Id"), "<>"),
+		Data:      data,
+	})
+	return nil
+}
+
+// ParseEmail parses an email in the format of RFC 5322 with MIME parts.
+func ParseEmail(data []byte) (*EmailMessage, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	m := &EmailMessage{Header: msg.Header}
+	p := mail.AddressParser{WordDecoder: mailWords}
+	if from, err := p.ParseList(msg.Header.Get("From")); err == nil && len(from) > 0 {
+		m.From = from[0]
+	}
+	m.To, _ = p.ParseList(msg.Header.Get("To"))
+	m.Cc, _ = p.ParseList(msg.Header.Get("Cc"))
+	m.Subject = mailHeader(msg.Header.Get("Subject"))
+	m.Date, _ = msg.Header.Date()
+	m.MessageID = strings.Trim(msg.Header.Get("Message-Id"), "<>")
+	err = m.addPart(textproto.MIMEHeader(msg.Header), msg.Body)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Writes a header line
+func writeMailHeader(w io.Writer, name, value string) {
+	fmt.Fprintf(w, "%s: %s\r\n", name, value)
+}
+
+func mailAddresses(addrs []*mail.Address) string {
+	s := make([]string, len(addrs))
+	for i, a := range addrs {
+		s[i] = a.String()
+	}
+	return strings.Join(s, ", ")
+}
+
+func mailBoundary() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Writes data in base64 with lines of 76 characters;
+// like all parts, without line break at the end
+func writeBase64(w io.Writer, data []byte) {
+	enc := base64.StdEncoding.EncodeToString(data)
+	for len(enc) > 76 {
+		io.WriteString(w, enc[:76]+"\r\n")
+		enc = enc[76:]
+	}
+	io.WriteString(w, enc)
+}
+
+// Writes a text part in quoted-printable
+func writeTextPart(w io.Writer, mtype, text string) {
+	fmt.Fprintf(w, "Content-Type: %s; charset=utf-8\r\n", mtype)
+	io.WriteString(w, "Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	qw := quotedprintable.NewWriter(w)
+	io.WriteString(qw, strings.Replace(strings.Replace(text, "\r\n", "\n", -1), "\n", "\r\n", -1))
+	qw.Close()
+}
+
+// Bytes formats the message in the format of RFC 5322 with MIME parts;
+// a missing Date and Message-ID are set, Bcc is omitted.
+// Further headers are taken from Header.
+func (m *EmailMessage) Bytes() []byte {
+	var b bytes.Buffer
+	if m.From != nil {
+		writeMailHeader(&b, "From", m.From.String())
+	}
+	if len(m.To) > 0 {
+		writeMailHeader(&b, "To", mailAddresses(m.To))
+	}
+	if len(m.Cc) > 0 {
+		writeMailHeader(&b, "Cc", mailAddresses(m.Cc))
+	}
+	writeMailHeader(&b, "Subject", mime.QEncoding.Encode("utf-8", m.Subject))
+	date := m.Date
+	if date.IsZero() {
+		date = time.Now()
+	}
+	writeMailHeader(&b, "Date", date.Format(time.RFC1123Z))
+	id := m.MessageID
+	if id == "" {
+		host, _ := os.Hostname()
+		id = mailBoundary() + "@" + host
+	}
+	writeMailHeader(&b, "Message-ID", "<"+id+">")
+	keys := make([]string, 0, len(m.Header))
+	for k := range m.Header {
+		switch textproto.CanonicalMIMEHeaderKey(k) {
+		case "From", "To", "Cc", "Bcc", "Subject", "Date", "Message-Id", "Mime-Version",
+			"Content-Type", "Content-Transfer-Encoding":
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range m.Header[k] {
+			writeMailHeader(&b, k, v)
+		}
+	}
+	writeMailHeader(&b, "MIME-Version", "1.0")
+
+	// multipart/mixed (attachments) of multipart/alternative (text and HTML)
+	body := func(w io.Writer) {
+		if m.HTML == "" {
+			writeTextPart(w, "text/plain", m.Text)
+			return
+		}
+		if m.Text == "" {
+			writeTextPart(w, "text/html", m.HTML)
+			return
+		}
+		alt := mailBoundary()
+		fmt.Fprintf(w, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", alt)
+		fmt.Fprintf(w, "--%s\r\n", alt)
+		writeTextPart(w, "text/plain", m.Text)
+		fmt.Fprintf(w, "\r\n--%s\r\n", alt)
+		writeTextPart(w, "text/html", m.HTML)
+		fmt.Fprintf(w, "\r\n--%s--", alt)
+	}
+	if len(m.Attachments) == 0 {
+		body(&b)
+		return b.Bytes()
+	}
+	mixed := mailBoundary()
+	fmt.Fprintf(&b, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", mixed)
+	fmt.Fprintf(&b, "--%s\r\n", mixed)
+	body(&b)
+	for _, a := range m.Attachments {
+		fmt.Fprintf(&b, "\r\n--%s\r\n", mixed)
+		ctype := a.Type
+		if ctype == "" {
+			ctype = "application/octet-stream"
+		}
+		tparams, dparams := map[string]string{}, map[string]string{}
+		if a.Name != "" {
+			name := mime.QEncoding.Encode("utf-8", a.Name)
+			tparams["name"], dparams["filename"] = name, name
+		}
+		disp := "attachment"
+		if a.ContentID != "" {
+			disp = "inline"
+		}
+		writeMailHeader(&b, "Content-Type", mime.FormatMediaType(ctype, tparams))
+		writeMailHeader(&b, "Content-Transfer-Encoding", "base64")
+		if a.ContentID != "" {
+			writeMailHeader(&b, "Content-ID", "<"+a.ContentID+">")
+		}
+		writeMailHeader(&b, "Content-Disposition", mime.FormatMediaType(disp, dparams))
+		b.WriteString("\r\n")
+		writeBase64(&b, a.Data)
+	}
+	fmt.Fprintf(&b, "\r\n--%s--\r\n", mixed)
+	return b.Bytes()
+}
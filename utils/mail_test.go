@@ -0,0 +1,144 @@
+package utils
+
+import (
+	"bytes"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseEmail(t *testing.T) {
+	raw := "From: =?ISO-8859-1?Q?J=F6rg?= <joerg@example.com>\r\n" +
+		"To: a@example.com, \"B, C\" <b@example.com>\r\n" +
+		"Subject: =?utf-8?B?w5xiZXJzaWNodA==?= for =?iso-8859-1?q?M=E4rz?=\r\n" +
+		"Date: Mon, 04 Mar 2024 10:00:00 +0100\r\n" +
+		"Message-ID: <1234@example.com>\r\n" +
+		"X-Priority: 1\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=\"outer\"\r\n" +
+		"\r\n" +
+		"preamble\r\n" +
+		"--outer\r\n" +
+		"Content-Type: multipart/alternative; boundary=inner\r\n" +
+		"\r\n" +
+		"--inner\r\n" +
+		"Content-Type: text/plain; charset=iso-8859-1\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"\r\n" +
+		"Gr=FC=DFe,=\r\n" +
+		" Welt\r\n" +
+		"--inner\r\n" +
+		"Content-Type: text/html; charset=utf-8\r\n" +
+		"\r\n" +
+		"<p>Grüße</p>\r\n" +
+		"--inner--\r\n" +
+		"--outer\r\n" +
+		"Content-Type: text/csv; name=\"=?utf-8?q?M=C3=A4rz.csv?=\"\r\n" +
+		"Content-Disposition: attachment; filename=\"=?utf-8?q?M=C3=A4rz.csv?=\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"YSxiCjEs\r\n" +
+		"Mgo=\r\n" +
+		"--outer\r\n" +
+		"Content-Type: image/png\r\n" +
+		"Content-ID: <logo>\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"iVBORw==\r\n" +
+		"--outer--\r\n"
+	m, err := ParseEmail([]byte(raw))
+	if err != nil {
+		t.Fatalf("ParseEmail failed: %v", err)
+	}
+	if m.From.Name != "Jörg" || m.From.Address != "joerg@example.com" {
+		t.Errorf("ParseEmail: From %v", m.From)
+	}
+	if len(m.To) != 2 || m.To[1].Name != "B, C" || m.To[1].Address != "b@example.com" {
+		t.Errorf("ParseEmail: To %v", m.To)
+	}
+	if m.Subject != "Übersicht for März" || m.MessageID != "1234@example.com" ||
+		!m.Date.Equal(time.Date(2024, 3, 4, 9, 0, 0, 0, time.UTC)) || m.Header.Get("X-Priority") != "1" {
+		t.Errorf("ParseEmail: unexpected headers %q %q %v %v", m.Subject, m.MessageID, m.Date, m.Header)
+	}
+	if m.Text != "Grüße, Welt" || m.HTML != "<p>Grüße</p>" {
+		t.Errorf("ParseEmail: unexpected bodies %q %q", m.Text, m.HTML)
+	}
+	if len(m.Attachments) != 2 {
+		t.Fatalf("ParseEmail: %d attachments", len(m.Attachments))
+	}
+	a := m.Attachments[0]
+	if a.Name != "März.csv" || a.Type != "text/csv" || string(a.Data) != "a,b\n1,2\n" {
+		t.Errorf("ParseEmail: unexpected attachment %q %q %q", a.Name, a.Type, a.Data)
+	}
+	a = m.Attachments[1]
+	if a.ContentID != "logo" || a.Type != "image/png" || !bytes.Equal(a.Data, []byte("\x89PNG")) {
+		t.Errorf("ParseEmail: unexpected inline part %q %q %q", a.ContentID, a.Type, a.Data)
+	}
+
+	m, err = ParseEmail([]byte("Subject: plain\n\nline 1\nline 2\n"))
+	if err != nil || m.Subject != "plain" || m.Text != "line 1\nline 2\n" || m.From != nil {
+		t.Errorf("ParseEmail: unexpected plain message %+v (%v)", m, err)
+	}
+	if _, err = ParseEmail([]byte("no header")); err == nil {
+		t.Errorf("ParseEmail: invalid message accepted")
+	}
+}
+
+// Composed messages:
+// - Headers and bodies survive parsing
+// - Long and non-ASCII text is encoded
+// - Bcc is not visible
+func TestEmailBytes(t *testing.T) {
+	text := strings.Repeat("Grüße aus dem Süden. ", 10) + "\n.\nEnde"
+	m := &EmailMessage{
+		Header:  mail.Header{"X-Report": {"daily"}, "Subject": {"ignored"}},
+		From:    &mail.Address{Name: "Jörg", Address: "joerg@example.com"},
+		To:      []*mail.Address{{Address: "a@example.com"}},
+		Cc:      []*mail.Address{{Name: "B", Address: "b@example.com"}},
+		Bcc:     []*mail.Address{{Address: "secret@example.com"}},
+		Subject: "Bericht für März",
+		Date:    time.Date(2024, 3, 4, 10, 0, 0, 0, time.UTC),
+		Text:    text,
+		HTML:    "<p>Grüße</p>",
+		Attachments: []Attachment{
+			{Name: "März.csv", Type: "text/csv", Data: bytes.Repeat([]byte("1,2\n"), 100)},
+			{ContentID: "logo", Type: "image/png", Data: []byte{0x89, 'P', 'N', 'G', 0}},
+		},
+	}
+	raw := m.Bytes()
+	for _, line := range strings.Split(string(raw), "\r\n") {
+		if len(line) > 998 {
+			t.Errorf("EmailMessage: line of %d characters", len(line))
+		}
+		for _, c := range line {
+			if c > 127 {
+				t.Fatalf("EmailMessage: non-ASCII line %q", line)
+			}
+		}
+	}
+	if bytes.Contains(raw, []byte("secret")) {
+		t.Errorf("EmailMessage: Bcc visible")
+	}
+	p, err := ParseEmail(raw)
+	if err != nil {
+		t.Fatalf("EmailMessage: cannot parse %s: %v", raw, err)
+	}
+	if p.From.String() != m.From.String() || len(p.To) != 1 || len(p.Cc) != 1 || p.Cc[0].Name != "B" ||
+		p.Subject != m.Subject || !p.Date.Equal(m.Date) || p.MessageID == "" || p.Header.Get("X-Report") != "daily" {
+		t.Errorf("EmailMessage: unexpected headers %+v", p)
+	}
+	if p.Text != text || p.HTML != m.HTML {
+		t.Errorf("EmailMessage: unexpected bodies %q %q", p.Text, p.HTML)
+	}
+	if len(p.Attachments) != 2 || p.Attachments[0].Name != "März.csv" ||
+		!bytes.Equal(p.Attachments[0].Data, m.Attachments[0].Data) ||
+		p.Attachments[1].ContentID != "logo" || !bytes.Equal(p.Attachments[1].Data, m.Attachments[1].Data) {
+		t.Errorf("EmailMessage: unexpected attachments %+v", p.Attachments)
+	}
+
+	p, err = ParseEmail((&EmailMessage{Subject: "x", Text: "only text"}).Bytes())
+	if err != nil || p.Text != "only text" || p.HTML != "" || len(p.Attachments) != 0 {
+		t.Errorf("EmailMessage: unexpected text message %+v (%v)", p, err)
+	}
+}
@@ -0,0 +1,890 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+
+	"github.com/toschoo/conduit"
+)
+
+// Kinds of Markdown blocks
+const (
+	mdParagraph = iota
+	mdHeading
+	mdCode
+	mdQuote
+	mdList
+	mdItem
+	mdRule
+)
+
+type mdBlock struct {
+	kind     int
+	level    int    // of headings
+	text     string // of paragraphs, headings and code
+	info     string // language of code
+	ordered  bool   // lists
+	start    int
+	loose    bool
+	children []*mdBlock
+}
+
+// Kinds of Markdown inlines
+const (
+	mdText = iota
+	mdCodeSpan
+	mdEm
+	mdStrong
+	mdDel
+	mdLink
+	mdImage
+	mdBreak
+	mdSoftBreak
+)
+
+type mdInline struct {
+	kind       int
+	text       string
+	url, title string
+	children   []*mdInline
+}
+
+func isBlank(line string) bool {
+	return strings.TrimSpace(line) == ""
+}
+
+func indentOf(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " "))
+}
+
+// Replaces tabs in the indentation of a line by 4 spaces
+func expandIndent(line string) string {
+	i := 0
+	for i < len(line) && (line[i] == ' ' || line[i] == '\t') {
+		i++
+	}
+	if strings.IndexByte(line[:i], '\t') < 0 {
+		return line
+	}
+	return strings.Replace(line[:i], "\t", "    ", -1) + line[i:]
+}
+
+// Runs of c at s[i:]
+func runLen(s string, i int, c byte) int {
+	n := 0
+	for i+n < len(s) && s[i+n] == c {
+		n++
+	}
+	return n
+}
+
+func isRule(t string) bool {
+	t = strings.Replace(strings.TrimSpace(t), " ", "", -1)
+	return len(t) >= 3 && strings.IndexByte("*-_", t[0]) >= 0 && runLen(t, 0, t[0]) == len(t)
+}
+
+// Parses an ATX heading, e.g. ## Title ##
+func atxHeading(t string) (int, string, bool) {
+	n := runLen(t, 0, '#')
+	if n == 0 || n > 6 || n < len(t) && t[n] != ' ' {
+		return 0, "", false
+	}
+	text := strings.TrimSpace(t[n:])
+	if c := strings.TrimRight(text, "#"); c == "" || strings.HasSuffix(c, " ") {
+		text = strings.TrimSpace(c)
+	}
+	return n, text, true
+}
+
+// Parses the opening line of a fenced code block
+func fenceStart(t string) (byte, int, string, bool) {
+	if t == "" || t[0] != '`' && t[0] != '~' {
+		return 0, 0, "", false
+	}
+	n := runLen(t, 0, t[0])
+	info := strings.TrimSpace(t[n:])
+	if n < 3 || t[0] == '`' && strings.IndexByte(info, '`') >= 0 {
+		return 0, 0, "", false
+	}
+	return t[0], n, info, true
+}
+
+// List item marker: the content starts at width
+type mdMarker struct {
+	ordered bool
+	delim   byte
+	start   int
+	width   int
+	rest    string
+}
+
+func listMarker(line string) (m mdMarker, ok bool) {
+	indent := indentOf(line)
+	if indent >= 4 {
+		return m, false
+	}
+	t := line[indent:]
+	n := 0
+	switch {
+	case t != "" && strings.IndexByte("-+*", t[0]) >= 0:
+		m.delim, n = t[0], 1
+	default:
+		for n < len(t) && n < 9 && t[n] >= '0' && t[n] <= '9' {
+			n++
+		}
+		if n == 0 || n == len(t) || t[n] != '.' && t[n] != ')' {
+			return m, false
+		}
+		m.ordered = true
+		m.start, _ = strconv.Atoi(t[:n])
+		m.delim = t[n]
+		n++
+	}
+	if n < len(t) && t[n] != ' ' {
+		return m, false
+	}
+	spaces := runLen(t, n, ' ')
+	if spaces == 0 || spaces > 4 || n+spaces == len(t) {
+		spaces = 1
+	}
+	m.width = indent + n + spaces
+	if n+spaces < len(t) {
+		m.rest = t[n+spaces:]
+	}
+	return m, true
+}
+
+// Reports whether a line starts a block other than a paragraph,
+// i.e. ends a paragraph
+func startsBlock(line string) bool {
+	if indentOf(line) >= 4 {
+		return false
+	}
+	t := strings.TrimLeft(line, " ")
+	if _, _, ok := atxHeading(t); ok {
+		return true
+	}
+	if _, _, _, ok := fenceStart(t); ok {
+		return true
+	}
+	if m, ok := listMarker(line); ok {
+		return m.rest != "" && (!m.ordered || m.start == 1)
+	}
+	return strings.HasPrefix(t, ">") || isRule(t)
+}
+
+func parseMarkdown(doc string) []*mdBlock {
+	lines := strings.Split(strings.Replace(doc, "\r\n", "\n", -1), "\n")
+	for i, l := range lines {
+		lines[i] = expandIndent(l)
+	}
+	return parseBlocks(lines)
+}
+
+func parseBlocks(lines []string) []*mdBlock {
+	var blocks []*mdBlock
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		if isBlank(line) {
+			i++
+			continue
+		}
+		indent := indentOf(line)
+		t := line[indent:]
+		if indent >= 4 {
+			var code []string
+			for ; i < len(lines) && (isBlank(lines[i]) || indentOf(lines[i]) >= 4); i++ {
+				if len(lines[i]) >= 4 {
+					code = append(code, lines[i][4:])
+				} else {
+					code = append(code, "")
+				}
+			}
+			for len(code) > 0 && isBlank(code[len(code)-1]) {
+				code = code[:len(code)-1]
+			}
+			blocks = append(blocks, &mdBlock{kind: mdCode, text: strings.Join(code, "\n") + "\n"})
+			continue
+		}
+		if c, n, info, ok := fenceStart(t); ok {
+			var code []string
+			for i++; i < len(lines); i++ {
+				l := lines[i]
+				if e := strings.TrimLeft(l, " "); indentOf(l) < 4 && runLen(e, 0, c) >= n && isBlank(e[runLen(e, 0, c):]) {
+					i++
+					break
+				}
+				if in := indentOf(l); in < indent {
+					l = l[in:]
+				} else {
+					l = l[indent:]
+				}
+				code = append(code, l)
+			}
+			text := strings.Join(code, "\n")
+			if len(code) > 0 {
+				text += "\n"
+			}
+			if f := strings.Fields(info); len(f) > 0 {
+				info = f[0]
+			}
+			blocks = append(blocks, &mdBlock{kind: mdCode, text: text, info: info})
+			continue
+		}
+		if level, text, ok := atxHeading(t); ok {
+			blocks = append(blocks, &mdBlock{kind: mdHeading, level: level, text: text})
+			i++
+			continue
+		}
+		if isRule(t) {
+			blocks = append(blocks, &mdBlock{kind: mdRule})
+			i++
+			continue
+		}
+		if strings.HasPrefix(t, ">") {
+			var quote []string
+			for ; i < len(lines); i++ {
+				l := lines[i]
+				if e := strings.TrimLeft(l, " "); indentOf(l) < 4 && strings.HasPrefix(e, ">") {
+					quote = append(quote, strings.TrimPrefix(e[1:], " "))
+					continue
+				}
+				if isBlank(l) || isBlank(quote[len(quote)-1]) || startsBlock(l) {
+					break
+				}
+				quote = append(quote, l)
+			}
+			blocks = append(blocks, &mdBlock{kind: mdQuote, children: parseBlocks(quote)})
+			continue
+		}
+		if first, ok := listMarker(line); ok {
+			var list *mdBlock
+			list, i = parseList(lines, i, first)
+			blocks = append(blocks, list)
+			continue
+		}
+		para := []string{t}
+		heading := 0
+		for i++; i < len(lines); i++ {
+			l := lines[i]
+			if isBlank(l) {
+				break
+			}
+			if e := strings.TrimSpace(l); indentOf(l) < 4 && e != "" && (runLen(e, 0, '=') == len(e) || runLen(e, 0, '-') == len(e)) {
+				heading = 1
+				if e[0] == '-' {
+					heading = 2
+				}
+				i++
+				break
+			}
+			if startsBlock(l) {
+				break
+			}
+			para = append(para, strings.TrimLeft(l, " "))
+		}
+		text := strings.TrimRight(strings.Join(para, "\n"), " ")
+		if heading > 0 {
+			blocks = append(blocks, &mdBlock{kind: mdHeading, level: heading, text: text})
+		} else {
+			blocks = append(blocks, &mdBlock{kind: mdParagraph, text: text})
+		}
+	}
+	return blocks
+}
+
+// Parses the items of a list starting at lines[i]
+// and returns the list and the line after it
+func parseList(lines []string, i int, first mdMarker) (*mdBlock, int) {
+	list := &mdBlock{kind: mdList, ordered: first.ordered, start: first.start}
+	for i < len(lines) {
+		m, ok := listMarker(lines[i])
+		if !ok || m.ordered != first.ordered || m.delim != first.delim {
+			break
+		}
+		item := []string{m.rest}
+	collect:
+		for i++; i < len(lines); i++ {
+			l := lines[i]
+			switch {
+			case isBlank(l):
+				item = append(item, "")
+			case indentOf(l) >= m.width:
+				item = append(item, l[m.width:])
+			case item[len(item)-1] != "" && !startsBlock(l) && !isListItem(l):
+				// lazy continuation of a paragraph
+				item = append(item, strings.TrimLeft(l, " "))
+			default:
+				break collect
+			}
+		}
+		n := len(item)
+		for n > 0 && item[n-1] == "" {
+			n--
+		}
+		blank := false
+		for _, l := range item[:n] {
+			blank = blank || l == ""
+		}
+		children := parseBlocks(item[:n])
+		if blank && len(children) > 1 {
+			list.loose = true
+		}
+		if next, ok := listMarker(lineAt(lines, i)); ok && n < len(item) &&
+			next.ordered == first.ordered && next.delim == first.delim {
+			list.loose = true
+		}
+		list.children = append(list.children, &mdBlock{kind: mdItem, children: children})
+	}
+	return list, i
+}
+
+func isListItem(line string) bool {
+	_, ok := listMarker(line)
+	return ok
+}
+
+func lineAt(lines []string, i int) string {
+	if i < len(lines) {
+		return lines[i]
+	}
+	return ""
+}
+
+func isASCIIPunct(c byte) bool {
+	return c > ' ' && c < 0x7f && !(c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z')
+}
+
+func isAlnum(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\n' || c == '\t'
+}
+
+// Parses the inline content of paragraphs and headings
+func parseInlines(s string) []*mdInline {
+	var out []*mdInline
+	var buf strings.Builder
+	flush := func() {
+		if buf.Len() > 0 {
+			out = append(out, &mdInline{kind: mdText, text: html.UnescapeString(buf.String())})
+			buf.Reset()
+		}
+	}
+	add := func(in *mdInline, n int) int {
+		flush()
+		out = append(out, in)
+		return n
+	}
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s) && s[i+1] == '\n':
+			i += add(&mdInline{kind: mdBreak}, 2)
+		case c == '\\' && i+1 < len(s) && isASCIIPunct(s[i+1]):
+			buf.WriteByte(s[i+1])
+			i += 2
+		case c == '`':
+			if in, n := codeSpan(s[i:]); n > 0 {
+				i += add(in, n)
+				continue
+			}
+			n := runLen(s, i, c)
+			buf.WriteString(s[i : i+n])
+			i += n
+		case c == '!' && strings.HasPrefix(s[i+1:], "["):
+			if in, n := parseLink(s[i+1:]); n > 0 {
+				in.kind = mdImage
+				i += add(in, n+1)
+				continue
+			}
+			buf.WriteByte(c)
+			i++
+		case c == '[':
+			if in, n := parseLink(s[i:]); n > 0 {
+				i += add(in, n)
+				continue
+			}
+			buf.WriteByte(c)
+			i++
+		case c == '<':
+			if in, n := autoLink(s[i:]); n > 0 {
+				i += add(in, n)
+				continue
+			}
+			buf.WriteByte(c)
+			i++
+		case c == '*' || c == '_' || c == '~':
+			if in, n := emphasis(s, i); n > 0 {
+				i += add(in, n)
+				continue
+			}
+			n := runLen(s, i, c)
+			buf.WriteString(s[i : i+n])
+			i += n
+		case c == '\n':
+			t := buf.String()
+			trimmed := strings.TrimRight(t, " ")
+			buf.Reset()
+			buf.WriteString(trimmed)
+			if len(t)-len(trimmed) >= 2 {
+				i += add(&mdInline{kind: mdBreak}, 1)
+			} else {
+				i += add(&mdInline{kind: mdSoftBreak}, 1)
+			}
+		default:
+			buf.WriteByte(c)
+			i++
+		}
+	}
+	flush()
+	return out
+}
+
+// Parses a code span at the start of s
+// and returns it and its length (0 if there is none)
+func codeSpan(s string) (*mdInline, int) {
+	n := runLen(s, 0, '`')
+	for j := n; j < len(s); {
+		m := runLen(s, j, '`')
+		if m == 0 {
+			j++
+			continue
+		}
+		if m == n {
+			code := strings.Replace(s[n:j], "\n", " ", -1)
+			if len(code) >= 2 && code[0] == ' ' && code[len(code)-1] == ' ' && strings.TrimSpace(code) != "" {
+				code = code[1 : len(code)-1]
+			}
+			return &mdInline{kind: mdCodeSpan, text: code}, j + m
+		}
+		j += m
+	}
+	return nil, 0
+}
+
+// Removes backslash escapes
+func mdUnescape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && isASCIIPunct(s[i+1]) {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return html.UnescapeString(b.String())
+}
+
+// Parses a link [text](url "title") at the start of s
+// and returns it and its length (0 if there is none)
+func parseLink(s string) (*mdInline, int) {
+	depth, j := 0, 0
+	for ; j < len(s); j++ {
+		switch s[j] {
+		case '\\':
+			j++
+		case '`':
+			if _, n := codeSpan(s[j:]); n > 0 {
+				j += n - 1
+			}
+		case '[':
+			depth++
+		case ']':
+			depth--
+		}
+		if depth == 0 {
+			break
+		}
+	}
+	if j >= len(s) || !strings.HasPrefix(s[j+1:], "(") {
+		return nil, 0
+	}
+	label := s[1:j]
+	k := j + 2
+	k += len(s[k:]) - len(strings.TrimLeft(s[k:], " \n"))
+	var dest string
+	if strings.HasPrefix(s[k:], "<") {
+		e := strings.IndexAny(s[k:], ">\n")
+		if e < 0 || s[k+e] != '>' {
+			return nil, 0
+		}
+		dest, k = s[k+1:k+e], k+e+1
+	} else {
+		start, parens := k, 0
+		for ; k < len(s) && s[k] > ' '; k++ {
+			if s[k] == '\\' {
+				k++
+			} else if s[k] == '(' {
+				parens++
+			} else if s[k] == ')' {
+				if parens == 0 {
+					break
+				}
+				parens--
+			}
+		}
+		if k > len(s) {
+			return nil, 0
+		}
+		dest = s[start:k]
+	}
+	in := &mdInline{kind: mdLink, url: mdUnescape(dest), children: parseInlines(label)}
+	ws := len(s[k:]) - len(strings.TrimLeft(s[k:], " \n"))
+	if k += ws; k < len(s) && ws > 0 && strings.IndexByte("\"'(", s[k]) >= 0 {
+		closing := s[k]
+		if closing == '(' {
+			closing = ')'
+		}
+		e := strings.IndexByte(s[k+1:], closing)
+		if e < 0 {
+			return nil, 0
+		}
+		in.title = mdUnescape(s[k+1 : k+1+e])
+		k += e + 2
+		k += len(s[k:]) - len(strings.TrimLeft(s[k:], " \n"))
+	}
+	if k >= len(s) || s[k] != ')' {
+		return nil, 0
+	}
+	return in, k + 1
+}
+
+// Parses an autolink <scheme:...> or <address@domain>
+// at the start of s and returns it and its length (0 if there is none)
+func autoLink(s string) (*mdInline, int) {
+	e := strings.IndexByte(s, '>')
+	if e < 0 {
+		return nil, 0
+	}
+	t := s[1:e]
+	if t == "" || strings.ContainsAny(t, " \t\n<") {
+		return nil, 0
+	}
+	url := t
+	if c := strings.IndexByte(t, ':'); c >= 2 && isTagStart(t[0]) {
+		for _, r := range t[:c] {
+			if !(r < 0x80 && (isAlnum(byte(r)) || r == '+' || r == '.' || r == '-')) {
+				return nil, 0
+			}
+		}
+	} else if a := strings.IndexByte(t, '@'); a > 0 && strings.IndexByte(t[a:], '.') > 1 {
+		url = "mailto:" + t
+	} else {
+		return nil, 0
+	}
+	return &mdInline{kind: mdLink, url: url, children: []*mdInline{{kind: mdText, text: t}}}, e + 1
+}
+
+// Parses emphasis (*, _), strong emphasis (**, __), both (***, ___)
+// or strikethrough (~~) at s[i:] and returns it
+// and its length (0 if there is none)
+func emphasis(s string, i int) (*mdInline, int) {
+	c := s[i]
+	n := runLen(s, i, c)
+	if n > 3 || c == '~' && n != 2 || i+n >= len(s) || isSpace(s[i+n]) ||
+		c == '_' && i > 0 && isAlnum(s[i-1]) {
+		return nil, 0
+	}
+	for j := i + n; j < len(s); {
+		switch s[j] {
+		case '\\':
+			j += 2
+			continue
+		case '`':
+			if _, m := codeSpan(s[j:]); m > 0 {
+				j += m
+				continue
+			}
+		case c:
+			m := runLen(s, j, c)
+			if m == n && !isSpace(s[j-1]) && !(c == '_' && j+m < len(s) && isAlnum(s[j+m])) {
+				inner := parseInlines(s[i+n : j])
+				var in *mdInline
+				switch {
+				case c == '~':
+					in = &mdInline{kind: mdDel, children: inner}
+				case n == 1:
+					in = &mdInline{kind: mdEm, children: inner}
+				case n == 2:
+					in = &mdInline{kind: mdStrong, children: inner}
+				default:
+					in = &mdInline{kind: mdEm, children: []*mdInline{{kind: mdStrong, children: inner}}}
+				}
+				return in, j + m - i
+			}
+			j += m
+			continue
+		}
+		j++
+	}
+	return nil, 0
+}
+
+// Reports whether a URL may be linked:
+// relative URLs and http, https and mailto
+func safeURL(u string) bool {
+	i := strings.IndexAny(u, ":/?#")
+	if i < 0 || u[i] != ':' {
+		return true
+	}
+	switch strings.ToLower(u[:i]) {
+	case "http", "https", "mailto":
+		return true
+	}
+	return false
+}
+
+func renderInlinesHTML(b *strings.Builder, ins []*mdInline) {
+	for _, in := range ins {
+		switch in.kind {
+		case mdText:
+			b.WriteString(html.EscapeString(in.text))
+		case mdCodeSpan:
+			b.WriteString("<code>" + html.EscapeString(in.text) + "</code>")
+		case mdEm, mdStrong, mdDel:
+			tag := map[int]string{mdEm: "em", mdStrong: "strong", mdDel: "del"}[in.kind]
+			b.WriteString("<" + tag + ">")
+			renderInlinesHTML(b, in.children)
+			b.WriteString("</" + tag + ">")
+		case mdLink:
+			if !safeURL(in.url) {
+				renderInlinesHTML(b, in.children)
+				continue
+			}
+			b.WriteString(`<a href="` + html.EscapeString(in.url) + `"`)
+			if in.title != "" {
+				b.WriteString(` title="` + html.EscapeString(in.title) + `"`)
+			}
+			b.WriteString(">")
+			renderInlinesHTML(b, in.children)
+			b.WriteString("</a>")
+		case mdImage:
+			alt := html.EscapeString(inlinesText(in.children))
+			if !safeURL(in.url) {
+				b.WriteString(alt)
+				continue
+			}
+			b.WriteString(`<img src="` + html.EscapeString(in.url) + `" alt="` + alt + `"`)
+			if in.title != "" {
+				b.WriteString(` title="` + html.EscapeString(in.title) + `"`)
+			}
+			b.WriteString(">")
+		case mdBreak:
+			b.WriteString("<br>\n")
+		case mdSoftBreak:
+			b.WriteString("\n")
+		}
+	}
+}
+
+func renderBlocksHTML(b *strings.Builder, blocks []*mdBlock, tight bool) {
+	for i, bl := range blocks {
+		switch bl.kind {
+		case mdParagraph:
+			if tight {
+				renderInlinesHTML(b, parseInlines(bl.text))
+				if i < len(blocks)-1 {
+					b.WriteString("\n")
+				}
+				continue
+			}
+			b.WriteString("<p>")
+			renderInlinesHTML(b, parseInlines(bl.text))
+			b.WriteString("</p>\n")
+		case mdHeading:
+			fmt.Fprintf(b, "<h%d>", bl.level)
+			renderInlinesHTML(b, parseInlines(bl.text))
+			fmt.Fprintf(b, "</h%d>\n", bl.level)
+		case mdCode:
+			b.WriteString("<pre><code")
+			if bl.info != "" {
+				b.WriteString(` class="language-` + html.EscapeString(bl.info) + `"`)
+			}
+			b.WriteString(">" + html.EscapeString(bl.text) + "</code></pre>\n")
+		case mdQuote:
+			b.WriteString("<blockquote>\n")
+			renderBlocksHTML(b, bl.children, false)
+			b.WriteString("</blockquote>\n")
+		case mdList:
+			tag := "ul"
+			if bl.ordered {
+				tag = "ol"
+			}
+			b.WriteString("<" + tag)
+			if bl.ordered && bl.start != 1 {
+				fmt.Fprintf(b, ` start="%d"`, bl.start)
+			}
+			b.WriteString(">\n")
+			for _, it := range bl.children {
+				b.WriteString("<li>")
+				if len(it.children) > 0 && (bl.loose || it.children[0].kind != mdParagraph) {
+					b.WriteString("\n")
+				}
+				renderBlocksHTML(b, it.children, !bl.loose)
+				b.WriteString("</li>\n")
+			}
+			b.WriteString("</" + tag + ">\n")
+		case mdRule:
+			b.WriteString("<hr>\n")
+		}
+	}
+}
+
+// Plain text of inlines
+func inlinesText(ins []*mdInline) string {
+	var b strings.Builder
+	for _, in := range ins {
+		switch in.kind {
+		case mdText, mdCodeSpan:
+			b.WriteString(in.text)
+		case mdBreak, mdSoftBreak:
+			b.WriteString("\n")
+		default:
+			b.WriteString(inlinesText(in.children))
+		}
+	}
+	return b.String()
+}
+
+// Plain text of blocks, separated by blank lines unless tight
+func blocksText(blocks []*mdBlock, tight bool) string {
+	sep := "\n\n"
+	if tight {
+		sep = "\n"
+	}
+	var parts []string
+	for _, bl := range blocks {
+		switch bl.kind {
+		case mdParagraph, mdHeading:
+			parts = append(parts, inlinesText(parseInlines(bl.text)))
+		case mdCode:
+			parts = append(parts, strings.TrimSuffix(bl.text, "\n"))
+		case mdQuote:
+			parts = append(parts, blocksText(bl.children, false))
+		case mdList:
+			items := make([]string, len(bl.children))
+			for i, it := range bl.children {
+				marker := "- "
+				if bl.ordered {
+					marker = strconv.Itoa(bl.start+i) + ". "
+				}
+				indent := "\n" + strings.Repeat(" ", len(marker))
+				items[i] = marker + strings.Replace(blocksText(it.children, !bl.loose), "\n", indent, -1)
+			}
+			if bl.loose {
+				parts = append(parts, strings.Join(items, "\n\n"))
+			} else {
+				parts = append(parts, strings.Join(items, "\n"))
+			}
+		}
+	}
+	return strings.Join(parts, sep)
+}
+
+// Markdown is a Conduit that converts Markdown documents
+// (strings or []byte) to HTML or, optionally, to plain text
+// (see PlainText) and sends them down the chain as strings.
+// If a field is set (see SetField), the field of records
+// (Record or map[string]interface{}) is converted instead
+// and copies of the records are sent; missing fields and nil
+// are left alone.
+// The syntax is CommonMark's core (headings, paragraphs,
+// block quotes, lists, code blocks, thematic breaks, emphasis,
+// code spans, links, images and autolinks) plus strikethrough (~~).
+// The HTML is sanitized: raw HTML in the document is escaped
+// and links and images with URLs other than relative,
+// http, https and mailto URLs are reduced to their text.
+type Markdown struct {
+	field string
+	text  bool
+}
+
+// NewMarkdown creates a new Markdown Conduit converting to HTML.
+func NewMarkdown() (md *Markdown) {
+	md = new(Markdown)
+	return
+}
+
+// PlainText converts to plain text: the text of blocks separated
+// by blank lines with list items marked by - or their number.
+func (md *Markdown) PlainText() *Markdown {
+	md.text = true
+	return md
+}
+
+// SetField makes the Markdown convert field of records.
+func (md *Markdown) SetField(field string) *Markdown {
+	md.field = field
+	return md
+}
+
+// Converts a document
+func (md *Markdown) convert(v interface{}) (string, error) {
+	var doc string
+	switch x := v.(type) {
+	case string:
+		doc = x
+	case []byte:
+		doc = string(x)
+	default:
+		return "", errors.New(fmt.Sprintf("cannot convert %T from Markdown", v))
+	}
+	blocks := parseMarkdown(doc)
+	if md.text {
+		return blocksText(blocks, false), nil
+	}
+	var b strings.Builder
+	renderBlocksHTML(&b, blocks, false)
+	return b.String(), nil
+}
+
+// Conduct is the pre-defined method that makes Markdown a Conduit.
+// Conduct terminates with an error on items (or fields)
+// that are not strings or []byte.
+func (md *Markdown) Conduct(src conduit.Source, trg conduit.Target) error {
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			trg <- inp
+			continue
+		}
+		if md.field == "" {
+			out, err := md.convert(inp)
+			if err != nil {
+				return err
+			}
+			trg <- out
+			continue
+		}
+		var rec map[string]interface{}
+		switch x := inp.(type) {
+		case Record:
+			rec = x
+		case map[string]interface{}:
+			rec = x
+		default:
+			return errors.New(fmt.Sprintf("cannot convert field of %T", inp))
+		}
+		cp := make(Record, len(rec))
+		for k, v := range rec {
+			cp[k] = v
+		}
+		if v := rec[md.field]; v != nil {
+			out, err := md.convert(v)
+			if err != nil {
+				return errors.New(fmt.Sprintf("field '%s': %v", md.field, err))
+			}
+			cp[md.field] = out
+		}
+		if _, ok := inp.(Record); ok {
+			trg <- cp
+		} else {
+			trg <- map[string]interface{}(cp)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package utils
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/toschoo/conduit"
+)
+
+// Markdown:
+// - Blocks and inlines are rendered as HTML
+// - Raw HTML and unsafe URLs are sanitized
+func TestMarkdownHTML(t *testing.T) {
+	tests := []struct {
+		md   string
+		want string
+	}{
+		{"# Title #\n\nSome *em*, **strong**, ***both***, ~~del~~ and `a<b`.",
+			"<h1>Title</h1>\n<p>Some <em>em</em>, <strong>strong</strong>, <em><strong>both</strong></em>, <del>del</del> and <code>a&lt;b</code>.</p>\n"},
+		{"Setext\n======\nsub\n---", "<h1>Setext</h1>\n<h2>sub</h2>\n"},
+		{"a  \nb\\\nc\nd", "<p>a<br>\nb<br>\nc\nd</p>\n"},
+		{"snake_case_name and _em_ and \\*no\\*", "<p>snake_case_name and <em>em</em> and *no*</p>\n"},
+		{"**a *b* c**", "<p><strong>a <em>b</em> c</strong></p>\n"},
+		{"[go](https://go.dev \"Go\") ![logo](/l.png) <https://x.org> <me@x.org>",
+			`<p><a href="https://go.dev" title="Go">go</a> <img src="/l.png" alt="logo"> <a href="https://x.org">https://x.org</a> <a href="mailto:me@x.org">me@x.org</a></p>` + "\n"},
+		{"[x](javascript:alert(1)) ![y](data:image/png) [z](JavaScript:void)", "<p>x y z</p>\n"},
+		{"<script>alert(1)</script> & <b onclick=x>", "<p>&lt;script&gt;alert(1)&lt;/script&gt; &amp; &lt;b onclick=x&gt;</p>\n"},
+		{"[a *b*](</my url>)", `<p><a href="/my url">a <em>b</em></a></p>` + "\n"},
+		{"```go\nfunc main() {\n\t<-done\n}\n```\n\n    indented\n      more",
+			"<pre><code class=\"language-go\">func main() {\n    &lt;-done\n}\n</code></pre>\n<pre><code>indented\n  more\n</code></pre>\n"},
+		{"> quote\nlazy\n> > nested\n\nafter", "<blockquote>\n<p>quote\nlazy</p>\n<blockquote>\n<p>nested</p>\n</blockquote>\n</blockquote>\n<p>after</p>\n"},
+		{"- a\n- b\n  - c\n  - d\n- e", "<ul>\n<li>a</li>\n<li>b\n<ul>\n<li>c</li>\n<li>d</li>\n</ul>\n</li>\n<li>e</li>\n</ul>\n"},
+		{"3. x\n\n4. y\n\n   more", "<ol start=\"3\">\n<li>\n<p>x</p>\n</li>\n<li>\n<p>y</p>\n<p>more</p>\n</li>\n</ol>\n"},
+		{"1) a\n2) b\n- c", "<ol>\n<li>a</li>\n<li>b</li>\n</ol>\n<ul>\n<li>c</li>\n</ul>\n"},
+		{"para\n* * *\n\\# no heading", "<p>para</p>\n<hr>\n<p># no heading</p>\n"},
+		{"Fish &amp; chips &copy; [unclosed *x", "<p>Fish &amp; chips © [unclosed *x</p>\n"},
+	}
+	for _, tc := range tests {
+		have, err := NewMarkdown().convert(tc.md)
+		if err != nil || have != tc.want {
+			t.Errorf("Markdown %q:\nhave %q\nwant %q (%v)", tc.md, have, tc.want, err)
+		}
+	}
+}
+
+// Markdown:
+// - Documents are converted to plain text
+// - Fields of records are converted
+// - Items that are not text fail
+func TestMarkdownChain(t *testing.T) {
+	doc := "# Title\n\nSome *text* with [a link](http://x.org).\n\n- one\n- two\n  continued\n\n1. first\n\n```\ncode\n```\n\n---\n> quoted"
+	text, _ := NewMarkdown().PlainText().convert(doc)
+	want := "Title\n\nSome text with a link.\n\n- one\n- two\n  continued\n\n1. first\n\ncode\n\nquoted"
+	if text != want {
+		t.Errorf("Markdown: plain text\n%q, want\n%q", text, want)
+	}
+
+	ac := &AnyConsumer{}
+	src := []interface{}{
+		[]byte("*a*"),
+		Record{"id": 1, "body": "**b**"},
+		map[string]interface{}{"id": 2},
+		&conduit.Barrier{},
+	}
+	err := conduit.NewChain(&AnyProducer{src: src[:1]}, []conduit.Conduit{NewMarkdown()}, ac, small).Run()
+	if err != nil || fmt.Sprint(ac.recvd) != "[<p><em>a</em></p>\n]" {
+		t.Errorf("Markdown: received %q (%v)", ac.recvd, err)
+	}
+	ac = &AnyConsumer{}
+	err = conduit.NewChain(&AnyProducer{src: src[1:]}, []conduit.Conduit{NewMarkdown().SetField("body")}, ac, small).Run()
+	if err != nil || len(ac.recvd) != 3 || !conduit.IsBarrier(ac.recvd[2]) {
+		t.Fatalf("Markdown: received %v (%v)", ac.recvd, err)
+	}
+	if rec := ac.recvd[0].(Record); rec["body"] != "<p><strong>b</strong></p>\n" || rec["id"] != 1 || src[1].(Record)["body"] != "**b**" {
+		t.Errorf("Markdown: unexpected record %v", rec)
+	}
+	if rec := ac.recvd[1].(map[string]interface{}); len(rec) != 1 {
+		t.Errorf("Markdown: unexpected record %v", rec)
+	}
+
+	for _, inp := range []interface{}{1, Record{"body": 2}} {
+		md := NewMarkdown()
+		if _, ok := inp.(Record); ok {
+			md.SetField("body")
+		}
+		if err = conduit.NewChain(&AnyProducer{src: []interface{}{inp}}, []conduit.Conduit{md}, ac, small).Run(); err == nil {
+			t.Errorf("Markdown: %v accepted", inp)
+		}
+	}
+}
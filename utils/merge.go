@@ -0,0 +1,73 @@
+package utils
+
+import (
+	"github.com/toschoo/conduit"
+)
+
+// MergeProducer is a Producer that merges the output
+// of several producers into one chain, e.g. to process
+// the data of several files or connections together.
+// Data of different producers are interleaved
+// as they arrive; the order of data of the same producer is preserved.
+// Since the interleaving differs from run to run,
+// chains with a MergeProducer cannot be checkpointed.
+type MergeProducer struct {
+	ps []conduit.Producer
+	sz int
+}
+
+// NewMergeProducer creates a new MergeProducer.
+func NewMergeProducer(ps ...conduit.Producer) (mp *MergeProducer) {
+	mp = new(MergeProducer)
+	if mp != nil {
+		mp.ps = ps
+		mp.sz = 10
+	}
+	return
+}
+
+// Cancel is the pre-defined method that makes MergeProducer
+// a conduit.Canceler; it cancels all producers that are Cancelers.
+func (mp *MergeProducer) Cancel() {
+	cancelAll(mp.ps)
+}
+
+// cancels all producers that are Cancelers
+func cancelAll(ps []conduit.Producer) {
+	for _, p := range ps {
+		if c, ok := p.(conduit.Canceler); ok {
+			c.Cancel()
+		}
+	}
+}
+
+// Produce is the pre-defined method that makes MergeProducer a Producer.
+// Produce terminates when all producers have terminated
+// and returns the first error reported by a producer.
+func (mp *MergeProducer) Produce(trg conduit.Target) error {
+	srcs := make([]conduit.Source, len(mp.ps))
+	errs := make([]chan error, len(mp.ps))
+	for i, p := range mp.ps {
+		conduit.ResetCancel(p)
+		var src chan interface{}
+		src, errs[i] = startProducer(p, mp.sz)
+		srcs[i] = src
+	}
+	for inp := range conduit.Merge(srcs...) {
+		trg <- inp
+	}
+	var err error
+	for _, e := range errs {
+		if x := <-e; err == nil {
+			err = x
+		}
+	}
+	return err
+}
+
+// Volatile is the pre-defined method that makes MergeProducer
+// a conduit.Volatile: the position of a checkpoint does not tell
+// how many items of each producer were consumed.
+func (mp *MergeProducer) Volatile() bool {
+	return true
+}
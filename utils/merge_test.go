@@ -0,0 +1,95 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+// MergeProducer:
+// - It is processed without errors
+// - All data of all producers arrive
+// - The order per producer is preserved
+func TestMergeProducerChain(t *testing.T) {
+	for i := 0; i < numOfTests; i++ {
+		err := testMergeProducerChain(numOfData, 1+i%5)
+		if err != nil {
+			m := fmt.Sprintf("MergeProducerChain failed: %v", err)
+			t.Error(m)
+		}
+	}
+}
+
+// MergeProducer with checkpointing:
+// - The chain refuses to run
+func TestCheckpointMergeProducer(t *testing.T) {
+	p := NewMergeProducer(&SeqProducer{makeSeq(numOfData)}, &SeqProducer{makeSeq(numOfData)})
+	c := new(BaseConsumer)
+	chn := conduit.NewChain(p, nil, c, small)
+	chn.SetCheckpoints(time.Millisecond, conduit.NewMemCheckpoints())
+	if chn.Run() == nil || len(c.recvd) != 0 {
+		t.Errorf("CheckpointMergeProducer: chain was checkpointed")
+	}
+}
+
+// MergeProducer with failing producer:
+// - The error is reported
+// - Data of other producers arrive
+func TestErrMergeProducerChain(t *testing.T) {
+	p := NewMergeProducer(&SeqProducer{makeSeq(numOfData)}, new(ErrProducer))
+	c := new(BaseConsumer)
+	chn := conduit.NewChain(p, nil, c, small)
+	err := chn.Run()
+	if err == nil || len(chn.Errs) != 1 || chn.Errs[0].Error() != errMsg {
+		t.Errorf("ErrMergeProducerChain: unexpected errors: %v", chn.Errs)
+	}
+	if len(c.recvd) < numOfData {
+		t.Errorf("ErrMergeProducerChain: expected %d items, have %d", numOfData, len(c.recvd))
+	}
+}
+
+func testMergeProducerChain(n, k int) error {
+
+	ps := make([]conduit.Producer, k)
+	for i := range ps {
+		seq := makeSeq(n)
+		for j := range seq {
+			seq[j] += i * n
+		}
+		ps[i] = &SeqProducer{seq}
+	}
+	c := new(BaseConsumer)
+
+	chn := conduit.NewChain(NewMergeProducer(ps...), nil, c, small)
+
+	err := chn.Run()
+	if err != nil {
+		m := fmt.Sprintf("error on running chain: %v", err)
+		return errors.New(m)
+	}
+	if len(c.recvd) != n*k {
+		m := fmt.Sprintf("expected %d items, have %d", n*k, len(c.recvd))
+		return errors.New(m)
+	}
+	last := make([]int, k)
+	for i := range last {
+		last[i] = -1
+	}
+	for _, v := range c.recvd {
+		if v <= last[v/n] {
+			return errors.New("items out of order")
+		}
+		last[v/n] = v
+	}
+	sort.Ints(c.recvd)
+	for i := range c.recvd {
+		if c.recvd[i] != i {
+			return errors.New("Received values differ from original!")
+		}
+	}
+	return nil
+}
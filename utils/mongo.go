@@ -0,0 +1,1199 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+// MongoDB wire protocol (OP_MSG, MongoDB 3.6 and later)
+const (
+	mongoOpMsg  = 2013
+	mongoMaxMsg = 48 * 1024 * 1024
+)
+
+// Error returned by a MongoDB command
+type mongoError struct {
+	code int
+	msg  string
+}
+
+func (e *mongoError) Error() string {
+	return fmt.Sprintf("mongodb: %s (%d)", e.msg, e.code)
+}
+
+// Codes of errors after which a command can be sent again,
+// e.g. NotWritablePrimary or ShutdownInProgress
+var mongoRetryable = map[int]bool{
+	6: true, 7: true, 89: true, 91: true, 189: true, 262: true, 9001: true,
+	10107: true, 11600: true, 11602: true, 13435: true, 13436: true,
+}
+
+// Connection errors and retryable command errors
+func mongoRetry(err error) bool {
+	if e, ok := err.(*mongoError); ok {
+		return mongoRetryable[e.code]
+	}
+	return true
+}
+
+// Connection options of a MongoDB URI
+// (mongodb://[user:password@]host1[:port1][,host2...]/db[?options])
+type mongoURI struct {
+	hosts  []string
+	user   string
+	pass   string
+	db     string
+	authDB string
+	tls    bool
+}
+
+func parseMongoURI(s string) (*mongoURI, error) {
+	if !strings.HasPrefix(s, "mongodb://") {
+		return nil, errors.New("not a mongodb URI: " + s)
+	}
+	rest := s[len("mongodb://"):]
+	var query string
+	if i := strings.Index(rest, "?"); i >= 0 {
+		rest, query = rest[:i], rest[i+1:]
+	}
+	var db string
+	if i := strings.Index(rest, "/"); i >= 0 {
+		rest, db = rest[:i], rest[i+1:]
+	}
+	u := &mongoURI{authDB: "admin"}
+	if i := strings.LastIndex(rest, "@"); i >= 0 {
+		creds := rest[:i]
+		rest = rest[i+1:]
+		pass := ""
+		if j := strings.Index(creds, ":"); j >= 0 {
+			creds, pass = creds[:j], creds[j+1:]
+		}
+		var err error
+		if u.user, err = url.PathUnescape(creds); err != nil {
+			return nil, err
+		}
+		if u.pass, err = url.PathUnescape(pass); err != nil {
+			return nil, err
+		}
+	}
+	for _, h := range strings.Split(rest, ",") {
+		if h == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(h); err != nil {
+			h = net.JoinHostPort(h, "27017")
+		}
+		u.hosts = append(u.hosts, h)
+	}
+	if len(u.hosts) == 0 {
+		return nil, errors.New("no host in mongodb URI: " + s)
+	}
+	var err error
+	if u.db, err = url.PathUnescape(db); err != nil {
+		return nil, err
+	}
+	q, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	if a := q.Get("authSource"); a != "" {
+		u.authDB = a
+	}
+	u.tls = q.Get("tls") == "true" || q.Get("ssl") == "true"
+	return u, nil
+}
+
+// Minimal MongoDB client
+type mongoConn struct {
+	conn    net.Conn
+	rd      *bufio.Reader
+	id      int32
+	timeout time.Duration
+}
+
+// Connects to the primary among the hosts of the URI
+// and authenticates with SCRAM-SHA-256
+func dialMongo(u *mongoURI, timeout time.Duration) (*mongoConn, error) {
+	var err error
+	for _, h := range u.hosts {
+		var mc *mongoConn
+		mc, err = dialMongoHost(u, h, timeout)
+		if err == nil {
+			return mc, nil
+		}
+	}
+	return nil, err
+}
+
+func dialMongoHost(u *mongoURI, host string, timeout time.Duration) (*mongoConn, error) {
+	conn, err := net.DialTimeout("tcp", host, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if u.tls {
+		name, _, _ := net.SplitHostPort(host)
+		conn = tls.Client(conn, &tls.Config{ServerName: name})
+	}
+	mc := &mongoConn{conn: conn, rd: bufio.NewReader(conn), timeout: timeout}
+	err = mc.hello()
+	if err == nil && u.user != "" {
+		err = mc.auth(u)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return mc, nil
+}
+
+// Checks that the server is the primary
+func (mc *mongoConn) hello() error {
+	reply, err := mc.run("admin", BSONDoc{{"hello", 1}}, 0)
+	if e, ok := err.(*mongoError); ok && e.code == 59 { // CommandNotFound
+		reply, err = mc.run("admin", BSONDoc{{"isMaster", 1}}, 0)
+	}
+	if err != nil {
+		return err
+	}
+	if reply["isWritablePrimary"] != true && reply["ismaster"] != true {
+		return errors.New(fmt.Sprintf("mongodb: %s is not primary", mc.conn.RemoteAddr()))
+	}
+	return nil
+}
+
+// Runs a command on db that waits up to wait on the server
+// and returns the reply; failed commands are returned as mongoError
+func (mc *mongoConn) run(db string, cmd BSONDoc, wait time.Duration) (map[string]interface{}, error) {
+	doc, err := MarshalBSON(append(cmd[:len(cmd):len(cmd)], BSONElem{"$db", db}))
+	if err != nil {
+		return nil, err
+	}
+	mc.id++
+	msg := make([]byte, 21, 21+len(doc))
+	binary.LittleEndian.PutUint32(msg, uint32(21+len(doc)))
+	binary.LittleEndian.PutUint32(msg[4:], uint32(mc.id))
+	binary.LittleEndian.PutUint32(msg[12:], mongoOpMsg)
+	msg = append(msg, doc...) // flags and section kind 0 are zero
+	if mc.timeout > 0 {
+		mc.conn.SetDeadline(time.Now().Add(mc.timeout + wait))
+	}
+	_, err = mc.conn.Write(msg)
+	if err != nil {
+		return nil, err
+	}
+	data, err := readMongoMsg(mc.rd)
+	if err != nil {
+		return nil, err
+	}
+	x, err := readBSONDoc(data, false)
+	if err != nil {
+		return nil, err
+	}
+	reply := x.(map[string]interface{})
+	if bsonInt(reply["ok"]) != 1 {
+		msg, _ := reply["errmsg"].(string)
+		return nil, &mongoError{code: int(bsonInt(reply["code"])), msg: msg}
+	}
+	return reply, nil
+}
+
+// Reads an OP_MSG and returns its body
+func readMongoMsg(rd io.Reader) ([]byte, error) {
+	var hdr [16]byte
+	_, err := io.ReadFull(rd, hdr[:])
+	if err != nil {
+		return nil, err
+	}
+	n := int(binary.LittleEndian.Uint32(hdr[:]))
+	if n < 21 || n > mongoMaxMsg || binary.LittleEndian.Uint32(hdr[12:]) != mongoOpMsg {
+		return nil, errors.New("mongodb: invalid message")
+	}
+	msg := make([]byte, n-16)
+	_, err = io.ReadFull(rd, msg)
+	if err != nil {
+		return nil, err
+	}
+	flags := binary.LittleEndian.Uint32(msg)
+	end := len(msg)
+	if flags&1 != 0 { // checksum
+		end -= 4
+	}
+	// the body is the section of kind 0; document sequences are skipped
+	for p := 4; p+5 <= end; {
+		size := int(binary.LittleEndian.Uint32(msg[p+1:]))
+		if msg[p] == 0 {
+			if p+1+size > end {
+				break
+			}
+			return msg[p+1 : p+1+size], nil
+		}
+		p += 1 + size
+	}
+	return nil, errors.New("mongodb: message without body")
+}
+
+func (mc *mongoConn) close() {
+	mc.conn.Close()
+}
+
+// Integer value of a number in a reply
+func bsonInt(v interface{}) int64 {
+	switch x := v.(type) {
+	case int32:
+		return int64(x)
+	case int64:
+		return x
+	case float64:
+		return int64(x)
+	}
+	return 0
+}
+
+// SCRAM-SHA-256 (RFC 7677); passwords are not normalized (SASLprep)
+func (mc *mongoConn) auth(u *mongoURI) error {
+	nonce := make([]byte, 24)
+	rand.Read(nonce)
+	cnonce := base64.StdEncoding.EncodeToString(nonce)
+	user := strings.NewReplacer("=", "=3D", ",", "=2C").Replace(u.user)
+	first := "n=" + user + ",r=" + cnonce
+	reply, err := mc.run(u.authDB, BSONDoc{
+		{"saslStart", 1},
+		{"mechanism", "SCRAM-SHA-256"},
+		{"payload", []byte("n,," + first)},
+		{"autoAuthorize", 1},
+		{"options", BSONDoc{{"skipEmptyExchange", true}}},
+	}, 0)
+	if err != nil {
+		return err
+	}
+	server, _ := reply["payload"].([]byte)
+	attrs := scramAttrs(string(server))
+	salt, err := base64.StdEncoding.DecodeString(attrs["s"])
+	var iter int
+	fmt.Sscanf(attrs["i"], "%d", &iter)
+	if err != nil || iter <= 0 || !strings.HasPrefix(attrs["r"], cnonce) {
+		return errors.New("mongodb: invalid SCRAM challenge")
+	}
+	salted := pbkdf2SHA256([]byte(u.pass), salt, iter)
+	final := "c=biws,r=" + attrs["r"]
+	msg := first + "," + string(server) + "," + final
+	proof, sig := scramProof(salted, msg)
+	reply, err = mc.run(u.authDB, BSONDoc{
+		{"saslContinue", 1},
+		{"conversationId", reply["conversationId"]},
+		{"payload", []byte(final + ",p=" + base64.StdEncoding.EncodeToString(proof))},
+	}, 0)
+	if err != nil {
+		return err
+	}
+	server, _ = reply["payload"].([]byte)
+	if scramAttrs(string(server))["v"] != base64.StdEncoding.EncodeToString(sig) {
+		return errors.New("mongodb: invalid SCRAM server signature")
+	}
+	for reply["done"] != true {
+		reply, err = mc.run(u.authDB, BSONDoc{
+			{"saslContinue", 1},
+			{"conversationId", reply["conversationId"]},
+			{"payload", []byte{}},
+		}, 0)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Attributes of a SCRAM message (a=value,...)
+func scramAttrs(s string) map[string]string {
+	attrs := make(map[string]string)
+	for _, a := range strings.Split(s, ",") {
+		if len(a) > 2 && a[1] == '=' {
+			attrs[a[:1]] = a[2:]
+		}
+	}
+	return attrs
+}
+
+// Client proof and server signature of an authentication message
+func scramProof(salted []byte, msg string) ([]byte, []byte) {
+	ckey := hmacSHA256(salted, "Client Key")
+	stored := sha256.Sum256(ckey)
+	proof := hmacSHA256(stored[:], msg)
+	for i := range proof {
+		proof[i] ^= ckey[i]
+	}
+	return proof, hmacSHA256(hmacSHA256(salted, "Server Key"), msg)
+}
+
+// PBKDF2 (RFC 8018) with HMAC-SHA-256 for one block of key
+func pbkdf2SHA256(pass, salt []byte, iter int) []byte {
+	prf := hmac.New(sha256.New, pass)
+	prf.Write(salt)
+	prf.Write([]byte{0, 0, 0, 1})
+	u := prf.Sum(nil)
+	key := append([]byte(nil), u...)
+	for i := 1; i < iter; i++ {
+		prf.Reset()
+		prf.Write(u)
+		u = prf.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+	return key
+}
+
+// Connection, database and retries shared
+// by MongoDB producers and consumers
+type mongoClient struct {
+	uri     *mongoURI
+	timeout time.Duration
+	retry   RetryPolicy
+	door    sync.Mutex
+	mc      *mongoConn
+}
+
+func (c *mongoClient) init(u *mongoURI) {
+	c.uri = u
+	c.timeout = 10 * time.Second
+	c.retry = DefaultRetry
+}
+
+// Returns the connection, connecting if necessary
+func (c *mongoClient) conn() (*mongoConn, error) {
+	c.door.Lock()
+	defer c.door.Unlock()
+	if c.mc == nil {
+		mc, err := dialMongo(c.uri, c.timeout)
+		if err != nil {
+			return nil, err
+		}
+		c.mc = mc
+	}
+	return c.mc, nil
+}
+
+// Runs a command on the database; the connection is dropped
+// after connection errors and retryable command errors
+func (c *mongoClient) run(cmd BSONDoc, wait time.Duration) (map[string]interface{}, error) {
+	mc, err := c.conn()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := mc.run(c.uri.db, cmd, wait)
+	if err != nil && mongoRetry(err) {
+		c.close()
+	}
+	return reply, err
+}
+
+func (c *mongoClient) close() {
+	c.door.Lock()
+	defer c.door.Unlock()
+	if c.mc != nil {
+		c.mc.close()
+		c.mc = nil
+	}
+}
+
+// Kinds of MongoReaders
+const (
+	mongoFind = iota
+	mongoAggregate
+	mongoWatch
+)
+
+// MongoChange is an event of a MongoDB change stream.
+// Operation is the kind of change, e.g. "insert", "update",
+// "replace" or "delete"; Key is the key of the document
+// (usually its _id), Doc the full document, if available
+// (see MongoReader.SetFullDocument), and Updated and Removed
+// are the fields set and removed by updates.
+type MongoChange struct {
+	Operation string
+	DB        string
+	Coll      string
+	Key       map[string]interface{}
+	Doc       interface{}
+	Updated   map[string]interface{}
+	Removed   []string
+}
+
+// MongoReader is a Producer that reads documents
+// from a MongoDB collection with a find command
+// (see NewMongoFind) or an aggregation pipeline
+// (see NewMongoAggregate) or that watches a collection
+// or database for changes (see NewMongoWatch).
+// Documents are sent down the chain as map[string]interface{}
+// (see UnmarshalBSON) or decoded into the result of newValue
+// (see Into), changes as *MongoChange.
+// Find and aggregate cursors end with the last batch
+// and are not resumed; the producer fails
+// when the connection is lost.
+// Change streams run until the chain is canceled;
+// when the connection is lost, the reader reconnects
+// according to the RetryPolicy (DefaultRetry) and resumes
+// after the last change sent down the chain.
+// With a StateStore (see SetStore), the resume token is stored
+// under the stage "mongodb/<db>/<collection>": by default
+// after each batch or, with StoreOnCheckpoint,
+// when a checkpoint of the chain covers the changes
+// (see conduit.Chain.SetCheckpoints and conduit.Committer);
+// after a restart, the change stream resumes
+// after the stored token (at least once).
+// Without stored token, the change stream starts
+// with the changes after the start of the producer.
+type MongoReader struct {
+	conduit.Cancelable
+	mongoClient
+	kind       int
+	coll       string
+	filter     interface{}
+	pipeline   []interface{}
+	sort       interface{}
+	projection interface{}
+	limit      int
+	batch      int
+	await      time.Duration
+	full       string
+	new        func() interface{}
+	store      conduit.StateStore
+	onCP       bool
+	acks       ackQueue
+	token      interface{}
+}
+
+func newMongoReader(uri, coll string, kind int) (mr *MongoReader) {
+	u, err := parseMongoURI(uri)
+	if err != nil || u.db == "" || (coll == "" && kind != mongoWatch) {
+		return nil
+	}
+	mr = new(MongoReader)
+	if mr != nil {
+		mr.init(u)
+		mr.kind = kind
+		mr.coll = coll
+		mr.batch = 1000
+		mr.await = time.Second
+	}
+	return
+}
+
+// NewMongoFind creates a new MongoReader Producer
+// reading the documents of coll that match filter
+// (a document, nil matches all documents) from the database
+// of the URI (mongodb://[user:password@]host[:port][,host2...]/db[?options]).
+// The first host that is primary is used.
+// Users are authenticated with SCRAM-SHA-256
+// against the database given by the option authSource (default: admin);
+// with the option tls=true, connections use TLS.
+func NewMongoFind(uri, coll string, filter interface{}) *MongoReader {
+	mr := newMongoReader(uri, coll, mongoFind)
+	if mr != nil {
+		mr.filter = filter
+	}
+	return mr
+}
+
+// NewMongoAggregate creates a new MongoReader Producer
+// reading the results of the aggregation pipeline on coll
+// (see NewMongoFind). Stages should be BSONDocs
+// where the order of fields matters, e.g. for $sort.
+func NewMongoAggregate(uri, coll string, pipeline ...interface{}) *MongoReader {
+	mr := newMongoReader(uri, coll, mongoAggregate)
+	if mr != nil {
+		mr.pipeline = pipeline
+	}
+	return mr
+}
+
+// NewMongoWatch creates a new MongoReader Producer
+// watching coll or, if coll is empty, the whole database
+// for changes (see NewMongoFind); the pipeline,
+// e.g. a $match stage, filters the change events.
+// Change streams require a replica set.
+func NewMongoWatch(uri, coll string, pipeline ...interface{}) *MongoReader {
+	mr := newMongoReader(uri, coll, mongoWatch)
+	if mr != nil {
+		mr.pipeline = pipeline
+	}
+	return mr
+}
+
+// SetSort sets the order of found documents, e.g.
+// BSONDoc{{"time", 1}}.
+func (mr *MongoReader) SetSort(sort interface{}) *MongoReader {
+	mr.sort = sort
+	return mr
+}
+
+// SetProjection restricts the fields of found documents,
+// e.g. map[string]int{"name": 1}.
+func (mr *MongoReader) SetProjection(projection interface{}) *MongoReader {
+	mr.projection = projection
+	return mr
+}
+
+// SetLimit restricts the number of found documents.
+func (mr *MongoReader) SetLimit(n int) *MongoReader {
+	mr.limit = n
+	return mr
+}
+
+// SetBatchSize sets the number of documents per batch (default 1000).
+func (mr *MongoReader) SetBatchSize(n int) *MongoReader {
+	if n > 0 {
+		mr.batch = n
+	}
+	return mr
+}
+
+// SetMaxAwait sets how long a request on a change stream
+// waits for new changes (default 1s).
+func (mr *MongoReader) SetMaxAwait(d time.Duration) *MongoReader {
+	mr.await = d
+	return mr
+}
+
+// SetFullDocument sets the fullDocument option of change streams,
+// e.g. "updateLookup" to receive the current document with updates.
+func (mr *MongoReader) SetFullDocument(mode string) *MongoReader {
+	mr.full = mode
+	return mr
+}
+
+// Into decodes documents into the result of newValue
+// (following the rules of UnmarshalBSON).
+func (mr *MongoReader) Into(newValue func() interface{}) *MongoReader {
+	mr.new = newValue
+	return mr
+}
+
+// SetTimeout sets the timeout for connecting and requests (default 10s).
+func (mr *MongoReader) SetTimeout(d time.Duration) *MongoReader {
+	mr.timeout = d
+	return mr
+}
+
+// SetRetry sets the RetryPolicy for reconnecting
+// change streams (default: DefaultRetry).
+func (mr *MongoReader) SetRetry(rp RetryPolicy) *MongoReader {
+	mr.retry = rp
+	return mr
+}
+
+// SetStore sets the StateStore where the resume token is kept.
+// The store should not be the StateStore of the chain,
+// which is reset to the latest checkpoint on restore.
+func (mr *MongoReader) SetStore(st conduit.StateStore) *MongoReader {
+	mr.store = st
+	return mr
+}
+
+// StoreOnCheckpoint stores the resume token only when
+// a checkpoint covers the changes.
+func (mr *MongoReader) StoreOnCheckpoint() *MongoReader {
+	mr.onCP = true
+	return mr
+}
+
+// Resume is the pre-defined method that makes MongoReader
+// a conduit.Resumer. Change streams resume after the stored token,
+// so nothing is skipped.
+func (mr *MongoReader) Resume(pos uint64) error {
+	mr.acks.resume(pos)
+	return nil
+}
+
+// Commit is the pre-defined method that makes MongoReader
+// a conduit.Committer; with StoreOnCheckpoint, it stores
+// the resume token of the last change covered by the checkpoint.
+func (mr *MongoReader) Commit(cp *conduit.Checkpoint) error {
+	if !mr.onCP {
+		return nil
+	}
+	return mr.acks.commit(cp.Position)
+}
+
+// Cancel cancels the producer and closes the connection.
+func (mr *MongoReader) Cancel() {
+	mr.Cancelable.Cancel()
+	mr.close()
+}
+
+func (mr *MongoReader) stage() string {
+	return "mongodb/" + mr.uri.db + "/" + mr.coll
+}
+
+// Stores a resume token
+func (mr *MongoReader) save(token interface{}) error {
+	if mr.store == nil || token == nil {
+		return nil
+	}
+	data, err := MarshalBSON(token)
+	if err != nil {
+		return err
+	}
+	return mr.store.Put(mr.stage(), "token", data)
+}
+
+// Produce is the pre-defined method that makes MongoReader a Producer.
+func (mr *MongoReader) Produce(trg conduit.Target) error {
+	mr.acks.start()
+	defer mr.close()
+	if mr.kind != mongoWatch {
+		return mr.read(trg)
+	}
+	mr.token = nil
+	if mr.store != nil {
+		data, err := mr.store.Get(mr.stage(), "token")
+		if err == nil {
+			var token map[string]interface{}
+			err = UnmarshalBSON(data, &token)
+			if err != nil {
+				return err
+			}
+			mr.token = token
+		} else if err != conduit.ErrNoState {
+			return err
+		}
+	}
+	failures := 0
+	for !mr.Canceled() {
+		ok, err := mr.watch(trg)
+		if err == nil || mr.Canceled() {
+			break
+		}
+		if !mongoRetry(err) {
+			return err
+		}
+		if ok {
+			failures = 0
+		}
+		failures++
+		if failures >= mr.retry.Attempts {
+			return errors.New(fmt.Sprintf("watching %s failed after %d attempts: %v", mr.stage(), failures, err))
+		}
+		if mr.retry.Backoff != nil {
+			sleep(mr.retry.Backoff(failures), mr.Canceled)
+		}
+	}
+	return nil
+}
+
+// Runs find or aggregate and sends the documents down the chain
+func (mr *MongoReader) read(trg conduit.Target) error {
+	var cmd BSONDoc
+	if mr.kind == mongoFind {
+		cmd = BSONDoc{{"find", mr.coll}}
+		if mr.filter != nil {
+			cmd = append(cmd, BSONElem{"filter", mr.filter})
+		}
+		if mr.sort != nil {
+			cmd = append(cmd, BSONElem{"sort", mr.sort})
+		}
+		if mr.projection != nil {
+			cmd = append(cmd, BSONElem{"projection", mr.projection})
+		}
+		if mr.limit > 0 {
+			cmd = append(cmd, BSONElem{"limit", mr.limit})
+		}
+		cmd = append(cmd, BSONElem{"batchSize", mr.batch})
+	} else {
+		cmd = BSONDoc{
+			{"aggregate", mr.coll},
+			{"pipeline", mr.stages(nil)},
+			{"cursor", BSONDoc{{"batchSize", mr.batch}}},
+		}
+	}
+	reply, err := mr.run(cmd, 0)
+	if err != nil {
+		return mr.failed(err)
+	}
+	for !mr.Canceled() {
+		id, docs, _, err := mongoCursor(reply)
+		if err != nil {
+			return err
+		}
+		for _, d := range docs {
+			v, err := mr.decode(d)
+			if err != nil {
+				return err
+			}
+			trg <- v
+		}
+		if id == 0 {
+			return nil
+		}
+		reply, err = mr.more(id, 0)
+		if err != nil {
+			return mr.failed(err)
+		}
+	}
+	return nil
+}
+
+// Errors after cancellation are ignored
+func (mr *MongoReader) failed(err error) error {
+	if mr.Canceled() {
+		return nil
+	}
+	return err
+}
+
+// Pipeline with the stage first, if any
+func (mr *MongoReader) stages(first interface{}) []interface{} {
+	pipeline := []interface{}{}
+	if first != nil {
+		pipeline = append(pipeline, first)
+	}
+	return append(pipeline, mr.pipeline...)
+}
+
+// Requests the next batch of a cursor
+func (mr *MongoReader) more(id int64, wait time.Duration) (map[string]interface{}, error) {
+	cmd := BSONDoc{{"getMore", id}, {"collection", mr.coll}, {"batchSize", mr.batch}}
+	if mr.coll == "" {
+		cmd[1].Value = "$cmd.aggregate"
+	}
+	if wait > 0 {
+		cmd = append(cmd, BSONElem{"maxTimeMS", wait.Milliseconds()})
+	}
+	return mr.run(cmd, wait)
+}
+
+// Cursor ID, batch and resume token of a reply
+func mongoCursor(reply map[string]interface{}) (int64, []interface{}, interface{}, error) {
+	cursor, ok := reply["cursor"].(map[string]interface{})
+	if !ok {
+		return 0, nil, nil, errors.New("mongodb: reply without cursor")
+	}
+	docs, ok := cursor["firstBatch"].([]interface{})
+	if !ok {
+		docs, _ = cursor["nextBatch"].([]interface{})
+	}
+	return bsonInt(cursor["id"]), docs, cursor["postBatchResumeToken"], nil
+}
+
+// Decodes a document
+func (mr *MongoReader) decode(d interface{}) (interface{}, error) {
+	if mr.new == nil || d == nil {
+		return d, nil
+	}
+	v := mr.new()
+	err := assignValue(d, v)
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Opens a change stream and sends the changes down the chain
+// until the producer is canceled; returns whether changes
+// were received before an error
+func (mr *MongoReader) watch(trg conduit.Target) (bool, error) {
+	opts := BSONDoc{}
+	if mr.full != "" {
+		opts = append(opts, BSONElem{"fullDocument", mr.full})
+	}
+	if mr.token != nil {
+		opts = append(opts, BSONElem{"resumeAfter", mr.token})
+	}
+	var coll interface{} = mr.coll
+	if mr.coll == "" {
+		coll = 1
+	}
+	reply, err := mr.run(BSONDoc{
+		{"aggregate", coll},
+		{"pipeline", mr.stages(BSONDoc{{"$changeStream", opts}})},
+		{"cursor", BSONDoc{{"batchSize", mr.batch}}},
+	}, 0)
+	if err != nil {
+		return false, err
+	}
+	ok := false
+	for !mr.Canceled() {
+		id, docs, token, err := mongoCursor(reply)
+		if err != nil {
+			return ok, err
+		}
+		for _, d := range docs {
+			ch, err := mr.change(d)
+			if err != nil {
+				return ok, err
+			}
+			ok = true
+			if !mr.deliver(ch, d.(map[string]interface{})["_id"], trg) {
+				return ok, nil
+			}
+		}
+		// the token after the batch also covers changes
+		// that were filtered out
+		if token != nil {
+			mr.token = token
+		}
+		if !mr.onCP {
+			err = mr.save(mr.token)
+			if err != nil {
+				return ok, err
+			}
+		}
+		if id == 0 {
+			return ok, errors.New("mongodb: change stream closed")
+		}
+		reply, err = mr.more(id, mr.await)
+		if err != nil {
+			return ok, err
+		}
+	}
+	return ok, nil
+}
+
+// Sends a change down the chain; with StoreOnCheckpoint,
+// storing its token is added in the same order
+func (mr *MongoReader) deliver(ch *MongoChange, token interface{}, trg conduit.Target) bool {
+	if mr.Canceled() {
+		return false
+	}
+	if mr.onCP {
+		mr.acks.add(func() error {
+			return mr.save(token)
+		})
+	}
+	mr.token = token
+	trg <- ch
+	return true
+}
+
+// Converts a change event
+func (mr *MongoReader) change(d interface{}) (*MongoChange, error) {
+	ev, ok := d.(map[string]interface{})
+	if !ok || ev["_id"] == nil {
+		return nil, errors.New("mongodb: change event without resume token")
+	}
+	ch := new(MongoChange)
+	ch.Operation, _ = ev["operationType"].(string)
+	if ns, ok := ev["ns"].(map[string]interface{}); ok {
+		ch.DB, _ = ns["db"].(string)
+		ch.Coll, _ = ns["coll"].(string)
+	}
+	ch.Key, _ = ev["documentKey"].(map[string]interface{})
+	var err error
+	ch.Doc, err = mr.decode(ev["fullDocument"])
+	if err != nil {
+		return nil, err
+	}
+	if upd, ok := ev["updateDescription"].(map[string]interface{}); ok {
+		ch.Updated, _ = upd["updatedFields"].(map[string]interface{})
+		removed, _ := upd["removedFields"].([]interface{})
+		for _, r := range removed {
+			if s, ok := r.(string); ok {
+				ch.Removed = append(ch.Removed, s)
+			}
+		}
+	}
+	return ch, nil
+}
+
+// MongoInsert inserts Doc (see MongoWriter).
+type MongoInsert struct {
+	Doc interface{}
+}
+
+// MongoUpdate updates the documents matching Filter
+// (only the first, unless Multi) with Update,
+// an update document (e.g. with $set) or pipeline;
+// with Upsert, a document is inserted if none matches.
+type MongoUpdate struct {
+	Filter interface{}
+	Update interface{}
+	Upsert bool
+	Multi  bool
+}
+
+// MongoReplace replaces the first document matching Filter with Doc;
+// with Upsert, Doc is inserted if none matches.
+type MongoReplace struct {
+	Filter interface{}
+	Doc    interface{}
+	Upsert bool
+}
+
+// MongoDelete deletes the first document matching Filter
+// or, with Multi, all of them.
+type MongoDelete struct {
+	Filter interface{}
+	Multi  bool
+}
+
+// Write operation of a bulk write
+type mongoOp struct {
+	kind string
+	doc  interface{}
+	size int
+}
+
+// Fields of the kinds of write commands
+var mongoOpFields = map[string]string{
+	"insert": "documents",
+	"update": "updates",
+	"delete": "deletes",
+}
+
+// MongoWriter is a Consumer that writes the incoming items
+// to a MongoDB collection in bulk (see NewMongoFind for the URI).
+// *MongoInsert, *MongoUpdate, *MongoReplace and *MongoDelete
+// items (or values) are executed as such; all other items
+// are inserted as documents (see MarshalBSON).
+// Operations are collected in batches (see SetBatchSize),
+// which are written when full, at barriers and at the end,
+// such that consecutive operations of the same kind
+// are sent in one command and operations are executed in order.
+// Documents without _id get a new ObjectID.
+// When the connection is lost, the writer reconnects
+// and writes the batch again according to the RetryPolicy
+// (DefaultRetry); documents that were inserted before are skipped,
+// but updates that are not idempotent (e.g. $inc)
+// may be applied twice. Consume terminates with an error
+// when the server rejects a write.
+type MongoWriter struct {
+	mongoClient
+	coll    string
+	batch   int
+	pending []mongoOp
+	size    int
+}
+
+// NewMongoWriter creates a new MongoWriter Consumer
+// writing to coll in the database of the URI (see NewMongoFind).
+func NewMongoWriter(uri, coll string) (mw *MongoWriter) {
+	u, err := parseMongoURI(uri)
+	if err != nil || u.db == "" || coll == "" {
+		return nil
+	}
+	mw = new(MongoWriter)
+	if mw != nil {
+		mw.init(u)
+		mw.coll = coll
+		mw.batch = 1000
+	}
+	return
+}
+
+// SetBatchSize sets the maximum number of operations
+// per batch (default 1000).
+func (mw *MongoWriter) SetBatchSize(n int) *MongoWriter {
+	if n > 0 {
+		mw.batch = n
+	}
+	return mw
+}
+
+// SetTimeout sets the timeout for connecting and requests (default 10s).
+func (mw *MongoWriter) SetTimeout(d time.Duration) *MongoWriter {
+	mw.timeout = d
+	return mw
+}
+
+// SetRetry sets the RetryPolicy for connection errors (default: DefaultRetry).
+func (mw *MongoWriter) SetRetry(rp RetryPolicy) *MongoWriter {
+	mw.retry = rp
+	return mw
+}
+
+// Consume is the pre-defined method that makes MongoWriter a Consumer.
+func (mw *MongoWriter) Consume(src conduit.Source) error {
+	defer mw.close()
+	mw.pending = nil
+	mw.size = 0
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			err := mw.flush()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		op, err := mongoOperation(inp)
+		if err != nil {
+			return err
+		}
+		mw.pending = append(mw.pending, op)
+		mw.size += op.size
+		// commands are limited to 16MiB
+		if len(mw.pending) >= mw.batch || mw.size >= 8*1024*1024 {
+			err = mw.flush()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return mw.flush()
+}
+
+// Converts an item to an operation
+func mongoOperation(inp interface{}) (mongoOp, error) {
+	switch x := inp.(type) {
+	case MongoInsert:
+		return mongoOperation(&x)
+	case MongoUpdate:
+		return mongoOperation(&x)
+	case MongoReplace:
+		return mongoOperation(&x)
+	case MongoDelete:
+		return mongoOperation(&x)
+	case *MongoInsert:
+		doc, err := mongoDocument(x.Doc)
+		return mongoOp{kind: "insert", doc: doc, size: len(doc)}, err
+	case *MongoUpdate:
+		return mongoOp{kind: "update", doc: BSONDoc{
+			{"q", mongoFilter(x.Filter)}, {"u", x.Update}, {"upsert", x.Upsert}, {"multi", x.Multi},
+		}}, nil
+	case *MongoReplace:
+		doc, err := MarshalBSON(x.Doc)
+		return mongoOp{kind: "update", doc: BSONDoc{
+			{"q", mongoFilter(x.Filter)}, {"u", bsonRaw(doc)}, {"upsert", x.Upsert},
+		}, size: len(doc)}, err
+	case *MongoDelete:
+		limit := 1
+		if x.Multi {
+			limit = 0
+		}
+		return mongoOp{kind: "delete", doc: BSONDoc{{"q", mongoFilter(x.Filter)}, {"limit", limit}}}, nil
+	}
+	doc, err := mongoDocument(inp)
+	return mongoOp{kind: "insert", doc: doc, size: len(doc)}, err
+}
+
+// Filters are documents; nil matches all documents
+func mongoFilter(filter interface{}) interface{} {
+	if filter == nil {
+		return BSONDoc{}
+	}
+	return filter
+}
+
+// Encodes a document to insert; documents without _id get one
+func mongoDocument(v interface{}) (bsonRaw, error) {
+	doc, err := MarshalBSON(v)
+	if err != nil {
+		return nil, err
+	}
+	if bsonHasField(doc, "_id") {
+		return doc, nil
+	}
+	id := NewObjectID()
+	with := make([]byte, 4, len(doc)+17)
+	with = append(with, 0x07, '_', 'i', 'd', 0)
+	with = append(append(with, id[:]...), doc[4:]...)
+	binary.LittleEndian.PutUint32(with, uint32(len(with)))
+	return with, nil
+}
+
+// Checks whether an encoded document has a top-level field
+func bsonHasField(doc []byte, name string) bool {
+	p := doc[4 : len(doc)-1]
+	for len(p) > 0 {
+		end := bytes.IndexByte(p[1:], 0)
+		if end < 0 {
+			return false
+		}
+		if string(p[1:1+end]) == name {
+			return true
+		}
+		t := p[0]
+		p = p[2+end:]
+		_, n, err := readBSONValue(t, p)
+		if err != nil {
+			return false
+		}
+		p = p[n:]
+	}
+	return false
+}
+
+// Writes the pending operations
+func (mw *MongoWriter) flush() error {
+	ops := mw.pending
+	mw.pending = nil
+	mw.size = 0
+	for len(ops) > 0 {
+		n := 1
+		for n < len(ops) && ops[n].kind == ops[0].kind {
+			n++
+		}
+		err := mw.write(ops[0].kind, ops[:n])
+		if err != nil {
+			return err
+		}
+		ops = ops[n:]
+	}
+	return nil
+}
+
+// Writes operations of one kind in one command
+func (mw *MongoWriter) write(kind string, ops []mongoOp) error {
+	docs := make([]interface{}, len(ops))
+	for i, op := range ops {
+		docs[i] = op.doc
+	}
+	retried := false
+	attempts, err := mw.retry.run(nil, func() (bool, error) {
+		// after an interruption, inserts are repeated independently,
+		// so that documents inserted before can be skipped
+		ordered := !(retried && kind == "insert")
+		retried = true
+		reply, err := mw.run(BSONDoc{
+			{kind, mw.coll},
+			{mongoOpFields[kind], docs},
+			{"ordered", ordered},
+		}, 0)
+		if err != nil {
+			return mongoRetry(err), err
+		}
+		return false, mongoWriteErrors(reply, !ordered)
+	})
+	if err != nil {
+		if _, ok := err.(*mongoError); ok || attempts <= 1 {
+			return err
+		}
+		return errors.New(fmt.Sprintf("%s failed after %d attempts: %v", kind, attempts, err))
+	}
+	return nil
+}
+
+// First write error of a reply; with dupsOK,
+// duplicate key errors are ignored
+func mongoWriteErrors(reply map[string]interface{}, dupsOK bool) error {
+	errs, _ := reply["writeErrors"].([]interface{})
+	for _, e := range errs {
+		we, _ := e.(map[string]interface{})
+		code := int(bsonInt(we["code"]))
+		if dupsOK && code == 11000 {
+			continue
+		}
+		msg, _ := we["errmsg"].(string)
+		return &mongoError{code: code, msg: fmt.Sprintf("write %d: %s", bsonInt(we["index"]), msg)}
+	}
+	if wce, ok := reply["writeConcernError"].(map[string]interface{}); ok {
+		msg, _ := wce["errmsg"].(string)
+		return &mongoError{code: int(bsonInt(wce["code"])), msg: msg}
+	}
+	return nil
+}
@@ -0,0 +1,717 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+// MongoDB test server with a single database
+// and user "app" with password "secret".
+// Filters match top-level fields by equality;
+// change streams are kept in one list of events.
+// With dropInsert, the connection is closed
+// after the n-th insert command has been executed.
+type mongoServer struct {
+	ln         net.Listener
+	door       sync.Mutex
+	colls      map[string][]map[string]interface{}
+	events     []map[string]interface{}
+	cursors    map[int64]*fakeCursor
+	nextID     int64
+	conns      map[net.Conn]bool
+	salt       []byte
+	stored     []byte
+	server     []byte
+	inserts    int
+	dropInsert int
+	getMores   int
+	streams    int
+}
+
+type fakeCursor struct {
+	docs   []interface{}
+	stream bool
+	coll   string
+	pos    int
+	full   bool
+	filter []map[string]interface{}
+}
+
+func newMongoServer() (*mongoServer, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	ms := &mongoServer{
+		ln:      ln,
+		colls:   make(map[string][]map[string]interface{}),
+		cursors: make(map[int64]*fakeCursor),
+		conns:   make(map[net.Conn]bool),
+		salt:    []byte("saltsaltsalt"),
+	}
+	salted := pbkdf2SHA256([]byte("secret"), ms.salt, 4096)
+	ckey := hmacSHA256(salted, "Client Key")
+	stored := sha256.Sum256(ckey)
+	ms.stored = stored[:]
+	ms.server = hmacSHA256(salted, "Server Key")
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			ms.door.Lock()
+			ms.conns[conn] = true
+			ms.door.Unlock()
+			go ms.serve(conn)
+		}
+	}()
+	return ms, nil
+}
+
+func (ms *mongoServer) uri(pass string) string {
+	return fmt.Sprintf("mongodb://app:%s@localhost:1,%s/shop?authSource=admin", pass, ms.ln.Addr())
+}
+
+func (ms *mongoServer) close() {
+	ms.ln.Close()
+	ms.kick()
+}
+
+// Closes all connections
+func (ms *mongoServer) kick() {
+	ms.door.Lock()
+	defer ms.door.Unlock()
+	for c := range ms.conns {
+		c.Close()
+		delete(ms.conns, c)
+	}
+}
+
+func (ms *mongoServer) count(coll string) int {
+	ms.door.Lock()
+	defer ms.door.Unlock()
+	return len(ms.colls[coll])
+}
+
+func (ms *mongoServer) serve(conn net.Conn) {
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	authed := false
+	var first, sfirst string
+	for {
+		data, err := readMongoMsg(rd)
+		if err != nil {
+			return
+		}
+		x, err := readBSONDoc(data, false)
+		if err != nil {
+			return
+		}
+		cmd := x.(map[string]interface{})
+		// the command is the first field
+		name := string(data[5 : 5+bytes.IndexByte(data[5:], 0)])
+		var reply interface{}
+		fail := func(code int, msg string) {
+			reply = BSONDoc{{"ok", 0}, {"errmsg", msg}, {"code", code}}
+		}
+		switch {
+		case cmd["$db"] == nil:
+			fail(40414, "$db missing")
+		case name == "hello":
+			reply = BSONDoc{{"isWritablePrimary", true}, {"ok", 1}}
+		case name == "saslStart":
+			payload, _ := cmd["payload"].([]byte)
+			first = strings.TrimPrefix(string(payload), "n,,")
+			sfirst = fmt.Sprintf("r=%sserver,s=%s,i=4096", scramAttrs(first)["r"], base64.StdEncoding.EncodeToString(ms.salt))
+			if cmd["$db"] != "admin" || cmd["mechanism"] != "SCRAM-SHA-256" || scramAttrs(first)["n"] != "app" {
+				fail(18, "Authentication failed.")
+				break
+			}
+			reply = BSONDoc{{"conversationId", 1}, {"payload", []byte(sfirst)}, {"done", false}, {"ok", 1}}
+		case name == "saslContinue":
+			payload, _ := cmd["payload"].([]byte)
+			final := string(payload)
+			i := strings.Index(final, ",p=")
+			proof, _ := base64.StdEncoding.DecodeString(final[i+3:])
+			msg := first + "," + sfirst + "," + final[:i]
+			ckey := hmacSHA256(ms.stored, msg)
+			for j := range ckey {
+				if j < len(proof) {
+					ckey[j] ^= proof[j]
+				}
+			}
+			if stored := sha256.Sum256(ckey); !bytes.Equal(stored[:], ms.stored) {
+				fail(18, "Authentication failed.")
+				break
+			}
+			authed = true
+			v := base64.StdEncoding.EncodeToString(hmacSHA256(ms.server, msg))
+			reply = BSONDoc{{"conversationId", 1}, {"payload", []byte("v=" + v)}, {"done", true}, {"ok", 1}}
+		case !authed:
+			fail(13, "command requires authentication")
+		default:
+			var drop bool
+			reply, drop = ms.command(name, cmd)
+			if drop {
+				return
+			}
+		}
+		doc, err := MarshalBSON(reply)
+		if err != nil {
+			panic(err)
+		}
+		msg := make([]byte, 21, 21+len(doc))
+		binary.LittleEndian.PutUint32(msg, uint32(21+len(doc)))
+		binary.LittleEndian.PutUint32(msg[12:], mongoOpMsg)
+		if _, err := conn.Write(append(msg, doc...)); err != nil {
+			return
+		}
+	}
+}
+
+// Checks whether doc matches a filter
+func mongoMatch(doc map[string]interface{}, filter map[string]interface{}) bool {
+	for k, v := range filter {
+		if fmt.Sprint(doc[k]) != fmt.Sprint(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// Executes a command; returns the reply
+// and whether the connection is to be dropped
+func (ms *mongoServer) command(name string, cmd map[string]interface{}) (interface{}, bool) {
+	ms.door.Lock()
+	defer ms.door.Unlock()
+	switch name {
+	case "find":
+		coll := cmd["find"].(string)
+		filter, _ := cmd["filter"].(map[string]interface{})
+		var docs []interface{}
+		for _, d := range ms.colls[coll] {
+			if mongoMatch(d, filter) {
+				docs = append(docs, d)
+			}
+		}
+		if n := int(bsonInt(cmd["limit"])); n > 0 && n < len(docs) {
+			docs = docs[:n]
+		}
+		return ms.open(&fakeCursor{docs: docs, coll: coll}, int(bsonInt(cmd["batchSize"]))), false
+	case "aggregate":
+		coll, _ := cmd["aggregate"].(string)
+		pipeline, _ := cmd["pipeline"].([]interface{})
+		size := int(bsonInt(cmd["cursor"].(map[string]interface{})["batchSize"]))
+		var filters []map[string]interface{}
+		cur := &fakeCursor{coll: coll}
+		for _, s := range pipeline {
+			stage := s.(map[string]interface{})
+			if cs, ok := stage["$changeStream"].(map[string]interface{}); ok {
+				cur.stream = true
+				cur.pos = len(ms.events)
+				cur.full = cs["fullDocument"] == "updateLookup"
+				if token, ok := cs["resumeAfter"].(map[string]interface{}); ok {
+					fmt.Sscanf(token["_data"].(string), "%08d", &cur.pos)
+				}
+				ms.streams++
+			}
+			if m, ok := stage["$match"].(map[string]interface{}); ok {
+				filters = append(filters, m)
+			}
+		}
+		if cur.stream {
+			cur.filter = filters
+			return ms.open(cur, size), false
+		}
+		for _, d := range ms.colls[coll] {
+			ok := true
+			for _, f := range filters {
+				ok = ok && mongoMatch(d, f)
+			}
+			if ok {
+				cur.docs = append(cur.docs, d)
+			}
+		}
+		return ms.open(cur, size), false
+	case "getMore":
+		ms.getMores++
+		id := bsonInt(cmd["getMore"])
+		cur, ok := ms.cursors[id]
+		if !ok || (cur.coll == "" && cmd["collection"] != "$cmd.aggregate") || (cur.coll != "" && cmd["collection"] != cur.coll) {
+			return BSONDoc{{"ok", 0}, {"errmsg", "cursor not found"}, {"code", 43}}, false
+		}
+		deadline := time.Now().Add(time.Duration(bsonInt(cmd["maxTimeMS"])) * time.Millisecond)
+		for cur.stream && cur.pos == len(ms.events) && time.Now().Before(deadline) {
+			ms.door.Unlock()
+			time.Sleep(2 * time.Millisecond)
+			ms.door.Lock()
+		}
+		return ms.batch(id, cur, int(bsonInt(cmd["batchSize"])), "nextBatch"), false
+	case "killCursors":
+		for _, id := range cmd["cursors"].([]interface{}) {
+			delete(ms.cursors, bsonInt(id))
+		}
+		return BSONDoc{{"ok", 1}}, false
+	case "insert":
+		coll := cmd["insert"].(string)
+		ms.inserts++
+		reply := ms.write(coll, cmd["documents"].([]interface{}), cmd["ordered"] != false, func(d map[string]interface{}) (int, error) {
+			for _, x := range ms.colls[coll] {
+				if fmt.Sprint(x["_id"]) == fmt.Sprint(d["_id"]) {
+					return 0, &mongoError{11000, "E11000 duplicate key error"}
+				}
+			}
+			ms.colls[coll] = append(ms.colls[coll], d)
+			ms.event("insert", coll, d, nil)
+			return 1, nil
+		})
+		return reply, ms.inserts == ms.dropInsert
+	case "update":
+		coll := cmd["update"].(string)
+		return ms.write(coll, cmd["updates"].([]interface{}), cmd["ordered"] != false, func(op map[string]interface{}) (int, error) {
+			q := op["q"].(map[string]interface{})
+			u := op["u"].(map[string]interface{})
+			n := 0
+			for i, d := range ms.colls[coll] {
+				if !mongoMatch(d, q) {
+					continue
+				}
+				if set, ok := u["$set"].(map[string]interface{}); ok {
+					for k, v := range set {
+						d[k] = v
+					}
+					ms.event("update", coll, d, set)
+				} else {
+					u["_id"] = d["_id"]
+					ms.colls[coll][i] = u
+					ms.event("replace", coll, u, nil)
+				}
+				n++
+				if op["multi"] != true {
+					return n, nil
+				}
+			}
+			if n == 0 && op["upsert"] == true {
+				d := make(map[string]interface{})
+				for k, v := range q {
+					d[k] = v
+				}
+				if set, ok := u["$set"].(map[string]interface{}); ok {
+					u = set
+				}
+				for k, v := range u {
+					d[k] = v
+				}
+				if d["_id"] == nil {
+					d["_id"] = NewObjectID()
+				}
+				ms.colls[coll] = append(ms.colls[coll], d)
+				ms.event("insert", coll, d, nil)
+				n++
+			}
+			return n, nil
+		}), false
+	case "delete":
+		coll := cmd["delete"].(string)
+		return ms.write(coll, cmd["deletes"].([]interface{}), cmd["ordered"] != false, func(op map[string]interface{}) (int, error) {
+			q := op["q"].(map[string]interface{})
+			var keep []map[string]interface{}
+			n := 0
+			for _, d := range ms.colls[coll] {
+				if mongoMatch(d, q) && (n == 0 || bsonInt(op["limit"]) == 0) {
+					n++
+					ms.event("delete", coll, d, nil)
+					continue
+				}
+				keep = append(keep, d)
+			}
+			ms.colls[coll] = keep
+			return n, nil
+		}), false
+	}
+	return BSONDoc{{"ok", 0}, {"errmsg", "no such command: " + name}, {"code", 59}}, false
+}
+
+// Executes the operations of a write command
+func (ms *mongoServer) write(coll string, ops []interface{}, ordered bool, f func(map[string]interface{}) (int, error)) interface{} {
+	n := 0
+	var errs []interface{}
+	for i, op := range ops {
+		k, err := f(op.(map[string]interface{}))
+		n += k
+		if err != nil {
+			e := err.(*mongoError)
+			errs = append(errs, BSONDoc{{"index", i}, {"code", e.code}, {"errmsg", e.msg}})
+			if ordered {
+				break
+			}
+		}
+	}
+	reply := BSONDoc{{"n", n}, {"ok", 1}}
+	if errs != nil {
+		reply = append(reply, BSONElem{"writeErrors", errs})
+	}
+	return reply
+}
+
+// Adds a change event
+func (ms *mongoServer) event(op, coll string, doc, set map[string]interface{}) {
+	copied := make(map[string]interface{})
+	for k, v := range doc {
+		copied[k] = v
+	}
+	ev := map[string]interface{}{
+		"_id":           map[string]interface{}{"_data": fmt.Sprintf("%08d", len(ms.events)+1)},
+		"operationType": op,
+		"ns":            map[string]interface{}{"db": "shop", "coll": coll},
+		"documentKey":   map[string]interface{}{"_id": doc["_id"]},
+	}
+	if op != "delete" {
+		ev["fullDocument"] = copied
+	}
+	if set != nil {
+		ev["updateDescription"] = map[string]interface{}{"updatedFields": set, "removedFields": []interface{}{}}
+	}
+	ms.events = append(ms.events, ev)
+}
+
+// Registers a cursor and returns its first batch
+func (ms *mongoServer) open(cur *fakeCursor, size int) interface{} {
+	ms.nextID++
+	ms.cursors[ms.nextID] = cur
+	return ms.batch(ms.nextID, cur, size, "firstBatch")
+}
+
+// Returns the next batch of a cursor
+func (ms *mongoServer) batch(id int64, cur *fakeCursor, size int, field string) interface{} {
+	if size <= 0 {
+		size = 101
+	}
+	docs := []interface{}{}
+	if cur.stream {
+		for cur.pos < len(ms.events) && len(docs) < size {
+			ev := ms.events[cur.pos]
+			cur.pos++
+			ns := ev["ns"].(map[string]interface{})
+			ok := cur.coll == "" || ns["coll"] == cur.coll
+			for _, f := range cur.filter {
+				ok = ok && mongoMatch(ev, f)
+			}
+			if !ok {
+				continue
+			}
+			if ev["operationType"] == "update" && !cur.full {
+				copied := make(map[string]interface{})
+				for k, v := range ev {
+					copied[k] = v
+				}
+				delete(copied, "fullDocument")
+				ev = copied
+			}
+			docs = append(docs, ev)
+		}
+		ns := "shop." + cur.coll
+		return BSONDoc{{"cursor", BSONDoc{
+			{"id", id}, {"ns", ns}, {field, docs},
+			{"postBatchResumeToken", map[string]interface{}{"_data": fmt.Sprintf("%08d", cur.pos)}},
+		}}, {"ok", 1}}
+	}
+	for len(cur.docs) > 0 && len(docs) < size {
+		docs = append(docs, cur.docs[0])
+		cur.docs = cur.docs[1:]
+	}
+	if len(cur.docs) == 0 {
+		delete(ms.cursors, id)
+		id = 0
+	}
+	return BSONDoc{{"cursor", BSONDoc{{"id", id}, {"ns", "shop." + cur.coll}, {field, docs}}}, {"ok", 1}}
+}
+
+func TestMongoURI(t *testing.T) {
+	u, err := parseMongoURI("mongodb://us%40er:p%3Ass@h1,h2:27018/db?authSource=users&tls=true")
+	if err != nil {
+		t.Fatalf("MongoURI: %v", err)
+	}
+	if u.user != "us@er" || u.pass != "p:ss" || u.db != "db" || u.authDB != "users" || !u.tls ||
+		strings.Join(u.hosts, ",") != "h1:27017,h2:27018" {
+		t.Errorf("MongoURI: unexpected options %+v", u)
+	}
+	for _, s := range []string{"http://host/db", "mongodb:///db", "mongodb://h/db?%zz"} {
+		if _, err := parseMongoURI(s); err == nil {
+			t.Errorf("MongoURI: %s accepted", s)
+		}
+	}
+	if NewMongoFind("mongodb://host", "c", nil) != nil || NewMongoWriter("mongodb://host/db", "") != nil ||
+		NewMongoWatch("mongodb://host/db", "") == nil {
+		t.Errorf("MongoURI: unexpected constructor results")
+	}
+}
+
+// Document written with MongoWriter and read back
+type mongoItem struct {
+	ID   interface{} `json:"_id"`
+	N    int         `json:"n"`
+	Kind string      `json:"kind"`
+}
+
+func TestMongo(t *testing.T) {
+	ms, err := newMongoServer()
+	if err != nil {
+		t.Fatalf("Mongo: cannot start server: %v", err)
+	}
+	defer ms.close()
+
+	chn := conduit.NewChain(NewMongoFind(ms.uri("wrong"), "items", nil), nil, &TakeConsumer{n: -1}, small)
+	if chn.Run() == nil || !strings.Contains(fmt.Sprint(chn.Errs), "Authentication failed") {
+		t.Errorf("MongoReader: unexpected errors with wrong password: %v", chn.Errs)
+	}
+
+	var items []interface{}
+	for i := 0; i < 300; i++ {
+		kind := "odd"
+		if i%2 == 0 {
+			kind = "even"
+		}
+		if i < 10 {
+			items = append(items, mongoItem{ID: fmt.Sprintf("id-%d", i), N: i, Kind: kind})
+		} else {
+			items = append(items, map[string]interface{}{"n": i, "kind": kind})
+		}
+	}
+	items = append(items,
+		&MongoUpdate{Filter: map[string]int{"n": 1}, Update: BSONDoc{{"$set", BSONDoc{{"kind", "one"}}}}},
+		MongoReplace{Filter: map[string]int{"n": 2}, Doc: map[string]interface{}{"n": 2, "kind": "two"}},
+		&MongoDelete{Filter: map[string]string{"kind": "even"}, Multi: true},
+		&MongoUpdate{Filter: map[string]int{"n": 1000}, Update: BSONDoc{{"$set", BSONDoc{{"kind", "new"}}}}, Upsert: true},
+		&MongoInsert{Doc: BSONDoc{{"n", 1001}, {"kind", "last"}}},
+	)
+	// the connection is lost after the second batch of inserts
+	ms.dropInsert = 2
+	mw := NewMongoWriter(ms.uri("secret"), "items").SetBatchSize(64).SetRetry(fastRetry)
+	if err := conduit.NewChain(&AnyProducer{src: items}, nil, mw, small).Run(); err != nil {
+		t.Fatalf("MongoWriter failed: %v", err)
+	}
+	if n := ms.count("items"); n != 153 {
+		t.Errorf("MongoWriter: %d documents written", n)
+	}
+	mw = NewMongoWriter(ms.uri("secret"), "items")
+	chn = conduit.NewChain(&AnyProducer{src: []interface{}{map[string]string{"_id": "id-1"}}}, nil, mw, small)
+	if chn.Run() == nil || !strings.Contains(fmt.Sprint(chn.Errs), "duplicate key") {
+		t.Errorf("MongoWriter: unexpected errors on duplicate: %v", chn.Errs)
+	}
+
+	c := &TakeConsumer{n: -1}
+	mr := NewMongoFind(ms.uri("secret"), "items", map[string]string{"kind": "odd"}).SetBatchSize(40).Into(func() interface{} { return new(mongoItem) })
+	if err := conduit.NewChain(mr, nil, c, small).Run(); err != nil {
+		t.Fatalf("MongoReader failed: %v", err)
+	}
+	if len(c.recvd) != 149 || ms.getMores != 3 {
+		t.Fatalf("MongoReader: %d documents with %d requests", len(c.recvd), ms.getMores)
+	}
+	ids := make(map[string]bool)
+	for i, inp := range c.recvd {
+		it := inp.(*mongoItem)
+		if it.N != 2*i+3 || it.Kind != "odd" || it.ID == nil || ids[fmt.Sprint(it.ID)] {
+			t.Errorf("MongoReader: unexpected document %+v", it)
+		}
+		ids[fmt.Sprint(it.ID)] = true
+	}
+
+	c = &TakeConsumer{n: -1}
+	mr = NewMongoFind(ms.uri("secret"), "items", nil).SetLimit(10)
+	if err := conduit.NewChain(mr, nil, c, small).Run(); err != nil {
+		t.Fatalf("MongoReader failed: %v", err)
+	}
+	if len(c.recvd) != 10 || c.recvd[0].(map[string]interface{})["_id"] != "id-1" {
+		t.Errorf("MongoReader: unexpected documents %v", c.recvd)
+	}
+
+	c = &TakeConsumer{n: -1}
+	mr = NewMongoAggregate(ms.uri("secret"), "items", BSONDoc{{"$match", BSONDoc{{"kind", "two"}}}})
+	if err := conduit.NewChain(mr, nil, c, small).Run(); err != nil {
+		t.Fatalf("MongoReader failed: %v", err)
+	}
+	if len(c.recvd) != 1 || c.recvd[0].(map[string]interface{})["n"] != int32(2) {
+		t.Errorf("MongoReader: unexpected documents %v", c.recvd)
+	}
+}
+
+// Consumer that drops the connections of the server
+// after kick changes and stops after n changes
+type MongoKickConsumer struct {
+	ms    *mongoServer
+	kick  int
+	n     int
+	recvd []interface{}
+}
+
+func (c *MongoKickConsumer) Consume(src conduit.Source) error {
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			continue
+		}
+		c.recvd = append(c.recvd, inp)
+		if len(c.recvd) == c.kick {
+			c.ms.kick()
+		}
+		if len(c.recvd) == c.n {
+			return conduit.EOS
+		}
+	}
+	return nil
+}
+
+// Runs the producer and, when it watches, the writer
+func runMongoWatch(ms *mongoServer, p conduit.Producer, c conduit.Consumer, items []interface{}, cps conduit.CheckpointStore) (error, error) {
+	streams := ms.streams
+	chn := conduit.NewChain(p, nil, c, small)
+	if cps != nil {
+		chn.SetCheckpoints(time.Millisecond, cps)
+	}
+	done := make(chan error, 1)
+	go func() { done <- chn.Run() }()
+	for {
+		ms.door.Lock()
+		open := ms.streams > streams
+		ms.door.Unlock()
+		if open {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	mw := NewMongoWriter(ms.uri("secret"), "items").SetBatchSize(10).SetRetry(fastRetry)
+	werr := conduit.NewChain(&AnyProducer{src: items}, nil, mw, small).Run()
+	return <-done, werr
+}
+
+// Checks that changes are inserts of documents n, n+1, ...
+func checkMongoChanges(changes []interface{}, n int) error {
+	for i, inp := range changes {
+		ch := inp.(*MongoChange)
+		doc, _ := ch.Doc.(map[string]interface{})
+		if ch.Operation != "insert" || ch.DB != "shop" || ch.Coll != "items" || doc == nil || bsonInt(doc["n"]) != int64(n+i) ||
+			fmt.Sprint(ch.Key["_id"]) != fmt.Sprint(doc["_id"]) {
+			return errors.New(fmt.Sprintf("unexpected change %d: %+v", i, ch))
+		}
+	}
+	return nil
+}
+
+// Change streams:
+// - Reconnecting resumes after the last change
+// - A restarted reader resumes after the stored token
+// - Updates and deletes are reported
+func TestMongoWatch(t *testing.T) {
+	ms, err := newMongoServer()
+	if err != nil {
+		t.Fatalf("Mongo: cannot start server: %v", err)
+	}
+	defer ms.close()
+	st := conduit.NewMemStore()
+
+	var items []interface{}
+	for i := 0; i < 100; i++ {
+		items = append(items, map[string]interface{}{"n": i})
+	}
+	c := &MongoKickConsumer{ms: ms, kick: 30, n: 100}
+	mr := NewMongoWatch(ms.uri("secret"), "items").SetStore(st).SetMaxAwait(20 * time.Millisecond).SetBatchSize(7).SetRetry(fastRetry)
+	err, werr := runMongoWatch(ms, mr, c, items, nil)
+	if err != nil || werr != nil {
+		t.Fatalf("MongoReader failed: %v (writer: %v)", err, werr)
+	}
+	if len(c.recvd) != 100 || ms.streams < 2 {
+		t.Fatalf("MongoReader: %d changes, %d streams", len(c.recvd), ms.streams)
+	}
+	if err := checkMongoChanges(c.recvd, 0); err != nil {
+		t.Errorf("MongoReader: %v", err)
+	}
+
+	items = []interface{}{map[string]interface{}{"n": 100}, map[string]interface{}{"n": 101}}
+	mw := NewMongoWriter(ms.uri("secret"), "items")
+	if err := conduit.NewChain(&AnyProducer{src: items}, nil, mw, small).Run(); err != nil {
+		t.Fatalf("MongoWriter failed: %v", err)
+	}
+	// changes of other collections are not reported
+	mw = NewMongoWriter(ms.uri("secret"), "other")
+	if err := conduit.NewChain(&AnyProducer{src: items}, nil, mw, small).Run(); err != nil {
+		t.Fatalf("MongoWriter failed: %v", err)
+	}
+	items = []interface{}{
+		MongoUpdate{Filter: map[string]int{"n": 100}, Update: map[string]interface{}{"$set": map[string]string{"kind": "x"}}},
+		MongoDelete{Filter: map[string]int{"n": 101}},
+	}
+	rest := &MongoKickConsumer{ms: ms, n: 4}
+	mr = NewMongoWatch(ms.uri("secret"), "items").SetStore(st).SetFullDocument("updateLookup").SetMaxAwait(20 * time.Millisecond)
+	err, werr = runMongoWatch(ms, mr, rest, items, nil)
+	if err != nil || werr != nil {
+		t.Fatalf("MongoReader failed: %v (writer: %v)", err, werr)
+	}
+	if err := checkMongoChanges(rest.recvd[:2], 100); err != nil {
+		t.Errorf("MongoReader after restart: %v", err)
+	}
+	upd := rest.recvd[2].(*MongoChange)
+	doc, _ := upd.Doc.(map[string]interface{})
+	if upd.Operation != "update" || upd.Updated["kind"] != "x" || doc["kind"] != "x" || len(upd.Removed) != 0 {
+		t.Errorf("MongoReader: unexpected update %+v", upd)
+	}
+	del := rest.recvd[3].(*MongoChange)
+	if del.Operation != "delete" || del.Doc != nil || fmt.Sprint(del.Key["_id"]) != fmt.Sprint(rest.recvd[1].(*MongoChange).Key["_id"]) {
+		t.Errorf("MongoReader: unexpected delete %+v", del)
+	}
+}
+
+// Change streams storing tokens on checkpoints:
+// - After a crash, the reader resumes at the checkpoint
+func TestMongoWatchCheckpoint(t *testing.T) {
+	ms, err := newMongoServer()
+	if err != nil {
+		t.Fatalf("Mongo: cannot start server: %v", err)
+	}
+	defer ms.close()
+	st := conduit.NewMemStore()
+	newReader := func() *MongoReader {
+		return NewMongoWatch(ms.uri("secret"), "items").SetStore(st).StoreOnCheckpoint().SetMaxAwait(20 * time.Millisecond)
+	}
+
+	var items []interface{}
+	for i := 0; i < 400; i++ {
+		items = append(items, map[string]interface{}{"n": i})
+	}
+	cps := conduit.NewMemCheckpoints()
+	c := &StopConsumer{n: 300, err: errors.New("crash")}
+	mr := newReader()
+	err, werr := runMongoWatch(ms, mr, c, items, cps)
+	if err == nil || werr != nil {
+		t.Fatalf("MongoReader: chain did not crash (writer: %v)", werr)
+	}
+	mr.Cancel()
+	cp, _ := cps.Latest()
+	if cp == nil {
+		t.Fatalf("MongoReader: no checkpoint taken")
+	}
+	pos := int(cp.Position)
+	if pos > len(c.recvd) {
+		t.Fatalf("MongoReader: checkpoint at %d after %d changes", pos, len(c.recvd))
+	}
+
+	rest := &StopConsumer{n: 400 - pos, err: conduit.EOS}
+	if err := conduit.NewChain(newReader(), nil, rest, small).Run(); err != nil {
+		t.Fatalf("MongoReader: restarted chain failed: %v", err)
+	}
+	if err := checkMongoChanges(append(c.recvd[:pos], rest.recvd...), 0); err != nil || pos+len(rest.recvd) != 400 {
+		t.Errorf("MongoReader: after restart: %d changes: %v", pos+len(rest.recvd), err)
+	}
+}
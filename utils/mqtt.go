@@ -0,0 +1,851 @@
+package utils
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+// MQTT protocol versions
+const (
+	MQTTv311 = 4 // MQTT 3.1.1
+	MQTTv5   = 5 // MQTT 5
+)
+
+// MQTT packet types
+const (
+	mqttConnect     = 1
+	mqttConnack     = 2
+	mqttPublish     = 3
+	mqttPuback      = 4
+	mqttPubrec      = 5
+	mqttPubrel      = 6
+	mqttPubcomp     = 7
+	mqttSubscribe   = 8
+	mqttSuback      = 9
+	mqttPingreq     = 12
+	mqttPingresp    = 13
+	mqttDisconnect  = 14
+	mqttMaxRemain   = 268435455
+	mqttDefaultPort = "1883"
+)
+
+// MQTTMsg is an MQTT application message.
+type MQTTMsg struct {
+	Topic   string
+	Payload []byte
+	QoS     byte
+	Retain  bool
+}
+
+// Connection options common to MQTTSubscriber and MQTTPublisher
+type mqttOptions struct {
+	broker    string
+	clientID  string
+	user      string
+	pass      string
+	auth      bool
+	version   byte
+	keepAlive time.Duration
+	timeout   time.Duration
+	clean     bool
+	retry     RetryPolicy
+}
+
+func (o *mqttOptions) init(broker string) {
+	o.broker = broker
+	b := make([]byte, 8)
+	rand.Read(b)
+	o.clientID = "conduit-" + hex.EncodeToString(b)
+	o.version = MQTTv311
+	o.keepAlive = 60 * time.Second
+	o.timeout = 10 * time.Second
+	o.clean = true
+	o.retry = DefaultRetry
+}
+
+// Minimal MQTT client
+type mqttConn struct {
+	conn     net.Conn
+	rd       *bufio.Reader
+	v5       bool
+	timeout  time.Duration
+	wdoor    sync.Mutex
+	door     sync.Mutex
+	next     uint16
+	pending  map[uint16]chan []byte
+	inflight map[uint16]bool
+	msgs     chan *MQTTMsg
+	err      error
+	quit     chan struct{}
+	once     sync.Once
+	done     chan struct{}
+}
+
+// Appends a string with 2-byte length
+func mqttString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// Reads a string with 2-byte length
+func mqttReadString(b []byte) (string, []byte, error) {
+	if len(b) < 2 {
+		return "", nil, errors.New("mqtt: packet too short")
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n {
+		return "", nil, errors.New("mqtt: packet too short")
+	}
+	return string(b[2 : 2+n]), b[2+n:], nil
+}
+
+// Appends a variable byte integer
+func mqttVarint(b []byte, n int) []byte {
+	for {
+		d := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			d |= 0x80
+		}
+		b = append(b, d)
+		if n == 0 {
+			return b
+		}
+	}
+}
+
+// Decodes a variable byte integer
+func mqttReadVarint(next func() (byte, error)) (int, error) {
+	n, mul := 0, 1
+	for i := 0; i < 4; i++ {
+		d, err := next()
+		if err != nil {
+			return 0, err
+		}
+		n += int(d&0x7f) * mul
+		if d&0x80 == 0 {
+			return n, nil
+		}
+		mul *= 128
+	}
+	return 0, errors.New("mqtt: malformed length")
+}
+
+// Skips the properties of an MQTT 5 packet
+func mqttSkipProps(b []byte) ([]byte, error) {
+	i := 0
+	n, err := mqttReadVarint(func() (byte, error) {
+		if i >= len(b) {
+			return 0, errors.New("mqtt: packet too short")
+		}
+		i++
+		return b[i-1], nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < i+n {
+		return nil, errors.New("mqtt: packet too short")
+	}
+	return b[i+n:], nil
+}
+
+// Connects to the broker (tcp://[user:password@]host[:port])
+// and starts reading
+func dialMQTT(o *mqttOptions) (*mqttConn, error) {
+	addr := o.broker
+	if !strings.Contains(addr, "://") {
+		addr = "tcp://" + addr
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), mqttDefaultPort)
+	}
+	user, pass, auth := o.user, o.pass, o.auth
+	if u.User != nil && !auth {
+		user = u.User.Username()
+		pass, _ = u.User.Password()
+		auth = true
+	}
+	conn, err := net.DialTimeout("tcp", host, o.timeout)
+	if err != nil {
+		return nil, err
+	}
+	mc := &mqttConn{
+		conn:     conn,
+		rd:       bufio.NewReader(conn),
+		v5:       o.version == MQTTv5,
+		timeout:  o.timeout,
+		pending:  make(map[uint16]chan []byte),
+		inflight: make(map[uint16]bool),
+		msgs:     make(chan *MQTTMsg, 256),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	conn.SetDeadline(time.Now().Add(o.timeout))
+	err = mc.connect(o, user, pass, auth)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	go mc.read()
+	if o.keepAlive > 0 {
+		go mc.ping(o.keepAlive)
+	}
+	return mc, nil
+}
+
+// Sends CONNECT and waits for CONNACK
+func (mc *mqttConn) connect(o *mqttOptions, user, pass string, auth bool) error {
+	var flags byte
+	if o.clean {
+		flags |= 0x02
+	}
+	if auth {
+		flags |= 0x80
+		if pass != "" {
+			flags |= 0x40
+		}
+	}
+	b := mqttString(nil, "MQTT")
+	b = append(b, o.version, flags)
+	b = binary.BigEndian.AppendUint16(b, uint16(o.keepAlive/time.Second))
+	if mc.v5 {
+		b = append(b, 0)
+	}
+	b = mqttString(b, o.clientID)
+	if auth {
+		b = mqttString(b, user)
+		if pass != "" {
+			b = mqttString(b, pass)
+		}
+	}
+	err := mc.send(mqttConnect<<4, b)
+	if err != nil {
+		return err
+	}
+	typ, body, err := mc.readPacket()
+	if err != nil {
+		return err
+	}
+	if typ>>4 != mqttConnack || len(body) < 2 {
+		return errors.New(fmt.Sprintf("mqtt: unexpected packet %d", typ>>4))
+	}
+	if body[1] != 0 {
+		return errors.New(fmt.Sprintf("mqtt: connection refused (%d)", body[1]))
+	}
+	return nil
+}
+
+// Writes a packet
+func (mc *mqttConn) send(typ byte, body []byte) error {
+	if len(body) > mqttMaxRemain {
+		return errors.New(fmt.Sprintf("mqtt: packet of %d bytes too large", len(body)))
+	}
+	b := mqttVarint([]byte{typ}, len(body))
+	mc.wdoor.Lock()
+	defer mc.wdoor.Unlock()
+	_, err := mc.conn.Write(append(b, body...))
+	return err
+}
+
+// Reads a packet: the first byte and the remaining bytes
+func (mc *mqttConn) readPacket() (byte, []byte, error) {
+	typ, err := mc.rd.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, err := mqttReadVarint(mc.rd.ReadByte)
+	if err != nil {
+		return 0, nil, err
+	}
+	body := make([]byte, n)
+	_, err = io.ReadFull(mc.rd, body)
+	return typ, body, err
+}
+
+// Sends a packet with a packet identifier only
+func (mc *mqttConn) sendID(typ byte, id uint16) error {
+	return mc.send(typ, binary.BigEndian.AppendUint16(nil, id))
+}
+
+// Sends PINGREQ until the connection is closed
+func (mc *mqttConn) ping(keepAlive time.Duration) {
+	t := time.NewTicker(keepAlive / 2)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if mc.send(mqttPingreq<<4, nil) != nil {
+				return
+			}
+		case <-mc.quit:
+			return
+		}
+	}
+}
+
+// Handles incoming packets until the connection is closed
+func (mc *mqttConn) read() {
+	var err error
+	defer func() {
+		mc.door.Lock()
+		if mc.err == nil {
+			mc.err = err
+		}
+		for id, c := range mc.pending {
+			delete(mc.pending, id)
+			close(c)
+		}
+		mc.door.Unlock()
+		mc.once.Do(func() { close(mc.quit) })
+		mc.conn.Close()
+		close(mc.msgs)
+		close(mc.done)
+	}()
+	for {
+		var typ byte
+		var body []byte
+		typ, body, err = mc.readPacket()
+		if err != nil {
+			return
+		}
+		switch typ >> 4 {
+		case mqttPublish:
+			err = mc.receive(typ, body)
+		case mqttPubrel:
+			if len(body) >= 2 {
+				id := binary.BigEndian.Uint16(body)
+				mc.door.Lock()
+				delete(mc.inflight, id)
+				mc.door.Unlock()
+				err = mc.sendID(mqttPubcomp<<4, id)
+			}
+		case mqttPubrec:
+			// QoS 2 publication: release it and wait for PUBCOMP
+			if len(body) >= 2 {
+				err = mc.sendID(mqttPubrel<<4|0x02, binary.BigEndian.Uint16(body))
+			}
+		case mqttPuback, mqttPubcomp, mqttSuback:
+			if len(body) >= 2 {
+				mc.acknowledged(binary.BigEndian.Uint16(body), body[2:])
+			}
+		case mqttDisconnect:
+			err = errors.New("mqtt: disconnected by broker")
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Handles an incoming PUBLISH
+func (mc *mqttConn) receive(typ byte, body []byte) error {
+	msg := &MQTTMsg{QoS: (typ >> 1) & 0x03, Retain: typ&0x01 != 0}
+	var err error
+	msg.Topic, body, err = mqttReadString(body)
+	if err != nil {
+		return err
+	}
+	var id uint16
+	if msg.QoS > 0 {
+		if len(body) < 2 {
+			return errors.New("mqtt: packet too short")
+		}
+		id = binary.BigEndian.Uint16(body)
+		body = body[2:]
+	}
+	if mc.v5 {
+		body, err = mqttSkipProps(body)
+		if err != nil {
+			return err
+		}
+	}
+	msg.Payload = body
+	switch msg.QoS {
+	case 0:
+		mc.deliver(msg)
+	case 1:
+		mc.deliver(msg)
+		return mc.sendID(mqttPuback<<4, id)
+	default:
+		// exactly once: deliver only the first copy until released
+		mc.door.Lock()
+		dup := mc.inflight[id]
+		mc.inflight[id] = true
+		mc.door.Unlock()
+		if !dup {
+			mc.deliver(msg)
+		}
+		return mc.sendID(mqttPubrec<<4, id)
+	}
+	return nil
+}
+
+// Delivers msg to the reader; blocks until it is taken
+// or the connection is closed
+func (mc *mqttConn) deliver(msg *MQTTMsg) {
+	select {
+	case mc.msgs <- msg:
+	case <-mc.quit:
+	}
+}
+
+// Passes an acknowledgment to the waiting sender
+func (mc *mqttConn) acknowledged(id uint16, rest []byte) {
+	mc.door.Lock()
+	c, ok := mc.pending[id]
+	delete(mc.pending, id)
+	mc.door.Unlock()
+	if ok {
+		c <- rest
+	}
+}
+
+// Allocates a packet identifier and registers its acknowledgment
+func (mc *mqttConn) register() (uint16, chan []byte) {
+	mc.door.Lock()
+	defer mc.door.Unlock()
+	for {
+		mc.next++
+		if mc.next == 0 {
+			continue
+		}
+		if _, ok := mc.pending[mc.next]; !ok {
+			break
+		}
+	}
+	c := make(chan []byte, 1)
+	mc.pending[mc.next] = c
+	return mc.next, c
+}
+
+// Waits for the acknowledgment of id
+func (mc *mqttConn) await(id uint16, c chan []byte) ([]byte, error) {
+	t := time.NewTimer(mc.timeout)
+	defer t.Stop()
+	select {
+	case rest, ok := <-c:
+		if !ok {
+			return nil, mc.failed()
+		}
+		return rest, nil
+	case <-t.C:
+		mc.door.Lock()
+		delete(mc.pending, id)
+		mc.door.Unlock()
+		return nil, errors.New("mqtt: acknowledgment timed out")
+	}
+}
+
+// Subscribes to topics and waits for SUBACK
+func (mc *mqttConn) subscribe(topics []string, qos byte) error {
+	id, c := mc.register()
+	b := binary.BigEndian.AppendUint16(nil, id)
+	if mc.v5 {
+		b = append(b, 0)
+	}
+	for _, t := range topics {
+		b = mqttString(b, t)
+		b = append(b, qos)
+	}
+	err := mc.send(mqttSubscribe<<4|0x02, b)
+	if err != nil {
+		return err
+	}
+	rest, err := mc.await(id, c)
+	if err != nil {
+		return err
+	}
+	if mc.v5 {
+		rest, err = mqttSkipProps(rest)
+		if err != nil {
+			return err
+		}
+	}
+	for i, code := range rest {
+		if code >= 0x80 && i < len(topics) {
+			return errors.New(fmt.Sprintf("mqtt: subscription to %s refused (%d)", topics[i], code))
+		}
+	}
+	return nil
+}
+
+// Publishes a message and, with QoS 1 and 2,
+// waits for its acknowledgment
+func (mc *mqttConn) publish(msg *MQTTMsg) error {
+	typ := byte(mqttPublish<<4) | msg.QoS<<1
+	if msg.Retain {
+		typ |= 0x01
+	}
+	b := mqttString(nil, msg.Topic)
+	var id uint16
+	var c chan []byte
+	if msg.QoS > 0 {
+		id, c = mc.register()
+		b = binary.BigEndian.AppendUint16(b, id)
+	}
+	if mc.v5 {
+		b = append(b, 0)
+	}
+	err := mc.send(typ, append(b, msg.Payload...))
+	if err != nil || msg.QoS == 0 {
+		return err
+	}
+	rest, err := mc.await(id, c)
+	if err != nil {
+		return err
+	}
+	if mc.v5 && len(rest) > 0 && rest[0] >= 0x80 {
+		return errors.New(fmt.Sprintf("mqtt: publication refused (%d)", rest[0]))
+	}
+	return nil
+}
+
+// The error that closed the connection
+func (mc *mqttConn) failed() error {
+	mc.door.Lock()
+	defer mc.door.Unlock()
+	if mc.err == nil {
+		return errors.New("mqtt: connection closed")
+	}
+	return mc.err
+}
+
+// Disconnects gracefully
+func (mc *mqttConn) disconnect() {
+	mc.send(mqttDisconnect<<4, nil)
+	mc.close()
+}
+
+func (mc *mqttConn) close() {
+	mc.door.Lock()
+	if mc.err == nil {
+		mc.err = errors.New("mqtt: connection closed")
+	}
+	mc.door.Unlock()
+	mc.once.Do(func() { close(mc.quit) })
+	mc.conn.Close()
+	<-mc.done
+}
+
+// MQTTSubscriber is a Producer that subscribes to MQTT topics
+// (which may contain the wildcards + and #) and sends
+// the messages as *MQTTMsg down the chain.
+// Messages are acknowledged when they are received.
+// When the connection is lost, MQTTSubscriber reconnects
+// and subscribes again according to the RetryPolicy (DefaultRetry);
+// with a persistent session (see SetCleanSession), the broker
+// keeps QoS 1 and 2 messages for the subscriber in the meantime.
+// The producer runs until the chain is canceled
+// or terminates with an error when it cannot reconnect.
+type MQTTSubscriber struct {
+	conduit.Cancelable
+	mqttOptions
+	topics []string
+	qos    byte
+	door   sync.Mutex
+	mc     *mqttConn
+}
+
+// NewMQTTSubscriber creates a new MQTTSubscriber Producer
+// connecting to broker (tcp://[user:password@]host[:port]).
+func NewMQTTSubscriber(broker string, topics ...string) (ms *MQTTSubscriber) {
+	if len(topics) == 0 {
+		return nil
+	}
+	ms = new(MQTTSubscriber)
+	if ms != nil {
+		ms.init(broker)
+		ms.topics = topics
+	}
+	return
+}
+
+// SetQoS sets the maximum quality of service (0, 1 or 2; default 0).
+func (ms *MQTTSubscriber) SetQoS(qos byte) *MQTTSubscriber {
+	if qos <= 2 {
+		ms.qos = qos
+	}
+	return ms
+}
+
+// SetClientID sets the client identifier (default: random).
+func (ms *MQTTSubscriber) SetClientID(id string) *MQTTSubscriber {
+	ms.clientID = id
+	return ms
+}
+
+// SetAuth sets user name and password.
+func (ms *MQTTSubscriber) SetAuth(user, pass string) *MQTTSubscriber {
+	ms.user, ms.pass, ms.auth = user, pass, true
+	return ms
+}
+
+// SetVersion sets the protocol version
+// (MQTTv311, the default, or MQTTv5).
+func (ms *MQTTSubscriber) SetVersion(v byte) *MQTTSubscriber {
+	if v == MQTTv311 || v == MQTTv5 {
+		ms.version = v
+	}
+	return ms
+}
+
+// SetCleanSession sets whether the broker discards the session
+// when the client disconnects (default true).
+// Persistent sessions need a fixed client identifier.
+func (ms *MQTTSubscriber) SetCleanSession(clean bool) *MQTTSubscriber {
+	ms.clean = clean
+	return ms
+}
+
+// SetKeepAlive sets the keep alive interval (default 60s).
+func (ms *MQTTSubscriber) SetKeepAlive(d time.Duration) *MQTTSubscriber {
+	ms.keepAlive = d
+	return ms
+}
+
+// SetTimeout sets the timeout for connecting
+// and acknowledgments (default 10s).
+func (ms *MQTTSubscriber) SetTimeout(d time.Duration) *MQTTSubscriber {
+	ms.timeout = d
+	return ms
+}
+
+// SetRetry sets the RetryPolicy for reconnecting;
+// Attempts is the number of consecutive failures
+// after which the producer gives up.
+func (ms *MQTTSubscriber) SetRetry(rp RetryPolicy) *MQTTSubscriber {
+	ms.retry = rp
+	return ms
+}
+
+// Cancel cancels the producer and closes the connection.
+func (ms *MQTTSubscriber) Cancel() {
+	ms.Cancelable.Cancel()
+	ms.door.Lock()
+	defer ms.door.Unlock()
+	if ms.mc != nil {
+		ms.mc.conn.Close()
+	}
+}
+
+// Resume is the pre-defined method that makes MQTTSubscriber
+// a conduit.Resumer. Messages received before a restart
+// are not delivered again (they were acknowledged on receipt),
+// so nothing is skipped.
+func (ms *MQTTSubscriber) Resume(pos uint64) error {
+	return nil
+}
+
+// Produce is the pre-defined method that makes MQTTSubscriber a Producer.
+func (ms *MQTTSubscriber) Produce(trg conduit.Target) error {
+	failures := 0
+	for !ms.Canceled() {
+		err := ms.session(trg, &failures)
+		if ms.Canceled() {
+			break
+		}
+		failures++
+		if failures >= ms.retry.Attempts {
+			return errors.New(fmt.Sprintf("connection failed after %d attempts: %v", failures, err))
+		}
+		if ms.retry.Backoff != nil {
+			sleep(ms.retry.Backoff(failures), ms.Canceled)
+		}
+	}
+	return nil
+}
+
+// Connects, subscribes and sends the messages down the chain
+// until the connection is lost
+func (ms *MQTTSubscriber) session(trg conduit.Target, failures *int) error {
+	mc, err := dialMQTT(&ms.mqttOptions)
+	if err != nil {
+		return err
+	}
+	ms.door.Lock()
+	ms.mc = mc
+	ms.door.Unlock()
+	defer mc.disconnect()
+	if ms.Canceled() {
+		return nil
+	}
+	err = mc.subscribe(ms.topics, ms.qos)
+	if err != nil {
+		return err
+	}
+	*failures = 0
+	for msg := range mc.msgs {
+		trg <- msg
+	}
+	return mc.failed()
+}
+
+// MQTTPublisher is a Consumer that publishes the incoming items
+// to an MQTT broker. The topic is a template (see Template)
+// rendered with the item. *MQTTMsg items are published
+// as they are, []byte and string items as payload,
+// others are encoded with a MarshalFunc (default: json.Marshal).
+// With QoS 1 and 2, the acknowledgment of the broker is awaited.
+// When publishing fails, MQTTPublisher reconnects and publishes
+// the message again according to the RetryPolicy (DefaultRetry).
+type MQTTPublisher struct {
+	mqttOptions
+	topic   Template
+	qos     byte
+	retain  bool
+	marshal MarshalFunc
+	mc      *mqttConn
+}
+
+// NewMQTTPublisher creates a new MQTTPublisher Consumer
+// connecting to broker (see NewMQTTSubscriber).
+func NewMQTTPublisher(broker string, topic Template) (mp *MQTTPublisher) {
+	if topic == nil {
+		return nil
+	}
+	mp = new(MQTTPublisher)
+	if mp != nil {
+		mp.init(broker)
+		mp.topic = topic
+		mp.marshal = json.Marshal
+	}
+	return
+}
+
+// SetQoS sets the quality of service (0, 1 or 2; default 0).
+func (mp *MQTTPublisher) SetQoS(qos byte) *MQTTPublisher {
+	if qos <= 2 {
+		mp.qos = qos
+	}
+	return mp
+}
+
+// Retain asks the broker to keep the last message of each topic
+// for future subscribers.
+func (mp *MQTTPublisher) Retain() *MQTTPublisher {
+	mp.retain = true
+	return mp
+}
+
+// SetMarshal sets the MarshalFunc for items
+// that are neither []byte nor string.
+func (mp *MQTTPublisher) SetMarshal(marshal MarshalFunc) *MQTTPublisher {
+	mp.marshal = marshal
+	return mp
+}
+
+// SetClientID sets the client identifier (default: random).
+func (mp *MQTTPublisher) SetClientID(id string) *MQTTPublisher {
+	mp.clientID = id
+	return mp
+}
+
+// SetAuth sets user name and password.
+func (mp *MQTTPublisher) SetAuth(user, pass string) *MQTTPublisher {
+	mp.user, mp.pass, mp.auth = user, pass, true
+	return mp
+}
+
+// SetVersion sets the protocol version
+// (MQTTv311, the default, or MQTTv5).
+func (mp *MQTTPublisher) SetVersion(v byte) *MQTTPublisher {
+	if v == MQTTv311 || v == MQTTv5 {
+		mp.version = v
+	}
+	return mp
+}
+
+// SetKeepAlive sets the keep alive interval (default 60s).
+func (mp *MQTTPublisher) SetKeepAlive(d time.Duration) *MQTTPublisher {
+	mp.keepAlive = d
+	return mp
+}
+
+// SetTimeout sets the timeout for connecting
+// and acknowledgments (default 10s).
+func (mp *MQTTPublisher) SetTimeout(d time.Duration) *MQTTPublisher {
+	mp.timeout = d
+	return mp
+}
+
+// SetRetry sets the RetryPolicy (default: DefaultRetry).
+func (mp *MQTTPublisher) SetRetry(rp RetryPolicy) *MQTTPublisher {
+	mp.retry = rp
+	return mp
+}
+
+// Consume is the pre-defined method that makes MQTTPublisher a Consumer.
+// Consume terminates with an error if an item cannot be encoded
+// or published after all attempts.
+func (mp *MQTTPublisher) Consume(src conduit.Source) error {
+	defer func() {
+		if mp.mc != nil {
+			mp.mc.disconnect()
+			mp.mc = nil
+		}
+	}()
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			continue
+		}
+		msg, err := mp.message(inp)
+		if err != nil {
+			return err
+		}
+		attempts, err := mp.retry.run(nil, func() (bool, error) {
+			if mp.mc == nil {
+				mc, err := dialMQTT(&mp.mqttOptions)
+				if err != nil {
+					return true, err
+				}
+				mp.mc = mc
+			}
+			err := mp.mc.publish(msg)
+			if err != nil {
+				mp.mc.close()
+				mp.mc = nil
+			}
+			return true, err
+		})
+		if err != nil {
+			return errors.New(fmt.Sprintf("publish failed after %d attempts: %v", attempts, err))
+		}
+	}
+	return nil
+}
+
+// Creates the message for an item
+func (mp *MQTTPublisher) message(inp interface{}) (*MQTTMsg, error) {
+	if msg, ok := inp.(*MQTTMsg); ok {
+		return msg, nil
+	}
+	topic, err := render(mp.topic, inp)
+	if err != nil {
+		return nil, err
+	}
+	data, err := payload(inp, mp.marshal)
+	if err != nil {
+		return nil, err
+	}
+	return &MQTTMsg{Topic: topic, Payload: data, QoS: mp.qos, Retain: mp.retain}, nil
+}
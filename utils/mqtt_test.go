@@ -0,0 +1,410 @@
+package utils
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+// MQTT test broker: QoS 0, 1 and 2, retained messages,
+// MQTT 3.1.1 and 5 (without properties)
+type mqttBroker struct {
+	ln         net.Listener
+	door       sync.Mutex
+	conns      map[*mqttClient]bool
+	retained   map[string]*MQTTMsg
+	subscribes int
+	acks       int
+}
+
+type mqttClient struct {
+	door sync.Mutex
+	conn net.Conn
+	v5   bool
+	subs map[string]byte
+	next uint16
+}
+
+func (cl *mqttClient) send(typ byte, body []byte) {
+	cl.door.Lock()
+	defer cl.door.Unlock()
+	cl.conn.Write(append(mqttVarint([]byte{typ}, len(body)), body...))
+}
+
+func (cl *mqttClient) sendID(typ byte, id uint16) {
+	cl.send(typ, binary.BigEndian.AppendUint16(nil, id))
+}
+
+func (cl *mqttClient) publish(msg *MQTTMsg, retained bool) {
+	typ := byte(mqttPublish<<4) | msg.QoS<<1
+	if retained {
+		typ |= 0x01
+	}
+	b := mqttString(nil, msg.Topic)
+	if msg.QoS > 0 {
+		cl.door.Lock()
+		cl.next++
+		b = binary.BigEndian.AppendUint16(b, cl.next)
+		cl.door.Unlock()
+	}
+	if cl.v5 {
+		b = append(b, 0)
+	}
+	cl.send(typ, append(b, msg.Payload...))
+}
+
+func newMQTTBroker() (*mqttBroker, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	mb := &mqttBroker{
+		ln:       ln,
+		conns:    make(map[*mqttClient]bool),
+		retained: make(map[string]*MQTTMsg),
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go mb.serve(conn)
+		}
+	}()
+	return mb, nil
+}
+
+func (mb *mqttBroker) url() string {
+	return "tcp://" + mb.ln.Addr().String()
+}
+
+func (mb *mqttBroker) close() {
+	mb.ln.Close()
+	mb.kick()
+}
+
+// Drops all connections
+func (mb *mqttBroker) kick() {
+	mb.door.Lock()
+	defer mb.door.Unlock()
+	for cl := range mb.conns {
+		cl.conn.Close()
+	}
+}
+
+// Number of SUBSCRIBE packets received
+func (mb *mqttBroker) subscribed() int {
+	mb.door.Lock()
+	defer mb.door.Unlock()
+	return mb.subscribes
+}
+
+// Number of PUBACK packets received
+func (mb *mqttBroker) acked() int {
+	mb.door.Lock()
+	defer mb.door.Unlock()
+	return mb.acks
+}
+
+// Topic matching with + and #
+func mqttMatch(filter, topic string) bool {
+	f := strings.Split(filter, "/")
+	s := strings.Split(topic, "/")
+	for i, tok := range f {
+		if tok == "#" {
+			return true
+		}
+		if i >= len(s) || (tok != "+" && tok != s[i]) {
+			return false
+		}
+	}
+	return len(f) == len(s)
+}
+
+func (mb *mqttBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	cl := &mqttClient{conn: conn, subs: make(map[string]byte)}
+	defer func() {
+		mb.door.Lock()
+		delete(mb.conns, cl)
+		mb.door.Unlock()
+	}()
+	for {
+		typ, err := rd.ReadByte()
+		if err != nil {
+			return
+		}
+		n, err := mqttReadVarint(rd.ReadByte)
+		if err != nil {
+			return
+		}
+		body := make([]byte, n)
+		if _, err = io.ReadFull(rd, body); err != nil {
+			return
+		}
+		switch typ >> 4 {
+		case mqttConnect:
+			_, rest, _ := mqttReadString(body)
+			cl.v5 = rest[0] == MQTTv5
+			mb.door.Lock()
+			mb.conns[cl] = true
+			mb.door.Unlock()
+			if cl.v5 {
+				cl.send(mqttConnack<<4, []byte{0, 0, 0})
+			} else {
+				cl.send(mqttConnack<<4, []byte{0, 0})
+			}
+		case mqttSubscribe:
+			mb.subscribe(cl, body)
+		case mqttPublish:
+			mb.publish(cl, typ, body)
+		case mqttPuback:
+			mb.door.Lock()
+			mb.acks++
+			mb.door.Unlock()
+		case mqttPubrel:
+			cl.sendID(mqttPubcomp<<4, binary.BigEndian.Uint16(body))
+		case mqttPubrec:
+			cl.sendID(mqttPubrel<<4|0x02, binary.BigEndian.Uint16(body))
+		case mqttPingreq:
+			cl.send(mqttPingresp<<4, nil)
+		case mqttDisconnect:
+			return
+		}
+	}
+}
+
+func (mb *mqttBroker) subscribe(cl *mqttClient, body []byte) {
+	id := binary.BigEndian.Uint16(body)
+	rest := body[2:]
+	if cl.v5 {
+		rest, _ = mqttSkipProps(rest)
+	}
+	var codes []byte
+	var filters []string
+	for len(rest) > 0 {
+		var filter string
+		filter, rest, _ = mqttReadString(rest)
+		qos := rest[0] & 0x03
+		rest = rest[1:]
+		mb.door.Lock()
+		cl.subs[filter] = qos
+		mb.door.Unlock()
+		filters = append(filters, filter)
+		codes = append(codes, qos)
+	}
+	b := binary.BigEndian.AppendUint16(nil, id)
+	if cl.v5 {
+		b = append(b, 0)
+	}
+	cl.send(mqttSuback<<4, append(b, codes...))
+
+	mb.door.Lock()
+	mb.subscribes++
+	var msgs []*MQTTMsg
+	for _, f := range filters {
+		for topic, msg := range mb.retained {
+			if mqttMatch(f, topic) {
+				m := *msg
+				m.QoS = min(m.QoS, cl.subs[f])
+				msgs = append(msgs, &m)
+			}
+		}
+	}
+	mb.door.Unlock()
+	for _, m := range msgs {
+		cl.publish(m, true)
+	}
+}
+
+func (mb *mqttBroker) publish(cl *mqttClient, typ byte, body []byte) {
+	msg := &MQTTMsg{QoS: (typ >> 1) & 0x03, Retain: typ&0x01 != 0}
+	msg.Topic, body, _ = mqttReadString(body)
+	var id uint16
+	if msg.QoS > 0 {
+		id = binary.BigEndian.Uint16(body)
+		body = body[2:]
+	}
+	if cl.v5 {
+		body, _ = mqttSkipProps(body)
+	}
+	msg.Payload = body
+
+	type delivery struct {
+		cl  *mqttClient
+		qos byte
+	}
+	var ds []delivery
+	mb.door.Lock()
+	if msg.Retain {
+		mb.retained[msg.Topic] = msg
+	}
+	for c := range mb.conns {
+		for f, qos := range c.subs {
+			if mqttMatch(f, msg.Topic) {
+				ds = append(ds, delivery{c, min(qos, msg.QoS)})
+				break
+			}
+		}
+	}
+	mb.door.Unlock()
+	for _, d := range ds {
+		m := *msg
+		m.QoS = d.qos
+		d.cl.publish(&m, false)
+	}
+
+	switch msg.QoS {
+	case 1:
+		cl.sendID(mqttPuback<<4, id)
+	case 2:
+		cl.sendID(mqttPubrec<<4, id)
+	}
+}
+
+func mqttPayloads(items []interface{}) []string {
+	var data []string
+	for _, inp := range items {
+		data = append(data, string(inp.(*MQTTMsg).Payload))
+	}
+	return data
+}
+
+// MQTT publish/subscribe:
+// - Items are published to the topic rendered from the item
+// - Subscribers receive the messages matching their filter
+// - Retained messages are delivered to new subscribers
+// - QoS levels 0, 1 and 2 with MQTT 3.1.1 and MQTT 5
+func TestMQTTPubSub(t *testing.T) {
+	for _, v := range []byte{MQTTv311, MQTTv5} {
+		for qos := byte(0); qos <= 2; qos++ {
+			err := testMQTTPubSub(v, qos)
+			if err != nil {
+				m := fmt.Sprintf("MQTTPubSub failed (version %d, QoS %d): %v", v, qos, err)
+				t.Error(m)
+			}
+		}
+	}
+}
+
+func testMQTTPubSub(v, qos byte) error {
+	mb, err := newMQTTBroker()
+	if err != nil {
+		return err
+	}
+	defer mb.close()
+
+	topic := template.Must(template.New("topic").Parse("sensors/{{.room}}/temp"))
+	retained := []interface{}{map[string]interface{}{"room": "attic", "t": 30}}
+	chn := conduit.NewChain(&AnyProducer{retained}, nil,
+		NewMQTTPublisher(mb.url(), topic).SetVersion(v).SetQoS(qos).Retain(), small)
+	if err := chn.Run(); err != nil {
+		return errors.New(fmt.Sprintf("cannot publish retained message: %v", chn.Errs))
+	}
+
+	c := &TakeConsumer{n: 4}
+	done := make(chan error)
+	go func() {
+		ms := NewMQTTSubscriber(mb.url(), "sensors/+/temp").SetVersion(v).SetQoS(qos)
+		done <- conduit.NewChain(ms, nil, c, small).Run()
+	}()
+	for mb.subscribed() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	items := []interface{}{
+		map[string]interface{}{"room": "kitchen", "t": 21},
+		map[string]interface{}{"room": "garage", "t": 12},
+		map[string]interface{}{"room": "kitchen", "t": 22},
+	}
+	chn = conduit.NewChain(&AnyProducer{items}, nil, NewMQTTPublisher(mb.url(), topic).SetVersion(v).SetQoS(qos), small)
+	if err := chn.Run(); err != nil {
+		return errors.New(fmt.Sprintf("MQTTPublisher failed: %v", chn.Errs))
+	}
+	select {
+	case err = <-done:
+	case <-time.After(5 * time.Second):
+		return errors.New("messages not received")
+	}
+	if err != nil {
+		return err
+	}
+	want := `[{"room":"attic","t":30} {"room":"kitchen","t":21} {"room":"garage","t":12} {"room":"kitchen","t":22}]`
+	if fmt.Sprint(mqttPayloads(c.recvd)) != want {
+		return errors.New(fmt.Sprintf("expected %s, have %s", want, mqttPayloads(c.recvd)))
+	}
+	first := c.recvd[0].(*MQTTMsg)
+	if !first.Retain || first.QoS != qos || first.Topic != "sensors/attic/temp" {
+		return errors.New(fmt.Sprintf("unexpected retained message %+v", first))
+	}
+	if c.recvd[2].(*MQTTMsg).Topic != "sensors/garage/temp" || c.recvd[2].(*MQTTMsg).Retain {
+		return errors.New(fmt.Sprintf("unexpected message %+v", c.recvd[2]))
+	}
+	return nil
+}
+
+// MQTT reconnect:
+// - The subscriber reconnects and subscribes again after a lost connection
+// - The publisher reports connection failures
+func TestMQTTReconnect(t *testing.T) {
+	mb, err := newMQTTBroker()
+	if err != nil {
+		t.Fatalf("MQTT: cannot start broker: %v", err)
+	}
+	defer mb.close()
+
+	c := &TakeConsumer{n: 2}
+	done := make(chan error)
+	go func() {
+		ms := NewMQTTSubscriber(mb.url(), "alerts/#").SetQoS(1).SetRetry(slowRetry)
+		done <- conduit.NewChain(ms, nil, c, small).Run()
+	}()
+	topic := template.Must(template.New("topic").Parse("alerts/{{.}}"))
+	for i, alert := range []string{"fire", "flood"} {
+		for mb.subscribed() <= i {
+			time.Sleep(time.Millisecond)
+		}
+		chn := conduit.NewChain(&AnyProducer{[]interface{}{alert}}, nil, NewMQTTPublisher(mb.url(), topic).SetQoS(1), small)
+		if err := chn.Run(); err != nil {
+			t.Fatalf("MQTTPublisher failed: %v", chn.Errs)
+		}
+		if i == 0 {
+			for mb.acked() == 0 {
+				time.Sleep(time.Millisecond)
+			}
+			mb.kick()
+		}
+	}
+	select {
+	case err = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("MQTTSubscriber: messages not received after reconnect")
+	}
+	if err != nil {
+		t.Fatalf("MQTTSubscriber failed: %v", err)
+	}
+	if fmt.Sprint(mqttPayloads(c.recvd)) != "[fire flood]" {
+		t.Errorf("MQTTSubscriber: unexpected messages %s", mqttPayloads(c.recvd))
+	}
+	if c.recvd[1].(*MQTTMsg).Topic != "alerts/flood" {
+		t.Errorf("MQTTSubscriber: unexpected topic %s", c.recvd[1].(*MQTTMsg).Topic)
+	}
+
+	chn := conduit.NewChain(&AnyProducer{[]interface{}{"smoke"}}, nil,
+		NewMQTTPublisher("127.0.0.1:1", topic).SetRetry(fastRetry).SetTimeout(time.Second), small)
+	if chn.Run() == nil {
+		t.Errorf("MQTTPublisher: connection failure not reported")
+	}
+}
@@ -0,0 +1,465 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+// MarshalMsgpack encodes v as MessagePack.
+// It is a MarshalFunc for use with Encoder and MsgpackWriter.
+// Supported are nil, bool, integers, floats, strings, []byte,
+// time.Time (as timestamp extension), slices, arrays, maps
+// and structs, which are encoded as maps of their exported fields
+// (named by their json tag, if any). Map keys are sorted.
+func MarshalMsgpack(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := writeMsgpack(&buf, reflect.ValueOf(v))
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalMsgpack decodes MessagePack data into the value v points to.
+// It is an UnmarshalFunc for use with Decoder and MsgpackReader.
+// Decoded into interface{}, values are represented as nil, bool,
+// int64, uint64, float32, float64, string, []byte, time.Time,
+// []interface{} and map[string]interface{}; other targets
+// are filled following the rules of encoding/json.
+func UnmarshalMsgpack(data []byte, v interface{}) error {
+	x, err := readMsgpack(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	return assignValue(x, v)
+}
+
+func writeMsgpack(buf *bytes.Buffer, v reflect.Value) error {
+	if !v.IsValid() {
+		buf.WriteByte(0xc0)
+		return nil
+	}
+	if t, ok := v.Interface().(time.Time); ok {
+		// timestamp 96
+		buf.Write([]byte{0xc7, 12, 0xff})
+		binary.Write(buf, binary.BigEndian, uint32(t.Nanosecond()))
+		binary.Write(buf, binary.BigEndian, t.Unix())
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			buf.WriteByte(0xc0)
+			return nil
+		}
+		return writeMsgpack(buf, v.Elem())
+	case reflect.Bool:
+		if v.Bool() {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n := v.Int()
+		switch {
+		case n >= 0:
+			writeMsgpackUint(buf, uint64(n))
+		case n >= -32:
+			buf.WriteByte(byte(n))
+		case n >= math.MinInt8:
+			buf.Write([]byte{0xd0, byte(n)})
+		case n >= math.MinInt16:
+			buf.WriteByte(0xd1)
+			binary.Write(buf, binary.BigEndian, int16(n))
+		case n >= math.MinInt32:
+			buf.WriteByte(0xd2)
+			binary.Write(buf, binary.BigEndian, int32(n))
+		default:
+			buf.WriteByte(0xd3)
+			binary.Write(buf, binary.BigEndian, n)
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		writeMsgpackUint(buf, v.Uint())
+	case reflect.Float32:
+		buf.WriteByte(0xca)
+		binary.Write(buf, binary.BigEndian, float32(v.Float()))
+	case reflect.Float64:
+		buf.WriteByte(0xcb)
+		binary.Write(buf, binary.BigEndian, v.Float())
+	case reflect.String:
+		writeMsgpackHead(buf, 0xa0, 31, 0xd9, 0xda, 0xdb, v.Len())
+		buf.WriteString(v.String())
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			buf.WriteByte(0xc0)
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			writeMsgpackHead(buf, 0, -1, 0xc4, 0xc5, 0xc6, v.Len())
+			b := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(b), v)
+			buf.Write(b)
+			return nil
+		}
+		writeMsgpackHead(buf, 0x90, 15, 0, 0xdc, 0xdd, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			err := writeMsgpack(buf, v.Index(i))
+			if err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if v.IsNil() {
+			buf.WriteByte(0xc0)
+			return nil
+		}
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool {
+			return fmt.Sprint(keys[i].Interface()) < fmt.Sprint(keys[j].Interface())
+		})
+		writeMsgpackHead(buf, 0x80, 15, 0, 0xde, 0xdf, len(keys))
+		for _, k := range keys {
+			err := writeMsgpack(buf, k)
+			if err != nil {
+				return err
+			}
+			err = writeMsgpack(buf, v.MapIndex(k))
+			if err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		t := v.Type()
+		var names []string
+		var fields []reflect.Value
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			name := f.Name
+			if tag := f.Tag.Get("json"); tag != "" {
+				if tag == "-" {
+					continue
+				}
+				if j := bytes.IndexByte([]byte(tag), ','); j >= 0 {
+					tag = tag[:j]
+				}
+				if tag != "" {
+					name = tag
+				}
+			}
+			names = append(names, name)
+			fields = append(fields, v.Field(i))
+		}
+		writeMsgpackHead(buf, 0x80, 15, 0, 0xde, 0xdf, len(names))
+		for i := range names {
+			writeMsgpack(buf, reflect.ValueOf(names[i]))
+			err := writeMsgpack(buf, fields[i])
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		return errors.New(fmt.Sprintf("cannot encode %s as MessagePack", v.Type()))
+	}
+	return nil
+}
+
+func writeMsgpackUint(buf *bytes.Buffer, n uint64) {
+	switch {
+	case n <= 127:
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint8:
+		buf.Write([]byte{0xcc, byte(n)})
+	case n <= math.MaxUint16:
+		buf.WriteByte(0xcd)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	case n <= math.MaxUint32:
+		buf.WriteByte(0xce)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	default:
+		buf.WriteByte(0xcf)
+		binary.Write(buf, binary.BigEndian, n)
+	}
+}
+
+// Writes the header of strings, binaries, arrays and maps:
+// fix is the fix format (used if n <= fixmax),
+// f8, f16 and f32 the formats with 8, 16 and 32 bit length
+// (f8 == 0: no such format)
+func writeMsgpackHead(buf *bytes.Buffer, fix byte, fixmax int, f8, f16, f32 byte, n int) {
+	switch {
+	case n <= fixmax:
+		buf.WriteByte(fix | byte(n))
+	case f8 != 0 && n <= math.MaxUint8:
+		buf.Write([]byte{f8, byte(n)})
+	case n <= math.MaxUint16:
+		buf.WriteByte(f16)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(f32)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
+
+// msgpackReader reads MessagePack data
+type msgpackReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+func readMsgpackN(rd msgpackReader, n int) ([]byte, error) {
+	buf := make([]byte, n)
+	_, err := io.ReadFull(rd, buf)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return buf, err
+}
+
+// reads an unsigned big endian integer of n bytes
+func readMsgpackUint(rd msgpackReader, n int) (uint64, error) {
+	buf, err := readMsgpackN(rd, n)
+	if err != nil {
+		return 0, err
+	}
+	var x uint64
+	for _, b := range buf {
+		x = x<<8 | uint64(b)
+	}
+	return x, nil
+}
+
+// Reads one value; io.EOF is returned only before the first byte
+func readMsgpack(rd msgpackReader) (interface{}, error) {
+	b, err := rd.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case b <= 0x7f:
+		return int64(b), nil
+	case b >= 0xe0:
+		return int64(int8(b)), nil
+	case b&0xe0 == 0xa0:
+		s, err := readMsgpackN(rd, int(b&0x1f))
+		return string(s), err
+	case b&0xf0 == 0x90:
+		return readMsgpackArray(rd, int(b&0x0f))
+	case b&0xf0 == 0x80:
+		return readMsgpackMap(rd, int(b&0x0f))
+	}
+	switch b {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		return readMsgpackUint(rd, 1<<(b-0xcc))
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		n := 1 << (b - 0xd0)
+		x, err := readMsgpackUint(rd, n)
+		shift := uint(64 - 8*n)
+		return int64(x<<shift) >> shift, err
+	case 0xca:
+		x, err := readMsgpackUint(rd, 4)
+		return math.Float32frombits(uint32(x)), err
+	case 0xcb:
+		x, err := readMsgpackUint(rd, 8)
+		return math.Float64frombits(x), err
+	case 0xd9, 0xda, 0xdb, 0xc4, 0xc5, 0xc6:
+		var sz int
+		if b >= 0xd9 {
+			sz = 1 << (b - 0xd9)
+		} else {
+			sz = 1 << (b - 0xc4)
+		}
+		n, err := readMsgpackUint(rd, sz)
+		if err != nil {
+			return nil, err
+		}
+		data, err := readMsgpackN(rd, int(n))
+		if b >= 0xd9 {
+			return string(data), err
+		}
+		return data, err
+	case 0xdc, 0xdd:
+		n, err := readMsgpackUint(rd, 2<<(b-0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return readMsgpackArray(rd, int(n))
+	case 0xde, 0xdf:
+		n, err := readMsgpackUint(rd, 2<<(b-0xde))
+		if err != nil {
+			return nil, err
+		}
+		return readMsgpackMap(rd, int(n))
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return readMsgpackExt(rd, 1<<(b-0xd4))
+	case 0xc7, 0xc8, 0xc9:
+		n, err := readMsgpackUint(rd, 1<<(b-0xc7))
+		if err != nil {
+			return nil, err
+		}
+		return readMsgpackExt(rd, int(n))
+	}
+	return nil, errors.New(fmt.Sprintf("invalid MessagePack format 0x%x", b))
+}
+
+func readMsgpackArray(rd msgpackReader, n int) (interface{}, error) {
+	arr := make([]interface{}, n)
+	for i := range arr {
+		x, err := readMsgpack(rd)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		arr[i] = x
+	}
+	return arr, nil
+}
+
+func readMsgpackMap(rd msgpackReader, n int) (interface{}, error) {
+	m := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		k, err := readMsgpack(rd)
+		if err == nil {
+			var v interface{}
+			v, err = readMsgpack(rd)
+			if s, ok := k.(string); ok {
+				m[s] = v
+			} else {
+				m[fmt.Sprint(k)] = v
+			}
+		}
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// Reads an extension of n bytes;
+// timestamps are returned as time.Time, others as []byte
+func readMsgpackExt(rd msgpackReader, n int) (interface{}, error) {
+	typ, err := rd.ReadByte()
+	if err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	data, err := readMsgpackN(rd, n)
+	if err != nil || int8(typ) != -1 {
+		return data, err
+	}
+	switch n {
+	case 4:
+		return time.Unix(int64(binary.BigEndian.Uint32(data)), 0), nil
+	case 8:
+		x := binary.BigEndian.Uint64(data)
+		return time.Unix(int64(x&0x3ffffffff), int64(x>>34)), nil
+	case 12:
+		ns := binary.BigEndian.Uint32(data)
+		return time.Unix(int64(binary.BigEndian.Uint64(data[4:])), int64(ns)), nil
+	}
+	return nil, errors.New("invalid MessagePack timestamp")
+}
+
+// MsgpackReader is a Producer that reads a stream
+// of concatenated MessagePack values and sends them
+// down the chain.
+type MsgpackReader struct {
+	conduit.Cancelable
+	rd  io.Reader
+	new func() interface{}
+}
+
+// NewMsgpackReader creates a new MsgpackReader Producer.
+// Values are decoded as by UnmarshalMsgpack into the result
+// of newValue or, if newValue is nil, into interface{}.
+func NewMsgpackReader(r io.Reader, newValue func() interface{}) (mr *MsgpackReader) {
+	mr = new(MsgpackReader)
+	if mr != nil {
+		mr.rd = r
+		mr.new = newValue
+	}
+	return
+}
+
+// Produce is the pre-defined method that makes MsgpackReader a Producer.
+func (mr *MsgpackReader) Produce(trg conduit.Target) error {
+	br := bufio.NewReader(mr.rd)
+	for !mr.Canceled() {
+		x, err := readMsgpack(br)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if mr.new == nil {
+			trg <- x
+			continue
+		}
+		v := mr.new()
+		err = assignValue(x, v)
+		if err != nil {
+			return err
+		}
+		trg <- v
+	}
+	return nil
+}
+
+// MsgpackWriter is a Consumer that writes incoming data
+// as stream of concatenated MessagePack values.
+type MsgpackWriter struct {
+	wt io.Writer
+}
+
+// NewMsgpackWriter creates a new MsgpackWriter Consumer.
+func NewMsgpackWriter(w io.Writer) (mw *MsgpackWriter) {
+	mw = new(MsgpackWriter)
+	if mw != nil {
+		mw.wt = w
+	}
+	return
+}
+
+// Consume is the pre-defined method that makes MsgpackWriter a Consumer.
+// Consume terminates with an error if an item cannot be encoded.
+func (mw *MsgpackWriter) Consume(src conduit.Source) error {
+	bw := bufio.NewWriter(mw.wt)
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			err := bw.Flush()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		buf, err := MarshalMsgpack(inp)
+		if err != nil {
+			return err
+		}
+		bw.Write(buf)
+	}
+	return bw.Flush()
+}
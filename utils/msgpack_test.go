@@ -0,0 +1,123 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+// MessagePack values of all formats
+func makeMsgpackValues() []interface{} {
+	big := make([]interface{}, 70000)
+	for i := range big {
+		big[i] = int64(i % 3)
+	}
+	return []interface{}{
+		nil, true, false,
+		int64(0), int64(127), int64(-1), int64(-32), int64(-33), int64(-200),
+		int64(-40000), int64(-3000000000), int64(math.MinInt64),
+		uint64(200), uint64(60000), uint64(4000000000), uint64(math.MaxUint64),
+		float32(1.5), float64(-2.25),
+		"", "short", string(make([]byte, 40)), string(make([]byte, 300)), string(make([]byte, 70000)),
+		[]byte{}, []byte{1, 2, 3}, make([]byte, 300),
+		[]interface{}{}, []interface{}{int64(1), "a", nil}, big,
+		map[string]interface{}{}, map[string]interface{}{"a": int64(1), "b": []interface{}{true}},
+		time.Unix(1600000000, 123456789),
+	}
+}
+
+// MessagePack:
+// - Values of all formats are written and read back without errors
+// - Structs are encoded as maps and decoded into structs
+func TestMsgpackChain(t *testing.T) {
+	values := makeMsgpackValues()
+
+	var buf bytes.Buffer
+	chn := conduit.NewChain(&AnyProducer{values}, nil, NewMsgpackWriter(&buf), small)
+	err := chn.Run()
+	if err != nil {
+		t.Fatalf("MsgpackChain failed on writing: %v", chn.Errs)
+	}
+	c := new(AnyConsumer)
+	chn = conduit.NewChain(NewMsgpackReader(&buf, nil), nil, c, small)
+	err = chn.Run()
+	if err != nil {
+		t.Fatalf("MsgpackChain failed on reading: %v", chn.Errs)
+	}
+	if len(c.recvd) != len(values) {
+		t.Fatalf("MsgpackChain: expected %d values, have %d", len(values), len(c.recvd))
+	}
+	for i, v := range c.recvd {
+		want := values[i]
+		if tm, ok := want.(time.Time); ok {
+			if !tm.Equal(v.(time.Time)) {
+				t.Errorf("MsgpackChain: expected %v, have %v", want, v)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(v, want) {
+			t.Errorf("MsgpackChain: value %d differs: %T", i, want)
+		}
+	}
+}
+
+// MessagePack codec with structs:
+// - Points are encoded and decoded without errors
+// - Truncated input is reported
+func TestMsgpackCodecChain(t *testing.T) {
+	for i := 0; i < numOfTests; i++ {
+		err := testMsgpackCodecChain(i)
+		if err != nil {
+			m := fmt.Sprintf("MsgpackCodecChain failed: %v", err)
+			t.Error(m)
+		}
+	}
+	buf, _ := MarshalMsgpack(map[string]interface{}{"a": "bcd"})
+	var v interface{}
+	if UnmarshalMsgpack(buf[:len(buf)-1], &v) == nil {
+		t.Errorf("MsgpackCodecChain: truncated input not reported")
+	}
+}
+
+func testMsgpackCodecChain(n int) error {
+
+	points := makePoints(n)
+	c := new(AnyConsumer)
+	pipe := []conduit.Conduit{NewEncoder(MarshalMsgpack), NewDecoder(UnmarshalMsgpack, newPoint)}
+	chn := conduit.NewChain(&AnyProducer{points}, pipe, c, small)
+
+	err := chn.Run()
+	if err != nil {
+		m := fmt.Sprintf("error on running chain: %v", chn.Errs)
+		return errors.New(m)
+	}
+	if len(c.recvd) != n {
+		m := fmt.Sprintf("expected %d items, have %d", n, len(c.recvd))
+		return errors.New(m)
+	}
+	for i, v := range c.recvd {
+		if *v.(*Point) != *points[i].(*Point) {
+			return errors.New("Received values differ from original!")
+		}
+	}
+	return nil
+}
+
+// MessagePack barrier:
+// - Items preceding a barrier are flushed at the barrier
+func TestMsgpackBarrier(t *testing.T) {
+	w := new(chunkWriter)
+	err := consumeWithBarrier(NewMsgpackWriter(w), 1, 2)
+	if err != nil {
+		t.Fatalf("MsgpackBarrier failed: %v", err)
+	}
+	if len(w.chunks) != 2 || w.chunks[0] != "\x01" {
+		t.Errorf("MsgpackBarrier: unexpected writes %q", w.chunks)
+	}
+}
@@ -0,0 +1,794 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+// NATSMsg is a message received from NATS.
+// Reply is the subject for replies, if any.
+type NATSMsg struct {
+	Subject string
+	Reply   string
+	Header  http.Header
+	Data    []byte
+	status  int
+}
+
+// Minimal client for the NATS protocol
+type natsConn struct {
+	conn  net.Conn
+	rd    *bufio.Reader
+	wdoor sync.Mutex
+	w     *bufio.Writer
+	door  sync.Mutex
+	subs  map[int]chan *NATSMsg
+	next  int
+	err   error
+	quit  chan struct{}
+	once  sync.Once
+	done  chan struct{}
+}
+
+// Connects to the server at addr
+// (nats://[user:password@|token@]host[:port])
+func dialNATS(addr string, timeout time.Duration) (*natsConn, error) {
+	if !strings.Contains(addr, "://") {
+		addr = "nats://" + addr
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "4222")
+	}
+	conn, err := net.DialTimeout("tcp", host, timeout)
+	if err != nil {
+		return nil, err
+	}
+	nc := &natsConn{
+		conn: conn,
+		rd:   bufio.NewReader(conn),
+		w:    bufio.NewWriter(conn),
+		subs: make(map[int]chan *NATSMsg),
+		quit: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	err = nc.handshake(u.User)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	go nc.read()
+	return nc, nil
+}
+
+// Reads INFO, sends CONNECT and waits for PONG
+func (nc *natsConn) handshake(user *url.Userinfo) error {
+	line, err := nc.readLine()
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		return errors.New(fmt.Sprintf("unexpected greeting %q", line))
+	}
+	opts := map[string]interface{}{
+		"verbose":       false,
+		"pedantic":      false,
+		"headers":       true,
+		"no_responders": true,
+		"protocol":      1,
+		"lang":          "go",
+		"version":       "conduit",
+	}
+	if user != nil {
+		if pass, ok := user.Password(); ok {
+			opts["user"] = user.Username()
+			opts["pass"] = pass
+		} else {
+			opts["auth_token"] = user.Username()
+		}
+	}
+	b, err := json.Marshal(opts)
+	if err != nil {
+		return err
+	}
+	err = nc.send(fmt.Sprintf("CONNECT %s\r\nPING\r\n", b), nil)
+	if err != nil {
+		return err
+	}
+	for {
+		line, err = nc.readLine()
+		if err != nil {
+			return err
+		}
+		switch {
+		case line == "PONG":
+			return nil
+		case strings.HasPrefix(line, "-ERR"):
+			return errors.New(fmt.Sprintf("nats: %s", strings.TrimSpace(line[4:])))
+		}
+	}
+}
+
+func (nc *natsConn) readLine() (string, error) {
+	line, err := nc.rd.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// Writes a command and its payload
+func (nc *natsConn) send(cmd string, data []byte) error {
+	nc.wdoor.Lock()
+	defer nc.wdoor.Unlock()
+	nc.w.WriteString(cmd)
+	if data != nil {
+		nc.w.Write(data)
+		nc.w.WriteString("\r\n")
+	}
+	return nc.w.Flush()
+}
+
+// Dispatches the incoming messages to the subscriptions
+// until the connection is closed
+func (nc *natsConn) read() {
+	var err error
+	defer func() {
+		nc.door.Lock()
+		if nc.err == nil {
+			nc.err = err
+		}
+		for sid, c := range nc.subs {
+			delete(nc.subs, sid)
+			close(c)
+		}
+		nc.door.Unlock()
+		nc.conn.Close()
+		close(nc.done)
+	}()
+	for {
+		var line string
+		line, err = nc.readLine()
+		if err != nil {
+			return
+		}
+		f := strings.Fields(line)
+		if len(f) == 0 {
+			continue
+		}
+		switch strings.ToUpper(f[0]) {
+		case "PING":
+			err = nc.send("PONG\r\n", nil)
+		case "MSG", "HMSG":
+			var msg *NATSMsg
+			var sid int
+			msg, sid, err = nc.message(f)
+			if err == nil {
+				nc.deliver(sid, msg)
+			}
+		case "-ERR":
+			err = errors.New(fmt.Sprintf("nats: %s", strings.TrimSpace(line[4:])))
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Reads a message: MSG subject sid [reply] size
+// or HMSG subject sid [reply] hdrsize size
+func (nc *natsConn) message(f []string) (*NATSMsg, int, error) {
+	hdr := strings.ToUpper(f[0]) == "HMSG"
+	args := f[1:]
+	min := 3
+	if hdr {
+		min = 4
+	}
+	if len(args) < min || len(args) > min+1 {
+		return nil, 0, errors.New(fmt.Sprintf("nats: invalid message %q", strings.Join(f, " ")))
+	}
+	msg := &NATSMsg{Subject: args[0]}
+	sid, err := strconv.Atoi(args[1])
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(args) == min+1 {
+		msg.Reply = args[2]
+	}
+	size, err := strconv.Atoi(args[len(args)-1])
+	if err != nil || size < 0 {
+		return nil, 0, errors.New(fmt.Sprintf("nats: invalid size in %q", strings.Join(f, " ")))
+	}
+	hsize := 0
+	if hdr {
+		hsize, err = strconv.Atoi(args[len(args)-2])
+		if err != nil || hsize < 0 || hsize > size {
+			return nil, 0, errors.New(fmt.Sprintf("nats: invalid header size in %q", strings.Join(f, " ")))
+		}
+	}
+	buf := make([]byte, size+2)
+	_, err = io.ReadFull(nc.rd, buf)
+	if err != nil {
+		return nil, 0, err
+	}
+	if hsize > 0 {
+		err = msg.parseHeader(buf[:hsize])
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	msg.Data = buf[hsize:size]
+	return msg, sid, nil
+}
+
+// Parses "NATS/1.0 [status [description]]" followed by MIME headers
+func (msg *NATSMsg) parseHeader(b []byte) error {
+	tp := textproto.NewReader(bufio.NewReader(bytes.NewReader(b)))
+	line, err := tp.ReadLine()
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "NATS/1.0") {
+		return errors.New(fmt.Sprintf("nats: invalid header %q", line))
+	}
+	if f := strings.Fields(line); len(f) > 1 {
+		msg.status, _ = strconv.Atoi(f[1])
+	}
+	h, err := tp.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if len(h) > 0 {
+		msg.Header = http.Header(h)
+	}
+	return nil
+}
+
+// Delivers msg to subscription sid;
+// blocks if the subscriber is slow, until the connection is closed
+func (nc *natsConn) deliver(sid int, msg *NATSMsg) {
+	nc.door.Lock()
+	c, ok := nc.subs[sid]
+	nc.door.Unlock()
+	if ok {
+		select {
+		case c <- msg:
+		case <-nc.quit:
+		}
+	}
+}
+
+// Subscribes to subject (in queue group queue, if not empty);
+// the channel is closed when the connection is closed
+func (nc *natsConn) subscribe(subject, queue string) (int, <-chan *NATSMsg, error) {
+	nc.door.Lock()
+	nc.next++
+	sid := nc.next
+	c := make(chan *NATSMsg, 256)
+	nc.subs[sid] = c
+	nc.door.Unlock()
+	cmd := fmt.Sprintf("SUB %s %d\r\n", subject, sid)
+	if queue != "" {
+		cmd = fmt.Sprintf("SUB %s %s %d\r\n", subject, queue, sid)
+	}
+	return sid, c, nc.send(cmd, nil)
+}
+
+// Ends a subscription; its channel is no longer served
+func (nc *natsConn) unsubscribe(sid int) error {
+	nc.door.Lock()
+	delete(nc.subs, sid)
+	nc.door.Unlock()
+	return nc.send(fmt.Sprintf("UNSUB %d\r\n", sid), nil)
+}
+
+func (nc *natsConn) publish(subject, reply string, data []byte) error {
+	cmd := fmt.Sprintf("PUB %s %d\r\n", subject, len(data))
+	if reply != "" {
+		cmd = fmt.Sprintf("PUB %s %s %d\r\n", subject, reply, len(data))
+	}
+	return nc.send(cmd, data)
+}
+
+// Sends a request and waits for the reply
+func (nc *natsConn) request(subject string, data []byte, timeout time.Duration) (*NATSMsg, error) {
+	inbox := newInbox()
+	sid, c, err := nc.subscribe(inbox, "")
+	if err != nil {
+		return nil, err
+	}
+	defer nc.unsubscribe(sid)
+	err = nc.publish(subject, inbox, data)
+	if err != nil {
+		return nil, err
+	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case msg, ok := <-c:
+		if !ok {
+			return nil, nc.failed()
+		}
+		if msg.status == 503 {
+			return nil, errors.New(fmt.Sprintf("nats: no responders on %s", subject))
+		}
+		return msg, nil
+	case <-t.C:
+		return nil, errors.New(fmt.Sprintf("nats: request on %s timed out", subject))
+	}
+}
+
+// The error that closed the connection
+func (nc *natsConn) failed() error {
+	nc.door.Lock()
+	defer nc.door.Unlock()
+	if nc.err == nil {
+		return errors.New("nats: connection closed")
+	}
+	return nc.err
+}
+
+func (nc *natsConn) close() {
+	nc.door.Lock()
+	if nc.err == nil {
+		nc.err = errors.New("nats: connection closed")
+	}
+	nc.door.Unlock()
+	nc.once.Do(func() { close(nc.quit) })
+	nc.conn.Close()
+	<-nc.done
+}
+
+// A unique subject for replies
+func newInbox() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return "_INBOX." + hex.EncodeToString(b)
+}
+
+// NATSSubscriber is a Producer that subscribes to a NATS subject
+// (which may contain wildcards) and sends the messages
+// as *NATSMsg down the chain. Subscribers in the same
+// queue group (see SetQueue) share the messages.
+// Delivery is at most once: messages published
+// while the subscriber is not connected are lost.
+// The producer runs until the chain is canceled
+// or terminates with an error when the connection is lost.
+type NATSSubscriber struct {
+	conduit.Cancelable
+	url     string
+	subject string
+	queue   string
+	timeout time.Duration
+	door    sync.Mutex
+	nc      *natsConn
+}
+
+// NewNATSSubscriber creates a new NATSSubscriber Producer
+// connecting to the server at url
+// (nats://[user:password@|token@]host[:port]).
+func NewNATSSubscriber(url, subject string) (ns *NATSSubscriber) {
+	ns = new(NATSSubscriber)
+	if ns != nil {
+		ns.url = url
+		ns.subject = subject
+		ns.timeout = 10 * time.Second
+	}
+	return
+}
+
+// SetQueue sets the queue group.
+func (ns *NATSSubscriber) SetQueue(queue string) *NATSSubscriber {
+	ns.queue = queue
+	return ns
+}
+
+// SetTimeout sets the timeout for connecting (default 10s).
+func (ns *NATSSubscriber) SetTimeout(d time.Duration) *NATSSubscriber {
+	ns.timeout = d
+	return ns
+}
+
+// Cancel cancels the producer and closes the connection.
+func (ns *NATSSubscriber) Cancel() {
+	ns.Cancelable.Cancel()
+	ns.door.Lock()
+	defer ns.door.Unlock()
+	if ns.nc != nil {
+		ns.nc.conn.Close()
+	}
+}
+
+// Produce is the pre-defined method that makes NATSSubscriber a Producer.
+func (ns *NATSSubscriber) Produce(trg conduit.Target) error {
+	nc, err := dialNATS(ns.url, ns.timeout)
+	if err != nil {
+		return err
+	}
+	defer nc.close()
+	ns.door.Lock()
+	ns.nc = nc
+	ns.door.Unlock()
+	if ns.Canceled() {
+		return nil
+	}
+	_, c, err := nc.subscribe(ns.subject, ns.queue)
+	if err != nil {
+		return err
+	}
+	for msg := range c {
+		trg <- msg
+	}
+	if ns.Canceled() {
+		return nil
+	}
+	return nc.failed()
+}
+
+// NATSPublisher is a Consumer that publishes the incoming items
+// to NATS. The subject is a template (see Template)
+// rendered with the item. Items of type []byte and string
+// are published as they are, *NATSMsg items with their Data,
+// others are encoded with a MarshalFunc (default: json.Marshal).
+// With JetStream, each message is published as request
+// and the acknowledgment of the stream is awaited;
+// failed publications are retried according to the RetryPolicy
+// (DefaultRetry).
+type NATSPublisher struct {
+	url     string
+	subject Template
+	marshal MarshalFunc
+	js      bool
+	retry   RetryPolicy
+	timeout time.Duration
+}
+
+// NewNATSPublisher creates a new NATSPublisher Consumer
+// connecting to the server at url (see NewNATSSubscriber).
+func NewNATSPublisher(url string, subject Template) (np *NATSPublisher) {
+	if subject == nil {
+		return nil
+	}
+	np = new(NATSPublisher)
+	if np != nil {
+		np.url = url
+		np.subject = subject
+		np.marshal = json.Marshal
+		np.retry = DefaultRetry
+		np.timeout = 10 * time.Second
+	}
+	return
+}
+
+// SetMarshal sets the MarshalFunc for items
+// that are neither []byte nor string.
+func (np *NATSPublisher) SetMarshal(marshal MarshalFunc) *NATSPublisher {
+	np.marshal = marshal
+	return np
+}
+
+// JetStream waits for the acknowledgment of the stream
+// for each message.
+func (np *NATSPublisher) JetStream() *NATSPublisher {
+	np.js = true
+	return np
+}
+
+// SetRetry sets the RetryPolicy for JetStream (default: DefaultRetry).
+func (np *NATSPublisher) SetRetry(rp RetryPolicy) *NATSPublisher {
+	np.retry = rp
+	return np
+}
+
+// SetTimeout sets the timeout for connecting and,
+// with JetStream, for acknowledgments (default 10s).
+func (np *NATSPublisher) SetTimeout(d time.Duration) *NATSPublisher {
+	np.timeout = d
+	return np
+}
+
+// Consume is the pre-defined method that makes NATSPublisher a Consumer.
+// Consume terminates with an error if an item cannot be encoded
+// or published.
+func (np *NATSPublisher) Consume(src conduit.Source) error {
+	nc, err := dialNATS(np.url, np.timeout)
+	if err != nil {
+		return err
+	}
+	defer nc.close()
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			continue
+		}
+		subject, err := render(np.subject, inp)
+		if err != nil {
+			return err
+		}
+		var data []byte
+		if msg, ok := inp.(*NATSMsg); ok {
+			data = msg.Data
+		} else {
+			data, err = payload(inp, np.marshal)
+			if err != nil {
+				return err
+			}
+		}
+		if !np.js {
+			err = nc.publish(subject, "", data)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		attempts, err := np.retry.run(nil, func() (bool, error) {
+			rsp, err := nc.request(subject, data, np.timeout)
+			if err != nil {
+				return true, err
+			}
+			return false, jsError(rsp.Data)
+		})
+		if err != nil {
+			return errors.New(fmt.Sprintf("publish failed after %d attempts: %v", attempts, err))
+		}
+	}
+	return nil
+}
+
+// Extracts the error from a JetStream API response
+func jsError(data []byte) error {
+	var rsp struct {
+		Error *struct {
+			Code        int    `json:"code"`
+			Description string `json:"description"`
+		} `json:"error"`
+	}
+	err := json.Unmarshal(data, &rsp)
+	if err != nil {
+		return errors.New(fmt.Sprintf("jetstream: invalid response: %v", err))
+	}
+	if rsp.Error != nil {
+		return errors.New(fmt.Sprintf("jetstream: %s (%d)", rsp.Error.Description, rsp.Error.Code))
+	}
+	return nil
+}
+
+// JetStreamConsumer is a Producer that reads the messages
+// of a JetStream stream with a durable pull consumer,
+// which is created if it does not exist,
+// and sends them as *NATSMsg down the chain.
+// Messages are acknowledged explicitly: by default
+// when they have been sent down the chain
+// or, with AckOnCheckpoint, when a checkpoint of the chain
+// covers them (see conduit.Chain.SetCheckpoints and conduit.Committer),
+// so that messages that were not completely processed
+// are redelivered after a crash (at least once).
+// The producer runs until the chain is canceled
+// or terminates with an error when the connection is lost.
+type JetStreamConsumer struct {
+	conduit.Cancelable
+	url     string
+	stream  string
+	durable string
+	filter  string
+	batch   int
+	wait    time.Duration
+	timeout time.Duration
+	onCP    bool
+	acks    ackQueue
+	door    sync.Mutex
+	nc      *natsConn
+}
+
+// NewJetStreamConsumer creates a new JetStreamConsumer Producer
+// reading stream with the durable consumer durable
+// from the server at url (see NewNATSSubscriber).
+func NewJetStreamConsumer(url, stream, durable string) (jc *JetStreamConsumer) {
+	if stream == "" || durable == "" {
+		return nil
+	}
+	jc = new(JetStreamConsumer)
+	if jc != nil {
+		jc.url = url
+		jc.stream = stream
+		jc.durable = durable
+		jc.batch = 64
+		jc.wait = 5 * time.Second
+		jc.timeout = 10 * time.Second
+	}
+	return
+}
+
+// SetFilter restricts the consumer to the subject filter,
+// when it is created.
+func (jc *JetStreamConsumer) SetFilter(subject string) *JetStreamConsumer {
+	jc.filter = subject
+	return jc
+}
+
+// SetBatch sets the number of messages fetched per request (default 64).
+func (jc *JetStreamConsumer) SetBatch(n int) *JetStreamConsumer {
+	if n > 0 {
+		jc.batch = n
+	}
+	return jc
+}
+
+// SetMaxWait sets how long a fetch request waits
+// for messages (default 5s).
+func (jc *JetStreamConsumer) SetMaxWait(d time.Duration) *JetStreamConsumer {
+	jc.wait = d
+	return jc
+}
+
+// SetTimeout sets the timeout for connecting
+// and API requests (default 10s).
+func (jc *JetStreamConsumer) SetTimeout(d time.Duration) *JetStreamConsumer {
+	jc.timeout = d
+	return jc
+}
+
+// AckOnCheckpoint acknowledges messages only when
+// a checkpoint covers them.
+func (jc *JetStreamConsumer) AckOnCheckpoint() *JetStreamConsumer {
+	jc.onCP = true
+	return jc
+}
+
+// Resume is the pre-defined method that makes JetStreamConsumer
+// a conduit.Resumer. The server redelivers the messages
+// that were not acknowledged, so nothing is skipped.
+func (jc *JetStreamConsumer) Resume(pos uint64) error {
+	jc.acks.resume(pos)
+	return nil
+}
+
+// Commit is the pre-defined method that makes JetStreamConsumer
+// a conduit.Committer; with AckOnCheckpoint, it acknowledges
+// the messages covered by the checkpoint.
+// Acknowledgments are dropped when the connection is closed.
+func (jc *JetStreamConsumer) Commit(cp *conduit.Checkpoint) error {
+	if !jc.onCP {
+		return nil
+	}
+	return jc.acks.commit(cp.Position)
+}
+
+// Cancel cancels the producer and closes the connection.
+func (jc *JetStreamConsumer) Cancel() {
+	jc.Cancelable.Cancel()
+	jc.door.Lock()
+	defer jc.door.Unlock()
+	if jc.nc != nil {
+		jc.nc.conn.Close()
+	}
+}
+
+// Creates the durable consumer, if it does not exist
+func (jc *JetStreamConsumer) create(nc *natsConn) error {
+	cfg := map[string]interface{}{
+		"durable_name":   jc.durable,
+		"ack_policy":     "explicit",
+		"deliver_policy": "all",
+	}
+	if jc.filter != "" {
+		cfg["filter_subject"] = jc.filter
+	}
+	req, err := json.Marshal(map[string]interface{}{"stream_name": jc.stream, "config": cfg})
+	if err != nil {
+		return err
+	}
+	subject := fmt.Sprintf("$JS.API.CONSUMER.DURABLE.CREATE.%s.%s", jc.stream, jc.durable)
+	rsp, err := nc.request(subject, req, jc.timeout)
+	if err != nil {
+		return err
+	}
+	return jsError(rsp.Data)
+}
+
+// Produce is the pre-defined method that makes JetStreamConsumer a Producer.
+func (jc *JetStreamConsumer) Produce(trg conduit.Target) error {
+	jc.acks.start()
+	nc, err := dialNATS(jc.url, jc.timeout)
+	if err != nil {
+		return err
+	}
+	defer nc.close()
+	jc.door.Lock()
+	jc.nc = nc
+	jc.door.Unlock()
+	if jc.Canceled() {
+		return nil
+	}
+	err = jc.create(nc)
+	if err != nil {
+		return err
+	}
+	inbox := newInbox()
+	_, c, err := nc.subscribe(inbox, "")
+	if err != nil {
+		return err
+	}
+	next := fmt.Sprintf("$JS.API.CONSUMER.MSG.NEXT.%s.%s", jc.stream, jc.durable)
+	req, err := json.Marshal(map[string]interface{}{"batch": jc.batch, "expires": jc.wait.Nanoseconds()})
+	if err != nil {
+		return err
+	}
+	for !jc.Canceled() {
+		err = nc.publish(next, inbox, req)
+		if err != nil {
+			break
+		}
+		err = jc.fetch(nc, c, trg)
+		if err != nil {
+			break
+		}
+	}
+	if jc.Canceled() {
+		return nil
+	}
+	return err
+}
+
+// Receives the messages of one fetch request
+func (jc *JetStreamConsumer) fetch(nc *natsConn, c <-chan *NATSMsg, trg conduit.Target) error {
+	t := time.NewTimer(jc.wait + jc.timeout)
+	defer t.Stop()
+	for n := 0; n < jc.batch; {
+		select {
+		case msg, ok := <-c:
+			if !ok {
+				return nc.failed()
+			}
+			switch msg.status {
+			case 0:
+			case 100:
+				continue // heartbeat
+			case 404, 408, 409:
+				return nil // no (more) messages
+			default:
+				return errors.New(fmt.Sprintf("jetstream: status %d", msg.status))
+			}
+			n++
+			reply := msg.Reply
+			ack := func() error {
+				if reply != "" {
+					// if the connection is lost, the message is redelivered
+					nc.publish(reply, "", []byte("+ACK"))
+				}
+				return nil
+			}
+			if jc.onCP {
+				jc.acks.add(ack)
+				trg <- msg
+				continue
+			}
+			trg <- msg
+			ack()
+		case <-t.C:
+			return nil
+		}
+	}
+	return nil
+}
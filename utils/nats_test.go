@@ -0,0 +1,444 @@
+package utils
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+// NATS test server: core publish/subscribe
+// and a JetStream emulation with one stream
+// that stores the messages published to prefix.*
+type natsServer struct {
+	ln     net.Listener
+	stream string
+	prefix string
+	door   sync.Mutex
+	subs   map[*natsSub]bool
+	stored [][]byte
+	acked  map[int]bool
+	sent   map[int]bool
+}
+
+type natsSub struct {
+	w       *natsWriter
+	subject string
+	sid     string
+}
+
+type natsWriter struct {
+	door sync.Mutex
+	w    *bufio.Writer
+}
+
+func (nw *natsWriter) write(format string, args ...interface{}) {
+	nw.door.Lock()
+	defer nw.door.Unlock()
+	fmt.Fprintf(nw.w, format, args...)
+	nw.w.Flush()
+}
+
+func newNATSServer(stream, prefix string) (*natsServer, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	ns := &natsServer{
+		ln:     ln,
+		stream: stream,
+		prefix: prefix,
+		subs:   make(map[*natsSub]bool),
+		acked:  make(map[int]bool),
+		sent:   make(map[int]bool),
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go ns.serve(conn)
+		}
+	}()
+	return ns, nil
+}
+
+func (ns *natsServer) url() string {
+	return "nats://" + ns.ln.Addr().String()
+}
+
+func (ns *natsServer) close() {
+	ns.ln.Close()
+}
+
+// Subject matching with * and >
+func natsMatch(pattern, subject string) bool {
+	p := strings.Split(pattern, ".")
+	s := strings.Split(subject, ".")
+	for i, tok := range p {
+		if tok == ">" {
+			return len(s) > i
+		}
+		if i >= len(s) || (tok != "*" && tok != s[i]) {
+			return false
+		}
+	}
+	return len(p) == len(s)
+}
+
+func (ns *natsServer) subscribed(subject string) bool {
+	ns.door.Lock()
+	defer ns.door.Unlock()
+	for s := range ns.subs {
+		if s.subject == subject {
+			return true
+		}
+	}
+	return false
+}
+
+func (ns *natsServer) serve(conn net.Conn) {
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	w := &natsWriter{w: bufio.NewWriter(conn)}
+	mine := make(map[string]*natsSub)
+	defer func() {
+		ns.door.Lock()
+		for _, s := range mine {
+			delete(ns.subs, s)
+		}
+		ns.door.Unlock()
+	}()
+	w.write("INFO {\"server_id\":\"test\",\"headers\":true}\r\n")
+	for {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			return
+		}
+		f := strings.Fields(line)
+		if len(f) == 0 {
+			continue
+		}
+		switch f[0] {
+		case "PING":
+			w.write("PONG\r\n")
+		case "SUB":
+			s := &natsSub{w: w, subject: f[1], sid: f[len(f)-1]}
+			mine[s.sid] = s
+			ns.door.Lock()
+			ns.subs[s] = true
+			ns.door.Unlock()
+		case "UNSUB":
+			ns.door.Lock()
+			delete(ns.subs, mine[f[1]])
+			ns.door.Unlock()
+			delete(mine, f[1])
+		case "PUB":
+			size, _ := strconv.Atoi(f[len(f)-1])
+			data := make([]byte, size+2)
+			if _, err := io.ReadFull(rd, data); err != nil {
+				return
+			}
+			reply := ""
+			if len(f) == 4 {
+				reply = f[2]
+			}
+			ns.publish(f[1], reply, data[:size])
+		}
+	}
+}
+
+// Routes a published message
+func (ns *natsServer) publish(subject, reply string, data []byte) {
+	switch {
+	case strings.HasPrefix(subject, "$JS.ACK."):
+		seq, _ := strconv.Atoi(strings.Split(subject, ".")[5])
+		ns.door.Lock()
+		ns.acked[seq] = true
+		ns.door.Unlock()
+	case strings.HasPrefix(subject, "$JS.API.CONSUMER.DURABLE.CREATE."):
+		if strings.Split(subject, ".")[5] != ns.stream {
+			ns.reply(reply, `{"error":{"code":404,"description":"stream not found"}}`)
+			return
+		}
+		// a new consumer gets the unacknowledged messages again
+		ns.door.Lock()
+		ns.sent = make(map[int]bool)
+		ns.door.Unlock()
+		ns.reply(reply, `{"name":"durable"}`)
+	case strings.HasPrefix(subject, "$JS.API.CONSUMER.MSG.NEXT."):
+		var req struct{ Batch int }
+		json.Unmarshal(data, &req)
+		go ns.next(reply, req.Batch)
+	case strings.HasPrefix(subject, ns.prefix+"."):
+		ns.door.Lock()
+		ns.stored = append(ns.stored, data)
+		seq := len(ns.stored)
+		ns.door.Unlock()
+		ns.reply(reply, fmt.Sprintf(`{"stream":"%s","seq":%d}`, ns.stream, seq))
+	default:
+		ns.deliver(subject, reply, data, "")
+	}
+}
+
+func (ns *natsServer) reply(subject, data string) {
+	if subject != "" {
+		ns.deliver(subject, "", []byte(data), "")
+	}
+}
+
+// Delivers up to batch stored messages that were neither acked nor sent
+func (ns *natsServer) next(inbox string, batch int) {
+	n := 0
+	ns.door.Lock()
+	for seq := 1; seq <= len(ns.stored) && n < batch; seq++ {
+		if ns.acked[seq] || ns.sent[seq] {
+			continue
+		}
+		ns.sent[seq] = true
+		n++
+		ack := fmt.Sprintf("$JS.ACK.%s.durable.1.%d.%d.0.0", ns.stream, seq, seq)
+		data := ns.stored[seq-1]
+		ns.door.Unlock()
+		ns.deliver(inbox, ack, data, "")
+		ns.door.Lock()
+	}
+	ns.door.Unlock()
+	if n < batch {
+		time.Sleep(5 * time.Millisecond)
+		ns.deliver(inbox, "", nil, "NATS/1.0 408 Request Timeout\r\n\r\n")
+	}
+}
+
+func (ns *natsServer) deliver(subject, reply string, data []byte, hdr string) {
+	ns.door.Lock()
+	var subs []*natsSub
+	for s := range ns.subs {
+		if natsMatch(s.subject, subject) {
+			subs = append(subs, s)
+		}
+	}
+	ns.door.Unlock()
+	for _, s := range subs {
+		r := ""
+		if reply != "" {
+			r = reply + " "
+		}
+		if hdr != "" {
+			s.w.write("HMSG %s %s %s%d %d\r\n%s%s\r\n", subject, s.sid, r, len(hdr), len(hdr)+len(data), hdr, data)
+			continue
+		}
+		s.w.write("MSG %s %s %s%d\r\n%s\r\n", subject, s.sid, r, len(data), data)
+	}
+}
+
+func (ns *natsServer) ackedSeqs() []int {
+	ns.door.Lock()
+	defer ns.door.Unlock()
+	var seqs []int
+	for seq := range ns.acked {
+		seqs = append(seqs, seq)
+	}
+	sort.Ints(seqs)
+	return seqs
+}
+
+// Data of the received messages
+func natsData(items []interface{}) []string {
+	var data []string
+	for _, inp := range items {
+		data = append(data, string(inp.(*NATSMsg).Data))
+	}
+	return data
+}
+
+// NATS publish/subscribe:
+// - Items are published to the subject rendered from the item
+// - Subscribers receive the messages matching their subject
+func TestNATSPubSub(t *testing.T) {
+	ns, err := newNATSServer("ORDERS", "orders")
+	if err != nil {
+		t.Fatalf("NATS: cannot start server: %v", err)
+	}
+	defer ns.close()
+
+	c := &TakeConsumer{n: 3}
+	done := make(chan error)
+	go func() {
+		done <- conduit.NewChain(NewNATSSubscriber(ns.url(), "events.>"), nil, c, small).Run()
+	}()
+	for !ns.subscribed("events.>") {
+		time.Sleep(time.Millisecond)
+	}
+
+	subject := template.Must(template.New("subject").Parse("events.{{.kind}}"))
+	items := []interface{}{
+		map[string]interface{}{"kind": "click", "n": 1},
+		map[string]interface{}{"kind": "view", "n": 2},
+		map[string]interface{}{"kind": "click", "n": 3},
+	}
+	chn := conduit.NewChain(&AnyProducer{items}, nil, NewNATSPublisher(ns.url(), subject), small)
+	if err := chn.Run(); err != nil {
+		t.Fatalf("NATSPublisher failed: %v", chn.Errs)
+	}
+	select {
+	case err = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("NATSSubscriber: messages not received")
+	}
+	if err != nil {
+		t.Fatalf("NATSSubscriber failed: %v", err)
+	}
+	want := `[{"kind":"click","n":1} {"kind":"view","n":2} {"kind":"click","n":3}]`
+	if fmt.Sprint(natsData(c.recvd)) != want {
+		t.Errorf("NATSSubscriber: expected %s, have %s", want, natsData(c.recvd))
+	}
+	if c.recvd[1].(*NATSMsg).Subject != "events.view" {
+		t.Errorf("NATSSubscriber: unexpected subject %s", c.recvd[1].(*NATSMsg).Subject)
+	}
+
+	chn = conduit.NewChain(&AnyProducer{items}, nil, NewNATSPublisher("127.0.0.1:1", subject).SetTimeout(time.Second), small)
+	if chn.Run() == nil {
+		t.Errorf("NATSPublisher: connection failure not reported")
+	}
+}
+
+// Publishes n messages to JetStream
+func publishJS(ns *natsServer, n int) error {
+	var items []interface{}
+	for i := 1; i <= n; i++ {
+		items = append(items, fmt.Sprintf("order %d", i))
+	}
+	subject := template.Must(template.New("subject").Parse("orders.new"))
+	chn := conduit.NewChain(&AnyProducer{items}, nil, NewNATSPublisher(ns.url(), subject).JetStream(), small)
+	if chn.Run() != nil {
+		return errors.New(fmt.Sprintf("cannot publish: %v", chn.Errs))
+	}
+	return nil
+}
+
+// JetStream:
+// - Messages are acknowledged by the stream when published
+// - A durable consumer receives and acknowledges all messages
+// - Unknown streams are reported
+func TestJetStream(t *testing.T) {
+	ns, err := newNATSServer("ORDERS", "orders")
+	if err != nil {
+		t.Fatalf("JetStream: cannot start server: %v", err)
+	}
+	defer ns.close()
+	if err = publishJS(ns, 100); err != nil {
+		t.Fatalf("JetStream: %v", err)
+	}
+
+	c := &TakeConsumer{n: 100}
+	jc := NewJetStreamConsumer(ns.url(), "ORDERS", "worker").SetBatch(16).SetMaxWait(50 * time.Millisecond)
+	if err = conduit.NewChain(jc, nil, c, small).Run(); err != nil {
+		t.Fatalf("JetStreamConsumer failed: %v", err)
+	}
+	for i, d := range natsData(c.recvd) {
+		if d != fmt.Sprintf("order %d", i+1) {
+			t.Fatalf("JetStreamConsumer: unexpected message %d: %s", i, d)
+		}
+	}
+	// the last acknowledgment may still be on the way
+	for i := 0; i < 100 && len(ns.ackedSeqs()) < 100; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if len(ns.ackedSeqs()) != 100 {
+		t.Errorf("JetStreamConsumer: %d messages acknowledged", len(ns.ackedSeqs()))
+	}
+
+	err = conduit.NewChain(NewJetStreamConsumer(ns.url(), "MISSING", "worker"), nil, c, small).Run()
+	if err == nil {
+		t.Errorf("JetStreamConsumer: missing stream not reported")
+	}
+}
+
+// Consumer that terminates with err after n items, ignoring barriers
+type StopConsumer struct {
+	n     int
+	err   error
+	recvd []interface{}
+}
+
+func (c *StopConsumer) Consume(src conduit.Source) error {
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			continue
+		}
+		c.recvd = append(c.recvd, inp)
+		if len(c.recvd) == c.n {
+			return c.err
+		}
+		time.Sleep(100 * time.Microsecond)
+	}
+	return nil
+}
+
+// JetStream with acknowledgment on checkpoints:
+// - Only messages covered by a checkpoint are acknowledged
+// - After a crash, the other messages are redelivered
+func TestJetStreamCheckpoint(t *testing.T) {
+	ns, err := newNATSServer("ORDERS", "orders")
+	if err != nil {
+		t.Fatalf("JetStream: cannot start server: %v", err)
+	}
+	defer ns.close()
+	if err = publishJS(ns, 200); err != nil {
+		t.Fatalf("JetStream: %v", err)
+	}
+
+	cps := conduit.NewMemCheckpoints()
+	newConsumer := func() *JetStreamConsumer {
+		return NewJetStreamConsumer(ns.url(), "ORDERS", "worker").
+			SetBatch(8).SetMaxWait(20 * time.Millisecond).AckOnCheckpoint()
+	}
+	c := &StopConsumer{n: 150, err: errors.New("crash")}
+	jc := newConsumer()
+	chn := conduit.NewChain(jc, nil, c, small)
+	chn.SetCheckpoints(time.Millisecond, cps)
+	if chn.Run() == nil {
+		t.Fatalf("JetStreamConsumer: chain did not crash")
+	}
+	// the producer is not stopped by the failing consumer
+	jc.Cancel()
+	cp, _ := cps.Latest()
+	if cp == nil {
+		t.Fatalf("JetStreamConsumer: no checkpoint taken")
+	}
+	// acknowledgments are published asynchronously
+	acked := ns.ackedSeqs()
+	for deadline := time.Now().Add(time.Second); len(acked) < int(cp.Position) && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+		acked = ns.ackedSeqs()
+	}
+	if len(acked) != int(cp.Position) || acked[len(acked)-1] != len(acked) {
+		t.Fatalf("JetStreamConsumer: checkpoint at %d, acknowledged %v", cp.Position, acked)
+	}
+
+	rest := &StopConsumer{n: 200 - len(acked), err: conduit.EOS}
+	chn = conduit.NewChain(newConsumer(), nil, rest, small)
+	chn.SetCheckpoints(time.Millisecond, cps)
+	if err = chn.Run(); err != nil {
+		t.Fatalf("JetStreamConsumer: restarted chain failed: %v", err)
+	}
+	data := natsData(rest.recvd)
+	for i, d := range data {
+		if d != fmt.Sprintf("order %d", len(acked)+i+1) {
+			t.Fatalf("JetStreamConsumer: unexpected redelivered message %d: %s", i, d)
+		}
+	}
+}
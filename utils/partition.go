@@ -0,0 +1,192 @@
+package utils
+
+import (
+	"bufio"
+	"container/list"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/toschoo/conduit"
+)
+
+// Open file of a PartitionedWriter
+type partitionFile struct {
+	key  string
+	file *os.File
+	buf  *bufio.Writer
+}
+
+func (pf *partitionFile) close() error {
+	err := pf.buf.Flush()
+	if e := pf.file.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// PartitionedWriter is a Consumer that writes each incoming item
+// to the file of its key, e.g. a date or a customer ID
+// obtained from the item by a KeyFunc. The key is the path
+// of the file relative to the directory of the writer
+// and may contain slashes for subdirectories,
+// which are created as needed; keys leading outside
+// the directory are rejected.
+// Items of type []byte and string are written as they are,
+// others are encoded with a MarshalFunc (default: json.Marshal);
+// each item is followed by a delimiter (default: newline).
+// Files are opened for appending and kept open
+// up to a maximum number (see SetMaxOpen);
+// when it is reached, the least recently used file is closed.
+// At barriers, the buffers of all open files are flushed;
+// at the end of the stream, all files are closed.
+type PartitionedWriter struct {
+	dir     string
+	kf      KeyFunc
+	marshal MarshalFunc
+	delim   []byte
+	max     int
+	perm    os.FileMode
+	files   map[string]*list.Element
+	lru     *list.List
+}
+
+// NewPartitionedWriter creates a new PartitionedWriter Consumer
+// that writes to files in dir named by kf
+// (which may be nil, see Keyed).
+func NewPartitionedWriter(dir string, kf KeyFunc) (pw *PartitionedWriter) {
+	if dir == "" {
+		return nil
+	}
+	pw = new(PartitionedWriter)
+	if pw != nil {
+		pw.dir = dir
+		pw.kf = kf
+		pw.marshal = json.Marshal
+		pw.delim = []byte{'\n'}
+		pw.max = 16
+		pw.perm = 0644
+	}
+	return
+}
+
+// SetMarshal sets the MarshalFunc for items
+// that are neither []byte nor string.
+func (pw *PartitionedWriter) SetMarshal(marshal MarshalFunc) *PartitionedWriter {
+	pw.marshal = marshal
+	return pw
+}
+
+// SetDelimiter sets the delimiter written after each item;
+// nil writes items without delimiter.
+func (pw *PartitionedWriter) SetDelimiter(delim []byte) *PartitionedWriter {
+	pw.delim = delim
+	return pw
+}
+
+// SetMaxOpen sets the maximum number of open files (default: 16).
+func (pw *PartitionedWriter) SetMaxOpen(n int) *PartitionedWriter {
+	if n > 0 {
+		pw.max = n
+	}
+	return pw
+}
+
+// SetPerm sets the permissions of new files (default: 0644).
+func (pw *PartitionedWriter) SetPerm(perm os.FileMode) *PartitionedWriter {
+	pw.perm = perm
+	return pw
+}
+
+// Consume is the pre-defined method that makes PartitionedWriter a Consumer.
+// Consume terminates with an error if an item cannot be encoded,
+// its key is invalid or its file cannot be written.
+func (pw *PartitionedWriter) Consume(src conduit.Source) (err error) {
+	pw.files = make(map[string]*list.Element)
+	pw.lru = list.New()
+	defer func() {
+		if e := pw.closeAll(); err == nil {
+			err = e
+		}
+	}()
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			if err := pw.flush(); err != nil {
+				return err
+			}
+			continue
+		}
+		data, err := payload(inp, pw.marshal)
+		if err != nil {
+			return err
+		}
+		pf, err := pw.open(keyOf(pw.kf, inp))
+		if err != nil {
+			return err
+		}
+		pf.buf.Write(data)
+		if _, err := pf.buf.Write(pw.delim); err != nil {
+			return errors.New(fmt.Sprintf("writing %s failed: %v", pf.file.Name(), err))
+		}
+	}
+	return nil
+}
+
+// Returns the file of key, opening it if necessary
+func (pw *PartitionedWriter) open(key string) (*partitionFile, error) {
+	if e, ok := pw.files[key]; ok {
+		pw.lru.MoveToFront(e)
+		return e.Value.(*partitionFile), nil
+	}
+	rel := filepath.Clean(filepath.FromSlash(key))
+	if key == "" || filepath.IsAbs(rel) || rel == "." || rel == ".." ||
+		strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, errors.New(fmt.Sprintf("invalid partition key %q", key))
+	}
+	if pw.lru.Len() >= pw.max {
+		last := pw.lru.Back()
+		pf := pw.lru.Remove(last).(*partitionFile)
+		delete(pw.files, pf.key)
+		if err := pf.close(); err != nil {
+			return nil, err
+		}
+	}
+	p := filepath.Join(pw.dir, rel)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_APPEND, pw.perm)
+	if err != nil {
+		return nil, err
+	}
+	pf := &partitionFile{key: key, file: f, buf: bufio.NewWriter(f)}
+	pw.files[key] = pw.lru.PushFront(pf)
+	return pf, nil
+}
+
+// Flushes the buffers of all open files
+func (pw *PartitionedWriter) flush() error {
+	for e := pw.lru.Front(); e != nil; e = e.Next() {
+		pf := e.Value.(*partitionFile)
+		if err := pf.buf.Flush(); err != nil {
+			return errors.New(fmt.Sprintf("writing %s failed: %v", pf.file.Name(), err))
+		}
+	}
+	return nil
+}
+
+// Closes all open files and returns the first error
+func (pw *PartitionedWriter) closeAll() error {
+	var err error
+	for e := pw.lru.Front(); e != nil; e = e.Next() {
+		if e := e.Value.(*partitionFile).close(); err == nil {
+			err = e
+		}
+	}
+	pw.files = make(map[string]*list.Element)
+	pw.lru.Init()
+	return err
+}
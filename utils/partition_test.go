@@ -0,0 +1,89 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+// Partitioned writer:
+// - Items are appended to the file of their key
+// - Files evicted from the LRU are reopened for appending
+// - Barriers flush the open files
+// - Keys leading outside the directory are rejected
+func TestPartitionedWriter(t *testing.T) {
+	dir := t.TempDir()
+	read := func(name string) string {
+		data, _ := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		return string(data)
+	}
+	if NewPartitionedWriter("", nil) != nil {
+		t.Errorf("PartitionedWriter: empty directory accepted")
+	}
+	kf := func(inp interface{}) string {
+		r := inp.(Record)
+		return fmt.Sprintf("%s/%s.jsonl", r["day"], r["cust"])
+	}
+	items := make(chan interface{})
+	done := make(chan error)
+	pw := NewPartitionedWriter(dir, kf).SetMaxOpen(2)
+	go func() {
+		done <- conduit.NewChain(&ChanProducer{items}, nil, pw, small).Run()
+	}()
+	for i, cust := range []string{"a", "b", "c", "a", "c", "b", "a"} {
+		items <- Record{"day": "2024-03-04", "cust": cust, "n": i}
+	}
+	items <- Record{"day": "2024-03-05", "cust": "a", "n": 7}
+	items <- &conduit.Barrier{}
+	items <- Record{"day": "2024-03-05", "cust": "a", "n": 8}
+	time.Sleep(20 * time.Millisecond)
+	if s := read("2024-03-05/a.jsonl"); s != `{"cust":"a","day":"2024-03-05","n":7}`+"\n" {
+		t.Errorf("PartitionedWriter: not flushed at barrier: %q", s)
+	}
+	close(items)
+	if err := <-done; err != nil {
+		t.Fatalf("PartitionedWriter failed: %v", err)
+	}
+	for name, want := range map[string]string{
+		"2024-03-04/a.jsonl": "0,3,6", "2024-03-04/b.jsonl": "1,5", "2024-03-04/c.jsonl": "2,4", "2024-03-05/a.jsonl": "7,8",
+	} {
+		var ns []string
+		for _, line := range strings.Split(strings.TrimSpace(read(name)), "\n") {
+			var r struct{ N int }
+			if err := json.Unmarshal([]byte(line), &r); err != nil {
+				t.Fatalf("PartitionedWriter: invalid line %q in %s", line, name)
+			}
+			ns = append(ns, fmt.Sprint(r.N))
+		}
+		if strings.Join(ns, ",") != want {
+			t.Errorf("PartitionedWriter: %s has %v, expected %s", name, ns, want)
+		}
+	}
+
+	// Keyed items, strings and a delimiter
+	pw = NewPartitionedWriter(dir, nil).SetDelimiter([]byte("|")).SetPerm(0600)
+	if err := conduit.NewChain(&AnyProducer{src: []interface{}{"x.txt", "y.txt", "x.txt"}}, nil, pw, small).Run(); err != nil {
+		t.Fatalf("PartitionedWriter failed: %v", err)
+	}
+	if read("x.txt") != "x.txt|x.txt|" || read("y.txt") != "y.txt|" {
+		t.Errorf("PartitionedWriter: unexpected files %q %q", read("x.txt"), read("y.txt"))
+	}
+	if fi, err := os.Stat(filepath.Join(dir, "x.txt")); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("PartitionedWriter: unexpected mode %v (%v)", fi.Mode(), err)
+	}
+
+	for _, key := range []string{"../escape", "", "/abs"} {
+		pw = NewPartitionedWriter(dir, func(interface{}) string { return key })
+		chn := conduit.NewChain(&AnyProducer{src: []interface{}{"x"}}, nil, pw, small)
+		if err := chn.Run(); err == nil || !strings.Contains(fmt.Sprint(chn.Errs), "invalid partition key") {
+			t.Errorf("PartitionedWriter: key %q accepted: %v", key, chn.Errs)
+		}
+	}
+}
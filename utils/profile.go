@@ -0,0 +1,367 @@
+package utils
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+// Precision of the distinct count estimation:
+// 2^14 registers, standard error about 0.8%
+const hllBits = 14
+
+// hyperLogLog estimates the number of distinct values
+type hyperLogLog struct {
+	regs [1 << hllBits]uint8
+}
+
+func (h *hyperLogLog) add(s string) {
+	f := fnv.New64a()
+	f.Write([]byte(s))
+	x := mix64(f.Sum64())
+	i := x >> (64 - hllBits)
+	rank := uint8(bits.LeadingZeros64(x<<hllBits|1<<(hllBits-1))) + 1
+	if rank > h.regs[i] {
+		h.regs[i] = rank
+	}
+}
+
+func (h *hyperLogLog) estimate() uint64 {
+	m := float64(len(h.regs))
+	sum, zeros := 0.0, 0
+	for _, r := range h.regs {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	e := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if e <= 2.5*m && zeros > 0 {
+		// linear counting for small cardinalities
+		e = m * math.Log(m/float64(zeros))
+	}
+	return uint64(math.Round(e))
+}
+
+// Finalizer of splitmix64 to spread the bits of a hash
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	return x ^ x>>31
+}
+
+// FieldProfile contains the statistics of one field:
+// Count is the number of records containing the field,
+// Nulls the number of nil values or empty strings
+// and Distinct the estimated number of distinct values.
+// Type is the type inferred from all non-null values
+// (strings are inspected for numbers, booleans and RFC 3339 times);
+// values of incompatible types result in ColString with Mixed set.
+// Min and Max are the extreme values of the inferred type
+// (float64 for numbers, time.Time or string).
+// If a pattern was set for the field (see SetPattern),
+// Conforming is the number of non-null values matching it.
+type FieldProfile struct {
+	Name       string
+	Count      uint64
+	Nulls      uint64
+	Distinct   uint64
+	Type       ColumnType
+	Mixed      bool
+	Min, Max   interface{}
+	Conforming uint64
+	Pattern    *regexp.Regexp
+}
+
+// Accumulated statistics of a field
+type fieldStats struct {
+	FieldProfile
+	types      map[ColumnType]uint64
+	other      bool
+	hll        hyperLogLog
+	minNum     float64
+	maxNum     float64
+	hasNum     bool
+	minT, maxT time.Time
+	minS, maxS string
+	hasT, hasS bool
+}
+
+// NullRate returns the rate of null values among the records
+// (missing fields count as null).
+func (f *FieldProfile) NullRate(records uint64) float64 {
+	if records == 0 {
+		return 0
+	}
+	return float64(f.Nulls+records-f.Count) / float64(records)
+}
+
+// ConformityRate returns the rate of non-null values matching the pattern.
+func (f *FieldProfile) ConformityRate() float64 {
+	if f.Count == f.Nulls {
+		return 1
+	}
+	return float64(f.Conforming) / float64(f.Count-f.Nulls)
+}
+
+// Profile is the data-quality report of a Profiler:
+// the number of records profiled, the number of other
+// items passed through without profiling and
+// the profiles of all fields ordered by name.
+type Profile struct {
+	Records uint64
+	Skipped uint64
+	Fields  []*FieldProfile
+}
+
+var colTypeNames = map[ColumnType]string{
+	ColString: "string", ColInt: "int", ColFloat: "float", ColBool: "bool", ColTime: "time",
+}
+
+// String formats the profile as table with one line per field.
+func (p *Profile) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "records: %d, skipped: %d\n", p.Records, p.Skipped)
+	for _, f := range p.Fields {
+		t := colTypeNames[f.Type]
+		if f.Mixed {
+			t = "mixed"
+		}
+		fmt.Fprintf(&b, "%s: type %s, nulls %.1f%%, distinct ~%d, min %v, max %v",
+			f.Name, t, 100*f.NullRate(p.Records), f.Distinct, f.Min, f.Max)
+		if f.Pattern != nil {
+			fmt.Fprintf(&b, ", conforming %.1f%%", 100*f.ConformityRate())
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// Profiler is a Conduit that passes all items through unchanged
+// and accumulates statistics on the fields of records
+// (Record or map[string]interface{}); other items are
+// passed through without profiling.
+// At the end of the stream, the *Profile is sent
+// to the side output "profile" (see conduit.SideOutputter) or,
+// if the side output is not connected, down the chain
+// as the last item. It is also available through Profile.
+type Profiler struct {
+	door     sync.Mutex
+	patterns map[string]*regexp.Regexp
+	side     conduit.Target
+	records  uint64
+	skipped  uint64
+	fields   map[string]*fieldStats
+}
+
+// NewProfiler creates a new Profiler Conduit.
+func NewProfiler() (p *Profiler) {
+	p = new(Profiler)
+	if p != nil {
+		p.patterns = make(map[string]*regexp.Regexp)
+		p.fields = make(map[string]*fieldStats)
+	}
+	return
+}
+
+// SetPattern sets a regular expression the values of field
+// (formatted with fmt.Sprint) are expected to match.
+func (p *Profiler) SetPattern(field string, re *regexp.Regexp) *Profiler {
+	p.patterns[field] = re
+	return p
+}
+
+// SideOutput is the pre-defined method that makes Profiler
+// a conduit.SideOutputter. Profiler has the side output "profile".
+func (p *Profiler) SideOutput(name string, trg conduit.Target) {
+	if name == "profile" {
+		p.side = trg
+	}
+}
+
+// Profile returns the profile of the items processed so far.
+func (p *Profiler) Profile() *Profile {
+	p.door.Lock()
+	defer p.door.Unlock()
+	prof := &Profile{Records: p.records, Skipped: p.skipped}
+	for _, f := range p.fields {
+		fp := f.FieldProfile
+		fp.Distinct = f.hll.estimate()
+		fp.Type, fp.Mixed = f.inferType()
+		switch {
+		case (fp.Type == ColInt || fp.Type == ColFloat) && f.hasNum:
+			fp.Min, fp.Max = f.minNum, f.maxNum
+		case fp.Type == ColTime && f.hasT:
+			fp.Min, fp.Max = f.minT, f.maxT
+		case f.hasS:
+			fp.Min, fp.Max = f.minS, f.maxS
+		}
+		prof.Fields = append(prof.Fields, &fp)
+	}
+	sort.Slice(prof.Fields, func(i, j int) bool {
+		return prof.Fields[i].Name < prof.Fields[j].Name
+	})
+	return prof
+}
+
+// Conduct is the pre-defined method that makes Profiler a Conduit.
+func (p *Profiler) Conduct(src conduit.Source, trg conduit.Target) error {
+	for inp := range src {
+		switch x := inp.(type) {
+		case Record:
+			p.add(x)
+		case map[string]interface{}:
+			p.add(x)
+		default:
+			if !conduit.IsBarrier(inp) {
+				p.door.Lock()
+				p.skipped++
+				p.door.Unlock()
+			}
+		}
+		trg <- inp
+	}
+	if p.side != nil {
+		p.side <- p.Profile()
+	} else {
+		trg <- p.Profile()
+	}
+	return nil
+}
+
+// Volatile is the pre-defined method that makes Profiler a conduit.Volatile:
+// the field statistics are not included in checkpoints.
+func (p *Profiler) Volatile() bool {
+	return true
+}
+
+func (p *Profiler) add(rec map[string]interface{}) {
+	p.door.Lock()
+	defer p.door.Unlock()
+	p.records++
+	for k, v := range rec {
+		f, ok := p.fields[k]
+		if !ok {
+			f = &fieldStats{types: make(map[ColumnType]uint64)}
+			f.Name, f.Pattern = k, p.patterns[k]
+			p.fields[k] = f
+		}
+		f.add(v)
+	}
+}
+
+func (f *fieldStats) add(v interface{}) {
+	f.Count++
+	if v == nil || v == "" {
+		f.Nulls++
+		return
+	}
+	s := fmt.Sprint(v)
+	f.hll.add(s)
+	if f.Pattern != nil && f.Pattern.MatchString(s) {
+		f.Conforming++
+	}
+	switch x := v.(type) {
+	case bool:
+		f.types[ColBool]++
+	case time.Time:
+		f.types[ColTime]++
+		f.time(x)
+	case string:
+		f.str(x)
+		x = strings.TrimSpace(x)
+		if n, err := strconv.ParseFloat(x, 64); err == nil {
+			if _, err := strconv.ParseInt(x, 10, 64); err == nil {
+				f.types[ColInt]++
+			} else {
+				f.types[ColFloat]++
+			}
+			f.num(n)
+		} else if _, err := strconv.ParseBool(x); err == nil {
+			f.types[ColBool]++
+		} else if t, err := time.Parse(time.RFC3339, x); err == nil {
+			f.types[ColTime]++
+			f.time(t)
+		} else {
+			f.types[ColString]++
+		}
+	default:
+		n, err := toFloat(v)
+		if err != nil {
+			f.other = true
+			f.str(s)
+			return
+		}
+		if n == math.Trunc(n) {
+			f.types[ColInt]++
+		} else {
+			f.types[ColFloat]++
+		}
+		f.num(n)
+	}
+}
+
+func (f *fieldStats) num(n float64) {
+	if !f.hasNum || n < f.minNum {
+		f.minNum = n
+	}
+	if !f.hasNum || n > f.maxNum {
+		f.maxNum = n
+	}
+	f.hasNum = true
+}
+
+func (f *fieldStats) time(t time.Time) {
+	if !f.hasT || t.Before(f.minT) {
+		f.minT = t
+	}
+	if !f.hasT || t.After(f.maxT) {
+		f.maxT = t
+	}
+	f.hasT = true
+}
+
+func (f *fieldStats) str(s string) {
+	if !f.hasS || s < f.minS {
+		f.minS = s
+	}
+	if !f.hasS || s > f.maxS {
+		f.maxS = s
+	}
+	f.hasS = true
+}
+
+// The most specific type that covers all values
+func (f *fieldStats) inferType() (ColumnType, bool) {
+	if f.other {
+		return ColString, true
+	}
+	var found []ColumnType
+	for t, n := range f.types {
+		if n > 0 {
+			found = append(found, t)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return ColString, false
+	case 1:
+		return found[0], false
+	case 2:
+		if f.types[ColInt] > 0 && f.types[ColFloat] > 0 {
+			return ColFloat, false
+		}
+	}
+	return ColString, true
+}
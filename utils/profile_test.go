@@ -0,0 +1,94 @@
+package utils
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+// Profiler:
+// - Items are passed through unchanged, the profile is sent at the end
+// - Null rates, types, min and max are computed per field
+// - Distinct counts are estimated closely
+// - Conformity to patterns is counted
+func TestProfiler(t *testing.T) {
+	t0 := time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC)
+	var items []interface{}
+	for i := 0; i < 10000; i++ {
+		r := Record{"id": float64(i), "email": fmt.Sprintf("u%d@example.com", i%500), "score": "1.5"}
+		if i%4 == 0 {
+			r["email"] = nil
+			r["score"] = "3"
+		}
+		if i%10 == 0 {
+			r["email"] = "broken"
+			r["ts"] = t0.Add(time.Duration(i) * time.Second).Format(time.RFC3339)
+			r["mixed"] = i
+		} else {
+			r["mixed"] = "x"
+		}
+		items = append(items, r)
+	}
+	items = append(items, &conduit.Barrier{}, "not a record", map[string]interface{}{"flag": true})
+	p := NewProfiler().SetPattern("email", regexp.MustCompile(`^[^@]+@[^@]+$`))
+	ac := &AnyConsumer{}
+	if err := conduit.NewChain(&AnyProducer{src: items}, []conduit.Conduit{p}, ac, small).Run(); err != nil {
+		t.Fatalf("Profiler failed: %v", err)
+	}
+	if len(ac.recvd) != len(items)+1 || ac.recvd[0].(Record)["id"] != 0.0 || !conduit.IsBarrier(ac.recvd[10000]) {
+		t.Fatalf("Profiler: received %d items", len(ac.recvd))
+	}
+	prof := ac.recvd[len(items)].(*Profile)
+	if prof.Records != 10001 || prof.Skipped != 1 || len(prof.Fields) != 6 {
+		t.Fatalf("Profiler: unexpected profile %v", prof)
+	}
+	fields := make(map[string]*FieldProfile)
+	for _, f := range prof.Fields {
+		fields[f.Name] = f
+	}
+	id, email, score, ts, mixed := fields["id"], fields["email"], fields["score"], fields["ts"], fields["mixed"]
+	if id.Type != ColInt || id.Min != 0.0 || id.Max != 9999.0 || id.Distinct < 9700 || id.Distinct > 10300 {
+		t.Errorf("Profiler: unexpected id profile %+v", id)
+	}
+	// 2000 nil, 1000 "broken", 350 distinct addresses
+	if email.Type != ColString || email.Nulls != 2000 || email.Conforming != 7000 ||
+		email.Distinct < 340 || email.Distinct > 362 || email.Pattern == nil {
+		t.Errorf("Profiler: unexpected email profile %+v", email)
+	}
+	if r := email.ConformityRate(); r != 0.875 {
+		t.Errorf("Profiler: conformity rate %v", r)
+	}
+	if score.Type != ColFloat || score.Mixed || score.Min != 1.5 || score.Max != 3.0 || score.Distinct != 2 {
+		t.Errorf("Profiler: unexpected score profile %+v", score)
+	}
+	if ts.Type != ColTime || ts.Count != 1000 || ts.NullRate(prof.Records) < 0.9 ||
+		!ts.Min.(time.Time).Equal(t0) || !ts.Max.(time.Time).Equal(t0.Add(9990*time.Second)) {
+		t.Errorf("Profiler: unexpected ts profile %+v", ts)
+	}
+	if !mixed.Mixed || mixed.Type != ColString || fields["flag"].Type != ColBool {
+		t.Errorf("Profiler: unexpected profiles %+v, %+v", mixed, fields["flag"])
+	}
+	if s := prof.String(); !strings.Contains(s, "records: 10001, skipped: 1\n") ||
+		!strings.Contains(s, "email: type string, nulls 20.0%") || !strings.Contains(s, "conforming 87.5%") ||
+		!strings.Contains(s, "mixed: type mixed") {
+		t.Errorf("Profiler: unexpected report %s", s)
+	}
+
+	side := make(chan interface{}, 1)
+	p = NewProfiler()
+	p.SideOutput("profile", side)
+	ac = &AnyConsumer{}
+	if err := conduit.NewChain(&AnyProducer{src: []interface{}{Record{"a": ""}}}, []conduit.Conduit{p}, ac, small).Run(); err != nil {
+		t.Fatalf("Profiler failed: %v", err)
+	}
+	if len(ac.recvd) != 1 || len(side) != 1 {
+		t.Fatalf("Profiler: received %v, %d profiles", ac.recvd, len(side))
+	}
+	if f := (<-side).(*Profile).Fields[0]; f.Name != "a" || f.Nulls != 1 || f.NullRate(1) != 1 || f.Min != nil {
+		t.Errorf("Profiler: unexpected profile %+v", f)
+	}
+}
@@ -0,0 +1,120 @@
+package utils
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/toschoo/conduit"
+)
+
+// ProtoReader is a Producer that reads a length-delimited
+// protobuf stream, i.e. messages each preceded by its length
+// as varint (as written by Java's writeDelimitedTo
+// or protodelim in Go), and sends the messages down the chain.
+type ProtoReader struct {
+	conduit.Cancelable
+	rd        io.Reader
+	unmarshal UnmarshalFunc
+	new       func() interface{}
+	max       uint64
+}
+
+// NewProtoReader creates a new ProtoReader Producer.
+// Messages are decoded with unmarshal (e.g. a wrapper
+// around proto.Unmarshal) into the result of newValue.
+// If unmarshal is nil, messages are sent undecoded as []byte.
+func NewProtoReader(r io.Reader, unmarshal UnmarshalFunc, newValue func() interface{}) (pr *ProtoReader) {
+	pr = new(ProtoReader)
+	if pr != nil {
+		pr.rd = r
+		pr.unmarshal = unmarshal
+		pr.new = newValue
+		pr.max = 64 * 1024 * 1024
+	}
+	return
+}
+
+// SetMaxSize sets the maximum size of a message (default 64MiB).
+// Larger messages terminate the producer with an error.
+func (pr *ProtoReader) SetMaxSize(n uint64) *ProtoReader {
+	pr.max = n
+	return pr
+}
+
+// Produce is the pre-defined method that makes ProtoReader a Producer.
+func (pr *ProtoReader) Produce(trg conduit.Target) error {
+	br := bufio.NewReader(pr.rd)
+	for !pr.Canceled() {
+		n, err := binary.ReadUvarint(br)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if n > pr.max {
+			return errors.New(fmt.Sprintf("message too large: %d bytes", n))
+		}
+		buf := make([]byte, n)
+		_, err = io.ReadFull(br, buf)
+		if err != nil {
+			return err
+		}
+		if pr.unmarshal == nil {
+			trg <- buf
+			continue
+		}
+		v, err := unmarshalNew(pr.unmarshal, buf, pr.new)
+		if err != nil {
+			return err
+		}
+		trg <- v
+	}
+	return nil
+}
+
+// ProtoWriter is a Consumer that writes incoming messages
+// as length-delimited protobuf stream.
+type ProtoWriter struct {
+	wt      io.Writer
+	marshal MarshalFunc
+}
+
+// NewProtoWriter creates a new ProtoWriter Consumer
+// encoding messages with marshal (e.g. a wrapper around proto.Marshal).
+// If marshal is nil, items must be encoded messages as []byte.
+func NewProtoWriter(w io.Writer, marshal MarshalFunc) (pw *ProtoWriter) {
+	pw = new(ProtoWriter)
+	if pw != nil {
+		pw.wt = w
+		pw.marshal = marshal
+	}
+	return
+}
+
+// Consume is the pre-defined method that makes ProtoWriter a Consumer.
+// Consume terminates with an error if an item cannot be encoded.
+func (pw *ProtoWriter) Consume(src conduit.Source) error {
+	bw := bufio.NewWriter(pw.wt)
+	var hdr [binary.MaxVarintLen64]byte
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			err := bw.Flush()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		buf, err := encodeDoc(pw.marshal, inp)
+		if err != nil {
+			return err
+		}
+		n := binary.PutUvarint(hdr[:], uint64(len(buf)))
+		bw.Write(hdr[:n])
+		bw.Write(buf)
+	}
+	return bw.Flush()
+}
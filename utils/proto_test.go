@@ -0,0 +1,77 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/toschoo/conduit"
+)
+
+// Length-delimited stream (with JSON standing in for protobuf):
+// - Messages are written and read back without errors
+// - Oversized messages are reported
+func TestProtoChain(t *testing.T) {
+	for i := 0; i < numOfTests; i++ {
+		err := testProtoChain(i)
+		if err != nil {
+			m := fmt.Sprintf("ProtoChain failed: %v", err)
+			t.Error(m)
+		}
+	}
+}
+
+func testProtoChain(n int) error {
+
+	points := makePoints(n)
+
+	var buf bytes.Buffer
+	chn := conduit.NewChain(&AnyProducer{points}, nil, NewProtoWriter(&buf, json.Marshal), small)
+	err := chn.Run()
+	if err != nil {
+		m := fmt.Sprintf("error on writing: %v", chn.Errs)
+		return errors.New(m)
+	}
+	data := buf.Bytes()
+
+	c := new(AnyConsumer)
+	chn = conduit.NewChain(NewProtoReader(bytes.NewReader(data), json.Unmarshal, newPoint), nil, c, small)
+	err = chn.Run()
+	if err != nil {
+		m := fmt.Sprintf("error on reading: %v", chn.Errs)
+		return errors.New(m)
+	}
+	if len(c.recvd) != n {
+		m := fmt.Sprintf("expected %d items, have %d", n, len(c.recvd))
+		return errors.New(m)
+	}
+	for i, v := range c.recvd {
+		if *v.(*Point) != *points[i].(*Point) {
+			return errors.New("Received values differ from original!")
+		}
+	}
+
+	if n > 0 {
+		p := NewProtoReader(bytes.NewReader(data), nil, nil).SetMaxSize(4)
+		chn = conduit.NewChain(p, nil, new(AnyConsumer), small)
+		if chn.Run() == nil {
+			return errors.New("oversized message not reported")
+		}
+	}
+	return nil
+}
+
+// Length-delimited stream barrier:
+// - Messages preceding a barrier are flushed at the barrier
+func TestProtoBarrier(t *testing.T) {
+	w := new(chunkWriter)
+	err := consumeWithBarrier(NewProtoWriter(w, nil), "abc", "de")
+	if err != nil {
+		t.Fatalf("ProtoBarrier failed: %v", err)
+	}
+	if len(w.chunks) != 2 || w.chunks[0] != "\x03abc" {
+		t.Errorf("ProtoBarrier: unexpected writes %q", w.chunks)
+	}
+}
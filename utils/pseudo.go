@@ -0,0 +1,199 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/toschoo/conduit"
+)
+
+// PseudoMode defines how Pseudonymizer creates tokens.
+type PseudoMode int
+
+const (
+	// PseudoHMAC replaces values by the first 32 hex digits
+	// of their HMAC-SHA-256 (irreversible).
+	PseudoHMAC PseudoMode = iota
+	// PseudoFPE replaces values by format-preserving encryption:
+	// digits are replaced by digits (if the value contains only digits
+	// apart from other characters) or letters and digits by letters
+	// and digits; all other characters (e.g. '-' or '@') are kept.
+	// Tokens can be decrypted with Reveal.
+	PseudoFPE
+)
+
+const (
+	fpeRounds   = 10
+	fpeDigits   = "0123456789"
+	fpeAlphaNum = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+)
+
+// Pseudonymizer is a Conduit that replaces the values of identifier fields
+// in records (Record or map[string]interface{}) by deterministic tokens
+// derived from a secret key: equal values result in equal tokens,
+// so that pseudonymized datasets can still be joined
+// if they were processed with the same key.
+// Values are formatted with fmt.Sprint, tokens are strings;
+// missing fields and nil are kept.
+// The converted copies of the records are sent down the chain.
+type Pseudonymizer struct {
+	key    []byte
+	fields []string
+	mode   PseudoMode
+}
+
+// NewPseudonymizer creates a new Pseudonymizer Conduit
+// for the given fields with the given key.
+func NewPseudonymizer(key []byte, fields ...string) (p *Pseudonymizer) {
+	if len(key) == 0 || len(fields) == 0 {
+		return nil
+	}
+	p = new(Pseudonymizer)
+	if p != nil {
+		p.key = key
+		p.fields = fields
+	}
+	return
+}
+
+// SetMode sets the PseudoMode (default: PseudoHMAC).
+func (p *Pseudonymizer) SetMode(mode PseudoMode) *Pseudonymizer {
+	p.mode = mode
+	return p
+}
+
+// Token returns the token for a value.
+// With PseudoFPE, values must contain at least 2 letters or digits.
+func (p *Pseudonymizer) Token(value string) (string, error) {
+	if p.mode == PseudoFPE {
+		return p.fpe(value, true)
+	}
+	h := hmac.New(sha256.New, p.key)
+	h.Write([]byte(value))
+	return hex.EncodeToString(h.Sum(nil)[:16]), nil
+}
+
+// Reveal returns the value for a token created with PseudoFPE.
+func (p *Pseudonymizer) Reveal(token string) (string, error) {
+	if p.mode != PseudoFPE {
+		return "", errors.New("tokens are only reversible with PseudoFPE")
+	}
+	return p.fpe(token, false)
+}
+
+// Encrypts or decrypts the letters and digits of s
+// with a Feistel network on numerals of radix 10 or 62
+func (p *Pseudonymizer) fpe(s string, encrypt bool) (string, error) {
+	alphabet := fpeDigits
+	var pos []int
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= '0' && c <= '9':
+		case c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z':
+			alphabet = fpeAlphaNum
+		default:
+			continue
+		}
+		pos = append(pos, i)
+	}
+	if len(pos) < 2 {
+		return "", errors.New(fmt.Sprintf("'%s' too short for format-preserving encryption", s))
+	}
+	radix := len(alphabet)
+	num := make([]int, len(pos))
+	for i, j := range pos {
+		num[i] = strings.IndexByte(alphabet, s[j])
+	}
+	u := len(num) / 2
+	a, b := append([]int{}, num[:u]...), append([]int{}, num[u:]...)
+	if encrypt {
+		// (A, B) -> (B, A + F(i, B))
+		for i := 0; i < fpeRounds; i++ {
+			f := p.round(i, radix, b, len(a))
+			for j := range a {
+				a[j] = (a[j] + f[j]) % radix
+			}
+			a, b = b, a
+		}
+	} else {
+		// (X, Y) -> (Y - F(i, X), X)
+		for i := fpeRounds - 1; i >= 0; i-- {
+			f := p.round(i, radix, a, len(b))
+			for j := range b {
+				b[j] = (b[j] - f[j] + radix) % radix
+			}
+			a, b = b, a
+		}
+	}
+	out := []byte(s)
+	for i, d := range append(a, b...) {
+		out[pos[i]] = alphabet[d]
+	}
+	return string(out), nil
+}
+
+// The round function: n numerals derived from the HMAC of round and half
+func (p *Pseudonymizer) round(i, radix int, half []int, n int) []int {
+	f := make([]int, 0, n)
+	for ctr := 0; len(f) < n; ctr++ {
+		h := hmac.New(sha256.New, p.key)
+		h.Write([]byte{byte(i), byte(radix), byte(ctr)})
+		for _, d := range half {
+			h.Write([]byte{byte(d)})
+		}
+		for _, x := range h.Sum(nil) {
+			if len(f) == n {
+				break
+			}
+			f = append(f, int(x)%radix)
+		}
+	}
+	return f
+}
+
+// Conduct is the pre-defined method that makes Pseudonymizer a Conduit.
+// Conduct terminates with an error if an item is not a record
+// or a value cannot be converted.
+func (p *Pseudonymizer) Conduct(src conduit.Source, trg conduit.Target) error {
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			trg <- inp
+			continue
+		}
+		var rec map[string]interface{}
+		switch x := inp.(type) {
+		case Record:
+			rec = x
+		case map[string]interface{}:
+			rec = x
+		default:
+			return errors.New(fmt.Sprintf("cannot pseudonymize %T", inp))
+		}
+		out := make(map[string]interface{}, len(rec))
+		for k, v := range rec {
+			out[k] = v
+		}
+		for _, f := range p.fields {
+			v, ok := out[f]
+			if !ok || v == nil {
+				continue
+			}
+			tok, err := p.Token(fmt.Sprint(v))
+			if err != nil {
+				return errors.New(fmt.Sprintf("field '%s': %v", f, err))
+			}
+			out[f] = tok
+		}
+		if _, ok := inp.(Record); ok {
+			trg <- Record(out)
+		} else {
+			trg <- out
+		}
+	}
+	return nil
+}
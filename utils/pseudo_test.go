@@ -0,0 +1,84 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/toschoo/conduit"
+)
+
+// Pseudonymizer:
+// - Equal identifiers result in equal tokens, different keys in different tokens
+// - Format-preserving tokens keep length, character classes and separators
+// - Format-preserving tokens can be revealed
+// - Other fields, missing fields and nil are kept
+func TestPseudonymizer(t *testing.T) {
+	if NewPseudonymizer(nil, "id") != nil || NewPseudonymizer([]byte("k")) != nil {
+		t.Errorf("Pseudonymizer: invalid arguments accepted")
+	}
+	p := NewPseudonymizer([]byte("secret"), "user", "id")
+	items := []interface{}{
+		Record{"user": "alice", "id": 42.0, "amount": 1.5},
+		&conduit.Barrier{},
+		map[string]interface{}{"user": "alice", "id": nil},
+		Record{"id": "42"},
+	}
+	ac := &AnyConsumer{}
+	if err := conduit.NewChain(&AnyProducer{src: items}, []conduit.Conduit{p}, ac, small).Run(); err != nil {
+		t.Fatalf("Pseudonymizer failed: %v", err)
+	}
+	if len(ac.recvd) != 4 || !conduit.IsBarrier(ac.recvd[1]) {
+		t.Fatalf("Pseudonymizer: received %v", ac.recvd)
+	}
+	r1, m, r2 := ac.recvd[0].(Record), ac.recvd[2].(map[string]interface{}), ac.recvd[3].(Record)
+	if len(r1["user"].(string)) != 32 || r1["user"] == "alice" || r1["user"] != m["user"] ||
+		r1["id"] != r2["id"] || r1["user"] == r1["id"] || r1["amount"] != 1.5 || m["id"] != nil {
+		t.Errorf("Pseudonymizer: unexpected records %v, %v, %v", r1, m, r2)
+	}
+	if items[0].(Record)["user"] != "alice" {
+		t.Errorf("Pseudonymizer: input modified")
+	}
+	other, _ := NewPseudonymizer([]byte("other"), "user").Token("alice")
+	if other == r1["user"] {
+		t.Errorf("Pseudonymizer: token independent of key")
+	}
+	if _, err := p.Reveal(other); err == nil {
+		t.Errorf("Pseudonymizer: HMAC token revealed")
+	}
+
+	p = NewPseudonymizer([]byte("secret"), "phone", "email").SetMode(PseudoFPE)
+	for _, v := range []string{"555-0123-4567", "4111111111111111", "jane.doe@example.com", "ab", "X1"} {
+		tok, err := p.Token(v)
+		if err != nil {
+			t.Fatalf("Pseudonymizer: %s: %v", v, err)
+		}
+		if tok == v || len(tok) != len(v) {
+			t.Errorf("Pseudonymizer: unexpected token %q for %q", tok, v)
+		}
+		for i := 0; i < len(v); i++ {
+			digit := func(c byte) bool { return c >= '0' && c <= '9' }
+			alnum := func(c byte) bool { return digit(c) || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' }
+			if alnum(v[i]) != alnum(tok[i]) || strings.Trim(v, "0123456789-") == "" && !digit(tok[i]) && digit(v[i]) {
+				t.Errorf("Pseudonymizer: token %q does not preserve the format of %q", tok, v)
+				break
+			}
+		}
+		again, _ := p.Token(v)
+		back, err := p.Reveal(tok)
+		if again != tok || err != nil || back != v {
+			t.Errorf("Pseudonymizer: %q -> %q -> %q (%v)", v, tok, back, err)
+		}
+	}
+	if _, err := p.Token("a-"); err == nil {
+		t.Errorf("Pseudonymizer: short value accepted")
+	}
+
+	chn := conduit.NewChain(&AnyProducer{src: []interface{}{Record{"phone": "1"}}}, []conduit.Conduit{p}, &AnyConsumer{}, small)
+	if err := chn.Run(); err == nil {
+		t.Errorf("Pseudonymizer: short value accepted")
+	}
+	chn = conduit.NewChain(&AnyProducer{src: []interface{}{"text"}}, []conduit.Conduit{p}, &AnyConsumer{}, small)
+	if err := chn.Run(); err == nil {
+		t.Errorf("Pseudonymizer: text accepted")
+	}
+}
@@ -0,0 +1,552 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+const (
+	pubsubMaxBatch = 1000
+	pubsubMaxBytes = 10 * 1024 * 1024
+	pubsubMaxIDs   = 1000
+)
+
+// PubSubMsg is a Google Cloud Pub/Sub message.
+// DeliveryAttempt is only set for subscriptions
+// with a dead letter policy.
+type PubSubMsg struct {
+	ID              string
+	AckID           string
+	Data            []byte
+	Attributes      map[string]string
+	OrderingKey     string
+	PublishTime     time.Time
+	DeliveryAttempt int
+}
+
+// Messages pulled but not yet acknowledged
+type pubsubFlight struct {
+	door  sync.Mutex
+	msgs  map[string]time.Time // ack ID -> time of reception
+	bytes int
+	sizes map[string]int
+	done  []string
+}
+
+func (f *pubsubFlight) reset() {
+	f.door.Lock()
+	defer f.door.Unlock()
+	f.msgs = make(map[string]time.Time)
+	f.sizes = make(map[string]int)
+	f.bytes = 0
+	f.done = nil
+}
+
+func (f *pubsubFlight) add(id string, size int) {
+	f.door.Lock()
+	defer f.door.Unlock()
+	f.msgs[id] = time.Now()
+	f.sizes[id] = size
+	f.bytes += size
+}
+
+// Marks a message for acknowledgment
+func (f *pubsubFlight) ack(id string) {
+	f.door.Lock()
+	defer f.door.Unlock()
+	f.done = append(f.done, id)
+}
+
+// Ack IDs of the messages marked for acknowledgment
+func (f *pubsubFlight) take() []string {
+	f.door.Lock()
+	defer f.door.Unlock()
+	ids := f.done
+	for _, id := range ids {
+		delete(f.msgs, id)
+		f.bytes -= f.sizes[id]
+		delete(f.sizes, id)
+	}
+	f.done = nil
+	return ids
+}
+
+// Number and size of the outstanding messages
+func (f *pubsubFlight) outstanding() (int, int) {
+	f.door.Lock()
+	defer f.door.Unlock()
+	return len(f.msgs), f.bytes
+}
+
+// Ack IDs of the messages received after since
+func (f *pubsubFlight) since(since time.Time) []string {
+	f.door.Lock()
+	defer f.door.Unlock()
+	var ids []string
+	for id, t := range f.msgs {
+		if t.After(since) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// PubSubSubscriber is a Producer that pulls the messages
+// of a Google Cloud Pub/Sub subscription
+// and sends them as *PubSubMsg down the chain.
+// Messages are acknowledged by default when they have been
+// sent down the chain or, with AckOnCheckpoint,
+// when a checkpoint of the chain covers them
+// (see conduit.Chain.SetCheckpoints and conduit.Committer).
+// While messages are not acknowledged, their ack deadline
+// is extended every half deadline, up to the maximum extension,
+// so that they are not redelivered during processing.
+// Flow control limits the number and size of the messages
+// that are outstanding (pulled but not acknowledged);
+// the subscriber pulls only when there is room.
+// When the producer stops, outstanding messages
+// are released for immediate redelivery (at least once).
+// The producer runs until the chain is canceled or terminates
+// with an error when pulling fails after all attempts.
+type PubSubSubscriber struct {
+	conduit.Cancelable
+	gcp          gcpClient
+	sub          string
+	batch        int
+	maxMsgs      int
+	maxBytes     int
+	deadline     time.Duration
+	maxExtension time.Duration
+	retry        RetryPolicy
+	onCP         bool
+	acks         ackQueue
+	flight       pubsubFlight
+	door         sync.Mutex
+	cancel       context.CancelFunc
+}
+
+// NewPubSubSubscriber creates a new PubSubSubscriber Producer
+// pulling from subscription.
+func NewPubSubSubscriber(cfg GCPConfig, subscription string) (ps *PubSubSubscriber) {
+	if subscription == "" {
+		return nil
+	}
+	ps = new(PubSubSubscriber)
+	if ps != nil {
+		ps.gcp = newGCPClient(cfg, "pubsub")
+		ps.sub = ps.gcp.resource("subscriptions", subscription)
+		ps.batch = 100
+		ps.maxMsgs = 1000
+		ps.maxBytes = 100 * 1024 * 1024
+		ps.deadline = 10 * time.Second
+		ps.maxExtension = time.Hour
+		ps.retry = DefaultRetry
+	}
+	return
+}
+
+// SetBatch sets the maximum number of messages
+// per pull request (default 100).
+func (ps *PubSubSubscriber) SetBatch(n int) *PubSubSubscriber {
+	if n > 0 {
+		ps.batch = n
+	}
+	return ps
+}
+
+// SetFlowControl sets the maximum number of messages
+// and bytes outstanding (default 1000 messages and 100 MiB);
+// 0 means no limit.
+func (ps *PubSubSubscriber) SetFlowControl(msgs, bytes int) *PubSubSubscriber {
+	ps.maxMsgs = msgs
+	ps.maxBytes = bytes
+	return ps
+}
+
+// SetAckDeadline sets the ack deadline requested
+// for outstanding messages (default 10s).
+func (ps *PubSubSubscriber) SetAckDeadline(d time.Duration) *PubSubSubscriber {
+	if d >= time.Second {
+		ps.deadline = d
+	}
+	return ps
+}
+
+// SetMaxExtension sets how long the ack deadline
+// of a message is extended at most (default 1h).
+func (ps *PubSubSubscriber) SetMaxExtension(d time.Duration) *PubSubSubscriber {
+	ps.maxExtension = d
+	return ps
+}
+
+// SetRetry sets the RetryPolicy for requests (default: DefaultRetry).
+func (ps *PubSubSubscriber) SetRetry(rp RetryPolicy) *PubSubSubscriber {
+	ps.retry = rp
+	return ps
+}
+
+// AckOnCheckpoint acknowledges messages only when
+// a checkpoint covers them.
+func (ps *PubSubSubscriber) AckOnCheckpoint() *PubSubSubscriber {
+	ps.onCP = true
+	return ps
+}
+
+// Resume is the pre-defined method that makes PubSubSubscriber
+// a conduit.Resumer. Messages that were not acknowledged
+// are redelivered, so nothing is skipped.
+func (ps *PubSubSubscriber) Resume(pos uint64) error {
+	ps.acks.resume(pos)
+	return nil
+}
+
+// Commit is the pre-defined method that makes PubSubSubscriber
+// a conduit.Committer; with AckOnCheckpoint, it acknowledges
+// the messages covered by the checkpoint.
+func (ps *PubSubSubscriber) Commit(cp *conduit.Checkpoint) error {
+	if !ps.onCP {
+		return nil
+	}
+	err := ps.acks.commit(cp.Position)
+	if err != nil {
+		return err
+	}
+	return ps.acknowledge()
+}
+
+// Cancel cancels the producer and the pending request.
+func (ps *PubSubSubscriber) Cancel() {
+	ps.Cancelable.Cancel()
+	ps.door.Lock()
+	defer ps.door.Unlock()
+	if ps.cancel != nil {
+		ps.cancel()
+	}
+}
+
+// Produce is the pre-defined method that makes PubSubSubscriber a Producer.
+func (ps *PubSubSubscriber) Produce(trg conduit.Target) error {
+	ps.acks.start()
+	ps.flight.reset()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ps.door.Lock()
+	ps.cancel = cancel
+	ps.door.Unlock()
+	if ps.Canceled() {
+		return nil
+	}
+	go ps.extend(ctx)
+	defer ps.release()
+	for !ps.Canceled() {
+		n := ps.room()
+		if n == 0 {
+			sleep(10*time.Millisecond, ps.Canceled)
+			continue
+		}
+		msgs, err := ps.pull(ctx, n)
+		if ps.Canceled() {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			ps.flight.add(m.AckID, len(m.Data))
+			id := m.AckID
+			if ps.onCP {
+				ps.acks.add(func() error {
+					ps.flight.ack(id)
+					return nil
+				})
+			}
+			trg <- m
+			if !ps.onCP {
+				ps.flight.ack(id)
+			}
+		}
+		if !ps.onCP {
+			err = ps.acknowledge()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Number of messages that can be pulled under flow control
+func (ps *PubSubSubscriber) room() int {
+	msgs, bytes := ps.flight.outstanding()
+	if ps.maxBytes > 0 && bytes >= ps.maxBytes {
+		return 0
+	}
+	n := ps.batch
+	if ps.maxMsgs > 0 && ps.maxMsgs-msgs < n {
+		n = ps.maxMsgs - msgs
+	}
+	if n < 0 {
+		return 0
+	}
+	return n
+}
+
+// Calls a method of the subscription with retries
+func (ps *PubSubSubscriber) call(ctx context.Context, method string, in, out interface{}) error {
+	attempts, err := ps.retry.run(ps.Canceled, func() (bool, error) {
+		err := ps.gcp.post(ctx, "v1/"+ps.sub+":"+method, in, out)
+		return gcpRetryable(err), err
+	})
+	if err != nil {
+		return errors.New(fmt.Sprintf("%s failed after %d attempts: %v", method, attempts, err))
+	}
+	return nil
+}
+
+// Pulls up to n messages
+func (ps *PubSubSubscriber) pull(ctx context.Context, n int) ([]*PubSubMsg, error) {
+	var rsp struct {
+		ReceivedMessages []struct {
+			AckID   string `json:"ackId"`
+			Message struct {
+				Data        []byte            `json:"data"`
+				Attributes  map[string]string `json:"attributes"`
+				MessageID   string            `json:"messageId"`
+				PublishTime time.Time         `json:"publishTime"`
+				OrderingKey string            `json:"orderingKey"`
+			} `json:"message"`
+			DeliveryAttempt int `json:"deliveryAttempt"`
+		} `json:"receivedMessages"`
+	}
+	err := ps.call(ctx, "pull", map[string]interface{}{"maxMessages": n}, &rsp)
+	if err != nil {
+		return nil, err
+	}
+	msgs := make([]*PubSubMsg, len(rsp.ReceivedMessages))
+	for i, r := range rsp.ReceivedMessages {
+		msgs[i] = &PubSubMsg{
+			ID:              r.Message.MessageID,
+			AckID:           r.AckID,
+			Data:            r.Message.Data,
+			Attributes:      r.Message.Attributes,
+			OrderingKey:     r.Message.OrderingKey,
+			PublishTime:     r.Message.PublishTime,
+			DeliveryAttempt: r.DeliveryAttempt,
+		}
+	}
+	return msgs, nil
+}
+
+// Sends the ack IDs in chunks to method
+func (ps *PubSubSubscriber) modify(ctx context.Context, method string, ids []string, extra map[string]interface{}) error {
+	for len(ids) > 0 {
+		n := len(ids)
+		if n > pubsubMaxIDs {
+			n = pubsubMaxIDs
+		}
+		req := map[string]interface{}{"ackIds": ids[:n]}
+		for k, v := range extra {
+			req[k] = v
+		}
+		err := ps.call(ctx, method, req, nil)
+		if err != nil {
+			return err
+		}
+		ids = ids[n:]
+	}
+	return nil
+}
+
+// Acknowledges the messages marked for acknowledgment
+func (ps *PubSubSubscriber) acknowledge() error {
+	return ps.modify(context.Background(), "acknowledge", ps.flight.take(), nil)
+}
+
+// Extends the ack deadline of the outstanding messages
+// every half deadline
+func (ps *PubSubSubscriber) extend(ctx context.Context) {
+	t := time.NewTicker(ps.deadline / 2)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+		ids := ps.flight.since(time.Now().Add(-ps.maxExtension))
+		// if extending fails, the message may be redelivered
+		ps.modify(ctx, "modifyAckDeadline", ids, map[string]interface{}{
+			"ackDeadlineSeconds": int(ps.deadline / time.Second),
+		})
+	}
+}
+
+// Releases the outstanding messages for redelivery
+func (ps *PubSubSubscriber) release() {
+	ps.acknowledge()
+	ids := ps.flight.since(time.Time{})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ps.modify(ctx, "modifyAckDeadline", ids, map[string]interface{}{"ackDeadlineSeconds": 0})
+}
+
+// Message to be published
+type pubsubEntry struct {
+	item        interface{}
+	Data        []byte            `json:"data"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
+	OrderingKey string            `json:"orderingKey,omitempty"`
+}
+
+func (e *pubsubEntry) source() interface{} { return e.item }
+func (e *pubsubEntry) size() int           { return len(e.Data) + len(e.OrderingKey) }
+
+// PubSubPublisher is a Consumer that publishes the incoming items
+// to a Google Cloud Pub/Sub topic in batches.
+// []byte and string items are sent as they are,
+// *PubSubMsg items with their data, attributes and ordering key
+// and others are encoded with a MarshalFunc (default: json.Marshal).
+// With SetOrderingKey, messages are published with ordering keys,
+// so that subscribers with message ordering receive messages
+// with the same key in order; when a message with an ordering key
+// finally fails, the following messages with that key
+// fail as well, since publishing them would break the order.
+// Batches hold up to 100 messages (see SetBatch) and are sent
+// when they are full, at barriers and at the end of the stream.
+// Requests that fail with a retryable error are sent again
+// according to the RetryPolicy (DefaultRetry).
+// Messages that finally fail are sent as FailedRequest
+// to the side output "failed" (see conduit.SideOutputter)
+// or, if the side output is not connected,
+// terminate the consumer with an error.
+type PubSubPublisher struct {
+	gcp     gcpClient
+	topic   string
+	batch   int
+	key     KeyFunc
+	marshal MarshalFunc
+	retry   RetryPolicy
+	side    conduit.Target
+	paused  map[string]bool
+}
+
+// NewPubSubPublisher creates a new PubSubPublisher Consumer
+// publishing to topic.
+func NewPubSubPublisher(cfg GCPConfig, topic string) (pp *PubSubPublisher) {
+	if topic == "" {
+		return nil
+	}
+	pp = new(PubSubPublisher)
+	if pp != nil {
+		pp.gcp = newGCPClient(cfg, "pubsub")
+		pp.topic = pp.gcp.resource("topics", topic)
+		pp.batch = 100
+		pp.marshal = json.Marshal
+		pp.retry = DefaultRetry
+	}
+	return
+}
+
+// SetBatch sets the maximum number of messages
+// per request (1 - 1000, default 100).
+func (pp *PubSubPublisher) SetBatch(n int) *PubSubPublisher {
+	if n > 0 && n <= pubsubMaxBatch {
+		pp.batch = n
+	}
+	return pp
+}
+
+// SetOrderingKey sets the KeyFunc that obtains the ordering key of items.
+func (pp *PubSubPublisher) SetOrderingKey(kf KeyFunc) *PubSubPublisher {
+	pp.key = kf
+	return pp
+}
+
+// SetMarshal sets the MarshalFunc.
+func (pp *PubSubPublisher) SetMarshal(marshal MarshalFunc) *PubSubPublisher {
+	pp.marshal = marshal
+	return pp
+}
+
+// SetRetry sets the RetryPolicy (default: DefaultRetry).
+func (pp *PubSubPublisher) SetRetry(rp RetryPolicy) *PubSubPublisher {
+	pp.retry = rp
+	return pp
+}
+
+// SideOutput is the pre-defined method that makes PubSubPublisher
+// a conduit.SideOutputter; name must be "failed".
+func (pp *PubSubPublisher) SideOutput(name string, trg conduit.Target) {
+	if name == "failed" {
+		pp.side = trg
+	}
+}
+
+// Consume is the pre-defined method that makes PubSubPublisher a Consumer.
+func (pp *PubSubPublisher) Consume(src conduit.Source) error {
+	pp.paused = make(map[string]bool)
+	failed := sideFailed(pp.side)
+	if failed != nil {
+		side := failed
+		failed = func(f *FailedRequest) {
+			if k := f.Item.(*pubsubEntry).OrderingKey; k != "" {
+				pp.paused[k] = true
+			}
+			side(f)
+		}
+	}
+	return consumeBatches(src, pp.batch, pubsubMaxBytes, pp.retry, failed, pp.entry, pp.send)
+}
+
+// Creates the message for an item
+func (pp *PubSubPublisher) entry(inp interface{}) (batchEntry, error) {
+	if m, ok := inp.(*PubSubMsg); ok {
+		return &pubsubEntry{item: inp, Data: m.Data, Attributes: m.Attributes, OrderingKey: m.OrderingKey}, nil
+	}
+	data, err := payload(inp, pp.marshal)
+	if err != nil {
+		return nil, err
+	}
+	e := &pubsubEntry{item: inp, Data: data}
+	if pp.key != nil {
+		e.OrderingKey = keyOf(pp.key, inp)
+	}
+	return e, nil
+}
+
+// Publishes a batch; messages with paused ordering keys
+// fail without being sent
+func (pp *PubSubPublisher) send(entries []interface{}) ([]batchFailure, error) {
+	var fs []batchFailure
+	var msgs []interface{}
+	var index []int
+	for i, inp := range entries {
+		e := inp.(*pubsubEntry)
+		if pp.paused[e.OrderingKey] {
+			err := errors.New(fmt.Sprintf("ordering key %s paused after failure", e.OrderingKey))
+			fs = append(fs, batchFailure{index: i, err: err})
+			continue
+		}
+		msgs = append(msgs, e)
+		index = append(index, i)
+	}
+	if len(msgs) == 0 {
+		return fs, nil
+	}
+	err := pp.gcp.post(context.Background(), "v1/"+pp.topic+":publish", map[string]interface{}{"messages": msgs}, nil)
+	if err != nil && gcpRetryable(err) {
+		return nil, err
+	}
+	if err != nil {
+		for _, i := range index {
+			fs = append(fs, batchFailure{index: i, err: err})
+		}
+	}
+	return fs, nil
+}
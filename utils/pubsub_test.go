@@ -0,0 +1,358 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+// Pub/Sub test server: one topic with one subscription,
+// requests with message "poison" are rejected,
+// requests with message "flaky" fail once
+type pubsubServer struct {
+	srv       *httptest.Server
+	door      sync.Mutex
+	msgs      []*pubsubStored
+	flaky     bool
+	delivered int
+	acked     int
+	released  int
+	extended  int
+}
+
+type pubsubStored struct {
+	id        string
+	data      []byte
+	key       string
+	ackID     string
+	deadline  time.Time
+	acked     bool
+	delivered int
+}
+
+func newPubSubServer() *pubsubServer {
+	ps := &pubsubServer{}
+	ps.srv = httptest.NewServer(http.HandlerFunc(ps.handle))
+	return ps
+}
+
+func (ps *pubsubServer) config() GCPConfig {
+	return GCPConfig{Project: "p", Token: StaticToken("secret"), Endpoint: ps.srv.URL}
+}
+
+// Numbers of deliveries, acknowledged and released messages
+func (ps *pubsubServer) counts() (int, int, int) {
+	ps.door.Lock()
+	defer ps.door.Unlock()
+	return ps.delivered, ps.acked, ps.released
+}
+
+// Number of ack deadline extensions
+func (ps *pubsubServer) extensions() int {
+	ps.door.Lock()
+	defer ps.door.Unlock()
+	return ps.extended
+}
+
+// Data of the stored messages with ordering key
+func (ps *pubsubServer) stored() []string {
+	ps.door.Lock()
+	defer ps.door.Unlock()
+	var data []string
+	for _, m := range ps.msgs {
+		data = append(data, m.key+":"+string(m.data))
+	}
+	return data
+}
+
+// Stored message with ack ID id
+func (ps *pubsubServer) msg(id string) *pubsubStored {
+	for _, m := range ps.msgs {
+		if m.ackID == id {
+			return m
+		}
+	}
+	return nil
+}
+
+func (ps *pubsubServer) handle(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	var req struct {
+		MaxMessages        int
+		AckIds             []string
+		AckDeadlineSeconds int
+		Messages           []struct {
+			Data        []byte
+			OrderingKey string
+		}
+	}
+	json.NewDecoder(r.Body).Decode(&req)
+	var rsp interface{} = map[string]interface{}{}
+	switch r.URL.Path {
+	case "/v1/projects/p/topics/events:publish":
+		ps.door.Lock()
+		var ids []string
+		for _, m := range req.Messages {
+			if string(m.Data) == "poison" || (string(m.Data) == "flaky" && !ps.flaky) {
+				ps.flaky = true
+				ps.door.Unlock()
+				status := http.StatusBadRequest
+				if string(m.Data) == "flaky" {
+					status = http.StatusServiceUnavailable
+				}
+				w.WriteHeader(status)
+				w.Write([]byte(`{"error":{"message":"rejected","status":"FAILED"}}`))
+				return
+			}
+		}
+		for _, m := range req.Messages {
+			id := fmt.Sprint(len(ps.msgs) + 1)
+			ps.msgs = append(ps.msgs, &pubsubStored{id: id, data: m.Data, key: m.OrderingKey})
+			ids = append(ids, id)
+		}
+		ps.door.Unlock()
+		rsp = map[string]interface{}{"messageIds": ids}
+	case "/v1/projects/p/subscriptions/events-sub:pull":
+		rsp = ps.pull(r, req.MaxMessages)
+	case "/v1/projects/p/subscriptions/events-sub:acknowledge":
+		ps.door.Lock()
+		for _, id := range req.AckIds {
+			if m := ps.msg(id); m != nil && !m.acked {
+				m.acked = true
+				ps.acked++
+			}
+		}
+		ps.door.Unlock()
+	case "/v1/projects/p/subscriptions/events-sub:modifyAckDeadline":
+		ps.door.Lock()
+		for _, id := range req.AckIds {
+			if m := ps.msg(id); m != nil && !m.acked {
+				m.deadline = time.Now().Add(time.Duration(req.AckDeadlineSeconds) * time.Second)
+				if req.AckDeadlineSeconds == 0 {
+					ps.released++
+				} else {
+					ps.extended++
+				}
+			}
+		}
+		ps.door.Unlock()
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error":{"message":"no such resource","status":"NOT_FOUND"}}`))
+		return
+	}
+	json.NewEncoder(w).Encode(rsp)
+}
+
+// Returns up to n messages; waits up to 100ms
+func (ps *pubsubServer) pull(r *http.Request, n int) interface{} {
+	deadline := time.Now().Add(100 * time.Millisecond)
+	for {
+		var msgs []map[string]interface{}
+		now := time.Now()
+		ps.door.Lock()
+		for _, m := range ps.msgs {
+			if len(msgs) == n {
+				break
+			}
+			if m.acked || now.Before(m.deadline) {
+				continue
+			}
+			m.deadline = now.Add(time.Second)
+			m.delivered++
+			ps.delivered++
+			m.ackID = fmt.Sprintf("%s-%d", m.id, m.delivered)
+			msgs = append(msgs, map[string]interface{}{
+				"ackId": m.ackID,
+				"message": map[string]interface{}{
+					"data":        m.data,
+					"messageId":   m.id,
+					"orderingKey": m.key,
+					"publishTime": now,
+				},
+			})
+		}
+		ps.door.Unlock()
+		if len(msgs) > 0 || now.After(deadline) || r.Context().Err() != nil {
+			return map[string]interface{}{"receivedMessages": msgs}
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// Publishes n messages
+func publishPubSub(ps *pubsubServer, n int) error {
+	var items []interface{}
+	for i := 1; i <= n; i++ {
+		items = append(items, fmt.Sprintf("job %d", i))
+	}
+	chn := conduit.NewChain(&AnyProducer{items}, nil, NewPubSubPublisher(ps.config(), "events"), small)
+	if chn.Run() != nil {
+		return errors.New(fmt.Sprintf("cannot publish: %v", chn.Errs))
+	}
+	return nil
+}
+
+func pubsubData(items []interface{}) []string {
+	var data []string
+	for _, inp := range items {
+		data = append(data, string(inp.(*PubSubMsg).Data))
+	}
+	return data
+}
+
+// Pub/Sub:
+// - Items are published in batches, failed requests are retried
+// - Messages with an ordering key are not published after a failure with that key
+// - The subscriber pulls and acknowledges all messages
+func TestPubSub(t *testing.T) {
+	ps := newPubSubServer()
+	defer ps.srv.Close()
+
+	items := []interface{}{"one", &PubSubMsg{Data: []byte("two"), OrderingKey: "k"}, "flaky"}
+	for i := 0; i < 150; i++ {
+		items = append(items, fmt.Sprintf("more %d", i))
+	}
+	pp := NewPubSubPublisher(ps.config(), "events").SetRetry(fastRetry)
+	if err := conduit.NewChain(&AnyProducer{items}, nil, pp, small).Run(); err != nil {
+		t.Fatalf("PubSubPublisher failed: %v", err)
+	}
+
+	c := &TakeConsumer{n: len(items)}
+	sub := NewPubSubSubscriber(ps.config(), "projects/p/subscriptions/events-sub")
+	if err := conduit.NewChain(sub, nil, c, small).Run(); err != nil {
+		t.Fatalf("PubSubSubscriber failed: %v", err)
+	}
+	data := pubsubData(c.recvd)
+	if len(data) != len(items) || data[1] != "two" || data[2] != "flaky" || data[152] != "more 149" {
+		t.Errorf("PubSubSubscriber: unexpected messages %v", data)
+	}
+	if c.recvd[1].(*PubSubMsg).OrderingKey != "k" {
+		t.Errorf("PubSubSubscriber: ordering key lost: %+v", c.recvd[1])
+	}
+	for i := 0; i < 100; i++ {
+		if _, acked, _ := ps.counts(); acked == len(items) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, acked, _ := ps.counts(); acked != len(items) {
+		t.Errorf("PubSubSubscriber: %d messages acknowledged", acked)
+	}
+
+	ps = newPubSubServer()
+	defer ps.srv.Close()
+	items = []interface{}{"a1", "poison", "a2", "b1"}
+	key := func(inp interface{}) string {
+		if inp == "poison" {
+			return "a"
+		}
+		return inp.(string)[:1]
+	}
+	failed := &sideCollector{items: make(chan interface{}, 10)}
+	pp = NewPubSubPublisher(ps.config(), "events").SetBatch(1).SetOrderingKey(key).SetRetry(fastRetry)
+	chn := conduit.NewChain(&AnyProducer{items}, nil, pp, small)
+	chn.AddSide(pp, "failed", failed)
+	if err := chn.Run(); err != nil {
+		t.Fatalf("PubSubPublisher failed: %v", chn.Errs)
+	}
+	f1, f2 := (<-failed.items).(*FailedRequest), (<-failed.items).(*FailedRequest)
+	if f1.Item != "poison" || f2.Item != "a2" || !strings.Contains(f2.Err.Error(), "paused") {
+		t.Errorf("PubSubPublisher: unexpected failed requests %+v %+v", f1, f2)
+	}
+	if stored := ps.stored(); fmt.Sprint(stored) != "[a:a1 b:b1]" {
+		t.Errorf("PubSubPublisher: unexpected messages %v", stored)
+	}
+
+	chn = conduit.NewChain(&AnyProducer{[]interface{}{"one"}}, nil, NewPubSubPublisher(ps.config(), "unknown"), small)
+	if chn.Run() == nil {
+		t.Errorf("PubSubPublisher: rejected message not reported")
+	}
+}
+
+// Pub/Sub with acknowledgment on checkpoints:
+// - Only messages covered by a checkpoint are acknowledged
+// - After a crash, the other messages are released and redelivered
+func TestPubSubCheckpoint(t *testing.T) {
+	ps := newPubSubServer()
+	defer ps.srv.Close()
+	if err := publishPubSub(ps, 300); err != nil {
+		t.Fatalf("PubSubPublisher: %v", err)
+	}
+
+	cps := conduit.NewMemCheckpoints()
+	newSubscriber := func() *PubSubSubscriber {
+		return NewPubSubSubscriber(ps.config(), "events-sub").SetBatch(20).AckOnCheckpoint()
+	}
+	c := &StopConsumer{n: 250, err: errors.New("crash")}
+	sub := newSubscriber()
+	chn := conduit.NewChain(sub, nil, c, small)
+	chn.SetCheckpoints(time.Millisecond, cps)
+	if chn.Run() == nil {
+		t.Fatalf("PubSubSubscriber: chain did not crash")
+	}
+	// the producer is not stopped by the failing consumer
+	sub.Cancel()
+	cp, _ := cps.Latest()
+	if cp == nil {
+		t.Fatalf("PubSubSubscriber: no checkpoint taken")
+	}
+	_, acked, _ := ps.counts()
+	if acked != int(cp.Position) {
+		t.Fatalf("PubSubSubscriber: checkpoint at %d, acknowledged %d", cp.Position, acked)
+	}
+	// wait until the canceled producer released the other messages
+	for i := 0; i < 100; i++ {
+		if delivered, _, released := ps.counts(); released == delivered-acked {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	rest := &StopConsumer{n: 300 - acked, err: conduit.EOS}
+	chn = conduit.NewChain(newSubscriber(), nil, rest, small)
+	chn.SetCheckpoints(time.Millisecond, cps)
+	if err := chn.Run(); err != nil {
+		t.Fatalf("PubSubSubscriber: restarted chain failed: %v", err)
+	}
+	for i, d := range pubsubData(rest.recvd) {
+		if d != fmt.Sprintf("job %d", acked+i+1) {
+			t.Fatalf("PubSubSubscriber: unexpected message %d after restart: %s", i, d)
+		}
+	}
+}
+
+// Pub/Sub flow control:
+// - No more messages are pulled than allowed outstanding
+// - The ack deadline of outstanding messages is extended
+// - Outstanding messages are released when the subscriber stops
+func TestPubSubFlowControl(t *testing.T) {
+	ps := newPubSubServer()
+	defer ps.srv.Close()
+	if err := publishPubSub(ps, 20); err != nil {
+		t.Fatalf("PubSubPublisher: %v", err)
+	}
+	sub := NewPubSubSubscriber(ps.config(), "events-sub").SetFlowControl(5, 0).SetAckDeadline(time.Second).AckOnCheckpoint()
+	c := &LingerConsumer{d: 1600 * time.Millisecond}
+	conduit.NewChain(sub, nil, c, small).Run()
+	sub.Cancel()
+	delivered, acked, released := ps.counts()
+	if delivered != 5 || acked != 0 || released != 5 {
+		t.Errorf("PubSubSubscriber: %d delivered, %d acknowledged, %d released", delivered, acked, released)
+	}
+	// extended every 500ms while the consumer lingers
+	if ps.extensions() < 10 {
+		t.Errorf("PubSubSubscriber: ack deadline extended %d times", ps.extensions())
+	}
+}
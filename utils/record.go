@@ -0,0 +1,19 @@
+package utils
+
+import (
+	"sort"
+)
+
+// Record is a generic structured item,
+// e.g. a decoded JSON object or a row with named columns.
+type Record map[string]interface{}
+
+// Keys returns the field names of the record in sorted order.
+func (r Record) Keys() []string {
+	keys := make([]string, 0, len(r))
+	for k := range r {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,274 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/toschoo/conduit"
+)
+
+// PIIPattern detects personal data in text:
+// matches of Re for which Valid (if not nil) returns true.
+type PIIPattern struct {
+	Name  string
+	Re    *regexp.Regexp
+	Valid func(match string) bool
+}
+
+// Patterns for common kinds of personal data
+var (
+	// PIIEmail detects email addresses.
+	PIIEmail = &PIIPattern{
+		Name: "email",
+		Re:   regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9\-]+(\.[A-Za-z0-9\-]+)*\.[A-Za-z]{2,}`),
+	}
+	// PIICreditCard detects credit card numbers
+	// (13 to 19 digits, optionally grouped by spaces or dashes)
+	// with valid Luhn checksum.
+	PIICreditCard = &PIIPattern{
+		Name:  "credit_card",
+		Re:    regexp.MustCompile(`\b\d(?:[ \-]?\d){12,18}\b`),
+		Valid: luhn,
+	}
+	// PIISSN detects US social security numbers (123-45-6789).
+	PIISSN = &PIIPattern{
+		Name:  "ssn",
+		Re:    regexp.MustCompile(`\b\d{3}-\d{2}-\d{4}\b`),
+		Valid: validSSN,
+	}
+	// PIIIBAN detects international bank account numbers
+	// with valid checksum (ISO 13616).
+	PIIIBAN = &PIIPattern{
+		Name:  "iban",
+		Re:    regexp.MustCompile(`\b[A-Z]{2}\d{2}(?: ?[A-Z0-9]){11,30}\b`),
+		Valid: validIBAN,
+	}
+	// PIIIPv4 detects IPv4 addresses.
+	PIIIPv4 = &PIIPattern{
+		Name: "ipv4",
+		Re:   regexp.MustCompile(`\b(?:(?:25[0-5]|2[0-4]\d|1?\d?\d)\.){3}(?:25[0-5]|2[0-4]\d|1?\d?\d)\b`),
+	}
+)
+
+// Luhn checksum of the digits in s
+func luhn(s string) bool {
+	sum, n := 0, 0
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if n%2 == 1 {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		n++
+	}
+	return n > 0 && sum%10 == 0
+}
+
+// Excludes numbers that are never assigned
+func validSSN(s string) bool {
+	return !strings.HasPrefix(s, "000") && !strings.HasPrefix(s, "666") && s[0] != '9' &&
+		s[4:6] != "00" && s[7:] != "0000"
+}
+
+// Checks the mod-97 checksum of an IBAN
+func validIBAN(s string) bool {
+	s = strings.Replace(s, " ", "", -1)
+	if len(s) < 15 || len(s) > 34 {
+		return false
+	}
+	mod := 0
+	for _, c := range s[4:] + s[:4] {
+		switch {
+		case c >= '0' && c <= '9':
+			mod = (mod*10 + int(c-'0')) % 97
+		case c >= 'A' && c <= 'Z':
+			mod = (mod*100 + int(c-'A'+10)) % 97
+		default:
+			return false
+		}
+	}
+	return mod == 1
+}
+
+// RedactMode defines how Redactor replaces personal data.
+type RedactMode int
+
+const (
+	// RedactMask replaces data by the name of the pattern
+	// in brackets (e.g. "[email]") or, for fields, by "[redacted]".
+	RedactMask RedactMode = iota
+	// RedactHash replaces data by the name of the pattern (or field)
+	// and the first 16 hex digits of its SHA-256 hash
+	// (HMAC-SHA-256 with a key, see SetHashKey),
+	// e.g. "email:3f2a...", so that equal values remain equal.
+	RedactHash
+)
+
+// Redactor is a Conduit that removes personal data
+// from text items ([]byte and string) and records
+// (Record and map[string]interface{}, including nested
+// maps and slices): the values of configured fields (see Fields)
+// are replaced as a whole and text matching one of the
+// PIIPatterns is replaced in all strings.
+// Other items are forwarded unchanged.
+// The number of redactions per pattern and field
+// is available through Counts for auditing.
+type Redactor struct {
+	patterns []*PIIPattern
+	fields   map[string]bool
+	mode     RedactMode
+	key      []byte
+	door     sync.Mutex
+	counts   map[string]uint64
+}
+
+// NewRedactor creates a new Redactor Conduit
+// that detects the given patterns.
+func NewRedactor(patterns ...*PIIPattern) (rd *Redactor) {
+	for _, p := range patterns {
+		if p == nil || p.Re == nil || p.Name == "" {
+			return nil
+		}
+	}
+	rd = new(Redactor)
+	if rd != nil {
+		rd.patterns = patterns
+		rd.fields = make(map[string]bool)
+		rd.counts = make(map[string]uint64)
+	}
+	return
+}
+
+// Fields redacts the values of the fields with the given names
+// at any level of records.
+func (rd *Redactor) Fields(names ...string) *Redactor {
+	for _, n := range names {
+		rd.fields[n] = true
+	}
+	return rd
+}
+
+// SetMode sets the RedactMode (default: RedactMask).
+func (rd *Redactor) SetMode(mode RedactMode) *Redactor {
+	rd.mode = mode
+	return rd
+}
+
+// SetHashKey sets the key for hashing with HMAC-SHA-256,
+// so that hashes cannot be reversed by hashing candidate values.
+func (rd *Redactor) SetHashKey(key []byte) *Redactor {
+	rd.key = key
+	return rd
+}
+
+// Counts returns the number of redactions per pattern
+// and per field since the Redactor was created.
+func (rd *Redactor) Counts() map[string]uint64 {
+	rd.door.Lock()
+	defer rd.door.Unlock()
+	counts := make(map[string]uint64, len(rd.counts))
+	for k, n := range rd.counts {
+		counts[k] = n
+	}
+	return counts
+}
+
+func (rd *Redactor) count(name string) {
+	rd.door.Lock()
+	defer rd.door.Unlock()
+	rd.counts[name]++
+}
+
+// Replacement of value found by name
+func (rd *Redactor) replace(name, value string, field bool) string {
+	rd.count(name)
+	if rd.mode == RedactHash {
+		var sum []byte
+		if len(rd.key) > 0 {
+			h := hmac.New(sha256.New, rd.key)
+			h.Write([]byte(value))
+			sum = h.Sum(nil)
+		} else {
+			s := sha256.Sum256([]byte(value))
+			sum = s[:]
+		}
+		return name + ":" + hex.EncodeToString(sum[:8])
+	}
+	if field {
+		return "[redacted]"
+	}
+	return "[" + name + "]"
+}
+
+// Redacts the matches of the patterns in s
+func (rd *Redactor) text(s string) string {
+	for _, p := range rd.patterns {
+		s = p.Re.ReplaceAllStringFunc(s, func(m string) string {
+			if p.Valid != nil && !p.Valid(m) {
+				return m
+			}
+			return rd.replace(p.Name, m, false)
+		})
+	}
+	return s
+}
+
+// Redacts a value, copying maps and slices
+func (rd *Redactor) value(v interface{}) interface{} {
+	switch x := v.(type) {
+	case string:
+		return rd.text(x)
+	case []byte:
+		return []byte(rd.text(string(x)))
+	case Record:
+		return Record(rd.record(x))
+	case map[string]interface{}:
+		return rd.record(x)
+	case []interface{}:
+		out := make([]interface{}, len(x))
+		for i, e := range x {
+			out[i] = rd.value(e)
+		}
+		return out
+	}
+	return v
+}
+
+func (rd *Redactor) record(r map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(r))
+	for k, v := range r {
+		if rd.fields[k] && v != nil {
+			out[k] = rd.replace(k, fmt.Sprint(v), true)
+			continue
+		}
+		out[k] = rd.value(v)
+	}
+	return out
+}
+
+// Conduct is the pre-defined method that makes Redactor a Conduit.
+func (rd *Redactor) Conduct(src conduit.Source, trg conduit.Target) error {
+	if len(rd.patterns) == 0 && len(rd.fields) == 0 {
+		return errors.New("redactor without patterns and fields")
+	}
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			trg <- inp
+			continue
+		}
+		trg <- rd.value(inp)
+	}
+	return nil
+}
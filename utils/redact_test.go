@@ -0,0 +1,91 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/toschoo/conduit"
+)
+
+// Redactor:
+// - Valid emails, credit cards, SSNs and IBANs are masked in text and nested records
+// - Numbers with invalid checksums are kept
+// - Configured fields are masked as a whole
+// - Hashing is deterministic and depends on the key
+// - Redactions are counted per pattern and field
+func TestRedactor(t *testing.T) {
+	if NewRedactor(&PIIPattern{Name: "x"}) != nil {
+		t.Errorf("Redactor: pattern without regexp accepted")
+	}
+	rd := NewRedactor(PIIEmail, PIIIBAN, PIICreditCard, PIISSN).Fields("password")
+	items := []interface{}{
+		"mail jane.doe@example.com, card 4111 1111 1111 1111, not 4111 1111 1111 1112",
+		&conduit.Barrier{},
+		[]byte("ssn 123-45-6789, not 000-12-3456, iban DE89 3704 0044 0532 0130 00"),
+		Record{"user": "bob@example.org", "password": "secret", "age": 42,
+			"meta": map[string]interface{}{"password": 1234, "cards": []interface{}{"5500-0000-0000-0004"}}},
+		42,
+	}
+	ac := &AnyConsumer{}
+	if err := conduit.NewChain(&AnyProducer{src: items}, []conduit.Conduit{rd}, ac, small).Run(); err != nil {
+		t.Fatalf("Redactor failed: %v", err)
+	}
+	if len(ac.recvd) != 5 {
+		t.Fatalf("Redactor: received %v", ac.recvd)
+	}
+	if ac.recvd[0] != "mail [email], card [credit_card], not 4111 1111 1111 1112" {
+		t.Errorf("Redactor: unexpected text %q", ac.recvd[0])
+	}
+	if !conduit.IsBarrier(ac.recvd[1]) {
+		t.Errorf("Redactor: barrier not forwarded")
+	}
+	if string(ac.recvd[2].([]byte)) != "ssn [ssn], not 000-12-3456, iban [iban]" {
+		t.Errorf("Redactor: unexpected text %q", ac.recvd[2])
+	}
+	r := ac.recvd[3].(Record)
+	meta := r["meta"].(map[string]interface{})
+	if r["user"] != "[email]" || r["password"] != "[redacted]" || r["age"] != 42 ||
+		meta["password"] != "[redacted]" || meta["cards"].([]interface{})[0] != "[credit_card]" {
+		t.Errorf("Redactor: unexpected record %v", r)
+	}
+	if items[3].(Record)["password"] != "secret" {
+		t.Errorf("Redactor: input modified")
+	}
+	if ac.recvd[4] != 42 {
+		t.Errorf("Redactor: unexpected item %v", ac.recvd[4])
+	}
+	counts := rd.Counts()
+	if len(counts) != 5 || counts["email"] != 2 || counts["credit_card"] != 2 || counts["ssn"] != 1 ||
+		counts["iban"] != 1 || counts["password"] != 2 {
+		t.Errorf("Redactor: unexpected counts %v", counts)
+	}
+
+	hash := func(key string) []interface{} {
+		rd := NewRedactor(PIIEmail).Fields("id").SetMode(RedactHash)
+		if key != "" {
+			rd.SetHashKey([]byte(key))
+		}
+		ac := &AnyConsumer{}
+		items := []interface{}{"from a@b.io", "to a@b.io", Record{"id": 7}}
+		if err := conduit.NewChain(&AnyProducer{src: items}, []conduit.Conduit{rd}, ac, small).Run(); err != nil {
+			t.Fatalf("Redactor failed: %v", err)
+		}
+		return ac.recvd
+	}
+	plain, keyed := hash(""), hash("k")
+	if len(plain) != 3 || len(keyed) != 3 {
+		t.Fatalf("Redactor: received %v and %v", plain, keyed)
+	}
+	a, b := plain[0].(string), plain[1].(string)
+	if !strings.HasPrefix(a, "from email:") || len(a) != len("from email:")+16 || a[5:] != b[3:] {
+		t.Errorf("Redactor: unexpected hashes %q and %q", a, b)
+	}
+	if keyed[0] == a || !strings.HasPrefix(plain[2].(Record)["id"].(string), "id:") {
+		t.Errorf("Redactor: unexpected hashes %v and %v", plain, keyed)
+	}
+
+	chn := conduit.NewChain(&AnyProducer{src: items}, []conduit.Conduit{NewRedactor()}, &AnyConsumer{}, small)
+	if err := chn.Run(); err == nil {
+		t.Errorf("Redactor without patterns and fields did not fail")
+	}
+}
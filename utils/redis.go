@@ -0,0 +1,716 @@
+package utils
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+// Error replied by the Redis server
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// Minimal Redis (RESP2) client
+type redisConn struct {
+	door    sync.Mutex
+	conn    net.Conn
+	rd      *bufio.Reader
+	w       *bufio.Writer
+	timeout time.Duration
+}
+
+// Connects to the server at addr
+// (redis://[[user]:password@]host[:port][/db])
+func dialRedis(addr string, timeout time.Duration) (*redisConn, error) {
+	if !strings.Contains(addr, "://") {
+		addr = "redis://" + addr
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	conn, err := net.DialTimeout("tcp", host, timeout)
+	if err != nil {
+		return nil, err
+	}
+	rc := &redisConn{
+		conn:    conn,
+		rd:      bufio.NewReader(conn),
+		w:       bufio.NewWriter(conn),
+		timeout: timeout,
+	}
+	if u.User != nil {
+		pass, ok := u.User.Password()
+		if ok && u.User.Username() != "" {
+			_, err = rc.do("AUTH", u.User.Username(), pass)
+		} else if ok {
+			_, err = rc.do("AUTH", pass)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		_, err = rc.do("SELECT", db)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+// Sends a command and reads the reply
+func (rc *redisConn) do(args ...string) (interface{}, error) {
+	return rc.call(0, args...)
+}
+
+// Sends a command that blocks up to wait on the server
+// and reads the reply
+func (rc *redisConn) call(wait time.Duration, args ...string) (interface{}, error) {
+	rc.door.Lock()
+	defer rc.door.Unlock()
+	if rc.timeout > 0 {
+		rc.conn.SetDeadline(time.Now().Add(rc.timeout + wait))
+	}
+	fmt.Fprintf(rc.w, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(rc.w, "$%d\r\n%s\r\n", len(a), a)
+	}
+	err := rc.w.Flush()
+	if err != nil {
+		return nil, err
+	}
+	return rc.reply()
+}
+
+// Reads a reply: string, int64, []interface{} or nil;
+// errors replied by the server are returned as redisError
+func (rc *redisConn) reply() (interface{}, error) {
+	line, err := rc.rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 {
+		return nil, errors.New(fmt.Sprintf("redis: invalid reply %q", line))
+	}
+	line = line[:len(line)-2]
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		b := make([]byte, n+2)
+		_, err = io.ReadFull(rc.rd, b)
+		if err != nil {
+			return nil, err
+		}
+		return string(b[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		a := make([]interface{}, n)
+		for i := range a {
+			a[i], err = rc.reply()
+			if err != nil {
+				if _, ok := err.(redisError); !ok {
+					return nil, err
+				}
+				a[i] = err
+			}
+		}
+		return a, nil
+	}
+	return nil, errors.New(fmt.Sprintf("redis: invalid reply %q", line))
+}
+
+func (rc *redisConn) close() {
+	rc.conn.Close()
+}
+
+// Converts a list of field/value pairs into a map
+func redisFields(v interface{}) map[string]string {
+	a, _ := v.([]interface{})
+	m := make(map[string]string, len(a)/2)
+	for i := 0; i+1 < len(a); i += 2 {
+		k, _ := a[i].(string)
+		m[k], _ = a[i+1].(string)
+	}
+	return m
+}
+
+// RedisEntry is an entry of a Redis stream.
+type RedisEntry struct {
+	Stream string
+	ID     string
+	Fields map[string]string
+}
+
+// RedisStreamReader is a Producer that reads a Redis stream
+// as member of a consumer group, which is created
+// if it does not exist, and sends the entries
+// as *RedisEntry down the chain.
+// At start, RedisStreamReader first reads the entries
+// that were delivered to the consumer before but not acknowledged.
+// Entries are acknowledged (XACK): by default
+// when they have been sent down the chain
+// or, with AckOnCheckpoint, when a checkpoint of the chain
+// covers them (see conduit.Chain.SetCheckpoints and conduit.Committer),
+// so that entries that were not completely processed
+// are read again after a crash (at least once).
+// The producer runs until the chain is canceled
+// or terminates with an error when the connection is lost.
+type RedisStreamReader struct {
+	conduit.Cancelable
+	url      string
+	stream   string
+	group    string
+	consumer string
+	start    string
+	count    int
+	block    time.Duration
+	timeout  time.Duration
+	onCP     bool
+	acks     ackQueue
+	door     sync.Mutex
+	rc       *redisConn
+}
+
+// NewRedisStreamReader creates a new RedisStreamReader Producer
+// reading stream as consumer of group from the server at url
+// (redis://[[user]:password@]host[:port][/db]).
+func NewRedisStreamReader(url, stream, group, consumer string) (rs *RedisStreamReader) {
+	if stream == "" || group == "" || consumer == "" {
+		return nil
+	}
+	rs = new(RedisStreamReader)
+	if rs != nil {
+		rs.url = url
+		rs.stream = stream
+		rs.group = group
+		rs.consumer = consumer
+		rs.start = "$"
+		rs.count = 64
+		rs.block = 5 * time.Second
+		rs.timeout = 10 * time.Second
+	}
+	return
+}
+
+// SetStart sets the ID after which a newly created group
+// starts reading (default "$": new entries only;
+// "0" reads the whole stream).
+func (rs *RedisStreamReader) SetStart(id string) *RedisStreamReader {
+	rs.start = id
+	return rs
+}
+
+// SetCount sets the number of entries read per request (default 64).
+func (rs *RedisStreamReader) SetCount(n int) *RedisStreamReader {
+	if n > 0 {
+		rs.count = n
+	}
+	return rs
+}
+
+// SetBlock sets how long a request waits for new entries (default 5s).
+func (rs *RedisStreamReader) SetBlock(d time.Duration) *RedisStreamReader {
+	rs.block = d
+	return rs
+}
+
+// SetTimeout sets the timeout for connecting
+// and requests (default 10s).
+func (rs *RedisStreamReader) SetTimeout(d time.Duration) *RedisStreamReader {
+	rs.timeout = d
+	return rs
+}
+
+// AckOnCheckpoint acknowledges entries only when
+// a checkpoint covers them.
+func (rs *RedisStreamReader) AckOnCheckpoint() *RedisStreamReader {
+	rs.onCP = true
+	return rs
+}
+
+// Resume is the pre-defined method that makes RedisStreamReader
+// a conduit.Resumer. The entries that were not acknowledged
+// are read again, so nothing is skipped.
+func (rs *RedisStreamReader) Resume(pos uint64) error {
+	rs.acks.resume(pos)
+	return nil
+}
+
+// Commit is the pre-defined method that makes RedisStreamReader
+// a conduit.Committer; with AckOnCheckpoint, it acknowledges
+// the entries covered by the checkpoint.
+// Acknowledgments are dropped when the producer has terminated.
+func (rs *RedisStreamReader) Commit(cp *conduit.Checkpoint) error {
+	if !rs.onCP {
+		return nil
+	}
+	return rs.acks.commit(cp.Position)
+}
+
+// Cancel cancels the producer and closes the connection.
+func (rs *RedisStreamReader) Cancel() {
+	rs.Cancelable.Cancel()
+	rs.door.Lock()
+	defer rs.door.Unlock()
+	if rs.rc != nil {
+		rs.rc.close()
+	}
+}
+
+// Produce is the pre-defined method that makes RedisStreamReader a Producer.
+func (rs *RedisStreamReader) Produce(trg conduit.Target) error {
+	rs.acks.start()
+	rc, err := dialRedis(rs.url, rs.timeout)
+	if err != nil {
+		return err
+	}
+	defer rc.close()
+	rs.door.Lock()
+	rs.rc = rc
+	rs.door.Unlock()
+	if rs.Canceled() {
+		return nil
+	}
+	_, err = rc.do("XGROUP", "CREATE", rs.stream, rs.group, rs.start, "MKSTREAM")
+	if err != nil && !strings.HasPrefix(err.Error(), "redis: BUSYGROUP") {
+		return err
+	}
+	acker := rc
+	if rs.onCP {
+		// commits run concurrently with blocking reads
+		acker, err = dialRedis(rs.url, rs.timeout)
+		if err != nil {
+			return err
+		}
+		defer acker.close()
+	}
+	id := "0" // pending entries first
+	for !rs.Canceled() {
+		var last string
+		last, err = rs.read(rc, acker, id, trg)
+		if err != nil {
+			break
+		}
+		if id != ">" {
+			id = last
+		}
+	}
+	if rs.Canceled() {
+		return nil
+	}
+	return err
+}
+
+// Reads the entries after id and sends them down the chain;
+// returns the ID of the last entry or ">" if there was none
+func (rs *RedisStreamReader) read(rc, acker *redisConn, id string, trg conduit.Target) (string, error) {
+	args := []string{"XREADGROUP", "GROUP", rs.group, rs.consumer, "COUNT", strconv.Itoa(rs.count)}
+	if id == ">" {
+		args = append(args, "BLOCK", strconv.FormatInt(rs.block.Milliseconds(), 10))
+	}
+	v, err := rc.call(rs.block, append(args, "STREAMS", rs.stream, id)...)
+	if err != nil || v == nil {
+		return ">", err // nil: timed out
+	}
+	streams, _ := v.([]interface{})
+	last := ">"
+	for _, s := range streams {
+		sa, _ := s.([]interface{})
+		if len(sa) != 2 {
+			return last, errors.New("redis: invalid stream reply")
+		}
+		entries, _ := sa[1].([]interface{})
+		for _, e := range entries {
+			ea, _ := e.([]interface{})
+			if len(ea) != 2 {
+				return last, errors.New("redis: invalid entry")
+			}
+			entry := &RedisEntry{Stream: rs.stream}
+			entry.ID, _ = ea[0].(string)
+			entry.Fields = redisFields(ea[1])
+			last = entry.ID
+			ack := func() error {
+				// if the connection is closed, the entry is read again
+				acker.do("XACK", rs.stream, rs.group, entry.ID)
+				return nil
+			}
+			if rs.onCP {
+				rs.acks.add(ack)
+				trg <- entry
+				continue
+			}
+			trg <- entry
+			ack()
+		}
+	}
+	return last, nil
+}
+
+// Connection and retries shared by Redis consumers and lookups
+type redisClient struct {
+	url     string
+	timeout time.Duration
+	retry   RetryPolicy
+	marshal MarshalFunc
+	rc      *redisConn
+}
+
+func (w *redisClient) init(url string) {
+	w.url = url
+	w.timeout = 10 * time.Second
+	w.retry = DefaultRetry
+	w.marshal = json.Marshal
+}
+
+// Executes a command; reconnects and retries on connection errors
+func (w *redisClient) exec(args ...string) (interface{}, error) {
+	var v interface{}
+	attempts, err := w.retry.run(nil, func() (bool, error) {
+		if w.rc == nil {
+			rc, err := dialRedis(w.url, w.timeout)
+			if err != nil {
+				return true, err
+			}
+			w.rc = rc
+		}
+		var err error
+		v, err = w.rc.do(args...)
+		if _, ok := err.(redisError); ok {
+			return false, err
+		}
+		if err != nil {
+			w.rc.close()
+			w.rc = nil
+		}
+		return true, err
+	})
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("%s failed after %d attempts: %v", args[0], attempts, err))
+	}
+	return v, nil
+}
+
+func (w *redisClient) close() {
+	if w.rc != nil {
+		w.rc.close()
+		w.rc = nil
+	}
+}
+
+// RedisStreamWriter is a Consumer that appends the incoming items
+// to a Redis stream (XADD). The stream name is a template
+// (see Template) rendered with the item.
+// *RedisEntry and map[string]string items are added
+// with their fields, map[string]interface{} items with one field
+// per key (values that are not strings are encoded with
+// the MarshalFunc, default: json.Marshal) and all other items
+// with one field "data" holding the item (see SetField).
+type RedisStreamWriter struct {
+	redisClient
+	stream Template
+	field  string
+	maxLen int
+}
+
+// NewRedisStreamWriter creates a new RedisStreamWriter Consumer
+// connecting to the server at url (see NewRedisStreamReader).
+func NewRedisStreamWriter(url string, stream Template) (rw *RedisStreamWriter) {
+	if stream == nil {
+		return nil
+	}
+	rw = new(RedisStreamWriter)
+	if rw != nil {
+		rw.init(url)
+		rw.stream = stream
+		rw.field = "data"
+	}
+	return
+}
+
+// SetField sets the name of the field holding
+// items that are not maps (default "data").
+func (rw *RedisStreamWriter) SetField(name string) *RedisStreamWriter {
+	rw.field = name
+	return rw
+}
+
+// SetMaxLen trims the stream to approximately n entries.
+func (rw *RedisStreamWriter) SetMaxLen(n int) *RedisStreamWriter {
+	rw.maxLen = n
+	return rw
+}
+
+// SetMarshal sets the MarshalFunc.
+func (rw *RedisStreamWriter) SetMarshal(marshal MarshalFunc) *RedisStreamWriter {
+	rw.marshal = marshal
+	return rw
+}
+
+// SetTimeout sets the timeout for connecting and requests (default 10s).
+func (rw *RedisStreamWriter) SetTimeout(d time.Duration) *RedisStreamWriter {
+	rw.timeout = d
+	return rw
+}
+
+// SetRetry sets the RetryPolicy for connection errors (default: DefaultRetry).
+func (rw *RedisStreamWriter) SetRetry(rp RetryPolicy) *RedisStreamWriter {
+	rw.retry = rp
+	return rw
+}
+
+// Consume is the pre-defined method that makes RedisStreamWriter a Consumer.
+// Consume terminates with an error if an item cannot be encoded
+// or the server rejects it.
+func (rw *RedisStreamWriter) Consume(src conduit.Source) error {
+	defer rw.close()
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			continue
+		}
+		stream, err := render(rw.stream, inp)
+		if err != nil {
+			return err
+		}
+		args := []string{"XADD", stream}
+		if rw.maxLen > 0 {
+			args = append(args, "MAXLEN", "~", strconv.Itoa(rw.maxLen))
+		}
+		fields, err := rw.fields(inp)
+		if err != nil {
+			return err
+		}
+		_, err = rw.exec(append(append(args, "*"), fields...)...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Field/value pairs of an item
+func (rw *RedisStreamWriter) fields(inp interface{}) ([]string, error) {
+	var fields []string
+	switch v := inp.(type) {
+	case *RedisEntry:
+		for k, s := range v.Fields {
+			fields = append(fields, k, s)
+		}
+	case map[string]string:
+		for k, s := range v {
+			fields = append(fields, k, s)
+		}
+	case map[string]interface{}:
+		for k, x := range v {
+			data, err := payload(x, rw.marshal)
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, k, string(data))
+		}
+	default:
+		data, err := payload(inp, rw.marshal)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, rw.field, string(data))
+	}
+	if len(fields) == 0 {
+		return nil, errors.New("redis: entry without fields")
+	}
+	return fields, nil
+}
+
+// RedisPublisher is a Consumer that publishes the incoming items
+// to a Redis Pub/Sub channel (PUBLISH). The channel is a template
+// (see Template) rendered with the item. []byte and string items
+// are published as they are, others are encoded
+// with a MarshalFunc (default: json.Marshal).
+type RedisPublisher struct {
+	redisClient
+	channel Template
+}
+
+// NewRedisPublisher creates a new RedisPublisher Consumer
+// connecting to the server at url (see NewRedisStreamReader).
+func NewRedisPublisher(url string, channel Template) (rp *RedisPublisher) {
+	if channel == nil {
+		return nil
+	}
+	rp = new(RedisPublisher)
+	if rp != nil {
+		rp.init(url)
+		rp.channel = channel
+	}
+	return
+}
+
+// SetMarshal sets the MarshalFunc.
+func (rp *RedisPublisher) SetMarshal(marshal MarshalFunc) *RedisPublisher {
+	rp.marshal = marshal
+	return rp
+}
+
+// SetTimeout sets the timeout for connecting and requests (default 10s).
+func (rp *RedisPublisher) SetTimeout(d time.Duration) *RedisPublisher {
+	rp.timeout = d
+	return rp
+}
+
+// SetRetry sets the RetryPolicy for connection errors (default: DefaultRetry).
+func (rp *RedisPublisher) SetRetry(policy RetryPolicy) *RedisPublisher {
+	rp.retry = policy
+	return rp
+}
+
+// Consume is the pre-defined method that makes RedisPublisher a Consumer.
+func (rp *RedisPublisher) Consume(src conduit.Source) error {
+	defer rp.close()
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			continue
+		}
+		channel, err := render(rp.channel, inp)
+		if err != nil {
+			return err
+		}
+		data, err := payload(inp, rp.marshal)
+		if err != nil {
+			return err
+		}
+		_, err = rp.exec("PUBLISH", channel, string(data))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RedisLookup is a Conduit that enriches each incoming item
+// with the value stored in Redis under the key of the item
+// (see KeyFunc and Keyed) preceded by an optional prefix.
+// It sends Enriched items down the chain;
+// Match is the string value of the key or, with SetHash,
+// the fields of the hash as map[string]string.
+// Items without value are handled according to the MissPolicy.
+type RedisLookup struct {
+	redisClient
+	key    KeyFunc
+	prefix string
+	hash   bool
+	miss   MissPolicy
+}
+
+// NewRedisLookup creates a new RedisLookup Conduit
+// connecting to the server at url (see NewRedisStreamReader).
+func NewRedisLookup(url string, key KeyFunc, miss MissPolicy) (rl *RedisLookup) {
+	rl = new(RedisLookup)
+	if rl != nil {
+		rl.init(url)
+		rl.key = key
+		rl.miss = miss
+	}
+	return
+}
+
+// SetPrefix sets the prefix of the Redis keys, e.g. "user:".
+func (rl *RedisLookup) SetPrefix(prefix string) *RedisLookup {
+	rl.prefix = prefix
+	return rl
+}
+
+// SetHash looks up hashes (HGETALL) instead of strings (GET).
+func (rl *RedisLookup) SetHash() *RedisLookup {
+	rl.hash = true
+	return rl
+}
+
+// SetTimeout sets the timeout for connecting and requests (default 10s).
+func (rl *RedisLookup) SetTimeout(d time.Duration) *RedisLookup {
+	rl.timeout = d
+	return rl
+}
+
+// SetRetry sets the RetryPolicy for connection errors (default: DefaultRetry).
+func (rl *RedisLookup) SetRetry(rp RetryPolicy) *RedisLookup {
+	rl.retry = rp
+	return rl
+}
+
+// Conduct is the pre-defined method that makes RedisLookup a Conduit.
+func (rl *RedisLookup) Conduct(src conduit.Source, trg conduit.Target) error {
+	defer rl.close()
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			trg <- inp
+			continue
+		}
+		k := keyOf(rl.key, inp)
+		m, err := rl.lookup(rl.prefix + k)
+		if err != nil {
+			return err
+		}
+		if m == nil {
+			switch rl.miss {
+			case MissDrop:
+				continue
+			case MissError:
+				s := fmt.Sprintf("no match for key %s", k)
+				return errors.New(s)
+			}
+		}
+		trg <- Enriched{Item: inp, Match: m}
+	}
+	return nil
+}
+
+// Looks up key; returns nil if there is no value
+func (rl *RedisLookup) lookup(key string) (interface{}, error) {
+	cmd := "GET"
+	if rl.hash {
+		cmd = "HGETALL"
+	}
+	v, err := rl.exec(cmd, key)
+	if err != nil {
+		return nil, err
+	}
+	if !rl.hash || v == nil {
+		return v, nil
+	}
+	fields := redisFields(v)
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	return fields, nil
+}
@@ -0,0 +1,446 @@
+package utils
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+// Redis test server: strings, hashes, Pub/Sub publishing
+// and streams with consumer groups
+type redisServer struct {
+	ln        net.Listener
+	door      sync.Mutex
+	strings   map[string]string
+	hashes    map[string]map[string]string
+	published []string
+	streams   map[string]*redisStream
+	acked     int
+}
+
+type redisStream struct {
+	entries [][]string // ID, field, value, ...
+	groups  map[string]*redisGroup
+}
+
+type redisGroup struct {
+	last    int            // sequence of the last delivered entry
+	pending map[int]string // sequence -> consumer
+}
+
+func newRedisServer() (*redisServer, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	rs := &redisServer{
+		ln:      ln,
+		strings: make(map[string]string),
+		hashes:  make(map[string]map[string]string),
+		streams: make(map[string]*redisStream),
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go rs.serve(conn)
+		}
+	}()
+	return rs, nil
+}
+
+func (rs *redisServer) url() string {
+	return "redis://" + rs.ln.Addr().String()
+}
+
+func (rs *redisServer) close() {
+	rs.ln.Close()
+}
+
+func (rs *redisServer) ackCount() int {
+	rs.door.Lock()
+	defer rs.door.Unlock()
+	return rs.acked
+}
+
+func (rs *redisServer) publishedMsgs() []string {
+	rs.door.Lock()
+	defer rs.door.Unlock()
+	return append([]string{}, rs.published...)
+}
+
+// Reply encoding
+func respBulk(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+func respArray(items []string) string {
+	return fmt.Sprintf("*%d\r\n%s", len(items), strings.Join(items, ""))
+}
+
+func (rs *redisServer) serve(conn net.Conn) {
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	for {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			return
+		}
+		n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		args := make([]string, n)
+		for i := range args {
+			line, err = rd.ReadString('\n')
+			if err != nil {
+				return
+			}
+			size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+			b := make([]byte, size+2)
+			if _, err = io.ReadFull(rd, b); err != nil {
+				return
+			}
+			args[i] = string(b[:size])
+		}
+		if _, err = conn.Write([]byte(rs.exec(args))); err != nil {
+			return
+		}
+	}
+}
+
+func (rs *redisServer) exec(args []string) string {
+	switch strings.ToUpper(args[0]) {
+	case "AUTH", "SELECT":
+		return "+OK\r\n"
+	case "GET":
+		rs.door.Lock()
+		defer rs.door.Unlock()
+		if v, ok := rs.strings[args[1]]; ok {
+			return respBulk(v)
+		}
+		return "$-1\r\n"
+	case "HGETALL":
+		rs.door.Lock()
+		defer rs.door.Unlock()
+		var items []string
+		for k, v := range rs.hashes[args[1]] {
+			items = append(items, respBulk(k), respBulk(v))
+		}
+		return respArray(items)
+	case "PUBLISH":
+		rs.door.Lock()
+		defer rs.door.Unlock()
+		rs.published = append(rs.published, args[1]+" "+args[2])
+		return ":0\r\n"
+	case "XGROUP":
+		return rs.xgroup(args[2], args[3], args[4])
+	case "XADD":
+		return rs.xadd(args[1:])
+	case "XREADGROUP":
+		return rs.xreadgroup(args[1:])
+	case "XACK":
+		rs.door.Lock()
+		defer rs.door.Unlock()
+		g := rs.streams[args[1]].groups[args[2]]
+		n := 0
+		for _, id := range args[3:] {
+			seq, _ := strconv.Atoi(strings.Split(id, "-")[0])
+			if _, ok := g.pending[seq]; ok {
+				delete(g.pending, seq)
+				n++
+			}
+		}
+		rs.acked += n
+		return fmt.Sprintf(":%d\r\n", n)
+	}
+	return fmt.Sprintf("-ERR unknown command '%s'\r\n", args[0])
+}
+
+func (rs *redisServer) xgroup(stream, group, start string) string {
+	rs.door.Lock()
+	defer rs.door.Unlock()
+	s, ok := rs.streams[stream]
+	if !ok {
+		s = &redisStream{groups: make(map[string]*redisGroup)}
+		rs.streams[stream] = s
+	}
+	if _, ok := s.groups[group]; ok {
+		return "-BUSYGROUP Consumer Group name already exists\r\n"
+	}
+	g := &redisGroup{pending: make(map[int]string)}
+	if start == "$" {
+		g.last = len(s.entries)
+	}
+	s.groups[group] = g
+	return "+OK\r\n"
+}
+
+func (rs *redisServer) xadd(args []string) string {
+	rs.door.Lock()
+	defer rs.door.Unlock()
+	s, ok := rs.streams[args[0]]
+	if !ok {
+		s = &redisStream{groups: make(map[string]*redisGroup)}
+		rs.streams[args[0]] = s
+	}
+	i := 1
+	if args[i] == "MAXLEN" {
+		i += 3
+	}
+	id := fmt.Sprintf("%d-0", len(s.entries)+1)
+	s.entries = append(s.entries, append([]string{id}, args[i+1:]...))
+	return respBulk(id)
+}
+
+// XREADGROUP GROUP g c COUNT n [BLOCK ms] STREAMS s id
+func (rs *redisServer) xreadgroup(args []string) string {
+	group, consumer := args[1], args[2]
+	count, _ := strconv.Atoi(args[4])
+	var block time.Duration
+	if args[5] == "BLOCK" {
+		ms, _ := strconv.Atoi(args[6])
+		block = time.Duration(ms) * time.Millisecond
+	}
+	stream, id := args[len(args)-2], args[len(args)-1]
+	deadline := time.Now().Add(block)
+	for {
+		rs.door.Lock()
+		s, ok := rs.streams[stream]
+		if !ok || s.groups[group] == nil {
+			rs.door.Unlock()
+			return "-NOGROUP No such key or consumer group\r\n"
+		}
+		g := s.groups[group]
+		var seqs []int
+		if id == ">" {
+			for seq := g.last + 1; seq <= len(s.entries) && len(seqs) < count; seq++ {
+				seqs = append(seqs, seq)
+				g.pending[seq] = consumer
+				g.last = seq
+			}
+		} else {
+			after, _ := strconv.Atoi(strings.Split(id, "-")[0])
+			for seq := after + 1; seq <= len(s.entries) && len(seqs) < count; seq++ {
+				if g.pending[seq] == consumer {
+					seqs = append(seqs, seq)
+				}
+			}
+		}
+		var entries []string
+		for _, seq := range seqs {
+			e := s.entries[seq-1]
+			var fields []string
+			for _, f := range e[1:] {
+				fields = append(fields, respBulk(f))
+			}
+			entries = append(entries, respArray([]string{respBulk(e[0]), respArray(fields)}))
+		}
+		rs.door.Unlock()
+		if len(entries) > 0 || id != ">" {
+			return respArray([]string{respArray([]string{respBulk(stream), respArray(entries)})})
+		}
+		if time.Now().After(deadline) {
+			return "*-1\r\n"
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Values of the field n of the received entries
+func redisValues(items []interface{}) []string {
+	var vs []string
+	for _, inp := range items {
+		vs = append(vs, inp.(*RedisEntry).Fields["n"])
+	}
+	return vs
+}
+
+// Adds n entries to stream
+func addEntries(rs *redisServer, stream string, n int) error {
+	var items []interface{}
+	for i := 1; i <= n; i++ {
+		items = append(items, map[string]interface{}{"n": i})
+	}
+	tmpl := template.Must(template.New("stream").Parse(stream))
+	chn := conduit.NewChain(&AnyProducer{items}, nil, NewRedisStreamWriter(rs.url(), tmpl).SetMaxLen(1000), small)
+	if chn.Run() != nil {
+		return errors.New(fmt.Sprintf("cannot add entries: %v", chn.Errs))
+	}
+	return nil
+}
+
+// Redis streams:
+// - Items are added as entries with one field per key
+// - A consumer group member reads and acknowledges all entries
+// - Unknown commands are reported as errors
+func TestRedisStream(t *testing.T) {
+	rs, err := newRedisServer()
+	if err != nil {
+		t.Fatalf("Redis: cannot start server: %v", err)
+	}
+	defer rs.close()
+	if err = addEntries(rs, "orders", 100); err != nil {
+		t.Fatalf("RedisStreamWriter: %v", err)
+	}
+
+	c := &TakeConsumer{n: 100}
+	r := NewRedisStreamReader(rs.url(), "orders", "workers", "w1").SetStart("0").SetCount(16).SetBlock(50 * time.Millisecond)
+	if err = conduit.NewChain(r, nil, c, small).Run(); err != nil {
+		t.Fatalf("RedisStreamReader failed: %v", err)
+	}
+	for i, v := range redisValues(c.recvd) {
+		if v != strconv.Itoa(i+1) {
+			t.Fatalf("RedisStreamReader: unexpected entry %d: %s", i, v)
+		}
+	}
+	if e := c.recvd[99].(*RedisEntry); e.ID != "100-0" || e.Stream != "orders" {
+		t.Errorf("RedisStreamReader: unexpected entry %+v", e)
+	}
+	// the last acknowledgment may still be on the way
+	for i := 0; i < 100 && rs.ackCount() < 100; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if rs.ackCount() != 100 {
+		t.Errorf("RedisStreamReader: %d entries acknowledged", rs.ackCount())
+	}
+
+	rc, err := dialRedis(rs.url(), time.Second)
+	if err != nil {
+		t.Fatalf("Redis: cannot connect: %v", err)
+	}
+	defer rc.close()
+	if _, err = rc.do("FLUSHALL"); err == nil {
+		t.Errorf("Redis: error reply not reported")
+	}
+}
+
+// Redis streams with acknowledgment on checkpoints:
+// - Only entries covered by a checkpoint are acknowledged
+// - After a crash, the pending entries are read again
+func TestRedisStreamCheckpoint(t *testing.T) {
+	rs, err := newRedisServer()
+	if err != nil {
+		t.Fatalf("Redis: cannot start server: %v", err)
+	}
+	defer rs.close()
+	if err = addEntries(rs, "orders", 200); err != nil {
+		t.Fatalf("RedisStreamWriter: %v", err)
+	}
+
+	cps := conduit.NewMemCheckpoints()
+	newReader := func() *RedisStreamReader {
+		return NewRedisStreamReader(rs.url(), "orders", "workers", "w1").
+			SetStart("0").SetCount(8).SetBlock(20 * time.Millisecond).AckOnCheckpoint()
+	}
+	c := &StopConsumer{n: 150, err: errors.New("crash")}
+	r := newReader()
+	chn := conduit.NewChain(r, nil, c, small)
+	chn.SetCheckpoints(time.Millisecond, cps)
+	if chn.Run() == nil {
+		t.Fatalf("RedisStreamReader: chain did not crash")
+	}
+	// the producer is not stopped by the failing consumer
+	r.Cancel()
+	cp, _ := cps.Latest()
+	if cp == nil {
+		t.Fatalf("RedisStreamReader: no checkpoint taken")
+	}
+	acked := rs.ackCount()
+	if acked != int(cp.Position) {
+		t.Fatalf("RedisStreamReader: checkpoint at %d, acknowledged %d", cp.Position, acked)
+	}
+
+	rest := &StopConsumer{n: 200 - acked, err: conduit.EOS}
+	chn = conduit.NewChain(newReader(), nil, rest, small)
+	chn.SetCheckpoints(time.Millisecond, cps)
+	if err = chn.Run(); err != nil {
+		t.Fatalf("RedisStreamReader: restarted chain failed: %v", err)
+	}
+	for i, v := range redisValues(rest.recvd) {
+		if v != strconv.Itoa(acked+i+1) {
+			t.Fatalf("RedisStreamReader: unexpected entry %d after restart: %s", i, v)
+		}
+	}
+}
+
+// Redis Pub/Sub:
+// - Items are published to the channel rendered from the item
+func TestRedisPublisher(t *testing.T) {
+	rs, err := newRedisServer()
+	if err != nil {
+		t.Fatalf("Redis: cannot start server: %v", err)
+	}
+	defer rs.close()
+
+	channel := template.Must(template.New("channel").Parse("events.{{.kind}}"))
+	items := []interface{}{
+		map[string]interface{}{"kind": "click", "n": 1},
+		"plain",
+	}
+	chn := conduit.NewChain(&AnyProducer{items[:1]}, nil, NewRedisPublisher(rs.url(), channel), small)
+	if err = chn.Run(); err != nil {
+		t.Fatalf("RedisPublisher failed: %v", chn.Errs)
+	}
+	want := `[events.click {"kind":"click","n":1}]`
+	if fmt.Sprint(rs.publishedMsgs()) != want {
+		t.Errorf("RedisPublisher: expected %s, have %s", want, rs.publishedMsgs())
+	}
+
+	chn = conduit.NewChain(&AnyProducer{items[1:]}, nil, NewRedisPublisher(rs.url(), channel), small)
+	if chn.Run() == nil {
+		t.Errorf("RedisPublisher: template error not reported")
+	}
+	chn = conduit.NewChain(&AnyProducer{items[:1]}, nil,
+		NewRedisPublisher("127.0.0.1:1", channel).SetRetry(fastRetry).SetTimeout(time.Second), small)
+	if chn.Run() == nil {
+		t.Errorf("RedisPublisher: connection failure not reported")
+	}
+}
+
+// Redis lookups:
+// - Items are enriched with the string or hash stored under their key
+// - Items without value are handled according to the MissPolicy
+func TestRedisLookup(t *testing.T) {
+	rs, err := newRedisServer()
+	if err != nil {
+		t.Fatalf("Redis: cannot start server: %v", err)
+	}
+	defer rs.close()
+	rs.strings["user:1"] = "alice"
+	rs.strings["user:2"] = "bob"
+	rs.hashes["user:1"] = map[string]string{"name": "alice"}
+
+	items := []interface{}{"1", "3", "2"}
+	c := &AnyConsumer{}
+	l := NewRedisLookup(rs.url(), nil, MissPass).SetPrefix("user:")
+	if err = conduit.NewChain(&AnyProducer{items}, []conduit.Conduit{l}, c, small).Run(); err != nil {
+		t.Fatalf("RedisLookup failed: %v", err)
+	}
+	if fmt.Sprint(c.recvd) != "[{1 alice} {3 <nil>} {2 bob}]" {
+		t.Errorf("RedisLookup: unexpected items %v", c.recvd)
+	}
+
+	c = &AnyConsumer{}
+	l = NewRedisLookup(rs.url(), nil, MissDrop).SetPrefix("user:").SetHash()
+	if err = conduit.NewChain(&AnyProducer{items}, []conduit.Conduit{l}, c, small).Run(); err != nil {
+		t.Fatalf("RedisLookup failed: %v", err)
+	}
+	if fmt.Sprint(c.recvd) != "[{1 map[name:alice]}]" {
+		t.Errorf("RedisLookup: unexpected items %v", c.recvd)
+	}
+
+	l = NewRedisLookup(rs.url(), nil, MissError).SetPrefix("user:")
+	if conduit.NewChain(&AnyProducer{items}, []conduit.Conduit{l}, &AnyConsumer{}, small).Run() == nil {
+		t.Errorf("RedisLookup: missing key not reported")
+	}
+}
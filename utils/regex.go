@@ -0,0 +1,133 @@
+package utils
+
+import (
+	"regexp"
+
+	"github.com/toschoo/conduit"
+)
+
+// RegexFilter is a Conduit that forwards only those
+// text items ([]byte or string, e.g. lines) that match
+// a regular expression.
+type RegexFilter struct {
+	re     *regexp.Regexp
+	invert bool
+}
+
+// NewRegexFilter creates a new RegexFilter Conduit.
+func NewRegexFilter(re *regexp.Regexp) (rf *RegexFilter) {
+	if re == nil {
+		return nil
+	}
+	rf = new(RegexFilter)
+	if rf != nil {
+		rf.re = re
+	}
+	return
+}
+
+// Invert forwards only the items that do not match.
+func (rf *RegexFilter) Invert() *RegexFilter {
+	rf.invert = true
+	return rf
+}
+
+// Conduct is the pre-defined method that makes RegexFilter a Conduit.
+// Conduct terminates with an error if an item is not []byte or string.
+func (rf *RegexFilter) Conduct(src conduit.Source, trg conduit.Target) error {
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			trg <- inp
+			continue
+		}
+		text, _, err := textOf(inp)
+		if err != nil {
+			return err
+		}
+		if rf.re.MatchString(text) != rf.invert {
+			trg <- inp
+		}
+	}
+	return nil
+}
+
+// RegexExtractor is a Conduit that matches text items
+// ([]byte or string, e.g. lines) against a regular expression
+// and sends the capture groups down the chain:
+// as Record with one field per named group,
+// if the expression has named groups, as []string
+// with all groups otherwise (or the whole match
+// for expressions without groups).
+// Groups that did not participate in the match are empty.
+// Items that do not match are sent to the side output
+// "unmatched" (see conduit.SideOutputter) or dropped,
+// if the side output is not connected.
+type RegexExtractor struct {
+	re    *regexp.Regexp
+	names []string
+	named bool
+	side  conduit.Target
+}
+
+// NewRegexExtractor creates a new RegexExtractor Conduit.
+func NewRegexExtractor(re *regexp.Regexp) (rx *RegexExtractor) {
+	if re == nil {
+		return nil
+	}
+	rx = new(RegexExtractor)
+	if rx != nil {
+		rx.re = re
+		rx.names = re.SubexpNames()
+		for _, name := range rx.names {
+			if name != "" {
+				rx.named = true
+			}
+		}
+	}
+	return
+}
+
+// SideOutput is the pre-defined method that makes RegexExtractor
+// a conduit.SideOutputter. RegexExtractor has the side output "unmatched".
+func (rx *RegexExtractor) SideOutput(name string, trg conduit.Target) {
+	if name == "unmatched" {
+		rx.side = trg
+	}
+}
+
+// Conduct is the pre-defined method that makes RegexExtractor a Conduit.
+// Conduct terminates with an error if an item is not []byte or string.
+func (rx *RegexExtractor) Conduct(src conduit.Source, trg conduit.Target) error {
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			trg <- inp
+			continue
+		}
+		text, _, err := textOf(inp)
+		if err != nil {
+			return err
+		}
+		m := rx.re.FindStringSubmatch(text)
+		if m == nil {
+			if rx.side != nil {
+				rx.side <- inp
+			}
+			continue
+		}
+		switch {
+		case rx.named:
+			rec := make(Record)
+			for i, name := range rx.names {
+				if name != "" {
+					rec[name] = m[i]
+				}
+			}
+			trg <- rec
+		case len(m) > 1:
+			trg <- m[1:]
+		default:
+			trg <- m[:1]
+		}
+	}
+	return nil
+}
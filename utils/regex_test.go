@@ -0,0 +1,88 @@
+package utils
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/toschoo/conduit"
+)
+
+var accessLog = []interface{}{
+	`127.0.0.1 - - [10/Oct/2020:13:55:36 +0000] "GET /index.html HTTP/1.1" 200 2326`,
+	`10.0.0.2 - bob [10/Oct/2020:13:56:01 +0000] "POST /login HTTP/1.1" 302 0`,
+	`garbage line`,
+	[]byte(`10.0.0.3 - - [10/Oct/2020:13:57:12 +0000] "GET /missing HTTP/1.1" 404 153`),
+}
+
+var accessRegex = regexp.MustCompile(
+	`^(?P<ip>\S+) \S+ (?P<user>\S+) \[(?P<time>[^\]]+)\] "(?P<method>\S+) (?P<path>\S+) \S+" (?P<status>\d{3}) (?P<size>\d+)$`)
+
+// Regex filter:
+// - Matching items pass, others are dropped
+// - Inverted filters pass the others
+func TestRegexFilter(t *testing.T) {
+	c := new(AnyConsumer)
+	chn := conduit.NewChain(&AnyProducer{accessLog}, []conduit.Conduit{NewRegexFilter(regexp.MustCompile(`" 40\d `))}, c, small)
+	err := chn.Run()
+	if err != nil {
+		t.Fatalf("RegexFilter failed: %v", chn.Errs)
+	}
+	if len(c.recvd) != 1 || !reflect.DeepEqual(c.recvd[0], accessLog[3]) {
+		t.Errorf("RegexFilter: unexpected result %v", c.recvd)
+	}
+
+	c = new(AnyConsumer)
+	chn = conduit.NewChain(&AnyProducer{accessLog}, []conduit.Conduit{NewRegexFilter(accessRegex).Invert()}, c, small)
+	err = chn.Run()
+	if err != nil {
+		t.Fatalf("RegexFilter failed: %v", chn.Errs)
+	}
+	if fmt.Sprint(c.recvd) != "[garbage line]" {
+		t.Errorf("RegexFilter: unexpected result %v", c.recvd)
+	}
+}
+
+// Regex extractor:
+// - Named groups become Record fields
+// - Unnamed groups are sent as []string
+// - Unmatched items are sent to the side output
+func TestRegexExtractor(t *testing.T) {
+	rx := NewRegexExtractor(accessRegex)
+	c := new(AnyConsumer)
+	side := new(AnyConsumer)
+	chn := conduit.NewChain(&AnyProducer{accessLog}, []conduit.Conduit{rx}, c, small)
+	err := chn.AddSide(rx, "unmatched", side)
+	if err != nil {
+		t.Fatalf("RegexExtractor: cannot add side: %v", err)
+	}
+	err = chn.Run()
+	if err != nil {
+		t.Fatalf("RegexExtractor failed: %v", chn.Errs)
+	}
+	if len(c.recvd) != 3 {
+		t.Fatalf("RegexExtractor: expected 3 records, have %d", len(c.recvd))
+	}
+	want := Record{
+		"ip": "10.0.0.2", "user": "bob", "time": "10/Oct/2020:13:56:01 +0000",
+		"method": "POST", "path": "/login", "status": "302", "size": "0",
+	}
+	if !reflect.DeepEqual(c.recvd[1], want) {
+		t.Errorf("RegexExtractor: expected %v, have %v", want, c.recvd[1])
+	}
+	if fmt.Sprint(side.recvd) != "[garbage line]" {
+		t.Errorf("RegexExtractor: unexpected unmatched items %v", side.recvd)
+	}
+
+	c = new(AnyConsumer)
+	pipe := []conduit.Conduit{NewRegexExtractor(regexp.MustCompile(`" (\d+) (\d+)$`))}
+	chn = conduit.NewChain(&AnyProducer{accessLog}, pipe, c, small)
+	err = chn.Run()
+	if err != nil {
+		t.Fatalf("RegexExtractor failed: %v", chn.Errs)
+	}
+	if fmt.Sprint(c.recvd) != "[[200 2326] [302 0] [404 153]]" {
+		t.Errorf("RegexExtractor: unexpected result %v", c.recvd)
+	}
+}
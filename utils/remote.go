@@ -0,0 +1,558 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+// RemoteFile is a file on an FTP or SFTP server.
+// Name is the path relative to the directory of the reader,
+// Path the full path on the server.
+// Data holds the contents of the file, or, in streaming mode,
+// Body is a reader on the contents, which must be closed.
+// RemoteFiles are also written by RemoteWriter;
+// there, only Name and Data or Body are used.
+type RemoteFile struct {
+	Name    string
+	Path    string
+	Size    int64
+	ModTime time.Time
+	Data    []byte
+	Body    io.ReadCloser
+}
+
+// Entry of a remote directory
+type remoteEntry struct {
+	name string
+	size int64
+	mod  time.Time
+	dir  bool
+}
+
+// File system on a remote server
+type remoteFS interface {
+	list(dir string) ([]remoteEntry, error)
+	open(path string) (io.ReadCloser, error)
+	create(path string) (io.WriteCloser, error)
+	rename(from, to string) error
+	remove(path string) error
+	mkdir(path string) error
+	close() error
+}
+
+// Connection to a remote file system that is
+// established on demand and shared under a lock
+type remoteConn struct {
+	dial func() (remoteFS, error)
+	door sync.Mutex
+	fs   remoteFS
+}
+
+// Runs f with the connection; the connection is dropped when f fails
+func (c *remoteConn) with(f func(remoteFS) error) error {
+	c.door.Lock()
+	defer c.door.Unlock()
+	return c.withLocked(f)
+}
+
+func (c *remoteConn) withLocked(f func(remoteFS) error) error {
+	if c.fs == nil {
+		fs, err := c.dial()
+		if err != nil {
+			return err
+		}
+		c.fs = fs
+	}
+	err := f(c.fs)
+	if err != nil {
+		c.fs.close()
+		c.fs = nil
+	}
+	return err
+}
+
+func (c *remoteConn) disconnect() {
+	c.door.Lock()
+	defer c.door.Unlock()
+	if c.fs != nil {
+		c.fs.close()
+		c.fs = nil
+	}
+}
+
+// Creates the parent directories of p; errors are ignored,
+// since directories may exist
+func mkdirs(fs remoteFS, p string) {
+	dir := path.Dir(p)
+	if dir == "." || dir == "/" {
+		return
+	}
+	mkdirs(fs, dir)
+	fs.mkdir(dir)
+}
+
+// Body that releases the connection when it is closed
+type remoteBody struct {
+	io.ReadCloser
+	once   sync.Once
+	err    error
+	failed bool
+	done   chan struct{}
+}
+
+func (b *remoteBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		b.failed = true
+	}
+	return n, err
+}
+
+func (b *remoteBody) Close() error {
+	b.once.Do(func() {
+		b.err = b.ReadCloser.Close()
+		close(b.done)
+	})
+	return b.err
+}
+
+// RemoteReader is a Producer that lists a directory
+// on an FTP or SFTP server and sends the files
+// as *RemoteFile down the chain in the order of their names,
+// optionally restricted to files matching glob patterns
+// (see Match) and including subdirectories (see SetRecursive).
+// After a file has been processed, it can be moved
+// to another directory (see SetMoveTo) or deleted (see SetDelete);
+// files count as processed when they have been sent
+// down the chain or, with AckOnCheckpoint,
+// when a checkpoint of the chain covers them
+// (see conduit.Chain.SetCheckpoints and conduit.Committer).
+// With SetPoll, the directory is listed periodically
+// and files that are new or changed are sent;
+// otherwise, the producer terminates after one listing.
+// When the connection fails, the reader reconnects
+// according to the RetryPolicy (DefaultRetry).
+type RemoteReader struct {
+	conduit.Cancelable
+	archiveFilter
+	conn      remoteConn
+	dir       string
+	recursive bool
+	moveTo    string
+	remove    bool
+	poll      time.Duration
+	retry     RetryPolicy
+	onCP      bool
+	acks      ackQueue
+	seen      map[string]time.Time
+}
+
+func newRemoteReader(dial func() (remoteFS, error), dir string) (rr *RemoteReader) {
+	rr = new(RemoteReader)
+	if rr != nil {
+		rr.conn.dial = dial
+		rr.dir = dir
+		if rr.dir == "" {
+			rr.dir = "."
+		}
+		rr.retry = DefaultRetry
+	}
+	return
+}
+
+// Match restricts the files to those matching one of the glob patterns
+// (see path.Match), either with their name or their base name.
+func (rr *RemoteReader) Match(patterns ...string) *RemoteReader {
+	rr.patterns = patterns
+	return rr
+}
+
+// Stream sends files with Body instead of Data.
+// Since the connection is used for one transfer at a time,
+// the producer waits until the Body of a file is closed
+// before it continues with the next file.
+func (rr *RemoteReader) Stream() *RemoteReader {
+	rr.stream = true
+	return rr
+}
+
+// SetRecursive includes the files of subdirectories.
+func (rr *RemoteReader) SetRecursive() *RemoteReader {
+	rr.recursive = true
+	return rr
+}
+
+// SetMoveTo moves processed files to dir,
+// keeping their path relative to the directory of the reader.
+func (rr *RemoteReader) SetMoveTo(dir string) *RemoteReader {
+	rr.moveTo = dir
+	return rr
+}
+
+// SetDelete deletes processed files.
+func (rr *RemoteReader) SetDelete() *RemoteReader {
+	rr.remove = true
+	return rr
+}
+
+// SetPoll lists the directory every d until the producer is canceled.
+func (rr *RemoteReader) SetPoll(d time.Duration) *RemoteReader {
+	rr.poll = d
+	return rr
+}
+
+// SetRetry sets the RetryPolicy for reconnecting (default: DefaultRetry).
+func (rr *RemoteReader) SetRetry(rp RetryPolicy) *RemoteReader {
+	rr.retry = rp
+	return rr
+}
+
+// AckOnCheckpoint moves or deletes files only when
+// a checkpoint covers them.
+func (rr *RemoteReader) AckOnCheckpoint() *RemoteReader {
+	rr.onCP = true
+	return rr
+}
+
+// Resume is the pre-defined method that makes RemoteReader
+// a conduit.Resumer. Files that were not moved or deleted
+// are read again, so nothing is skipped.
+func (rr *RemoteReader) Resume(pos uint64) error {
+	rr.acks.resume(pos)
+	return nil
+}
+
+// Commit is the pre-defined method that makes RemoteReader
+// a conduit.Committer; with AckOnCheckpoint, it moves or deletes
+// the files covered by the checkpoint.
+func (rr *RemoteReader) Commit(cp *conduit.Checkpoint) error {
+	if !rr.onCP {
+		return nil
+	}
+	return rr.acks.commit(cp.Position)
+}
+
+// Produce is the pre-defined method that makes RemoteReader a Producer.
+func (rr *RemoteReader) Produce(trg conduit.Target) error {
+	rr.acks.start()
+	rr.seen = make(map[string]time.Time)
+	defer rr.conn.disconnect()
+	failures := 0
+	for !rr.Canceled() {
+		err := rr.scan(trg)
+		if err != nil {
+			if rr.Canceled() {
+				break
+			}
+			failures++
+			if failures >= rr.retry.Attempts {
+				return errors.New(fmt.Sprintf("reading %s failed after %d attempts: %v", rr.dir, failures, err))
+			}
+			if rr.retry.Backoff != nil {
+				sleep(rr.retry.Backoff(failures), rr.Canceled)
+			}
+			continue
+		}
+		failures = 0
+		if rr.poll <= 0 {
+			break
+		}
+		sleep(rr.poll, rr.Canceled)
+	}
+	return nil
+}
+
+// Lists the directory and sends the files not yet seen
+func (rr *RemoteReader) scan(trg conduit.Target) error {
+	var files []*RemoteFile
+	err := rr.conn.with(func(fs remoteFS) error {
+		var err error
+		files, err = rr.walk(fs, "")
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	// files that are gone (e.g. moved) are forgotten
+	listed := make(map[string]bool)
+	for _, f := range files {
+		listed[f.Path] = true
+	}
+	for p := range rr.seen {
+		if !listed[p] {
+			delete(rr.seen, p)
+		}
+	}
+	for _, f := range files {
+		if rr.Canceled() {
+			return nil
+		}
+		if t, ok := rr.seen[f.Path]; ok && t.Equal(f.ModTime) {
+			continue
+		}
+		err = rr.send(f, trg)
+		if err != nil {
+			return err
+		}
+		rr.seen[f.Path] = f.ModTime
+	}
+	return nil
+}
+
+// Lists the matching files of a directory relative to the directory of the reader
+func (rr *RemoteReader) walk(fs remoteFS, rel string) ([]*RemoteFile, error) {
+	entries, err := fs.list(path.Join(rr.dir, rel))
+	if err != nil {
+		return nil, err
+	}
+	var files []*RemoteFile
+	for _, e := range entries {
+		name := path.Join(rel, e.name)
+		if e.dir {
+			if !rr.recursive {
+				continue
+			}
+			sub, err := rr.walk(fs, name)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, sub...)
+			continue
+		}
+		if !rr.match(name) {
+			continue
+		}
+		files = append(files, &RemoteFile{Name: name, Path: path.Join(rr.dir, name), Size: e.size, ModTime: e.mod})
+	}
+	return files, nil
+}
+
+// Sends a file down the chain
+func (rr *RemoteReader) send(f *RemoteFile, trg conduit.Target) error {
+	if !rr.stream {
+		err := rr.conn.with(func(fs remoteFS) error {
+			body, err := fs.open(f.Path)
+			if err != nil {
+				return err
+			}
+			f.Data, err = ioutil.ReadAll(body)
+			if e := body.Close(); err == nil {
+				err = e
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		return rr.deliver(f, trg)
+	}
+	// the connection is locked until the body is closed
+	rr.conn.door.Lock()
+	var body *remoteBody
+	err := rr.conn.withLocked(func(fs remoteFS) error {
+		rc, err := fs.open(f.Path)
+		if err != nil {
+			return err
+		}
+		body = &remoteBody{ReadCloser: rc, done: make(chan struct{})}
+		return nil
+	})
+	if err != nil {
+		rr.conn.door.Unlock()
+		return err
+	}
+	f.Body = body
+	go func() {
+		<-body.done
+		if (body.err != nil || body.failed) && rr.conn.fs != nil {
+			rr.conn.fs.close()
+			rr.conn.fs = nil
+		}
+		rr.conn.door.Unlock()
+	}()
+	return rr.deliver(f, trg)
+}
+
+// Sends a file down the chain; with AckOnCheckpoint,
+// moving or deleting it is added in the same order
+func (rr *RemoteReader) deliver(f *RemoteFile, trg conduit.Target) error {
+	ack := func() error {
+		return rr.done(f)
+	}
+	if rr.onCP {
+		rr.acks.add(ack)
+	}
+	trg <- f
+	if !rr.onCP {
+		return ack()
+	}
+	return nil
+}
+
+// Moves or deletes a processed file
+func (rr *RemoteReader) done(f *RemoteFile) error {
+	if rr.moveTo == "" && !rr.remove {
+		return nil
+	}
+	return rr.conn.with(func(fs remoteFS) error {
+		// files whose body could not be read are kept
+		if b, ok := f.Body.(*remoteBody); ok && (b.failed || b.err != nil) {
+			return errors.New(fmt.Sprintf("reading %s failed", f.Path))
+		}
+		if rr.remove {
+			return fs.remove(f.Path)
+		}
+		to := path.Join(rr.moveTo, f.Name)
+		mkdirs(fs, to)
+		return fs.rename(f.Path, to)
+	})
+}
+
+// RemoteWriter is a Consumer that writes the incoming items
+// as files to a directory on an FTP or SFTP server.
+// *RemoteFile and *ArchiveEntry items are written
+// with their name and contents, []byte and string items
+// as they are and other items encoded with a MarshalFunc
+// (default: json.Marshal); the names of these files
+// are formed by a naming function (see SetNaming).
+// Files are written under a temporary name,
+// which is renamed when the file is complete,
+// so that readers never see partial files;
+// missing directories are created.
+// When writing fails, the writer reconnects and writes the file
+// again according to the RetryPolicy (DefaultRetry).
+type RemoteWriter struct {
+	conn    remoteConn
+	dir     string
+	naming  func(n int) string
+	marshal MarshalFunc
+	retry   RetryPolicy
+}
+
+func newRemoteWriter(dial func() (remoteFS, error), dir string) (rw *RemoteWriter) {
+	rw = new(RemoteWriter)
+	if rw != nil {
+		rw.conn.dial = dial
+		rw.dir = dir
+		if rw.dir == "" {
+			rw.dir = "."
+		}
+		rw.naming = func(n int) string { return fmt.Sprintf("%05d", n) }
+		rw.marshal = json.Marshal
+		rw.retry = DefaultRetry
+	}
+	return
+}
+
+// SetNaming sets the function that forms the name
+// of the n-th file (starting at 1) of items without name.
+func (rw *RemoteWriter) SetNaming(f func(n int) string) *RemoteWriter {
+	rw.naming = f
+	return rw
+}
+
+// SetMarshal sets the MarshalFunc.
+func (rw *RemoteWriter) SetMarshal(marshal MarshalFunc) *RemoteWriter {
+	rw.marshal = marshal
+	return rw
+}
+
+// SetRetry sets the RetryPolicy (default: DefaultRetry).
+func (rw *RemoteWriter) SetRetry(rp RetryPolicy) *RemoteWriter {
+	rw.retry = rp
+	return rw
+}
+
+// Name and contents of an item
+func (rw *RemoteWriter) file(inp interface{}, n int) (string, []byte, error) {
+	var name string
+	var data []byte
+	var body io.ReadCloser
+	switch x := inp.(type) {
+	case *RemoteFile:
+		name, data, body = x.Name, x.Data, x.Body
+	case *ArchiveEntry:
+		name, data, body = x.Name, x.Data, x.Body
+	case []byte:
+		name, data = rw.naming(n), x
+	case string:
+		name, data = rw.naming(n), []byte(x)
+	default:
+		var err error
+		name = rw.naming(n)
+		data, err = rw.marshal(inp)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+	// bodies are read completely, so that they can be written again
+	if body != nil {
+		var err error
+		data, err = ioutil.ReadAll(body)
+		body.Close()
+		if err != nil {
+			return "", nil, err
+		}
+	}
+	return name, data, nil
+}
+
+// Writes a file under a temporary name and renames it
+func (rw *RemoteWriter) write(fs remoteFS, name string, data []byte) error {
+	p := path.Join(rw.dir, name)
+	tmp := path.Join(path.Dir(p), "."+path.Base(p)+".part")
+	mkdirs(fs, p)
+	w, err := fs.create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	if e := w.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return err
+	}
+	// renaming does not replace files on all servers
+	fs.remove(p)
+	return fs.rename(tmp, p)
+}
+
+// Consume is the pre-defined method that makes RemoteWriter a Consumer.
+func (rw *RemoteWriter) Consume(src conduit.Source) error {
+	defer rw.conn.disconnect()
+	n := 0
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			continue
+		}
+		n++
+		name, data, err := rw.file(inp, n)
+		if err != nil {
+			return err
+		}
+		if name == "" || strings.HasPrefix(path.Clean(name), "..") {
+			return errors.New(fmt.Sprintf("invalid file name %q", name))
+		}
+		_, err = rw.retry.run(nil, func() (bool, error) {
+			return true, rw.conn.with(func(fs remoteFS) error {
+				return rw.write(fs, name, data)
+			})
+		})
+		if err != nil {
+			return errors.New(fmt.Sprintf("cannot write %s: %v", name, err))
+		}
+	}
+	return nil
+}
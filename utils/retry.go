@@ -0,0 +1,87 @@
+package utils
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Backoff computes the delay before retry n (starting with 1).
+type Backoff func(n int) time.Duration
+
+// ExponentialBackoff creates a Backoff that starts with base
+// and doubles the delay with each retry up to max.
+// Delays are randomised by up to -50%,
+// so that concurrent clients do not retry in lockstep.
+func ExponentialBackoff(base, max time.Duration) Backoff {
+	return func(n int) time.Duration {
+		d := base
+		for i := 1; i < n && d < max; i++ {
+			d *= 2
+		}
+		if d > max {
+			d = max
+		}
+		if d <= 1 {
+			return d
+		}
+		return d/2 + time.Duration(rand.Int63n(int64(d/2)))
+	}
+}
+
+// ConstantBackoff creates a Backoff that always waits d.
+func ConstantBackoff(d time.Duration) Backoff {
+	return func(int) time.Duration { return d }
+}
+
+// RetryPolicy defines how often failed operations are attempted
+// and how long to wait in between. The zero value
+// attempts operations only once.
+type RetryPolicy struct {
+	Attempts int     // maximum number of attempts
+	Backoff  Backoff // delay between attempts (nil: no delay)
+}
+
+// DefaultRetry attempts operations up to 3 times
+// with exponential backoff starting at 100ms.
+var DefaultRetry = RetryPolicy{
+	Attempts: 3,
+	Backoff:  ExponentialBackoff(100*time.Millisecond, 5*time.Second),
+}
+
+// Runs f until it succeeds, fails with retry false,
+// the attempts are exhausted or canceled returns true;
+// returns the number of attempts and the last error
+func (rp RetryPolicy) run(canceled func() bool, f func() (retry bool, err error)) (int, error) {
+	n := 0
+	for {
+		n++
+		retry, err := f()
+		if err == nil || !retry || n >= rp.Attempts {
+			return n, err
+		}
+		if rp.Backoff != nil && !sleep(rp.Backoff(n), canceled) {
+			return n, err
+		}
+		if canceled != nil && canceled() {
+			return n, err
+		}
+	}
+}
+
+// Sleeps d or until canceled returns true;
+// tells whether d has passed
+func sleep(d time.Duration, canceled func() bool) bool {
+	const step = 20 * time.Millisecond
+	for d > 0 {
+		if canceled != nil && canceled() {
+			return false
+		}
+		s := d
+		if s > step {
+			s = step
+		}
+		time.Sleep(s)
+		d -= s
+	}
+	return true
+}
@@ -0,0 +1,59 @@
+package utils
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// Retry policy:
+// - Operations are attempted until they succeed or the attempts are exhausted
+// - Permanent errors are not retried
+// - Backoff delays grow up to the maximum
+func TestRetryPolicy(t *testing.T) {
+	rp := RetryPolicy{Attempts: 4, Backoff: ConstantBackoff(time.Millisecond)}
+	calls := 0
+	n, err := rp.run(nil, func() (bool, error) {
+		calls++
+		if calls < 3 {
+			return true, errors.New("try again")
+		}
+		return false, nil
+	})
+	if err != nil || n != 3 {
+		t.Errorf("Retry: expected success after 3 attempts, have %d: %v", n, err)
+	}
+
+	n, err = rp.run(nil, func() (bool, error) { return true, errors.New("always") })
+	if err == nil || n != 4 {
+		t.Errorf("Retry: expected failure after 4 attempts, have %d: %v", n, err)
+	}
+
+	n, err = rp.run(nil, func() (bool, error) { return false, errors.New("permanent") })
+	if err == nil || n != 1 {
+		t.Errorf("Retry: permanent error was retried %d times", n)
+	}
+
+	n, _ = RetryPolicy{}.run(nil, func() (bool, error) { return true, errors.New("once") })
+	if n != 1 {
+		t.Errorf("Retry: zero policy attempted %d times", n)
+	}
+
+	b := ExponentialBackoff(10*time.Millisecond, 100*time.Millisecond)
+	for i := 1; i < 10; i++ {
+		d := b(i)
+		if d > 100*time.Millisecond || d < 5*time.Millisecond {
+			t.Errorf("Backoff: delay %v out of range for retry %d", d, i)
+		}
+	}
+	if d := b(1); d > 10*time.Millisecond {
+		t.Errorf("Backoff: first delay %v greater than base", d)
+	}
+
+	start := time.Now()
+	rp = RetryPolicy{Attempts: 2, Backoff: ConstantBackoff(time.Hour)}
+	rp.run(func() bool { return true }, func() (bool, error) { return true, errors.New("x") })
+	if time.Since(start) > time.Second {
+		t.Errorf("Retry: cancellation did not interrupt backoff")
+	}
+}
@@ -0,0 +1,116 @@
+package utils
+
+import (
+	"github.com/toschoo/conduit"
+)
+
+// route is one branch of a router with its sieve
+type route struct {
+	sv Sieve
+	b  Branch
+}
+
+// Router is a Conduit that routes incoming data
+// to branches based on Sieves: each item is sent
+// to the first branch whose Sieve it passes.
+// Items that pass no Sieve go to the default branch
+// or, if there is none, down the chain.
+// A Router is created by NewRouter and configured with Route
+// and Default, e.g.
+//
+//	NewRouter().Route(errSieve, nil, errLog).Route(...).Default(nil, other)
+type Router struct {
+	routes []route
+	dflt   *Branch
+	sz     int
+}
+
+// NewRouter creates a new Router without branches.
+func NewRouter() *Router {
+	r := new(Router)
+	if r != nil {
+		r.sz = 10
+	}
+	return r
+}
+
+// Route adds a branch consisting of pipe (which may be nil)
+// and consumer for items that pass sv.
+func (r *Router) Route(sv Sieve, pipe []conduit.Conduit, consumer conduit.Consumer) *Router {
+	r.routes = append(r.routes, route{sv, Branch{pipe, consumer}})
+	return r
+}
+
+// Default adds a branch consisting of pipe (which may be nil)
+// and consumer for items that pass no Sieve.
+func (r *Router) Default(pipe []conduit.Conduit, consumer conduit.Consumer) *Router {
+	r.dflt = &Branch{pipe, consumer}
+	return r
+}
+
+// Conduct is the pre-defined method that makes Router a Conduit.
+// Conduct terminates when all branches have terminated
+// and returns the first error reported by a branch.
+// Barriers are sent down the chain when all branches
+// have processed the data received before the barrier (see Branch).
+func (r *Router) Conduct(src conduit.Source, trg conduit.Target) error {
+	rbs := make([]*runningBranch, len(r.routes))
+	for i, rt := range r.routes {
+		rbs[i] = startBranch(rt.b, r.sz)
+	}
+	var dflt *runningBranch
+	if r.dflt != nil {
+		dflt = startBranch(*r.dflt, r.sz)
+	}
+
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			syncBranches(inp, append(rbs, dflt)...)
+			trg <- inp
+			continue
+		}
+		routed := false
+		for i, rt := range r.routes {
+			if rt.sv.Sieve(inp) {
+				rbs[i].in <- inp
+				routed = true
+				break
+			}
+		}
+		if routed {
+			continue
+		}
+		if dflt != nil {
+			dflt.in <- inp
+		} else {
+			trg <- inp
+		}
+	}
+
+	var err error
+	if dflt != nil {
+		rbs = append(rbs, dflt)
+	}
+	for _, rb := range rbs {
+		e := rb.stop()
+		if err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Volatile is the pre-defined method that makes Router a conduit.Volatile:
+// a Router is volatile if a branch keeps state,
+// which is not included in the checkpoints of the chain.
+func (r *Router) Volatile() bool {
+	if r.dflt != nil && r.dflt.stateful() {
+		return true
+	}
+	for _, rt := range r.routes {
+		if rt.b.stateful() {
+			return true
+		}
+	}
+	return false
+}
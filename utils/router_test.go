@@ -0,0 +1,137 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/toschoo/conduit"
+)
+
+type FailConsumer struct{}
+
+func (c *FailConsumer) Consume(src conduit.Source) error {
+	return errors.New(errMsg)
+}
+
+func divisibleBy(k int) Sieve {
+	return SieveFunc(func(inp interface{}) bool {
+		return inp.(int)%k == 0
+	})
+}
+
+// Router:
+// - It is processed without errors
+// - Items go to the first matching branch
+// - Other items go to the default branch or down the chain
+func TestRouterChain(t *testing.T) {
+	for i := 0; i < numOfTests; i++ {
+		for _, dflt := range []bool{false, true} {
+			err := testRouterChain(numOfData, dflt)
+			if err != nil {
+				m := fmt.Sprintf("RouterChain failed: %v", err)
+				t.Error(m)
+			}
+		}
+	}
+}
+
+// Router with failing branch:
+// - The error is reported
+// - Other branches are not blocked
+func TestErrRouterChain(t *testing.T) {
+	p := &SeqProducer{makeSeq(medium)}
+	c := new(BaseConsumer)
+	r := NewRouter().Route(divisibleBy(2), nil, new(FailConsumer))
+	chn := conduit.NewChain(p, []conduit.Conduit{r}, c, small)
+	err := chn.Run()
+	if err == nil || len(chn.Errs) != 1 || chn.Errs[0].Error() != errMsg {
+		t.Errorf("ErrRouterChain: unexpected errors: %v", chn.Errs)
+	}
+	if len(c.recvd) != medium/2 {
+		t.Errorf("ErrRouterChain: expected %d items, have %d", medium/2, len(c.recvd))
+	}
+}
+
+func testRouterChain(n int, dflt bool) error {
+
+	p := &SeqProducer{makeSeq(n)}
+	c := new(BaseConsumer)
+
+	even := new(BaseConsumer)
+	three := new(BaseConsumer)
+	other := new(BaseConsumer)
+
+	r := NewRouter().
+		Route(divisibleBy(2), nil, even).
+		Route(divisibleBy(3), []conduit.Conduit{NewIdentity()}, three)
+	if dflt {
+		r.Default(nil, other)
+	} else {
+		other = c
+	}
+
+	chn := conduit.NewChain(p, []conduit.Conduit{r}, c, small)
+
+	err := chn.Run()
+	if err != nil {
+		m := fmt.Sprintf("error on running chain: %v", err)
+		return errors.New(m)
+	}
+	if dflt && len(c.recvd) != 0 {
+		return errors.New("items sent down the chain")
+	}
+	var e, t, o []int
+	for i := 0; i < n; i++ {
+		switch {
+		case i%2 == 0:
+			e = append(e, i)
+		case i%3 == 0:
+			t = append(t, i)
+		default:
+			o = append(o, i)
+		}
+	}
+	for _, x := range []struct {
+		have, want []int
+	}{{even.recvd, e}, {three.recvd, t}, {other.recvd, o}} {
+		if len(x.have) != len(x.want) {
+			m := fmt.Sprintf("expected %d items, have %d", len(x.want), len(x.have))
+			return errors.New(m)
+		}
+		for i := range x.want {
+			if x.have[i] != x.want[i] {
+				return errors.New("Received values differ from original!")
+			}
+		}
+	}
+	return nil
+}
+
+// Router with barriers:
+// - Branches have processed their items before the barrier
+// - It is volatile if a branch keeps state
+func TestRouterBarrier(t *testing.T) {
+	var items []interface{}
+	for i := 0; i < 100; i++ {
+		items = append(items, i)
+		if i%10 == 9 {
+			items = append(items, &conduit.Barrier{ID: uint64(i)})
+		}
+	}
+	sc := new(SyncConsumer)
+	r := NewRouter().Route(divisibleBy(2), nil, sc)
+	c := &BarrierConsumer{f: func(id uint64) int { return int(id+1) / 2 }, have: sc.count}
+	if err := conduit.NewChain(&AnyProducer{src: items}, []conduit.Conduit{r}, c, small).Run(); err != nil {
+		t.Fatalf("RouterBarrier failed: %v", err)
+	}
+	for _, e := range c.errs {
+		t.Errorf("RouterBarrier: branch has %s", e)
+	}
+	if len(c.recvd) != 60 || sc.count() != 50 {
+		t.Errorf("RouterBarrier: received %d items, branch %d", len(c.recvd), sc.count())
+	}
+	if r.Volatile() || !r.Default(nil, NewKeyCounter(nil)).Volatile() {
+		t.Errorf("RouterBarrier: unexpected volatility")
+	}
+}
@@ -0,0 +1,173 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/toschoo/conduit"
+)
+
+// RuneMapper is a Conduit that applies a sequence
+// of rune mappings to a text stream.
+// Mappings are applied in the order they were added;
+// a mapping that returns a negative value drops the rune
+// (as with strings.Map).
+// Incoming []byte blocks are treated as one stream,
+// i.e. runes split by block boundaries are joined
+// and outgoing blocks contain only full runes
+// (as with Utf8Conduit), while strings are mapped one by one.
+type RuneMapper struct {
+	maps   []func(rune) rune
+	inWord bool
+}
+
+// NewRuneMapper creates a new RuneMapper Conduit
+// with the given mappings.
+func NewRuneMapper(maps ...func(rune) rune) (rm *RuneMapper) {
+	rm = new(RuneMapper)
+	if rm != nil {
+		rm.maps = maps
+	}
+	return
+}
+
+// Map adds a user-defined mapping.
+func (rm *RuneMapper) Map(f func(rune) rune) *RuneMapper {
+	rm.maps = append(rm.maps, f)
+	return rm
+}
+
+// Upper adds a mapping to upper case.
+func (rm *RuneMapper) Upper() *RuneMapper {
+	return rm.Map(unicode.ToUpper)
+}
+
+// Lower adds a mapping to lower case.
+func (rm *RuneMapper) Lower() *RuneMapper {
+	return rm.Map(unicode.ToLower)
+}
+
+// Title adds a mapping of the first letter of each word
+// to title case; the other runes are not changed,
+// Lower should therefore precede Title to obtain "Title Case".
+// Words are defined as in Tokenizer.
+func (rm *RuneMapper) Title() *RuneMapper {
+	return rm.Map(func(r rune) rune {
+		start := !rm.inWord
+		rm.inWord = isWordRune(r) || (rm.inWord && isJoiner(r))
+		if start {
+			return unicode.ToTitle(r)
+		}
+		return r
+	})
+}
+
+// StripAccents adds a mapping that removes diacritics
+// from Latin letters (e.g. "é" becomes "e")
+// and drops combining marks.
+func (rm *RuneMapper) StripAccents() *RuneMapper {
+	return rm.Map(stripAccent)
+}
+
+// Conduct is the pre-defined method that makes RuneMapper a Conduit.
+// Conduct terminates with an error if an item is not []byte or string.
+func (rm *RuneMapper) Conduct(src conduit.Source, trg conduit.Target) error {
+	var carry []byte
+	rm.inWord = false
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			trg <- inp
+			continue
+		}
+		switch x := inp.(type) {
+		case string:
+			rm.inWord = false
+			trg <- strings.Map(rm.mapRune, x)
+		case []byte:
+			buf := append(carry, x...)
+			n := len(buf) - incompleteTail(buf)
+			if n > 0 {
+				trg <- bytes.Map(rm.mapRune, buf[:n])
+			}
+			carry = append([]byte(nil), buf[n:]...)
+		default:
+			return errors.New(fmt.Sprintf("cannot map runes of %T", inp))
+		}
+	}
+	if len(carry) > 0 {
+		trg <- bytes.Map(rm.mapRune, carry)
+	}
+	return nil
+}
+
+// Applies all mappings to r
+func (rm *RuneMapper) mapRune(r rune) rune {
+	for _, f := range rm.maps {
+		if r < 0 {
+			break
+		}
+		r = f(r)
+	}
+	return r
+}
+
+var accentBase = func() map[rune]rune {
+	m := make(map[rune]rune, utf8.RuneCountInString(accented))
+	base := []rune(unaccented)
+	for i, r := range []rune(accented) {
+		m[r] = base[i]
+	}
+	return m
+}()
+
+// Maps accented Latin letters to their base letters
+// and drops combining marks
+func stripAccent(r rune) rune {
+	if b, ok := accentBase[r]; ok {
+		return b
+	}
+	if unicode.Is(unicode.Mn, r) {
+		return -1
+	}
+	return r
+}
+
+// Precomposed Latin letters and their base letters
+const (
+	accented = "ÀÁÂÃÄÅÇÈÉÊËÌÍÎÏÑÒÓÔÕÖØÙÚÛÜÝàáâãä" +
+		"åçèéêëìíîïñòóôõöøùúûüýÿĀāĂăĄąĆćĈ" +
+		"ĉĊċČčĎďĐđĒēĔĕĖėĘęĚěĜĝĞğĠġĢģĤĥĦħĨ" +
+		"ĩĪīĬĭĮįİĴĵĶķĹĺĻļĽľŁłŃńŅņŇňŌōŎŏŐő" +
+		"ŔŕŖŗŘřŚśŜŝŞşŠšŢţŤťŦŧŨũŪūŬŭŮůŰűŲų" +
+		"ŴŵŶŷŸŹźŻżŽžƠơƯưǍǎǏǐǑǒǓǔǕǖǗǘǙǚǛǜǞ" +
+		"ǟǠǡǢǣǦǧǨǩǪǫǬǭǮǯǰǴǵǸǹǺǻǼǽǾǿȀȁȂȃȄȅ" +
+		"ȆȇȈȉȊȋȌȍȎȏȐȑȒȓȔȕȖȗȘșȚțȞȟȦȧȨȩȪȫȬȭ" +
+		"ȮȯȰȱȲȳḀḁḂḃḄḅḆḇḈḉḊḋḌḍḎḏḐḑḒḓḔḕḖḗḘḙ" +
+		"ḚḛḜḝḞḟḠḡḢḣḤḥḦḧḨḩḪḫḬḭḮḯḰḱḲḳḴḵḶḷḸḹ" +
+		"ḺḻḼḽḾḿṀṁṂṃṄṅṆṇṈṉṊṋṌṍṎṏṐṑṒṓṔṕṖṗṘṙ" +
+		"ṚṛṜṝṞṟṠṡṢṣṤṥṦṧṨṩṪṫṬṭṮṯṰṱṲṳṴṵṶṷṸṹ" +
+		"ṺṻṼṽṾṿẀẁẂẃẄẅẆẇẈẉẊẋẌẍẎẏẐẑẒẓẔẕẖẗẘẙ" +
+		"ẛẠạẢảẤấẦầẨẩẪẫẬậẮắẰằẲẳẴẵẶặẸẹẺẻẼẽẾ" +
+		"ếỀềỂểỄễỆệỈỉỊịỌọỎỏỐốỒồỔổỖỗỘộỚớỜờỞ" +
+		"ởỠỡỢợỤụỦủỨứỪừỬửỮữỰựỲỳỴỵỶỷỸỹ"
+	unaccented = "AAAAAACEEEEIIIINOOOOOOUUUUYaaaaa" +
+		"aceeeeiiiinoooooouuuuyyAaAaAaCcC" +
+		"cCcCcDdDdEeEeEeEeEeGgGgGgGgHhHhI" +
+		"iIiIiIiIJjKkLlLlLlLlNnNnNnOoOoOo" +
+		"RrRrRrSsSsSsSsTtTtTtUuUuUuUuUuUu" +
+		"WwYyYZzZzZzOoUuAaIiOoUuUuUuUuUuA" +
+		"aAaÆæGgKkOoOoƷʒjGgNnAaÆæØøAaAaEe" +
+		"EeIiIiOoOoRrRrUuUuSsTtHhAaEeOoOo" +
+		"OoOoYyAaBbBbBbCcDdDdDdDdDdEeEeEe" +
+		"EeEeFfGgHhHhHhHhHhIiIiKkKkKkLlLl" +
+		"LlLlMmMmMmNnNnNnNnOoOoOoOoPpPpRr" +
+		"RrRrRrSsSsSsSsSsTtTtTtTtUuUuUuUu" +
+		"UuVvVvWwWwWwWwWwXxXxYyZzZzZzhtwy" +
+		"ſAaAaAaAaAaAaAaAaAaAaAaAaEeEeEeE" +
+		"eEeEeEeEeIiIiOoOoOoOoOoOoOoOoOoO" +
+		"oOoOoUuUuUuUuUuUuUuYyYyYyYy"
+)
@@ -0,0 +1,77 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/toschoo/conduit"
+)
+
+const mapText = "the naïve CAFÉ owner's well-known Smørrebrød in Łódź, Ærø "
+
+// Rune mapper:
+// - Case mappings and accent stripping are applied in order
+// - Block boundaries do not split runes
+// - Strings are mapped one by one
+func TestRuneMapper(t *testing.T) {
+	type sample struct {
+		rm   func() *RuneMapper
+		want string
+	}
+	samples := map[string]sample{
+		"upper": {func() *RuneMapper { return NewRuneMapper().Upper() },
+			"THE NAÏVE CAFÉ OWNER'S WELL-KNOWN SMØRREBRØD IN ŁÓDŹ, ÆRØ "},
+		"title": {func() *RuneMapper { return NewRuneMapper().Lower().Title() },
+			"The Naïve Café Owner's Well-known Smørrebrød In Łódź, Ærø "},
+		"strip": {func() *RuneMapper { return NewRuneMapper().StripAccents() },
+			"the naive CAFE owner's well-known Smorrebrod in Lodz, Æro "},
+		"custom": {func() *RuneMapper {
+			return NewRuneMapper(func(r rune) rune {
+				if r == ' ' {
+					return -1
+				}
+				return r
+			}).Lower()
+		}, "thenaïvecaféowner'swell-knownsmørrebrødinłódź,ærø"},
+	}
+	for name, s := range samples {
+		for i := 0; i < numOfTests; i++ {
+			var out bytes.Buffer
+			text := strings.Repeat(mapText, i)
+			pipe := []conduit.Conduit{new(Rechunk), s.rm(), new(Rechunk), NewUtf8Conduit()}
+			chn := conduit.NewChain(&AnyProducer{[]interface{}{[]byte(text)}}, pipe, NewTextPrinter(&out), small)
+			if chn.Run() != nil {
+				t.Fatalf("RuneMapper failed (%s): %v", name, chn.Errs)
+			}
+			if out.String() != strings.Repeat(s.want, i) {
+				m := fmt.Sprintf("RuneMapper failed (%s): expected %q, have %q", name, strings.Repeat(s.want, i), out.String())
+				t.Error(m)
+				break
+			}
+		}
+
+		c := new(AnyConsumer)
+		chn := conduit.NewChain(&AnyProducer{[]interface{}{mapText, "é"}}, []conduit.Conduit{s.rm()}, c, small)
+		if chn.Run() != nil {
+			t.Fatalf("RuneMapper failed (%s): %v", name, chn.Errs)
+		}
+		if len(c.recvd) != 2 || c.recvd[0] != s.want {
+			t.Errorf("RuneMapper on strings (%s): unexpected result %q", name, c.recvd)
+		}
+	}
+}
+
+// Rune mapper with decomposed input:
+// - Combining marks are dropped
+func TestRuneMapperCombining(t *testing.T) {
+	c := new(AnyConsumer)
+	chn := conduit.NewChain(&AnyProducer{[]interface{}{"cafe\u0301 nai\u0308ve"}}, []conduit.Conduit{NewRuneMapper().StripAccents()}, c, small)
+	if chn.Run() != nil {
+		t.Fatalf("RuneMapper failed: %v", chn.Errs)
+	}
+	if fmt.Sprint(c.recvd) != "[cafe naive]" {
+		t.Errorf("RuneMapper: unexpected result %v", c.recvd)
+	}
+}
@@ -0,0 +1,716 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+const (
+	s3MinPart     = 5 * 1024 * 1024
+	s3DefaultPart = 8 * 1024 * 1024
+)
+
+// S3Object is an object of an S3 bucket.
+// Data holds the contents of the object, or, in streaming mode,
+// Body is a reader on the contents, which must be closed.
+type S3Object struct {
+	Bucket       string
+	Key          string
+	Size         int64
+	ETag         string
+	LastModified time.Time
+	Data         []byte
+	Body         io.ReadCloser
+}
+
+// Client for the REST API of S3 with path-style addressing,
+// which is also supported by S3-compatible services
+// like MinIO and the interoperability API of Google Cloud Storage
+type s3Client struct {
+	awsClient
+}
+
+func newS3Client(cfg AWSConfig) s3Client {
+	return s3Client{newAWSClient(cfg, "s3")}
+}
+
+// Escapes a path; slashes are kept
+func s3Escape(p string) string {
+	var b strings.Builder
+	for _, c := range []byte(p) {
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-._~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// Parses an S3 error document into e
+func s3Error(data []byte, e *AWSError) {
+	var rsp struct {
+		Code    string
+		Message string
+	}
+	if xml.Unmarshal(data, &rsp) == nil && rsp.Code != "" {
+		e.Code, e.Message = rsp.Code, rsp.Message
+	}
+}
+
+// Sends a signed request for an object or, if key is empty, a bucket;
+// responses with an error status are returned as *AWSError
+func (c *s3Client) do(ctx context.Context, method, bucket, key string, query url.Values,
+	header http.Header, body []byte) (*http.Response, error) {
+	u, err := url.Parse(c.cfg.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = s3Escape(u.Path)
+	u.RawQuery = strings.Replace(query.Encode(), "+", "%20", -1)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	req.Header.Set("X-Amz-Content-Sha256", sha256Hex(body))
+	signAWS(req, body, c.cfg.Credentials, c.cfg.Region, c.service, time.Now())
+	rsp, err := c.cfg.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.StatusCode >= 300 {
+		data, _ := ioutil.ReadAll(rsp.Body)
+		rsp.Body.Close()
+		e := &AWSError{Status: rsp.StatusCode, Code: rsp.Status}
+		s3Error(data, e)
+		return nil, e
+	}
+	return rsp, nil
+}
+
+// Sends a request and returns the response body and header
+func (c *s3Client) call(ctx context.Context, method, bucket, key string, query url.Values,
+	header http.Header, body []byte) ([]byte, http.Header, error) {
+	rsp, err := c.do(ctx, method, bucket, key, query, header, body)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := ioutil.ReadAll(rsp.Body)
+	rsp.Body.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, rsp.Header, nil
+}
+
+// A range of an object
+type s3Range struct {
+	data []byte
+	err  error
+}
+
+// Body of an object that is read in ranges of part bytes;
+// up to ahead ranges are fetched concurrently in advance
+type s3Body struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	fetch  func(ctx context.Context, first, last int64) ([]byte, error)
+	size   int64
+	part   int64
+	ahead  int
+	next   int64
+	queue  []chan s3Range
+	cur    []byte
+	err    error
+}
+
+// Starts fetching the next ranges
+func (b *s3Body) prefetch() {
+	for len(b.queue) < b.ahead && b.next < b.size {
+		first, last := b.next, b.next+b.part-1
+		if last >= b.size {
+			last = b.size - 1
+		}
+		b.next = last + 1
+		ch := make(chan s3Range, 1)
+		go func() {
+			data, err := b.fetch(b.ctx, first, last)
+			if err == nil && int64(len(data)) != last-first+1 {
+				err = errors.New(fmt.Sprintf("range %d-%d: %d bytes received", first, last, len(data)))
+			}
+			ch <- s3Range{data, err}
+		}()
+		b.queue = append(b.queue, ch)
+	}
+}
+
+func (b *s3Body) Read(p []byte) (int, error) {
+	for len(b.cur) == 0 {
+		if b.err != nil {
+			return 0, b.err
+		}
+		b.prefetch()
+		if len(b.queue) == 0 {
+			return 0, io.EOF
+		}
+		r := <-b.queue[0]
+		b.queue = b.queue[1:]
+		b.cur, b.err = r.data, r.err
+	}
+	n := copy(p, b.cur)
+	b.cur = b.cur[n:]
+	return n, nil
+}
+
+// Close cancels the requests of the body.
+func (b *s3Body) Close() error {
+	b.cancel()
+	if b.err == nil {
+		b.err = errors.New("body closed")
+	}
+	return nil
+}
+
+// S3Reader is a Producer that reads the objects of an S3 bucket
+// and sends them as *S3Object down the chain.
+// The objects are either given by their keys (see SetKeys)
+// or listed, optionally restricted to a prefix
+// and to keys matching glob patterns (see Match).
+// Objects are read in ranges of the part size,
+// which are fetched concurrently (see SetConcurrency);
+// if an object changes while it is read, reading fails.
+// Requests that fail are sent again according
+// to the RetryPolicy (DefaultRetry).
+type S3Reader struct {
+	conduit.Cancelable
+	archiveFilter
+	s3     s3Client
+	bucket string
+	keys   []string
+	prefix string
+	part   int64
+	conc   int
+	retry  RetryPolicy
+	door   sync.Mutex
+	cancel context.CancelFunc
+}
+
+// NewS3Reader creates a new S3Reader Producer
+// reading objects of bucket.
+func NewS3Reader(cfg AWSConfig, bucket string) (sr *S3Reader) {
+	if bucket == "" {
+		return nil
+	}
+	sr = new(S3Reader)
+	if sr != nil {
+		sr.s3 = newS3Client(cfg)
+		sr.bucket = bucket
+		sr.part = s3DefaultPart
+		sr.conc = 4
+		sr.retry = DefaultRetry
+	}
+	return
+}
+
+// SetKeys sets the keys of the objects to read
+// (default: all objects of the bucket).
+func (sr *S3Reader) SetKeys(keys ...string) *S3Reader {
+	sr.keys = keys
+	return sr
+}
+
+// SetPrefix restricts the listed objects to keys
+// starting with prefix.
+func (sr *S3Reader) SetPrefix(prefix string) *S3Reader {
+	sr.prefix = prefix
+	return sr
+}
+
+// Match restricts the listed objects to those matching one of
+// the glob patterns (see path.Match), either with their full key
+// or their base name.
+func (sr *S3Reader) Match(patterns ...string) *S3Reader {
+	sr.patterns = patterns
+	return sr
+}
+
+// Stream sends objects with Body instead of Data.
+// Bodies may be read in any order and concurrently.
+func (sr *S3Reader) Stream() *S3Reader {
+	sr.stream = true
+	return sr
+}
+
+// SetPartSize sets the size of the ranges
+// in which objects are read (default 8MiB).
+func (sr *S3Reader) SetPartSize(n int) *S3Reader {
+	if n > 0 {
+		sr.part = int64(n)
+	}
+	return sr
+}
+
+// SetConcurrency sets the number of ranges of an object
+// that are fetched concurrently (default 4).
+func (sr *S3Reader) SetConcurrency(n int) *S3Reader {
+	if n > 0 {
+		sr.conc = n
+	}
+	return sr
+}
+
+// SetRetry sets the RetryPolicy for requests (default: DefaultRetry).
+func (sr *S3Reader) SetRetry(rp RetryPolicy) *S3Reader {
+	sr.retry = rp
+	return sr
+}
+
+// Cancel cancels the producer and the pending requests.
+func (sr *S3Reader) Cancel() {
+	sr.Cancelable.Cancel()
+	sr.door.Lock()
+	defer sr.door.Unlock()
+	if sr.cancel != nil {
+		sr.cancel()
+	}
+}
+
+// Produce is the pre-defined method that makes S3Reader a Producer.
+func (sr *S3Reader) Produce(trg conduit.Target) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sr.door.Lock()
+	sr.cancel = cancel
+	sr.door.Unlock()
+	for _, key := range sr.keys {
+		if sr.Canceled() {
+			return nil
+		}
+		obj, err := sr.head(ctx, key)
+		if err == nil {
+			err = sr.send(obj, trg)
+		}
+		if err != nil {
+			return sr.failed(err)
+		}
+	}
+	if len(sr.keys) > 0 {
+		return nil
+	}
+	token := ""
+	for !sr.Canceled() {
+		objs, next, err := sr.list(ctx, token)
+		if err != nil {
+			return sr.failed(err)
+		}
+		for _, obj := range objs {
+			if sr.Canceled() {
+				return nil
+			}
+			if !sr.match(obj.Key) {
+				continue
+			}
+			if err = sr.send(obj, trg); err != nil {
+				return sr.failed(err)
+			}
+		}
+		if next == "" {
+			break
+		}
+		token = next
+	}
+	return nil
+}
+
+// Ignores errors caused by canceling
+func (sr *S3Reader) failed(err error) error {
+	if sr.Canceled() {
+		return nil
+	}
+	return err
+}
+
+// Sends a request with retries
+func (sr *S3Reader) call(ctx context.Context, method, key string, query url.Values,
+	header http.Header) (data []byte, h http.Header, err error) {
+	_, err = sr.retry.run(sr.Canceled, func() (bool, error) {
+		data, h, err = sr.s3.call(ctx, method, sr.bucket, key, query, header, nil)
+		return awsRetryable(err) && ctx.Err() == nil, err
+	})
+	return
+}
+
+// Requests the metadata of an object
+func (sr *S3Reader) head(ctx context.Context, key string) (*S3Object, error) {
+	_, h, err := sr.call(ctx, http.MethodHead, key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	obj := &S3Object{Bucket: sr.bucket, Key: key, ETag: h.Get("ETag")}
+	obj.Size, _ = strconv.ParseInt(h.Get("Content-Length"), 10, 64)
+	obj.LastModified, _ = http.ParseTime(h.Get("Last-Modified"))
+	return obj, nil
+}
+
+// Lists a page of objects; returns the token of the next page
+func (sr *S3Reader) list(ctx context.Context, token string) ([]*S3Object, string, error) {
+	query := url.Values{"list-type": {"2"}}
+	if sr.prefix != "" {
+		query.Set("prefix", sr.prefix)
+	}
+	if token != "" {
+		query.Set("continuation-token", token)
+	}
+	data, _, err := sr.call(ctx, http.MethodGet, "", query, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	var rsp struct {
+		Contents []struct {
+			Key          string
+			Size         int64
+			ETag         string
+			LastModified time.Time
+		}
+		IsTruncated           bool
+		NextContinuationToken string
+	}
+	if err = xml.Unmarshal(data, &rsp); err != nil {
+		return nil, "", err
+	}
+	var objs []*S3Object
+	for _, c := range rsp.Contents {
+		objs = append(objs, &S3Object{Bucket: sr.bucket, Key: c.Key, Size: c.Size, ETag: c.ETag, LastModified: c.LastModified})
+	}
+	if !rsp.IsTruncated {
+		return objs, "", nil
+	}
+	return objs, rsp.NextContinuationToken, nil
+}
+
+// Sends an object with its contents or its body down the chain
+func (sr *S3Reader) send(obj *S3Object, trg conduit.Target) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	body := &s3Body{ctx: ctx, cancel: cancel, size: obj.Size, part: sr.part, ahead: sr.conc}
+	body.fetch = func(ctx context.Context, first, last int64) ([]byte, error) {
+		header := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", first, last)}}
+		if obj.ETag != "" {
+			header.Set("If-Match", obj.ETag)
+		}
+		data, _, err := sr.call(ctx, http.MethodGet, obj.Key, nil, header)
+		return data, err
+	}
+	if sr.stream {
+		obj.Body = body
+		trg <- obj
+		return nil
+	}
+	data, err := ioutil.ReadAll(body)
+	body.Close()
+	if err != nil {
+		return errors.New(fmt.Sprintf("cannot read %s: %v", obj.Key, err))
+	}
+	obj.Data = data
+	trg <- obj
+	return nil
+}
+
+// A part of a multipart upload
+type s3Part struct {
+	PartNumber int
+	ETag       string
+}
+
+// Object being written: the data is uploaded in parts
+// once it exceeds the part size
+type s3Upload struct {
+	w     *S3Writer
+	key   string
+	id    string
+	buf   bytes.Buffer
+	size  int64
+	parts []s3Part
+}
+
+// Sends a request with retries
+func (u *s3Upload) call(method string, query url.Values, body []byte) (data []byte, h http.Header, err error) {
+	_, err = u.w.retry.run(nil, func() (bool, error) {
+		data, h, err = u.w.s3.call(context.Background(), method, u.w.bucket, u.key, query, u.w.header, body)
+		return awsRetryable(err), err
+	})
+	return
+}
+
+func (u *s3Upload) write(data []byte) error {
+	u.buf.Write(data)
+	u.size += int64(len(data))
+	for u.buf.Len() >= u.w.part {
+		err := u.upload(u.buf.Next(u.w.part))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Uploads the next part; starts the upload with the first part
+func (u *s3Upload) upload(data []byte) error {
+	if u.id == "" {
+		rsp, _, err := u.call(http.MethodPost, url.Values{"uploads": {""}}, nil)
+		if err != nil {
+			return err
+		}
+		var r struct{ UploadId string }
+		if err = xml.Unmarshal(rsp, &r); err != nil {
+			return err
+		}
+		u.id = r.UploadId
+	}
+	n := len(u.parts) + 1
+	_, h, err := u.call(http.MethodPut, url.Values{"partNumber": {strconv.Itoa(n)}, "uploadId": {u.id}}, data)
+	if err != nil {
+		return err
+	}
+	u.parts = append(u.parts, s3Part{PartNumber: n, ETag: h.Get("ETag")})
+	return nil
+}
+
+// Completes the object; small objects are put with a single request
+func (u *s3Upload) finish() error {
+	if u.id == "" {
+		_, _, err := u.call(http.MethodPut, nil, u.buf.Bytes())
+		return err
+	}
+	if u.buf.Len() > 0 {
+		if err := u.upload(u.buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: u.parts})
+	if err != nil {
+		return err
+	}
+	// completion may fail after the response has started;
+	// the error is then reported in the body
+	_, err = u.w.retry.run(nil, func() (bool, error) {
+		data, _, err := u.w.s3.call(context.Background(), http.MethodPost, u.w.bucket, u.key,
+			url.Values{"uploadId": {u.id}}, nil, body)
+		if err == nil && bytes.Contains(data, []byte("<Error>")) {
+			e := &AWSError{Status: http.StatusInternalServerError}
+			s3Error(data, e)
+			err = e
+		}
+		return awsRetryable(err), err
+	})
+	return err
+}
+
+// Aborts the upload, so that the parts are deleted
+func (u *s3Upload) abort() {
+	if u.id != "" {
+		u.w.s3.call(context.Background(), http.MethodDelete, u.w.bucket, u.key, url.Values{"uploadId": {u.id}}, nil, nil)
+	}
+}
+
+// S3Writer is a Consumer that writes the incoming items
+// to objects of an S3 bucket. []byte and string items
+// are written as they are, other items are encoded
+// with a MarshalFunc (default: json.Marshal)
+// and terminated by a newline (JSON Lines).
+// An object is completed and a new one started when it reaches
+// the maximum size (see SetMaxSize), when it reaches
+// the maximum age (see SetMaxAge), at barriers,
+// so that checkpoints cover only complete objects,
+// and at the end of the stream.
+// Objects are written with multipart uploads in parts
+// of the part size; smaller objects with a single request.
+// Requests that fail are sent again according
+// to the RetryPolicy (DefaultRetry); if they finally fail,
+// the upload is aborted and the consumer terminates with an error.
+type S3Writer struct {
+	s3      s3Client
+	bucket  string
+	naming  func(n int, t time.Time) string
+	header  http.Header
+	marshal MarshalFunc
+	maxSize int64
+	maxAge  time.Duration
+	part    int
+	retry   RetryPolicy
+}
+
+// NewS3Writer creates a new S3Writer Consumer writing objects
+// to bucket; by default, keys are formed of the prefix,
+// the time the object is started and a sequence number,
+// e.g. logs/20240102T150405Z-00001.
+func NewS3Writer(cfg AWSConfig, bucket, prefix string) (sw *S3Writer) {
+	if bucket == "" {
+		return nil
+	}
+	sw = new(S3Writer)
+	if sw != nil {
+		sw.s3 = newS3Client(cfg)
+		sw.bucket = bucket
+		sw.naming = func(n int, t time.Time) string {
+			return fmt.Sprintf("%s%s-%05d", prefix, t.UTC().Format("20060102T150405Z"), n)
+		}
+		sw.header = make(http.Header)
+		sw.marshal = json.Marshal
+		sw.maxSize = 128 * 1024 * 1024
+		sw.part = s3DefaultPart
+		sw.retry = DefaultRetry
+	}
+	return
+}
+
+// SetNaming sets the function that forms the key of the n-th object
+// (starting at 1) started at t.
+func (sw *S3Writer) SetNaming(f func(n int, t time.Time) string) *S3Writer {
+	sw.naming = f
+	return sw
+}
+
+// SetContentType sets the content type of the objects.
+func (sw *S3Writer) SetContentType(ct string) *S3Writer {
+	sw.header.Set("Content-Type", ct)
+	return sw
+}
+
+// SetMarshal sets the MarshalFunc.
+func (sw *S3Writer) SetMarshal(marshal MarshalFunc) *S3Writer {
+	sw.marshal = marshal
+	return sw
+}
+
+// SetMaxSize sets the size in bytes at which an object
+// is completed (default 128MiB).
+func (sw *S3Writer) SetMaxSize(n int64) *S3Writer {
+	if n > 0 {
+		sw.maxSize = n
+	}
+	return sw
+}
+
+// SetMaxAge sets the time after which an object
+// is completed (default: none).
+func (sw *S3Writer) SetMaxAge(d time.Duration) *S3Writer {
+	sw.maxAge = d
+	return sw
+}
+
+// SetPartSize sets the size of the parts
+// of multipart uploads (at least 5MiB, default 8MiB).
+func (sw *S3Writer) SetPartSize(n int) *S3Writer {
+	if n >= s3MinPart {
+		sw.part = n
+	}
+	return sw
+}
+
+// SetRetry sets the RetryPolicy for requests (default: DefaultRetry).
+func (sw *S3Writer) SetRetry(rp RetryPolicy) *S3Writer {
+	sw.retry = rp
+	return sw
+}
+
+// Contents of an item
+func (sw *S3Writer) encode(inp interface{}) ([]byte, error) {
+	switch x := inp.(type) {
+	case []byte:
+		return x, nil
+	case string:
+		return []byte(x), nil
+	}
+	data, err := sw.marshal(inp)
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// Consume is the pre-defined method that makes S3Writer a Consumer.
+func (sw *S3Writer) Consume(src conduit.Source) error {
+	var u *s3Upload
+	var timer *time.Timer
+	var expired <-chan time.Time
+	n := 0
+	roll := func() error {
+		if u == nil {
+			return nil
+		}
+		if timer != nil {
+			timer.Stop()
+			timer, expired = nil, nil
+		}
+		err := u.finish()
+		if err != nil {
+			u.abort()
+		}
+		u = nil
+		return err
+	}
+	for {
+		select {
+		case inp, ok := <-src:
+			if !ok {
+				return roll()
+			}
+			if conduit.IsBarrier(inp) {
+				if err := roll(); err != nil {
+					return err
+				}
+				continue
+			}
+			data, err := sw.encode(inp)
+			if err != nil {
+				return err
+			}
+			if u == nil {
+				n++
+				u = &s3Upload{w: sw, key: sw.naming(n, time.Now())}
+				if sw.maxAge > 0 {
+					timer = time.NewTimer(sw.maxAge)
+					expired = timer.C
+				}
+			}
+			if err = u.write(data); err != nil {
+				u.abort()
+				return err
+			}
+			if u.size >= sw.maxSize {
+				if err = roll(); err != nil {
+					return err
+				}
+			}
+		case <-expired:
+			timer, expired = nil, nil
+			if err := roll(); err != nil {
+				return err
+			}
+		}
+	}
+}
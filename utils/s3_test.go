@@ -0,0 +1,347 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+// S3 test server with a single bucket; listings are paged by 2.
+// The first range request of keys starting with "flaky"
+// and the first completion of a multipart upload fail.
+type s3Server struct {
+	srv       *httptest.Server
+	door      sync.Mutex
+	objects   map[string][]byte
+	uploads   map[string]map[int][]byte
+	flaked    map[string]bool
+	completed bool
+	ranges    int
+	parts     int
+}
+
+func newS3Server() *s3Server {
+	ss := &s3Server{
+		objects: make(map[string][]byte),
+		uploads: make(map[string]map[int][]byte),
+		flaked:  make(map[string]bool),
+	}
+	ss.srv = httptest.NewServer(http.HandlerFunc(ss.handle))
+	return ss
+}
+
+func (ss *s3Server) config() AWSConfig {
+	return AWSConfig{
+		Region:      "us-east-1",
+		Credentials: AWSCredentials{AccessKeyID: "key", SecretAccessKey: "secret"},
+		Endpoint:    ss.srv.URL,
+	}
+}
+
+func (ss *s3Server) put(key string, data []byte) {
+	ss.door.Lock()
+	defer ss.door.Unlock()
+	ss.objects[key] = data
+}
+
+func (ss *s3Server) keys() []string {
+	ss.door.Lock()
+	defer ss.door.Unlock()
+	var keys []string
+	for k := range ss.objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (ss *s3Server) object(key string) []byte {
+	ss.door.Lock()
+	defer ss.door.Unlock()
+	return ss.objects[key]
+}
+
+func etag(data []byte) string {
+	h := md5.Sum(data)
+	return `"` + hex.EncodeToString(h[:]) + `"`
+}
+
+func (ss *s3Server) fail(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func (ss *s3Server) handle(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=key/") ||
+		r.Header.Get("X-Amz-Content-Sha256") != sha256Hex(body) {
+		ss.fail(w, http.StatusForbidden, "SignatureDoesNotMatch")
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, "/bucket") {
+		ss.fail(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/bucket"), "/")
+	q := r.URL.Query()
+	ss.door.Lock()
+	defer ss.door.Unlock()
+	switch {
+	case key == "" && q.Get("list-type") == "2":
+		ss.list(w, q.Get("prefix"), q.Get("continuation-token"))
+	case r.Method == http.MethodHead || r.Method == http.MethodGet:
+		data, ok := ss.objects[key]
+		if !ok {
+			ss.fail(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		if m := r.Header.Get("If-Match"); m != "" && m != etag(data) {
+			ss.fail(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		w.Header().Set("ETag", etag(data))
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		if r.Method == http.MethodHead {
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			return
+		}
+		ss.ranges++
+		if strings.HasPrefix(key, "flaky") && !ss.flaked[key] {
+			ss.flaked[key] = true
+			ss.fail(w, http.StatusServiceUnavailable, "SlowDown")
+			return
+		}
+		var first, last int
+		fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &first, &last)
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(data[first : last+1])
+	case r.Method == http.MethodPost && q["uploads"] != nil:
+		id := fmt.Sprintf("upload-%d", len(ss.uploads))
+		ss.uploads[id] = make(map[int][]byte)
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", id)
+	case r.Method == http.MethodPut && q["uploadId"] != nil:
+		parts, ok := ss.uploads[q.Get("uploadId")]
+		if !ok {
+			ss.fail(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		n, _ := strconv.Atoi(q.Get("partNumber"))
+		parts[n] = body
+		ss.parts++
+		w.Header().Set("ETag", etag(body))
+	case r.Method == http.MethodPost && q["uploadId"] != nil:
+		ss.complete(w, key, q.Get("uploadId"), body)
+	case r.Method == http.MethodDelete && q["uploadId"] != nil:
+		delete(ss.uploads, q.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut:
+		ss.objects[key] = body
+		w.Header().Set("ETag", etag(body))
+	default:
+		ss.fail(w, http.StatusBadRequest, "InvalidRequest")
+	}
+}
+
+func (ss *s3Server) list(w http.ResponseWriter, prefix, token string) {
+	var keys []string
+	for k := range ss.objects {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	start, _ := strconv.Atoi(token)
+	end := start + 2
+	if end > len(keys) {
+		end = len(keys)
+	}
+	var b strings.Builder
+	b.WriteString("<ListBucketResult>")
+	for _, k := range keys[start:end] {
+		fmt.Fprintf(&b, "<Contents><Key>%s</Key><Size>%d</Size><ETag>%s</ETag><LastModified>%s</LastModified></Contents>",
+			k, len(ss.objects[k]), strings.Replace(etag(ss.objects[k]), `"`, "&quot;", -1),
+			time.Now().UTC().Format("2006-01-02T15:04:05.000Z"))
+	}
+	if end < len(keys) {
+		fmt.Fprintf(&b, "<IsTruncated>true</IsTruncated><NextContinuationToken>%d</NextContinuationToken>", end)
+	}
+	b.WriteString("</ListBucketResult>")
+	w.Write([]byte(b.String()))
+}
+
+// Completes an upload; parts must have the minimum size except the last
+func (ss *s3Server) complete(w http.ResponseWriter, key, id string, body []byte) {
+	parts, ok := ss.uploads[id]
+	if !ok {
+		ss.fail(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+	if !ss.completed {
+		ss.completed = true
+		w.Write([]byte("<Error><Code>InternalError</Code><Message>try again</Message></Error>"))
+		return
+	}
+	var req struct {
+		Part []struct {
+			PartNumber int
+			ETag       string
+		}
+	}
+	if xml.Unmarshal(body, &req) != nil || len(req.Part) != len(parts) {
+		ss.fail(w, http.StatusBadRequest, "InvalidPart")
+		return
+	}
+	var data []byte
+	for i, p := range req.Part {
+		part := parts[p.PartNumber]
+		if p.PartNumber != i+1 || p.ETag != etag(part) || (i < len(req.Part)-1 && len(part) < s3MinPart) {
+			ss.fail(w, http.StatusBadRequest, "InvalidPart")
+			return
+		}
+		data = append(data, part...)
+	}
+	ss.objects[key] = data
+	delete(ss.uploads, id)
+	w.Write([]byte("<CompleteMultipartUploadResult></CompleteMultipartUploadResult>"))
+}
+
+// S3 writer:
+// - Objects are completed at the maximum size with multipart uploads
+// in parts of the part size; failed completions are retried
+// - Objects are completed at the maximum age and at the end;
+// small objects are put with a single request
+// - Items are written as they are or as JSON Lines
+func TestS3Writer(t *testing.T) {
+	ss := newS3Server()
+	defer ss.srv.Close()
+
+	var items []interface{}
+	var all []byte
+	for i := 0; i < 200; i++ {
+		item := bytes.Repeat([]byte{byte('a' + i%26)}, 100*1024)
+		items = append(items, item)
+		all = append(all, item...)
+	}
+	sw := NewS3Writer(ss.config(), "bucket", "big/").SetPartSize(s3MinPart).SetMaxSize(12 * 1024 * 1024).SetRetry(fastRetry)
+	if err := conduit.NewChain(&AnyProducer{items}, nil, sw, small).Run(); err != nil {
+		t.Fatalf("S3Writer failed: %v", err)
+	}
+	keys := ss.keys()
+	if len(keys) != 2 || !strings.HasPrefix(keys[0], "big/") || !strings.HasSuffix(keys[1], "-00002") {
+		t.Fatalf("S3Writer: unexpected objects %v", keys)
+	}
+	data := append(ss.object(keys[0]), ss.object(keys[1])...)
+	if !bytes.Equal(data, all) || len(ss.object(keys[0])) < 12*1024*1024 {
+		t.Errorf("S3Writer: objects of %d and %d bytes", len(ss.object(keys[0])), len(ss.object(keys[1])))
+	}
+	if ss.parts != 5 || len(ss.uploads) != 0 {
+		t.Errorf("S3Writer: %d parts uploaded, %d uploads left", ss.parts, len(ss.uploads))
+	}
+
+	ch := make(chan interface{})
+	sw = NewS3Writer(ss.config(), "bucket", "small/").SetMaxAge(50 * time.Millisecond).
+		SetNaming(func(n int, _ time.Time) string { return fmt.Sprintf("small/%d.jsonl", n) })
+	done := make(chan error)
+	go func() { done <- conduit.NewChain(&ChanProducer{ch}, nil, sw, small).Run() }()
+	ch <- kinesisItem{K: "a", N: 1}
+	ch <- "raw\n"
+	time.Sleep(150 * time.Millisecond)
+	ch <- kinesisItem{K: "b", N: 2}
+	close(ch)
+	if err := <-done; err != nil {
+		t.Fatalf("S3Writer failed: %v", err)
+	}
+	if s := string(ss.object("small/1.jsonl")); s != "{\"k\":\"a\",\"n\":1}\nraw\n" {
+		t.Errorf("S3Writer: unexpected object %q", s)
+	}
+	if s := string(ss.object("small/2.jsonl")); s != "{\"k\":\"b\",\"n\":2}\n" {
+		t.Errorf("S3Writer: unexpected object %q", s)
+	}
+}
+
+// S3 reader:
+// - Objects are listed by prefix and pattern and read in ranges
+// - Failed range requests are retried
+// - Bodies are streamed; reading fails if the object changes
+func TestS3Reader(t *testing.T) {
+	ss := newS3Server()
+	defer ss.srv.Close()
+	rnd := rand.New(rand.NewSource(1))
+	objs := make(map[string][]byte)
+	for _, k := range []string{"logs/a.jsonl", "logs/b.txt", "logs/c d.jsonl", "logs/e.jsonl", "other/f.jsonl", "flaky/g"} {
+		data := make([]byte, 1000+rnd.Intn(5000))
+		rnd.Read(data)
+		objs[k] = data
+		ss.put(k, data)
+	}
+	ss.put("logs/empty.jsonl", nil)
+
+	c := &TakeConsumer{n: -1}
+	sr := NewS3Reader(ss.config(), "bucket").SetPrefix("logs/").Match("*.jsonl").SetPartSize(1000).SetConcurrency(3)
+	if err := conduit.NewChain(sr, nil, c, small).Run(); err != nil {
+		t.Fatalf("S3Reader failed: %v", err)
+	}
+	var keys []string
+	for _, inp := range c.recvd {
+		obj := inp.(*S3Object)
+		keys = append(keys, obj.Key)
+		if !bytes.Equal(obj.Data, objs[obj.Key]) || obj.Size != int64(len(obj.Data)) || obj.ETag != etag(obj.Data) {
+			t.Errorf("S3Reader: unexpected data of %s (%d bytes)", obj.Key, len(obj.Data))
+		}
+	}
+	if strings.Join(keys, ",") != "logs/a.jsonl,logs/c d.jsonl,logs/e.jsonl,logs/empty.jsonl" {
+		t.Errorf("S3Reader: unexpected objects %v", keys)
+	}
+	if ss.ranges < 6 {
+		t.Errorf("S3Reader: objects not read in ranges (%d requests)", ss.ranges)
+	}
+
+	c = &TakeConsumer{n: -1}
+	sr = NewS3Reader(ss.config(), "bucket").SetKeys("flaky/g", "other/f.jsonl").Stream().SetPartSize(500).SetRetry(fastRetry)
+	if err := conduit.NewChain(sr, nil, c, small).Run(); err != nil {
+		t.Fatalf("S3Reader failed: %v", err)
+	}
+	for _, inp := range c.recvd {
+		obj := inp.(*S3Object)
+		data, err := ioutil.ReadAll(obj.Body)
+		obj.Body.Close()
+		if err != nil || !bytes.Equal(data, objs[obj.Key]) {
+			t.Errorf("S3Reader: unexpected body of %s: %v", obj.Key, err)
+		}
+	}
+	if len(c.recvd) != 2 {
+		t.Fatalf("S3Reader: %d objects received", len(c.recvd))
+	}
+
+	c = &TakeConsumer{n: -1}
+	sr = NewS3Reader(ss.config(), "bucket").SetKeys("logs/a.jsonl").Stream().SetPartSize(100).SetConcurrency(1)
+	if err := conduit.NewChain(sr, nil, c, small).Run(); err != nil {
+		t.Fatalf("S3Reader failed: %v", err)
+	}
+	body := c.recvd[0].(*S3Object).Body
+	defer body.Close()
+	if _, err := body.Read(make([]byte, 100)); err != nil {
+		t.Fatalf("S3Reader: %v", err)
+	}
+	ss.put("logs/a.jsonl", []byte("changed"))
+	if _, err := ioutil.ReadAll(body); err == nil || !strings.Contains(err.Error(), "PreconditionFailed") {
+		t.Errorf("S3Reader: changed object read: %v", err)
+	}
+	if NewS3Reader(ss.config(), "") != nil {
+		t.Errorf("NewS3Reader: reader without bucket created")
+	}
+}
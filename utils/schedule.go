@@ -0,0 +1,295 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+// Schedule determines the times at which a Scheduler fires.
+type Schedule interface {
+	// Next returns the first time after t
+	// or the zero time if there is none.
+	Next(t time.Time) time.Time
+}
+
+// Every returns a Schedule that fires every d,
+// aligned to multiples of d since the zero time
+// (i.e. every full hour for time.Hour).
+func Every(d time.Duration) Schedule {
+	return every(d)
+}
+
+type every time.Duration
+
+func (e every) Next(t time.Time) time.Time {
+	d := time.Duration(e)
+	if d <= 0 {
+		return time.Time{}
+	}
+	return t.Truncate(d).Add(d)
+}
+
+// CronSchedule is a Schedule defined by a cron expression
+// (see ParseCron).
+type CronSchedule struct {
+	second, minute, hour, dom, month, dow uint64
+	anyDom, anyDow                        bool
+	loc                                   *time.Location
+}
+
+// A field of a cron expression
+type cronField struct {
+	min, max int
+	names    []string
+}
+
+var (
+	cronSeconds = cronField{0, 59, nil}
+	cronMinutes = cronField{0, 59, nil}
+	cronHours   = cronField{0, 23, nil}
+	cronDays    = cronField{1, 31, nil}
+	cronMonths  = cronField{1, 12, []string{"jan", "feb", "mar", "apr", "may", "jun",
+		"jul", "aug", "sep", "oct", "nov", "dec"}}
+	cronWeekdays = cronField{0, 7, []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}}
+)
+
+// Expressions of the macros
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// Parses a value of f, which may be a name
+func (f cronField) value(s string) (int, error) {
+	for i, n := range f.names {
+		if strings.EqualFold(s, n) {
+			return i + f.min, nil
+		}
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < f.min || v > f.max {
+		return 0, errors.New(fmt.Sprintf("invalid value %q", s))
+	}
+	return v, nil
+}
+
+// Parses a field into a bit set
+func (f cronField) parse(s string) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(s, ",") {
+		rng, step := part, 1
+		if i := strings.IndexByte(part, '/'); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, errors.New(fmt.Sprintf("invalid step in %q", part))
+			}
+			rng, step = part[:i], n
+		}
+		lo, hi := f.min, f.max
+		switch {
+		case rng == "*" || rng == "?":
+		case strings.Contains(rng, "-"):
+			i := strings.IndexByte(rng, '-')
+			var err error
+			if lo, err = f.value(rng[:i]); err != nil {
+				return 0, err
+			}
+			if hi, err = f.value(rng[i+1:]); err != nil {
+				return 0, err
+			}
+			if hi < lo {
+				return 0, errors.New(fmt.Sprintf("invalid range %q", rng))
+			}
+		default:
+			v, err := f.value(rng)
+			if err != nil {
+				return 0, err
+			}
+			lo = v
+			if step == 1 {
+				hi = v
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// ParseCron parses a cron expression with five fields
+// (minute, hour, day of month, month, day of week)
+// or six fields (with seconds first). Fields are
+// "*", values, ranges ("1-5"), steps ("*/15", "0-30/10")
+// and lists of these ("1,15"); months and days of the week
+// may be given by their English abbreviations ("jan", "mon"),
+// Sunday is 0 or 7. If both day of month and day of week
+// are restricted, days matching either are selected.
+// The macros @yearly, @monthly, @weekly, @daily and @hourly
+// are accepted as well. Times are computed in loc
+// (nil: time.Local).
+func ParseCron(expr string, loc *time.Location) (*CronSchedule, error) {
+	if m, ok := cronMacros[strings.ToLower(strings.TrimSpace(expr))]; ok {
+		expr = m
+	}
+	fields := strings.Fields(expr)
+	if len(fields) == 5 {
+		fields = append([]string{"0"}, fields...)
+	}
+	if len(fields) != 6 {
+		return nil, errors.New(fmt.Sprintf("cron: %q: expected 5 or 6 fields", expr))
+	}
+	if loc == nil {
+		loc = time.Local
+	}
+	cs := &CronSchedule{loc: loc}
+	for i, f := range []struct {
+		field cronField
+		bits  *uint64
+	}{
+		{cronSeconds, &cs.second}, {cronMinutes, &cs.minute}, {cronHours, &cs.hour},
+		{cronDays, &cs.dom}, {cronMonths, &cs.month}, {cronWeekdays, &cs.dow},
+	} {
+		bits, err := f.field.parse(fields[i])
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("cron: %q: %v", expr, err))
+		}
+		*f.bits = bits
+	}
+	if cs.dow&(1<<7) != 0 {
+		cs.dow |= 1
+	}
+	cs.anyDom = fields[3] == "*" || fields[3] == "?"
+	cs.anyDow = fields[5] == "*" || fields[5] == "?"
+	return cs, nil
+}
+
+// Tells whether the day of t matches
+func (cs *CronSchedule) day(t time.Time) bool {
+	dom := cs.dom&(1<<uint(t.Day())) != 0
+	dow := cs.dow&(1<<uint(t.Weekday())) != 0
+	if cs.anyDom || cs.anyDow {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// Next is the pre-defined method that makes CronSchedule a Schedule.
+func (cs *CronSchedule) Next(t time.Time) time.Time {
+	t = t.In(cs.loc).Truncate(time.Second).Add(time.Second)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case cs.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, cs.loc)
+		case !cs.day(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, cs.loc)
+		case cs.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, cs.loc)
+		case cs.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Truncate(time.Minute).Add(time.Minute)
+		case cs.second&(1<<uint(t.Second())) == 0:
+			t = t.Add(time.Second)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// Scheduler is a Producer that fires at the times of a Schedule
+// and sends the time (of the schedule) down the chain
+// or, with a Generator (see SetGenerator), the item it generates.
+// Times that are missed, because the chain is busy,
+// are skipped. The scheduler runs until it is canceled,
+// the schedule has no next time or the Generator returns io.EOF.
+type Scheduler struct {
+	conduit.Cancelable
+	sched   Schedule
+	gen     Generator
+	barrier bool
+}
+
+// NewScheduler creates a new Scheduler Producer.
+func NewScheduler(s Schedule) (sc *Scheduler) {
+	if s == nil {
+		return nil
+	}
+	sc = new(Scheduler)
+	if sc != nil {
+		sc.sched = s
+	}
+	return
+}
+
+// NewCronScheduler creates a new Scheduler Producer
+// that fires according to the cron expression expr
+// in local time (see ParseCron).
+func NewCronScheduler(expr string) (*Scheduler, error) {
+	cs, err := ParseCron(expr, nil)
+	if err != nil {
+		return nil, err
+	}
+	return NewScheduler(cs), nil
+}
+
+// SetGenerator calls g at each time
+// and sends its result instead of the time.
+func (sc *Scheduler) SetGenerator(g Generator) *Scheduler {
+	sc.gen = g
+	return sc
+}
+
+// SetBarrier sends a barrier after each item,
+// e.g. to make stages downstream flush their output.
+func (sc *Scheduler) SetBarrier() *Scheduler {
+	sc.barrier = true
+	return sc
+}
+
+// Resume is the pre-defined method that makes Scheduler
+// a conduit.Resumer. After a restart, the scheduler fires
+// at the next time of the schedule, so nothing is skipped.
+func (sc *Scheduler) Resume(pos uint64) error {
+	return nil
+}
+
+// Produce is the pre-defined method that makes Scheduler a Producer.
+func (sc *Scheduler) Produce(trg conduit.Target) error {
+	for !sc.Canceled() {
+		next := sc.sched.Next(time.Now())
+		if next.IsZero() {
+			return nil
+		}
+		if !sleep(time.Until(next), sc.Canceled) {
+			return nil
+		}
+		var item interface{} = next
+		if sc.gen != nil {
+			var err error
+			item, err = sc.gen.Generate()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+		trg <- item
+		if sc.barrier {
+			trg <- &conduit.Barrier{}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package utils
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+func TestParseCron(t *testing.T) {
+	at := func(s string) time.Time {
+		tm, err := time.ParseInLocation("2006-01-02 15:04:05", s, time.UTC)
+		if err != nil {
+			t.Fatalf("invalid time %s", s)
+		}
+		return tm
+	}
+	for _, tc := range []struct {
+		expr string
+		from string
+		want string
+	}{
+		{"* * * * *", "2024-03-04 10:00:30", "2024-03-04 10:01:00"},
+		{"*/15 * * * *", "2024-03-04 10:00:00", "2024-03-04 10:15:00"},
+		{"0 9-17/4 * * mon-fri", "2024-03-04 17:00:00", "2024-03-05 09:00:00"},
+		{"30 2 * * 7", "2024-03-04 10:00:00", "2024-03-10 02:30:00"},
+		{"0 0 1,15 * *", "2024-03-04 10:00:00", "2024-03-15 00:00:00"},
+		{"0 0 13 * fri", "2024-03-04 10:00:00", "2024-03-08 00:00:00"},
+		{"0 0 29 feb *", "2024-03-04 10:00:00", "2028-02-29 00:00:00"},
+		{"@monthly", "2024-12-31 23:59:59", "2025-01-01 00:00:00"},
+		{"@hourly", "2024-03-04 10:00:00", "2024-03-04 11:00:00"},
+		{"*/20 * * * * *", "2024-03-04 10:00:45", "2024-03-04 10:01:00"},
+		{"0 0 31 apr *", "2024-03-04 10:00:00", ""},
+	} {
+		cs, err := ParseCron(tc.expr, time.UTC)
+		if err != nil {
+			t.Errorf("ParseCron %q failed: %v", tc.expr, err)
+			continue
+		}
+		next := cs.Next(at(tc.from))
+		if (tc.want == "" && !next.IsZero()) || (tc.want != "" && !next.Equal(at(tc.want))) {
+			t.Errorf("ParseCron %q: next after %s is %v, expected %s", tc.expr, tc.from, next, tc.want)
+		}
+	}
+	for _, expr := range []string{"* * * *", "60 * * * *", "* 5-1 * * *", "*/0 * * * *", "* * * foo *", "@often"} {
+		if _, err := ParseCron(expr, nil); err == nil {
+			t.Errorf("ParseCron: %q accepted", expr)
+		}
+	}
+	if next := Every(time.Hour).Next(at("2024-03-04 10:20:00")); !next.Equal(at("2024-03-04 11:00:00")) {
+		t.Errorf("Every: next is %v", next)
+	}
+}
+
+// Generator that counts up to n
+type countGenerator struct {
+	i, n int
+}
+
+func (g *countGenerator) Generate() (interface{}, error) {
+	if g.i >= g.n {
+		return nil, io.EOF
+	}
+	g.i++
+	return g.i, nil
+}
+
+// Scheduler:
+// - Times are sent at the times of the schedule
+// - Generated items are sent with barriers until the generator ends
+func TestScheduler(t *testing.T) {
+	if NewScheduler(nil) != nil {
+		t.Errorf("Scheduler: nil schedule accepted")
+	}
+	if _, err := NewCronScheduler("x"); err == nil {
+		t.Errorf("Scheduler: invalid expression accepted")
+	}
+	c := &TakeConsumer{n: 3}
+	start := time.Now()
+	if err := conduit.NewChain(NewScheduler(Every(30*time.Millisecond)), nil, c, small).Run(); err != nil {
+		t.Fatalf("Scheduler failed: %v", err)
+	}
+	for i, inp := range c.recvd {
+		tm := inp.(time.Time)
+		if tm.Before(start) || tm.UnixNano()%int64(30*time.Millisecond) != 0 || (i > 0 && !tm.After(c.recvd[i-1].(time.Time))) {
+			t.Errorf("Scheduler: unexpected times %v", c.recvd)
+		}
+	}
+
+	ac := &AnyConsumer{}
+	sc := NewScheduler(Every(10 * time.Millisecond)).SetGenerator(&countGenerator{n: 3}).SetBarrier()
+	if err := conduit.NewChain(sc, nil, ac, small).Run(); err != nil {
+		t.Fatalf("Scheduler failed: %v", err)
+	}
+	if len(ac.recvd) != 6 || ac.recvd[0] != 1 || !conduit.IsBarrier(ac.recvd[1]) || ac.recvd[4] != 3 {
+		t.Errorf("Scheduler: received %v", ac.recvd)
+	}
+}
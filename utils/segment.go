@@ -0,0 +1,243 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/toschoo/conduit"
+)
+
+// Segmenter is a Conduit that re-chunks a text stream
+// into sentences or paragraphs and sends them down the chain
+// as strings. Incoming []byte blocks and strings are treated
+// as one stream; strings are considered lines,
+// i.e. they are terminated by a newline.
+// Paragraphs are separated by blank lines
+// and are sent with leading and trailing space removed.
+// Sentences end with '.', '!', '?' or '…', optionally
+// followed by closing quotes or brackets, and whitespace;
+// a period does not end a sentence, if the next sentence
+// would start with a lower-case letter or the word before it
+// is an abbreviation. Paragraph breaks always end sentences.
+// Whitespace within sentences is collapsed to single spaces.
+// Text of incomplete segments is included in checkpoints
+// (see conduit.Checkpointer).
+type Segmenter struct {
+	para     bool
+	abbrev   func(word string) bool
+	pending  []byte // text of incomplete segments
+	restored bool   // pending was restored from a checkpoint
+}
+
+// NewSentenceSegmenter creates a new Segmenter Conduit
+// that sends sentences using CommonAbbreviation.
+func NewSentenceSegmenter() (sg *Segmenter) {
+	sg = new(Segmenter)
+	if sg != nil {
+		sg.abbrev = CommonAbbreviation
+	}
+	return
+}
+
+// NewParagraphSegmenter creates a new Segmenter Conduit
+// that sends paragraphs.
+func NewParagraphSegmenter() (sg *Segmenter) {
+	sg = new(Segmenter)
+	if sg != nil {
+		sg.para = true
+	}
+	return
+}
+
+// SetAbbreviations sets the heuristic that decides whether a word
+// followed by a period is an abbreviation. The word is passed
+// without the final period (e.g. "Dr" or "e.g").
+func (sg *Segmenter) SetAbbreviations(f func(word string) bool) *Segmenter {
+	sg.abbrev = f
+	return sg
+}
+
+var commonAbbreviations = AbbreviationList(
+	"mr", "mrs", "ms", "dr", "prof", "sr", "jr", "st", "vs", "cf",
+	"e.g", "i.e", "fig", "no", "vol", "approx", "dept", "inc", "ltd", "co",
+)
+
+// CommonAbbreviation is the default abbreviation heuristic:
+// it accepts single upper-case letters (initials)
+// and a list of common English abbreviations (e.g. "Dr" or "i.e").
+func CommonAbbreviation(word string) bool {
+	r, n := utf8.DecodeRuneInString(word)
+	if n == len(word) && unicode.IsUpper(r) {
+		return true
+	}
+	return commonAbbreviations(word)
+}
+
+// AbbreviationList creates an abbreviation heuristic
+// that accepts the given words, ignoring case.
+func AbbreviationList(words ...string) func(string) bool {
+	set := make(map[string]bool, len(words))
+	for _, w := range words {
+		set[strings.ToLower(strings.TrimSuffix(w, "."))] = true
+	}
+	return func(word string) bool {
+		return set[strings.ToLower(word)]
+	}
+}
+
+// Conduct is the pre-defined method that makes Segmenter a Conduit.
+// Conduct terminates with an error if an item is not []byte or string.
+func (sg *Segmenter) Conduct(src conduit.Source, trg conduit.Target) error {
+	var buf, tail []byte
+	if sg.restored {
+		buf = sg.pending
+	}
+	sg.restored = false
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			sg.pending = append(append([]byte(nil), buf...), tail...)
+			trg <- inp
+			continue
+		}
+		switch x := inp.(type) {
+		case []byte:
+			buf = append(append(buf, tail...), x...)
+			n := len(buf) - incompleteTail(buf)
+			tail = append([]byte(nil), buf[n:]...)
+			buf = buf[:n]
+		case string:
+			buf = append(append(append(buf, tail...), x...), '\n')
+			tail = nil
+		default:
+			return errors.New(fmt.Sprintf("cannot segment %T", inp))
+		}
+		rest := sg.segment(string(buf), false, trg)
+		buf = append(buf[:0], rest...)
+	}
+	sg.segment(string(append(buf, tail...)), true, trg)
+	return nil
+}
+
+// Snapshot is the pre-defined method that makes Segmenter
+// a conduit.Checkpointer.
+func (sg *Segmenter) Snapshot() ([]byte, error) {
+	return append([]byte{}, sg.pending...), nil
+}
+
+// Restore is the pre-defined method that makes Segmenter
+// a conduit.Checkpointer.
+func (sg *Segmenter) Restore(b []byte) error {
+	sg.pending = append([]byte(nil), b...)
+	sg.restored = true
+	return nil
+}
+
+// Sends the segments of text; without final, the last segment,
+// which may continue, is returned instead
+func (sg *Segmenter) segment(text string, final bool, trg conduit.Target) string {
+	start := 0
+	send := func(seg string) {
+		if sg.para {
+			seg = strings.TrimSpace(seg)
+		} else {
+			seg = strings.Join(strings.Fields(seg), " ")
+		}
+		if seg != "" {
+			trg <- seg
+		}
+	}
+	for i := 0; i < len(text); {
+		r, n := utf8.DecodeRuneInString(text[i:])
+		switch {
+		case r == '\n':
+			k, breaks := skipSpace(text, i)
+			if k == len(text) && !final {
+				return text[start:]
+			}
+			if breaks > 1 {
+				send(text[start:i])
+				start = k
+			}
+			i = k
+			continue
+		case !sg.para && isTerminator(r):
+			j := i
+			for j < len(text) {
+				c, m := utf8.DecodeRuneInString(text[j:])
+				if !isTerminator(c) && !isClosing(c) {
+					break
+				}
+				j += m
+			}
+			k, _ := skipSpace(text, j)
+			if k == len(text) && !final {
+				return text[start:]
+			}
+			if k == j && k < len(text) {
+				i = j // e.g. "3.14"
+				continue
+			}
+			if r == '.' && j == i+n && !sg.sentenceEnd(text[start:i], text[k:]) {
+				i = j
+				continue
+			}
+			send(text[start:j])
+			start = j
+			i = j
+			continue
+		}
+		i += n
+	}
+	if final {
+		send(text[start:])
+		return ""
+	}
+	return text[start:]
+}
+
+// Decides whether a period between before and after ends a sentence
+func (sg *Segmenter) sentenceEnd(before, after string) bool {
+	next, _ := utf8.DecodeRuneInString(after)
+	if unicode.IsLower(next) {
+		return false
+	}
+	w := len(before)
+	for w > 0 {
+		c, m := utf8.DecodeLastRuneInString(before[:w])
+		if !unicode.IsLetter(c) && c != '.' {
+			break
+		}
+		w -= m
+	}
+	word := before[w:]
+	return word == "" || sg.abbrev == nil || !sg.abbrev(word)
+}
+
+// Returns the index of the first non-space rune at or after i
+// and the number of newlines skipped
+func skipSpace(text string, i int) (int, int) {
+	breaks := 0
+	for i < len(text) {
+		r, n := utf8.DecodeRuneInString(text[i:])
+		if !unicode.IsSpace(r) {
+			break
+		}
+		if r == '\n' {
+			breaks++
+		}
+		i += n
+	}
+	return i, breaks
+}
+
+func isTerminator(r rune) bool {
+	return r == '.' || r == '!' || r == '?' || r == '…'
+}
+
+func isClosing(r rune) bool {
+	return r == '"' || r == '\'' || r == ')' || r == ']' ||
+		unicode.Is(unicode.Pf, r) || unicode.Is(unicode.Pe, r)
+}
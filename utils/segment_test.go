@@ -0,0 +1,125 @@
+package utils
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/toschoo/conduit"
+)
+
+const segmentText = `Dr. Watson met J. R. Smith at 3.45 p.m. in the park.
+It was cold, e.g. below zero! "Really?" he asked.
+
+A new paragraph starts here… and ends
+on the next line.
+
+  Last one (short).`
+
+var sentences = []string{
+	"Dr. Watson met J. R. Smith at 3.45 p.m. in the park.",
+	"It was cold, e.g. below zero!",
+	`"Really?"`,
+	"he asked.",
+	"A new paragraph starts here…",
+	"and ends on the next line.",
+	"Last one (short).",
+}
+
+var paragraphs = []string{
+	"Dr. Watson met J. R. Smith at 3.45 p.m. in the park.\nIt was cold, e.g. below zero! \"Really?\" he asked.",
+	"A new paragraph starts here… and ends\non the next line.",
+	"Last one (short).",
+}
+
+// Segmenter:
+// - Text in blocks of random size is split into sentences or paragraphs
+// - Abbreviations, initials and numbers do not end sentences
+// - Strings are treated as lines
+func TestSegmenter(t *testing.T) {
+	for i := 1; i < numOfTests; i++ {
+		text := strings.Repeat(segmentText+"\n\n", i)
+		for _, para := range []bool{false, true} {
+			sg := NewSentenceSegmenter()
+			want := sentences
+			if para {
+				sg = NewParagraphSegmenter()
+				want = paragraphs
+			}
+			c := new(AnyConsumer)
+			chn := conduit.NewChain(&AnyProducer{[]interface{}{[]byte(text)}}, []conduit.Conduit{new(Rechunk), sg}, c, small)
+			if chn.Run() != nil {
+				t.Fatalf("Segmenter failed: %v", chn.Errs)
+			}
+			var expect []interface{}
+			for k := 0; k < i; k++ {
+				for _, s := range want {
+					expect = append(expect, s)
+				}
+			}
+			if !reflect.DeepEqual(c.recvd, expect) {
+				m := fmt.Sprintf("Segmenter failed: expected %q, have %q", expect, c.recvd)
+				t.Error(m)
+				return
+			}
+		}
+	}
+
+	var lines []interface{}
+	for _, l := range strings.Split(segmentText, "\n") {
+		lines = append(lines, l)
+	}
+	c := new(AnyConsumer)
+	chn := conduit.NewChain(&AnyProducer{lines}, []conduit.Conduit{NewParagraphSegmenter()}, c, small)
+	if chn.Run() != nil {
+		t.Fatalf("Segmenter failed: %v", chn.Errs)
+	}
+	if len(c.recvd) != len(paragraphs) {
+		t.Errorf("Segmenter on lines: unexpected paragraphs %q", c.recvd)
+	}
+}
+
+// Segmenter with user-defined abbreviations
+func TestSegmenterAbbreviations(t *testing.T) {
+	c := new(AnyConsumer)
+	sg := NewSentenceSegmenter().SetAbbreviations(AbbreviationList("Nr."))
+	chn := conduit.NewChain(&AnyProducer{[]interface{}{"See Nr. 5. Dr. Who is here."}}, []conduit.Conduit{sg}, c, small)
+	if chn.Run() != nil {
+		t.Fatalf("Segmenter failed: %v", chn.Errs)
+	}
+	if fmt.Sprintf("%q", c.recvd) != `["See Nr. 5." "Dr." "Who is here."]` {
+		t.Errorf("Segmenter: unexpected sentences %q", c.recvd)
+	}
+}
+
+// Segmenter with checkpoints:
+// - Text of incomplete sentences is included in the snapshot
+// - The restored Segmenter completes the sentence
+func TestSegmenterRestore(t *testing.T) {
+	sg := NewSentenceSegmenter()
+	src := make(chan interface{}, 2)
+	src <- []byte("One. Two and")
+	src <- &conduit.Barrier{}
+	close(src)
+	trg := make(chan interface{}, 3)
+	if err := sg.Conduct(src, trg); err != nil {
+		t.Fatalf("SegmenterRestore failed: %v", err)
+	}
+	b, err := sg.Snapshot()
+	if err != nil {
+		t.Fatalf("SegmenterRestore: cannot snapshot: %v", err)
+	}
+	sg = NewSentenceSegmenter()
+	if err = sg.Restore(b); err != nil {
+		t.Fatalf("SegmenterRestore: cannot restore: %v", err)
+	}
+	c := new(AnyConsumer)
+	chn := conduit.NewChain(&AnyProducer{[]interface{}{[]byte(" three.")}}, []conduit.Conduit{sg}, c, small)
+	if err = chn.Run(); err != nil {
+		t.Fatalf("SegmenterRestore failed: %v", chn.Errs)
+	}
+	if !reflect.DeepEqual(c.recvd, []interface{}{"Two and three."}) {
+		t.Errorf("SegmenterRestore: unexpected segments %q", c.recvd)
+	}
+}
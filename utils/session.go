@@ -0,0 +1,162 @@
+package utils
+
+import (
+	"sort"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+// Session is sent down the chain by SessionWindows,
+// one per closed session. Start and End are the times
+// of the first and the last item in the session.
+type Session struct {
+	Key   string
+	Start time.Time
+	End   time.Time
+	Items []interface{}
+}
+
+// SessionWindow is a Conduit that collects items per key
+// into sessions. A session is closed after a period
+// of inactivity, i.e. when no item with the same key
+// arrived for at least gap, and is then sent down
+// the chain as Session.
+type SessionWindow struct {
+	gap  time.Duration
+	kf   KeyFunc
+	ts   Timestamp
+	mark time.Time // watermark: latest time seen
+	open map[string]*Session
+}
+
+// NewSessionWindow creates a new SessionWindow.
+// Keys are obtained using kf (see KeyFunc and Keyed).
+// If ts is not nil, it is used to obtain the event time
+// of each item; sessions then close as soon as an item
+// arrives that is gap or more later than the session's last item.
+// Items that are older than gap relative to
+// the latest item seen so far are dropped.
+// If ts is nil, the processing time is used instead;
+// sessions then close when the gap is over,
+// even if no more data arrive.
+// When the stream ends, all open sessions are closed.
+func NewSessionWindow(gap time.Duration, kf KeyFunc, ts Timestamp) (w *SessionWindow) {
+	if gap <= 0 {
+		return nil
+	}
+	w = new(SessionWindow)
+	if w != nil {
+		w.gap = gap
+		w.kf = kf
+		w.ts = ts
+		w.open = make(map[string]*Session)
+	}
+	return
+}
+
+// Conduct is the pre-defined method that makes SessionWindow a Conduit.
+func (w *SessionWindow) Conduct(src conduit.Source, trg conduit.Target) error {
+	var tick <-chan time.Time
+	if w.ts == nil {
+		d := w.gap / 2
+		if d <= 0 {
+			d = w.gap
+		}
+		t := time.NewTicker(d)
+		defer t.Stop()
+		tick = t.C
+	}
+	for {
+		select {
+		case inp, ok := <-src:
+			if !ok {
+				w.closeAll(trg)
+				return nil
+			}
+			if conduit.IsBarrier(inp) {
+				trg <- inp
+				continue
+			}
+			t := w.timeOf(inp)
+			w.advance(t, trg)
+			w.add(t, inp)
+		case now := <-tick:
+			w.advance(now, trg)
+		}
+	}
+}
+
+// Volatile is the pre-defined method that makes SessionWindow a conduit.Volatile:
+// open sessions are not included in checkpoints.
+func (w *SessionWindow) Volatile() bool {
+	return true
+}
+
+// event time or processing time of an item
+func (w *SessionWindow) timeOf(inp interface{}) time.Time {
+	if w.ts == nil {
+		return time.Now()
+	}
+	return w.ts.Timestamp(inp)
+}
+
+// adds an item to the session of its key;
+// items of sessions that are already closed are dropped.
+func (w *SessionWindow) add(t time.Time, inp interface{}) {
+	k := keyOf(w.kf, inp)
+	s, ok := w.open[k]
+	if !ok {
+		if !t.Add(w.gap).After(w.mark) {
+			return
+		}
+		s = &Session{Key: k, Start: t, End: t}
+		w.open[k] = s
+	}
+	if t.Before(s.Start) {
+		s.Start = t
+	}
+	if t.After(s.End) {
+		s.End = t
+	}
+	s.Items = append(s.Items, inp)
+}
+
+// moves the watermark forward and closes
+// all sessions that are inactive for gap or longer.
+func (w *SessionWindow) advance(t time.Time, trg conduit.Target) {
+	if t.After(w.mark) {
+		w.mark = t
+	}
+	var closed []*Session
+	for k, s := range w.open {
+		if !s.End.Add(w.gap).After(w.mark) {
+			closed = append(closed, s)
+			delete(w.open, k)
+		}
+	}
+	emitSessions(closed, trg)
+}
+
+// closes all open sessions
+func (w *SessionWindow) closeAll(trg conduit.Target) {
+	closed := make([]*Session, 0, len(w.open))
+	for k, s := range w.open {
+		closed = append(closed, s)
+		delete(w.open, k)
+	}
+	emitSessions(closed, trg)
+}
+
+// sends sessions down the chain ordered by start
+func emitSessions(ss []*Session, trg conduit.Target) {
+	sort.Slice(ss, func(i, j int) bool {
+		if ss[i].Start.Equal(ss[j].Start) {
+			return ss[i].Key < ss[j].Key
+		}
+		return ss[i].Start.Before(ss[j].Start)
+	})
+	for _, s := range ss {
+		trg <- *s
+	}
+}
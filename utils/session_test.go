@@ -0,0 +1,165 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+type Click struct {
+	user string
+	sec  int
+}
+
+func (c Click) Key() string {
+	return c.user
+}
+
+type ClickTimestamp struct{}
+
+func (s *ClickTimestamp) Timestamp(inp interface{}) time.Time {
+	return time.Unix(int64(inp.(Click).sec), 0)
+}
+
+type ClickProducer struct {
+	clicks []Click
+}
+
+func (p *ClickProducer) Produce(trg conduit.Target) error {
+	for _, c := range p.clicks {
+		trg <- c
+	}
+	return nil
+}
+
+type SessionConsumer struct {
+	recvd []Session
+}
+
+func (c *SessionConsumer) Consume(src conduit.Source) error {
+	for v := range src {
+		c.recvd = append(c.recvd, v.(Session))
+	}
+	return nil
+}
+
+// clicks of k users in ascending time order
+func makeClicks(n, k int) []Click {
+	clicks := make([]Click, n)
+	sec := 0
+	for i := 0; i < n; i++ {
+		sec += rand.Int() % 5
+		clicks[i] = Click{fmt.Sprintf("user%d", rand.Int()%k), sec}
+	}
+	return clicks
+}
+
+// Session window with event time:
+// - It is processed without errors
+// - Sessions are split at gaps of inactivity per key
+// - All clicks are contained in sessions
+func TestSessionWindowChain(t *testing.T) {
+	for i := 0; i < numOfTests; i++ {
+		err := testSessionWindowChain(numOfData, 1+rand.Int()%5, 1+rand.Int()%10)
+		if err != nil {
+			m := fmt.Sprintf("SessionWindowChain failed: %v", err)
+			t.Error(m)
+		}
+	}
+}
+
+// Session window with processing time:
+// - It is processed without errors
+// - Each key has exactly one session
+func TestProcTimeSessionWindowChain(t *testing.T) {
+	clicks := makeClicks(numOfData, 3)
+	p := &ClickProducer{clicks}
+	c := new(SessionConsumer)
+	pipe := []conduit.Conduit{NewSessionWindow(time.Minute, nil, nil)}
+	chn := conduit.NewChain(p, pipe, c, small)
+	err := chn.Run()
+	if err != nil {
+		t.Errorf("ProcTimeSessionWindowChain failed: %v", err)
+	}
+	users := make(map[string]bool)
+	total := 0
+	for _, s := range c.recvd {
+		if users[s.Key] {
+			t.Errorf("ProcTimeSessionWindowChain: more than one session for %s", s.Key)
+		}
+		users[s.Key] = true
+		total += len(s.Items)
+	}
+	if total != numOfData {
+		t.Errorf("ProcTimeSessionWindowChain: expected %d clicks, have %d", numOfData, total)
+	}
+}
+
+func testSessionWindowChain(n, k, g int) error {
+
+	clicks := makeClicks(n, k)
+
+	p := &ClickProducer{clicks}
+	c := new(SessionConsumer)
+
+	gap := time.Duration(g) * time.Second
+	pipe := []conduit.Conduit{NewSessionWindow(gap, nil, new(ClickTimestamp))}
+
+	chn := conduit.NewChain(p, pipe, c, small)
+
+	err := chn.Run()
+	if err != nil {
+		m := fmt.Sprintf("error on running chain: %v", err)
+		return errors.New(m)
+	}
+
+	// expected sessions
+	var expected []Session
+	last := make(map[string]*Session)
+	for _, x := range clicks {
+		t := time.Unix(int64(x.sec), 0)
+		s, ok := last[x.user]
+		if !ok || t.Sub(s.End) >= gap {
+			s = &Session{Key: x.user, Start: t}
+			last[x.user] = s
+			expected = append(expected, Session{})
+		}
+		s.End = t
+		s.Items = append(s.Items, x)
+	}
+	if len(c.recvd) != len(expected) {
+		m := fmt.Sprintf("expected %d sessions, have %d", len(expected), len(c.recvd))
+		return errors.New(m)
+	}
+
+	total := 0
+	for _, s := range c.recvd {
+		if len(s.Items) == 0 {
+			return errors.New("empty session")
+		}
+		for i, x := range s.Items {
+			cl := x.(Click)
+			if cl.user != s.Key {
+				m := fmt.Sprintf("click of %s in session of %s", cl.user, s.Key)
+				return errors.New(m)
+			}
+			if i > 0 {
+				d := cl.sec - s.Items[i-1].(Click).sec
+				if time.Duration(d)*time.Second >= gap {
+					m := fmt.Sprintf("gap of %ds in session", d)
+					return errors.New(m)
+				}
+			}
+		}
+		total += len(s.Items)
+	}
+	if total != n {
+		m := fmt.Sprintf("expected %d clicks, have %d", n, total)
+		return errors.New(m)
+	}
+	return nil
+}
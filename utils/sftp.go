@@ -0,0 +1,422 @@
+package utils
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"time"
+)
+
+// SFTP version 3 (draft-ietf-secsh-filexfer-02)
+const (
+	sftpInit     = 1
+	sftpVersion  = 2
+	sftpOpen     = 3
+	sftpClose    = 4
+	sftpRead     = 5
+	sftpWrite    = 6
+	sftpOpendir  = 11
+	sftpReaddir  = 12
+	sftpRemove   = 13
+	sftpMkdir    = 14
+	sftpRename   = 18
+	sftpStatus   = 101
+	sftpHandle   = 102
+	sftpData     = 103
+	sftpName     = 104
+	sftpAttrSize = 1
+	sftpAttrUID  = 2
+	sftpAttrPerm = 4
+	sftpAttrTime = 8
+	sftpAttrExt  = 0x80000000
+	sftpFRead    = 1
+	sftpFWrite   = 2
+	sftpFCreat   = 8
+	sftpFTrunc   = 0x10
+	sftpOK       = 0
+	sftpEOF      = 1
+	sftpChunk    = 32 * 1024
+	sftpMaxPkt   = 256 * 1024
+	sftpIsDir    = 0040000
+	sftpTypeMask = 0170000
+)
+
+// SFTPConnect opens a channel to an SFTP server,
+// e.g. the sftp subsystem of an SSH connection (see SSHCommand).
+type SFTPConnect func() (io.ReadWriteCloser, error)
+
+// SSHCommand returns an SFTPConnect that runs the ssh command
+// with the sftp subsystem (ssh -s args... sftp);
+// args are options and destination, e.g. "-p", "2222", "user@host".
+// Since the command cannot ask for passwords,
+// authentication must be configured for ssh,
+// e.g. with keys or an agent.
+func SSHCommand(args ...string) SFTPConnect {
+	return func() (io.ReadWriteCloser, error) {
+		cmd := exec.Command("ssh", append(append([]string{"-s", "-oBatchMode=yes"}, args...), "sftp")...)
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return nil, err
+		}
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		err = cmd.Start()
+		if err != nil {
+			return nil, err
+		}
+		return &sshProc{cmd: cmd, WriteCloser: stdin, Reader: stdout}, nil
+	}
+}
+
+// ssh process as channel
+type sshProc struct {
+	io.WriteCloser
+	io.Reader
+	cmd *exec.Cmd
+}
+
+// Close closes the input of ssh and waits for it to terminate.
+func (p *sshProc) Close() error {
+	p.WriteCloser.Close()
+	done := make(chan error, 1)
+	go func() { done <- p.cmd.Wait() }()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(5 * time.Second):
+		p.cmd.Process.Kill()
+		return <-done
+	}
+}
+
+// Encoding of SFTP packets
+type sftpBuf []byte
+
+func (b sftpBuf) u32(v uint32) sftpBuf {
+	return binary.BigEndian.AppendUint32(b, v)
+}
+
+func (b sftpBuf) u64(v uint64) sftpBuf {
+	return binary.BigEndian.AppendUint64(b, v)
+}
+
+func (b sftpBuf) str(s string) sftpBuf {
+	return append(b.u32(uint32(len(s))), s...)
+}
+
+// Decoding of SFTP packets; reading beyond the end sets short
+type sftpPacket struct {
+	typ   byte
+	data  []byte
+	short bool
+}
+
+func (p *sftpPacket) u32() uint32 {
+	if len(p.data) < 4 {
+		p.short = true
+		p.data = nil
+		return 0
+	}
+	v := binary.BigEndian.Uint32(p.data)
+	p.data = p.data[4:]
+	return v
+}
+
+func (p *sftpPacket) u64() uint64 {
+	return uint64(p.u32())<<32 | uint64(p.u32())
+}
+
+func (p *sftpPacket) str() string {
+	n := p.u32()
+	if uint32(len(p.data)) < n {
+		p.short = true
+		p.data = nil
+		return ""
+	}
+	s := string(p.data[:n])
+	p.data = p.data[n:]
+	return s
+}
+
+// Reads file attributes
+func (p *sftpPacket) attrs() (size int64, mod time.Time, dir bool) {
+	flags := p.u32()
+	if flags&sftpAttrSize != 0 {
+		size = int64(p.u64())
+	}
+	if flags&sftpAttrUID != 0 {
+		p.u32()
+		p.u32()
+	}
+	if flags&sftpAttrPerm != 0 {
+		dir = p.u32()&sftpTypeMask == sftpIsDir
+	}
+	if flags&sftpAttrTime != 0 {
+		p.u32()
+		mod = time.Unix(int64(p.u32()), 0)
+	}
+	if flags&sftpAttrExt != 0 {
+		for n := p.u32(); n > 0 && !p.short; n-- {
+			p.str()
+			p.str()
+		}
+	}
+	return
+}
+
+func writeSFTP(w io.Writer, typ byte, payload sftpBuf) error {
+	pkt := make(sftpBuf, 0, len(payload)+5).u32(uint32(len(payload) + 1))
+	pkt = append(append(pkt, typ), payload...)
+	_, err := w.Write(pkt)
+	return err
+}
+
+func readSFTP(r io.Reader) (*sftpPacket, error) {
+	var hdr [5]byte
+	_, err := io.ReadFull(r, hdr[:])
+	if err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[:4])
+	if n < 1 || n > sftpMaxPkt {
+		return nil, errors.New(fmt.Sprintf("sftp: invalid packet length %d", n))
+	}
+	p := &sftpPacket{typ: hdr[4], data: make([]byte, n-1)}
+	_, err = io.ReadFull(r, p.data)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// SFTP client; requests are sent one at a time
+type sftpClient struct {
+	ch io.ReadWriteCloser
+	id uint32
+}
+
+func dialSFTP(connect SFTPConnect) (*sftpClient, error) {
+	ch, err := connect()
+	if err != nil {
+		return nil, err
+	}
+	c := &sftpClient{ch: ch}
+	err = writeSFTP(ch, sftpInit, sftpBuf{}.u32(3))
+	if err == nil {
+		var p *sftpPacket
+		p, err = readSFTP(ch)
+		if err == nil && p.typ != sftpVersion {
+			err = errors.New(fmt.Sprintf("sftp: unexpected packet %d", p.typ))
+		}
+	}
+	if err != nil {
+		ch.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Sends a request and reads the response
+func (c *sftpClient) request(typ byte, payload sftpBuf) (*sftpPacket, error) {
+	c.id++
+	err := writeSFTP(c.ch, typ, append(sftpBuf{}.u32(c.id), payload...))
+	if err != nil {
+		return nil, err
+	}
+	p, err := readSFTP(c.ch)
+	if err == io.EOF {
+		// not to be confused with the end of a file
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	if id := p.u32(); id != c.id {
+		return nil, errors.New(fmt.Sprintf("sftp: unexpected response %d to request %d", id, c.id))
+	}
+	return p, nil
+}
+
+// Converts a status response to an error; EOF is io.EOF
+func (p *sftpPacket) status() error {
+	if p.typ != sftpStatus {
+		return errors.New(fmt.Sprintf("sftp: unexpected packet %d", p.typ))
+	}
+	code := p.u32()
+	switch code {
+	case sftpOK:
+		return nil
+	case sftpEOF:
+		return io.EOF
+	}
+	return errors.New(fmt.Sprintf("sftp: %s (%d)", p.str(), code))
+}
+
+// Sends a request that is answered by a status
+func (c *sftpClient) call(typ byte, payload sftpBuf) error {
+	p, err := c.request(typ, payload)
+	if err != nil {
+		return err
+	}
+	return p.status()
+}
+
+// Sends a request that is answered by a handle
+func (c *sftpClient) handle(typ byte, payload sftpBuf) (string, error) {
+	p, err := c.request(typ, payload)
+	if err != nil {
+		return "", err
+	}
+	if p.typ != sftpHandle {
+		return "", p.status()
+	}
+	h := p.str()
+	if p.short {
+		return "", errors.New("sftp: short packet")
+	}
+	return h, nil
+}
+
+func (c *sftpClient) list(dir string) ([]remoteEntry, error) {
+	h, err := c.handle(sftpOpendir, sftpBuf{}.str(dir))
+	if err != nil {
+		return nil, err
+	}
+	var entries []remoteEntry
+	for err == nil {
+		var p *sftpPacket
+		p, err = c.request(sftpReaddir, sftpBuf{}.str(h))
+		if err != nil {
+			break
+		}
+		if p.typ != sftpName {
+			err = p.status()
+			break
+		}
+		for n := p.u32(); n > 0 && !p.short; n-- {
+			var e remoteEntry
+			e.name = p.str()
+			p.str() // long name
+			e.size, e.mod, e.dir = p.attrs()
+			if e.name != "." && e.name != ".." {
+				entries = append(entries, e)
+			}
+		}
+		if p.short {
+			err = errors.New("sftp: short packet")
+		}
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	if e := c.call(sftpClose, sftpBuf{}.str(h)); err == nil {
+		err = e
+	}
+	return entries, err
+}
+
+// Open file on the server
+type sftpFile struct {
+	c   *sftpClient
+	h   string
+	off uint64
+}
+
+func (f *sftpFile) Read(b []byte) (int, error) {
+	if len(b) > sftpChunk {
+		b = b[:sftpChunk]
+	}
+	p, err := f.c.request(sftpRead, sftpBuf{}.str(f.h).u64(f.off).u32(uint32(len(b))))
+	if err != nil {
+		return 0, err
+	}
+	if p.typ != sftpData {
+		return 0, p.status()
+	}
+	data := p.str()
+	if p.short || len(data) > len(b) {
+		return 0, errors.New("sftp: invalid data packet")
+	}
+	f.off += uint64(len(data))
+	return copy(b, data), nil
+}
+
+func (f *sftpFile) Write(b []byte) (int, error) {
+	n := 0
+	for n < len(b) {
+		k := len(b) - n
+		if k > sftpChunk {
+			k = sftpChunk
+		}
+		err := f.c.call(sftpWrite, sftpBuf{}.str(f.h).u64(f.off).str(string(b[n:n+k])))
+		if err != nil {
+			return n, err
+		}
+		f.off += uint64(k)
+		n += k
+	}
+	return n, nil
+}
+
+func (f *sftpFile) Close() error {
+	return f.c.call(sftpClose, sftpBuf{}.str(f.h))
+}
+
+func (c *sftpClient) openFile(p string, flags uint32) (*sftpFile, error) {
+	h, err := c.handle(sftpOpen, sftpBuf{}.str(p).u32(flags).u32(0))
+	if err != nil {
+		return nil, err
+	}
+	return &sftpFile{c: c, h: h}, nil
+}
+
+func (c *sftpClient) open(p string) (io.ReadCloser, error) {
+	return c.openFile(p, sftpFRead)
+}
+
+func (c *sftpClient) create(p string) (io.WriteCloser, error) {
+	return c.openFile(p, sftpFWrite|sftpFCreat|sftpFTrunc)
+}
+
+func (c *sftpClient) rename(from, to string) error {
+	return c.call(sftpRename, sftpBuf{}.str(from).str(to))
+}
+
+func (c *sftpClient) remove(p string) error {
+	return c.call(sftpRemove, sftpBuf{}.str(p))
+}
+
+func (c *sftpClient) mkdir(p string) error {
+	return c.call(sftpMkdir, sftpBuf{}.str(p).u32(0))
+}
+
+func (c *sftpClient) close() error {
+	return c.ch.Close()
+}
+
+// NewSFTPReader creates a new RemoteReader Producer reading
+// dir on an SFTP server; dir is relative to the home directory
+// unless it is absolute.
+func NewSFTPReader(connect SFTPConnect, dir string) *RemoteReader {
+	if connect == nil {
+		return nil
+	}
+	return newRemoteReader(func() (remoteFS, error) {
+		return dialSFTP(connect)
+	}, dir)
+}
+
+// NewSFTPWriter creates a new RemoteWriter Consumer writing
+// to dir on an SFTP server (see NewSFTPReader).
+func NewSFTPWriter(connect SFTPConnect, dir string) *RemoteWriter {
+	if connect == nil {
+		return nil
+	}
+	return newRemoteWriter(func() (remoteFS, error) {
+		return dialSFTP(connect)
+	}, dir)
+}
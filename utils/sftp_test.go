@@ -0,0 +1,330 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+// SFTP test server on a local directory;
+// like many servers, it does not rename to existing files.
+// The first read of a file starting with "flaky" drops the connection.
+type sftpServer struct {
+	root     string
+	door     sync.Mutex
+	flaked   bool
+	connects int
+}
+
+func (ss *sftpServer) connect() (io.ReadWriteCloser, error) {
+	ss.door.Lock()
+	ss.connects++
+	ss.door.Unlock()
+	cli, srv := net.Pipe()
+	go ss.serve(srv)
+	return cli, nil
+}
+
+func (ss *sftpServer) path(p string) string {
+	return filepath.Join(ss.root, filepath.FromSlash(p))
+}
+
+func (ss *sftpServer) serve(ch io.ReadWriteCloser) {
+	defer ch.Close()
+	files := make(map[string]*os.File)
+	dirs := make(map[string][]os.FileInfo)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	n := 0
+	for {
+		p, err := readSFTP(ch)
+		if err != nil {
+			return
+		}
+		if p.typ == sftpInit {
+			writeSFTP(ch, sftpVersion, sftpBuf{}.u32(3))
+			continue
+		}
+		id := p.u32()
+		status := func(err error) {
+			code, msg := uint32(sftpOK), "ok"
+			if err == io.EOF {
+				code, msg = sftpEOF, "eof"
+			} else if err != nil {
+				code, msg = 4, err.Error()
+			}
+			writeSFTP(ch, sftpStatus, sftpBuf{}.u32(id).u32(code).str(msg).str(""))
+		}
+		handle := func(h string) {
+			writeSFTP(ch, sftpHandle, sftpBuf{}.u32(id).str(h))
+		}
+		switch p.typ {
+		case sftpOpen:
+			name, pflags := p.str(), p.u32()
+			flags := os.O_RDONLY
+			if pflags&sftpFWrite != 0 {
+				flags = os.O_WRONLY
+			}
+			if pflags&sftpFCreat != 0 {
+				flags |= os.O_CREATE
+			}
+			if pflags&sftpFTrunc != 0 {
+				flags |= os.O_TRUNC
+			}
+			f, err := os.OpenFile(ss.path(name), flags, 0644)
+			if err != nil {
+				status(err)
+				continue
+			}
+			n++
+			h := fmt.Sprintf("f%d", n)
+			files[h] = f
+			handle(h)
+		case sftpOpendir:
+			entries, err := ioutil.ReadDir(ss.path(p.str()))
+			if err != nil {
+				status(err)
+				continue
+			}
+			n++
+			h := fmt.Sprintf("d%d", n)
+			dirs[h] = entries
+			handle(h)
+		case sftpReaddir:
+			h := p.str()
+			entries, ok := dirs[h]
+			if !ok || len(entries) == 0 {
+				status(io.EOF)
+				continue
+			}
+			// names are sent in batches of 3 with . and ..
+			k := len(entries)
+			if k > 3 {
+				k = 3
+			}
+			b := sftpBuf{}.u32(id).u32(uint32(k + 2))
+			b = b.str(".").str("").u32(0).str("..").str("").u32(0)
+			for _, e := range entries[:k] {
+				perm := uint32(0100644)
+				if e.IsDir() {
+					perm = 0040755
+				}
+				b = b.str(e.Name()).str("-rw-r--r-- " + e.Name()).u32(sftpAttrSize | sftpAttrPerm | sftpAttrTime)
+				b = b.u64(uint64(e.Size())).u32(perm).u32(0).u32(uint32(e.ModTime().Unix()))
+			}
+			dirs[h] = entries[k:]
+			writeSFTP(ch, sftpName, b)
+		case sftpClose:
+			h := p.str()
+			if f, ok := files[h]; ok {
+				status(f.Close())
+				delete(files, h)
+			} else {
+				delete(dirs, h)
+				status(nil)
+			}
+		case sftpRead:
+			h, off, size := p.str(), p.u64(), p.u32()
+			f, ok := files[h]
+			if !ok {
+				status(errors.New("invalid handle"))
+				continue
+			}
+			ss.door.Lock()
+			flaky := !ss.flaked && strings.HasPrefix(filepath.Base(f.Name()), "flaky")
+			if flaky {
+				ss.flaked = true
+			}
+			ss.door.Unlock()
+			if flaky {
+				return
+			}
+			buf := make([]byte, size)
+			k, err := f.ReadAt(buf, int64(off))
+			if k == 0 {
+				if err == nil {
+					err = io.EOF
+				}
+				status(err)
+				continue
+			}
+			writeSFTP(ch, sftpData, sftpBuf{}.u32(id).str(string(buf[:k])))
+		case sftpWrite:
+			h, off, data := p.str(), p.u64(), p.str()
+			f, ok := files[h]
+			if !ok {
+				status(errors.New("invalid handle"))
+				continue
+			}
+			_, err := f.WriteAt([]byte(data), int64(off))
+			status(err)
+		case sftpRemove:
+			status(os.Remove(ss.path(p.str())))
+		case sftpMkdir:
+			status(os.Mkdir(ss.path(p.str()), 0755))
+		case sftpRename:
+			from, to := ss.path(p.str()), ss.path(p.str())
+			if _, err := os.Stat(to); err == nil {
+				status(errors.New("file exists"))
+				continue
+			}
+			status(os.Rename(from, to))
+		default:
+			status(errors.New("unsupported"))
+		}
+	}
+}
+
+// Consumer that reads the bodies of RemoteFiles into Data
+type BodyConsumer struct {
+	recvd []interface{}
+}
+
+func (c *BodyConsumer) Consume(src conduit.Source) error {
+	for inp := range src {
+		if f, ok := inp.(*RemoteFile); ok {
+			data, err := ioutil.ReadAll(f.Body)
+			f.Body.Close()
+			if err != nil {
+				return err
+			}
+			f.Data = data
+			c.recvd = append(c.recvd, f)
+		}
+	}
+	return nil
+}
+
+func TestSFTP(t *testing.T) {
+	ss := &sftpServer{root: t.TempDir()}
+	if NewSFTPReader(nil, "dir") != nil || NewSFTPWriter(nil, "dir") != nil {
+		t.Errorf("SFTP: nil connection accepted")
+	}
+
+	var items []interface{}
+	for i := 0; i < 30; i++ {
+		items = append(items, fmt.Sprintf("record %d\n%s", i, strings.Repeat("x", i*5000)))
+	}
+	items = append(items, &RemoteFile{Name: "flaky.txt", Data: []byte("flaky")})
+	sw := NewSFTPWriter(ss.connect, "out").SetNaming(func(n int) string { return fmt.Sprintf("%d/rec%02d.txt", n%3, n) })
+	if err := conduit.NewChain(&AnyProducer{src: items}, nil, sw, small).Run(); err != nil {
+		t.Fatalf("SFTPWriter failed: %v", err)
+	}
+	// replaced although renaming does not replace files
+	sw = NewSFTPWriter(ss.connect, "out")
+	if err := conduit.NewChain(&AnyProducer{src: []interface{}{&RemoteFile{Name: "1/rec01.txt", Data: []byte("record 0\n")}}}, nil, sw, small).Run(); err != nil {
+		t.Fatalf("SFTPWriter failed: %v", err)
+	}
+	files := listFiles(filepath.Join(ss.root, "out"))
+	if len(files) != 31 || files[0] != "0/rec03.txt" || files[30] != "flaky.txt" {
+		t.Fatalf("SFTPWriter: unexpected files %v", files)
+	}
+
+	c := &BodyConsumer{}
+	sr := NewSFTPReader(ss.connect, "out").SetRecursive().Stream().SetDelete().Match("rec*")
+	if err := conduit.NewChain(sr, nil, c, small).Run(); err != nil {
+		t.Fatalf("SFTPReader failed: %v", err)
+	}
+	if len(c.recvd) != 30 {
+		t.Fatalf("SFTPReader: %d files received", len(c.recvd))
+	}
+	for i, inp := range c.recvd {
+		f := inp.(*RemoteFile)
+		if i > 0 && f.Name <= c.recvd[i-1].(*RemoteFile).Name {
+			t.Errorf("SFTPReader: %s not in order", f.Name)
+		}
+		var n int
+		fmt.Sscanf(f.Name[2:], "rec%02d.txt", &n)
+		want := []byte(items[n-1].(string))
+		if n == 1 {
+			want = []byte("record 0\n")
+		}
+		if !bytes.Equal(f.Data, want) || f.Size != int64(len(want)) || f.Path != "out/"+f.Name {
+			t.Errorf("SFTPReader: unexpected file %s (%s): %d bytes", f.Name, f.Path, len(f.Data))
+		}
+	}
+	if files := listFiles(filepath.Join(ss.root, "out")); len(files) != 1 {
+		t.Errorf("SFTPReader: files not deleted: %v", files)
+	}
+
+	// the file is read again after the connection is dropped
+	connects := ss.connects
+	tc := &TakeConsumer{n: -1}
+	sr = NewSFTPReader(ss.connect, "out").SetDelete().SetRetry(fastRetry)
+	if err := conduit.NewChain(sr, nil, tc, small).Run(); err != nil {
+		t.Fatalf("SFTPReader failed: %v", err)
+	}
+	if len(tc.recvd) != 1 || string(tc.recvd[0].(*RemoteFile).Data) != "flaky" {
+		t.Fatalf("SFTPReader: unexpected files %v", tc.recvd)
+	}
+	if !ss.flaked || ss.connects != connects+2 {
+		t.Errorf("SFTPReader: connection not dropped (%d connections)", ss.connects-connects)
+	}
+	if files := listFiles(filepath.Join(ss.root, "out")); len(files) != 0 {
+		t.Errorf("SFTPReader: files not deleted: %v", files)
+	}
+}
+
+// Files are moved only when a checkpoint covers them
+func TestSFTPCheckpoint(t *testing.T) {
+	ss := &sftpServer{root: t.TempDir()}
+	var items []interface{}
+	for i := 0; i < 300; i++ {
+		items = append(items, i)
+	}
+	sw := NewSFTPWriter(ss.connect, "in").SetNaming(func(n int) string { return fmt.Sprintf("%03d.json", n) })
+	if err := conduit.NewChain(&AnyProducer{src: items}, nil, sw, small).Run(); err != nil {
+		t.Fatalf("SFTPWriter failed: %v", err)
+	}
+
+	cps := conduit.NewMemCheckpoints()
+	c := &StopConsumer{n: 250, err: errors.New("crash")}
+	sr := NewSFTPReader(ss.connect, "in").Match("*.json").SetMoveTo("done").AckOnCheckpoint()
+	chn := conduit.NewChain(sr, nil, c, small)
+	chn.SetCheckpoints(time.Millisecond, cps)
+	if chn.Run() == nil {
+		t.Fatalf("SFTPReader: chain did not crash")
+	}
+	sr.Cancel()
+	cp, _ := cps.Latest()
+	if cp == nil {
+		t.Fatalf("SFTPReader: no checkpoint taken")
+	}
+	pos := int(cp.Position)
+	moved := listFiles(filepath.Join(ss.root, "done"))
+	if pos > len(c.recvd) || len(moved) != pos {
+		t.Fatalf("SFTPReader: %d files moved at checkpoint %d after %d files", len(moved), pos, len(c.recvd))
+	}
+
+	rest := &TakeConsumer{n: -1}
+	if err := conduit.NewChain(NewSFTPReader(ss.connect, "in").Match("*.json").SetMoveTo("done"), nil, rest, small).Run(); err != nil {
+		t.Fatalf("SFTPReader: restarted chain failed: %v", err)
+	}
+	all := append(c.recvd[:pos], rest.recvd...)
+	if len(all) != 300 {
+		t.Fatalf("SFTPReader: %d files after restart", len(all))
+	}
+	for i, inp := range all {
+		f := inp.(*RemoteFile)
+		if f.Name != fmt.Sprintf("%03d.json", i+1) || string(f.Data) != fmt.Sprint(i) {
+			t.Errorf("SFTPReader: unexpected file %s: %q", f.Name, f.Data)
+		}
+	}
+	if moved = listFiles(filepath.Join(ss.root, "done")); len(moved) != 300 {
+		t.Errorf("SFTPReader: %d files moved", len(moved))
+	}
+}
@@ -0,0 +1,207 @@
+package utils
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/sha512"
+	"encoding"
+	"errors"
+	"fmt"
+	"hash"
+	"sync"
+
+	"github.com/toschoo/conduit"
+)
+
+// Signatures are Ed25519ph signatures (RFC 8032)
+// of the SHA-512 digest of the whole stream,
+// so that streams of any length can be signed and verified
+// without holding them in memory. They can be verified with
+// ed25519.VerifyWithOptions(key, digest, sig, &ed25519.Options{Hash: crypto.SHA512}).
+var signOptions = &ed25519.Options{Hash: crypto.SHA512}
+
+// Hashes an item of a byte stream
+func hashBlock(h hash.Hash, inp interface{}) error {
+	switch x := inp.(type) {
+	case []byte:
+		h.Write(x)
+	case string:
+		h.Write([]byte(x))
+	default:
+		return errors.New(fmt.Sprintf("cannot sign %T", inp))
+	}
+	return nil
+}
+
+// Signer is a Conduit that forwards a stream of []byte blocks
+// (or strings) unchanged and signs the stream with an Ed25519 key.
+// At the end of the stream, the detached signature
+// is available through Signature and sent as []byte
+// to the side output "signature" (see conduit.SideOutputter).
+// The digest computed so far is included in checkpoints
+// (see conduit.Checkpointer).
+type Signer struct {
+	key      ed25519.PrivateKey
+	side     conduit.Target
+	mu       sync.Mutex
+	sig      []byte
+	h        hash.Hash
+	restored bool // h was restored from a checkpoint
+}
+
+// NewSigner creates a new Signer Conduit.
+func NewSigner(key ed25519.PrivateKey) (s *Signer) {
+	if len(key) != ed25519.PrivateKeySize {
+		return nil
+	}
+	s = new(Signer)
+	if s != nil {
+		s.key = key
+		s.h = sha512.New()
+	}
+	return
+}
+
+// Signature returns the signature of the latest stream
+// or nil, if the stream has not yet ended.
+func (s *Signer) Signature() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sig
+}
+
+// SideOutput is the pre-defined method that makes Signer
+// a conduit.SideOutputter. Signer has the side output "signature".
+func (s *Signer) SideOutput(name string, trg conduit.Target) {
+	if name == "signature" {
+		s.side = trg
+	}
+}
+
+// Conduct is the pre-defined method that makes Signer a Conduit.
+// Conduct terminates with an error if an item is not []byte or string.
+func (s *Signer) Conduct(src conduit.Source, trg conduit.Target) error {
+	s.mu.Lock()
+	s.sig = nil
+	s.mu.Unlock()
+	if !s.restored {
+		s.h = sha512.New()
+	}
+	s.restored = false
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			trg <- inp
+			continue
+		}
+		err := hashBlock(s.h, inp)
+		if err != nil {
+			return err
+		}
+		trg <- inp
+	}
+	sig, err := s.key.Sign(nil, s.h.Sum(nil), signOptions)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.sig = sig
+	s.mu.Unlock()
+	if s.side != nil {
+		s.side <- sig
+	}
+	return nil
+}
+
+// Snapshot is the pre-defined method that makes Signer
+// a conduit.Checkpointer.
+func (s *Signer) Snapshot() ([]byte, error) {
+	return s.h.(encoding.BinaryMarshaler).MarshalBinary()
+}
+
+// Restore is the pre-defined method that makes Signer
+// a conduit.Checkpointer.
+func (s *Signer) Restore(b []byte) error {
+	h := sha512.New()
+	err := h.(encoding.BinaryUnmarshaler).UnmarshalBinary(b)
+	if err != nil {
+		return err
+	}
+	s.h = h
+	s.restored = true
+	return nil
+}
+
+// VerifyingProducer is a Producer that wraps a producer
+// of a byte stream (e.g. a Reader) and verifies the stream
+// against a detached signature created by Signer.
+// Since the stream is not held in memory, data are sent
+// down the chain as they arrive; a mismatch is reported
+// as error at the end of the stream.
+type VerifyingProducer struct {
+	p   conduit.Producer
+	key ed25519.PublicKey
+	sig []byte
+	sz  int
+}
+
+// NewVerifyingProducer creates a new VerifyingProducer
+// that verifies the output of p with the public key and signature.
+func NewVerifyingProducer(p conduit.Producer, key ed25519.PublicKey, sig []byte) (vp *VerifyingProducer) {
+	if p == nil || len(key) != ed25519.PublicKeySize {
+		return nil
+	}
+	vp = new(VerifyingProducer)
+	if vp != nil {
+		vp.p = p
+		vp.key = key
+		vp.sig = sig
+		vp.sz = 10
+	}
+	return
+}
+
+// Cancel is the pre-defined method that makes VerifyingProducer
+// a conduit.Canceler; it cancels the wrapped producer.
+// A canceled stream is not verified.
+func (vp *VerifyingProducer) Cancel() {
+	cancelAll([]conduit.Producer{vp.p})
+}
+
+// Produce is the pre-defined method that makes VerifyingProducer a Producer.
+// Produce terminates with an error if the wrapped producer fails,
+// sends an item that is not []byte or string
+// or if the signature does not match.
+func (vp *VerifyingProducer) Produce(trg conduit.Target) error {
+	conduit.ResetCancel(vp.p)
+	src, errc := startProducer(vp.p, vp.sz)
+	h := sha512.New()
+	var err error
+	for inp := range src {
+		if err != nil {
+			continue
+		}
+		if conduit.IsBarrier(inp) {
+			trg <- inp
+			continue
+		}
+		err = hashBlock(h, inp)
+		if err == nil {
+			trg <- inp
+		}
+	}
+	perr := <-errc
+	if err != nil {
+		return err
+	}
+	if perr != nil {
+		return perr
+	}
+	if c, ok := vp.p.(interface{ Canceled() bool }); ok && c.Canceled() {
+		return nil
+	}
+	err = ed25519.VerifyWithOptions(vp.key, h.Sum(nil), vp.sig, signOptions)
+	if err != nil {
+		return errors.New(fmt.Sprintf("signature verification failed: %v", err))
+	}
+	return nil
+}
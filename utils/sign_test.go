@@ -0,0 +1,95 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"strings"
+	"testing"
+
+	"github.com/toschoo/conduit"
+)
+
+// Signatures:
+// - A stream is signed while passing unchanged
+// - The signature is sent to the side output
+// - The stream is verified with the signature
+// - Modified data and wrong keys are reported
+func TestSignature(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Signature: cannot generate key: %v", err)
+	}
+	text := strings.Repeat("signed data feed\n", 1000)
+
+	var out bytes.Buffer
+	s := NewSigner(priv)
+	side := new(AnyConsumer)
+	chn := conduit.NewChain(NewReader(strings.NewReader(text)), []conduit.Conduit{s}, NewTextPrinter(&out), small)
+	err = chn.AddSide(s, "signature", side)
+	if err != nil {
+		t.Fatalf("Signature: cannot add side: %v", err)
+	}
+	err = chn.Run()
+	if err != nil {
+		t.Fatalf("Signature failed on signing: %v", chn.Errs)
+	}
+	if out.String() != text {
+		t.Errorf("Signature: data changed")
+	}
+	sig := s.Signature()
+	if len(side.recvd) != 1 || !bytes.Equal(side.recvd[0].([]byte), sig) {
+		t.Errorf("Signature: signature not sent to side output")
+	}
+
+	out.Reset()
+	p := NewVerifyingProducer(NewReader(strings.NewReader(text)), pub, sig)
+	chn = conduit.NewChain(p, nil, NewTextPrinter(&out), small)
+	err = chn.Run()
+	if err != nil {
+		t.Errorf("Signature: verification failed: %v", chn.Errs)
+	}
+	if out.String() != text {
+		t.Errorf("Signature: verified data changed")
+	}
+
+	p = NewVerifyingProducer(NewReader(strings.NewReader(text+"!")), pub, sig)
+	chn = conduit.NewChain(p, nil, NewTextPrinter(new(bytes.Buffer)), small)
+	if chn.Run() == nil {
+		t.Errorf("Signature: modified data not reported")
+	}
+
+	other, _, _ := ed25519.GenerateKey(nil)
+	p = NewVerifyingProducer(NewReader(strings.NewReader(text)), other, sig)
+	chn = conduit.NewChain(p, nil, NewTextPrinter(new(bytes.Buffer)), small)
+	if chn.Run() == nil {
+		t.Errorf("Signature: wrong key not reported")
+	}
+}
+
+// Signatures with checkpoints:
+// - The restored Signer continues the digest
+func TestSignerRestore(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("SignerRestore: cannot generate key: %v", err)
+	}
+	s := NewSigner(priv)
+	if err = conduit.NewChain(&AnyProducer{[]interface{}{"signed "}}, []conduit.Conduit{s}, new(AnyConsumer), small).Run(); err != nil {
+		t.Fatalf("SignerRestore failed: %v", err)
+	}
+	b, err := s.Snapshot()
+	if err != nil {
+		t.Fatalf("SignerRestore: cannot snapshot: %v", err)
+	}
+	s = NewSigner(priv)
+	if err = s.Restore(b); err != nil {
+		t.Fatalf("SignerRestore: cannot restore: %v", err)
+	}
+	if err = conduit.NewChain(&AnyProducer{[]interface{}{"data"}}, []conduit.Conduit{s}, new(AnyConsumer), small).Run(); err != nil {
+		t.Fatalf("SignerRestore failed: %v", err)
+	}
+	p := NewVerifyingProducer(NewReader(strings.NewReader("signed data")), pub, s.Signature())
+	if err = conduit.NewChain(p, nil, new(AnyConsumer), small).Run(); err != nil {
+		t.Errorf("SignerRestore: verification failed: %v", err)
+	}
+}
@@ -0,0 +1,296 @@
+package utils
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"net/url"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+// SMTPWriter is a Consumer that sends the incoming items as emails
+// via an SMTP server, e.g. alerts or reports at the end of a chain.
+// The server is given by a URL (smtp://[user:password@]host[:port];
+// with smtps, the connection uses TLS, otherwise STARTTLS
+// if the server offers it); users are authenticated with PLAIN.
+// *EmailMessage items are sent as they are (from the sender
+// of the writer, if From is not set). Other items are rendered
+// with templates (see Template) to recipients (see SetTo and SetCc),
+// subject (see SetSubject) and body (see SetBody and SetHTML);
+// without body template, []byte and string items are the body
+// as they are, others are encoded with a MarshalFunc (default: json.Marshal).
+// When sending fails, SMTPWriter reconnects and sends
+// the message again according to the RetryPolicy (DefaultRetry);
+// messages rejected permanently by the server (5xx) are not retried.
+type SMTPWriter struct {
+	url     *url.URL
+	from    *mail.Address
+	to      Template
+	cc      Template
+	subject Template
+	text    Template
+	html    Template
+	marshal MarshalFunc
+	timeout time.Duration
+	retry   RetryPolicy
+	conn    net.Conn
+	client  *smtp.Client
+}
+
+// NewSMTPWriter creates a new SMTPWriter Consumer
+// sending messages from the address from
+// (e.g. "Reports <reports@example.com>") via the server of the URL.
+func NewSMTPWriter(rawurl, from string) (sw *SMTPWriter) {
+	u, err := url.Parse(rawurl)
+	if err != nil || (u.Scheme != "smtp" && u.Scheme != "smtps") || u.Host == "" {
+		return nil
+	}
+	addr, err := mail.ParseAddress(from)
+	if err != nil {
+		return nil
+	}
+	sw = new(SMTPWriter)
+	if sw != nil {
+		sw.url = u
+		sw.from = addr
+		sw.marshal = json.Marshal
+		sw.timeout = 30 * time.Second
+		sw.retry = DefaultRetry
+	}
+	return
+}
+
+// SetTo sets the template of the recipients,
+// a comma-separated list of addresses.
+func (sw *SMTPWriter) SetTo(t Template) *SMTPWriter {
+	sw.to = t
+	return sw
+}
+
+// SetCc sets the template of the recipients in copy.
+func (sw *SMTPWriter) SetCc(t Template) *SMTPWriter {
+	sw.cc = t
+	return sw
+}
+
+// SetSubject sets the template of the subject.
+func (sw *SMTPWriter) SetSubject(t Template) *SMTPWriter {
+	sw.subject = t
+	return sw
+}
+
+// SetBody sets the template of the plain text body.
+func (sw *SMTPWriter) SetBody(t Template) *SMTPWriter {
+	sw.text = t
+	return sw
+}
+
+// SetHTML sets the template of the HTML body,
+// e.g. an html/template.Template.
+func (sw *SMTPWriter) SetHTML(t Template) *SMTPWriter {
+	sw.html = t
+	return sw
+}
+
+// SetMarshal sets the MarshalFunc for the body of items
+// that are neither []byte nor string.
+func (sw *SMTPWriter) SetMarshal(marshal MarshalFunc) *SMTPWriter {
+	sw.marshal = marshal
+	return sw
+}
+
+// SetTimeout sets the timeout for connecting
+// and sending a message (default 30s).
+func (sw *SMTPWriter) SetTimeout(d time.Duration) *SMTPWriter {
+	sw.timeout = d
+	return sw
+}
+
+// SetRetry sets the RetryPolicy (default: DefaultRetry).
+func (sw *SMTPWriter) SetRetry(rp RetryPolicy) *SMTPWriter {
+	sw.retry = rp
+	return sw
+}
+
+// Consume is the pre-defined method that makes SMTPWriter a Consumer.
+// Consume terminates with an error if an item cannot be rendered
+// or sent after all attempts.
+func (sw *SMTPWriter) Consume(src conduit.Source) error {
+	defer func() {
+		if sw.client != nil {
+			sw.client.Quit()
+			sw.disconnect()
+		}
+	}()
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			continue
+		}
+		m, err := sw.message(inp)
+		if err != nil {
+			return err
+		}
+		attempts, err := sw.retry.run(nil, func() (bool, error) {
+			if sw.client == nil {
+				err := sw.connect()
+				if err != nil {
+					return true, err
+				}
+			}
+			err := sw.send(m)
+			if err != nil {
+				sw.client.Reset()
+				if e, ok := err.(*textproto.Error); ok && e.Code >= 500 {
+					return false, err
+				}
+				sw.disconnect()
+			}
+			return true, err
+		})
+		if err != nil {
+			return errors.New(fmt.Sprintf("sending mail failed after %d attempts: %v", attempts, err))
+		}
+	}
+	return nil
+}
+
+// Connects, starts TLS and authenticates
+func (sw *SMTPWriter) connect() error {
+	implicit := sw.url.Scheme == "smtps"
+	host := sw.url.Hostname()
+	addr := sw.url.Host
+	if sw.url.Port() == "" {
+		port := "25"
+		if implicit {
+			port = "465"
+		}
+		addr = net.JoinHostPort(host, port)
+	}
+	conn, err := net.DialTimeout("tcp", addr, sw.timeout)
+	if err != nil {
+		return err
+	}
+	if implicit {
+		conn = tls.Client(conn, &tls.Config{ServerName: host})
+	}
+	conn.SetDeadline(time.Now().Add(sw.timeout))
+	c, err := smtp.NewClient(conn, host)
+	if err == nil && !implicit {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			err = c.StartTLS(&tls.Config{ServerName: host})
+		}
+	}
+	if err == nil && sw.url.User != nil {
+		pass, _ := sw.url.User.Password()
+		err = c.Auth(smtp.PlainAuth("", sw.url.User.Username(), pass, host))
+	}
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	sw.conn, sw.client = conn, c
+	return nil
+}
+
+func (sw *SMTPWriter) disconnect() {
+	sw.conn.Close()
+	sw.conn, sw.client = nil, nil
+}
+
+// Sends a message to its recipients (To, Cc and Bcc)
+func (sw *SMTPWriter) send(m *EmailMessage) error {
+	sw.conn.SetDeadline(time.Now().Add(sw.timeout))
+	err := sw.client.Mail(sw.from.Address)
+	if err != nil {
+		return err
+	}
+	for _, addrs := range [][]*mail.Address{m.To, m.Cc, m.Bcc} {
+		for _, a := range addrs {
+			err = sw.client.Rcpt(a.Address)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	w, err := sw.client.Data()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(m.Bytes())
+	if err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// Parses a rendered list of addresses
+func (sw *SMTPWriter) addresses(t Template, inp interface{}) ([]*mail.Address, error) {
+	if t == nil {
+		return nil, nil
+	}
+	list, err := render(t, inp)
+	if err != nil || list == "" {
+		return nil, err
+	}
+	return mail.ParseAddressList(list)
+}
+
+// Creates the message for an item
+func (sw *SMTPWriter) message(inp interface{}) (*EmailMessage, error) {
+	if m, ok := inp.(*EmailMessage); ok {
+		if len(m.To)+len(m.Cc)+len(m.Bcc) == 0 {
+			return nil, errors.New("mail without recipients")
+		}
+		if m.From == nil {
+			c := *m
+			c.From = sw.from
+			m = &c
+		}
+		return m, nil
+	}
+	var err error
+	m := &EmailMessage{From: sw.from}
+	m.To, err = sw.addresses(sw.to, inp)
+	if err != nil {
+		return nil, err
+	}
+	m.Cc, err = sw.addresses(sw.cc, inp)
+	if err != nil {
+		return nil, err
+	}
+	if len(m.To)+len(m.Cc) == 0 {
+		return nil, errors.New(fmt.Sprintf("no recipients for %v", inp))
+	}
+	if sw.subject != nil {
+		m.Subject, err = render(sw.subject, inp)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if sw.html != nil {
+		m.HTML, err = render(sw.html, inp)
+		if err != nil {
+			return nil, err
+		}
+	}
+	switch {
+	case sw.text != nil:
+		m.Text, err = render(sw.text, inp)
+	case sw.html == nil:
+		var data []byte
+		data, err = payload(inp, sw.marshal)
+		m.Text = string(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
@@ -0,0 +1,218 @@
+package utils
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"text/template"
+
+	"github.com/toschoo/conduit"
+)
+
+// Mail received by smtpServer
+type smtpMail struct {
+	from string
+	to   []string
+	data string
+}
+
+// SMTP test server with the user "user" (password "p@ss");
+// the first fail transactions are rejected as temporary failure
+// and recipients at invalid are rejected permanently
+type smtpServer struct {
+	ln    net.Listener
+	door  sync.Mutex
+	fail  int
+	conns int
+	mails []smtpMail
+}
+
+func newSMTPServer(t *testing.T) *smtpServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("SMTP: cannot listen: %v", err)
+	}
+	s := &smtpServer{ln: ln}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return s
+}
+
+func (s *smtpServer) url(user string) string {
+	return "smtp://" + user + s.ln.Addr().String()
+}
+
+func (s *smtpServer) received() ([]smtpMail, int) {
+	s.door.Lock()
+	defer s.door.Unlock()
+	return append([]smtpMail(nil), s.mails...), s.conns
+}
+
+func (s *smtpServer) serve(conn net.Conn) {
+	defer conn.Close()
+	s.door.Lock()
+	s.conns++
+	s.door.Unlock()
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 test server ready")
+	auth := false
+	var m smtpMail
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		arg := strings.TrimSpace(strings.TrimPrefix(line, strings.SplitN(line, " ", 2)[0]))
+		switch cmd {
+		case "EHLO":
+			tp.PrintfLine("250-test\r\n250-AUTH PLAIN\r\n250 8BITMIME")
+		case "AUTH":
+			cred, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(arg, "PLAIN "))
+			if string(cred) != "\x00user\x00p@ss" {
+				tp.PrintfLine("535 authentication failed")
+				continue
+			}
+			auth = true
+			tp.PrintfLine("235 ok")
+		case "MAIL":
+			if !auth {
+				tp.PrintfLine("530 authentication required")
+				continue
+			}
+			s.door.Lock()
+			fail := s.fail > 0
+			s.fail--
+			s.door.Unlock()
+			if fail {
+				tp.PrintfLine("421 try again later")
+				return
+			}
+			m = smtpMail{from: strings.Trim(strings.Fields(strings.TrimPrefix(arg, "FROM:"))[0], "<>")}
+			tp.PrintfLine("250 ok")
+		case "RCPT":
+			to := strings.Trim(strings.TrimPrefix(arg, "TO:"), "<>")
+			if strings.HasSuffix(to, "@invalid") {
+				tp.PrintfLine("550 no such user")
+				continue
+			}
+			m.to = append(m.to, to)
+			tp.PrintfLine("250 ok")
+		case "DATA":
+			tp.PrintfLine("354 go ahead")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			m.data = string(data)
+			s.door.Lock()
+			s.mails = append(s.mails, m)
+			s.door.Unlock()
+			tp.PrintfLine("250 queued")
+		case "RSET", "NOOP":
+			tp.PrintfLine("250 ok")
+		case "QUIT":
+			tp.PrintfLine("221 bye")
+			return
+		default:
+			tp.PrintfLine("502 unknown command")
+		}
+	}
+}
+
+// SMTP writer:
+// - Items are rendered with the templates
+// - EmailMessages are sent as they are to all recipients
+// - Temporary failures are retried on a new connection
+// - Rejected recipients fail without retry
+func TestSMTPWriter(t *testing.T) {
+	srv := newSMTPServer(t)
+	srv.fail = 1
+	if NewSMTPWriter("http://host", "a@example.com") != nil || NewSMTPWriter(srv.url(""), "no address") != nil {
+		t.Errorf("SMTPWriter: invalid arguments accepted")
+	}
+	tmpl := func(s string) Template {
+		return template.Must(template.New("").Parse(s))
+	}
+	items := []interface{}{
+		Record{"host": "db1", "load": 0.95, "owner": "ops@example.com"},
+		&conduit.Barrier{},
+		&EmailMessage{To: []*mail.Address{{Address: "x@example.com"}}, Bcc: []*mail.Address{{Address: "y@example.com"}},
+			Subject: "direct", Text: "as is"},
+		Record{"host": "web", "load": 0.99, "owner": "web@example.com, Web Team <team@example.com>"},
+	}
+	sw := NewSMTPWriter(srv.url("user:p%40ss@"), "Alerts <alerts@example.com>").
+		SetTo(tmpl("{{.owner}}")).SetSubject(tmpl("High load on {{.host}}")).
+		SetBody(tmpl("Load is {{.load}}.")).SetRetry(fastRetry)
+	if err := conduit.NewChain(&AnyProducer{src: items}, nil, sw, small).Run(); err != nil {
+		t.Fatalf("SMTPWriter failed: %v", err)
+	}
+	mails, conns := srv.received()
+	if len(mails) != 3 || conns != 2 {
+		t.Fatalf("SMTPWriter: %d mails on %d connections", len(mails), conns)
+	}
+	for i, want := range []struct {
+		to      string
+		subject string
+		text    string
+	}{
+		{"[ops@example.com]", "High load on db1", "Load is 0.95."},
+		{"[x@example.com y@example.com]", "direct", "as is"},
+		{"[web@example.com team@example.com]", "High load on web", "Load is 0.99."},
+	} {
+		m := mails[i]
+		p, err := ParseEmail([]byte(m.data))
+		if err != nil {
+			t.Errorf("SMTPWriter: cannot parse mail %d: %v", i, err)
+			continue
+		}
+		if m.from != "alerts@example.com" || fmt.Sprint(m.to) != want.to || p.From.String() != `"Alerts" <alerts@example.com>` ||
+			p.Subject != want.subject || strings.TrimSpace(p.Text) != want.text || len(p.Cc) != 0 {
+			t.Errorf("SMTPWriter: unexpected mail %d from %s to %v: %+v", i, m.from, m.to, p)
+		}
+	}
+
+	// without body template, the item is the body
+	sw = NewSMTPWriter(srv.url("user:p%40ss@"), "alerts@example.com").SetTo(tmpl("ops@example.com")).SetCc(tmpl("{{.cc}}"))
+	if err := conduit.NewChain(&AnyProducer{src: []interface{}{map[string]string{"cc": "dev@example.com"}}}, nil, sw, small).Run(); err != nil {
+		t.Fatalf("SMTPWriter failed: %v", err)
+	}
+	mails, _ = srv.received()
+	p, err := ParseEmail([]byte(mails[3].data))
+	if err != nil || strings.TrimSpace(p.Text) != `{"cc":"dev@example.com"}` || len(p.Cc) != 1 || p.Cc[0].Address != "dev@example.com" {
+		t.Errorf("SMTPWriter: unexpected mail %+v (%v)", p, err)
+	}
+
+	for _, tc := range []struct {
+		sw   *SMTPWriter
+		item interface{}
+		err  string
+	}{
+		{NewSMTPWriter(srv.url("user:wrong@"), "a@example.com").SetTo(tmpl("b@example.com")).SetRetry(fastRetry), "x", "authentication failed"},
+		{NewSMTPWriter(srv.url("user:p%40ss@"), "a@example.com").SetTo(tmpl("b@invalid")).SetRetry(fastRetry), "x", "after 1 attempts"},
+		{NewSMTPWriter(srv.url("user:p%40ss@"), "a@example.com"), "x", "no recipients"},
+		{NewSMTPWriter(srv.url("user:p%40ss@"), "a@example.com"), &EmailMessage{}, "without recipients"},
+		{NewSMTPWriter(srv.url("user:p%40ss@"), "a@example.com").SetTo(tmpl("{{.x}}")), "x", "can't evaluate"},
+	} {
+		chn := conduit.NewChain(&AnyProducer{src: []interface{}{tc.item}}, nil, tc.sw, small)
+		if chn.Run() == nil || !strings.Contains(fmt.Sprint(chn.Errs), tc.err) {
+			t.Errorf("SMTPWriter: expected %q: %v", tc.err, chn.Errs)
+		}
+	}
+	if mails, _ = srv.received(); len(mails) != 4 {
+		t.Errorf("SMTPWriter: %d mails", len(mails))
+	}
+}
@@ -0,0 +1,92 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/toschoo/conduit"
+)
+
+// Sort is a Conduit that buffers incoming items in memory
+// and sends them sorted according to a LessFunc down the chain
+// when the input ends. Equal items keep their order.
+// Barriers are passed on without flushing the buffer;
+// instead, the buffered items are included in checkpoints
+// (see conduit.Checkpointer), which requires their types
+// to be registered with gob.Register.
+// Sort is meant for small reorder jobs: if more than
+// the maximum number of items are to be buffered,
+// Sort terminates with an error.
+type Sort struct {
+	less     LessFunc
+	max      int
+	buf      []interface{}
+	restored bool // buf was restored from a checkpoint
+}
+
+// NewSort creates a new Sort Conduit
+// that buffers at most maxItems items.
+func NewSort(less LessFunc, maxItems int) (s *Sort) {
+	if less == nil || maxItems <= 0 {
+		return nil
+	}
+	s = new(Sort)
+	if s != nil {
+		s.less = less
+		s.max = maxItems
+	}
+	return
+}
+
+// Conduct is the pre-defined method that makes Sort a Conduit.
+func (s *Sort) Conduct(src conduit.Source, trg conduit.Target) error {
+	if !s.restored {
+		s.buf = nil
+	}
+	s.restored = false
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			trg <- inp
+			continue
+		}
+		if len(s.buf) >= s.max {
+			return errors.New(fmt.Sprintf("sort exceeds %d items", s.max))
+		}
+		s.buf = append(s.buf, inp)
+	}
+	sort.SliceStable(s.buf, func(i, j int) bool {
+		return s.less(s.buf[i], s.buf[j])
+	})
+	for _, v := range s.buf {
+		trg <- v
+	}
+	s.buf = nil
+	return nil
+}
+
+// Snapshot is the pre-defined method that makes Sort
+// a conduit.Checkpointer.
+func (s *Sort) Snapshot() ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(s.buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Restore is the pre-defined method that makes Sort
+// a conduit.Checkpointer.
+func (s *Sort) Restore(b []byte) error {
+	var items []interface{}
+	err := gob.NewDecoder(bytes.NewReader(b)).Decode(&items)
+	if err != nil {
+		return err
+	}
+	s.buf = items
+	s.restored = true
+	return nil
+}
@@ -0,0 +1,58 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/toschoo/conduit"
+)
+
+// Sort:
+// - Items are sorted stably; barriers do not flush the buffer
+// - More items than the limit terminate the chain with an error
+// - Restored items are sorted together with the new ones
+func TestSort(t *testing.T) {
+	if NewSort(nil, 10) != nil || NewSort(func(a, b interface{}) bool { return false }, 0) != nil {
+		t.Errorf("Sort: invalid arguments accepted")
+	}
+	byFirst := func(a, b interface{}) bool { return a.(string)[0] < b.(string)[0] }
+	items := []interface{}{"c1", "a1", "b1", "a2", &conduit.Barrier{}, "z", "c2", "a3", "c3"}
+	ac := &AnyConsumer{}
+	if err := conduit.NewChain(&AnyProducer{src: items}, []conduit.Conduit{NewSort(byFirst, 8)}, ac, small).Run(); err != nil {
+		t.Fatalf("Sort failed: %v", err)
+	}
+	if len(ac.recvd) != len(items) || !conduit.IsBarrier(ac.recvd[0]) {
+		t.Fatalf("Sort: received %v", ac.recvd)
+	}
+	if s := fmt.Sprint(ac.recvd[1:]); s != "[a1 a2 a3 b1 c1 c2 c3 z]" {
+		t.Errorf("Sort: received %s", s)
+	}
+
+	ac = &AnyConsumer{}
+	chn := conduit.NewChain(&AnyProducer{src: items}, []conduit.Conduit{NewSort(byFirst, 3)}, ac, small)
+	if err := chn.Run(); err == nil || !strings.Contains(fmt.Sprint(chn.Errs), "sort exceeds 3 items") {
+		t.Errorf("Sort: expected error: %v", chn.Errs)
+	}
+	if len(ac.recvd) != 0 {
+		t.Errorf("Sort: received %v", ac.recvd)
+	}
+
+	srt := NewSort(byFirst, 8)
+	srt.buf = []interface{}{"c1", "a1"}
+	b, err := srt.Snapshot()
+	if err != nil {
+		t.Fatalf("Sort: cannot snapshot: %v", err)
+	}
+	srt = NewSort(byFirst, 8)
+	if err = srt.Restore(b); err != nil {
+		t.Fatalf("Sort: cannot restore: %v", err)
+	}
+	ac = &AnyConsumer{}
+	if err := conduit.NewChain(&AnyProducer{src: []interface{}{"b1", "a2"}}, []conduit.Conduit{srt}, ac, small).Run(); err != nil {
+		t.Fatalf("Sort failed: %v", err)
+	}
+	if s := fmt.Sprint(ac.recvd); s != "[a1 a2 b1 c1]" {
+		t.Errorf("Sort: received %s after restore", s)
+	}
+}
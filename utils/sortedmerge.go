@@ -0,0 +1,115 @@
+package utils
+
+import (
+	"container/heap"
+
+	"github.com/toschoo/conduit"
+)
+
+// LessFunc reports whether a must be sorted before b.
+type LessFunc func(a, b interface{}) bool
+
+// SortedMerge is a Producer that merges the output
+// of several producers, each sorted according to a LessFunc,
+// into one sorted stream, e.g. to merge log files by timestamp.
+// If the output of a producer is not sorted,
+// the merged output is not sorted either.
+// Equal items are sent in the order of the producers.
+type SortedMerge struct {
+	less LessFunc
+	ps   []conduit.Producer
+	sz   int
+}
+
+// NewSortedMerge creates a new SortedMerge Producer.
+func NewSortedMerge(less LessFunc, ps ...conduit.Producer) (sm *SortedMerge) {
+	if less == nil {
+		return nil
+	}
+	sm = new(SortedMerge)
+	if sm != nil {
+		sm.less = less
+		sm.ps = ps
+		sm.sz = 10
+	}
+	return
+}
+
+// head is the next item of one input
+type head struct {
+	item interface{}
+	idx  int
+}
+
+// heads implements heap.Interface
+type heads struct {
+	less LessFunc
+	hs   []head
+}
+
+func (h *heads) Len() int { return len(h.hs) }
+
+func (h *heads) Less(i, j int) bool {
+	if h.less(h.hs[i].item, h.hs[j].item) {
+		return true
+	}
+	if h.less(h.hs[j].item, h.hs[i].item) {
+		return false
+	}
+	return h.hs[i].idx < h.hs[j].idx
+}
+
+func (h *heads) Swap(i, j int) { h.hs[i], h.hs[j] = h.hs[j], h.hs[i] }
+
+func (h *heads) Push(x interface{}) { h.hs = append(h.hs, x.(head)) }
+
+func (h *heads) Pop() interface{} {
+	x := h.hs[len(h.hs)-1]
+	h.hs = h.hs[:len(h.hs)-1]
+	return x
+}
+
+// Cancel is the pre-defined method that makes SortedMerge
+// a conduit.Canceler; it cancels all producers that are Cancelers.
+func (sm *SortedMerge) Cancel() {
+	cancelAll(sm.ps)
+}
+
+// Produce is the pre-defined method that makes SortedMerge a Producer.
+// Produce terminates when all producers have terminated
+// and returns the first error reported by a producer.
+func (sm *SortedMerge) Produce(trg conduit.Target) error {
+	srcs := make([]chan interface{}, len(sm.ps))
+	errs := make([]chan error, len(sm.ps))
+	for i, p := range sm.ps {
+		conduit.ResetCancel(p)
+		srcs[i], errs[i] = startProducer(p, sm.sz)
+	}
+
+	h := &heads{less: sm.less}
+	for i, src := range srcs {
+		if inp, ok := <-src; ok {
+			h.hs = append(h.hs, head{inp, i})
+		}
+	}
+	heap.Init(h)
+
+	for h.Len() > 0 {
+		x := h.hs[0]
+		trg <- x.item
+		if inp, ok := <-srcs[x.idx]; ok {
+			h.hs[0].item = inp
+			heap.Fix(h, 0)
+		} else {
+			heap.Pop(h)
+		}
+	}
+
+	var err error
+	for _, e := range errs {
+		if x := <-e; err == nil {
+			err = x
+		}
+	}
+	return err
+}
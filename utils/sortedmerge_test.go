@@ -0,0 +1,80 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/toschoo/conduit"
+)
+
+func lessInt(a, b interface{}) bool {
+	return a.(int) < b.(int)
+}
+
+// SortedMerge:
+// - It is processed without errors
+// - All data of all producers arrive
+// - The output is sorted
+func TestSortedMergeChain(t *testing.T) {
+	for i := 0; i < numOfTests; i++ {
+		err := testSortedMergeChain(numOfData, 1+i%7)
+		if err != nil {
+			m := fmt.Sprintf("SortedMergeChain failed: %v", err)
+			t.Error(m)
+		}
+	}
+}
+
+// SortedMerge with failing producer:
+// - The error is reported
+// - Data of other producers arrive
+func TestErrSortedMergeChain(t *testing.T) {
+	p := NewSortedMerge(lessInt, new(ErrProducer), &SeqProducer{makeSeq(numOfData)})
+	c := new(BaseConsumer)
+	chn := conduit.NewChain(p, nil, c, small)
+	err := chn.Run()
+	if err == nil || len(chn.Errs) != 1 || chn.Errs[0].Error() != errMsg {
+		t.Errorf("ErrSortedMergeChain: unexpected errors: %v", chn.Errs)
+	}
+	if len(c.recvd) != numOfData {
+		t.Errorf("ErrSortedMergeChain: expected %d items, have %d", numOfData, len(c.recvd))
+	}
+}
+
+func testSortedMergeChain(n, k int) error {
+
+	var all []int
+	ps := make([]conduit.Producer, k)
+	for i := range ps {
+		seq := make([]int, rand.Intn(n))
+		for j := range seq {
+			seq[j] = rand.Intn(n)
+		}
+		sort.Ints(seq)
+		all = append(all, seq...)
+		ps[i] = &SeqProducer{seq}
+	}
+	sort.Ints(all)
+	c := new(BaseConsumer)
+
+	chn := conduit.NewChain(NewSortedMerge(lessInt, ps...), nil, c, small)
+
+	err := chn.Run()
+	if err != nil {
+		m := fmt.Sprintf("error on running chain: %v", err)
+		return errors.New(m)
+	}
+	if len(c.recvd) != len(all) {
+		m := fmt.Sprintf("expected %d items, have %d", len(all), len(c.recvd))
+		return errors.New(m)
+	}
+	for i := range all {
+		if c.recvd[i] != all[i] {
+			return errors.New("Received values are not sorted!")
+		}
+	}
+	return nil
+}
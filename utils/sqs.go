@@ -0,0 +1,651 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+const (
+	sqsMaxBatch = 10
+	sqsMaxBytes = 256 * 1024
+)
+
+// SQSMsg is a message received from an SQS queue.
+// MessageAttributes holds the string values of the attributes.
+type SQSMsg struct {
+	ID                string
+	ReceiptHandle     string
+	Body              string
+	Attributes        map[string]string
+	MessageAttributes map[string]string
+}
+
+type sqsAttribute struct {
+	DataType    string
+	StringValue string
+}
+
+// Messages received but not yet deleted
+type sqsFlight struct {
+	door     sync.Mutex
+	receipts map[string]string
+	done     []string
+}
+
+func (f *sqsFlight) reset() {
+	f.door.Lock()
+	defer f.door.Unlock()
+	f.receipts = make(map[string]string)
+	f.done = nil
+}
+
+func (f *sqsFlight) add(id, receipt string) {
+	f.door.Lock()
+	defer f.door.Unlock()
+	f.receipts[id] = receipt
+}
+
+// Marks a message for deletion
+func (f *sqsFlight) ack(id string) {
+	f.door.Lock()
+	defer f.door.Unlock()
+	f.done = append(f.done, id)
+}
+
+// Receipt handles of the messages marked for deletion
+func (f *sqsFlight) take() []interface{} {
+	f.door.Lock()
+	defer f.door.Unlock()
+	var receipts []interface{}
+	for _, id := range f.done {
+		receipts = append(receipts, f.receipts[id])
+		delete(f.receipts, id)
+	}
+	f.done = nil
+	return receipts
+}
+
+// Receipt handles of all messages
+func (f *sqsFlight) all() []string {
+	f.door.Lock()
+	defer f.door.Unlock()
+	var receipts []string
+	for _, r := range f.receipts {
+		receipts = append(receipts, r)
+	}
+	return receipts
+}
+
+// SQSReader is a Producer that receives the messages
+// of an SQS queue with long polling and sends them
+// as *SQSMsg down the chain.
+// Messages are deleted from the queue when they are acknowledged:
+// by default when the messages of a receive request
+// have been sent down the chain or, with AckOnCheckpoint,
+// when a checkpoint of the chain covers them
+// (see conduit.Chain.SetCheckpoints and conduit.Committer).
+// Messages that are not deleted become visible again
+// after the visibility timeout and are received again (at least once).
+// With SetVisibility, the visibility timeout of the messages
+// that are not yet deleted is extended periodically,
+// so that long running processing does not cause redelivery.
+// The producer runs until the chain is canceled or terminates
+// with an error when receiving fails after all attempts.
+type SQSReader struct {
+	conduit.Cancelable
+	aws    awsClient
+	queue  string
+	batch  int
+	wait   time.Duration
+	vis    time.Duration
+	retry  RetryPolicy
+	onCP   bool
+	acks   ackQueue
+	flight sqsFlight
+	door   sync.Mutex
+	cancel context.CancelFunc
+}
+
+// NewSQSReader creates a new SQSReader Producer
+// receiving from the queue with URL queueURL.
+func NewSQSReader(cfg AWSConfig, queueURL string) (sr *SQSReader) {
+	if queueURL == "" {
+		return nil
+	}
+	sr = new(SQSReader)
+	if sr != nil {
+		sr.aws = newAWSClient(cfg, "sqs")
+		sr.queue = queueURL
+		sr.batch = sqsMaxBatch
+		sr.wait = 20 * time.Second
+		sr.retry = DefaultRetry
+	}
+	return
+}
+
+// SetBatch sets the maximum number of messages
+// per receive request (1 - 10, default 10).
+func (sr *SQSReader) SetBatch(n int) *SQSReader {
+	if n > 0 && n <= sqsMaxBatch {
+		sr.batch = n
+	}
+	return sr
+}
+
+// SetWait sets how long a receive request waits
+// for messages (up to 20s, the default).
+func (sr *SQSReader) SetWait(d time.Duration) *SQSReader {
+	if d >= 0 && d <= 20*time.Second {
+		sr.wait = d
+	}
+	return sr
+}
+
+// SetVisibility sets the visibility timeout of received messages,
+// which is extended every half timeout until they are deleted
+// (default: the timeout of the queue, not extended).
+func (sr *SQSReader) SetVisibility(d time.Duration) *SQSReader {
+	sr.vis = d
+	return sr
+}
+
+// SetRetry sets the RetryPolicy for requests (default: DefaultRetry).
+func (sr *SQSReader) SetRetry(rp RetryPolicy) *SQSReader {
+	sr.retry = rp
+	return sr
+}
+
+// AckOnCheckpoint deletes messages only when
+// a checkpoint covers them.
+func (sr *SQSReader) AckOnCheckpoint() *SQSReader {
+	sr.onCP = true
+	return sr
+}
+
+// Resume is the pre-defined method that makes SQSReader
+// a conduit.Resumer. Messages that were not deleted
+// are received again, so nothing is skipped.
+func (sr *SQSReader) Resume(pos uint64) error {
+	sr.acks.resume(pos)
+	return nil
+}
+
+// Commit is the pre-defined method that makes SQSReader
+// a conduit.Committer; with AckOnCheckpoint, it deletes
+// the messages covered by the checkpoint.
+func (sr *SQSReader) Commit(cp *conduit.Checkpoint) error {
+	if !sr.onCP {
+		return nil
+	}
+	err := sr.acks.commit(cp.Position)
+	if err != nil {
+		return err
+	}
+	return sr.delete()
+}
+
+// Cancel cancels the producer and the pending request.
+func (sr *SQSReader) Cancel() {
+	sr.Cancelable.Cancel()
+	sr.door.Lock()
+	defer sr.door.Unlock()
+	if sr.cancel != nil {
+		sr.cancel()
+	}
+}
+
+// Produce is the pre-defined method that makes SQSReader a Producer.
+func (sr *SQSReader) Produce(trg conduit.Target) error {
+	sr.acks.start()
+	sr.flight.reset()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sr.door.Lock()
+	sr.cancel = cancel
+	sr.door.Unlock()
+	if sr.Canceled() {
+		return nil
+	}
+	if sr.vis > 0 {
+		go sr.extend(ctx)
+	}
+	for !sr.Canceled() {
+		msgs, err := sr.receive(ctx)
+		if sr.Canceled() {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			sr.flight.add(m.ID, m.ReceiptHandle)
+			id := m.ID
+			if sr.onCP {
+				sr.acks.add(func() error {
+					sr.flight.ack(id)
+					return nil
+				})
+			}
+			trg <- m
+			if !sr.onCP {
+				sr.flight.ack(id)
+			}
+		}
+		if !sr.onCP {
+			err = sr.delete()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Receives a batch of messages
+func (sr *SQSReader) receive(ctx context.Context) ([]*SQSMsg, error) {
+	req := map[string]interface{}{
+		"QueueUrl":              sr.queue,
+		"MaxNumberOfMessages":   sr.batch,
+		"WaitTimeSeconds":       int(sr.wait / time.Second),
+		"AttributeNames":        []string{"All"},
+		"MessageAttributeNames": []string{"All"},
+	}
+	if sr.vis > 0 {
+		req["VisibilityTimeout"] = int(sr.vis / time.Second)
+	}
+	var rsp struct {
+		Messages []struct {
+			MessageId         string
+			ReceiptHandle     string
+			Body              string
+			Attributes        map[string]string
+			MessageAttributes map[string]sqsAttribute
+		}
+	}
+	attempts, err := sr.retry.run(sr.Canceled, func() (bool, error) {
+		err := sr.aws.callJSON(ctx, "1.0", "AmazonSQS.ReceiveMessage", req, &rsp)
+		return awsRetryable(err), err
+	})
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("receive failed after %d attempts: %v", attempts, err))
+	}
+	msgs := make([]*SQSMsg, len(rsp.Messages))
+	for i, m := range rsp.Messages {
+		msgs[i] = &SQSMsg{
+			ID:                m.MessageId,
+			ReceiptHandle:     m.ReceiptHandle,
+			Body:              m.Body,
+			Attributes:        m.Attributes,
+			MessageAttributes: make(map[string]string),
+		}
+		for k, a := range m.MessageAttributes {
+			msgs[i].MessageAttributes[k] = a.StringValue
+		}
+	}
+	return msgs, nil
+}
+
+// Deletes the acknowledged messages
+func (sr *SQSReader) delete() error {
+	receipts := sr.flight.take()
+	for len(receipts) > 0 {
+		n := len(receipts)
+		if n > sqsMaxBatch {
+			n = sqsMaxBatch
+		}
+		err := sendBatch(receipts[:n], sr.retry, nil, func(items []interface{}) ([]batchFailure, error) {
+			return sr.batchRequest("AmazonSQS.DeleteMessageBatch", items, nil)
+		})
+		if err != nil {
+			return err
+		}
+		receipts = receipts[n:]
+	}
+	return nil
+}
+
+// Extends the visibility timeout of the messages in flight
+// every half timeout
+func (sr *SQSReader) extend(ctx context.Context) {
+	t := time.NewTicker(sr.vis / 2)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+		receipts := sr.flight.all()
+		for len(receipts) > 0 {
+			n := len(receipts)
+			if n > sqsMaxBatch {
+				n = sqsMaxBatch
+			}
+			var items []interface{}
+			for _, r := range receipts[:n] {
+				items = append(items, r)
+			}
+			// if extending fails, the message may be received again
+			sr.batchRequest("AmazonSQS.ChangeMessageVisibilityBatch", items, map[string]interface{}{
+				"VisibilityTimeout": int(sr.vis / time.Second),
+			})
+			receipts = receipts[n:]
+		}
+	}
+}
+
+// Sends a batch request on receipt handles
+func (sr *SQSReader) batchRequest(target string, receipts []interface{}, extra map[string]interface{}) ([]batchFailure, error) {
+	var entries []map[string]interface{}
+	for i, r := range receipts {
+		e := map[string]interface{}{"Id": strconv.Itoa(i), "ReceiptHandle": r}
+		for k, v := range extra {
+			e[k] = v
+		}
+		entries = append(entries, e)
+	}
+	var rsp sqsBatchResult
+	err := sr.aws.callJSON(context.Background(), "1.0", target,
+		map[string]interface{}{"QueueUrl": sr.queue, "Entries": entries}, &rsp)
+	if err != nil {
+		return nil, err
+	}
+	return rsp.failures(), nil
+}
+
+// Result of SQS batch requests
+type sqsBatchResult struct {
+	Failed []struct {
+		Id          string
+		Code        string
+		Message     string
+		SenderFault bool
+	}
+}
+
+func (r *sqsBatchResult) failures() []batchFailure {
+	var fs []batchFailure
+	for _, f := range r.Failed {
+		i, err := strconv.Atoi(f.Id)
+		if err != nil {
+			continue
+		}
+		e := &AWSError{Code: f.Code, Message: f.Message}
+		fs = append(fs, batchFailure{index: i, retryable: !f.SenderFault, err: e})
+	}
+	return fs
+}
+
+// Message to be sent in a batch
+type sqsEntry struct {
+	item  interface{}
+	body  string
+	group string
+	dedup string
+	attrs map[string]string
+}
+
+func (e *sqsEntry) source() interface{} { return e.item }
+func (e *sqsEntry) size() int           { return len(e.body) }
+
+// Options and logic common to SQSWriter and SNSPublisher
+type sqsSend struct {
+	aws     awsClient
+	marshal MarshalFunc
+	group   KeyFunc
+	dedup   KeyFunc
+	retry   RetryPolicy
+	side    conduit.Target
+}
+
+// Creates the entry for an item
+func (s *sqsSend) entry(inp interface{}) (*sqsEntry, error) {
+	e := &sqsEntry{item: inp}
+	if m, ok := inp.(*SQSMsg); ok {
+		e.body = m.Body
+		e.attrs = m.MessageAttributes
+	} else {
+		data, err := payload(inp, s.marshal)
+		if err != nil {
+			return nil, err
+		}
+		e.body = string(data)
+	}
+	if len(e.body) > sqsMaxBytes {
+		return nil, errors.New(fmt.Sprintf("message of %d bytes too large", len(e.body)))
+	}
+	if s.group != nil {
+		e.group = keyOf(s.group, inp)
+	}
+	if s.dedup != nil {
+		e.dedup = keyOf(s.dedup, inp)
+	}
+	return e, nil
+}
+
+// Sends the items in batches of up to 10 messages and 256 KiB
+func (s *sqsSend) consume(src conduit.Source, send func([]interface{}) ([]batchFailure, error)) error {
+	entry := func(inp interface{}) (batchEntry, error) {
+		return s.entry(inp)
+	}
+	return consumeBatches(src, sqsMaxBatch, sqsMaxBytes, s.retry, sideFailed(s.side), entry, send)
+}
+
+// SQSWriter is a Consumer that sends the incoming items
+// to an SQS queue in batches (SendMessageBatch).
+// []byte and string items are sent as they are,
+// *SQSMsg items with their body and message attributes
+// and others are encoded with a MarshalFunc (default: json.Marshal).
+// Batches hold up to 10 messages and are sent
+// when they are full, at barriers and at the end of the stream.
+// Messages that fail with a retryable error are sent again
+// according to the RetryPolicy (DefaultRetry).
+// Messages that finally fail are sent as FailedRequest
+// to the side output "failed" (see conduit.SideOutputter)
+// or, if the side output is not connected,
+// terminate the consumer with an error.
+type SQSWriter struct {
+	sqsSend
+	queue string
+}
+
+// NewSQSWriter creates a new SQSWriter Consumer
+// sending to the queue with URL queueURL.
+func NewSQSWriter(cfg AWSConfig, queueURL string) (sw *SQSWriter) {
+	if queueURL == "" {
+		return nil
+	}
+	sw = new(SQSWriter)
+	if sw != nil {
+		sw.aws = newAWSClient(cfg, "sqs")
+		sw.queue = queueURL
+		sw.marshal = json.Marshal
+		sw.retry = DefaultRetry
+	}
+	return
+}
+
+// SetMarshal sets the MarshalFunc.
+func (sw *SQSWriter) SetMarshal(marshal MarshalFunc) *SQSWriter {
+	sw.marshal = marshal
+	return sw
+}
+
+// SetGroup sets the KeyFunc that obtains the message group ID
+// of FIFO queues (see KeyFunc and Keyed).
+func (sw *SQSWriter) SetGroup(kf KeyFunc) *SQSWriter {
+	sw.group = kf
+	return sw
+}
+
+// SetDeduplication sets the KeyFunc that obtains
+// the deduplication ID of messages sent to FIFO queues
+// without content-based deduplication.
+func (sw *SQSWriter) SetDeduplication(kf KeyFunc) *SQSWriter {
+	sw.dedup = kf
+	return sw
+}
+
+// SetRetry sets the RetryPolicy (default: DefaultRetry).
+func (sw *SQSWriter) SetRetry(rp RetryPolicy) *SQSWriter {
+	sw.retry = rp
+	return sw
+}
+
+// SideOutput is the pre-defined method that makes SQSWriter
+// a conduit.SideOutputter; name must be "failed".
+func (sw *SQSWriter) SideOutput(name string, trg conduit.Target) {
+	if name == "failed" {
+		sw.side = trg
+	}
+}
+
+// Consume is the pre-defined method that makes SQSWriter a Consumer.
+func (sw *SQSWriter) Consume(src conduit.Source) error {
+	return sw.consume(src, sw.send)
+}
+
+// Sends a batch
+func (sw *SQSWriter) send(entries []interface{}) ([]batchFailure, error) {
+	var es []map[string]interface{}
+	for i, x := range entries {
+		e := x.(*sqsEntry)
+		m := map[string]interface{}{"Id": strconv.Itoa(i), "MessageBody": e.body}
+		if e.group != "" {
+			m["MessageGroupId"] = e.group
+		}
+		if e.dedup != "" {
+			m["MessageDeduplicationId"] = e.dedup
+		}
+		if len(e.attrs) > 0 {
+			attrs := make(map[string]sqsAttribute)
+			for k, v := range e.attrs {
+				attrs[k] = sqsAttribute{DataType: "String", StringValue: v}
+			}
+			m["MessageAttributes"] = attrs
+		}
+		es = append(es, m)
+	}
+	var rsp sqsBatchResult
+	err := sw.aws.callJSON(context.Background(), "1.0", "AmazonSQS.SendMessageBatch",
+		map[string]interface{}{"QueueUrl": sw.queue, "Entries": es}, &rsp)
+	if err != nil {
+		return nil, err
+	}
+	return rsp.failures(), nil
+}
+
+// SNSPublisher is a Consumer that publishes the incoming items
+// to an SNS topic in batches (PublishBatch).
+// Items are encoded, batched and retried like by SQSWriter.
+type SNSPublisher struct {
+	sqsSend
+	topic string
+}
+
+// NewSNSPublisher creates a new SNSPublisher Consumer
+// publishing to the topic with ARN topicARN.
+func NewSNSPublisher(cfg AWSConfig, topicARN string) (sp *SNSPublisher) {
+	if topicARN == "" {
+		return nil
+	}
+	sp = new(SNSPublisher)
+	if sp != nil {
+		sp.aws = newAWSClient(cfg, "sns")
+		sp.topic = topicARN
+		sp.marshal = json.Marshal
+		sp.retry = DefaultRetry
+	}
+	return
+}
+
+// SetMarshal sets the MarshalFunc.
+func (sp *SNSPublisher) SetMarshal(marshal MarshalFunc) *SNSPublisher {
+	sp.marshal = marshal
+	return sp
+}
+
+// SetGroup sets the KeyFunc that obtains the message group ID
+// of FIFO topics (see KeyFunc and Keyed).
+func (sp *SNSPublisher) SetGroup(kf KeyFunc) *SNSPublisher {
+	sp.group = kf
+	return sp
+}
+
+// SetDeduplication sets the KeyFunc that obtains
+// the deduplication ID of messages published to FIFO topics
+// without content-based deduplication.
+func (sp *SNSPublisher) SetDeduplication(kf KeyFunc) *SNSPublisher {
+	sp.dedup = kf
+	return sp
+}
+
+// SetRetry sets the RetryPolicy (default: DefaultRetry).
+func (sp *SNSPublisher) SetRetry(rp RetryPolicy) *SNSPublisher {
+	sp.retry = rp
+	return sp
+}
+
+// SideOutput is the pre-defined method that makes SNSPublisher
+// a conduit.SideOutputter; name must be "failed".
+func (sp *SNSPublisher) SideOutput(name string, trg conduit.Target) {
+	if name == "failed" {
+		sp.side = trg
+	}
+}
+
+// Consume is the pre-defined method that makes SNSPublisher a Consumer.
+func (sp *SNSPublisher) Consume(src conduit.Source) error {
+	return sp.consume(src, sp.send)
+}
+
+// Publishes a batch
+func (sp *SNSPublisher) send(entries []interface{}) ([]batchFailure, error) {
+	params := url.Values{}
+	params.Set("Action", "PublishBatch")
+	params.Set("Version", "2010-03-31")
+	params.Set("TopicArn", sp.topic)
+	for i, x := range entries {
+		e := x.(*sqsEntry)
+		prefix := fmt.Sprintf("PublishBatchRequestEntries.member.%d.", i+1)
+		params.Set(prefix+"Id", strconv.Itoa(i))
+		params.Set(prefix+"Message", e.body)
+		if e.group != "" {
+			params.Set(prefix+"MessageGroupId", e.group)
+		}
+		if e.dedup != "" {
+			params.Set(prefix+"MessageDeduplicationId", e.dedup)
+		}
+		j := 1
+		for k, v := range e.attrs {
+			attr := fmt.Sprintf("%sMessageAttributes.entry.%d.", prefix, j)
+			params.Set(attr+"Name", k)
+			params.Set(attr+"Value.DataType", "String")
+			params.Set(attr+"Value.StringValue", v)
+			j++
+		}
+	}
+	var rsp struct {
+		Failed []struct {
+			Id          string
+			Code        string
+			Message     string
+			SenderFault bool
+		} `xml:"PublishBatchResult>Failed>member"`
+	}
+	err := sp.aws.callQuery(context.Background(), params, &rsp)
+	if err != nil {
+		return nil, err
+	}
+	var r sqsBatchResult
+	r.Failed = rsp.Failed
+	return r.failures(), nil
+}
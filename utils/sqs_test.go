@@ -0,0 +1,406 @@
+package utils
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+// SQS and SNS test server: one queue,
+// messages with body "poison" are rejected,
+// messages with body "flaky" fail once
+type sqsServer struct {
+	srv       *httptest.Server
+	door      sync.Mutex
+	msgs      []*sqsStored
+	received  map[string]int
+	deleted   int
+	flaky     bool
+	published []string
+}
+
+type sqsStored struct {
+	id      string
+	body    string
+	attrs   map[string]sqsAttribute
+	visible time.Time
+	receipt string
+	deleted bool
+}
+
+func newSQSServer() *sqsServer {
+	qs := &sqsServer{received: make(map[string]int)}
+	qs.srv = httptest.NewServer(http.HandlerFunc(qs.handle))
+	return qs
+}
+
+func (qs *sqsServer) config() AWSConfig {
+	return AWSConfig{
+		Region:      "eu-west-1",
+		Credentials: AWSCredentials{AccessKeyID: "key", SecretAccessKey: "secret"},
+		Endpoint:    qs.srv.URL,
+	}
+}
+
+func (qs *sqsServer) publishedMsgs() []string {
+	qs.door.Lock()
+	defer qs.door.Unlock()
+	return append([]string{}, qs.published...)
+}
+
+func (qs *sqsServer) deletedCount() int {
+	qs.door.Lock()
+	defer qs.door.Unlock()
+	return qs.deleted
+}
+
+// Number of messages that were received more than once
+func (qs *sqsServer) redelivered() int {
+	qs.door.Lock()
+	defer qs.door.Unlock()
+	n := 0
+	for _, c := range qs.received {
+		if c > 1 {
+			n++
+		}
+	}
+	return n
+}
+
+func (qs *sqsServer) handle(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=key/") {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if r.Header.Get("X-Amz-Target") == "" {
+		qs.publish(w, r)
+		return
+	}
+	var req struct {
+		MaxNumberOfMessages int
+		WaitTimeSeconds     int
+		VisibilityTimeout   int
+		Entries             []struct {
+			Id                string
+			ReceiptHandle     string
+			VisibilityTimeout int
+			MessageBody       string
+			MessageAttributes map[string]sqsAttribute
+		}
+	}
+	json.NewDecoder(r.Body).Decode(&req)
+	var rsp interface{}
+	switch r.Header.Get("X-Amz-Target") {
+	case "AmazonSQS.ReceiveMessage":
+		rsp = qs.receive(r, req.MaxNumberOfMessages, req.WaitTimeSeconds, req.VisibilityTimeout)
+	case "AmazonSQS.SendMessageBatch":
+		var failed []map[string]interface{}
+		qs.door.Lock()
+		for _, e := range req.Entries {
+			switch {
+			case e.MessageBody == "poison":
+				failed = append(failed, map[string]interface{}{"Id": e.Id, "Code": "InvalidMessageContents", "SenderFault": true})
+				continue
+			case e.MessageBody == "flaky" && !qs.flaky:
+				qs.flaky = true
+				failed = append(failed, map[string]interface{}{"Id": e.Id, "Code": "InternalError", "SenderFault": false})
+				continue
+			}
+			id := strconv.Itoa(len(qs.msgs) + 1)
+			qs.msgs = append(qs.msgs, &sqsStored{id: id, body: e.MessageBody, attrs: e.MessageAttributes})
+		}
+		qs.door.Unlock()
+		rsp = map[string]interface{}{"Failed": failed}
+	case "AmazonSQS.DeleteMessageBatch", "AmazonSQS.ChangeMessageVisibilityBatch":
+		qs.door.Lock()
+		for _, e := range req.Entries {
+			for _, m := range qs.msgs {
+				if m.receipt != e.ReceiptHandle || m.deleted {
+					continue
+				}
+				if e.VisibilityTimeout > 0 {
+					m.visible = time.Now().Add(time.Duration(e.VisibilityTimeout) * time.Second)
+					continue
+				}
+				m.deleted = true
+				qs.deleted++
+			}
+		}
+		qs.door.Unlock()
+		rsp = map[string]interface{}{}
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"__type":"UnknownOperationException"}`))
+		return
+	}
+	json.NewEncoder(w).Encode(rsp)
+}
+
+// Returns up to n visible messages; waits up to wait seconds
+func (qs *sqsServer) receive(r *http.Request, n, wait, vis int) interface{} {
+	if vis == 0 {
+		vis = 1
+	}
+	deadline := time.Now().Add(time.Duration(wait) * time.Second)
+	for {
+		var msgs []map[string]interface{}
+		now := time.Now()
+		qs.door.Lock()
+		for _, m := range qs.msgs {
+			if len(msgs) == n {
+				break
+			}
+			if m.deleted || now.Before(m.visible) {
+				continue
+			}
+			m.visible = now.Add(time.Duration(vis) * time.Second)
+			qs.received[m.id]++
+			m.receipt = fmt.Sprintf("%s-%d", m.id, qs.received[m.id])
+			msgs = append(msgs, map[string]interface{}{
+				"MessageId":         m.id,
+				"ReceiptHandle":     m.receipt,
+				"Body":              m.body,
+				"MessageAttributes": m.attrs,
+			})
+		}
+		qs.door.Unlock()
+		if len(msgs) > 0 || now.After(deadline) || r.Context().Err() != nil {
+			return map[string]interface{}{"Messages": msgs}
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// SNS PublishBatch
+func (qs *sqsServer) publish(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	if r.Form.Get("Action") != "PublishBatch" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`<ErrorResponse><Error><Code>InvalidAction</Code></Error></ErrorResponse>`))
+		return
+	}
+	type member struct {
+		Id          string
+		Code        string
+		SenderFault bool
+	}
+	var rsp struct {
+		XMLName xml.Name `xml:"PublishBatchResponse"`
+		Failed  []member `xml:"PublishBatchResult>Failed>member"`
+	}
+	qs.door.Lock()
+	for i := 1; ; i++ {
+		prefix := fmt.Sprintf("PublishBatchRequestEntries.member.%d.", i)
+		id := r.Form.Get(prefix + "Id")
+		if id == "" {
+			break
+		}
+		msg := r.Form.Get(prefix + "Message")
+		if msg == "poison" {
+			rsp.Failed = append(rsp.Failed, member{Id: id, Code: "InvalidParameter", SenderFault: true})
+			continue
+		}
+		if g := r.Form.Get(prefix + "MessageGroupId"); g != "" {
+			msg = g + ":" + msg
+		}
+		qs.published = append(qs.published, msg)
+	}
+	qs.door.Unlock()
+	xml.NewEncoder(w).Encode(rsp)
+}
+
+// Sends n messages to the queue
+func sendSQS(qs *sqsServer, n int) error {
+	var items []interface{}
+	for i := 1; i <= n; i++ {
+		items = append(items, fmt.Sprintf("job %d", i))
+	}
+	chn := conduit.NewChain(&AnyProducer{items}, nil, NewSQSWriter(qs.config(), "https://queue"), small)
+	if chn.Run() != nil {
+		return errors.New(fmt.Sprintf("cannot send: %v", chn.Errs))
+	}
+	return nil
+}
+
+func sqsBodies(items []interface{}) []string {
+	var bodies []string
+	for _, inp := range items {
+		bodies = append(bodies, inp.(*SQSMsg).Body)
+	}
+	return bodies
+}
+
+// SQS:
+// - Items are sent in batches
+// - Failed messages are retried or sent to the side output
+// - The reader receives and deletes all messages
+func TestSQS(t *testing.T) {
+	qs := newSQSServer()
+	defer qs.srv.Close()
+
+	items := []interface{}{"one", &SQSMsg{Body: "two", MessageAttributes: map[string]string{"kind": "test"}}, "poison", "flaky"}
+	for i := 0; i < 21; i++ {
+		items = append(items, fmt.Sprintf("more %d", i))
+	}
+	failed := &sideCollector{items: make(chan interface{}, 10)}
+	sw := NewSQSWriter(qs.config(), "https://queue").SetRetry(fastRetry)
+	chn := conduit.NewChain(&AnyProducer{items}, nil, sw, small)
+	chn.AddSide(sw, "failed", failed)
+	if err := chn.Run(); err != nil {
+		t.Fatalf("SQSWriter failed: %v", chn.Errs)
+	}
+	f := (<-failed.items).(*FailedRequest)
+	if f.Item != "poison" || f.Attempts != 1 {
+		t.Errorf("SQSWriter: unexpected failed request %+v", f)
+	}
+
+	c := &TakeConsumer{n: len(items) - 1}
+	sr := NewSQSReader(qs.config(), "https://queue").SetWait(time.Second)
+	if err := conduit.NewChain(sr, nil, c, small).Run(); err != nil {
+		t.Fatalf("SQSReader failed: %v", err)
+	}
+	// flaky is sent again after its batch
+	want := []string{"one", "two"}
+	for i := 0; i < 21; i++ {
+		if i == 6 {
+			want = append(want, "flaky")
+		}
+		want = append(want, fmt.Sprintf("more %d", i))
+	}
+	bodies := sqsBodies(c.recvd)
+	if fmt.Sprint(bodies) != fmt.Sprint(want) {
+		t.Errorf("SQSReader: unexpected messages %v", bodies)
+	}
+	if c.recvd[1].(*SQSMsg).MessageAttributes["kind"] != "test" {
+		t.Errorf("SQSReader: message attributes lost: %+v", c.recvd[1])
+	}
+	for i := 0; i < 100 && qs.deletedCount() < len(bodies); i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if qs.deletedCount() != len(bodies) {
+		t.Errorf("SQSReader: %d messages deleted", qs.deletedCount())
+	}
+
+	chn = conduit.NewChain(&AnyProducer{[]interface{}{"poison"}}, nil, NewSQSWriter(qs.config(), "https://queue"), small)
+	if chn.Run() == nil {
+		t.Errorf("SQSWriter: rejected message not reported")
+	}
+}
+
+// SQS with deletion on checkpoints:
+// - Only messages covered by a checkpoint are deleted
+// - After a crash, the other messages are received again
+func TestSQSCheckpoint(t *testing.T) {
+	qs := newSQSServer()
+	defer qs.srv.Close()
+	if err := sendSQS(qs, 300); err != nil {
+		t.Fatalf("SQSWriter: %v", err)
+	}
+
+	cps := conduit.NewMemCheckpoints()
+	newReader := func() *SQSReader {
+		return NewSQSReader(qs.config(), "https://queue").SetWait(time.Second).AckOnCheckpoint()
+	}
+	c := &StopConsumer{n: 250, err: errors.New("crash")}
+	sr := newReader()
+	chn := conduit.NewChain(sr, nil, c, small)
+	chn.SetCheckpoints(time.Millisecond, cps)
+	if chn.Run() == nil {
+		t.Fatalf("SQSReader: chain did not crash")
+	}
+	// the producer is not stopped by the failing consumer
+	sr.Cancel()
+	cp, _ := cps.Latest()
+	if cp == nil {
+		t.Fatalf("SQSReader: no checkpoint taken")
+	}
+	deleted := qs.deletedCount()
+	if deleted != int(cp.Position) {
+		t.Fatalf("SQSReader: checkpoint at %d, deleted %d", cp.Position, deleted)
+	}
+
+	// the other messages become visible again after 1s
+	rest := &StopConsumer{n: 300 - deleted, err: conduit.EOS}
+	chn = conduit.NewChain(newReader(), nil, rest, small)
+	chn.SetCheckpoints(time.Millisecond, cps)
+	if err := chn.Run(); err != nil {
+		t.Fatalf("SQSReader: restarted chain failed: %v", err)
+	}
+	for i, b := range sqsBodies(rest.recvd) {
+		if b != fmt.Sprintf("job %d", deleted+i+1) {
+			t.Fatalf("SQSReader: unexpected message %d after restart: %s", i, b)
+		}
+	}
+}
+
+// Consumer that waits d after the first item
+type LingerConsumer struct {
+	d     time.Duration
+	recvd []interface{}
+}
+
+func (c *LingerConsumer) Consume(src conduit.Source) error {
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			continue
+		}
+		c.recvd = append(c.recvd, inp)
+		time.Sleep(c.d)
+		return conduit.EOS
+	}
+	return nil
+}
+
+// SQS visibility:
+// - The visibility timeout of messages in flight is extended
+func TestSQSVisibility(t *testing.T) {
+	qs := newSQSServer()
+	defer qs.srv.Close()
+	if err := sendSQS(qs, 1); err != nil {
+		t.Fatalf("SQSWriter: %v", err)
+	}
+	sr := NewSQSReader(qs.config(), "https://queue").SetWait(0).SetVisibility(time.Second).AckOnCheckpoint()
+	c := &LingerConsumer{d: 1600 * time.Millisecond}
+	conduit.NewChain(sr, nil, c, small).Run()
+	sr.Cancel()
+	if len(c.recvd) != 1 || qs.redelivered() != 0 {
+		t.Errorf("SQSReader: message redelivered while in flight")
+	}
+}
+
+// SNS:
+// - Items are published in batches with message group
+// - Rejected messages are reported
+func TestSNSPublisher(t *testing.T) {
+	qs := newSQSServer()
+	defer qs.srv.Close()
+
+	var items []interface{}
+	for i := 0; i < 15; i++ {
+		items = append(items, map[string]interface{}{"n": i})
+	}
+	group := func(inp interface{}) string { return fmt.Sprint(inp.(map[string]interface{})["n"].(int) % 2) }
+	sp := NewSNSPublisher(qs.config(), "arn:aws:sns:eu-west-1:123:topic.fifo").SetGroup(group)
+	if err := conduit.NewChain(&AnyProducer{items}, nil, sp, small).Run(); err != nil {
+		t.Fatalf("SNSPublisher failed: %v", err)
+	}
+	published := qs.publishedMsgs()
+	if len(published) != 15 || published[3] != `1:{"n":3}` {
+		t.Errorf("SNSPublisher: unexpected messages %v", published)
+	}
+
+	chn := conduit.NewChain(&AnyProducer{[]interface{}{"poison"}}, nil, NewSNSPublisher(qs.config(), "arn:topic"), small)
+	if chn.Run() == nil {
+		t.Errorf("SNSPublisher: rejected message not reported")
+	}
+}
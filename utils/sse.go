@@ -0,0 +1,450 @@
+package utils
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+// SSEEvent is a Server-Sent Event.
+// Event is the event type ("" for the default type "message").
+type SSEEvent struct {
+	ID    string
+	Event string
+	Data  string
+}
+
+// SSEReader is a Producer that connects to an event stream
+// (text/event-stream) and sends the events as *SSEEvent down the chain.
+// When the connection is lost, SSEReader reconnects
+// after the delay requested by the server (default 3s),
+// sending the ID of the last event as Last-Event-ID.
+// The producer terminates when the server answers with status 204,
+// when the chain is canceled, or with an error on other
+// client errors (4xx) and after too many failed connection attempts
+// (see SetMaxRetries).
+type SSEReader struct {
+	conduit.Cancelable
+	url     string
+	client  *http.Client
+	last    string
+	delay   time.Duration
+	retries int
+	door    sync.Mutex
+	stop    context.CancelFunc
+}
+
+// NewSSEReader creates a new SSEReader Producer.
+func NewSSEReader(url string) (sr *SSEReader) {
+	sr = new(SSEReader)
+	if sr != nil {
+		sr.url = url
+		sr.client = http.DefaultClient
+		sr.delay = 3 * time.Second
+	}
+	return
+}
+
+// SetClient sets the http.Client (default: http.DefaultClient).
+// The client should not have a timeout.
+func (sr *SSEReader) SetClient(c *http.Client) *SSEReader {
+	sr.client = c
+	return sr
+}
+
+// SetLastEventID sets the ID of the event after which
+// the stream shall continue on the first connection.
+func (sr *SSEReader) SetLastEventID(id string) *SSEReader {
+	sr.last = id
+	return sr
+}
+
+// SetReconnectDelay sets the delay before reconnecting
+// until the server requests another one.
+func (sr *SSEReader) SetReconnectDelay(d time.Duration) *SSEReader {
+	sr.delay = d
+	return sr
+}
+
+// SetMaxRetries sets the number of consecutive failed
+// connection attempts after which the producer gives up
+// (default 0: never).
+func (sr *SSEReader) SetMaxRetries(n int) *SSEReader {
+	sr.retries = n
+	return sr
+}
+
+// LastEventID returns the ID of the last event received.
+func (sr *SSEReader) LastEventID() string {
+	sr.door.Lock()
+	defer sr.door.Unlock()
+	return sr.last
+}
+
+// Cancel cancels the producer and closes the connection.
+func (sr *SSEReader) Cancel() {
+	sr.Cancelable.Cancel()
+	sr.door.Lock()
+	defer sr.door.Unlock()
+	if sr.stop != nil {
+		sr.stop()
+	}
+}
+
+// Resume is the pre-defined method that makes SSEReader
+// a conduit.Resumer. After a restart, the stream continues
+// with the events the server sends on the new connection,
+// so nothing is skipped.
+func (sr *SSEReader) Resume(pos uint64) error {
+	return nil
+}
+
+// Produce is the pre-defined method that makes SSEReader a Producer.
+func (sr *SSEReader) Produce(trg conduit.Target) error {
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	sr.door.Lock()
+	sr.stop = stop
+	sr.door.Unlock()
+
+	failures := 0
+	for !sr.Canceled() {
+		connected, err := sr.connect(ctx, trg)
+		if sr.Canceled() {
+			return nil
+		}
+		if err == io.EOF {
+			return nil
+		}
+		var perr permanentError
+		if errors.As(err, &perr) {
+			return perr.err
+		}
+		if connected {
+			failures = 0
+		} else {
+			failures++
+		}
+		if sr.retries > 0 && failures >= sr.retries {
+			return errors.New(fmt.Sprintf("cannot connect to event stream: %v", err))
+		}
+		sleep(sr.delay, sr.Canceled)
+	}
+	return nil
+}
+
+// An error that ends reconnecting
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string { return e.err.Error() }
+
+// Connects and reads events until the connection is lost;
+// tells whether any event was received;
+// io.EOF means that the server does not want us to reconnect
+func (sr *SSEReader) connect(ctx context.Context, trg conduit.Target) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, sr.url, nil)
+	if err != nil {
+		return false, permanentError{err}
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Cache-Control", "no-cache")
+	if id := sr.LastEventID(); id != "" {
+		req.Header.Set("Last-Event-ID", id)
+	}
+	rsp, err := sr.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer rsp.Body.Close()
+	switch {
+	case rsp.StatusCode == http.StatusNoContent:
+		return false, io.EOF
+	case rsp.StatusCode >= 400 && rsp.StatusCode < 500:
+		return false, permanentError{errors.New(rsp.Status)}
+	case rsp.StatusCode != http.StatusOK:
+		return false, errors.New(rsp.Status)
+	}
+	if ct := rsp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/event-stream") {
+		return false, permanentError{errors.New(fmt.Sprintf("unexpected content type %q", ct))}
+	}
+	return sr.read(bufio.NewReader(rsp.Body), trg)
+}
+
+// Parses the event stream
+func (sr *SSEReader) read(rd *bufio.Reader, trg conduit.Target) (bool, error) {
+	received := false
+	var data []string
+	var event string
+	id := sr.LastEventID()
+	for {
+		line, err := rd.ReadString('\n')
+		if err == io.EOF {
+			// connection closed; incomplete events are discarded
+			return received, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return received, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			if data != nil {
+				trg <- &SSEEvent{ID: id, Event: event, Data: strings.Join(data, "\n")}
+				received = true
+			}
+			sr.door.Lock()
+			sr.last = id
+			sr.door.Unlock()
+			data, event = nil, ""
+			continue
+		}
+		if line[0] == ':' {
+			continue
+		}
+		field, value := line, ""
+		if i := strings.IndexByte(line, ':'); i >= 0 {
+			field, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+		}
+		switch field {
+		case "data":
+			data = append(data, value)
+		case "event":
+			event = value
+		case "id":
+			if !strings.ContainsRune(value, 0) {
+				id = value
+			}
+		case "retry":
+			if ms, err := strconv.Atoi(value); err == nil && ms >= 0 {
+				sr.delay = time.Duration(ms) * time.Millisecond
+			}
+		}
+	}
+}
+
+// SSEWriter is a Consumer and an http.Handler
+// that serves the incoming items as event stream to all
+// connected clients. *SSEEvent and SSEEvent items are sent as they are,
+// []byte and string items as data, other items as JSON-encoded data.
+// Events without ID are numbered. The last events are kept
+// (see SetHistory), so that clients reconnecting with Last-Event-ID
+// receive the events they missed. Clients that cannot keep up
+// (see SetClientBuffer) are disconnected.
+// When the stream ends, all clients are disconnected
+// and new clients are answered with status 204,
+// which tells them not to reconnect.
+type SSEWriter struct {
+	door    sync.Mutex
+	clients map[chan *SSEEvent]bool
+	history []*SSEEvent
+	max     int
+	buf     int
+	next    uint64
+	done    bool
+}
+
+// NewSSEWriter creates a new SSEWriter Consumer.
+func NewSSEWriter() (sw *SSEWriter) {
+	sw = new(SSEWriter)
+	if sw != nil {
+		sw.clients = make(map[chan *SSEEvent]bool)
+		sw.max = 100
+		sw.buf = 64
+	}
+	return
+}
+
+// SetHistory sets the number of events kept for clients
+// that reconnect (default 100).
+func (sw *SSEWriter) SetHistory(n int) *SSEWriter {
+	sw.max = n
+	return sw
+}
+
+// SetClientBuffer sets the number of events buffered per client
+// (default 64); clients falling further behind are disconnected.
+func (sw *SSEWriter) SetClientBuffer(n int) *SSEWriter {
+	if n > 0 {
+		sw.buf = n
+	}
+	return sw
+}
+
+// Clients returns the number of connected clients.
+func (sw *SSEWriter) Clients() int {
+	sw.door.Lock()
+	defer sw.door.Unlock()
+	return len(sw.clients)
+}
+
+// Converts an item to an event
+func (sw *SSEWriter) event(inp interface{}) (*SSEEvent, error) {
+	switch x := inp.(type) {
+	case *SSEEvent:
+		ev := *x
+		return &ev, nil
+	case SSEEvent:
+		return &x, nil
+	case []byte:
+		return &SSEEvent{Data: string(x)}, nil
+	case string:
+		return &SSEEvent{Data: x}, nil
+	}
+	b, err := json.Marshal(inp)
+	if err != nil {
+		return nil, err
+	}
+	return &SSEEvent{Data: string(b)}, nil
+}
+
+// Consume is the pre-defined method that makes SSEWriter a Consumer.
+// Consume terminates with an error if an item cannot be encoded.
+func (sw *SSEWriter) Consume(src conduit.Source) error {
+	defer sw.close()
+	sw.door.Lock()
+	sw.done = false
+	sw.door.Unlock()
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			continue
+		}
+		ev, err := sw.event(inp)
+		if err != nil {
+			return err
+		}
+		sw.publish(ev)
+	}
+	return nil
+}
+
+// Sends ev to all clients
+func (sw *SSEWriter) publish(ev *SSEEvent) {
+	sw.door.Lock()
+	defer sw.door.Unlock()
+	sw.next++
+	if ev.ID == "" {
+		ev.ID = strconv.FormatUint(sw.next, 10)
+	}
+	if sw.max > 0 {
+		sw.history = append(sw.history, ev)
+		if len(sw.history) > sw.max {
+			sw.history = sw.history[len(sw.history)-sw.max:]
+		}
+	}
+	for c := range sw.clients {
+		select {
+		case c <- ev:
+		default:
+			delete(sw.clients, c)
+			close(c)
+		}
+	}
+}
+
+// Disconnects all clients
+func (sw *SSEWriter) close() {
+	sw.door.Lock()
+	defer sw.door.Unlock()
+	sw.done = true
+	for c := range sw.clients {
+		delete(sw.clients, c)
+		close(c)
+	}
+}
+
+// Registers a client; returns the events it missed
+func (sw *SSEWriter) subscribe(last string) (chan *SSEEvent, []*SSEEvent) {
+	sw.door.Lock()
+	defer sw.door.Unlock()
+	if sw.done {
+		return nil, nil
+	}
+	c := make(chan *SSEEvent, sw.buf)
+	sw.clients[c] = true
+	if last == "" {
+		return c, nil
+	}
+	for i, ev := range sw.history {
+		if ev.ID == last {
+			return c, append([]*SSEEvent(nil), sw.history[i+1:]...)
+		}
+	}
+	return c, nil
+}
+
+func (sw *SSEWriter) unsubscribe(c chan *SSEEvent) {
+	sw.door.Lock()
+	defer sw.door.Unlock()
+	if sw.clients[c] {
+		delete(sw.clients, c)
+		close(c)
+	}
+}
+
+// Writes an event in the event stream format
+func writeEvent(w io.Writer, ev *SSEEvent) error {
+	var b strings.Builder
+	if ev.ID != "" {
+		fmt.Fprintf(&b, "id: %s\n", ev.ID)
+	}
+	if ev.Event != "" {
+		fmt.Fprintf(&b, "event: %s\n", ev.Event)
+	}
+	for _, line := range strings.Split(ev.Data, "\n") {
+		fmt.Fprintf(&b, "data: %s\n", line)
+	}
+	b.WriteString("\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// ServeHTTP is the pre-defined method that makes SSEWriter
+// an http.Handler.
+func (sw *SSEWriter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	c, missed := sw.subscribe(r.Header.Get("Last-Event-ID"))
+	if c == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	defer sw.unsubscribe(c)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	for _, ev := range missed {
+		if writeEvent(w, ev) != nil {
+			return
+		}
+	}
+	f.Flush()
+	for {
+		select {
+		case ev, ok := <-c:
+			if !ok {
+				return
+			}
+			if writeEvent(w, ev) != nil {
+				return
+			}
+			f.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
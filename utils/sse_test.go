@@ -0,0 +1,166 @@
+package utils
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+// Consumer that stops after n items
+type TakeConsumer struct {
+	n     int
+	recvd []interface{}
+}
+
+func (c *TakeConsumer) Consume(src conduit.Source) error {
+	for inp := range src {
+		c.recvd = append(c.recvd, inp)
+		if len(c.recvd) == c.n {
+			return conduit.EOS
+		}
+	}
+	return nil
+}
+
+// Producer that sends the items from a channel
+type ChanProducer struct {
+	items chan interface{}
+}
+
+func (p *ChanProducer) Produce(trg conduit.Target) error {
+	for inp := range p.items {
+		trg <- inp
+	}
+	return nil
+}
+
+// Formats received events as id/event/data
+func events(recvd []interface{}) string {
+	var evs []string
+	for _, v := range recvd {
+		ev := v.(*SSEEvent)
+		evs = append(evs, fmt.Sprintf("%s/%s/%q", ev.ID, ev.Event, ev.Data))
+	}
+	return fmt.Sprint(evs)
+}
+
+// SSE reader:
+// - Events are parsed (multi-line data, types, IDs, comments)
+// - After a lost connection, the reader reconnects with Last-Event-ID
+// - Status 204 ends the stream
+func TestSSEReader(t *testing.T) {
+	var door sync.Mutex
+	var lastIDs []string
+	conn := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		door.Lock()
+		conn++
+		n := conn
+		lastIDs = append(lastIDs, r.Header.Get("Last-Event-ID"))
+		door.Unlock()
+		switch n {
+		case 1:
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprint(w, ": hello\nretry: 10\n\nid: 1\ndata: first\ndata: line\n\n")
+			fmt.Fprint(w, "id: 2\nevent: update\ndata:second\r\n\r\ndata: incomplete")
+		case 2:
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprint(w, "id: 3\ndata: third\n\n")
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer srv.Close()
+
+	c := new(AnyConsumer)
+	sr := NewSSEReader(srv.URL).SetReconnectDelay(time.Hour)
+	chn := conduit.NewChain(sr, nil, c, small)
+	if chn.Run() != nil {
+		t.Fatalf("SSEReader failed: %v", chn.Errs)
+	}
+	want := `[1//"first\nline" 2/update/"second" 3//"third"]`
+	if events(c.recvd) != want {
+		t.Errorf("SSEReader: expected %s, have %s", want, events(c.recvd))
+	}
+	if fmt.Sprintf("%q", lastIDs) != `["" "2" "3"]` {
+		t.Errorf("SSEReader: unexpected Last-Event-IDs %q", lastIDs)
+	}
+
+	missing := httptest.NewServer(http.NotFoundHandler())
+	defer missing.Close()
+	chn = conduit.NewChain(NewSSEReader(missing.URL), nil, new(AnyConsumer), small)
+	if chn.Run() == nil {
+		t.Errorf("SSEReader: client error not reported")
+	}
+
+	missing.Close()
+	chn = conduit.NewChain(NewSSEReader(missing.URL).SetReconnectDelay(time.Millisecond).SetMaxRetries(2),
+		nil, new(AnyConsumer), small)
+	if chn.Run() == nil {
+		t.Errorf("SSEReader: failed connections not reported")
+	}
+}
+
+// SSE writer:
+// - Items are served to all clients as events
+// - Reconnecting clients receive the events they missed
+// - The end of the stream disconnects the clients
+func TestSSEWriter(t *testing.T) {
+	sw := NewSSEWriter()
+	srv := httptest.NewServer(sw)
+	defer srv.Close()
+
+	items := make(chan interface{})
+	p := &ChanProducer{items}
+	done := make(chan error)
+	go func() {
+		done <- conduit.NewChain(p, nil, sw, small).Run()
+	}()
+
+	readers := make([]*TakeConsumer, 2)
+	results := make(chan error)
+	for i := range readers {
+		readers[i] = &TakeConsumer{n: 3}
+		go func(c *TakeConsumer) {
+			results <- conduit.NewChain(NewSSEReader(srv.URL), nil, c, small).Run()
+		}(readers[i])
+	}
+	for sw.Clients() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	items <- "plain"
+	items <- &SSEEvent{Event: "tick", Data: "a\nb"}
+	items <- map[string]int{"n": 3}
+	for range readers {
+		if err := <-results; err != nil {
+			t.Fatalf("SSEWriter: reader failed: %v", err)
+		}
+	}
+	want := `[1//"plain" 2/tick/"a\nb" 3//"{\"n\":3}"]`
+	for _, c := range readers {
+		if events(c.recvd) != want {
+			t.Errorf("SSEWriter: expected %s, have %s", want, events(c.recvd))
+		}
+	}
+
+	// reconnect after event 1
+	c := &TakeConsumer{n: 2}
+	err := conduit.NewChain(NewSSEReader(srv.URL).SetLastEventID("1"), nil, c, small).Run()
+	if err != nil || events(c.recvd) != `[2/tick/"a\nb" 3//"{\"n\":3}"]` {
+		t.Errorf("SSEWriter: unexpected replay %s: %v", events(c.recvd), err)
+	}
+
+	close(items)
+	if <-done != nil {
+		t.Fatalf("SSEWriter failed")
+	}
+	rsp, err := http.Get(srv.URL)
+	if err != nil || rsp.StatusCode != http.StatusNoContent {
+		t.Errorf("SSEWriter: expected 204 after end of stream")
+	}
+}
@@ -0,0 +1,283 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/toschoo/conduit"
+)
+
+// Compression of t-digests: the number of centroids is about 2*tdDelta
+const tdDelta = 100
+
+type centroid struct {
+	mean, count float64
+}
+
+// tDigest estimates quantiles of a stream of numbers
+// in bounded memory (merging t-digest with scale function k1)
+type tDigest struct {
+	cs    []centroid
+	buf   []centroid
+	total float64
+}
+
+func (td *tDigest) add(x float64) {
+	td.buf = append(td.buf, centroid{x, 1})
+	if len(td.buf) >= 5*tdDelta {
+		td.compress()
+	}
+}
+
+// k1 scale function and its inverse
+func tdK(q float64) float64 {
+	return tdDelta / (2 * math.Pi) * math.Asin(2*q-1)
+}
+
+func tdKInv(k float64) float64 {
+	if k >= tdDelta/4 {
+		return 1
+	}
+	return (math.Sin(2*math.Pi*k/tdDelta) + 1) / 2
+}
+
+// Merges the buffer into the centroids
+func (td *tDigest) compress() {
+	if len(td.buf) == 0 {
+		return
+	}
+	all := append(td.cs, td.buf...)
+	td.buf = td.buf[:0]
+	sort.Slice(all, func(i, j int) bool { return all[i].mean < all[j].mean })
+	n := 0.0
+	for _, c := range all {
+		n += c.count
+	}
+	td.total = n
+	out := make([]centroid, 0, 2*tdDelta)
+	cur, done := all[0], 0.0
+	limit := tdKInv(tdK(0) + 1)
+	for _, c := range all[1:] {
+		if (done+cur.count+c.count)/n <= limit {
+			cur.mean += (c.mean - cur.mean) * c.count / (cur.count + c.count)
+			cur.count += c.count
+			continue
+		}
+		out = append(out, cur)
+		done += cur.count
+		limit = tdKInv(tdK(done/n) + 1)
+		cur = c
+	}
+	td.cs = append(out, cur)
+}
+
+// Estimates the q-quantile by interpolation between centroids
+// and the minimum and maximum of the stream
+func (td *tDigest) quantile(q, min, max float64) float64 {
+	td.compress()
+	switch {
+	case len(td.cs) == 0:
+		return math.NaN()
+	case q <= 0:
+		return min
+	case q >= 1:
+		return max
+	case len(td.cs) == 1:
+		return td.cs[0].mean
+	}
+	target := q * td.total
+	first, last := td.cs[0], td.cs[len(td.cs)-1]
+	if target < first.count/2 {
+		return min + (first.mean-min)*target/(first.count/2)
+	}
+	if target > td.total-last.count/2 {
+		return last.mean + (max-last.mean)*(target-(td.total-last.count/2))/(last.count/2)
+	}
+	cum := first.count / 2
+	for i := 1; i < len(td.cs); i++ {
+		a, b := td.cs[i-1], td.cs[i]
+		step := (a.count + b.count) / 2
+		if target <= cum+step {
+			return a.mean + (b.mean-a.mean)*(target-cum)/step
+		}
+		cum += step
+	}
+	return last.mean
+}
+
+// Summary contains descriptive statistics of numbers:
+// Variance and StdDev are those of the sample;
+// Quantiles maps the configured quantiles to their estimates.
+type Summary struct {
+	Count     uint64
+	Sum       float64
+	Mean      float64
+	Variance  float64
+	StdDev    float64
+	Min, Max  float64
+	Quantiles map[float64]float64
+}
+
+// String formats the summary in one line.
+func (s *Summary) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "count %d, sum %g, mean %g, stddev %g, min %g, max %g",
+		s.Count, s.Sum, s.Mean, s.StdDev, s.Min, s.Max)
+	qs := make([]float64, 0, len(s.Quantiles))
+	for q := range s.Quantiles {
+		qs = append(qs, q)
+	}
+	sort.Float64s(qs)
+	for _, q := range qs {
+		fmt.Fprintf(&b, ", p%g %g", 100*q, s.Quantiles[q])
+	}
+	return b.String()
+}
+
+// Accumulates a Summary (Welford's algorithm for the variance)
+type accumulator struct {
+	n        uint64
+	sum      float64
+	mean, m2 float64
+	min, max float64
+	td       tDigest
+}
+
+func (a *accumulator) add(x float64) {
+	if a.n == 0 || x < a.min {
+		a.min = x
+	}
+	if a.n == 0 || x > a.max {
+		a.max = x
+	}
+	a.n++
+	a.sum += x
+	d := x - a.mean
+	a.mean += d / float64(a.n)
+	a.m2 += d * (x - a.mean)
+	a.td.add(x)
+}
+
+func (a *accumulator) summary(qs []float64) *Summary {
+	s := &Summary{Count: a.n, Sum: a.sum, Mean: a.mean, Min: a.min, Max: a.max,
+		Quantiles: make(map[float64]float64, len(qs))}
+	if a.n > 1 {
+		s.Variance = a.m2 / float64(a.n-1)
+		s.StdDev = math.Sqrt(s.Variance)
+	}
+	if a.n > 0 {
+		for _, q := range qs {
+			s.Quantiles[q] = a.td.quantile(q, a.min, a.max)
+		}
+	}
+	return s
+}
+
+// Stats is a Consumer that computes descriptive statistics
+// (see Summary) of numbers (and numeric strings) or,
+// if fields are given, of the numeric fields of records
+// (Record or map[string]interface{}); missing fields and nil are ignored.
+// Quantiles are estimated in bounded memory by t-digests.
+// Stats terminates with an error on items that are not numbers
+// or records with non-numeric fields.
+// The result is available through Result:
+// a *Summary or, with fields, a map[string]*Summary.
+type Stats struct {
+	fields []string
+	qs     []float64
+	all    *accumulator
+	accs   map[string]*accumulator
+}
+
+// NewStats creates a new Stats Consumer
+// computing statistics of the given fields.
+func NewStats(fields ...string) (s *Stats) {
+	s = new(Stats)
+	if s != nil {
+		s.fields = fields
+		s.qs = []float64{0.5, 0.9, 0.99}
+	}
+	return
+}
+
+// SetQuantiles sets the quantiles to estimate (default: 0.5, 0.9 and 0.99).
+func (s *Stats) SetQuantiles(qs ...float64) *Stats {
+	s.qs = qs
+	return s
+}
+
+// Consume is the pre-defined method that makes Stats a Consumer.
+func (s *Stats) Consume(src conduit.Source) error {
+	s.all = new(accumulator)
+	s.accs = make(map[string]*accumulator)
+	for _, f := range s.fields {
+		s.accs[f] = new(accumulator)
+	}
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			continue
+		}
+		if len(s.fields) == 0 {
+			x, err := toFloat(inp)
+			if err != nil {
+				return err
+			}
+			s.all.add(x)
+			continue
+		}
+		var rec map[string]interface{}
+		switch x := inp.(type) {
+		case Record:
+			rec = x
+		case map[string]interface{}:
+			rec = x
+		default:
+			return errors.New(fmt.Sprintf("cannot compute statistics of %T", inp))
+		}
+		for _, f := range s.fields {
+			v := rec[f]
+			if v == nil {
+				continue
+			}
+			x, err := toFloat(v)
+			if err != nil {
+				return errors.New(fmt.Sprintf("field '%s': %v", f, err))
+			}
+			s.accs[f].add(x)
+		}
+	}
+	return nil
+}
+
+// Volatile is the pre-defined method that makes Stats a conduit.Volatile:
+// the statistics are not included in checkpoints.
+func (s *Stats) Volatile() bool {
+	return true
+}
+
+// Summary returns the statistics of field
+// ("" for numbers) or nil if it was not computed.
+func (s *Stats) Summary(field string) *Summary {
+	if field == "" && len(s.fields) == 0 && s.all != nil {
+		return s.all.summary(s.qs)
+	}
+	if a, ok := s.accs[field]; ok {
+		return a.summary(s.qs)
+	}
+	return nil
+}
+
+// Result returns the statistics.
+func (s *Stats) Result() interface{} {
+	if len(s.fields) == 0 {
+		return s.Summary("")
+	}
+	r := make(map[string]*Summary, len(s.fields))
+	for _, f := range s.fields {
+		r[f] = s.Summary(f)
+	}
+	return r
+}
@@ -0,0 +1,72 @@
+package utils
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/toschoo/conduit"
+)
+
+// Stats:
+// - Count, sum, mean, variance, min and max are exact
+// - Quantiles are estimated closely
+// - Statistics of fields ignore missing fields and nil
+// - Non-numeric items terminate the chain with an error
+func TestStats(t *testing.T) {
+	var items []interface{}
+	for _, i := range rand.Perm(100000) {
+		items = append(items, float64(i))
+	}
+	items = append(items, &conduit.Barrier{})
+	s := NewStats().SetQuantiles(0.01, 0.5, 0.99, 0.999)
+	if err := conduit.NewChain(&AnyProducer{src: items}, nil, s, small).Run(); err != nil {
+		t.Fatalf("Stats failed: %v", err)
+	}
+	var r Result = s
+	sum := r.Result().(*Summary)
+	if sum.Count != 100000 || sum.Sum != 4999950000 || math.Abs(sum.Mean-49999.5) > 1e-6 || sum.Min != 0 || sum.Max != 99999 ||
+		math.Abs(sum.Variance-100000*100001/12.0) > 1 || math.Abs(sum.StdDev-math.Sqrt(sum.Variance)) > 1e-9 {
+		t.Errorf("Stats: unexpected summary %v", sum)
+	}
+	for q, want := range map[float64]float64{0.01: 1000, 0.5: 50000, 0.99: 99000, 0.999: 99900} {
+		// t-digests are most accurate at the tails
+		if got := sum.Quantiles[q]; math.Abs(got-want) > 100+2000*q*(1-q) {
+			t.Errorf("Stats: quantile %v is %v, expected %v", q, got, want)
+		}
+	}
+	if !strings.HasPrefix(sum.String(), "count 100000, sum 4.99995e+09, mean 4999") ||
+		!strings.Contains(sum.String(), ", p1 ") || !strings.Contains(sum.String(), ", p99.9 ") {
+		t.Errorf("Stats: unexpected format %s", sum)
+	}
+
+	items = []interface{}{
+		Record{"ms": 10, "size": "2.5"},
+		map[string]interface{}{"ms": 30.0, "size": nil},
+		Record{"ms": int64(20)},
+	}
+	s = NewStats("ms", "size")
+	if err := conduit.NewChain(&AnyProducer{src: items}, nil, s, small).Run(); err != nil {
+		t.Fatalf("Stats failed: %v", err)
+	}
+	fields := s.Result().(map[string]*Summary)
+	ms, size := fields["ms"], fields["size"]
+	if ms.Count != 3 || ms.Mean != 20 || ms.Variance != 100 || ms.Quantiles[0.5] != 20 ||
+		size.Count != 1 || size.Sum != 2.5 || size.Variance != 0 || size.Quantiles[0.99] != 2.5 {
+		t.Errorf("Stats: unexpected summaries %v, %v", ms, size)
+	}
+	if s.Summary("other") != nil || s.Summary("") != nil {
+		t.Errorf("Stats: unexpected summaries of unknown fields")
+	}
+
+	chn := conduit.NewChain(&AnyProducer{src: []interface{}{1, "x"}}, nil, NewStats(), small)
+	if err := chn.Run(); err == nil || !strings.Contains(fmt.Sprint(chn.Errs), "invalid syntax") {
+		t.Errorf("Stats: expected error: %v", chn.Errs)
+	}
+	chn = conduit.NewChain(&AnyProducer{src: []interface{}{Record{"ms": true}}}, nil, NewStats("ms"), small)
+	if err := chn.Run(); err == nil || !strings.Contains(fmt.Sprint(chn.Errs), "field 'ms': cannot convert bool") {
+		t.Errorf("Stats: expected error: %v", chn.Errs)
+	}
+}
@@ -0,0 +1,659 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+// Layout of RFC 3164 timestamps
+const syslogStamp = "Jan _2 15:04:05"
+
+// Tells whether network is a datagram network
+func packetNetwork(network string) bool {
+	switch network {
+	case "udp", "udp4", "udp6", "unixgram":
+		return true
+	}
+	return false
+}
+
+func streamNetwork(network string) bool {
+	switch network {
+	case "tcp", "tcp4", "tcp6", "unix":
+		return true
+	}
+	return false
+}
+
+// Reads the next space-separated field; "-" is empty
+func syslogField(s string) (string, string) {
+	i := strings.IndexByte(s, ' ')
+	if i < 0 {
+		i = len(s)
+	}
+	f, rest := s[:i], strings.TrimPrefix(s[i:], " ")
+	if f == "-" {
+		f = ""
+	}
+	return f, rest
+}
+
+// Parses structured data ([id name="value" ...]...)
+func parseStructured(s string) (map[string]map[string]string, string, error) {
+	if strings.HasPrefix(s, "-") {
+		return nil, strings.TrimPrefix(s[1:], " "), nil
+	}
+	invalid := errors.New("invalid structured data")
+	sd := make(map[string]map[string]string)
+	for strings.HasPrefix(s, "[") {
+		s = s[1:]
+		i := strings.IndexAny(s, " ]")
+		if i <= 0 {
+			return nil, "", invalid
+		}
+		params := make(map[string]string)
+		sd[s[:i]] = params
+		s = s[i:]
+		for strings.HasPrefix(s, " ") {
+			s = s[1:]
+			j := strings.Index(s, `="`)
+			if j <= 0 {
+				return nil, "", invalid
+			}
+			name := s[:j]
+			s = s[j+2:]
+			var val strings.Builder
+			for {
+				if s == "" {
+					return nil, "", invalid
+				}
+				c := s[0]
+				s = s[1:]
+				if c == '"' {
+					break
+				}
+				if c == '\\' && s != "" && strings.IndexByte(`"\]`, s[0]) >= 0 {
+					c = s[0]
+					s = s[1:]
+				}
+				val.WriteByte(c)
+			}
+			params[name] = val.String()
+		}
+		if !strings.HasPrefix(s, "]") {
+			return nil, "", invalid
+		}
+		s = s[1:]
+	}
+	if len(sd) == 0 {
+		return nil, "", invalid
+	}
+	return sd, strings.TrimPrefix(s, " "), nil
+}
+
+// ParseSyslog parses a syslog message in the format
+// of RFC 5424 or RFC 3164 (BSD syslog) into a Record with
+// the fields facility and severity (int), timestamp (time.Time),
+// hostname, app, procid, msgid (strings, if present),
+// structured (map[string]map[string]string, RFC 5424 only)
+// and message. RFC 3164 timestamps, which have neither
+// year nor timezone, are local times within the last year.
+func ParseSyslog(data []byte) (Record, error) {
+	return parseSyslog(data, time.Local, time.Now())
+}
+
+func parseSyslog(data []byte, loc *time.Location, now time.Time) (Record, error) {
+	s := strings.TrimRight(string(data), "\r\n\x00")
+	end := strings.IndexByte(s, '>')
+	if !strings.HasPrefix(s, "<") || end < 2 || end > 4 {
+		return nil, errors.New("syslog message without priority")
+	}
+	pri, err := strconv.Atoi(s[1:end])
+	if err != nil || pri > 191 {
+		return nil, errors.New("invalid syslog priority " + s[1:end])
+	}
+	r := Record{"facility": pri / 8, "severity": pri % 8}
+	s = s[end+1:]
+	if strings.HasPrefix(s, "1 ") {
+		// RFC 5424
+		var stamp, f string
+		stamp, s = syslogField(s[2:])
+		if stamp != "" {
+			tm, err := time.Parse(time.RFC3339Nano, stamp)
+			if err != nil {
+				return nil, errors.New("invalid syslog timestamp " + stamp)
+			}
+			r["timestamp"] = tm
+		}
+		for _, k := range []string{"hostname", "app", "procid", "msgid"} {
+			if f, s = syslogField(s); f != "" {
+				r[k] = f
+			}
+		}
+		sd, rest, err := parseStructured(s)
+		if err != nil {
+			return nil, err
+		}
+		if sd != nil {
+			r["structured"] = sd
+		}
+		r["message"] = strings.TrimPrefix(rest, "\ufeff")
+		return r, nil
+	}
+	// RFC 3164: the header is optional
+	if len(s) >= len(syslogStamp) {
+		if tm, err := time.ParseInLocation(syslogStamp, s[:len(syslogStamp)], loc); err == nil {
+			tm = tm.AddDate(now.In(loc).Year(), 0, 0)
+			if tm.After(now.Add(24 * time.Hour)) {
+				tm = tm.AddDate(-1, 0, 0)
+			}
+			r["timestamp"] = tm
+			s = strings.TrimPrefix(s[len(syslogStamp):], " ")
+		} else if f, rest := syslogField(s); f != "" {
+			// high-precision timestamps of rsyslog
+			if tm, err := time.Parse(time.RFC3339Nano, f); err == nil {
+				r["timestamp"] = tm
+				s = rest
+			}
+		}
+		if _, ok := r["timestamp"]; ok {
+			var host string
+			if host, s = syslogField(s); host != "" {
+				r["hostname"] = host
+			}
+		}
+	}
+	// tag: app[procid]: message
+	i := strings.IndexAny(s, ":[ ")
+	if i > 0 && i <= 48 {
+		app, rest := s[:i], s[i:]
+		var procid string
+		if strings.HasPrefix(rest, "[") {
+			if j := strings.Index(rest, "]"); j > 0 {
+				procid, rest = rest[1:j], rest[j+1:]
+			}
+		}
+		if strings.HasPrefix(rest, ":") {
+			r["app"] = app
+			if procid != "" {
+				r["procid"] = procid
+			}
+			s = strings.TrimPrefix(rest[1:], " ")
+		}
+	}
+	r["message"] = s
+	return r, nil
+}
+
+// Reads a message framed by octet counting or newlines (RFC 6587)
+func readSyslogFrame(r *bufio.Reader, max int) ([]byte, error) {
+	for {
+		c, err := r.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		if c[0] >= '0' && c[0] <= '9' {
+			n := 0
+			for {
+				b, err := r.ReadByte()
+				if err != nil {
+					return nil, io.ErrUnexpectedEOF
+				}
+				if b == ' ' {
+					break
+				}
+				if b < '0' || b > '9' || n > max {
+					return nil, errors.New("invalid syslog frame")
+				}
+				n = n*10 + int(b-'0')
+			}
+			if n > max {
+				return nil, errors.New(fmt.Sprintf("syslog message of %d bytes exceeds maximum of %d", n, max))
+			}
+			msg := make([]byte, n)
+			if _, err := io.ReadFull(r, msg); err != nil {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return msg, nil
+		}
+		var msg []byte
+		for {
+			line, err := r.ReadSlice('\n')
+			msg = append(msg, line...)
+			if len(msg) > max {
+				return nil, errors.New(fmt.Sprintf("syslog message exceeds maximum of %d bytes", max))
+			}
+			if err == bufio.ErrBufferFull {
+				continue
+			}
+			if err != nil && len(msg) == 0 {
+				return nil, err
+			}
+			break
+		}
+		if msg = bytes.TrimRight(msg, "\r\n"); len(msg) > 0 {
+			return msg, nil
+		}
+	}
+}
+
+// SyslogServer is a Producer that receives syslog messages
+// over UDP, TCP or Unix sockets and sends them as Records
+// (see ParseSyslog) down the chain; the field remote
+// is the address of the sender (if known).
+// On stream sockets, messages are framed by octet counting
+// or by newlines (RFC 6587). Messages that cannot be parsed
+// are sent as message with facility user and severity notice
+// (RFC 3164). The server runs until the chain is canceled.
+type SyslogServer struct {
+	conduit.Cancelable
+	network string
+	addr    string
+	max     int
+	loc     *time.Location
+	door    sync.Mutex
+	pc      net.PacketConn
+	cs      connSet
+}
+
+// NewSyslogServer creates a new SyslogServer Producer
+// listening on addr of network ("udp", "tcp", "unix" or "unixgram").
+func NewSyslogServer(network, addr string) (ss *SyslogServer) {
+	if !packetNetwork(network) && !streamNetwork(network) {
+		return nil
+	}
+	ss = new(SyslogServer)
+	if ss != nil {
+		ss.network = network
+		ss.addr = addr
+		ss.max = 64 * 1024
+		ss.loc = time.Local
+	}
+	return
+}
+
+// SetMaxSize sets the maximum size of a message (default 64KiB).
+// Longer datagrams are truncated,
+// connections sending longer messages are closed.
+func (ss *SyslogServer) SetMaxSize(n int) *SyslogServer {
+	if n > 0 {
+		ss.max = n
+	}
+	return ss
+}
+
+// SetLocation sets the timezone of RFC 3164 timestamps
+// (default: time.Local).
+func (ss *SyslogServer) SetLocation(loc *time.Location) *SyslogServer {
+	if loc != nil {
+		ss.loc = loc
+	}
+	return ss
+}
+
+// Cancel cancels the producer and closes all sockets.
+func (ss *SyslogServer) Cancel() {
+	ss.Cancelable.Cancel()
+	ss.cs.close()
+	ss.door.Lock()
+	defer ss.door.Unlock()
+	if ss.pc != nil {
+		ss.pc.Close()
+	}
+}
+
+// Converts a message to a Record
+func (ss *SyslogServer) record(data []byte, addr net.Addr) Record {
+	r, err := parseSyslog(data, ss.loc, time.Now())
+	if err != nil {
+		r = Record{"facility": 1, "severity": 5, "message": strings.TrimRight(string(data), "\r\n\x00")}
+	}
+	// unnamed Unix sockets are @
+	if addr != nil && addr.String() != "" && addr.String() != "@" {
+		r["remote"] = addr.String()
+	}
+	return r
+}
+
+// Resume is the pre-defined method that makes SyslogServer
+// a conduit.Resumer. Messages received before a restart
+// are not received again, so nothing is skipped.
+func (ss *SyslogServer) Resume(pos uint64) error {
+	return nil
+}
+
+// Produce is the pre-defined method that makes SyslogServer a Producer.
+// Produce terminates with an error if the socket cannot be opened
+// or read.
+func (ss *SyslogServer) Produce(trg conduit.Target) error {
+	if packetNetwork(ss.network) {
+		return ss.receive(trg)
+	}
+	ln, err := net.Listen(ss.network, ss.addr)
+	if err != nil {
+		return err
+	}
+	ss.cs.reset()
+	if !ss.cs.listen(ln) || ss.Canceled() {
+		ln.Close()
+		return nil
+	}
+	for {
+		conn, aerr := ln.Accept()
+		if aerr != nil {
+			if !ss.Canceled() {
+				err = aerr
+			}
+			break
+		}
+		if !ss.cs.add(conn) {
+			conn.Close()
+			break
+		}
+		go ss.serve(conn, trg)
+	}
+	ss.cs.close()
+	ss.cs.wg.Wait()
+	return err
+}
+
+// Receives datagrams
+func (ss *SyslogServer) receive(trg conduit.Target) error {
+	pc, err := net.ListenPacket(ss.network, ss.addr)
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+	ss.door.Lock()
+	ss.pc = pc
+	ss.door.Unlock()
+	buf := make([]byte, ss.max)
+	for !ss.Canceled() {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if ss.Canceled() {
+				break
+			}
+			return err
+		}
+		if n > 0 {
+			trg <- ss.record(buf[:n], addr)
+		}
+	}
+	return nil
+}
+
+// Reads the messages of a connection
+func (ss *SyslogServer) serve(conn net.Conn, trg conduit.Target) {
+	defer ss.cs.remove(conn)
+	r := bufio.NewReader(conn)
+	for {
+		msg, err := readSyslogFrame(r, ss.max)
+		if err != nil {
+			return
+		}
+		trg <- ss.record(msg, conn.RemoteAddr())
+	}
+}
+
+// SyslogWriter is a Consumer that sends incoming items as
+// syslog messages over UDP, TCP or Unix sockets, in the format
+// of RFC 5424 or RFC 3164 (see SetRFC3164).
+// Records (and maps with string keys) are formatted
+// from the fields read by ParseSyslog, so that messages
+// received by a SyslogServer can be forwarded;
+// missing fields are taken from the defaults of the writer.
+// Items of type string and []byte are sent as message.
+// On stream sockets, messages are framed by octet counting
+// (see SetLineFraming). Messages that cannot be sent
+// are sent again according to the RetryPolicy (DefaultRetry)
+// after reconnecting.
+type SyslogWriter struct {
+	network  string
+	addr     string
+	facility int
+	severity int
+	hostname string
+	app      string
+	rfc3164  bool
+	lines    bool
+	timeout  time.Duration
+	retry    RetryPolicy
+	conn     net.Conn
+}
+
+// NewSyslogWriter creates a new SyslogWriter Consumer
+// sending to addr of network ("udp", "tcp", "unix" or "unixgram").
+func NewSyslogWriter(network, addr string) (sw *SyslogWriter) {
+	if !packetNetwork(network) && !streamNetwork(network) {
+		return nil
+	}
+	sw = new(SyslogWriter)
+	if sw != nil {
+		sw.network = network
+		sw.addr = addr
+		sw.facility = 1
+		sw.severity = 5
+		sw.hostname, _ = os.Hostname()
+		sw.app = filepath.Base(os.Args[0])
+		sw.timeout = 10 * time.Second
+		sw.retry = DefaultRetry
+	}
+	return
+}
+
+// SetPriority sets the default facility (0-23, default 1: user)
+// and severity (0-7, default 5: notice).
+func (sw *SyslogWriter) SetPriority(facility, severity int) *SyslogWriter {
+	if facility >= 0 && facility < 24 && severity >= 0 && severity < 8 {
+		sw.facility = facility
+		sw.severity = severity
+	}
+	return sw
+}
+
+// SetHostname sets the default hostname (default: os.Hostname).
+func (sw *SyslogWriter) SetHostname(host string) *SyslogWriter {
+	sw.hostname = host
+	return sw
+}
+
+// SetApp sets the default application name
+// (default: the name of the program).
+func (sw *SyslogWriter) SetApp(app string) *SyslogWriter {
+	sw.app = app
+	return sw
+}
+
+// SetRFC3164 sends messages in the format of RFC 3164 (BSD syslog).
+func (sw *SyslogWriter) SetRFC3164() *SyslogWriter {
+	sw.rfc3164 = true
+	return sw
+}
+
+// SetLineFraming terminates messages on stream sockets
+// with newlines instead of prefixing their length.
+func (sw *SyslogWriter) SetLineFraming() *SyslogWriter {
+	sw.lines = true
+	return sw
+}
+
+// SetDialTimeout sets the timeout for connecting (default 10s).
+func (sw *SyslogWriter) SetDialTimeout(d time.Duration) *SyslogWriter {
+	sw.timeout = d
+	return sw
+}
+
+// SetRetry sets the RetryPolicy (default: DefaultRetry).
+func (sw *SyslogWriter) SetRetry(rp RetryPolicy) *SyslogWriter {
+	sw.retry = rp
+	return sw
+}
+
+// Header field of RFC 5424: printable ASCII of at most n characters
+func syslogHeader(s string, n int) string {
+	b := []byte(s)
+	for i, c := range b {
+		if c <= ' ' || c > '~' {
+			b[i] = '_'
+		}
+	}
+	if len(b) > n {
+		b = b[:n]
+	}
+	if len(b) == 0 {
+		return "-"
+	}
+	return string(b)
+}
+
+// Formats an item as syslog message
+func (sw *SyslogWriter) format(inp interface{}) ([]byte, error) {
+	r := Record{}
+	switch x := inp.(type) {
+	case Record:
+		r = x
+	case map[string]interface{}:
+		r = x
+	case string:
+		r["message"] = x
+	case []byte:
+		r["message"] = string(x)
+	default:
+		return nil, errors.New(fmt.Sprintf("cannot send %T", inp))
+	}
+	str := func(k, def string) string {
+		if v, ok := r[k]; ok && v != nil {
+			return fmt.Sprint(v)
+		}
+		return def
+	}
+	facility, severity := int64(sw.facility), int64(sw.severity)
+	var err error
+	if v, ok := r["facility"]; ok {
+		if facility, err = chInt(v); err != nil || facility < 0 || facility > 23 {
+			return nil, errors.New(fmt.Sprintf("invalid facility %v", v))
+		}
+	}
+	if v, ok := r["severity"]; ok {
+		if severity, err = chInt(v); err != nil || severity < 0 || severity > 7 {
+			return nil, errors.New(fmt.Sprintf("invalid severity %v", v))
+		}
+	}
+	tm, ok := r["timestamp"].(time.Time)
+	if !ok {
+		tm = time.Now()
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "<%d>", facility*8+severity)
+	host, app, procid := str("hostname", sw.hostname), str("app", sw.app), str("procid", "")
+	if sw.rfc3164 {
+		b.WriteString(tm.Local().Format(syslogStamp) + " " + syslogHeader(host, 255) + " ")
+		if app != "" {
+			b.WriteString(syslogHeader(app, 32))
+			if procid != "" {
+				b.WriteString("[" + syslogHeader(procid, 128) + "]")
+			}
+			b.WriteString(": ")
+		}
+		b.WriteString(str("message", ""))
+		return b.Bytes(), nil
+	}
+	b.WriteString("1 " + tm.Format("2006-01-02T15:04:05.000000Z07:00"))
+	b.WriteString(" " + syslogHeader(host, 255) + " " + syslogHeader(app, 48))
+	b.WriteString(" " + syslogHeader(procid, 128) + " " + syslogHeader(str("msgid", ""), 32) + " ")
+	sd, _ := r["structured"].(map[string]map[string]string)
+	if len(sd) == 0 {
+		b.WriteString("-")
+	}
+	ids := make([]string, 0, len(sd))
+	for id := range sd {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	esc := strings.NewReplacer(`"`, `\"`, `\`, `\\`, `]`, `\]`)
+	for _, id := range ids {
+		b.WriteString("[" + syslogHeader(id, 32))
+		names := make([]string, 0, len(sd[id]))
+		for n := range sd[id] {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		for _, n := range names {
+			b.WriteString(" " + syslogHeader(n, 32) + `="` + esc.Replace(sd[id][n]) + `"`)
+		}
+		b.WriteString("]")
+	}
+	if msg := str("message", ""); msg != "" {
+		b.WriteString(" " + msg)
+	}
+	return b.Bytes(), nil
+}
+
+// Consume is the pre-defined method that makes SyslogWriter a Consumer.
+// Consume terminates with an error if an item cannot be formatted
+// or sent after all attempts.
+// The connection is closed at the end of the stream.
+func (sw *SyslogWriter) Consume(src conduit.Source) error {
+	defer sw.close()
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			continue
+		}
+		msg, err := sw.format(inp)
+		if err != nil {
+			return err
+		}
+		if streamNetwork(sw.network) {
+			if sw.lines {
+				msg = append(bytes.Replace(msg, []byte("\n"), []byte(" "), -1), '\n')
+			} else {
+				msg = append([]byte(strconv.Itoa(len(msg))+" "), msg...)
+			}
+		}
+		attempts, err := sw.retry.run(nil, func() (bool, error) {
+			return true, sw.write(msg)
+		})
+		if err != nil {
+			return errors.New(fmt.Sprintf("send failed after %d attempts: %v", attempts, err))
+		}
+	}
+	return nil
+}
+
+// Writes a message, connecting if necessary;
+// the connection is closed on error
+func (sw *SyslogWriter) write(msg []byte) error {
+	if sw.conn == nil {
+		conn, err := net.DialTimeout(sw.network, sw.addr, sw.timeout)
+		if err != nil {
+			return err
+		}
+		sw.conn = conn
+	}
+	_, err := sw.conn.Write(msg)
+	if err != nil {
+		sw.close()
+	}
+	return err
+}
+
+func (sw *SyslogWriter) close() {
+	if sw.conn != nil {
+		sw.conn.Close()
+		sw.conn = nil
+	}
+}
@@ -0,0 +1,156 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+func TestParseSyslog(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	sd := map[string]map[string]string{
+		"exampleSDID@32473":     {"iut": "3", "eventSource": "Application", "eventID": "1011"},
+		"examplePriority@32473": {"class": "high"},
+	}
+	for _, tc := range []struct {
+		msg  string
+		want Record
+	}{
+		{"<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog - ID47 " +
+			`[exampleSDID@32473 iut="3" eventSource="Application" eventID="1011"][examplePriority@32473 class="high"]` +
+			" \xEF\xBB\xBFAn application event log entry...",
+			Record{"facility": 20, "severity": 5, "timestamp": time.Date(2003, 10, 11, 22, 14, 15, 3000000, time.UTC),
+				"hostname": "mymachine.example.com", "app": "evntslog", "msgid": "ID47", "structured": sd,
+				"message": "An application event log entry..."}},
+		{"<34>1 - - - - - -", Record{"facility": 4, "severity": 2, "message": ""}},
+		{`<14>1 - h a 42 - [id a="x\"y\]z\\" b=""] hello` + "\n",
+			Record{"facility": 1, "severity": 6, "hostname": "h", "app": "a", "procid": "42",
+				"structured": map[string]map[string]string{"id": {"a": `x"y]z\`, "b": ""}}, "message": "hello"}},
+		{"<34>Oct 11 22:14:15 mymachine su[123]: 'su root' failed on /dev/pts/8",
+			Record{"facility": 4, "severity": 2, "timestamp": time.Date(2023, 10, 11, 22, 14, 15, 0, time.UTC),
+				"hostname": "mymachine", "app": "su", "procid": "123", "message": "'su root' failed on /dev/pts/8"}},
+		{"<13>Feb  5 01:02:03 host cron: job done",
+			Record{"facility": 1, "severity": 5, "timestamp": time.Date(2024, 2, 5, 1, 2, 3, 0, time.UTC),
+				"hostname": "host", "app": "cron", "message": "job done"}},
+		{"<30>2024-01-02T03:04:05.123+01:00 host app: msg",
+			Record{"facility": 3, "severity": 6, "timestamp": time.Date(2024, 1, 2, 2, 4, 5, 123000000, time.UTC),
+				"hostname": "host", "app": "app", "message": "msg"}},
+		{"<13>hello world", Record{"facility": 1, "severity": 5, "message": "hello world"}},
+		{"<0>myapp: started", Record{"facility": 0, "severity": 0, "app": "myapp", "message": "started"}},
+	} {
+		r, err := parseSyslog([]byte(tc.msg), time.UTC, now)
+		if err != nil {
+			t.Errorf("ParseSyslog: %q failed: %v", tc.msg, err)
+			continue
+		}
+		if tm, ok := r["timestamp"].(time.Time); ok {
+			r["timestamp"] = tm.UTC()
+		}
+		if !reflect.DeepEqual(r, tc.want) {
+			t.Errorf("ParseSyslog: %q:\n%v\nexpected\n%v", tc.msg, r, tc.want)
+		}
+	}
+	for _, msg := range []string{"no priority", "<999>x", "<>x", "<13>1 yesterday h a p m -", "<13>1 - h a p m [broken"} {
+		if _, err := ParseSyslog([]byte(msg)); err == nil {
+			t.Errorf("ParseSyslog: %q accepted", msg)
+		}
+	}
+}
+
+// Syslog over Unix sockets:
+// - Forwarded Records keep their fields
+// - Messages are framed by octet counting or newlines
+// - Unparsable messages are received as notice
+func TestSyslog(t *testing.T) {
+	if NewSyslogServer("ip", "x") != nil || NewSyslogWriter("http", "x") != nil {
+		t.Errorf("Syslog: invalid network accepted")
+	}
+	dir := t.TempDir()
+	for _, network := range []string{"unix", "unixgram"} {
+		path := filepath.Join(dir, network+".sock")
+		c := &TakeConsumer{n: 5}
+		done := make(chan error)
+		go func() {
+			done <- conduit.NewChain(NewSyslogServer(network, path), nil, c, small).Run()
+		}()
+
+		tm := time.Date(2024, 5, 1, 10, 20, 30, 123456000, time.UTC)
+		// RFC 3164 timestamps have no year and no fraction
+		bsd := time.Now().Add(-time.Hour).Truncate(time.Second)
+		items := []interface{}{
+			Record{"facility": 4, "severity": 2, "timestamp": tm, "hostname": "h1", "app": "su", "procid": 7,
+				"msgid": "ID1", "structured": map[string]map[string]string{"x@1": {"k": `a"]`}}, "message": "first\nline"},
+			"plain message",
+			[]byte("bytes"),
+		}
+		sw := NewSyslogWriter(network, path).SetHostname("my host").SetApp("test").SetPriority(3, 6).SetRetry(slowRetry)
+		if err := conduit.NewChain(&AnyProducer{src: items}, nil, sw, small).Run(); err != nil {
+			t.Fatalf("SyslogWriter failed: %v", err)
+		}
+		sw = NewSyslogWriter(network, path).SetHostname("old").SetRFC3164().SetLineFraming()
+		items = []interface{}{Record{"timestamp": bsd, "app": "cron", "procid": "9", "message": "bsd"}}
+		if err := conduit.NewChain(&AnyProducer{src: items}, nil, sw, small).Run(); err != nil {
+			t.Fatalf("SyslogWriter failed: %v", err)
+		}
+		chn := conduit.NewChain(&AnyProducer{src: []interface{}{Record{"severity": 9}}}, nil, NewSyslogWriter(network, path), small)
+		if chn.Run() == nil {
+			t.Errorf("SyslogWriter: invalid severity accepted")
+		}
+		conn, err := net.Dial(network, path)
+		if err != nil {
+			t.Fatalf("Syslog: cannot connect: %v", err)
+		}
+		if network == "unix" {
+			conn.Write([]byte("no priority\n\n"))
+		} else {
+			conn.Write([]byte("no priority"))
+		}
+		conn.Close()
+		if err := <-done; err != nil {
+			t.Fatalf("SyslogServer failed: %v", err)
+		}
+
+		if len(c.recvd) != 5 {
+			t.Fatalf("SyslogServer: %d messages", len(c.recvd))
+		}
+		// messages of different connections may arrive in any order
+		got := make(map[string]Record)
+		for _, inp := range c.recvd {
+			r := inp.(Record)
+			delete(r, "remote")
+			got[fmt.Sprint(r["message"])] = r
+		}
+		want := []Record{
+			{"facility": 4, "severity": 2, "timestamp": tm, "hostname": "h1", "app": "su", "procid": "7",
+				"msgid": "ID1", "structured": map[string]map[string]string{"x@1": {"k": `a"]`}}, "message": "first\nline"},
+			{"facility": 3, "severity": 6, "hostname": "my_host", "app": "test", "message": "plain message"},
+			{"facility": 3, "severity": 6, "hostname": "my_host", "app": "test", "message": "bytes"},
+			{"facility": 1, "severity": 5, "hostname": "old", "app": "cron", "procid": "9", "message": "bsd",
+				"timestamp": bsd.UTC()},
+			{"facility": 1, "severity": 5, "message": "no priority"},
+		}
+		for _, w := range want {
+			r, ok := got[fmt.Sprint(w["message"])]
+			if !ok {
+				t.Errorf("Syslog (%s): %q not received", network, w["message"])
+				continue
+			}
+			if _, ok := w["timestamp"]; !ok {
+				if _, ok := r["timestamp"].(time.Time); !ok && w["message"] != "no priority" {
+					t.Errorf("Syslog (%s): no timestamp in %v", network, r)
+				}
+				delete(r, "timestamp")
+			} else if tm, ok := r["timestamp"].(time.Time); ok {
+				r["timestamp"] = tm.UTC()
+			}
+			if !reflect.DeepEqual(r, w) {
+				t.Errorf("Syslog (%s):\n%v\nexpected\n%v", network, r, w)
+			}
+		}
+	}
+}
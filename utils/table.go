@@ -0,0 +1,278 @@
+package utils
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/toschoo/conduit"
+)
+
+// Table is a Consumer that prints incoming rows
+// as a table with aligned columns, e.g. for command line tools.
+// Rows are []string, []interface{}, Record, map[string]interface{}
+// or map[string]string; the columns of maps are given
+// by SetColumns or, by default, the sorted keys of the first row.
+// By default, all rows are collected and printed at the end;
+// in streaming mode, the column widths are determined
+// by the first rows and later rows are printed as they arrive.
+type Table struct {
+	wt     io.Writer
+	cols   []string
+	border bool
+	max    int
+	limit  int
+	stream int
+}
+
+// NewTable creates a new Table Consumer.
+func NewTable(w io.Writer) (tb *Table) {
+	tb = new(Table)
+	if tb != nil {
+		tb.wt = w
+	}
+	return
+}
+
+// SetColumns sets the column names printed as header
+// and used to select the fields of maps.
+func (tb *Table) SetColumns(names ...string) *Table {
+	tb.cols = names
+	return tb
+}
+
+// Border draws lines around and between the columns.
+func (tb *Table) Border() *Table {
+	tb.border = true
+	return tb
+}
+
+// SetMaxWidth truncates cells to n characters.
+func (tb *Table) SetMaxWidth(n int) *Table {
+	tb.max = n
+	return tb
+}
+
+// SetLimit prints at most n rows
+// followed by the number of rows omitted.
+func (tb *Table) SetLimit(n int) *Table {
+	tb.limit = n
+	return tb
+}
+
+// Stream prints rows as they arrive, using the first n rows
+// to determine the column widths; wider cells in later rows
+// are truncated.
+func (tb *Table) Stream(n int) *Table {
+	tb.stream = n
+	return tb
+}
+
+// Consume is the pre-defined method that makes Table a Consumer.
+// Consume terminates with an error if a row has an unsupported type.
+func (tb *Table) Consume(src conduit.Source) error {
+	w := bufio.NewWriter(tb.wt)
+	cols := tb.cols
+	var rows [][]string
+	var widths []int
+	printed := 0
+	omitted := 0
+	started := false
+
+	start := func() {
+		widths = tb.widths(cols, rows)
+		if tb.border {
+			tb.line(w, widths)
+		}
+		if cols != nil {
+			tb.row(w, widths, cols)
+			if tb.border {
+				tb.line(w, widths)
+			}
+		}
+		started = true
+	}
+	emit := func(row []string) {
+		if tb.limit > 0 && printed >= tb.limit {
+			omitted++
+			return
+		}
+		tb.row(w, widths, row)
+		printed++
+	}
+
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			if started {
+				err := w.Flush()
+				if err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if cols == nil {
+			cols = tableColumns(inp)
+		}
+		row, err := tableRow(cols, inp)
+		if err != nil {
+			return err
+		}
+		if started {
+			emit(row)
+			continue
+		}
+		rows = append(rows, row)
+		if tb.stream > 0 && len(rows) >= tb.stream {
+			start()
+			for _, r := range rows {
+				emit(r)
+			}
+			rows = nil
+		}
+	}
+	if !started {
+		start()
+		for _, r := range rows {
+			emit(r)
+		}
+	}
+	if tb.border {
+		tb.line(w, widths)
+	}
+	if omitted > 0 {
+		fmt.Fprintf(w, "(%d more rows)\n", omitted)
+	}
+	return w.Flush()
+}
+
+// Computes the column widths
+func (tb *Table) widths(cols []string, rows [][]string) []int {
+	var widths []int
+	measure := func(row []string) {
+		for i, cell := range row {
+			n := utf8.RuneCountInString(cell)
+			if tb.max > 0 && n > tb.max {
+				n = tb.max
+			}
+			if i >= len(widths) {
+				widths = append(widths, n)
+			} else if n > widths[i] {
+				widths[i] = n
+			}
+		}
+	}
+	measure(cols)
+	for _, row := range rows {
+		measure(row)
+	}
+	return widths
+}
+
+// Prints a horizontal border line
+func (tb *Table) line(w io.Writer, widths []int) {
+	var b strings.Builder
+	for _, n := range widths {
+		b.WriteString("+")
+		b.WriteString(strings.Repeat("-", n+2))
+	}
+	b.WriteString("+\n")
+	io.WriteString(w, b.String())
+}
+
+// Prints one row
+func (tb *Table) row(w io.Writer, widths []int, row []string) {
+	var b strings.Builder
+	for i, n := range widths {
+		cell := ""
+		if i < len(row) {
+			cell = truncate(row[i], n)
+		}
+		pad := strings.Repeat(" ", n-utf8.RuneCountInString(cell))
+		if tb.border {
+			b.WriteString("| " + cell + pad + " ")
+		} else if i < len(widths)-1 {
+			b.WriteString(cell + pad + "  ")
+		} else {
+			b.WriteString(cell)
+		}
+	}
+	if tb.border {
+		b.WriteString("|")
+	}
+	b.WriteString("\n")
+	io.WriteString(w, b.String())
+}
+
+// Truncates s to n characters, marking the truncation with "…"
+func truncate(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	if n <= 0 {
+		return ""
+	}
+	r := []rune(s)
+	return string(r[:n-1]) + "…"
+}
+
+// Derives the columns from the first row
+func tableColumns(inp interface{}) []string {
+	switch x := inp.(type) {
+	case Record:
+		return x.Keys()
+	case map[string]interface{}:
+		return Record(x).Keys()
+	case map[string]string:
+		keys := make([]string, 0, len(x))
+		for k := range x {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		return keys
+	}
+	return nil
+}
+
+// Converts an item to a row
+func tableRow(cols []string, inp interface{}) ([]string, error) {
+	switch x := inp.(type) {
+	case []string:
+		return x, nil
+	case []interface{}:
+		row := make([]string, len(x))
+		for i, v := range x {
+			row[i] = tableCell(v)
+		}
+		return row, nil
+	case Record:
+		return tableRow(cols, map[string]interface{}(x))
+	case map[string]interface{}:
+		row := make([]string, len(cols))
+		for i, c := range cols {
+			if v, ok := x[c]; ok {
+				row[i] = tableCell(v)
+			}
+		}
+		return row, nil
+	case map[string]string:
+		row := make([]string, len(cols))
+		for i, c := range cols {
+			row[i] = x[c]
+		}
+		return row, nil
+	}
+	return nil, errors.New(fmt.Sprintf("cannot print %T as table row", inp))
+}
+
+// Formats a cell; line breaks are replaced by spaces
+func tableCell(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	return strings.NewReplacer("\r\n", " ", "\n", " ", "\t", " ").Replace(fmt.Sprint(v))
+}
@@ -0,0 +1,71 @@
+package utils
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/toschoo/conduit"
+)
+
+// Tables:
+// - Records are printed with aligned columns and a derived header
+// - Borders, truncation and row limits are applied
+// - Streaming tables truncate cells wider than the first rows
+func TestTable(t *testing.T) {
+	recs := []interface{}{
+		Record{"name": "alice", "age": 30},
+		Record{"name": "bob", "age": 4, "city": "Berlin"},
+		Record{"name": "charlotte-amalie", "age": nil},
+	}
+
+	var out bytes.Buffer
+	chn := conduit.NewChain(&AnyProducer{recs}, nil, NewTable(&out), small)
+	err := chn.Run()
+	if err != nil {
+		t.Fatalf("Table failed: %v", chn.Errs)
+	}
+	want := "age  name\n" +
+		"30   alice\n" +
+		"4    bob\n" +
+		"     charlotte-amalie\n"
+	if out.String() != want {
+		t.Errorf("Table: expected\n%s\nhave\n%s", want, out.String())
+	}
+
+	out.Reset()
+	tb := NewTable(&out).SetColumns("name", "city").Border().SetMaxWidth(8).SetLimit(2)
+	chn = conduit.NewChain(&AnyProducer{recs}, nil, tb, small)
+	err = chn.Run()
+	if err != nil {
+		t.Fatalf("Table failed: %v", chn.Errs)
+	}
+	want = "+----------+--------+\n" +
+		"| name     | city   |\n" +
+		"+----------+--------+\n" +
+		"| alice    |        |\n" +
+		"| bob      | Berlin |\n" +
+		"+----------+--------+\n" +
+		"(1 more rows)\n"
+	if out.String() != want {
+		t.Errorf("Table: expected\n%s\nhave\n%s", want, out.String())
+	}
+
+	out.Reset()
+	rows := []interface{}{[]string{"a", "b"}, []string{"ccc", "d"}, []string{"eeeee", "f"}}
+	chn = conduit.NewChain(&AnyProducer{rows}, nil, NewTable(&out).Stream(2), small)
+	err = chn.Run()
+	if err != nil {
+		t.Fatalf("Table failed: %v", chn.Errs)
+	}
+	want = "a    b\n" +
+		"ccc  d\n" +
+		"ee…  f\n"
+	if out.String() != want {
+		t.Errorf("Table: expected\n%s\nhave\n%s", want, out.String())
+	}
+
+	chn = conduit.NewChain(&AnyProducer{[]interface{}{42}}, nil, NewTable(new(bytes.Buffer)), small)
+	if chn.Run() == nil {
+		t.Errorf("Table: invalid row not reported")
+	}
+}
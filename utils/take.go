@@ -0,0 +1,174 @@
+package utils
+
+import (
+	"github.com/toschoo/conduit"
+)
+
+// Take is a Conduit that sends the first n items
+// down the chain and then terminates with conduit.EOS,
+// which cancels the components upstream.
+type Take struct {
+	n int
+}
+
+// NewTake creates a new Take Conduit.
+func NewTake(n int) (tk *Take) {
+	tk = new(Take)
+	if tk != nil {
+		tk.n = n
+	}
+	return
+}
+
+// NewLimit is an alias for NewTake.
+func NewLimit(n int) *Take {
+	return NewTake(n)
+}
+
+// Conduct is the pre-defined method that makes Take a Conduit.
+func (tk *Take) Conduct(src conduit.Source, trg conduit.Target) error {
+	if tk.n <= 0 {
+		return conduit.EOS
+	}
+	i := 0
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			trg <- inp
+			continue
+		}
+		trg <- inp
+		i++
+		if i >= tk.n {
+			return conduit.EOS
+		}
+	}
+	return nil
+}
+
+// Volatile is the pre-defined method that makes Take a conduit.Volatile:
+// the number of items sent is not included in checkpoints.
+func (tk *Take) Volatile() bool {
+	return true
+}
+
+// Skip is a Conduit that drops the first n items
+// and sends all others down the chain.
+type Skip struct {
+	n int
+}
+
+// NewSkip creates a new Skip Conduit.
+func NewSkip(n int) (sk *Skip) {
+	sk = new(Skip)
+	if sk != nil {
+		sk.n = n
+	}
+	return
+}
+
+// Conduct is the pre-defined method that makes Skip a Conduit.
+func (sk *Skip) Conduct(src conduit.Source, trg conduit.Target) error {
+	i := 0
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			trg <- inp
+			continue
+		}
+		if i < sk.n {
+			i++
+			continue
+		}
+		trg <- inp
+	}
+	return nil
+}
+
+// Volatile is the pre-defined method that makes Skip a conduit.Volatile:
+// the number of items dropped is not included in checkpoints.
+func (sk *Skip) Volatile() bool {
+	return true
+}
+
+// TakeWhile is a Conduit that sends items down the chain
+// as long as they pass a Sieve. It terminates
+// with conduit.EOS at the first item that does not pass,
+// which cancels the components upstream,
+// e.g. to process a time range of sorted input.
+type TakeWhile struct {
+	sv Sieve
+}
+
+// NewTakeWhile creates a new TakeWhile Conduit.
+func NewTakeWhile(sv Sieve) (tw *TakeWhile) {
+	if sv == nil {
+		return nil
+	}
+	tw = new(TakeWhile)
+	if tw != nil {
+		tw.sv = sv
+	}
+	return
+}
+
+// Conduct is the pre-defined method that makes TakeWhile a Conduit.
+func (tw *TakeWhile) Conduct(src conduit.Source, trg conduit.Target) error {
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			trg <- inp
+			continue
+		}
+		if !tw.sv.Sieve(inp) {
+			return conduit.EOS
+		}
+		trg <- inp
+	}
+	return nil
+}
+
+// Volatile is the pre-defined method that makes TakeWhile a conduit.Volatile:
+// whether the predicate has failed is not included in checkpoints.
+func (tw *TakeWhile) Volatile() bool {
+	return true
+}
+
+// DropWhile is a Conduit that drops items
+// as long as they pass a Sieve. From the first item
+// that does not pass on, all items are sent down the chain.
+type DropWhile struct {
+	sv Sieve
+}
+
+// NewDropWhile creates a new DropWhile Conduit.
+func NewDropWhile(sv Sieve) (dw *DropWhile) {
+	if sv == nil {
+		return nil
+	}
+	dw = new(DropWhile)
+	if dw != nil {
+		dw.sv = sv
+	}
+	return
+}
+
+// Conduct is the pre-defined method that makes DropWhile a Conduit.
+func (dw *DropWhile) Conduct(src conduit.Source, trg conduit.Target) error {
+	dropping := true
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			trg <- inp
+			continue
+		}
+		if dropping && dw.sv.Sieve(inp) {
+			continue
+		}
+		dropping = false
+		trg <- inp
+	}
+	return nil
+}
+
+// Volatile is the pre-defined method that makes DropWhile a conduit.Volatile:
+// whether the predicate has failed is not included in checkpoints.
+func (dw *DropWhile) Volatile() bool {
+	return true
+}
@@ -0,0 +1,232 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"testing"
+
+	"github.com/toschoo/conduit"
+)
+
+// generates 0, 1, 2, ... without end
+type Naturals struct {
+	n int32
+}
+
+func (g *Naturals) Generate() (interface{}, error) {
+	return int(atomic.AddInt32(&g.n, 1) - 1), nil
+}
+
+// generates 0..max-1
+type Upto struct {
+	n, max int
+}
+
+func (g *Upto) Generate() (interface{}, error) {
+	if g.n >= g.max {
+		return nil, io.EOF
+	}
+	g.n++
+	return g.n - 1, nil
+}
+
+// Take:
+// - It is processed without errors
+// - The first n items are sent down the chain
+// - An infinite producer is canceled
+// - The chain can be run again
+func TestTakeChain(t *testing.T) {
+	for i := 0; i < numOfTests; i++ {
+		err := testTakeChain(i)
+		if err != nil {
+			m := fmt.Sprintf("TakeChain failed: %v", err)
+			t.Error(m)
+		}
+	}
+}
+
+func testTakeChain(n int) error {
+
+	g := new(Naturals)
+	p := NewGeneric(g)
+	c := new(BaseConsumer)
+
+	pipe := []conduit.Conduit{NewIdentity(), NewLimit(n), NewIdentity()}
+	chn := conduit.NewChain(p, pipe, c, small)
+
+	for k := 0; k < 2; k++ {
+		c.recvd = nil
+		atomic.StoreInt32(&g.n, 0)
+		err := chn.Run()
+		if err != nil {
+			m := fmt.Sprintf("error on running chain: %v", err)
+			return errors.New(m)
+		}
+		if len(c.recvd) != n {
+			m := fmt.Sprintf("expected %d items, have %d", n, len(c.recvd))
+			return errors.New(m)
+		}
+		for i := range c.recvd {
+			if c.recvd[i] != i {
+				return errors.New("Received values differ from original!")
+			}
+		}
+	}
+	return nil
+}
+
+// Skip:
+// - It is processed without errors
+// - All but the first n items are sent down the chain
+func TestSkipChain(t *testing.T) {
+	for i := 0; i < numOfTests; i++ {
+		err := testSkipChain(numOfData, i+i%3)
+		if err != nil {
+			m := fmt.Sprintf("SkipChain failed: %v", err)
+			t.Error(m)
+		}
+	}
+}
+
+func testSkipChain(max, n int) error {
+
+	p := NewGeneric(&Upto{max: max})
+	c := new(BaseConsumer)
+
+	chn := conduit.NewChain(p, []conduit.Conduit{NewSkip(n)}, c, small)
+
+	err := chn.Run()
+	if err != nil {
+		m := fmt.Sprintf("error on running chain: %v", err)
+		return errors.New(m)
+	}
+	expected := max - n
+	if expected < 0 {
+		expected = 0
+	}
+	if len(c.recvd) != expected {
+		m := fmt.Sprintf("expected %d items, have %d", expected, len(c.recvd))
+		return errors.New(m)
+	}
+	for i := range c.recvd {
+		if c.recvd[i] != n+i {
+			return errors.New("Received values differ from original!")
+		}
+	}
+	return nil
+}
+
+// Consumer returning EOS:
+// - EOS is not reported as error
+// - An infinite producer is canceled
+func TestEOSConsumer(t *testing.T) {
+	p := NewGeneric(new(Naturals))
+	c := NewFold(0, sum)
+	eos := conduit.Consumer(&takeConsumer{c, numOfData})
+	chn := conduit.NewChain(p, nil, eos, small)
+	err := chn.Run()
+	if err != nil {
+		t.Fatalf("EOSConsumer failed: %v", chn.Errs)
+	}
+	expected := numOfData * (numOfData - 1) / 2
+	if c.Result().(int) != expected {
+		t.Errorf("EOSConsumer: expected %d, have %v", expected, c.Result())
+	}
+}
+
+// passes n items to a Fold and returns EOS
+type takeConsumer struct {
+	fd *Fold
+	n  int
+}
+
+func (c *takeConsumer) Consume(src conduit.Source) error {
+	ch := make(chan interface{})
+	done := make(chan error)
+	go func() {
+		done <- c.fd.Consume(ch)
+	}()
+	i := 0
+	for inp := range src {
+		ch <- inp
+		i++
+		if i >= c.n {
+			break
+		}
+	}
+	close(ch)
+	<-done
+	return conduit.EOS
+}
+
+func below(n int) Sieve {
+	return SieveFunc(func(inp interface{}) bool {
+		return inp.(int) < n
+	})
+}
+
+// TakeWhile and DropWhile:
+// - They are processed without errors
+// - TakeWhile sends the prefix passing the Sieve
+//   and cancels an infinite producer
+// - DropWhile sends everything after that prefix,
+//   even items passing the Sieve
+func TestTakeDropWhileChain(t *testing.T) {
+	for i := 0; i < numOfTests; i++ {
+		err := testTakeDropWhileChain(numOfData, i)
+		if err != nil {
+			m := fmt.Sprintf("TakeDropWhileChain failed: %v", err)
+			t.Error(m)
+		}
+	}
+}
+
+func testTakeDropWhileChain(max, n int) error {
+
+	c := new(BaseConsumer)
+	pipe := []conduit.Conduit{NewTakeWhile(below(n))}
+	chn := conduit.NewChain(NewGeneric(new(Naturals)), pipe, c, small)
+
+	err := chn.Run()
+	if err != nil {
+		m := fmt.Sprintf("error on running chain: %v", err)
+		return errors.New(m)
+	}
+	if len(c.recvd) != n {
+		m := fmt.Sprintf("TakeWhile: expected %d items, have %d", n, len(c.recvd))
+		return errors.New(m)
+	}
+	for i := range c.recvd {
+		if c.recvd[i] != i {
+			return errors.New("Received values differ from original!")
+		}
+	}
+
+	// 0..max-1, 0..max-1
+	seq := append(makeSeq(max), makeSeq(max)...)
+	c = new(BaseConsumer)
+	pipe = []conduit.Conduit{NewDropWhile(below(n))}
+	chn = conduit.NewChain(&SeqProducer{seq}, pipe, c, small)
+
+	err = chn.Run()
+	if err != nil {
+		m := fmt.Sprintf("error on running chain: %v", err)
+		return errors.New(m)
+	}
+	skip := n
+	if skip > max {
+		skip = 2 * max
+	}
+	if len(c.recvd) != len(seq)-skip {
+		m := fmt.Sprintf("DropWhile: expected %d items, have %d", len(seq)-skip, len(c.recvd))
+		return errors.New(m)
+	}
+	for i := range c.recvd {
+		if c.recvd[i] != seq[skip+i] {
+			return errors.New("Received values differ from original!")
+		}
+	}
+	return nil
+}
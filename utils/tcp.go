@@ -0,0 +1,445 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+// ConnError is the error of a connection,
+// sent by TCPServer to the side output "errors".
+type ConnError struct {
+	Addr net.Addr
+	Err  error
+}
+
+// Open connections of a server
+type connSet struct {
+	door   sync.Mutex
+	ln     net.Listener
+	conns  map[net.Conn]bool
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// Reopens the set after close
+func (cs *connSet) reset() {
+	cs.door.Lock()
+	defer cs.door.Unlock()
+	cs.closed = false
+}
+
+// Registers the listener; false if the set is already closed
+func (cs *connSet) listen(ln net.Listener) bool {
+	cs.door.Lock()
+	defer cs.door.Unlock()
+	cs.ln = ln
+	cs.conns = make(map[net.Conn]bool)
+	return !cs.closed
+}
+
+// Registers a connection; false if the set is already closed
+func (cs *connSet) add(conn net.Conn) bool {
+	cs.door.Lock()
+	defer cs.door.Unlock()
+	if cs.closed {
+		return false
+	}
+	cs.conns[conn] = true
+	cs.wg.Add(1)
+	return true
+}
+
+func (cs *connSet) remove(conn net.Conn) {
+	cs.door.Lock()
+	delete(cs.conns, conn)
+	cs.door.Unlock()
+	conn.Close()
+	cs.wg.Done()
+}
+
+// Closes the listener and all connections
+func (cs *connSet) close() {
+	cs.door.Lock()
+	defer cs.door.Unlock()
+	cs.closed = true
+	if cs.ln != nil {
+		cs.ln.Close()
+	}
+	for conn := range cs.conns {
+		conn.Close()
+	}
+}
+
+func (cs *connSet) isClosed() bool {
+	cs.door.Lock()
+	defer cs.door.Unlock()
+	return cs.closed
+}
+
+// Consumer that forwards the items of a connection chain
+type forwarder struct {
+	trg conduit.Target
+}
+
+func (fw *forwarder) Consume(src conduit.Source) error {
+	for inp := range src {
+		fw.trg <- inp
+	}
+	return nil
+}
+
+// TCPServer is a Producer that accepts TCP connections
+// and sends the data received on them down the chain.
+// Each connection is read by a chain of its own
+// whose output is sent down the main chain.
+// By default, this chain sends the data in []byte blocks
+// as they arrive (see NewReader), so that blocks of different
+// connections are interleaved at arbitrary positions;
+// to receive complete messages, create the chain
+// with a Deframer (see SetPipe).
+// Connections whose chain fails are closed;
+// the errors are sent as ConnError to the side output "errors"
+// (see conduit.SideOutputter) if it is connected.
+// The server runs until the chain is canceled;
+// it then closes the listener and all connections.
+// TCPServer also serves Unix stream sockets (see NewUnixServer).
+type TCPServer struct {
+	conduit.Cancelable
+	network string
+	addr    string
+	ln      net.Listener
+	pipe    func(conn net.Conn) []conduit.Conduit
+	sz      uint32
+	side    conduit.Target
+	cs      connSet
+}
+
+// NewTCPServer creates a new TCPServer Producer listening on addr.
+func NewTCPServer(addr string) (ts *TCPServer) {
+	ts = new(TCPServer)
+	if ts != nil {
+		ts.network = "tcp"
+		ts.addr = addr
+		ts.sz = 128
+	}
+	return
+}
+
+// NewTCPServerOn creates a new TCPServer Producer
+// accepting connections on the listener ln, which is closed at shutdown.
+func NewTCPServerOn(ln net.Listener) (ts *TCPServer) {
+	if ln == nil {
+		return nil
+	}
+	ts = NewTCPServer(ln.Addr().String())
+	if ts != nil {
+		ts.ln = ln
+	}
+	return
+}
+
+// SetPipe sets the function creating the conduits
+// of the chain for a connection (which may return nil).
+func (ts *TCPServer) SetPipe(pipe func(conn net.Conn) []conduit.Conduit) *TCPServer {
+	ts.pipe = pipe
+	return ts
+}
+
+// SetBufferSize sets the buffer size of the connection chains
+// (default 128).
+func (ts *TCPServer) SetBufferSize(sz uint32) *TCPServer {
+	ts.sz = sz
+	return ts
+}
+
+// SideOutput is the pre-defined method that makes TCPServer
+// a conduit.SideOutputter. TCPServer has the side output "errors".
+func (ts *TCPServer) SideOutput(name string, trg conduit.Target) {
+	if name == "errors" {
+		ts.side = trg
+	}
+}
+
+// Cancel cancels the producer and closes all connections.
+func (ts *TCPServer) Cancel() {
+	ts.Cancelable.Cancel()
+	ts.cs.close()
+}
+
+// Resume is the pre-defined method that makes TCPServer
+// a conduit.Resumer. Data received before a restart
+// are not received again, so nothing is skipped.
+func (ts *TCPServer) Resume(pos uint64) error {
+	return nil
+}
+
+// Produce is the pre-defined method that makes TCPServer a Producer.
+// Produce terminates with an error if the server cannot listen
+// or accept connections.
+func (ts *TCPServer) Produce(trg conduit.Target) error {
+	ln := ts.ln
+	if ln == nil {
+		var err error
+		ln, err = net.Listen(ts.network, ts.addr)
+		if err != nil {
+			return err
+		}
+	}
+	ts.cs.reset()
+	if !ts.cs.listen(ln) || ts.Canceled() {
+		ln.Close()
+		return nil
+	}
+	var err error
+	for {
+		conn, aerr := ln.Accept()
+		if aerr != nil {
+			if !ts.Canceled() {
+				err = aerr
+			}
+			break
+		}
+		if !ts.cs.add(conn) {
+			conn.Close()
+			break
+		}
+		go ts.serve(conn, trg)
+	}
+	ts.cs.close()
+	ts.cs.wg.Wait()
+	return err
+}
+
+// Runs the chain of a connection
+func (ts *TCPServer) serve(conn net.Conn, trg conduit.Target) {
+	defer ts.cs.remove(conn)
+	var pipe []conduit.Conduit
+	if ts.pipe != nil {
+		pipe = ts.pipe(conn)
+	}
+	chn := conduit.NewChain(NewReader(conn), pipe, &forwarder{trg}, ts.sz)
+	err := chn.Run()
+	if err == nil || ts.cs.isClosed() || ts.side == nil {
+		return
+	}
+	ts.side <- &ConnError{Addr: conn.RemoteAddr(), Err: err}
+}
+
+// TCPChainServer serves TCP connections with a chain
+// per connection: the producer reads from the connection,
+// the conduits process the data and the consumer writes
+// the results back to the connection, e.g. an echo server
+// or, with Deframer and Framer, a request-response server.
+// Since components have state, they are created anew
+// for each connection. By default, the connection is read
+// in []byte blocks (see NewReader) and []byte and string items
+// are written to it as they are. The connection is closed
+// when the chain terminates. Serve accepts any stream listener,
+// e.g. on a Unix socket (see ListenAndServeUnix).
+type TCPChainServer struct {
+	pipe func(conn net.Conn) []conduit.Conduit
+	prod func(r io.Reader) conduit.Producer
+	cons func(w io.Writer) conduit.Consumer
+	sz   uint32
+	cs   connSet
+}
+
+// NewTCPChainServer creates a new TCPChainServer
+// with the conduits created by pipe (which may return nil).
+func NewTCPChainServer(pipe func(conn net.Conn) []conduit.Conduit) (tc *TCPChainServer) {
+	if pipe == nil {
+		return nil
+	}
+	tc = new(TCPChainServer)
+	if tc != nil {
+		tc.pipe = pipe
+		tc.prod = func(r io.Reader) conduit.Producer { return NewReader(r) }
+		tc.cons = func(w io.Writer) conduit.Consumer { return &textWriter{w} }
+		tc.sz = 128
+	}
+	return
+}
+
+// SetProducer sets the function creating the Producer
+// that reads from the connection.
+func (tc *TCPChainServer) SetProducer(prod func(r io.Reader) conduit.Producer) *TCPChainServer {
+	tc.prod = prod
+	return tc
+}
+
+// SetConsumer sets the function creating the Consumer
+// that writes to the connection.
+func (tc *TCPChainServer) SetConsumer(cons func(w io.Writer) conduit.Consumer) *TCPChainServer {
+	tc.cons = cons
+	return tc
+}
+
+// SetBufferSize sets the buffer size of the chains (default 128).
+func (tc *TCPChainServer) SetBufferSize(sz uint32) *TCPChainServer {
+	tc.sz = sz
+	return tc
+}
+
+// ListenAndServe listens on addr and serves the connections
+// (see Serve).
+func (tc *TCPChainServer) ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return tc.Serve(ln)
+}
+
+// ListenAndServeUnix listens on the Unix socket path
+// and serves the connections (see Serve).
+func (tc *TCPChainServer) ListenAndServeUnix(path string) error {
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	return tc.Serve(ln)
+}
+
+// Serve accepts connections on ln and serves them
+// until Close is called or accepting fails.
+// Serve returns nil after Close, when all connections are closed.
+func (tc *TCPChainServer) Serve(ln net.Listener) error {
+	if !tc.cs.listen(ln) {
+		ln.Close()
+		return nil
+	}
+	var err error
+	for {
+		conn, aerr := ln.Accept()
+		if aerr != nil {
+			if !tc.cs.isClosed() {
+				err = aerr
+			}
+			break
+		}
+		if !tc.cs.add(conn) {
+			conn.Close()
+			break
+		}
+		go tc.serve(conn)
+	}
+	tc.cs.close()
+	tc.cs.wg.Wait()
+	return err
+}
+
+// Close closes the listener and all connections.
+func (tc *TCPChainServer) Close() error {
+	tc.cs.close()
+	return nil
+}
+
+// Runs the chain of a connection
+func (tc *TCPChainServer) serve(conn net.Conn) {
+	defer tc.cs.remove(conn)
+	chn := conduit.NewChain(tc.prod(conn), tc.pipe(conn), tc.cons(conn), tc.sz)
+	chn.Run()
+}
+
+// TCPClient is a Consumer that writes incoming []byte
+// and string items to a TCP connection. The connection is
+// established with the first item; if it cannot be established
+// or is lost, TCPClient reconnects according to the RetryPolicy
+// (DefaultRetry) and writes the item again.
+// Since the item may have been written partially before,
+// the receiver should read the data with framing
+// (see Framer and Deframer): it then sees an incomplete frame
+// on the lost connection and receives the item
+// completely on the new one.
+// TCPClient also connects to Unix stream sockets (see NewUnixClient).
+type TCPClient struct {
+	network string
+	addr    string
+	timeout time.Duration
+	retry   RetryPolicy
+	conn    net.Conn
+}
+
+// NewTCPClient creates a new TCPClient Consumer
+// connecting to addr.
+func NewTCPClient(addr string) (tc *TCPClient) {
+	tc = new(TCPClient)
+	if tc != nil {
+		tc.network = "tcp"
+		tc.addr = addr
+		tc.timeout = 10 * time.Second
+		tc.retry = DefaultRetry
+	}
+	return
+}
+
+// SetDialTimeout sets the timeout for connecting (default 10s).
+func (tc *TCPClient) SetDialTimeout(d time.Duration) *TCPClient {
+	tc.timeout = d
+	return tc
+}
+
+// SetRetry sets the RetryPolicy (default: DefaultRetry).
+func (tc *TCPClient) SetRetry(rp RetryPolicy) *TCPClient {
+	tc.retry = rp
+	return tc
+}
+
+// Consume is the pre-defined method that makes TCPClient a Consumer.
+// Consume terminates with an error if an item is not []byte or string
+// or cannot be written after all attempts.
+// The connection is closed at the end of the stream.
+func (tc *TCPClient) Consume(src conduit.Source) error {
+	defer tc.close()
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			continue
+		}
+		var data []byte
+		switch x := inp.(type) {
+		case []byte:
+			data = x
+		case string:
+			data = []byte(x)
+		default:
+			return errors.New(fmt.Sprintf("cannot write %T", inp))
+		}
+		attempts, err := tc.retry.run(nil, func() (bool, error) {
+			return true, tc.write(data)
+		})
+		if err != nil {
+			return errors.New(fmt.Sprintf("write failed after %d attempts: %v", attempts, err))
+		}
+	}
+	return nil
+}
+
+// Writes data, connecting if necessary;
+// the connection is closed on error
+func (tc *TCPClient) write(data []byte) error {
+	if tc.conn == nil {
+		conn, err := net.DialTimeout(tc.network, tc.addr, tc.timeout)
+		if err != nil {
+			return err
+		}
+		tc.conn = conn
+	}
+	_, err := tc.conn.Write(data)
+	if err != nil {
+		tc.close()
+	}
+	return err
+}
+
+func (tc *TCPClient) close() {
+	if tc.conn != nil {
+		tc.conn.Close()
+		tc.conn = nil
+	}
+}
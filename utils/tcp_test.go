@@ -0,0 +1,244 @@
+package utils
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+func deframed(net.Conn) []conduit.Conduit {
+	return []conduit.Conduit{NewDeframer(4, binary.BigEndian)}
+}
+
+// Sends msgs framed with a TCPClient
+func sendFramed(addr string, msgs []interface{}) error {
+	chn := conduit.NewChain(&AnyProducer{msgs}, []conduit.Conduit{NewFramer(4, binary.BigEndian)},
+		NewTCPClient(addr).SetRetry(fastRetry), small)
+	return chn.Run()
+}
+
+// TCP server:
+// - Messages from concurrent clients arrive complete (with Deframer)
+// - The server stops when the chain is canceled
+func TestTCPServer(t *testing.T) {
+	for i := 0; i < numOfTests; i++ {
+		err := testTCPServer(4, 25)
+		if err != nil {
+			m := fmt.Sprintf("TCPServer failed: %v", err)
+			t.Error(m)
+		}
+	}
+}
+
+func testTCPServer(clients, n int) error {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	c := &TakeConsumer{n: clients * n}
+	chn := conduit.NewChain(NewTCPServerOn(ln).SetPipe(deframed), nil, c, small)
+	done := make(chan error)
+	go func() { done <- chn.Run() }()
+
+	var want []string
+	errs := make(chan error, clients)
+	for k := 0; k < clients; k++ {
+		var msgs []interface{}
+		for j := 0; j < n; j++ {
+			m := fmt.Sprintf("client %d: message %d", k, j)
+			msgs = append(msgs, m)
+			want = append(want, m)
+		}
+		go func(msgs []interface{}) { errs <- sendFramed(ln.Addr().String(), msgs) }(msgs)
+	}
+	for k := 0; k < clients; k++ {
+		if err := <-errs; err != nil {
+			return err
+		}
+	}
+	select {
+	case err = <-done:
+	case <-time.After(5 * time.Second):
+		return errors.New("server did not terminate")
+	}
+	if err != nil {
+		return err
+	}
+	var have []string
+	for _, m := range c.recvd {
+		have = append(have, string(m.([]byte)))
+	}
+	sort.Strings(want)
+	sort.Strings(have)
+	if fmt.Sprint(have) != fmt.Sprint(want) {
+		return errors.New(fmt.Sprintf("expected %d messages, have %d: %q", len(want), len(have), have))
+	}
+	return nil
+}
+
+// TCP server errors:
+// - Connections ending within a frame are reported on the side output
+func TestTCPServerErrors(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("TCPServer: cannot listen: %v", err)
+	}
+	ts := NewTCPServerOn(ln).SetPipe(deframed)
+	errs := make(chan interface{}, 1)
+	chn := conduit.NewChain(ts, nil, &TakeConsumer{n: 1}, small)
+	err = chn.AddSide(ts, "errors", &sideCollector{errs})
+	if err != nil {
+		t.Fatalf("TCPServer: cannot add side: %v", err)
+	}
+	done := make(chan error)
+	go func() { done <- chn.Run() }()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("TCPServer: cannot connect: %v", err)
+	}
+	conn.Write([]byte{0, 0, 0, 9, 'h', 'i'})
+	conn.Close()
+	select {
+	case e := <-errs:
+		ce, ok := e.(*ConnError)
+		if !ok || ce.Err == nil {
+			t.Errorf("TCPServer: unexpected side output %v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("TCPServer: error not reported")
+	}
+
+	err = sendFramed(ln.Addr().String(), []interface{}{"bye"})
+	if err != nil {
+		t.Fatalf("TCPServer: cannot send: %v", err)
+	}
+	if err = <-done; err != nil {
+		t.Errorf("TCPServer failed: %v", err)
+	}
+}
+
+// Consumer that sends the items to a channel
+type sideCollector struct {
+	items chan interface{}
+}
+
+func (c *sideCollector) Consume(src conduit.Source) error {
+	for inp := range src {
+		c.items <- inp
+	}
+	return nil
+}
+
+// TCP chain server:
+// - Each connection is served by its own chain (echo)
+// - Framed requests are answered with framed responses
+// - Serve returns after Close
+func TestTCPChainServer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("TCPChainServer: cannot listen: %v", err)
+	}
+	srv := NewTCPChainServer(func(net.Conn) []conduit.Conduit {
+		return []conduit.Conduit{
+			NewDeframer(2, binary.BigEndian),
+			NewTransformer(TransformFunc(func(inp interface{}) (interface{}, error) {
+				return fmt.Sprintf("echo: %s", inp), nil
+			})),
+			NewFramer(2, binary.BigEndian),
+		}
+	})
+	served := make(chan error)
+	go func() { served <- srv.Serve(ln) }()
+
+	for i := 0; i < numOfTests; i++ {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("TCPChainServer: cannot connect: %v", err)
+		}
+		msg := fmt.Sprintf("hello %d", i)
+		conn.Write(append([]byte{0, byte(len(msg))}, msg...))
+		conn.(*net.TCPConn).CloseWrite()
+		rsp, err := ioutil.ReadAll(conn)
+		conn.Close()
+		if err != nil {
+			t.Fatalf("TCPChainServer: cannot read: %v", err)
+		}
+		want := "echo: " + msg
+		if len(rsp) != 2+len(want) || string(rsp[2:]) != want {
+			t.Errorf("TCPChainServer: expected %q, have %q", want, rsp)
+		}
+	}
+
+	// an open connection does not keep the server from closing
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("TCPChainServer: cannot connect: %v", err)
+	}
+	defer conn.Close()
+	time.Sleep(10 * time.Millisecond)
+	srv.Close()
+	select {
+	case err = <-served:
+		if err != nil {
+			t.Errorf("TCPChainServer: unexpected error %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("TCPChainServer: Serve did not return")
+	}
+}
+
+// TCP client:
+// - The client retries until the server is up
+// - The client fails when the attempts are exhausted
+func TestTCPClient(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("TCPClient: cannot listen: %v", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	rp := RetryPolicy{Attempts: 50, Backoff: ConstantBackoff(20 * time.Millisecond)}
+	sent := make(chan error)
+	go func() {
+		chn := conduit.NewChain(&AnyProducer{[]interface{}{"late", []byte(" but there")}}, nil,
+			NewTCPClient(addr).SetRetry(rp), small)
+		sent <- chn.Run()
+	}()
+	time.Sleep(100 * time.Millisecond)
+	ln, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("TCPClient: cannot listen again: %v", err)
+	}
+	defer ln.Close()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("TCPClient: cannot accept: %v", err)
+	}
+	data, _ := ioutil.ReadAll(conn)
+	conn.Close()
+	if err = <-sent; err != nil {
+		t.Errorf("TCPClient failed: %v", err)
+	}
+	if string(data) != "late but there" {
+		t.Errorf("TCPClient: unexpected data %q", data)
+	}
+
+	ln.Close()
+	chn := conduit.NewChain(&AnyProducer{[]interface{}{"nobody"}}, nil, NewTCPClient(addr).SetRetry(fastRetry), small)
+	if chn.Run() == nil {
+		t.Errorf("TCPClient: failed connection not reported")
+	}
+	chn = conduit.NewChain(&AnyProducer{[]interface{}{42}}, nil, NewTCPClient(addr), small)
+	if chn.Run() == nil {
+		t.Errorf("TCPClient: invalid item not reported")
+	}
+}
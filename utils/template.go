@@ -0,0 +1,133 @@
+package utils
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/toschoo/conduit"
+)
+
+// Template is implemented by text/template.Template
+// and html/template.Template.
+type Template interface {
+	Execute(w io.Writer, data interface{}) error
+	ExecuteTemplate(w io.Writer, name string, data interface{}) error
+}
+
+// TemplateFuncs returns helper functions for templates
+// used with TemplateWriter, to be added with Funcs
+// before parsing the template: upper, lower and trim
+// (strings.ToUpper, ToLower and TrimSpace), join and split
+// taking the separator first (e.g. {{join ", " .Tags}}),
+// replace (strings.ReplaceAll), json (the JSON encoding of a value),
+// sql (a single-quoted SQL string literal or NULL),
+// pad (a value padded to a width, left-aligned if the width
+// is negative) and default (a default for empty values).
+func TemplateFuncs() map[string]interface{} {
+	return map[string]interface{}{
+		"upper": strings.ToUpper,
+		"lower": strings.ToLower,
+		"trim":  strings.TrimSpace,
+		"join": func(sep string, elems []string) string {
+			return strings.Join(elems, sep)
+		},
+		"split": func(sep string, s string) []string {
+			return strings.Split(s, sep)
+		},
+		"replace": strings.ReplaceAll,
+		"json": func(v interface{}) (string, error) {
+			buf, err := json.Marshal(v)
+			return string(buf), err
+		},
+		"sql": func(v interface{}) string {
+			if v == nil {
+				return "NULL"
+			}
+			return "'" + strings.ReplaceAll(fmt.Sprint(v), "'", "''") + "'"
+		},
+		"pad": func(width int, v interface{}) string {
+			return fmt.Sprintf("%*v", width, v)
+		},
+		"default": func(def interface{}, v interface{}) interface{} {
+			if v == nil || fmt.Sprint(v) == "" {
+				return def
+			}
+			return v
+		},
+	}
+}
+
+// TemplateWriter is a Consumer that renders each incoming item
+// with a template and writes the result to an io.Writer,
+// e.g. to generate reports, SQL scripts or configuration files.
+// Optionally, named templates are rendered as header
+// before the first and as footer after the last item;
+// they receive the number of items rendered so far.
+type TemplateWriter struct {
+	wt     io.Writer
+	t      Template
+	header string
+	footer string
+}
+
+// NewTemplateWriter creates a new TemplateWriter Consumer.
+func NewTemplateWriter(w io.Writer, t Template) (tw *TemplateWriter) {
+	if t == nil {
+		return nil
+	}
+	tw = new(TemplateWriter)
+	if tw != nil {
+		tw.wt = w
+		tw.t = t
+	}
+	return
+}
+
+// SetHeader sets the name of the template rendered as header.
+func (tw *TemplateWriter) SetHeader(name string) *TemplateWriter {
+	tw.header = name
+	return tw
+}
+
+// SetFooter sets the name of the template rendered as footer.
+func (tw *TemplateWriter) SetFooter(name string) *TemplateWriter {
+	tw.footer = name
+	return tw
+}
+
+// Consume is the pre-defined method that makes TemplateWriter a Consumer.
+// Consume terminates with an error if an item cannot be rendered.
+func (tw *TemplateWriter) Consume(src conduit.Source) error {
+	w := bufio.NewWriter(tw.wt)
+	n := 0
+	if tw.header != "" {
+		err := tw.t.ExecuteTemplate(w, tw.header, n)
+		if err != nil {
+			return err
+		}
+	}
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			err := w.Flush()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		err := tw.t.Execute(w, inp)
+		if err != nil {
+			return err
+		}
+		n++
+	}
+	if tw.footer != "" {
+		err := tw.t.ExecuteTemplate(w, tw.footer, n)
+		if err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
@@ -0,0 +1,58 @@
+package utils
+
+import (
+	"bytes"
+	htmltemplate "html/template"
+	"testing"
+	"text/template"
+
+	"github.com/toschoo/conduit"
+)
+
+// Templates:
+// - Items are rendered with a text template and helper functions
+// - Header and footer are rendered with the number of items
+// - HTML templates escape their input
+// - Execution errors are reported
+func TestTemplateWriter(t *testing.T) {
+	items := []interface{}{
+		map[string]interface{}{"name": "o'brien", "tags": []string{"a", "b"}},
+		map[string]interface{}{"name": "smith", "tags": []string{}},
+	}
+	tmpl := template.Must(template.New("row").Funcs(TemplateFuncs()).Parse(
+		`INSERT INTO t VALUES ({{sql .name}}, {{join "," .tags | sql}}, {{default "-" (join "," .tags)}});` + "\n" +
+			`{{define "head"}}BEGIN;{{"\n"}}{{end}}` +
+			`{{define "foot"}}-- {{.}} rows{{"\n"}}COMMIT;{{"\n"}}{{end}}`))
+
+	var out bytes.Buffer
+	tw := NewTemplateWriter(&out, tmpl).SetHeader("head").SetFooter("foot")
+	chn := conduit.NewChain(&AnyProducer{items}, nil, tw, small)
+	err := chn.Run()
+	if err != nil {
+		t.Fatalf("TemplateWriter failed: %v", chn.Errs)
+	}
+	want := "BEGIN;\n" +
+		"INSERT INTO t VALUES ('o''brien', 'a,b', a,b);\n" +
+		"INSERT INTO t VALUES ('smith', '', -);\n" +
+		"-- 2 rows\nCOMMIT;\n"
+	if out.String() != want {
+		t.Errorf("TemplateWriter: expected\n%s\nhave\n%s", want, out.String())
+	}
+
+	out.Reset()
+	html := htmltemplate.Must(htmltemplate.New("li").Funcs(TemplateFuncs()).Parse(`<li>{{upper .}}</li>`))
+	chn = conduit.NewChain(&AnyProducer{[]interface{}{"<b>"}}, nil, NewTemplateWriter(&out, html), small)
+	err = chn.Run()
+	if err != nil {
+		t.Fatalf("TemplateWriter failed on HTML: %v", chn.Errs)
+	}
+	if out.String() != "<li>&lt;B&gt;</li>" {
+		t.Errorf("TemplateWriter: unexpected HTML: %s", out.String())
+	}
+
+	bad := template.Must(template.New("bad").Parse(`{{.X.Y}}`))
+	chn = conduit.NewChain(&AnyProducer{[]interface{}{1}}, nil, NewTemplateWriter(new(bytes.Buffer), bad), small)
+	if chn.Run() == nil {
+		t.Errorf("TemplateWriter: execution error not reported")
+	}
+}
@@ -0,0 +1,106 @@
+package utils
+
+import (
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+// Ticker is a Producer that sends the current time
+// as time.Time down the chain every interval,
+// e.g. to trigger window flushes or as heartbeat
+// merged into another stream. Like time.Ticker,
+// it drops ticks when the chain is too slow.
+// The ticker runs until it is canceled
+// or has sent the number of ticks set with SetCount.
+type Ticker struct {
+	conduit.Cancelable
+	d     time.Duration
+	count int
+	sent  uint64 // ticks sent before a restart
+}
+
+// NewTicker creates a new Ticker Producer
+// that ticks every d, starting at d after it is started.
+func NewTicker(d time.Duration) (t *Ticker) {
+	if d <= 0 {
+		return nil
+	}
+	t = new(Ticker)
+	if t != nil {
+		t.d = d
+	}
+	return
+}
+
+// SetCount stops the ticker after n ticks.
+func (t *Ticker) SetCount(n int) *Ticker {
+	t.count = n
+	return t
+}
+
+// Resume is the pre-defined method that makes Ticker
+// a conduit.Resumer. Ticks are not replayed, so nothing is skipped;
+// the ticks sent before the restart count towards SetCount.
+func (t *Ticker) Resume(pos uint64) error {
+	t.sent = pos
+	return nil
+}
+
+// Produce is the pre-defined method that makes Ticker a Producer.
+func (t *Ticker) Produce(trg conduit.Target) error {
+	next := time.Now()
+	n := int(t.sent)
+	t.sent = 0
+	for ; t.count <= 0 || n < t.count; n++ {
+		next = next.Add(t.d)
+		if now := time.Now(); next.Before(now) {
+			// skip the ticks that were missed
+			next = next.Add((now.Sub(next)/t.d + 1) * t.d)
+		}
+		if !sleep(time.Until(next), t.Canceled) || t.Canceled() {
+			return nil
+		}
+		trg <- time.Now()
+	}
+	return nil
+}
+
+// Timer is a Producer that sends the current time
+// as time.Time down the chain once after a delay
+// and then terminates.
+type Timer struct {
+	conduit.Cancelable
+	d     time.Duration
+	fired bool // the timer fired before a restart
+}
+
+// NewTimer creates a new Timer Producer that fires d after it is started.
+func NewTimer(d time.Duration) (t *Timer) {
+	t = new(Timer)
+	if t != nil {
+		t.d = d
+	}
+	return
+}
+
+// Resume is the pre-defined method that makes Timer
+// a conduit.Resumer. A timer that fired before the restart
+// does not fire again; otherwise, it fires d after it is started.
+func (t *Timer) Resume(pos uint64) error {
+	t.fired = pos > 0
+	return nil
+}
+
+// Produce is the pre-defined method that makes Timer a Producer.
+func (t *Timer) Produce(trg conduit.Target) error {
+	if t.fired {
+		t.fired = false
+		return nil
+	}
+	if !sleep(t.d, t.Canceled) || t.Canceled() {
+		return nil
+	}
+	trg <- time.Now()
+	return nil
+}
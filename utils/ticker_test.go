@@ -0,0 +1,55 @@
+package utils
+
+import (
+	"testing"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+// Ticker and timer:
+// - The ticker sends a time every interval until the count is reached or it is canceled
+// - The timer sends one time after the delay
+// - Resumed, the ticker sends the remaining ticks and a fired timer nothing
+func TestTicker(t *testing.T) {
+	if NewTicker(0) != nil {
+		t.Errorf("Ticker: zero interval accepted")
+	}
+	ac := &AnyConsumer{}
+	start := time.Now()
+	if err := conduit.NewChain(NewTicker(10*time.Millisecond).SetCount(3), nil, ac, small).Run(); err != nil {
+		t.Fatalf("Ticker failed: %v", err)
+	}
+	if len(ac.recvd) != 3 || ac.recvd[0].(time.Time).Sub(start) < 10*time.Millisecond ||
+		ac.recvd[2].(time.Time).Sub(start) < 30*time.Millisecond {
+		t.Errorf("Ticker: received %v after %v", ac.recvd, start)
+	}
+
+	tc := &TakeConsumer{n: 2}
+	if err := conduit.NewChain(NewTicker(5*time.Millisecond), nil, tc, small).Run(); err != nil || len(tc.recvd) != 2 {
+		t.Errorf("Ticker: received %v (%v)", tc.recvd, err)
+	}
+
+	ac = &AnyConsumer{}
+	start = time.Now()
+	if err := conduit.NewChain(NewTimer(20*time.Millisecond), nil, ac, small).Run(); err != nil {
+		t.Fatalf("Timer failed: %v", err)
+	}
+	if len(ac.recvd) != 1 || ac.recvd[0].(time.Time).Sub(start) < 20*time.Millisecond {
+		t.Errorf("Timer: received %v after %v", ac.recvd, start)
+	}
+
+	ac = &AnyConsumer{}
+	tk := NewTicker(time.Millisecond).SetCount(3)
+	tk.Resume(2)
+	if err := conduit.NewChain(tk, nil, ac, small).Run(); err != nil || len(ac.recvd) != 1 {
+		t.Errorf("Ticker: resumed at 2, received %v (%v)", ac.recvd, err)
+	}
+
+	ac = &AnyConsumer{}
+	tm := NewTimer(time.Millisecond)
+	tm.Resume(1)
+	if err := conduit.NewChain(tm, nil, ac, small).Run(); err != nil || len(ac.recvd) != 0 {
+		t.Errorf("Timer: resumed after firing, received %v (%v)", ac.recvd, err)
+	}
+}
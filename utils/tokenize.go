@@ -0,0 +1,150 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/toschoo/conduit"
+)
+
+// Returns the number of bytes at the end of b
+// that form the beginning of an incomplete rune
+func incompleteTail(b []byte) int {
+	for k := 1; k < utf8.UTFMax && k <= len(b); k++ {
+		i := len(b) - k
+		if utf8.RuneStart(b[i]) {
+			if utf8.FullRune(b[i:]) {
+				return 0
+			}
+			return k
+		}
+	}
+	return 0
+}
+
+// Returns the text of a []byte block or string item
+func textOf(inp interface{}) (string, bool, error) {
+	switch x := inp.(type) {
+	case []byte:
+		return string(x), true, nil
+	case string:
+		return x, false, nil
+	}
+	return "", false, errors.New(fmt.Sprintf("cannot process %T as text", inp))
+}
+
+// Tokenizer is a Conduit that splits text into words
+// and sends them down the chain as strings.
+// Words consist of letters, digits and marks (Unicode-aware);
+// apostrophes and hyphens between letters or digits
+// belong to the word (e.g. "don't", "well-known").
+// Incoming []byte blocks are treated as one stream,
+// i.e. words (and runes) split by block boundaries are joined,
+// while strings (e.g. lines) are tokenized one by one.
+type Tokenizer struct {
+	lower bool
+	punct bool
+}
+
+// NewTokenizer creates a new Tokenizer Conduit.
+func NewTokenizer() (tk *Tokenizer) {
+	tk = new(Tokenizer)
+	return
+}
+
+// Lower converts words to lower case.
+func (tk *Tokenizer) Lower() *Tokenizer {
+	tk.lower = true
+	return tk
+}
+
+// KeepPunct sends punctuation and symbols
+// as tokens of their own instead of dropping them.
+func (tk *Tokenizer) KeepPunct() *Tokenizer {
+	tk.punct = true
+	return tk
+}
+
+// Conduct is the pre-defined method that makes Tokenizer a Conduit.
+// Conduct terminates with an error if an item is not []byte or string.
+func (tk *Tokenizer) Conduct(src conduit.Source, trg conduit.Target) error {
+	var carry []byte
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			trg <- inp
+			continue
+		}
+		text, stream, err := textOf(inp)
+		if err != nil {
+			return err
+		}
+		if !stream {
+			tk.tokenize(text, false, trg)
+			continue
+		}
+		buf := append(carry, inp.([]byte)...)
+		n := len(buf) - incompleteTail(buf)
+		rest := tk.tokenize(string(buf[:n]), true, trg)
+		carry = append([]byte(rest), buf[n:]...)
+	}
+	if len(carry) > 0 {
+		tk.tokenize(string(carry), false, trg)
+	}
+	return nil
+}
+
+// Checks whether r is part of a word
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r)
+}
+
+// Checks whether r joins word runes
+func isJoiner(r rune) bool {
+	return r == '\'' || r == '’' || r == '-'
+}
+
+// Sends the tokens of text; with more, a token at the end
+// of text may continue and is returned instead
+func (tk *Tokenizer) tokenize(text string, more bool, trg conduit.Target) string {
+	start := -1
+	send := func(tok string) {
+		if tk.lower {
+			tok = strings.ToLower(tok)
+		}
+		trg <- tok
+	}
+	for i, r := range text {
+		if isWordRune(r) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start >= 0 && isJoiner(r) {
+			next, _ := utf8.DecodeRuneInString(text[i+utf8.RuneLen(r):])
+			if isWordRune(next) {
+				continue
+			}
+			if more && i+utf8.RuneLen(r) == len(text) {
+				return text[start:]
+			}
+		}
+		if start >= 0 {
+			send(text[start:i])
+			start = -1
+		}
+		if tk.punct && (unicode.IsPunct(r) || unicode.IsSymbol(r)) {
+			trg <- string(r)
+		}
+	}
+	if start >= 0 {
+		if more {
+			return text[start:]
+		}
+		send(text[start:])
+	}
+	return ""
+}
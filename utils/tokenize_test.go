@@ -0,0 +1,55 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/toschoo/conduit"
+)
+
+const tokenText = "Don't panic! The well-known Ünïcödé text, 42 times — naïve café’s 日本語 -dash- end."
+
+// Tokenizer:
+// - Text is split into words with joiners kept inside words
+// - Words are lowercased and punctuation is kept on request
+// - Block boundaries do not split words or runes
+func TestTokenizer(t *testing.T) {
+	want := "[don't panic the well-known ünïcödé text 42 times naïve café’s 日本語 dash end]"
+	c := new(AnyConsumer)
+	chn := conduit.NewChain(&AnyProducer{[]interface{}{tokenText}}, []conduit.Conduit{NewTokenizer().Lower()}, c, small)
+	err := chn.Run()
+	if err != nil {
+		t.Fatalf("Tokenizer failed: %v", chn.Errs)
+	}
+	if fmt.Sprint(c.recvd) != want {
+		t.Errorf("Tokenizer: expected %s, have %v", want, c.recvd)
+	}
+
+	for i := 0; i < numOfTests; i++ {
+		text := strings.Repeat(tokenText+" ", i)
+		c = new(AnyConsumer)
+		pipe := []conduit.Conduit{new(Rechunk), NewTokenizer().Lower()}
+		chn = conduit.NewChain(&AnyProducer{[]interface{}{[]byte(text)}}, pipe, c, small)
+		err = chn.Run()
+		if err != nil {
+			t.Fatalf("Tokenizer failed: %v", chn.Errs)
+		}
+		have := fmt.Sprint(c.recvd)
+		expect := "[" + strings.TrimSpace(strings.Repeat(want[1:len(want)-1]+" ", i)) + "]"
+		if have != expect {
+			t.Errorf("Tokenizer on blocks: expected %s, have %s", expect, have)
+			break
+		}
+	}
+
+	c = new(AnyConsumer)
+	chn = conduit.NewChain(&AnyProducer{[]interface{}{"Hi, you!"}}, []conduit.Conduit{NewTokenizer().KeepPunct()}, c, small)
+	err = chn.Run()
+	if err != nil {
+		t.Fatalf("Tokenizer failed: %v", chn.Errs)
+	}
+	if fmt.Sprint(c.recvd) != "[Hi , you !]" {
+		t.Errorf("Tokenizer: unexpected tokens %v", c.recvd)
+	}
+}
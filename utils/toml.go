@@ -0,0 +1,137 @@
+package utils
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+
+	"github.com/toschoo/conduit"
+)
+
+// TOMLTable is a top-level table of a TOML document.
+type TOMLTable struct {
+	Name  string
+	Value interface{}
+}
+
+// TOMLReader is a Producer that decodes a TOML document
+// and sends it down the chain, either as a whole
+// or table by table (see PerTable).
+type TOMLReader struct {
+	rd        io.Reader
+	unmarshal UnmarshalFunc
+	new       func() interface{}
+	tables    bool
+}
+
+// NewTOMLReader creates a new TOMLReader Producer.
+// The document is decoded with unmarshal (e.g. toml.Unmarshal)
+// into the result of newValue or, if newValue is nil,
+// into interface{}.
+func NewTOMLReader(r io.Reader, unmarshal UnmarshalFunc, newValue func() interface{}) (tr *TOMLReader) {
+	if unmarshal == nil {
+		return nil
+	}
+	tr = new(TOMLReader)
+	if tr != nil {
+		tr.rd = r
+		tr.unmarshal = unmarshal
+		tr.new = newValue
+	}
+	return
+}
+
+// PerTable makes the reader send the top-level entries
+// of the document (i.e. tables, but also top-level keys)
+// one by one as TOMLTable, ordered by name.
+// newValue is ignored in this mode.
+func (tr *TOMLReader) PerTable() *TOMLReader {
+	tr.tables = true
+	return tr
+}
+
+// Produce is the pre-defined method that makes TOMLReader a Producer.
+func (tr *TOMLReader) Produce(trg conduit.Target) error {
+	data, err := ioutil.ReadAll(tr.rd)
+	if err != nil {
+		return err
+	}
+	if !tr.tables {
+		v, err := unmarshalNew(tr.unmarshal, data, tr.new)
+		if err != nil {
+			return err
+		}
+		trg <- v
+		return nil
+	}
+	var doc map[string]interface{}
+	err = tr.unmarshal(data, &doc)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(doc))
+	for k := range doc {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		trg <- TOMLTable{k, doc[k]}
+	}
+	return nil
+}
+
+// TOMLWriter is a Consumer that writes incoming data
+// as TOML. TOMLTables are written as tables of one document;
+// other items are written as they are encoded,
+// separated by blank lines. It is up to the user
+// to avoid duplicate keys.
+type TOMLWriter struct {
+	wt      io.Writer
+	marshal MarshalFunc
+}
+
+// NewTOMLWriter creates a new TOMLWriter Consumer
+// encoding items with marshal (e.g. toml.Marshal).
+func NewTOMLWriter(w io.Writer, marshal MarshalFunc) (tw *TOMLWriter) {
+	if marshal == nil {
+		return nil
+	}
+	tw = new(TOMLWriter)
+	if tw != nil {
+		tw.wt = w
+		tw.marshal = marshal
+	}
+	return
+}
+
+// Consume is the pre-defined method that makes TOMLWriter a Consumer.
+// Consume terminates with an error if an item cannot be encoded.
+func (tw *TOMLWriter) Consume(src conduit.Source) error {
+	bw := bufio.NewWriter(tw.wt)
+	first := true
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			err := bw.Flush()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if t, ok := inp.(TOMLTable); ok {
+			inp = map[string]interface{}{t.Name: t.Value}
+		}
+		buf, err := tw.marshal(inp)
+		if err != nil {
+			return errors.New(fmt.Sprintf("cannot encode %T: %v", inp, err))
+		}
+		if !first {
+			bw.WriteByte('\n')
+		}
+		first = false
+		bw.Write(buf)
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,144 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/toschoo/conduit"
+)
+
+// a tiny codec for TOML documents with tables of string values
+func tableMarshal(v interface{}) ([]byte, error) {
+	doc, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("not a document")
+	}
+	var buf bytes.Buffer
+	for _, name := range sortedKeys(doc) {
+		t, ok := doc[name].(map[string]string)
+		if !ok {
+			return nil, errors.New("not a table")
+		}
+		fmt.Fprintf(&buf, "[%s]\n", name)
+		flat, _ := flatMarshal(t)
+		buf.Write(bytes.Replace(flat, []byte(": "), []byte(" = "), -1))
+	}
+	return buf.Bytes(), nil
+}
+
+func tableUnmarshal(data []byte, v interface{}) error {
+	doc := make(map[string]interface{})
+	var t map[string]string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "":
+		case line[0] == '[':
+			t = make(map[string]string)
+			doc[strings.Trim(line, "[]")] = t
+		case t == nil:
+			return errors.New("key outside table")
+		default:
+			kv := strings.SplitN(line, "=", 2)
+			t[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+	}
+	switch x := v.(type) {
+	case *map[string]interface{}:
+		*x = doc
+	case *interface{}:
+		*x = doc
+	default:
+		return errors.New("unsupported type")
+	}
+	return nil
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// TOML:
+// - Tables are written and read back without errors
+// - per table and per document
+func TestTOMLChain(t *testing.T) {
+	for i := 0; i < numOfTests; i++ {
+		err := testTOMLChain(i)
+		if err != nil {
+			m := fmt.Sprintf("TOMLChain failed: %v", err)
+			t.Error(m)
+		}
+	}
+}
+
+func testTOMLChain(n int) error {
+
+	tables := make([]interface{}, n)
+	for i := range tables {
+		tables[i] = TOMLTable{fmt.Sprintf("t%03d", i), map[string]string{"x": fmt.Sprintf("%d", i)}}
+	}
+
+	var buf bytes.Buffer
+	chn := conduit.NewChain(&AnyProducer{tables}, nil, NewTOMLWriter(&buf, tableMarshal), small)
+	err := chn.Run()
+	if err != nil {
+		m := fmt.Sprintf("error on writing: %v", chn.Errs)
+		return errors.New(m)
+	}
+	doc := buf.String()
+
+	c := new(AnyConsumer)
+	p := NewTOMLReader(strings.NewReader(doc), tableUnmarshal, nil).PerTable()
+	chn = conduit.NewChain(p, nil, c, small)
+	err = chn.Run()
+	if err != nil {
+		m := fmt.Sprintf("error on reading: %v", chn.Errs)
+		return errors.New(m)
+	}
+	if len(c.recvd) != n {
+		m := fmt.Sprintf("expected %d tables, have %d", n, len(c.recvd))
+		return errors.New(m)
+	}
+	for i, v := range c.recvd {
+		if fmt.Sprintf("%v", v) != fmt.Sprintf("%v", tables[i]) {
+			return errors.New("Received values differ from original!")
+		}
+	}
+
+	c = new(AnyConsumer)
+	p = NewTOMLReader(strings.NewReader(doc), tableUnmarshal, nil)
+	chn = conduit.NewChain(p, nil, c, small)
+	err = chn.Run()
+	if err != nil {
+		m := fmt.Sprintf("error on reading: %v", chn.Errs)
+		return errors.New(m)
+	}
+	if len(c.recvd) != 1 || len(c.recvd[0].(map[string]interface{})) != n {
+		return errors.New("document not read as a whole")
+	}
+	return nil
+}
+
+// TOML barrier:
+// - Tables preceding a barrier are flushed at the barrier
+func TestTOMLBarrier(t *testing.T) {
+	w := new(chunkWriter)
+	err := consumeWithBarrier(NewTOMLWriter(w, tableMarshal),
+		TOMLTable{"a", map[string]string{"x": "1"}},
+		TOMLTable{"b", map[string]string{"y": "2"}})
+	if err != nil {
+		t.Fatalf("TOMLBarrier failed: %v", err)
+	}
+	if len(w.chunks) != 2 || w.chunks[0] != "[a]\nx = 1\n" {
+		t.Errorf("TOMLBarrier: unexpected writes %q", w.chunks)
+	}
+}
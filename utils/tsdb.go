@@ -0,0 +1,619 @@
+package utils
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+// Metric is a measurement at a point in time
+// with tags (labels) identifying the series
+// and one or more field values.
+// A zero Time is the time of the server (InfluxDB)
+// or the time of sending (Prometheus).
+type Metric struct {
+	Name   string
+	Tags   map[string]string
+	Fields map[string]interface{}
+	Time   time.Time
+}
+
+// MetricFunc converts an item to a Metric.
+type MetricFunc func(inp interface{}) (*Metric, error)
+
+// RecordMetric returns a MetricFunc that converts Records
+// (and maps with string keys) to Metrics named name;
+// the fields tags are tags, a time.Time in field "time" is the time
+// and all other fields (except nil values) are field values.
+func RecordMetric(name string, tags ...string) MetricFunc {
+	return func(inp interface{}) (*Metric, error) {
+		var r map[string]interface{}
+		switch x := inp.(type) {
+		case Record:
+			r = x
+		case map[string]interface{}:
+			r = x
+		default:
+			return nil, errors.New(fmt.Sprintf("cannot convert %T to Metric", inp))
+		}
+		m := &Metric{Name: name, Tags: make(map[string]string), Fields: make(map[string]interface{})}
+		istag := make(map[string]bool)
+		for _, t := range tags {
+			istag[t] = true
+		}
+		for k, v := range r {
+			switch {
+			case v == nil:
+			case istag[k]:
+				m.Tags[k] = fmt.Sprint(v)
+			case k == "time":
+				if tm, ok := v.(time.Time); ok {
+					m.Time = tm
+					continue
+				}
+				m.Fields[k] = v
+			default:
+				m.Fields[k] = v
+			}
+		}
+		return m, nil
+	}
+}
+
+// Converts Metric and *Metric
+func anyMetric(inp interface{}) (*Metric, error) {
+	switch m := inp.(type) {
+	case *Metric:
+		return m, nil
+	case Metric:
+		return &m, nil
+	}
+	return nil, errors.New(fmt.Sprintf("cannot convert %T to Metric", inp))
+}
+
+// Escapes with backslashes the characters in chars
+func escapeLine(s, chars string) string {
+	if !strings.ContainsAny(s, chars) {
+		return s
+	}
+	var b strings.Builder
+	for _, c := range s {
+		if strings.ContainsRune(chars, c) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// Appends a field value in line protocol
+func appendInfluxValue(b []byte, v interface{}) ([]byte, error) {
+	switch x := v.(type) {
+	case string:
+		return append(append(b, '"'), escapeLine(x, `"\`)+`"`...), nil
+	case bool:
+		return strconv.AppendBool(b, x), nil
+	case json.Number:
+		if n, err := x.Int64(); err == nil {
+			return append(strconv.AppendInt(b, n, 10), 'i'), nil
+		}
+		f, err := x.Float64()
+		if err != nil {
+			return nil, err
+		}
+		return appendInfluxValue(b, f)
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return append(strconv.AppendInt(b, rv.Int(), 10), 'i'), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		// InfluxDB 1 has no unsigned integers
+		if u := rv.Uint(); u > math.MaxInt64 {
+			return append(strconv.AppendUint(b, u, 10), 'u'), nil
+		}
+		return append(strconv.AppendUint(b, rv.Uint(), 10), 'i'), nil
+	case reflect.Float32, reflect.Float64:
+		f := rv.Float()
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil, errors.New(fmt.Sprintf("invalid field value %v", f))
+		}
+		return strconv.AppendFloat(b, f, 'g', -1, 64), nil
+	}
+	return nil, errors.New(fmt.Sprintf("invalid field value of type %T", v))
+}
+
+// Appends m in line protocol with timestamps in units of prec
+func appendInflux(b []byte, m *Metric, prec time.Duration) ([]byte, error) {
+	if m.Name == "" || len(m.Fields) == 0 {
+		return nil, errors.New(fmt.Sprintf("metric %q without name or fields", m.Name))
+	}
+	b = append(b, escapeLine(m.Name, ", ")...)
+	keys := make([]string, 0, len(m.Tags))
+	for k, v := range m.Tags {
+		if v != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		b = append(b, ',')
+		b = append(b, escapeLine(k, ",= ")...)
+		b = append(b, '=')
+		b = append(b, escapeLine(m.Tags[k], ",= ")...)
+	}
+	keys = keys[:0]
+	for k := range m.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for i, k := range keys {
+		if i == 0 {
+			b = append(b, ' ')
+		} else {
+			b = append(b, ',')
+		}
+		b = append(b, escapeLine(k, ",= ")...)
+		b = append(b, '=')
+		var err error
+		b, err = appendInfluxValue(b, m.Fields[k])
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("field %s: %v", k, err))
+		}
+	}
+	if !m.Time.IsZero() {
+		b = append(b, ' ')
+		b = strconv.AppendInt(b, m.Time.UnixNano()/int64(prec), 10)
+	}
+	return append(b, '\n'), nil
+}
+
+// MarshalInflux encodes a Metric or *Metric as line
+// in InfluxDB line protocol with timestamp in nanoseconds.
+// It can be used as MarshalFunc, e.g. with a TCP writer
+// sending to Telegraf.
+func MarshalInflux(v interface{}) ([]byte, error) {
+	m, err := anyMetric(v)
+	if err != nil {
+		return nil, err
+	}
+	return appendInflux(nil, m, time.Nanosecond)
+}
+
+// Converts a field value to a sample value
+func promValue(v interface{}) (float64, bool) {
+	switch x := v.(type) {
+	case bool:
+		if x {
+			return 1, true
+		}
+		return 0, true
+	case json.Number:
+		f, err := x.Float64()
+		return f, err == nil
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	}
+	return 0, false
+}
+
+// Replaces characters not allowed in metric and label names
+func promName(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if !(c == '_' || c == ':' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' && i > 0) {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+// Protobuf encoding
+type pbBuf []byte
+
+func (b pbBuf) varint(field int, v uint64) pbBuf {
+	return binary.AppendUvarint(binary.AppendUvarint(b, uint64(field<<3)), v)
+}
+
+func (b pbBuf) double(field int, f float64) pbBuf {
+	return binary.LittleEndian.AppendUint64(binary.AppendUvarint(b, uint64(field<<3|1)), math.Float64bits(f))
+}
+
+func (b pbBuf) bytes(field int, data []byte) pbBuf {
+	b = binary.AppendUvarint(binary.AppendUvarint(b, uint64(field<<3|2)), uint64(len(data)))
+	return append(b, data...)
+}
+
+// Encodes metrics as Prometheus remote-write WriteRequest;
+// every numeric field is a series named name_field
+// (or name for the field "value")
+func encodePromWrite(ms []*Metric, now time.Time) []byte {
+	type series struct {
+		labels  pbBuf
+		samples []pbBuf
+		times   []int64
+	}
+	var order []*series
+	index := make(map[string]*series)
+	for _, m := range ms {
+		tm := m.Time
+		if tm.IsZero() {
+			tm = now
+		}
+		ts := tm.UnixNano() / int64(time.Millisecond)
+		fields := make([]string, 0, len(m.Fields))
+		for k := range m.Fields {
+			fields = append(fields, k)
+		}
+		sort.Strings(fields)
+		for _, field := range fields {
+			f, ok := promValue(m.Fields[field])
+			if !ok {
+				continue
+			}
+			name := promName(m.Name)
+			if field != "value" {
+				name += "_" + promName(field)
+			}
+			labels := [][2]string{{"__name__", name}}
+			for k, v := range m.Tags {
+				if v != "" {
+					labels = append(labels, [2]string{promName(k), v})
+				}
+			}
+			sort.Slice(labels, func(i, j int) bool { return labels[i][0] < labels[j][0] })
+			var key strings.Builder
+			var lb pbBuf
+			for _, l := range labels {
+				key.WriteString(l[0] + "\xff" + l[1] + "\xff")
+				lb = lb.bytes(1, pbBuf{}.bytes(1, []byte(l[0])).bytes(2, []byte(l[1])))
+			}
+			s, ok := index[key.String()]
+			if !ok {
+				s = &series{labels: lb}
+				index[key.String()] = s
+				order = append(order, s)
+			}
+			s.samples = append(s.samples, pbBuf{}.double(1, f).varint(2, uint64(ts)))
+			s.times = append(s.times, ts)
+		}
+	}
+	var req pbBuf
+	for _, s := range order {
+		// samples of a series must be in order of time
+		idx := make([]int, len(s.samples))
+		for i := range idx {
+			idx[i] = i
+		}
+		sort.SliceStable(idx, func(i, j int) bool { return s.times[idx[i]] < s.times[idx[j]] })
+		ts := append(pbBuf{}, s.labels...)
+		for _, i := range idx {
+			ts = ts.bytes(2, s.samples[i])
+		}
+		req = req.bytes(1, ts)
+	}
+	return req
+}
+
+// Compresses data in the snappy block format
+func snappyEncode(data []byte) []byte {
+	out := binary.AppendUvarint(nil, uint64(len(data)))
+	literal := func(lit []byte) {
+		for len(lit) > 0 {
+			n := len(lit)
+			if n > 65536 {
+				n = 65536
+			}
+			switch {
+			case n <= 60:
+				out = append(out, byte(n-1)<<2)
+			case n <= 256:
+				out = append(out, 60<<2, byte(n-1))
+			default:
+				out = append(out, 61<<2, byte(n-1), byte((n-1)>>8))
+			}
+			out = append(out, lit[:n]...)
+			lit = lit[n:]
+		}
+	}
+	const hashBits = 14
+	var table [1 << hashBits]int32
+	hash := func(i int) uint32 {
+		return (binary.LittleEndian.Uint32(data[i:]) * 0x1e35a7bd) >> (32 - hashBits)
+	}
+	start := 0
+	for i := 0; i+4 <= len(data); {
+		h := hash(i)
+		cand := int(table[h]) - 1
+		table[h] = int32(i + 1)
+		if cand < 0 || i-cand > 65535 || binary.LittleEndian.Uint32(data[cand:]) != binary.LittleEndian.Uint32(data[i:]) {
+			i++
+			continue
+		}
+		literal(data[start:i])
+		n := 4
+		for i+n < len(data) && data[cand+n] == data[i+n] {
+			n++
+		}
+		off := i - cand
+		for k := n; k > 0; k -= 64 {
+			l := k
+			if l > 64 {
+				l = 64
+			}
+			out = append(out, byte(l-1)<<2|2, byte(off), byte(off>>8))
+		}
+		i += n
+		start = i
+	}
+	literal(data[start:])
+	return out
+}
+
+// MetricWriter is a Consumer that sends incoming items
+// as Metrics to a time-series database, either in InfluxDB
+// line protocol (NewInfluxWriter) or as Prometheus
+// remote-write requests (NewPromWriter).
+// Items are Metrics or are converted to Metrics by a MetricFunc
+// (see SetConvert and RecordMetric).
+// Metrics are sent in batches (see SetBatch and SetMaxAge),
+// which are also sent at barriers and at the end.
+// Requests that fail with a network error or status 429 or 5xx
+// are retried according to the RetryPolicy (DefaultRetry),
+// which defines the backoff between attempts.
+type MetricWriter struct {
+	url      string
+	header   http.Header
+	encode   func(ms []*Metric) ([]byte, error)
+	compress bool
+	convert  MetricFunc
+	batch    int
+	maxAge   time.Duration
+	client   *http.Client
+	retry    RetryPolicy
+}
+
+// Creates a MetricWriter with the user of the URL as basic auth
+func newMetricWriter(rawurl string) *MetricWriter {
+	u, err := url.Parse(rawurl)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil
+	}
+	mw := &MetricWriter{header: make(http.Header)}
+	if u.User != nil {
+		pass, _ := u.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + pass))
+		mw.header.Set("Authorization", "Basic "+auth)
+		u.User = nil
+	}
+	mw.url = u.String()
+	mw.convert = anyMetric
+	mw.batch = 5000
+	mw.client = http.DefaultClient
+	mw.retry = DefaultRetry
+	return mw
+}
+
+// NewInfluxWriter creates a new MetricWriter Consumer
+// that writes in line protocol to the write endpoint of InfluxDB,
+// e.g. http://host:8086/api/v2/write?org=o&bucket=b (InfluxDB 2)
+// or http://host:8086/write?db=d (InfluxDB 1);
+// the parameter precision (ns, us, ms or s, default ns)
+// determines the unit of timestamps.
+// InfluxDB 2 needs an API token (see SetHeader),
+// the user and password of the URL are sent as basic auth.
+func NewInfluxWriter(rawurl string) (mw *MetricWriter) {
+	mw = newMetricWriter(rawurl)
+	if mw != nil {
+		u, _ := url.Parse(rawurl)
+		prec := time.Nanosecond
+		switch u.Query().Get("precision") {
+		case "", "ns", "n":
+		case "us", "u":
+			prec = time.Microsecond
+		case "ms":
+			prec = time.Millisecond
+		case "s":
+			prec = time.Second
+		default:
+			return nil
+		}
+		mw.header.Set("Content-Type", "text/plain; charset=utf-8")
+		mw.encode = func(ms []*Metric) ([]byte, error) {
+			var b []byte
+			for _, m := range ms {
+				var err error
+				if b, err = appendInflux(b, m, prec); err != nil {
+					return nil, err
+				}
+			}
+			return b, nil
+		}
+	}
+	return
+}
+
+// NewPromWriter creates a new MetricWriter Consumer
+// that sends Prometheus remote-write (1.0) requests to the URL,
+// e.g. http://host:9090/api/v1/write;
+// the user and password of the URL are sent as basic auth.
+// Every numeric field of a Metric is a sample of the series
+// named name_field (or name for the field "value")
+// with the tags as labels; booleans are 0 or 1,
+// other fields are ignored.
+func NewPromWriter(rawurl string) (mw *MetricWriter) {
+	mw = newMetricWriter(rawurl)
+	if mw != nil {
+		mw.header.Set("Content-Type", "application/x-protobuf")
+		mw.header.Set("Content-Encoding", "snappy")
+		mw.header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+		mw.encode = func(ms []*Metric) ([]byte, error) {
+			req := encodePromWrite(ms, time.Now())
+			if len(req) == 0 {
+				return nil, nil
+			}
+			return snappyEncode(req), nil
+		}
+	}
+	return
+}
+
+// SetHeader sets a header of requests,
+// e.g. Authorization: Token ... for InfluxDB 2.
+func (mw *MetricWriter) SetHeader(name, value string) *MetricWriter {
+	mw.header.Set(name, value)
+	return mw
+}
+
+// SetConvert sets the MetricFunc that converts items
+// (default: only Metric and *Metric are accepted).
+func (mw *MetricWriter) SetConvert(convert MetricFunc) *MetricWriter {
+	mw.convert = convert
+	return mw
+}
+
+// SetBatch sets the number of Metrics per request (default 5000).
+func (mw *MetricWriter) SetBatch(n int) *MetricWriter {
+	if n > 0 {
+		mw.batch = n
+	}
+	return mw
+}
+
+// SetMaxAge sets the time after which a batch is sent
+// even if it is not full.
+func (mw *MetricWriter) SetMaxAge(d time.Duration) *MetricWriter {
+	mw.maxAge = d
+	return mw
+}
+
+// SetCompress compresses line protocol with gzip;
+// remote-write requests are always compressed with snappy.
+func (mw *MetricWriter) SetCompress() *MetricWriter {
+	mw.compress = true
+	return mw
+}
+
+// SetClient sets the http.Client (default: http.DefaultClient).
+func (mw *MetricWriter) SetClient(c *http.Client) *MetricWriter {
+	mw.client = c
+	return mw
+}
+
+// SetRetry sets the RetryPolicy (default: DefaultRetry).
+func (mw *MetricWriter) SetRetry(rp RetryPolicy) *MetricWriter {
+	mw.retry = rp
+	return mw
+}
+
+// Sends a batch
+func (mw *MetricWriter) send(ms []*Metric) error {
+	body, err := mw.encode(ms)
+	if err != nil || len(body) == 0 {
+		return err
+	}
+	header := mw.header.Clone()
+	if mw.compress && header.Get("Content-Encoding") == "" {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(body)
+		zw.Close()
+		body = buf.Bytes()
+		header.Set("Content-Encoding", "gzip")
+	}
+	_, err = mw.retry.run(nil, func() (bool, error) {
+		req, err := http.NewRequest("POST", mw.url, bytes.NewReader(body))
+		if err != nil {
+			return false, err
+		}
+		req.Header = header
+		rsp, err := mw.client.Do(req)
+		if err != nil {
+			return true, err
+		}
+		if rsp.StatusCode/100 != 2 {
+			msg := make([]byte, 512)
+			n, _ := rsp.Body.Read(msg)
+			discardBody(rsp.Body)
+			return retryableStatus(rsp.StatusCode), errors.New(fmt.Sprintf("%s: %s: %s", mw.url, rsp.Status, strings.TrimSpace(string(msg[:n]))))
+		}
+		discardBody(rsp.Body)
+		return false, nil
+	})
+	return err
+}
+
+// Consume is the pre-defined method that makes MetricWriter a Consumer.
+// Consume terminates with an error if an item cannot be converted
+// or a batch cannot be sent.
+func (mw *MetricWriter) Consume(src conduit.Source) error {
+	var batch []*Metric
+	var timer *time.Timer
+	var expired <-chan time.Time
+	flush := func() error {
+		if timer != nil {
+			timer.Stop()
+			timer, expired = nil, nil
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+		err := mw.send(batch)
+		batch = nil
+		return err
+	}
+	for {
+		select {
+		case inp, ok := <-src:
+			if !ok {
+				return flush()
+			}
+			if conduit.IsBarrier(inp) {
+				if err := flush(); err != nil {
+					return err
+				}
+				continue
+			}
+			m, err := mw.convert(inp)
+			if err != nil {
+				return err
+			}
+			batch = append(batch, m)
+			if len(batch) == 1 && mw.maxAge > 0 {
+				timer = time.NewTimer(mw.maxAge)
+				expired = timer.C
+			}
+			if len(batch) >= mw.batch {
+				if err = flush(); err != nil {
+					return err
+				}
+			}
+		case <-expired:
+			timer, expired = nil, nil
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
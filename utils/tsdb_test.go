@@ -0,0 +1,305 @@
+package utils
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+// Decodes the snappy block format
+func snappyDecode(src []byte) ([]byte, error) {
+	n, k := binary.Uvarint(src)
+	if k <= 0 {
+		return nil, errors.New("invalid length")
+	}
+	src = src[k:]
+	var dst []byte
+	for len(src) > 0 {
+		tag := src[0]
+		switch tag & 3 {
+		case 0:
+			l := int(tag >> 2)
+			src = src[1:]
+			if l >= 60 {
+				b := l - 59
+				l = 0
+				for i := b - 1; i >= 0; i-- {
+					l = l<<8 | int(src[i])
+				}
+				src = src[b:]
+			}
+			l++
+			if l > len(src) {
+				return nil, errors.New("short literal")
+			}
+			dst = append(dst, src[:l]...)
+			src = src[l:]
+			continue
+		}
+		var l, off int
+		switch tag & 3 {
+		case 1:
+			l, off = int(tag>>2&7)+4, int(tag>>5)<<8|int(src[1])
+			src = src[2:]
+		case 2:
+			l, off = int(tag>>2)+1, int(binary.LittleEndian.Uint16(src[1:]))
+			src = src[3:]
+		case 3:
+			l, off = int(tag>>2)+1, int(binary.LittleEndian.Uint32(src[1:]))
+			src = src[5:]
+		}
+		if off == 0 || off > len(dst) {
+			return nil, errors.New("invalid offset")
+		}
+		for i := 0; i < l; i++ {
+			dst = append(dst, dst[len(dst)-off])
+		}
+	}
+	if uint64(len(dst)) != n {
+		return nil, errors.New("invalid length")
+	}
+	return dst, nil
+}
+
+// Decodes protobuf fields into values (varint or fixed64) and bytes
+type pbField struct {
+	num  int
+	val  uint64
+	data []byte
+}
+
+func pbDecode(b []byte) []pbField {
+	var fields []pbField
+	for len(b) > 0 {
+		key, k := binary.Uvarint(b)
+		b = b[k:]
+		f := pbField{num: int(key >> 3)}
+		switch key & 7 {
+		case 0:
+			f.val, k = binary.Uvarint(b)
+			b = b[k:]
+		case 1:
+			f.val = binary.LittleEndian.Uint64(b)
+			b = b[8:]
+		case 2:
+			n, k := binary.Uvarint(b)
+			f.data = b[k : k+int(n)]
+			b = b[k+int(n):]
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+// Decodes a WriteRequest as name{labels} value@time per sample
+func promDecode(req []byte) []string {
+	var samples []string
+	for _, ts := range pbDecode(req) {
+		var labels []string
+		for _, f := range pbDecode(ts.data) {
+			switch f.num {
+			case 1:
+				l := pbDecode(f.data)
+				labels = append(labels, fmt.Sprintf("%s=%s", l[0].data, l[1].data))
+			case 2:
+				s := pbDecode(f.data)
+				samples = append(samples, fmt.Sprintf("{%s} %v@%d", strings.Join(labels, ","), math.Float64frombits(s[0].val), int64(s[1].val)))
+			}
+		}
+	}
+	return samples
+}
+
+// TSDB test server; the first request fails with 503
+type tsdbServer struct {
+	*httptest.Server
+	door     sync.Mutex
+	requests int
+	bodies   []string
+}
+
+func newTSDBServer(t *testing.T) *tsdbServer {
+	s := &tsdbServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.door.Lock()
+		defer s.door.Unlock()
+		s.requests++
+		if user, pass, _ := r.BasicAuth(); r.Header.Get("Authorization") != "Token secret" && (user != "user" || pass != "p@ss") {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if s.requests == 1 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		switch {
+		case r.URL.Path == "/api/v2/write" && r.Header.Get("Content-Encoding") == "gzip":
+			zr, err := gzip.NewReader(bytes.NewReader(body))
+			if err == nil {
+				body, err = ioutil.ReadAll(zr)
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		case r.URL.Path == "/api/v2/write":
+		case r.URL.Path == "/api/v1/write" && r.Header.Get("Content-Encoding") == "snappy" &&
+			r.Header.Get("Content-Type") == "application/x-protobuf":
+			req, err := snappyDecode(body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			body = []byte(strings.Join(promDecode(req), "\n"))
+		default:
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		s.bodies = append(s.bodies, string(body))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	return s
+}
+
+func TestMarshalInflux(t *testing.T) {
+	m := Metric{
+		Name: "cpu load",
+		Tags: map[string]string{"host": "a,b=c", "empty": ""},
+		Fields: map[string]interface{}{"v": 1.5, "n": -3, "u": uint64(7), "big": uint64(math.MaxUint64),
+			"s": `say "hi" \o/`, "ok": true},
+		Time: time.Unix(1, 500),
+	}
+	line, err := MarshalInflux(m)
+	want := `cpu\ load,host=a\,b\=c big=18446744073709551615u,n=-3i,ok=true,s="say \"hi\" \\o/",u=7i,v=1.5 1000000500` + "\n"
+	if err != nil || string(line) != want {
+		t.Errorf("MarshalInflux: %q (%v)", line, err)
+	}
+	for _, v := range []interface{}{&Metric{Name: "x"}, &Metric{Fields: map[string]interface{}{"v": 1}},
+		&Metric{Name: "x", Fields: map[string]interface{}{"v": math.NaN()}}, "x"} {
+		if _, err := MarshalInflux(v); err == nil {
+			t.Errorf("MarshalInflux: %v accepted", v)
+		}
+	}
+}
+
+func TestSnappy(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	random := make([]byte, 100000)
+	rnd.Read(random)
+	for _, data := range [][]byte{nil, []byte("abc"), bytes.Repeat([]byte("abcdefgh"), 10000),
+		random, []byte(strings.Repeat("x", 70) + string(random[:300]) + strings.Repeat("ab", 1000))} {
+		enc := snappyEncode(data)
+		dec, err := snappyDecode(enc)
+		if err != nil || !bytes.Equal(dec, data) {
+			t.Errorf("snappy: %d bytes not restored (%v)", len(data), err)
+		}
+		if len(data) == 80000 && len(enc) > 5000 {
+			t.Errorf("snappy: %d bytes compressed to %d", len(data), len(enc))
+		}
+	}
+}
+
+// InfluxDB writer:
+// - Batches are sent in line protocol with timestamps in the precision
+// - Records are converted by RecordMetric
+// - Failed requests are retried
+func TestInfluxWriter(t *testing.T) {
+	srv := newTSDBServer(t)
+	defer srv.Close()
+
+	if NewInfluxWriter("ftp://host/write") != nil || NewInfluxWriter(srv.URL+"/api/v2/write?precision=h") != nil {
+		t.Errorf("InfluxWriter: invalid URL accepted")
+	}
+	var items []interface{}
+	for i := 0; i < 5; i++ {
+		items = append(items, Record{"host": fmt.Sprint("h", i), "used": i * 10, "free": 0.5, "note": nil,
+			"time": time.Unix(int64(i), 2000000)})
+	}
+	items = append(items, &conduit.Barrier{}, Record{"host": "x", "used": 1})
+	iw := NewInfluxWriter(srv.URL+"/api/v2/write?org=o&bucket=b&precision=ms").SetHeader("Authorization", "Token secret").
+		SetConvert(RecordMetric("mem", "host")).SetBatch(2).SetCompress().SetRetry(fastRetry)
+	if err := conduit.NewChain(&AnyProducer{src: items}, nil, iw, small).Run(); err != nil {
+		t.Fatalf("InfluxWriter failed: %v", err)
+	}
+	want := []string{
+		"mem,host=h0 free=0.5,used=0i 2\nmem,host=h1 free=0.5,used=10i 1002\n",
+		"mem,host=h2 free=0.5,used=20i 2002\nmem,host=h3 free=0.5,used=30i 3002\n",
+		"mem,host=h4 free=0.5,used=40i 4002\n",
+		"mem,host=x used=1i\n",
+	}
+	if srv.requests != 5 || fmt.Sprint(srv.bodies) != fmt.Sprint(want) {
+		t.Errorf("InfluxWriter: %d requests: %q", srv.requests, srv.bodies)
+	}
+
+	// items that cannot be converted fail
+	iw = NewInfluxWriter(strings.Replace(srv.URL, "http://", "http://user:p%40ss@", 1) + "/api/v2/write")
+	chn := conduit.NewChain(&AnyProducer{src: []interface{}{Metric{Name: "m", Fields: map[string]interface{}{"v": 1}}, "x"}}, nil, iw, small)
+	if chn.Run() == nil || !strings.Contains(fmt.Sprint(chn.Errs), "cannot convert string") {
+		t.Errorf("InfluxWriter: invalid item accepted: %v", chn.Errs)
+	}
+	if srv.requests != 5 {
+		t.Errorf("InfluxWriter: %d requests", srv.requests)
+	}
+	iw = NewInfluxWriter(strings.Replace(srv.URL, "http://", "http://user:p%40ss@", 1) + "/api/v2/write").SetMaxAge(time.Millisecond)
+	if err := conduit.NewChain(&AnyProducer{src: []interface{}{Metric{Name: "m", Fields: map[string]interface{}{"v": 1}}}}, nil, iw, small).Run(); err != nil {
+		t.Errorf("InfluxWriter failed with basic auth: %v", err)
+	}
+	if srv.bodies[len(srv.bodies)-1] != "m v=1i\n" {
+		t.Errorf("InfluxWriter: unexpected body %q", srv.bodies[len(srv.bodies)-1])
+	}
+}
+
+// Prometheus remote-write:
+// - Numeric fields are series named name_field with tags as labels
+// - Samples of a series are in order of time
+func TestPromWriter(t *testing.T) {
+	srv := newTSDBServer(t)
+	defer srv.Close()
+
+	items := []interface{}{
+		&Metric{Name: "http.requests", Tags: map[string]string{"code": "200", "path": "/"},
+			Fields: map[string]interface{}{"value": 10, "status": "ok"}, Time: time.Unix(20, 0)},
+		&Metric{Name: "http.requests", Tags: map[string]string{"path": "/", "code": "200"},
+			Fields: map[string]interface{}{"value": 7}, Time: time.Unix(10, 0)},
+		Metric{Name: "up", Tags: map[string]string{"job-name": "a"},
+			Fields: map[string]interface{}{"value": true, "latency": 0.25}, Time: time.Unix(10, 5000000)},
+		&Metric{Name: "info", Fields: map[string]interface{}{"version": "1.0"}},
+	}
+	pw := NewPromWriter(strings.Replace(srv.URL, "http://", "http://user:p%40ss@", 1) + "/api/v1/write").SetRetry(fastRetry)
+	if err := conduit.NewChain(&AnyProducer{src: items}, nil, pw, small).Run(); err != nil {
+		t.Fatalf("PromWriter failed: %v", err)
+	}
+	if srv.requests != 2 || len(srv.bodies) != 1 {
+		t.Fatalf("PromWriter: %d requests: %q", srv.requests, srv.bodies)
+	}
+	got := strings.Split(srv.bodies[0], "\n")
+	want := []string{
+		"{__name__=http_requests,code=200,path=/} 7@10000",
+		"{__name__=http_requests,code=200,path=/} 10@20000",
+		"{__name__=up_latency,job_name=a} 0.25@10005",
+		"{__name__=up,job_name=a} 1@10005",
+	}
+	if len(got) != 4 || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("PromWriter: samples not in order of time: %v", got)
+	}
+	sort.Strings(got)
+	sort.Strings(want)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("PromWriter: unexpected samples\n%s", strings.Join(got, "\n"))
+	}
+}
@@ -0,0 +1,206 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/toschoo/conduit"
+)
+
+// NewUnixServer creates a new TCPServer Producer
+// listening on the Unix stream socket path.
+// The socket file is removed at shutdown.
+func NewUnixServer(path string) (ts *TCPServer) {
+	ts = NewTCPServer(path)
+	if ts != nil {
+		ts.network = "unix"
+	}
+	return
+}
+
+// NewUnixClient creates a new TCPClient Consumer
+// connecting to the Unix stream socket path.
+func NewUnixClient(path string) (tc *TCPClient) {
+	tc = NewTCPClient(path)
+	if tc != nil {
+		tc.network = "unix"
+	}
+	return
+}
+
+// PacketReader is a Producer that receives datagrams
+// (e.g. on a Unix datagram socket or a UDP port)
+// and sends each datagram as []byte down the chain.
+// Datagrams longer than the maximum size (see SetMaxSize)
+// are truncated. The reader runs until the chain is canceled.
+type PacketReader struct {
+	conduit.Cancelable
+	network string
+	addr    string
+	max     int
+	door    sync.Mutex
+	pc      net.PacketConn
+}
+
+// NewPacketReader creates a new PacketReader Producer
+// listening on addr of network ("unixgram", "udp", ...).
+func NewPacketReader(network, addr string) (pr *PacketReader) {
+	pr = new(PacketReader)
+	if pr != nil {
+		pr.network = network
+		pr.addr = addr
+		pr.max = 64 * 1024
+	}
+	return
+}
+
+// NewUnixgramReader creates a new PacketReader Producer
+// listening on the Unix datagram socket path.
+// The socket file is removed at shutdown.
+func NewUnixgramReader(path string) *PacketReader {
+	return NewPacketReader("unixgram", path)
+}
+
+// SetMaxSize sets the maximum size of a datagram (default 64KiB).
+func (pr *PacketReader) SetMaxSize(n int) *PacketReader {
+	if n > 0 {
+		pr.max = n
+	}
+	return pr
+}
+
+// Cancel cancels the producer and closes the socket.
+func (pr *PacketReader) Cancel() {
+	pr.Cancelable.Cancel()
+	pr.door.Lock()
+	defer pr.door.Unlock()
+	if pr.pc != nil {
+		pr.pc.Close()
+	}
+}
+
+// Resume is the pre-defined method that makes PacketReader
+// a conduit.Resumer. Datagrams received before a restart
+// are not received again, so nothing is skipped.
+func (pr *PacketReader) Resume(pos uint64) error {
+	return nil
+}
+
+// Produce is the pre-defined method that makes PacketReader a Producer.
+// Produce terminates with an error if the socket cannot be opened
+// or read.
+func (pr *PacketReader) Produce(trg conduit.Target) error {
+	pc, err := net.ListenPacket(pr.network, pr.addr)
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+	pr.door.Lock()
+	pr.pc = pc
+	pr.door.Unlock()
+	buf := make([]byte, pr.max)
+	for !pr.Canceled() {
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			if pr.Canceled() {
+				break
+			}
+			return err
+		}
+		data := make([]byte, n)
+		copy(data, buf[:n])
+		trg <- data
+	}
+	return nil
+}
+
+// PacketWriter is a Consumer that sends each incoming
+// []byte or string item as a datagram
+// (e.g. to a Unix datagram socket or a UDP port).
+// Failed sends (e.g. when no receiver is listening
+// on a Unix socket) are retried according to the RetryPolicy
+// (DefaultRetry); the socket is then reconnected.
+type PacketWriter struct {
+	network string
+	addr    string
+	retry   RetryPolicy
+	conn    net.Conn
+}
+
+// NewPacketWriter creates a new PacketWriter Consumer
+// sending to addr of network ("unixgram", "udp", ...).
+func NewPacketWriter(network, addr string) (pw *PacketWriter) {
+	pw = new(PacketWriter)
+	if pw != nil {
+		pw.network = network
+		pw.addr = addr
+		pw.retry = DefaultRetry
+	}
+	return
+}
+
+// NewUnixgramWriter creates a new PacketWriter Consumer
+// sending to the Unix datagram socket path.
+func NewUnixgramWriter(path string) *PacketWriter {
+	return NewPacketWriter("unixgram", path)
+}
+
+// SetRetry sets the RetryPolicy (default: DefaultRetry).
+func (pw *PacketWriter) SetRetry(rp RetryPolicy) *PacketWriter {
+	pw.retry = rp
+	return pw
+}
+
+// Consume is the pre-defined method that makes PacketWriter a Consumer.
+// Consume terminates with an error if an item is not []byte or string
+// or cannot be sent after all attempts.
+func (pw *PacketWriter) Consume(src conduit.Source) error {
+	defer pw.close()
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			continue
+		}
+		var data []byte
+		switch x := inp.(type) {
+		case []byte:
+			data = x
+		case string:
+			data = []byte(x)
+		default:
+			return errors.New(fmt.Sprintf("cannot send %T", inp))
+		}
+		attempts, err := pw.retry.run(nil, func() (bool, error) {
+			return true, pw.send(data)
+		})
+		if err != nil {
+			return errors.New(fmt.Sprintf("send failed after %d attempts: %v", attempts, err))
+		}
+	}
+	return nil
+}
+
+// Sends one datagram, connecting if necessary;
+// the socket is closed on error
+func (pw *PacketWriter) send(data []byte) error {
+	if pw.conn == nil {
+		conn, err := net.Dial(pw.network, pw.addr)
+		if err != nil {
+			return err
+		}
+		pw.conn = conn
+	}
+	_, err := pw.conn.Write(data)
+	if err != nil {
+		pw.close()
+	}
+	return err
+}
+
+func (pw *PacketWriter) close() {
+	if pw.conn != nil {
+		pw.conn.Close()
+		pw.conn = nil
+	}
+}
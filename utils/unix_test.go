@@ -0,0 +1,127 @@
+package utils
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+var slowRetry = RetryPolicy{Attempts: 50, Backoff: ConstantBackoff(10 * time.Millisecond)}
+
+// Unix stream sockets:
+// - Framed messages from a client arrive complete
+// - The socket file is removed at shutdown
+func TestUnixServer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stream.sock")
+	msgs := []interface{}{"one", "two", []byte("three")}
+	c := &TakeConsumer{n: len(msgs)}
+	done := make(chan error)
+	go func() {
+		done <- conduit.NewChain(NewUnixServer(path).SetPipe(deframed), nil, c, small).Run()
+	}()
+
+	chn := conduit.NewChain(&AnyProducer{msgs}, []conduit.Conduit{NewFramer(4, binary.BigEndian)},
+		NewUnixClient(path).SetRetry(slowRetry), small)
+	if err := chn.Run(); err != nil {
+		t.Fatalf("UnixClient failed: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("UnixServer failed: %v", err)
+	}
+	if fmt.Sprintf("%s", c.recvd) != "[one two three]" {
+		t.Errorf("UnixServer: unexpected messages %s", c.recvd)
+	}
+	if _, err := net.Dial("unix", path); err == nil {
+		t.Errorf("UnixServer: socket still open")
+	}
+}
+
+// Chain server on a Unix socket:
+// - The connection is echoed
+func TestUnixChainServer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "echo.sock")
+	srv := NewTCPChainServer(func(net.Conn) []conduit.Conduit { return nil })
+	served := make(chan error)
+	go func() { served <- srv.ListenAndServeUnix(path) }()
+	defer func() {
+		srv.Close()
+		if err := <-served; err != nil {
+			t.Errorf("TCPChainServer: unexpected error %v", err)
+		}
+	}()
+
+	var conn net.Conn
+	_, err := slowRetry.run(nil, func() (bool, error) {
+		var err error
+		conn, err = net.Dial("unix", path)
+		return true, err
+	})
+	if err != nil {
+		t.Fatalf("TCPChainServer: cannot connect: %v", err)
+	}
+	conn.Write([]byte("hello unix"))
+	conn.(*net.UnixConn).CloseWrite()
+	data, _ := ioutil.ReadAll(conn)
+	conn.Close()
+	if string(data) != "hello unix" {
+		t.Errorf("TCPChainServer: unexpected echo %q", data)
+	}
+}
+
+// Unix datagram sockets:
+// - Each item is received as one datagram
+// - The writer waits for the reader according to the retry policy
+// - The writer fails without reader
+func TestUnixgram(t *testing.T) {
+	for i := 0; i < numOfTests; i++ {
+		err := testUnixgram(filepath.Join(t.TempDir(), "dgram.sock"), 100)
+		if err != nil {
+			m := fmt.Sprintf("Unixgram failed: %v", err)
+			t.Error(m)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "nobody.sock")
+	chn := conduit.NewChain(&AnyProducer{[]interface{}{"hello?"}}, nil, NewUnixgramWriter(path).SetRetry(fastRetry), small)
+	if chn.Run() == nil {
+		t.Errorf("UnixgramWriter: failed send not reported")
+	}
+}
+
+func testUnixgram(path string, n int) error {
+	var want []string
+	var msgs []interface{}
+	for i := 0; i < n; i++ {
+		m := fmt.Sprintf("datagram %d", i)
+		want = append(want, m)
+		msgs = append(msgs, m)
+	}
+	c := &TakeConsumer{n: n}
+	done := make(chan error)
+	go func() {
+		done <- conduit.NewChain(NewUnixgramReader(path), nil, c, small).Run()
+	}()
+	chn := conduit.NewChain(&AnyProducer{msgs}, nil, NewUnixgramWriter(path).SetRetry(slowRetry), small)
+	if err := chn.Run(); err != nil {
+		return err
+	}
+	if err := <-done; err != nil {
+		return err
+	}
+	var have []string
+	for _, d := range c.recvd {
+		have = append(have, string(d.([]byte)))
+	}
+	if fmt.Sprint(have) != fmt.Sprint(want) {
+		m := fmt.Sprintf("expected %d datagrams in order, have %d: %q", len(want), len(have), have)
+		return errors.New(m)
+	}
+	return nil
+}
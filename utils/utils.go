@@ -4,7 +4,9 @@
 package utils
 
 import (
-	"encoding/csv"
+	"bytes"
+	"encoding/gob"
+	"errors"
 	"fmt"
 	"github.com/toschoo/conduit"
 	"io"
@@ -22,15 +24,16 @@ type Generator interface {
 // Generic is a Producer that uses a Generator
 // to create data. It continues calling Generate()
 // and sending the result down the chain, util
-// Generate() returns io.EOF.
+// Generate() returns io.EOF or Generic is canceled.
 type Generic struct {
+	conduit.Cancelable
 	gen Generator
 }
 
 // Produce is the pre-defined method that
 // makes Generic a Producer.
 func (g *Generic) Produce(trg conduit.Target) error {
-	for {
+	for !g.Canceled() {
 		rec, err := g.gen.Generate()
 		if err != nil {
 			if err == io.EOF {
@@ -57,6 +60,7 @@ func NewGeneric(gen Generator) (g *Generic) {
 // read from some kind of source 
 // into the processing chain.
 type Reader struct {
+	conduit.Cancelable
 	rd   io.Reader
 	sz   int
 }
@@ -64,7 +68,7 @@ type Reader struct {
 // Produce is the pre-defined method that
 // makes Reader a Producer.
 func (rd *Reader) Produce(trg conduit.Target) error {
-	for {
+	for !rd.Canceled() {
 		buf := make([]byte,rd.sz)
 		n, err := rd.rd.Read(buf)
 		if err != nil {
@@ -94,71 +98,6 @@ func NewReader(reader io.Reader) (r *Reader) {
 	return
 }
 
-// CSV is a Producer that feeds data
-// read from a CSV-encoded source 
-// line by line into the processing chain.
-// CSV releases data as string slices,
-// each slice representing 
-// one line in the CSV source.
-type CSV struct {
-	Rd *csv.Reader
-}
-
-// Produce is the pre-defined method that
-// makes CSV a Producer.
-func (p *CSV) Produce(trg conduit.Target) error {
-	for {
-		rec, err := p.Rd.Read()
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return err
-		}
-		trg <- rec
-	}
-	return nil
-}
-
-// NewCSV creates a new CSV Producer
-// using some kind of io.Reader.
-func NewCSV (r io.Reader) (p *CSV) {
-	p = new(CSV)
-	if p != nil {
-		p.Rd = csv.NewReader(r)
-	}
-	return
-}
-
-// CSW is a Consumer that feeds data
-// read from a CSV-encoded source 
-// line by line into the processing chain.
-// CSW receives data as string slices,
-// each slice representing 
-// one line in the CSV target.
-type CSW struct {
-	Wt *csv.Writer
-}
-
-// Consume is the pre-defined method that
-// makes CSW a Consumer.
-func (csw *CSW) Consume(src conduit.Source) error {
-	for inp := range src {
-		line := inp.([]string)
-		csw.Wt.Write(line)
-	}
-	csw.Wt.Flush()
-	return nil
-}
-
-// NewCSW creates a new CSV Consumer
-// using some kind of io.Writer.
-func NewCSW(stream io.Writer) *CSW {
-	csw := new(CSW)
-	csw.Wt = csv.NewWriter(stream)
-	return csw
-}
-
 // Identity is a Conduit that 
 // forwards incoming data as is.
 // It is useful only as a demonstration
@@ -188,6 +127,14 @@ type Sieve interface {
 	Sieve(interface{}) bool
 }
 
+// SieveFunc is an ordinary function used as Sieve.
+type SieveFunc func(interface{}) bool
+
+// Sieve calls f(inp).
+func (f SieveFunc) Sieve(inp interface{}) bool {
+	return f(inp)
+}
+
 // Filter is a Conduit that 
 // forwards incoming data based on a Sieve.
 // Only those data are passed onward that
@@ -199,6 +146,10 @@ type Filter struct {
 // Conduct is the predefined method that makes Filter a Conduit.
 func (fil *Filter) Conduct(src conduit.Source, trg conduit.Target) error {
 	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			trg <- inp
+			continue
+		}
 		if fil.f.Sieve(inp) {
 			trg <- inp
 		}
@@ -223,6 +174,14 @@ type Transform interface {
 	Transform(interface{}) (interface{}, error)
 }
 
+// TransformFunc is an ordinary function used as Transform.
+type TransformFunc func(interface{}) (interface{}, error)
+
+// Transform calls f(inp).
+func (f TransformFunc) Transform(inp interface{}) (interface{}, error) {
+	return f(inp)
+}
+
 // Transformer is a conduit that uses a Transform
 // to process incoming data. It passes the result
 // onward in the processing chain.
@@ -237,6 +196,10 @@ type Transformer struct {
 // Conduct is the pre-defined method that makes Transformer a Conduit.
 func (trn *Transformer) Conduct(src conduit.Source, trg conduit.Target) error {
 	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			trg <- inp
+			continue
+		}
 		oup, err := trn.t.Transform(inp)
 		if err != nil {
 			return err
@@ -259,6 +222,20 @@ func NewTransformer(trnf Transform) (trn *Transformer) {
 	return
 }
 
+// Utf8Mode defines how Utf8Conduit handles invalid input.
+type Utf8Mode int
+
+const (
+	// Utf8Replace replaces runes that cannot be completed
+	// at the block edges by utf8.RuneError
+	// (invalid bytes within blocks are not inspected).
+	Utf8Replace Utf8Mode = iota
+	// Utf8Error terminates with an error on invalid input.
+	Utf8Error
+	// Utf8Drop removes invalid bytes from the stream.
+	Utf8Drop
+)
+
 // Utf8Conduit receives a stream of bytes
 // that represent utf8-encoded runes;
 // Utf8Conduit guarantees that each block
@@ -270,138 +247,187 @@ func NewTransformer(trnf Transform) (trn *Transformer) {
 // invalid rune, then Utf8Conduit guarantees
 // that the outgoing stream does not contain
 // invalid runes either.
+// By default, only the block edges are inspected:
+// incomplete runes at the end of a block
+// are completed with the beginning of the next one;
+// if that fails, they are replaced by utf8.RuneError.
+// An incomplete rune at the end of the stream is dropped.
+// Other behaviour can be chosen with SetMode.
+// The incomplete rune is included in checkpoints
+// (see conduit.Checkpointer).
 type Utf8Conduit struct {
-	lo  []byte
-	inv []byte
-	idx int
+	mode     Utf8Mode
+	pos      int64  // stream position of the current block
+	carry    []byte // incomplete rune at the end of the last block
+	arena    []byte // storage for runes completed across blocks
+	restored bool   // pos and carry were restored from a checkpoint
 }
 
 // Conduct makes Utf8Conduit a Conduit
 func (u *Utf8Conduit) Conduct(src conduit.Source, trg conduit.Target) error {
+	if !u.restored {
+		u.pos = 0
+		u.carry = u.carry[:0]
+	}
+	u.restored = false
 	for inp := range src {
 
-		bs := inp.([]byte)
+		if conduit.IsBarrier(inp) {
+			trg <- inp
+			continue
+		}
 
-		n := u.addLeftOver(bs, trg)
-		b2 := bs[n:]
+		bs := inp.([]byte)
+		pos := u.pos
+		u.pos += int64(len(bs))
+
+		if len(u.carry) > 0 {
+			k := len(bs)
+			var err error
+			bs, err = u.complete(bs, trg)
+			if err != nil {
+				return err
+			}
+			pos += int64(k - len(bs))
+		}
 
-		l := u.storeLeftOver(b2)
-		if len(b2[:l]) > 0 {
-			trg <- b2[:l]
+		n := len(bs) - incompleteTail(bs)
+		out := bs[:n]
+		if u.mode != Utf8Replace && !utf8.Valid(out) {
+			if u.mode == Utf8Error {
+				return u.invalid(pos + int64(invalidAt(out)))
+			}
+			out = dropInvalid(out)
 		}
+		if len(out) > 0 {
+			trg <- out
+		}
+		u.carry = append(u.carry, bs[n:]...)
+	}
+	if len(u.carry) > 0 && u.mode == Utf8Error {
+		return u.invalid(u.pos - int64(len(u.carry)))
 	}
+	u.carry = u.carry[:0]
 	return nil
 }
 
 // NewUtf8Conduit creates a new conduit
 func NewUtf8Conduit() *Utf8Conduit {
 	u := new(Utf8Conduit)
-	u.lo = make([]byte,utf8.UTFMax)
-	u.inv = make([]byte,3)
-	_ = utf8.EncodeRune(u.inv, utf8.RuneError)
+	u.carry = make([]byte, 0, utf8.UTFMax)
 	return u
 }
 
-// helper for Utf8Conduit that stores leftover bytes,
-// i.e. bytes at the end of the buffer that do not
-//      form a valid rune
-func (u *Utf8Conduit) storeLeftOver(bs []byte) int {
-
-	s := len(bs)
+type utf8State struct {
+	Pos   int64
+	Carry []byte
+}
 
-	// buf is empty: nothing to do
-	if s == 0 {
-		return 0
+// Snapshot is the pre-defined method that makes Utf8Conduit
+// a conduit.Checkpointer.
+func (u *Utf8Conduit) Snapshot() ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(&utf8State{Pos: u.pos, Carry: u.carry})
+	if err != nil {
+		return nil, err
 	}
+	return buf.Bytes(), nil
+}
 
-	r, _ := utf8.DecodeLastRune(bs)
-
-	// last rune complete: nothing to do
-	if r != utf8.RuneError {
-		return s
+// Restore is the pre-defined method that makes Utf8Conduit
+// a conduit.Checkpointer.
+func (u *Utf8Conduit) Restore(b []byte) error {
+	var st utf8State
+	err := gob.NewDecoder(bytes.NewReader(b)).Decode(&st)
+	if err != nil {
+		return err
 	}
+	u.pos = st.Pos
+	u.carry = append(u.carry[:0], st.Carry...)
+	u.restored = true
+	return nil
+}
 
-	l := s-1
+// SetMode defines how invalid input is handled;
+// the default is Utf8Replace.
+// Utf8Error and Utf8Drop validate the entire stream
+// and are therefore slower.
+func (u *Utf8Conduit) SetMode(mode Utf8Mode) *Utf8Conduit {
+	u.mode = mode
+	return u
+}
 
-	// buf has only one element, grab it
-	if l == 0 {
-		u.lo[u.idx] = bs[l]
-		u.idx++
-		return s-1
-	}
+var replacementChar = []byte(string(utf8.RuneError))
 
-	// go backwards in the buf, until we find
-	// a valid rune (at most UTFMax byte); 
-	// the bytes ahead of the end
-	// of that rune are leftovers. 
-	min := s-utf8.UTFMax
-	for ; l >= 0 && l > min; l-- {
-		r, _ := utf8.DecodeLastRune(bs[:l])
-		if r != utf8.RuneError {
-			for i:=l; i<s; i++ {
-				u.lo[u.idx] = bs[i]
-				u.idx++
-			}
-			return l
-		}
+// helper for Utf8Conduit that completes the leftover rune
+// with bytes from the beginning of bs;
+// returns the remainder of bs
+func (u *Utf8Conduit) complete(bs []byte, trg conduit.Target) ([]byte, error) {
+	i := 0
+	for ; i < len(bs) && !utf8.FullRune(u.carry); i++ {
+		u.carry = append(u.carry, bs[i])
 	}
-	// invalid utf
-	if u.idx == utf8.UTFMax {
-		return s
+	// still incomplete: wait for the next block
+	if !utf8.FullRune(u.carry) {
+		return nil, nil
 	}
-	// buffer < utf8.UTFMax
-	l++
-	for i:=l; i<s; i++ {
-		u.lo[u.idx] = bs[i]
-		u.idx++
+	r, n := utf8.DecodeRune(u.carry)
+	if r == utf8.RuneError && n < len(u.carry) {
+		// invalid: handle the leftover, keep the new bytes
+		k := len(u.carry) - i
+		u.carry = u.carry[:0]
+		switch u.mode {
+		case Utf8Error:
+			return nil, u.invalid(u.pos - int64(len(bs)+k))
+		case Utf8Replace:
+			trg <- u.store(replacementChar)
+		}
+		return bs, nil
 	}
-	return l
+	trg <- u.store(u.carry)
+	u.carry = u.carry[:0]
+	return bs[i:], nil
 }
 
-// helper for Utf8Conduit that completes runes
-// using the leftover bytes
-func (u *Utf8Conduit) addLeftOver(bs []byte, trg conduit.Target) int {
+// helper for Utf8Conduit that creates the error for invalid input
+func (u *Utf8Conduit) invalid(pos int64) error {
+	return errors.New(fmt.Sprintf("invalid UTF-8 at byte %d", pos))
+}
 
-	// no leftovers
-	if u.idx == 0 {
-		return 0
+// Returns the index of the first invalid byte in b
+func invalidAt(b []byte) int {
+	for i := 0; i < len(b); {
+		r, n := utf8.DecodeRune(b[i:])
+		if r == utf8.RuneError && n == 1 {
+			return i
+		}
+		i += n
 	}
+	return len(b)
+}
 
-	// start with the leftovers
-	tmp := make([]byte, u.idx)
-	copy(tmp, u.lo[:u.idx])
-
-	i:=0
-	s := len(bs)
-
-	// add bytes until we have a valid rune,
-	// at most UTFMax
-	for ; i<s && u.idx < utf8.UTFMax; i++ {
-
-		tmp = append(tmp,bs[i])
-
-		// complete: send it
-		if utf8.FullRune(tmp) {
-			trg <- tmp
-			u.idx = 0
-			return i+1
+// Returns a copy of b without invalid bytes
+func dropInvalid(b []byte) []byte {
+	out := make([]byte, 0, len(b))
+	for i := 0; i < len(b); {
+		r, n := utf8.DecodeRune(b[i:])
+		if r != utf8.RuneError || n > 1 {
+			out = append(out, b[i:i+n]...)
 		}
-
-		// remember for the case
-		// the buffer is smaller 
-		// than UTF8Max
-		u.lo[u.idx] = bs[i]
-		u.idx++;
-	}
-	// invalid rune
-	if u.idx == utf8.UTFMax {
-		trg <- u.inv
-		u.idx = 0
-		return i
+		i += n
 	}
+	return out
+}
 
-	// ignore entire buffer
-	return s
+// helper for Utf8Conduit that copies b to the arena,
+// so that small pieces do not need an allocation each
+func (u *Utf8Conduit) store(b []byte) []byte {
+	if cap(u.arena)-len(u.arena) < len(b) {
+		u.arena = make([]byte, 0, 4096)
+	}
+	k := len(u.arena)
+	u.arena = append(u.arena, b...)
+	return u.arena[k:len(u.arena):len(u.arena)]
 }
 
 // Printer is a Consumer that writes the result
@@ -415,6 +441,9 @@ type Printer struct {
 // that makes Printer a Consumer.
 func (prn *Printer) Consume(src conduit.Source) error {
 	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			continue
+		}
 		if prn.text {
 			buf := inp.([]byte)
 			runes := string(buf)
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"github.com/toschoo/conduit"
 	"math/rand"
+	"strings"
 	"testing"
 	"time"
 	"unicode/utf8"
@@ -308,3 +309,205 @@ func testUtf8ConduitChain() error {
 	return nil
 }
 
+
+// Blocks of mixed text for Utf8Conduit benchmarks
+func utf8BenchBlocks(total, size int) [][]byte {
+	text := []byte(strings.Repeat("Hello, wörld! 爾欠少什麼。道流 😀 ", total/40+1))[:total]
+	var blocks [][]byte
+	for i := 0; i < len(text); i += size {
+		j := i + size
+		if j > len(text) {
+			j = len(text)
+		}
+		blocks = append(blocks, text[i:j])
+	}
+	return blocks
+}
+
+type blockProducer struct {
+	blocks [][]byte
+}
+
+func (p *blockProducer) Produce(trg conduit.Target) error {
+	for _, b := range p.blocks {
+		trg <- b
+	}
+	return nil
+}
+
+type discardConsumer struct{}
+
+func (c discardConsumer) Consume(src conduit.Source) error {
+	for range src {
+	}
+	return nil
+}
+
+func benchmarkUtf8Conduit(b *testing.B, size int) {
+	blocks := utf8BenchBlocks(1<<20, size)
+	b.SetBytes(1 << 20)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		chn := conduit.NewChain(&blockProducer{blocks}, []conduit.Conduit{NewUtf8Conduit()}, discardConsumer{}, small)
+		if chn.Run() != nil {
+			b.Fatalf("Utf8Conduit failed: %v", chn.Errs)
+		}
+	}
+}
+
+func BenchmarkUtf8Conduit8K(b *testing.B) { benchmarkUtf8Conduit(b, 8192) }
+func BenchmarkUtf8Conduit64(b *testing.B) { benchmarkUtf8Conduit(b, 64) }
+
+// Runs Utf8Conduit in mode on data split into blocks of size
+func runUtf8Conduit(mode Utf8Mode, data []byte, size int) ([][]byte, error) {
+	var blocks [][]byte
+	for i := 0; i < len(data); i += size {
+		j := i + size
+		if j > len(data) {
+			j = len(data)
+		}
+		blocks = append(blocks, data[i:j])
+	}
+	c := new(AnyConsumer)
+	chn := conduit.NewChain(&blockProducer{blocks}, []conduit.Conduit{NewUtf8Conduit().SetMode(mode)}, c, small)
+	err := chn.Run()
+	var out [][]byte
+	for _, b := range c.recvd {
+		out = append(out, b.([]byte))
+	}
+	return out, err
+}
+
+// Utf8Conduit modes
+// - Replace replaces runes broken at the block edges
+// - Error fails on invalid bytes anywhere in the stream
+// - Drop removes invalid bytes
+func TestUtf8ConduitModes(t *testing.T) {
+	data := []byte("ab\xe2\x82c\xffd€")
+	type sample struct {
+		mode Utf8Mode
+		size int
+		want string
+		fail bool
+	}
+	samples := []sample{
+		{Utf8Replace, 4, "ab�c\xffd€", false},
+		{Utf8Drop, 4, "abcd€", false},
+		{Utf8Drop, 1, "abcd€", false},
+		{Utf8Error, 4, "", true},
+		{Utf8Error, 100, "", true},
+		{Utf8Error, 3, "", true},
+	}
+	for _, s := range samples {
+		out, err := runUtf8Conduit(s.mode, data, s.size)
+		if (err != nil) != s.fail {
+			t.Errorf("Utf8Conduit mode %d, size %d: unexpected error: %v", s.mode, s.size, err)
+			continue
+		}
+		if !s.fail && string(bytes.Join(out, nil)) != s.want {
+			t.Errorf("Utf8Conduit mode %d, size %d: expected %q, have %q", s.mode, s.size, s.want, bytes.Join(out, nil))
+		}
+	}
+
+	_, err := runUtf8Conduit(Utf8Error, []byte("abc\xe2\x82"), 2)
+	if err == nil {
+		t.Errorf("Utf8Conduit accepted an incomplete rune at the end")
+	}
+}
+
+func FuzzUtf8Conduit(f *testing.F) {
+	f.Add([]byte("Hello, wörld! 爾欠少什麼 😀"), uint8(3))
+	f.Add([]byte("ab\xe2\x82c\xffd€\xf0\x9f"), uint8(1))
+	f.Add([]byte{0xed, 0xa0, 0x80, 0xc0, 0xaf, 0xf4, 0x90, 0x80, 0x80}, uint8(2))
+	f.Fuzz(func(t *testing.T, data []byte, size uint8) {
+		sz := int(size%16) + 1
+		valid := utf8.Valid(data)
+
+		out, err := runUtf8Conduit(Utf8Error, data, sz)
+		if valid != (err == nil) {
+			t.Fatalf("Error mode: valid: %v, error: %v", valid, err)
+		}
+		if valid && !bytes.Equal(bytes.Join(out, nil), data) {
+			t.Fatalf("Error mode: output differs from input")
+		}
+
+		out, err = runUtf8Conduit(Utf8Drop, data, sz)
+		if err != nil {
+			t.Fatalf("Drop mode failed: %v", err)
+		}
+		for _, b := range out {
+			if !utf8.Valid(b) {
+				t.Fatalf("Drop mode: invalid block % x", b)
+			}
+		}
+		if valid && !bytes.Equal(bytes.Join(out, nil), data) {
+			t.Fatalf("Drop mode: output differs from input")
+		}
+
+		out, err = runUtf8Conduit(Utf8Replace, data, sz)
+		if err != nil {
+			t.Fatalf("Replace mode failed: %v", err)
+		}
+		if !valid {
+			return
+		}
+		for _, b := range out {
+			if !utf8.Valid(b) {
+				t.Fatalf("Replace mode: broken rune in % x", b)
+			}
+		}
+		if !bytes.Equal(bytes.Join(out, nil), data) {
+			t.Fatalf("Replace mode: output differs from input")
+		}
+	})
+}
+
+// Utf8Conduit with checkpoints:
+// - An incomplete rune preceding a barrier is included in the snapshot
+// - The restored Utf8Conduit completes the rune
+// - Errors report positions in the whole stream
+func TestUtf8ConduitRestore(t *testing.T) {
+	u := NewUtf8Conduit()
+	src := make(chan interface{}, 2)
+	trg := make(chan interface{}, 2)
+	done := make(chan error)
+	go func() { done <- u.Conduct(src, trg) }()
+	src <- []byte("a\xe2\x82")
+	src <- &conduit.Barrier{}
+	<-trg
+	<-trg // the barrier
+	b, err := u.Snapshot()
+	if err != nil {
+		t.Fatalf("Utf8ConduitRestore: cannot snapshot: %v", err)
+	}
+	close(src)
+	if err = <-done; err != nil {
+		t.Fatalf("Utf8ConduitRestore failed: %v", err)
+	}
+	u = NewUtf8Conduit()
+	if err = u.Restore(b); err != nil {
+		t.Fatalf("Utf8ConduitRestore: cannot restore: %v", err)
+	}
+	c := new(AnyConsumer)
+	chn := conduit.NewChain(&AnyProducer{[]interface{}{[]byte("\xac!")}}, []conduit.Conduit{u}, c, small)
+	if err = chn.Run(); err != nil {
+		t.Fatalf("Utf8ConduitRestore failed: %v", chn.Errs)
+	}
+	var out []byte
+	for _, b := range c.recvd {
+		out = append(out, b.([]byte)...)
+	}
+	if string(out) != "€!" {
+		t.Errorf("Utf8ConduitRestore: unexpected output %q", out)
+	}
+
+	u = NewUtf8Conduit().SetMode(Utf8Error)
+	if err = u.Restore(b); err != nil {
+		t.Fatalf("Utf8ConduitRestore: cannot restore: %v", err)
+	}
+	chn = conduit.NewChain(&AnyProducer{[]interface{}{[]byte("\xacx\xff")}}, []conduit.Conduit{u}, new(AnyConsumer), small)
+	err = chn.Run()
+	if err == nil || !strings.Contains(fmt.Sprint(chn.Errs), "at byte 5") {
+		t.Errorf("Utf8ConduitRestore: unexpected error %v", chn.Errs)
+	}
+}
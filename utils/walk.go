@@ -0,0 +1,194 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/toschoo/conduit"
+)
+
+// SymlinkPolicy defines how DirWalker treats symbolic links.
+type SymlinkPolicy int
+
+const (
+	// SymlinkSkip ignores symbolic links.
+	SymlinkSkip SymlinkPolicy = iota
+	// SymlinkReport sends links as entries of their own
+	// without following them.
+	SymlinkReport
+	// SymlinkFollow treats links like their targets;
+	// links to directories are walked, unless they lead
+	// into a directory that is already being walked.
+	SymlinkFollow
+)
+
+// WalkEntry is a file found by DirWalker.
+// Name is the path relative to the root with slashes,
+// Path the full path, Depth the number of directories
+// between the root and the file plus 1.
+// Body is a reader on the contents, if DirWalker
+// opens the files (see Stream), which must be closed;
+// otherwise, the file can be opened with Open when it is needed.
+type WalkEntry struct {
+	Name  string
+	Path  string
+	Depth int
+	Info  os.FileInfo
+	Body  io.ReadCloser
+}
+
+// Open opens the file of the entry for reading.
+func (e *WalkEntry) Open() (*os.File, error) {
+	return os.Open(e.Path)
+}
+
+// DirWalker is a Producer that walks a directory tree
+// and sends its files as *WalkEntry down the chain,
+// in lexical order within each directory.
+// Files can be selected with Include and Exclude;
+// excluded directories are not walked.
+// Errors reading directories or opening files
+// terminate the producer; files that vanish during
+// the walk are skipped.
+type DirWalker struct {
+	conduit.Cancelable
+	archiveFilter
+	root     string
+	exclude  []string
+	maxDepth int
+	links    SymlinkPolicy
+}
+
+// NewDirWalker creates a new DirWalker Producer
+// that walks the tree at root.
+func NewDirWalker(root string) (dw *DirWalker) {
+	fi, err := os.Stat(root)
+	if err != nil || !fi.IsDir() {
+		return nil
+	}
+	dw = new(DirWalker)
+	if dw != nil {
+		dw.root = root
+	}
+	return
+}
+
+// Include restricts the files to those matching one of the glob patterns
+// (see path.Match), either with their name or their base name.
+func (dw *DirWalker) Include(patterns ...string) *DirWalker {
+	dw.patterns = patterns
+	return dw
+}
+
+// Exclude skips files and directories matching one of the glob patterns,
+// either with their name or their base name (e.g. ".git").
+func (dw *DirWalker) Exclude(patterns ...string) *DirWalker {
+	dw.exclude = patterns
+	return dw
+}
+
+// SetMaxDepth restricts the walk to files up to depth n;
+// with 1, only the files in the root are sent (default: 0, unlimited).
+func (dw *DirWalker) SetMaxDepth(n int) *DirWalker {
+	dw.maxDepth = n
+	return dw
+}
+
+// SetSymlinks sets the SymlinkPolicy (default: SymlinkSkip).
+func (dw *DirWalker) SetSymlinks(p SymlinkPolicy) *DirWalker {
+	dw.links = p
+	return dw
+}
+
+// Stream opens the files and sends entries with Body.
+func (dw *DirWalker) Stream() *DirWalker {
+	dw.stream = true
+	return dw
+}
+
+func (dw *DirWalker) excluded(name string) bool {
+	f := archiveFilter{patterns: dw.exclude}
+	return len(dw.exclude) > 0 && f.match(name)
+}
+
+// Produce is the pre-defined method that makes DirWalker a Producer.
+func (dw *DirWalker) Produce(trg conduit.Target) error {
+	root, err := filepath.EvalSymlinks(dw.root)
+	if err != nil {
+		return err
+	}
+	return dw.walk("", 1, map[string]bool{root: true}, trg)
+}
+
+// Walks the directory rel at depth;
+// active holds the real paths of the directories being walked
+func (dw *DirWalker) walk(rel string, depth int, active map[string]bool, trg conduit.Target) error {
+	dir := filepath.Join(dw.root, filepath.FromSlash(rel))
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) && rel != "" {
+			return nil
+		}
+		return errors.New(fmt.Sprintf("walking %s failed: %v", dir, err))
+	}
+	for _, fi := range infos {
+		if dw.Canceled() {
+			return nil
+		}
+		name := path.Join(rel, fi.Name())
+		p := filepath.Join(dir, fi.Name())
+		if dw.excluded(name) {
+			continue
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			switch dw.links {
+			case SymlinkSkip:
+				continue
+			case SymlinkFollow:
+				target, err := os.Stat(p)
+				if err != nil {
+					// dangling link
+					continue
+				}
+				fi = target
+			}
+		}
+		if fi.IsDir() {
+			if dw.maxDepth > 0 && depth >= dw.maxDepth {
+				continue
+			}
+			rp, err := filepath.EvalSymlinks(p)
+			if err != nil || active[rp] {
+				continue
+			}
+			active[rp] = true
+			err = dw.walk(name, depth+1, active, trg)
+			delete(active, rp)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if !dw.match(name) {
+			continue
+		}
+		e := &WalkEntry{Name: name, Path: p, Depth: depth, Info: fi}
+		if dw.stream && fi.Mode().IsRegular() {
+			f, err := os.Open(p)
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			e.Body = f
+		}
+		trg <- e
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/toschoo/conduit"
+)
+
+// Walks dw and returns the names of the entries
+func walkNames(t *testing.T, dw *DirWalker) string {
+	c := &AnyConsumer{}
+	if err := conduit.NewChain(dw, nil, c, small).Run(); err != nil {
+		t.Fatalf("DirWalker failed: %v", err)
+	}
+	var names []string
+	for _, inp := range c.recvd {
+		e := inp.(*WalkEntry)
+		if e.Body != nil {
+			data, _ := ioutil.ReadAll(e.Body)
+			e.Body.Close()
+			names = append(names, e.Name+"="+string(data))
+			continue
+		}
+		names = append(names, e.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+// Directory walker:
+// - Files are sent in lexical order with include and exclude patterns
+// - Depth is limited on request
+// - Symbolic links are skipped, reported or followed without cycles
+func TestDirWalker(t *testing.T) {
+	root := t.TempDir()
+	for name, data := range map[string]string{
+		"b.txt": "b", "a.csv": "a", "sub/c.txt": "c", "sub/deep/d.txt": "d",
+		".git/config": "x", "sub/e.log": "e",
+	} {
+		p := filepath.Join(root, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(p), 0755)
+		if err := ioutil.WriteFile(p, []byte(data), 0644); err != nil {
+			t.Fatalf("DirWalker: cannot write %s: %v", name, err)
+		}
+	}
+	if NewDirWalker(filepath.Join(root, "b.txt")) != nil || NewDirWalker(filepath.Join(root, "missing")) != nil {
+		t.Errorf("DirWalker: invalid root accepted")
+	}
+
+	for _, tc := range []struct {
+		dw   *DirWalker
+		want string
+	}{
+		{NewDirWalker(root), ".git/config,a.csv,b.txt,sub/c.txt,sub/deep/d.txt,sub/e.log"},
+		{NewDirWalker(root).Exclude(".git", "*.log").Include("*.txt"), "b.txt,sub/c.txt,sub/deep/d.txt"},
+		{NewDirWalker(root).Exclude(".*", "sub/deep").SetMaxDepth(2), "a.csv,b.txt,sub/c.txt,sub/e.log"},
+		{NewDirWalker(root).SetMaxDepth(1).Stream(), "a.csv=a,b.txt=b"},
+	} {
+		if names := walkNames(t, tc.dw); names != tc.want {
+			t.Errorf("DirWalker: received %s, expected %s", names, tc.want)
+		}
+	}
+
+	// links to a file, to a parent directory (a cycle) and nowhere
+	if err := os.Symlink(filepath.Join(root, "b.txt"), filepath.Join(root, "sub", "link.txt")); err != nil {
+		t.Skipf("DirWalker: no symbolic links: %v", err)
+	}
+	os.Symlink(root, filepath.Join(root, "sub", "deep", "up"))
+	os.Symlink(filepath.Join(root, "missing"), filepath.Join(root, "dangling"))
+	os.Symlink(filepath.Join(root, "sub", "deep"), filepath.Join(root, "z"))
+	for _, tc := range []struct {
+		dw   *DirWalker
+		want string
+	}{
+		{NewDirWalker(root).Exclude(".git"), "a.csv,b.txt,sub/c.txt,sub/deep/d.txt,sub/e.log"},
+		{NewDirWalker(root).Exclude(".git").SetSymlinks(SymlinkReport), "a.csv,b.txt,dangling,sub/c.txt,sub/deep/d.txt,sub/deep/up,sub/e.log,sub/link.txt,z"},
+		{NewDirWalker(root).Exclude(".git").Include("*.txt").SetSymlinks(SymlinkFollow).Stream(),
+			"b.txt=b,sub/c.txt=c,sub/deep/d.txt=d,sub/link.txt=b,z/d.txt=d"},
+	} {
+		if names := walkNames(t, tc.dw); names != tc.want {
+			t.Errorf("DirWalker: received %s, expected %s", names, tc.want)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+// FileOp is the kind of change reported by a FileEvent.
+type FileOp int
+
+const (
+	FileCreated FileOp = iota
+	FileModified
+	FileRemoved
+)
+
+func (op FileOp) String() string {
+	switch op {
+	case FileCreated:
+		return "created"
+	case FileModified:
+		return "modified"
+	case FileRemoved:
+		return "removed"
+	}
+	return fmt.Sprintf("FileOp(%d)", int(op))
+}
+
+// FileEvent is a change of a file in a watched directory.
+// Name is the path relative to the directory, Path the full path.
+// Data holds the contents of the file if FileWatcher
+// reads the contents (see SetContents); otherwise,
+// the file can be opened with Open when it is needed.
+type FileEvent struct {
+	Op      FileOp
+	Dir     string
+	Name    string
+	Path    string
+	Size    int64
+	ModTime time.Time
+	Data    []byte
+}
+
+// Open opens the file of the event for reading.
+func (e *FileEvent) Open() (*os.File, error) {
+	return os.Open(e.Path)
+}
+
+// State of a watched file
+type watchedFile struct {
+	dir     string
+	name    string
+	size    int64
+	mod     time.Time
+	changed time.Time // last change of size or mtime
+	sent    bool      // an event has been sent
+	pending bool      // a change has not yet been sent
+}
+
+// FileWatcher is a Producer that watches directories
+// and sends changes of their files as *FileEvent down the chain,
+// optionally restricted to files matching glob patterns
+// (see Match) and including subdirectories (see SetRecursive).
+// The directories are scanned periodically (see SetInterval),
+// which works on all platforms and file systems, including
+// network shares, where change notifications are unreliable.
+// Files present at the first scan are reported as created
+// unless SkipExisting is set; removed files are reported
+// only with ReportRemoved.
+// With SetDebounce, a change is reported only when the file
+// has not changed for some time, so that files that are
+// still being written are not processed prematurely.
+// The watcher runs until it is canceled.
+type FileWatcher struct {
+	conduit.Cancelable
+	archiveFilter
+	dirs      []string
+	recursive bool
+	interval  time.Duration
+	debounce  time.Duration
+	contents  bool
+	skip      bool
+	removed   bool
+	files     map[string]*watchedFile
+}
+
+// NewFileWatcher creates a new FileWatcher Producer
+// that watches the directories dirs.
+func NewFileWatcher(dirs ...string) (fw *FileWatcher) {
+	if len(dirs) == 0 {
+		return nil
+	}
+	for _, d := range dirs {
+		fi, err := os.Stat(d)
+		if err != nil || !fi.IsDir() {
+			return nil
+		}
+	}
+	fw = new(FileWatcher)
+	if fw != nil {
+		fw.dirs = dirs
+		fw.interval = time.Second
+	}
+	return
+}
+
+// Match restricts the files to those matching one of the glob patterns
+// (see path.Match), either with their name or their base name.
+func (fw *FileWatcher) Match(patterns ...string) *FileWatcher {
+	fw.patterns = patterns
+	return fw
+}
+
+// SetRecursive includes the files of subdirectories.
+func (fw *FileWatcher) SetRecursive() *FileWatcher {
+	fw.recursive = true
+	return fw
+}
+
+// SetInterval scans the directories every d (default: 1s).
+func (fw *FileWatcher) SetInterval(d time.Duration) *FileWatcher {
+	if d > 0 {
+		fw.interval = d
+	}
+	return fw
+}
+
+// SetDebounce reports changes only after the file
+// has not changed for d.
+func (fw *FileWatcher) SetDebounce(d time.Duration) *FileWatcher {
+	fw.debounce = d
+	return fw
+}
+
+// SetContents reads the contents of created and modified files
+// into Data.
+func (fw *FileWatcher) SetContents() *FileWatcher {
+	fw.contents = true
+	return fw
+}
+
+// SkipExisting does not report the files present at the first scan.
+func (fw *FileWatcher) SkipExisting() *FileWatcher {
+	fw.skip = true
+	return fw
+}
+
+// ReportRemoved reports removed files.
+func (fw *FileWatcher) ReportRemoved() *FileWatcher {
+	fw.removed = true
+	return fw
+}
+
+// Resume is the pre-defined method that makes FileWatcher
+// a conduit.Resumer. After a restart, the directories are scanned
+// anew, so nothing is skipped; files present at the first scan
+// are reported again unless SkipExisting is set.
+func (fw *FileWatcher) Resume(pos uint64) error {
+	return nil
+}
+
+// Produce is the pre-defined method that makes FileWatcher a Producer.
+func (fw *FileWatcher) Produce(trg conduit.Target) error {
+	fw.files = make(map[string]*watchedFile)
+	for first := true; !fw.Canceled(); first = false {
+		err := fw.scan(first, trg)
+		if err != nil {
+			return err
+		}
+		sleep(fw.interval, fw.Canceled)
+	}
+	return nil
+}
+
+// Scans the directories and sends the changes that are due
+func (fw *FileWatcher) scan(first bool, trg conduit.Target) error {
+	now := time.Now()
+	var events []*FileEvent
+	listed := make(map[string]bool)
+	for _, dir := range fw.dirs {
+		err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+			if err != nil {
+				// files may vanish during the scan
+				if os.IsNotExist(err) && p != dir {
+					return nil
+				}
+				return err
+			}
+			if fi.IsDir() {
+				if p != dir && !fw.recursive {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			name, _ := filepath.Rel(dir, p)
+			if !fi.Mode().IsRegular() || !fw.match(filepath.ToSlash(name)) {
+				return nil
+			}
+			listed[p] = true
+			f, ok := fw.files[p]
+			switch {
+			case !ok:
+				f = &watchedFile{dir: dir, name: name, size: fi.Size(), mod: fi.ModTime(), changed: now,
+					sent: first && fw.skip, pending: !(first && fw.skip)}
+				fw.files[p] = f
+			case f.size != fi.Size() || !f.mod.Equal(fi.ModTime()):
+				f.size, f.mod, f.changed, f.pending = fi.Size(), fi.ModTime(), now, true
+			}
+			if !f.pending || now.Sub(f.changed) < fw.debounce {
+				return nil
+			}
+			op := FileCreated
+			if f.sent {
+				op = FileModified
+			}
+			f.pending, f.sent = false, true
+			events = append(events, &FileEvent{Op: op, Dir: dir, Name: name, Path: p, Size: f.size, ModTime: f.mod})
+			return nil
+		})
+		if err != nil {
+			return errors.New(fmt.Sprintf("watching %s failed: %v", dir, err))
+		}
+	}
+	var gone []*FileEvent
+	for p, f := range fw.files {
+		if listed[p] {
+			continue
+		}
+		delete(fw.files, p)
+		if fw.removed && f.sent {
+			gone = append(gone, &FileEvent{Op: FileRemoved, Dir: f.dir, Name: f.name, Path: p})
+		}
+	}
+	sort.Slice(gone, func(i, j int) bool { return gone[i].Path < gone[j].Path })
+	events = append(events, gone...)
+	for _, e := range events {
+		if fw.Canceled() {
+			return nil
+		}
+		if fw.contents && e.Op != FileRemoved {
+			data, err := ioutil.ReadFile(e.Path)
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			e.Data = data
+		}
+		trg <- e
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package utils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+// Consumer that forwards n items to a channel
+type ForwardConsumer struct {
+	n   int
+	out chan interface{}
+}
+
+func (c *ForwardConsumer) Consume(src conduit.Source) error {
+	for inp := range src {
+		c.out <- inp
+		if c.n--; c.n == 0 {
+			return conduit.EOS
+		}
+	}
+	return nil
+}
+
+// Waits for the next event and formats it
+func nextFileEvent(t *testing.T, ch chan interface{}) string {
+	select {
+	case inp := <-ch:
+		e := inp.(*FileEvent)
+		return fmt.Sprintf("%s %s %s", e.Op, filepath.ToSlash(e.Name), e.Data)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("FileWatcher: no event")
+	}
+	return ""
+}
+
+// File watcher:
+// - Existing, created, modified and removed files are reported
+// - Only matching files are reported, subdirectories on request
+// - Files are reported when they have not changed for the debounce time
+func TestFileWatcher(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string) {
+		p := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(p), 0755)
+		if err := ioutil.WriteFile(p, []byte(data), 0644); err != nil {
+			t.Fatalf("FileWatcher: cannot write %s: %v", name, err)
+		}
+	}
+	if NewFileWatcher() != nil || NewFileWatcher(filepath.Join(dir, "missing")) != nil {
+		t.Errorf("FileWatcher: invalid directories accepted")
+	}
+	write("old.txt", "old")
+
+	ch := make(chan interface{}, 10)
+	fw := NewFileWatcher(dir).Match("*.txt", "*.csv").SetRecursive().SetContents().ReportRemoved().
+		SetInterval(5 * time.Millisecond).SetDebounce(50 * time.Millisecond)
+	done := make(chan error)
+	go func() {
+		done <- conduit.NewChain(fw, nil, &ForwardConsumer{n: 5, out: ch}, small).Run()
+	}()
+	if e := nextFileEvent(t, ch); e != "created old.txt old" {
+		t.Errorf("FileWatcher: unexpected event %q", e)
+	}
+	// a file written in steps is reported once
+	write("new.csv", "a")
+	write("ignored.tmp", "x")
+	time.Sleep(20 * time.Millisecond)
+	write("new.csv", "a,b")
+	if e := nextFileEvent(t, ch); e != "created new.csv a,b" {
+		t.Errorf("FileWatcher: unexpected event %q", e)
+	}
+	write("sub/deep.txt", "deep")
+	if e := nextFileEvent(t, ch); e != "created sub/deep.txt deep" {
+		t.Errorf("FileWatcher: unexpected event %q", e)
+	}
+	write("old.txt", "changed")
+	if e := nextFileEvent(t, ch); e != "modified old.txt changed" {
+		t.Errorf("FileWatcher: unexpected event %q", e)
+	}
+	os.Remove(filepath.Join(dir, "new.csv"))
+	if e := nextFileEvent(t, ch); e != "removed new.csv " {
+		t.Errorf("FileWatcher: unexpected event %q", e)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("FileWatcher failed: %v", err)
+	}
+
+	// existing files are skipped, subdirectories ignored
+	fw = NewFileWatcher(dir).SkipExisting().SetInterval(5 * time.Millisecond)
+	go func() {
+		done <- conduit.NewChain(fw, nil, &ForwardConsumer{n: 2, out: ch}, small).Run()
+	}()
+	time.Sleep(20 * time.Millisecond)
+	write("sub/deeper.txt", "x")
+	write("ignored.tmp", "yy")
+	if e := nextFileEvent(t, ch); e != "modified ignored.tmp " {
+		t.Errorf("FileWatcher: unexpected event %q", e)
+	}
+	write("last.txt", "z")
+	if e := nextFileEvent(t, ch); e != "created last.txt " {
+		t.Errorf("FileWatcher: unexpected event %q", e)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("FileWatcher failed: %v", err)
+	}
+}
@@ -0,0 +1,325 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+// Headers of webhook requests
+const (
+	WebhookIDHeader        = "X-Webhook-Id"
+	WebhookTimestampHeader = "X-Webhook-Timestamp"
+	WebhookSignatureHeader = "X-Webhook-Signature"
+)
+
+// WebhookSignature computes the signature of a webhook request
+// as sent in the header X-Webhook-Signature: "sha256=" followed by
+// the hex encoded HMAC-SHA256 of id, timestamp and body,
+// separated by dots. Receivers recompute the signature
+// from the headers and the body and compare it with hmac.Equal;
+// the timestamp (Unix seconds) lets them reject replayed requests.
+func WebhookSignature(secret []byte, id, timestamp string, body []byte) string {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(id + "." + timestamp + "."))
+	h.Write(body)
+	return "sha256=" + hex.EncodeToString(h.Sum(nil))
+}
+
+// WebhookEvent is the delivery of an item to an endpoint.
+// The ID is the same for all endpoints and all attempts,
+// so that receivers can discard duplicates.
+type WebhookEvent struct {
+	ID   string
+	URL  string
+	Body []byte
+}
+
+// WebhookRetry is the default RetryPolicy of WebhookWriter:
+// up to 6 attempts with exponential backoff from 1s to 1m.
+var WebhookRetry = RetryPolicy{
+	Attempts: 6,
+	Backoff:  ExponentialBackoff(time.Second, time.Minute),
+}
+
+// Queue and retry policy of an endpoint
+type webhookEndpoint struct {
+	url   string
+	retry RetryPolicy
+	queue chan *WebhookEvent
+}
+
+// WebhookWriter is a Consumer that delivers each incoming item
+// as signed webhook, i.e. as body of a POST request,
+// to each of its endpoints.
+// Items of type []byte and string are sent as they are,
+// others are encoded with a MarshalFunc (default: json.Marshal).
+// Requests carry the headers X-Webhook-Id, X-Webhook-Timestamp
+// and X-Webhook-Signature (see WebhookSignature).
+// Each endpoint has its own queue, so that a failing endpoint
+// does not delay the others, and its own RetryPolicy
+// (see SetEndpointRetry, default: WebhookRetry);
+// items are delivered to each endpoint in the order of the stream.
+// Requests that fail with a network error or status 429 or 5xx
+// are retried; other status codes outside 2xx are not.
+// At barriers, WebhookWriter waits until all items are delivered.
+// Undeliverable events are kept in the dead letter store
+// (see SetDeadLetters) and sent as FailedRequest
+// with the *WebhookEvent as Item to the side output "failed"
+// (see conduit.SideOutputter); if there is neither,
+// they terminate the consumer with an error.
+type WebhookWriter struct {
+	secret    []byte
+	endpoints []*webhookEndpoint
+	ctype     string
+	marshal   MarshalFunc
+	client    *http.Client
+	dead      conduit.StateStore
+	side      conduit.Target
+	pending   sync.WaitGroup
+	door      sync.Mutex
+	err       error
+}
+
+// NewWebhookWriter creates a new WebhookWriter Consumer
+// that delivers items to the endpoints at urls
+// signed with secret.
+func NewWebhookWriter(secret []byte, urls ...string) (ww *WebhookWriter) {
+	if len(secret) == 0 || len(urls) == 0 {
+		return nil
+	}
+	for _, u := range urls {
+		p, err := url.Parse(u)
+		if err != nil || (p.Scheme != "http" && p.Scheme != "https") {
+			return nil
+		}
+	}
+	ww = new(WebhookWriter)
+	if ww != nil {
+		ww.secret = secret
+		for _, u := range urls {
+			ww.endpoints = append(ww.endpoints, &webhookEndpoint{url: u, retry: WebhookRetry})
+		}
+		ww.ctype = "application/json"
+		ww.marshal = json.Marshal
+		ww.client = http.DefaultClient
+	}
+	return
+}
+
+// SetContentType sets the Content-Type header
+// (default: application/json).
+func (ww *WebhookWriter) SetContentType(ctype string) *WebhookWriter {
+	ww.ctype = ctype
+	return ww
+}
+
+// SetMarshal sets the MarshalFunc for items
+// that are neither []byte nor string.
+func (ww *WebhookWriter) SetMarshal(marshal MarshalFunc) *WebhookWriter {
+	ww.marshal = marshal
+	return ww
+}
+
+// SetClient sets the http.Client (default: http.DefaultClient).
+func (ww *WebhookWriter) SetClient(c *http.Client) *WebhookWriter {
+	ww.client = c
+	return ww
+}
+
+// SetRetry sets the RetryPolicy of all endpoints.
+func (ww *WebhookWriter) SetRetry(rp RetryPolicy) *WebhookWriter {
+	for _, ep := range ww.endpoints {
+		ep.retry = rp
+	}
+	return ww
+}
+
+// SetEndpointRetry sets the RetryPolicy of the endpoint at u.
+func (ww *WebhookWriter) SetEndpointRetry(u string, rp RetryPolicy) *WebhookWriter {
+	if ep := ww.endpoint(u); ep != nil {
+		ep.retry = rp
+	}
+	return ww
+}
+
+// SetDeadLetters sets the StateStore where undeliverable events
+// are kept under the stage "webhook" with ID and URL as key.
+// They can be delivered again with Redeliver.
+func (ww *WebhookWriter) SetDeadLetters(st conduit.StateStore) *WebhookWriter {
+	ww.dead = st
+	return ww
+}
+
+// SideOutput is the pre-defined method that makes WebhookWriter
+// a conduit.SideOutputter. WebhookWriter has the side output "failed".
+func (ww *WebhookWriter) SideOutput(name string, trg conduit.Target) {
+	if name == "failed" {
+		ww.side = trg
+	}
+}
+
+func (ww *WebhookWriter) endpoint(u string) *webhookEndpoint {
+	for _, ep := range ww.endpoints {
+		if ep.url == u {
+			return ep
+		}
+	}
+	return nil
+}
+
+// Records the first error
+func (ww *WebhookWriter) fail(err error) {
+	ww.door.Lock()
+	defer ww.door.Unlock()
+	if ww.err == nil {
+		ww.err = err
+	}
+}
+
+func (ww *WebhookWriter) failed() error {
+	ww.door.Lock()
+	defer ww.door.Unlock()
+	return ww.err
+}
+
+func webhookID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Consume is the pre-defined method that makes WebhookWriter a Consumer.
+// Consume terminates with an error if an item cannot be encoded
+// or an event is undeliverable and neither the dead letter store
+// nor the side output is set.
+func (ww *WebhookWriter) Consume(src conduit.Source) error {
+	ww.err = nil
+	var workers sync.WaitGroup
+	for _, ep := range ww.endpoints {
+		ep.queue = make(chan *WebhookEvent, 64)
+		workers.Add(1)
+		go func(ep *webhookEndpoint) {
+			defer workers.Done()
+			for ev := range ep.queue {
+				ww.deliver(ep, ev)
+				ww.pending.Done()
+			}
+		}(ep)
+	}
+	defer func() {
+		for _, ep := range ww.endpoints {
+			close(ep.queue)
+		}
+		workers.Wait()
+	}()
+
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			ww.pending.Wait()
+			continue
+		}
+		if err := ww.failed(); err != nil {
+			return err
+		}
+		body, err := payload(inp, ww.marshal)
+		if err != nil {
+			return err
+		}
+		id := webhookID()
+		for _, ep := range ww.endpoints {
+			ww.pending.Add(1)
+			ep.queue <- &WebhookEvent{ID: id, URL: ep.url, Body: body}
+		}
+	}
+	ww.pending.Wait()
+	return ww.failed()
+}
+
+// Delivers an event and handles the failure
+func (ww *WebhookWriter) deliver(ep *webhookEndpoint, ev *WebhookEvent) {
+	attempts, err := ww.request(ep.retry, ev)
+	if err == nil {
+		return
+	}
+	if ww.dead != nil {
+		if err := ww.dead.Put("webhook", ev.ID+" "+ev.URL, ev.Body); err != nil {
+			ww.fail(err)
+			return
+		}
+	}
+	if ww.side != nil {
+		ww.side <- &FailedRequest{Item: ev, Attempts: attempts, Err: err}
+	}
+	if ww.dead == nil && ww.side == nil {
+		ww.fail(errors.New(fmt.Sprintf("delivery of %s to %s failed after %d attempts: %v", ev.ID, ev.URL, attempts, err)))
+	}
+}
+
+// Sends the request for ev with retries;
+// each attempt is signed with a new timestamp
+func (ww *WebhookWriter) request(rp RetryPolicy, ev *WebhookEvent) (int, error) {
+	return rp.run(nil, func() (bool, error) {
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, ev.URL, bytes.NewReader(ev.Body))
+		if err != nil {
+			return false, err
+		}
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("Content-Type", ww.ctype)
+		req.Header.Set(WebhookIDHeader, ev.ID)
+		req.Header.Set(WebhookTimestampHeader, ts)
+		req.Header.Set(WebhookSignatureHeader, WebhookSignature(ww.secret, ev.ID, ts, ev.Body))
+		rsp, err := ww.client.Do(req)
+		if err != nil {
+			return true, err
+		}
+		discardBody(rsp.Body)
+		if rsp.StatusCode/100 == 2 {
+			return false, nil
+		}
+		return retryableStatus(rsp.StatusCode), errors.New(rsp.Status)
+	})
+}
+
+// Redeliver attempts to deliver the events in the dead letter store
+// again, each according to the RetryPolicy of its endpoint,
+// and removes the events that were delivered.
+// Redeliver returns the number of delivered events
+// and the number of events that remain in the store.
+func (ww *WebhookWriter) Redeliver() (delivered, remaining int, err error) {
+	if ww.dead == nil {
+		return 0, 0, errors.New("no dead letter store")
+	}
+	err = ww.dead.Iterate("webhook", func(key string, val []byte) error {
+		i := strings.IndexByte(key, ' ')
+		if i < 0 {
+			return nil
+		}
+		ev := &WebhookEvent{ID: key[:i], URL: key[i+1:], Body: val}
+		rp := WebhookRetry
+		if ep := ww.endpoint(ev.URL); ep != nil {
+			rp = ep.retry
+		}
+		if _, err := ww.request(rp, ev); err != nil {
+			remaining++
+			return nil
+		}
+		delivered++
+		return ww.dead.Delete("webhook", key)
+	})
+	return
+}
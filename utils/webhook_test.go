@@ -0,0 +1,157 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/toschoo/conduit"
+)
+
+// Webhook test server; requests with invalid signatures are rejected,
+// /flaky/ fails three times with 503, /down/ fails with 503
+// until up is set and /gone/ fails with 410
+type webhookServer struct {
+	*httptest.Server
+	door  sync.Mutex
+	up    bool
+	tries map[string]int
+	recvd map[string][]string
+	ids   map[string]string
+}
+
+func newWebhookServer(secret string) *webhookServer {
+	s := &webhookServer{tries: make(map[string]int), recvd: make(map[string][]string), ids: make(map[string]string)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		id, ts := r.Header.Get(WebhookIDHeader), r.Header.Get(WebhookTimestampHeader)
+		sig := WebhookSignature([]byte(secret), id, ts, body)
+		if r.Method != http.MethodPost || ts == "" || !hmac.Equal([]byte(sig), []byte(r.Header.Get(WebhookSignatureHeader))) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		s.door.Lock()
+		defer s.door.Unlock()
+		s.tries[r.URL.Path]++
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/flaky/") && s.tries[r.URL.Path] <= 3,
+			strings.HasPrefix(r.URL.Path, "/down/") && !s.up:
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		case strings.HasPrefix(r.URL.Path, "/gone/"):
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+		s.recvd[r.URL.Path] = append(s.recvd[r.URL.Path], string(body))
+		s.ids[string(body)+r.URL.Path] = id
+	}))
+	return s
+}
+
+func (s *webhookServer) received(path string) string {
+	s.door.Lock()
+	defer s.door.Unlock()
+	return strings.Join(s.recvd[path], ",")
+}
+
+func (s *webhookServer) attempts(path string) int {
+	s.door.Lock()
+	defer s.door.Unlock()
+	return s.tries[path]
+}
+
+// Webhook writer:
+// - Items are delivered in order to all endpoints with valid signatures
+// - Each endpoint is retried according to its own policy
+// - Undeliverable events go to the dead letter store and the side output
+// - Dead letters can be redelivered with their original ID
+func TestWebhookWriter(t *testing.T) {
+	srv := newWebhookServer("s3cret")
+	defer srv.Close()
+	if NewWebhookWriter(nil, srv.URL) != nil || NewWebhookWriter([]byte("s")) != nil ||
+		NewWebhookWriter([]byte("s"), "ftp://host/") != nil {
+		t.Errorf("WebhookWriter: invalid arguments accepted")
+	}
+	if sig := WebhookSignature([]byte("key"), "1", "1700000000", []byte("{}")); sig !=
+		"sha256=50bc9b415036e4f001bf0e404d0d258fd0f01d966f85e631de1da703a554554c" {
+		t.Errorf("WebhookSignature: %s", sig)
+	}
+
+	dead := conduit.NewMemStore()
+	failed := make(chan interface{}, 10)
+	ww := NewWebhookWriter([]byte("s3cret"), srv.URL+"/ok/", srv.URL+"/flaky/", srv.URL+"/down/", srv.URL+"/gone/").
+		SetRetry(fastRetry).SetEndpointRetry(srv.URL+"/down/", RetryPolicy{Attempts: 2}).SetDeadLetters(dead)
+	ww.SideOutput("failed", failed)
+	items := []interface{}{"a", Record{"n": 1}, &conduit.Barrier{}, []byte("c")}
+	if err := conduit.NewChain(&AnyProducer{src: items}, nil, ww, small).Run(); err != nil {
+		t.Fatalf("WebhookWriter failed: %v", err)
+	}
+	if r := srv.received("/ok/"); r != `a,{"n":1},c` {
+		t.Errorf("WebhookWriter: /ok/ received %q", r)
+	}
+	if r := srv.received("/flaky/"); r != `{"n":1},c` {
+		t.Errorf("WebhookWriter: /flaky/ received %q", r)
+	}
+	if n := srv.attempts("/down/"); n != 6 {
+		t.Errorf("WebhookWriter: %d attempts on /down/", n)
+	}
+	if n := srv.attempts("/gone/"); n != 3 {
+		t.Errorf("WebhookWriter: %d attempts on /gone/", n)
+	}
+	if len(failed) != 7 {
+		t.Fatalf("WebhookWriter: %d failed", len(failed))
+	}
+	for len(failed) > 0 {
+		f := (<-failed).(*FailedRequest)
+		ev := f.Item.(*WebhookEvent)
+		if !(strings.HasSuffix(ev.URL, "/down/") && f.Attempts == 2) && !(strings.HasSuffix(ev.URL, "/gone/") && f.Attempts == 1) &&
+			!(strings.HasSuffix(ev.URL, "/flaky/") && f.Attempts == 3 && string(ev.Body) == "a") {
+			t.Errorf("WebhookWriter: unexpected failure %d %s %s", f.Attempts, ev.URL, ev.Body)
+		}
+	}
+
+	// redelivery
+	srv.door.Lock()
+	srv.up = true
+	srv.door.Unlock()
+	delivered, remaining, err := ww.Redeliver()
+	if err != nil || delivered != 4 || remaining != 3 {
+		t.Errorf("WebhookWriter: %d redelivered, %d remaining (%v)", delivered, remaining, err)
+	}
+	if r := srv.received("/down/"); len(r) != len(`a,{"n":1},c`) {
+		t.Errorf("WebhookWriter: /down/ received %q", r)
+	}
+	srv.door.Lock()
+	if srv.ids["a/down/"] == "" || srv.ids["a/down/"] != srv.ids["a/ok/"] {
+		t.Errorf("WebhookWriter: IDs differ on redelivery")
+	}
+	srv.door.Unlock()
+	var keys []string
+	dead.Iterate("webhook", func(key string, _ []byte) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if len(keys) != 3 || !strings.HasSuffix(keys[0], "/gone/") {
+		t.Errorf("WebhookWriter: dead letters %v", keys)
+	}
+
+	// without dead letters and side output
+	ww = NewWebhookWriter([]byte("s3cret"), srv.URL+"/gone/")
+	chn := conduit.NewChain(&AnyProducer{src: []interface{}{"x"}}, nil, ww, small)
+	if err := chn.Run(); err == nil || !strings.Contains(fmt.Sprint(chn.Errs), "410 Gone") {
+		t.Errorf("WebhookWriter: expected error: %v", chn.Errs)
+	}
+	if _, _, err := ww.Redeliver(); err == nil {
+		t.Errorf("WebhookWriter: Redeliver without store")
+	}
+	ww = NewWebhookWriter([]byte("wrong"), srv.URL+"/ok/").SetRetry(fastRetry)
+	chn = conduit.NewChain(&AnyProducer{src: []interface{}{"x"}}, nil, ww, small)
+	if err := chn.Run(); err == nil || !strings.Contains(fmt.Sprint(chn.Errs), "401") {
+		t.Errorf("WebhookWriter: expected error: %v", chn.Errs)
+	}
+}
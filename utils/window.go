@@ -0,0 +1,439 @@
+package utils
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+// Aggregates are expected to provide the Aggregate method
+// that reduces the items collected in one window
+// to a single result. Aggregates are used by Windows
+// to implement streaming analytics.
+type Aggregate interface {
+	Aggregate([]interface{}) (interface{}, error)
+}
+
+// Timestamps are expected to provide the event time
+// of incoming items. Time windows use a Timestamp
+// to assign items to windows.
+type Timestamp interface {
+	Timestamp(interface{}) time.Time
+}
+
+// WindowResult is sent down the chain by Windows,
+// one per window. Start and End delimit the window
+// (End is exclusive); for count windows they are
+// the times the first and the last item arrived.
+// Result is the outcome of the Aggregate.
+// Update is set when the result replaces an earlier result
+// for the same window because of late data (see LatePolicy).
+type WindowResult struct {
+	Start  time.Time
+	End    time.Time
+	Count  int
+	Result interface{}
+	Update bool
+}
+
+// LatePolicy defines how event-time windows handle late items,
+// i.e. items that arrive after their window already produced
+// its result.
+type LatePolicy int
+
+const (
+	// LateDrop drops late items.
+	LateDrop LatePolicy = iota
+	// LateUpdate adds late items to their window
+	// and sends an updated result down the chain,
+	// as long as the window is within the allowed lateness;
+	// later items are dropped.
+	LateUpdate
+	// LateSide sends late items to the side output "late"
+	// (see conduit.SideOutputter).
+	LateSide
+)
+
+// Window is a Conduit that groups incoming data
+// into windows and applies an Aggregate to each window,
+// sending one WindowResult per window down the chain.
+// Windows either contain a fixed number of items
+// (count windows) or all items whose time falls
+// into a fixed interval (time windows).
+// Tumbling windows are fixed and non-overlapping;
+// sliding windows start every slide items or every
+// slide interval and may overlap, such that one item
+// may contribute to several windows.
+// Windows without items produce no result.
+type Window struct {
+	agg      Aggregate
+	ts       Timestamp
+	n        int           // count windows: items per window
+	step     int           // count windows: items between windows
+	size     time.Duration // time windows: window length
+	slide    time.Duration // time windows: distance between windows
+	mark     time.Time     // watermark: latest time seen
+	open     map[int64]*pane
+	lateness time.Duration // how long windows are kept after firing
+	policy   LatePolicy
+	side     conduit.Target // late items
+	late     uint64
+	dropped  uint64
+}
+
+// pane holds the items of one open window.
+type pane struct {
+	start time.Time
+	fired bool
+	items []interface{}
+}
+
+// stamped is an item together with its arrival time.
+type stamped struct {
+	t    time.Time
+	item interface{}
+}
+
+// NewCountWindow creates a new tumbling Window
+// that emits a result for every n items;
+// when the stream ends, the remaining items
+// form a last, smaller window.
+func NewCountWindow(n int, agg Aggregate) *Window {
+	return NewSlidingCountWindow(n, n, agg)
+}
+
+// NewSlidingCountWindow creates a new sliding Window
+// that emits, for every slide items, a result
+// for the last n items. Windows at the start of the stream
+// contain fewer than n items; when the stream ends,
+// the items that arrived after the last window
+// form a last, truncated window.
+func NewSlidingCountWindow(n, slide int, agg Aggregate) (w *Window) {
+	if n < 1 || slide < 1 || agg == nil {
+		return nil
+	}
+	w = new(Window)
+	if w != nil {
+		w.agg = agg
+		w.n = n
+		w.step = slide
+		w.open = make(map[int64]*pane)
+	}
+	return
+}
+
+// NewTimeWindow creates a new tumbling Window
+// that groups items into windows of length size.
+// If ts is not nil, it is used to obtain the event time
+// of each item; windows then close as soon as an item
+// with a time beyond their end arrives.
+// Items arriving for a window that is already closed
+// are dropped.
+// If ts is nil, the processing time is used instead;
+// windows then close when their time is over,
+// even if no more data arrive.
+// When the stream ends, all open windows are closed.
+// Windows are aligned to the Unix epoch.
+func NewTimeWindow(size time.Duration, ts Timestamp, agg Aggregate) *Window {
+	return NewSlidingTimeWindow(size, size, ts, agg)
+}
+
+// NewSlidingTimeWindow creates a new sliding Window
+// with windows of length size starting every slide,
+// e.g. 5-minute windows every 30 seconds.
+// Windows close like those created by NewTimeWindow.
+func NewSlidingTimeWindow(size, slide time.Duration, ts Timestamp, agg Aggregate) (w *Window) {
+	if size <= 0 || slide <= 0 || agg == nil {
+		return nil
+	}
+	w = new(Window)
+	if w != nil {
+		w.agg = agg
+		w.ts = ts
+		w.size = size
+		w.slide = slide
+		w.open = make(map[int64]*pane)
+	}
+	return
+}
+
+// SetLateness defines how event-time windows handle late items.
+// Windows are kept for the allowed lateness after they produced
+// their result; within that period, late items are handled
+// according to policy. Items arriving even later are dropped,
+// unless the policy is LateSide. If the side output "late"
+// is not connected, LateSide behaves like LateDrop.
+func (w *Window) SetLateness(lateness time.Duration, policy LatePolicy) {
+	w.lateness = lateness
+	w.policy = policy
+}
+
+// SideOutput is the pre-defined method that makes Window
+// a conduit.SideOutputter. Window has the side output "late".
+func (w *Window) SideOutput(name string, trg conduit.Target) {
+	if name == "late" {
+		w.side = trg
+	}
+}
+
+// Late returns the number of late items seen so far.
+func (w *Window) Late() uint64 {
+	return atomic.LoadUint64(&w.late)
+}
+
+// Dropped returns the number of late items dropped so far.
+func (w *Window) Dropped() uint64 {
+	return atomic.LoadUint64(&w.dropped)
+}
+
+// Conduct is the pre-defined method that makes Window a Conduit.
+func (w *Window) Conduct(src conduit.Source, trg conduit.Target) error {
+	if w.n > 0 {
+		return w.conductCount(src, trg)
+	}
+	return w.conductTime(src, trg)
+}
+
+// Volatile is the pre-defined method that makes Window a conduit.Volatile:
+// the items of open windows are not included in checkpoints.
+func (w *Window) Volatile() bool {
+	return true
+}
+
+// count windows
+func (w *Window) conductCount(src conduit.Source, trg conduit.Target) error {
+	ring := make([]stamped, w.n)
+	seen, fresh := 0, 0
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			trg <- inp
+			continue
+		}
+		ring[seen%w.n] = stamped{time.Now(), inp}
+		seen++
+		fresh++
+		if fresh == w.step {
+			fresh = 0
+			err := w.emitLast(ring, seen, w.n, trg)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	// the next window would end step-fresh items later
+	if fresh > 0 && w.n > w.step-fresh {
+		return w.emitLast(ring, seen, w.n-(w.step-fresh), trg)
+	}
+	return nil
+}
+
+// emits the last k of seen items
+func (w *Window) emitLast(ring []stamped, seen, k int, trg conduit.Target) error {
+	if k > seen {
+		k = seen
+	}
+	p := &pane{items: make([]interface{}, 0, k)}
+	for i := seen - k; i < seen; i++ {
+		p.items = append(p.items, ring[i%w.n].item)
+	}
+	return w.emit(p, ring[(seen-k)%w.n].t, ring[(seen-1)%w.n].t, trg)
+}
+
+// time windows
+func (w *Window) conductTime(src conduit.Source, trg conduit.Target) error {
+	var tick <-chan time.Time
+	if w.ts == nil {
+		t := time.NewTicker(w.slide)
+		defer t.Stop()
+		tick = t.C
+	}
+	for {
+		select {
+		case inp, ok := <-src:
+			if !ok {
+				return w.closeAll(trg)
+			}
+			if conduit.IsBarrier(inp) {
+				trg <- inp
+				continue
+			}
+			t := w.timeOf(inp)
+			err := w.add(t, inp, trg)
+			if err != nil {
+				return err
+			}
+			err = w.advance(t, trg)
+			if err != nil {
+				return err
+			}
+		case now := <-tick:
+			err := w.advance(now, trg)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// event time or processing time of an item
+func (w *Window) timeOf(inp interface{}) time.Time {
+	if w.ts == nil {
+		return time.Now()
+	}
+	return w.ts.Timestamp(inp)
+}
+
+// assigns an item to all windows it belongs to;
+// late items are handled according to the late policy.
+func (w *Window) add(t time.Time, inp interface{}, trg conduit.Target) error {
+	late, dropped := false, false
+	var updates []*pane
+	for start := align(t, w.slide); t.Sub(start) < w.size; start = start.Add(-w.slide) {
+		end := start.Add(w.size)
+		k := start.UnixNano()
+		p, ok := w.open[k]
+		if w.fired(end) {
+			late = true
+			if w.policy != LateUpdate || !end.Add(w.lateness).After(w.mark) {
+				dropped = true
+				continue
+			}
+			if !ok {
+				p = &pane{start: start, fired: true}
+				w.open[k] = p
+			}
+			p.items = append(p.items, inp)
+			updates = append(updates, p)
+			continue
+		}
+		if !ok {
+			p = &pane{start: start}
+			w.open[k] = p
+		}
+		p.items = append(p.items, inp)
+	}
+	if late {
+		atomic.AddUint64(&w.late, 1)
+		if w.policy == LateSide && w.side != nil {
+			w.side <- inp
+			dropped = false
+		}
+	}
+	if dropped {
+		atomic.AddUint64(&w.dropped, 1)
+	}
+	for _, p := range updates {
+		err := w.emitUpdate(p, trg)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// a window ending at end has fired already
+func (w *Window) fired(end time.Time) bool {
+	return !w.mark.IsZero() && !end.After(w.mark)
+}
+
+// the start of the window of length d containing t;
+// windows are aligned to the Unix epoch.
+func align(t time.Time, d time.Duration) time.Time {
+	n := t.UnixNano()
+	r := n % int64(d)
+	if r < 0 {
+		r += int64(d)
+	}
+	return time.Unix(0, n-r)
+}
+
+// moves the watermark forward, fires all windows
+// that end before the watermark and removes windows
+// that exceeded the allowed lateness.
+func (w *Window) advance(t time.Time, trg conduit.Target) error {
+	if t.After(w.mark) {
+		w.mark = t
+	}
+	for _, k := range w.starts() {
+		p := w.open[k]
+		end := p.start.Add(w.size)
+		if end.After(w.mark) {
+			break
+		}
+		if !end.Add(w.lateness).After(w.mark) {
+			delete(w.open, k)
+		}
+		if p.fired {
+			continue
+		}
+		p.fired = true
+		err := w.emit(p, p.start, end, trg)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fires all open windows in order
+func (w *Window) closeAll(trg conduit.Target) error {
+	for _, k := range w.starts() {
+		p := w.open[k]
+		delete(w.open, k)
+		if p.fired {
+			continue
+		}
+		err := w.emit(p, p.start, p.start.Add(w.size), trg)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// the start of all open windows in ascending order
+func (w *Window) starts() []int64 {
+	ks := make([]int64, 0, len(w.open))
+	for k := range w.open {
+		ks = append(ks, k)
+	}
+	sort.Slice(ks, func(i, j int) bool { return ks[i] < ks[j] })
+	return ks
+}
+
+// aggregates a window and sends the result down the chain
+func (w *Window) emit(p *pane, start, end time.Time, trg conduit.Target) error {
+	if len(p.items) == 0 {
+		return nil
+	}
+	res, err := w.agg.Aggregate(p.items)
+	if err != nil {
+		return err
+	}
+	trg <- WindowResult{
+		Start:  start,
+		End:    end,
+		Count:  len(p.items),
+		Result: res,
+	}
+	return nil
+}
+
+// aggregates a window that received late items
+// and sends the updated result down the chain
+func (w *Window) emitUpdate(p *pane, trg conduit.Target) error {
+	res, err := w.agg.Aggregate(p.items)
+	if err != nil {
+		return err
+	}
+	trg <- WindowResult{
+		Start:  p.start,
+		End:    p.start.Add(w.size),
+		Count:  len(p.items),
+		Result: res,
+		Update: true,
+	}
+	return nil
+}
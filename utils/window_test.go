@@ -0,0 +1,469 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+type SumAggregate struct{}
+
+func (s *SumAggregate) Aggregate(items []interface{}) (interface{}, error) {
+	sum := 0
+	for _, v := range items {
+		sum += v.(int)
+	}
+	return sum, nil
+}
+
+type ErrAggregate struct{}
+
+func (s *ErrAggregate) Aggregate(items []interface{}) (interface{}, error) {
+	return nil, errors.New(errMsg)
+}
+
+var errMsg string = "random error"
+
+// Items are seconds since epoch
+type SecTimestamp struct{}
+
+func (s *SecTimestamp) Timestamp(inp interface{}) time.Time {
+	return time.Unix(int64(inp.(int)), 0)
+}
+
+type SeqProducer struct {
+	src []int
+}
+
+func (p *SeqProducer) Produce(trg conduit.Target) error {
+	for _, v := range p.src {
+		trg <- v
+	}
+	return nil
+}
+
+type ResultConsumer struct {
+	recvd []WindowResult
+}
+
+func (c *ResultConsumer) Consume(src conduit.Source) error {
+	for v := range src {
+		c.recvd = append(c.recvd, v.(WindowResult))
+	}
+	return nil
+}
+
+func makeSeq(n int) []int {
+	seq := make([]int, n)
+	for i := 0; i < n; i++ {
+		seq[i] = i
+	}
+	return seq
+}
+
+// Count window:
+// - It is processed without errors
+// - Each window contains n items, the last one the rest
+// - The windows contain the data in the order in which they were sent
+func TestCountWindowChain(t *testing.T) {
+	for i := 0; i < numOfTests; i++ {
+		err := testCountWindowChain(numOfData, 1+rand.Int()%10)
+		if err != nil {
+			m := fmt.Sprintf("CountWindowChain failed: %v", err)
+			t.Error(m)
+		}
+	}
+}
+
+// Event time window:
+// - It is processed without errors
+// - Each window contains all items of its interval
+// - Windows are sent in order
+func TestEventTimeWindowChain(t *testing.T) {
+	for i := 0; i < numOfTests; i++ {
+		err := testEventTimeWindowChain(numOfData, 1+rand.Int()%10)
+		if err != nil {
+			m := fmt.Sprintf("EventTimeWindowChain failed: %v", err)
+			t.Error(m)
+		}
+	}
+}
+
+// Sliding count window:
+// - It is processed without errors
+// - Every slide items, the last n items are aggregated
+// - The last window contains the items after the last slide
+func TestSlidingCountWindowChain(t *testing.T) {
+	for i := 0; i < numOfTests; i++ {
+		err := testSlidingCountWindowChain(numOfData, 1+rand.Int()%10, 1+rand.Int()%10)
+		if err != nil {
+			m := fmt.Sprintf("SlidingCountWindowChain failed: %v", err)
+			t.Error(m)
+		}
+	}
+}
+
+// Sliding event time window:
+// - It is processed without errors
+// - Each window contains all items of its interval
+// - Windows start every slide and are sent in order
+func TestSlidingTimeWindowChain(t *testing.T) {
+	for i := 0; i < numOfTests; i++ {
+		err := testSlidingTimeWindowChain(numOfData, 1+rand.Int()%10, 1+rand.Int()%10)
+		if err != nil {
+			m := fmt.Sprintf("SlidingTimeWindowChain failed: %v", err)
+			t.Error(m)
+		}
+	}
+}
+
+// Event time window with late items:
+// - It is processed without errors
+// - Drop: late items are dropped and counted
+// - Update: late items lead to updated results
+// - Side: late items are sent to the side target
+func TestLateWindowChain(t *testing.T) {
+	for i := 0; i < numOfTests; i++ {
+		for _, pol := range []LatePolicy{LateDrop, LateUpdate, LateSide} {
+			err := testLateWindowChain(numOfData, 1+rand.Int()%5, pol)
+			if err != nil {
+				m := fmt.Sprintf("LateWindowChain failed: %v", err)
+				t.Error(m)
+			}
+		}
+	}
+}
+
+// Processing time window:
+// - It is processed without errors
+// - All items are aggregated
+func TestProcTimeWindowChain(t *testing.T) {
+	err := testProcTimeWindowChain(numOfData)
+	if err != nil {
+		m := fmt.Sprintf("ProcTimeWindowChain failed: %v", err)
+		t.Error(m)
+	}
+}
+
+// Window with failing aggregate:
+// - The error is reported
+func TestErrWindowChain(t *testing.T) {
+	p := &SeqProducer{makeSeq(numOfData)}
+	c := new(ResultConsumer)
+	pipe := []conduit.Conduit{NewCountWindow(10, new(ErrAggregate))}
+	chn := conduit.NewChain(p, pipe, c, small)
+	err := chn.Run()
+	if err == nil {
+		t.Error("ErrWindowChain: no error reported")
+	}
+	if len(chn.Errs) != 1 || chn.Errs[0].Error() != errMsg {
+		t.Errorf("ErrWindowChain: unexpected errors: %v", chn.Errs)
+	}
+}
+
+func testCountWindowChain(n, k int) error {
+
+	p := &SeqProducer{makeSeq(n)}
+	c := new(ResultConsumer)
+
+	pipe := []conduit.Conduit{NewCountWindow(k, new(SumAggregate))}
+
+	chn := conduit.NewChain(p, pipe, c, small)
+
+	err := chn.Run()
+	if err != nil {
+		m := fmt.Sprintf("error on running chain: %v", err)
+		return errors.New(m)
+	}
+	w := n / k
+	if n%k != 0 {
+		w++
+	}
+	if len(c.recvd) != w {
+		m := fmt.Sprintf("expected %d windows, have %d", w, len(c.recvd))
+		return errors.New(m)
+	}
+	for i, r := range c.recvd {
+		sum := 0
+		cnt := 0
+		for j := i * k; j < n && j < (i+1)*k; j++ {
+			sum += j
+			cnt++
+		}
+		if r.Count != cnt || r.Result.(int) != sum {
+			m := fmt.Sprintf("window %d: expected %d/%d, have %d/%v",
+				i, cnt, sum, r.Count, r.Result)
+			return errors.New(m)
+		}
+	}
+	return nil
+}
+
+func testEventTimeWindowChain(n, k int) error {
+
+	p := &SeqProducer{makeSeq(n)}
+	c := new(ResultConsumer)
+
+	size := time.Duration(k) * time.Second
+	pipe := []conduit.Conduit{NewTimeWindow(size, new(SecTimestamp), new(SumAggregate))}
+
+	chn := conduit.NewChain(p, pipe, c, small)
+
+	err := chn.Run()
+	if err != nil {
+		m := fmt.Sprintf("error on running chain: %v", err)
+		return errors.New(m)
+	}
+	total := 0
+	for i, r := range c.recvd {
+		if i > 0 && !r.Start.After(c.recvd[i-1].Start) {
+			return errors.New("windows not in order")
+		}
+		if r.End.Sub(r.Start) != size {
+			m := fmt.Sprintf("wrong window size: %v", r.End.Sub(r.Start))
+			return errors.New(m)
+		}
+		sum := 0
+		s := int(r.Start.Unix())
+		for j := s; j < s+k && j < n; j++ {
+			sum += j
+		}
+		if r.Result.(int) != sum {
+			m := fmt.Sprintf("window %d: expected %d, have %v", i, sum, r.Result)
+			return errors.New(m)
+		}
+		total += r.Count
+	}
+	if total != n {
+		m := fmt.Sprintf("expected %d items, have %d", n, total)
+		return errors.New(m)
+	}
+	return nil
+}
+
+func testSlidingCountWindowChain(n, k, slide int) error {
+
+	p := &SeqProducer{makeSeq(n)}
+	c := new(ResultConsumer)
+
+	pipe := []conduit.Conduit{NewSlidingCountWindow(k, slide, new(SumAggregate))}
+
+	chn := conduit.NewChain(p, pipe, c, small)
+
+	err := chn.Run()
+	if err != nil {
+		m := fmt.Sprintf("error on running chain: %v", err)
+		return errors.New(m)
+	}
+
+	// expected windows as [from, to)
+	var ws [][2]int
+	seen := 0
+	for seen = slide; seen <= n; seen += slide {
+		from := seen - k
+		if from < 0 {
+			from = 0
+		}
+		ws = append(ws, [2]int{from, seen})
+	}
+	if fresh := n - (seen - slide); fresh > 0 && k > slide-fresh {
+		from := n - (k - (slide - fresh))
+		if from < 0 {
+			from = 0
+		}
+		ws = append(ws, [2]int{from, n})
+	}
+	if len(c.recvd) != len(ws) {
+		m := fmt.Sprintf("expected %d windows, have %d", len(ws), len(c.recvd))
+		return errors.New(m)
+	}
+	for i, r := range c.recvd {
+		sum := 0
+		for j := ws[i][0]; j < ws[i][1]; j++ {
+			sum += j
+		}
+		if r.Count != ws[i][1]-ws[i][0] || r.Result.(int) != sum {
+			m := fmt.Sprintf("window %d: expected %v/%d, have %d/%v",
+				i, ws[i], sum, r.Count, r.Result)
+			return errors.New(m)
+		}
+	}
+	return nil
+}
+
+func testSlidingTimeWindowChain(n, k, j int) error {
+
+	p := &SeqProducer{makeSeq(n)}
+	c := new(ResultConsumer)
+
+	size := time.Duration(k) * time.Second
+	slide := time.Duration(j) * time.Second
+	pipe := []conduit.Conduit{NewSlidingTimeWindow(size, slide, new(SecTimestamp), new(SumAggregate))}
+
+	chn := conduit.NewChain(p, pipe, c, small)
+
+	err := chn.Run()
+	if err != nil {
+		m := fmt.Sprintf("error on running chain: %v", err)
+		return errors.New(m)
+	}
+
+	// windows start at multiples of j in (-k, n)
+	starts := 0
+	for s := -((k - 1) / j) * j; s < n; s += j {
+		if s+k > 0 {
+			starts++
+		}
+	}
+	if len(c.recvd) != starts {
+		m := fmt.Sprintf("expected %d windows, have %d", starts, len(c.recvd))
+		return errors.New(m)
+	}
+	for i, r := range c.recvd {
+		if i > 0 && r.Start.Sub(c.recvd[i-1].Start) != slide {
+			return errors.New("windows not in order")
+		}
+		s := int(r.Start.Unix())
+		if s%j != 0 {
+			m := fmt.Sprintf("window not aligned: %d", s)
+			return errors.New(m)
+		}
+		sum, cnt := 0, 0
+		for x := s; x < s+k && x < n; x++ {
+			if x >= 0 {
+				sum += x
+				cnt++
+			}
+		}
+		if r.Count != cnt || r.Result.(int) != sum {
+			m := fmt.Sprintf("window %d: expected %d/%d, have %d/%v", i, cnt, sum, r.Count, r.Result)
+			return errors.New(m)
+		}
+	}
+	return nil
+}
+
+// sequence where some numbers arrive late
+func makeLateSeq(n, delay int) []int {
+	seq := makeSeq(n)
+	for i := 0; i+delay < n; i += 7 {
+		v := seq[i]
+		copy(seq[i:], seq[i+1:i+delay+1])
+		seq[i+delay] = v
+	}
+	return seq
+}
+
+// counts items
+type CountConsumer struct {
+	n int
+}
+
+func (c *CountConsumer) Consume(src conduit.Source) error {
+	for range src {
+		c.n++
+	}
+	return nil
+}
+
+func testLateWindowChain(n, k int, pol LatePolicy) error {
+
+	p := &SeqProducer{makeLateSeq(n, 2*k)}
+	c := new(ResultConsumer)
+
+	size := time.Duration(k) * time.Second
+	w := NewTimeWindow(size, new(SecTimestamp), new(SumAggregate))
+
+	side := new(CountConsumer)
+	w.SetLateness(4*size, pol)
+
+	chn := conduit.NewChain(p, []conduit.Conduit{w}, c, small)
+	err := chn.AddSide(w, "late", side)
+	if err != nil {
+		return err
+	}
+
+	err = chn.Run()
+	if err != nil {
+		m := fmt.Sprintf("error on running chain: %v", err)
+		return errors.New(m)
+	}
+	sideCount := side.n
+
+	if w.Late() == 0 {
+		return errors.New("no late items")
+	}
+
+	// latest result per window
+	final := make(map[int64]WindowResult)
+	for _, r := range c.recvd {
+		prev, ok := final[r.Start.Unix()]
+		if ok && !r.Update {
+			return errors.New("second result is no update")
+		}
+		if !ok && r.Update && pol != LateUpdate {
+			return errors.New("unexpected update")
+		}
+		if ok && r.Count <= prev.Count {
+			return errors.New("update has no more items")
+		}
+		final[r.Start.Unix()] = r
+	}
+	total := 0
+	for _, r := range final {
+		total += r.Count
+	}
+
+	switch pol {
+	case LateDrop:
+		if w.Dropped() != w.Late() {
+			m := fmt.Sprintf("late: %d, dropped: %d", w.Late(), w.Dropped())
+			return errors.New(m)
+		}
+		if uint64(total)+w.Dropped() != uint64(n) {
+			m := fmt.Sprintf("%d in windows, %d dropped", total, w.Dropped())
+			return errors.New(m)
+		}
+	case LateUpdate:
+		if w.Dropped() != 0 || total != n {
+			m := fmt.Sprintf("%d in windows, %d dropped", total, w.Dropped())
+			return errors.New(m)
+		}
+	case LateSide:
+		if w.Dropped() != 0 || uint64(sideCount) != w.Late() || total+sideCount != n {
+			m := fmt.Sprintf("%d in windows, %d in side", total, sideCount)
+			return errors.New(m)
+		}
+	}
+	return nil
+}
+
+func testProcTimeWindowChain(n int) error {
+
+	p := &SeqProducer{makeSeq(n)}
+	c := new(ResultConsumer)
+
+	pipe := []conduit.Conduit{NewTimeWindow(time.Millisecond, nil, new(SumAggregate))}
+
+	chn := conduit.NewChain(p, pipe, c, small)
+
+	err := chn.Run()
+	if err != nil {
+		m := fmt.Sprintf("error on running chain: %v", err)
+		return errors.New(m)
+	}
+	sum, cnt := 0, 0
+	for _, r := range c.recvd {
+		sum += r.Result.(int)
+		cnt += r.Count
+	}
+	if cnt != n || sum != n*(n-1)/2 {
+		m := fmt.Sprintf("expected %d/%d, have %d/%d", n, n*(n-1)/2, cnt, sum)
+		return errors.New(m)
+	}
+	return nil
+}
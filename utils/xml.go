@@ -0,0 +1,138 @@
+package utils
+
+import (
+	"encoding/xml"
+	"io"
+
+	"github.com/toschoo/conduit"
+)
+
+// XMLReader is a Producer that decodes all elements
+// with a given name from a large XML document
+// and sends them down the chain one by one,
+// e.g. the pages of a Wikipedia dump.
+// Only one element is held in memory at a time.
+// Matching elements nested in matching elements
+// are part of the outer element.
+type XMLReader struct {
+	conduit.Cancelable
+	rd   io.Reader
+	name string
+	new  func() interface{}
+}
+
+// NewXMLReader creates a new XMLReader Producer
+// for elements with the local name element.
+// Each element is decoded into the result of newValue,
+// typically a pointer to a new struct, which is then sent
+// down the chain. If newValue is nil, the elements are
+// sent as strings containing their character data.
+func NewXMLReader(r io.Reader, element string, newValue func() interface{}) (xr *XMLReader) {
+	xr = new(XMLReader)
+	if xr != nil {
+		xr.rd = r
+		xr.name = element
+		xr.new = newValue
+	}
+	return
+}
+
+// Produce is the pre-defined method that makes XMLReader a Producer.
+func (xr *XMLReader) Produce(trg conduit.Target) error {
+	dec := xml.NewDecoder(xr.rd)
+	for !xr.Canceled() {
+		t, err := dec.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		se, ok := t.(xml.StartElement)
+		if !ok || se.Name.Local != xr.name {
+			continue
+		}
+		if xr.new == nil {
+			var s string
+			err = dec.DecodeElement(&s, &se)
+			if err != nil {
+				return err
+			}
+			trg <- s
+			continue
+		}
+		v := xr.new()
+		err = dec.DecodeElement(v, &se)
+		if err != nil {
+			return err
+		}
+		trg <- v
+	}
+	return nil
+}
+
+// XMLWriter is a Consumer that writes incoming data
+// as XML elements using xml.Encoder. The elements
+// are wrapped into an envelope, i.e. a root element
+// preceded by the XML header.
+type XMLWriter struct {
+	wt   io.Writer
+	root xml.StartElement
+	pre  string
+	ind  string
+}
+
+// NewXMLWriter creates a new XMLWriter Consumer
+// with root as envelope. If root has no name,
+// the elements are written without header and envelope.
+func NewXMLWriter(w io.Writer, root xml.StartElement) (xw *XMLWriter) {
+	xw = new(XMLWriter)
+	if xw != nil {
+		xw.wt = w
+		xw.root = root
+	}
+	return
+}
+
+// SetIndent sets the indentation as in xml.Encoder.
+func (xw *XMLWriter) SetIndent(prefix, indent string) *XMLWriter {
+	xw.pre = prefix
+	xw.ind = indent
+	return xw
+}
+
+// Consume is the pre-defined method that makes XMLWriter a Consumer.
+// Consume terminates with an error if an item cannot be encoded.
+func (xw *XMLWriter) Consume(src conduit.Source) error {
+	env := xw.root.Name.Local != ""
+	if env {
+		_, err := io.WriteString(xw.wt, xml.Header)
+		if err != nil {
+			return err
+		}
+	}
+	enc := xml.NewEncoder(xw.wt)
+	enc.Indent(xw.pre, xw.ind)
+	if env {
+		err := enc.EncodeToken(xw.root)
+		if err != nil {
+			return err
+		}
+	}
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			continue
+		}
+		err := enc.Encode(inp)
+		if err != nil {
+			return err
+		}
+	}
+	if env {
+		err := enc.EncodeToken(xw.root.End())
+		if err != nil {
+			return err
+		}
+	}
+	return enc.Flush()
+}
@@ -0,0 +1,93 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/toschoo/conduit"
+)
+
+// XML:
+// - Points are written with envelope and read back
+// - The document is well-formed
+func TestXMLChain(t *testing.T) {
+	for i := 0; i < numOfTests; i++ {
+		err := testXMLChain(i, i%2 == 0)
+		if err != nil {
+			m := fmt.Sprintf("XMLChain failed: %v", err)
+			t.Error(m)
+		}
+	}
+}
+
+// XML without newValue:
+// - Character data of matching elements are sent
+// - Invalid XML is reported
+func TestStringXMLChain(t *testing.T) {
+	c := new(AnyConsumer)
+	doc := `<a><b>1</b><c><b>2</b></c><b>3<x/></b></a>`
+	chn := conduit.NewChain(NewXMLReader(strings.NewReader(doc), "b", nil), nil, c, small)
+	err := chn.Run()
+	if err != nil {
+		t.Fatalf("StringXMLChain failed: %v", chn.Errs)
+	}
+	if fmt.Sprintf("%v", c.recvd) != "[1 2 3]" {
+		t.Errorf("StringXMLChain: unexpected values: %v", c.recvd)
+	}
+	chn = conduit.NewChain(NewXMLReader(strings.NewReader("<a><b></a>"), "b", nil), nil, c, small)
+	if chn.Run() == nil {
+		t.Errorf("StringXMLChain: invalid XML not reported")
+	}
+}
+
+func testXMLChain(n int, indent bool) error {
+
+	points := makePoints(n)
+
+	var buf bytes.Buffer
+	root := xml.StartElement{Name: xml.Name{Local: "points"}}
+	w := NewXMLWriter(&buf, root)
+	if indent {
+		w.SetIndent("", "  ")
+	}
+	chn := conduit.NewChain(&AnyProducer{points}, nil, w, small)
+	err := chn.Run()
+	if err != nil {
+		m := fmt.Sprintf("error on writing: %v", chn.Errs)
+		return errors.New(m)
+	}
+	if !strings.HasPrefix(buf.String(), xml.Header+"<points>") {
+		return errors.New("envelope missing")
+	}
+
+	var all struct {
+		Points []Point `xml:"Point"`
+	}
+	err = xml.Unmarshal(buf.Bytes(), &all)
+	if err != nil || len(all.Points) != n {
+		m := fmt.Sprintf("invalid document: %v", err)
+		return errors.New(m)
+	}
+
+	c := new(AnyConsumer)
+	chn = conduit.NewChain(NewXMLReader(&buf, "Point", newPoint), nil, c, small)
+	err = chn.Run()
+	if err != nil {
+		m := fmt.Sprintf("error on reading: %v", chn.Errs)
+		return errors.New(m)
+	}
+	if len(c.recvd) != n {
+		m := fmt.Sprintf("expected %d items, have %d", n, len(c.recvd))
+		return errors.New(m)
+	}
+	for i, v := range c.recvd {
+		if *v.(*Point) != *points[i].(*Point) {
+			return errors.New("Received values differ from original!")
+		}
+	}
+	return nil
+}
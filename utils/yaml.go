@@ -0,0 +1,156 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/toschoo/conduit"
+)
+
+// YAMLReader is a Producer that splits a multi-document
+// YAML stream into documents at "---" separators
+// (and "..." end markers), decodes each document
+// and sends it down the chain, e.g. Kubernetes manifests.
+// Documents consisting only of whitespace are skipped.
+type YAMLReader struct {
+	conduit.Cancelable
+	rd        io.Reader
+	unmarshal UnmarshalFunc
+	new       func() interface{}
+}
+
+// NewYAMLReader creates a new YAMLReader Producer.
+// Documents are decoded with unmarshal (e.g. yaml.Unmarshal)
+// into the result of newValue or, if newValue is nil,
+// into interface{}. If unmarshal is nil,
+// the documents are sent undecoded as []byte.
+func NewYAMLReader(r io.Reader, unmarshal UnmarshalFunc, newValue func() interface{}) (yr *YAMLReader) {
+	yr = new(YAMLReader)
+	if yr != nil {
+		yr.rd = r
+		yr.unmarshal = unmarshal
+		yr.new = newValue
+	}
+	return
+}
+
+// Sends one document
+func (yr *YAMLReader) send(doc []byte, trg conduit.Target) error {
+	if len(bytes.TrimSpace(doc)) == 0 {
+		return nil
+	}
+	if yr.unmarshal == nil {
+		trg <- doc
+		return nil
+	}
+	v, err := unmarshalNew(yr.unmarshal, doc, yr.new)
+	if err != nil {
+		return err
+	}
+	trg <- v
+	return nil
+}
+
+// Produce is the pre-defined method that makes YAMLReader a Producer.
+func (yr *YAMLReader) Produce(trg conduit.Target) error {
+	br := bufio.NewReader(yr.rd)
+	var doc []byte
+	for !yr.Canceled() {
+		line, err := br.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		eof := err == io.EOF
+		if isDocStart(line) || isDocEnd(line) {
+			err = yr.send(doc, trg)
+			if err != nil {
+				return err
+			}
+			doc = nil
+			if isDocStart(line) {
+				// "--- value" starts a document with content
+				doc = append(doc, bytes.TrimLeft(line[3:], " \t\r\n")...)
+			}
+		} else {
+			doc = append(doc, line...)
+		}
+		if eof {
+			return yr.send(doc, trg)
+		}
+	}
+	return nil
+}
+
+// Tells whether the line is a document separator
+func isDocStart(line []byte) bool {
+	return bytes.HasPrefix(line, []byte("---")) &&
+		(len(line) == 3 || line[3] == ' ' || line[3] == '\t' || line[3] == '\n' || line[3] == '\r')
+}
+
+// Tells whether the line is a document end marker
+func isDocEnd(line []byte) bool {
+	return string(bytes.TrimRight(line, " \t\r\n")) == "..."
+}
+
+// YAMLWriter is a Consumer that writes incoming data
+// as YAML documents separated by "---".
+type YAMLWriter struct {
+	wt      io.Writer
+	marshal MarshalFunc
+}
+
+// NewYAMLWriter creates a new YAMLWriter Consumer
+// encoding items with marshal (e.g. yaml.Marshal).
+// If marshal is nil, items must be []byte or string
+// holding YAML documents, which are written as they are.
+func NewYAMLWriter(w io.Writer, marshal MarshalFunc) (yw *YAMLWriter) {
+	yw = new(YAMLWriter)
+	if yw != nil {
+		yw.wt = w
+		yw.marshal = marshal
+	}
+	return
+}
+
+// Consume is the pre-defined method that makes YAMLWriter a Consumer.
+// Consume terminates with an error if an item cannot be encoded.
+func (yw *YAMLWriter) Consume(src conduit.Source) error {
+	bw := bufio.NewWriter(yw.wt)
+	for inp := range src {
+		if conduit.IsBarrier(inp) {
+			err := bw.Flush()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		doc, err := encodeDoc(yw.marshal, inp)
+		if err != nil {
+			return err
+		}
+		bw.WriteString("---\n")
+		bw.Write(doc)
+		if len(doc) > 0 && doc[len(doc)-1] != '\n' {
+			bw.WriteByte('\n')
+		}
+	}
+	return bw.Flush()
+}
+
+// Encodes an item with marshal; without marshal,
+// []byte and string are taken as they are.
+func encodeDoc(marshal MarshalFunc, inp interface{}) ([]byte, error) {
+	if marshal != nil {
+		return marshal(inp)
+	}
+	switch v := inp.(type) {
+	case []byte:
+		return v, nil
+	case string:
+		return []byte(v), nil
+	}
+	return nil, errors.New(fmt.Sprintf("cannot write %T without marshaler", inp))
+}
@@ -0,0 +1,155 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/toschoo/conduit"
+)
+
+// a tiny codec for flat YAML mappings of strings
+func flatMarshal(v interface{}) ([]byte, error) {
+	m, ok := v.(map[string]string)
+	if !ok {
+		return nil, errors.New("not a flat map")
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var buf bytes.Buffer
+	for _, k := range keys {
+		fmt.Fprintf(&buf, "%s: %s\n", k, m[k])
+	}
+	return buf.Bytes(), nil
+}
+
+func flatUnmarshal(data []byte, v interface{}) error {
+	m := make(map[string]string)
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			return errors.New("invalid line: " + line)
+		}
+		m[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	*v.(*map[string]string) = m
+	return nil
+}
+
+func newFlat() interface{} {
+	return new(map[string]string)
+}
+
+// YAML:
+// - Documents are written and read back without errors
+// - The documents read equal the documents written
+func TestYAMLChain(t *testing.T) {
+	for i := 0; i < numOfTests; i++ {
+		err := testYAMLChain(i)
+		if err != nil {
+			m := fmt.Sprintf("YAMLChain failed: %v", err)
+			t.Error(m)
+		}
+	}
+}
+
+// YAML documents:
+// - Separators, end markers and empty documents are handled
+// - Without codec, documents are sent as they are
+func TestYAMLDocuments(t *testing.T) {
+	stream := "a: 1\n---\n\n--- # second\nb: 2\n...\n---\nc: 3"
+	c := new(AnyConsumer)
+	chn := conduit.NewChain(NewYAMLReader(strings.NewReader(stream), nil, nil), nil, c, small)
+	err := chn.Run()
+	if err != nil {
+		t.Fatalf("YAMLDocuments failed: %v", chn.Errs)
+	}
+	expected := []string{"a: 1\n", "# second\nb: 2\n", "c: 3"}
+	if len(c.recvd) != len(expected) {
+		t.Fatalf("YAMLDocuments: expected %d documents, have %d", len(expected), len(c.recvd))
+	}
+	for i, doc := range c.recvd {
+		if string(doc.([]byte)) != expected[i] {
+			t.Errorf("YAMLDocuments: unexpected document '%s'", doc)
+		}
+	}
+}
+
+func testYAMLChain(n int) error {
+
+	docs := make([]interface{}, n)
+	for i := range docs {
+		docs[i] = map[string]string{"id": fmt.Sprintf("%d", i), "kind": "Point"}
+	}
+
+	var buf bytes.Buffer
+	chn := conduit.NewChain(&AnyProducer{docs}, nil, NewYAMLWriter(&buf, flatMarshal), small)
+	err := chn.Run()
+	if err != nil {
+		m := fmt.Sprintf("error on writing: %v", chn.Errs)
+		return errors.New(m)
+	}
+
+	c := new(AnyConsumer)
+	p := NewYAMLReader(&buf, flatUnmarshal, newFlat)
+	chn = conduit.NewChain(p, nil, c, small)
+	err = chn.Run()
+	if err != nil {
+		m := fmt.Sprintf("error on reading: %v", chn.Errs)
+		return errors.New(m)
+	}
+	if len(c.recvd) != n {
+		m := fmt.Sprintf("expected %d items, have %d", n, len(c.recvd))
+		return errors.New(m)
+	}
+	for i, v := range c.recvd {
+		if fmt.Sprintf("%v", *v.(*map[string]string)) != fmt.Sprintf("%v", docs[i]) {
+			return errors.New("Received values differ from original!")
+		}
+	}
+	return nil
+}
+
+// YAML barrier:
+// - Documents preceding a barrier are flushed at the barrier
+func TestYAMLBarrier(t *testing.T) {
+	w := new(chunkWriter)
+	err := consumeWithBarrier(NewYAMLWriter(w, flatMarshal),
+		map[string]string{"id": "1"}, map[string]string{"id": "2"})
+	if err != nil {
+		t.Fatalf("YAMLBarrier failed: %v", err)
+	}
+	if len(w.chunks) != 2 || w.chunks[0] != "---\nid: 1\n" {
+		t.Errorf("YAMLBarrier: unexpected writes %q", w.chunks)
+	}
+}
+
+// records every single write
+type chunkWriter struct {
+	chunks []string
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	w.chunks = append(w.chunks, string(p))
+	return len(p), nil
+}
+
+// passes first, a barrier and second to the consumer
+func consumeWithBarrier(c conduit.Consumer, first, second interface{}) error {
+	src := make(chan interface{}, 3)
+	src <- first
+	src <- &conduit.Barrier{}
+	src <- second
+	close(src)
+	return c.Consume(src)
+}
@@ -0,0 +1,97 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/toschoo/conduit"
+)
+
+// ZipPair is a pair of items produced by Zip.
+type ZipPair struct {
+	Left  interface{}
+	Right interface{}
+}
+
+// Zip is a Producer that pairs the i-th items
+// of two producers and sends them down the chain as ZipPair.
+// Zip ends when the shorter stream ends;
+// the other producer is canceled, if it is a conduit.Canceler.
+// In strict mode, Zip reports an error if the streams
+// have different lengths.
+type Zip struct {
+	left   conduit.Producer
+	right  conduit.Producer
+	strict bool
+	sz     int
+}
+
+// NewZip creates a new Zip Producer.
+func NewZip(left, right conduit.Producer, strict bool) (z *Zip) {
+	if left == nil || right == nil {
+		return nil
+	}
+	z = new(Zip)
+	if z != nil {
+		z.left = left
+		z.right = right
+		z.strict = strict
+		z.sz = 10
+	}
+	return
+}
+
+// Cancel is the pre-defined method that makes Zip
+// a conduit.Canceler; it cancels both producers.
+func (z *Zip) Cancel() {
+	cancelAll([]conduit.Producer{z.left, z.right})
+}
+
+// Produce is the pre-defined method that makes Zip a Producer.
+func (z *Zip) Produce(trg conduit.Target) error {
+	conduit.ResetCancel(z.left)
+	conduit.ResetCancel(z.right)
+	l, lerr := startProducer(z.left, z.sz)
+	r, rerr := startProducer(z.right, z.sz)
+
+	n := 0
+	var mismatch error
+	for {
+		a, lok := <-l
+		if !lok {
+			if !z.strict {
+				break
+			}
+			if _, rok := <-r; rok {
+				mismatch = errors.New(fmt.Sprintf("left stream ended after %d items", n))
+			}
+			break
+		}
+		b, rok := <-r
+		if !rok {
+			mismatch = errors.New(fmt.Sprintf("right stream ended after %d items", n))
+			break
+		}
+		trg <- ZipPair{a, b}
+		n++
+	}
+
+	z.Cancel()
+	go drain(l)
+	go drain(r)
+
+	err := <-lerr
+	if e := <-rerr; err == nil {
+		err = e
+	}
+	if err == nil && z.strict {
+		err = mismatch
+	}
+	return err
+}
+
+// drain discards the data left in src
+func drain(src <-chan interface{}) {
+	for range src {
+	}
+}
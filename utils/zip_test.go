@@ -0,0 +1,101 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/toschoo/conduit"
+)
+
+type ZipConsumer struct {
+	recvd []ZipPair
+}
+
+func (c *ZipConsumer) Consume(src conduit.Source) error {
+	for v := range src {
+		c.recvd = append(c.recvd, v.(ZipPair))
+	}
+	return nil
+}
+
+// Sends n items and then stalls until it is canceled
+type StallProducer struct {
+	conduit.Cancelable
+	n int
+}
+
+func (p *StallProducer) Produce(trg conduit.Target) error {
+	for i := 0; i < p.n; i++ {
+		trg <- i
+	}
+	for !p.Canceled() {
+		time.Sleep(time.Millisecond)
+	}
+	return nil
+}
+
+// Zip:
+// - It is processed without errors (unless strict and lengths differ)
+// - The i-th items are paired
+// - Zip ends with the shorter stream, even if the other is infinite
+// - In non-strict mode, Zip does not wait for the right stream
+//   after the left stream ended
+func TestZipChain(t *testing.T) {
+	for i := 0; i < numOfTests; i++ {
+		for _, strict := range []bool{false, true} {
+			err := testZipChain(numOfData, i, strict)
+			if err != nil {
+				m := fmt.Sprintf("ZipChain failed: %v", err)
+				t.Error(m)
+			}
+		}
+	}
+	p := NewZip(NewGeneric(new(Naturals)), &SeqProducer{makeSeq(numOfData)}, false)
+	c := new(ZipConsumer)
+	chn := conduit.NewChain(p, nil, c, small)
+	err := chn.Run()
+	if err != nil || len(c.recvd) != numOfData {
+		t.Errorf("ZipChain with infinite stream failed: %v, %d items", chn.Errs, len(c.recvd))
+	}
+	p = NewZip(&SeqProducer{makeSeq(numOfData)}, &StallProducer{n: numOfData}, false)
+	c = new(ZipConsumer)
+	chn = conduit.NewChain(p, nil, c, small)
+	err = chn.Run()
+	if err != nil || len(c.recvd) != numOfData {
+		t.Errorf("ZipChain with stalling stream failed: %v, %d items", chn.Errs, len(c.recvd))
+	}
+}
+
+func testZipChain(n, m int, strict bool) error {
+
+	p := NewZip(&SeqProducer{makeSeq(n)}, &SeqProducer{makeSeq(m)}, strict)
+	c := new(ZipConsumer)
+
+	chn := conduit.NewChain(p, nil, c, small)
+
+	err := chn.Run()
+	if strict && n != m {
+		if err == nil {
+			return errors.New("length mismatch not reported")
+		}
+	} else if err != nil {
+		m := fmt.Sprintf("error on running chain: %v", err)
+		return errors.New(m)
+	}
+	k := n
+	if m < k {
+		k = m
+	}
+	if len(c.recvd) != k {
+		m := fmt.Sprintf("expected %d pairs, have %d", k, len(c.recvd))
+		return errors.New(m)
+	}
+	for i, x := range c.recvd {
+		if x.Left != i || x.Right != i {
+			return errors.New("Received values differ from original!")
+		}
+	}
+	return nil
+}